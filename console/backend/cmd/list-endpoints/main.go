@@ -4,12 +4,16 @@
 // (docs/grpc-transport-design.md §0.5): the relay calls the qubesair.RemoteEndpoints
 // qrexec service, which runs this, and writes each line into its own QubesDB so
 // the qubesair.GrpcProxy handler can resolve a RemoteVM's address without the
-// console being in the per-call path. The relay refreshes on a short timer, so a
-// newly provisioned qube becomes reachable within one interval.
+// console being in the per-call path.
 //
 // Output is one "<name> <ip>:<port>" per line. Only names and addresses cross
 // this channel — never credentials — so unlike issue-relay-cert it needs no
 // encryption key, only the database.
+//
+// With -watch it instead follows the console's endpoint feed
+// (GET /api/v1/endpoints/watch) and prints each change as it happens; that is
+// what qubesair.WatchEndpoints runs, so a relay learns of a new qube or a
+// changed address within moments instead of at its next poll. See watch.go.
 package main
 
 import (
@@ -17,6 +21,7 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"os"
 	"strings"
 	"time"
 
@@ -31,8 +36,19 @@ func main() {
 
 	dsn := flag.String("db", "", "console sqlite DSN")
 	port := flag.String("port", "8443", "agent mTLS port")
+	watchMode := flag.Bool("watch", false, "follow the console's endpoint feed instead of reading the database once")
+	api := flag.String("api", "http://127.0.0.1:8080", "console API base URL, for -watch")
 	flag.Parse()
 
+	if *watchMode {
+		// The token is the console's API token, read from the environment so
+		// it never shows on a command line.
+		if err := watch(context.Background(), *api, os.Getenv("QUBES_AIR_API_TOKEN"), os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
 	defer cancel()
 
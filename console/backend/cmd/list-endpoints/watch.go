@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/slchris/qubes-air/console/internal/transport"
+)
+
+// watchIdle is how long the feed may stay silent before the stream is taken
+// for dead. The console sends a ping every 30s, so this is three missed ones:
+// a qrexec forward or a console that hung without closing the connection.
+const watchIdle = 90 * time.Second
+
+// watchEvent is one event of GET /api/v1/endpoints/watch.
+type watchEvent struct {
+	Type      string `json:"type"`
+	Version   uint64 `json:"version"`
+	Name      string `json:"name"`
+	Address   string `json:"address"`
+	Endpoints []struct {
+		Name    string `json:"name"`
+		Address string `json:"address"`
+	} `json:"endpoints"`
+}
+
+// watch follows the console's endpoint feed and writes each event to out as
+// lines the relay's shell can read without a JSON parser:
+//
+//	reset <version>                   a full table follows; forget the old one
+//	set <version> <name> <ip:port>    name is at this address
+//	synced <version>                  the full table is complete
+//	del <version> <name>              name is gone
+//	ping <version>                    nothing changed; the stream is alive
+//
+// Every connection begins with reset … synced, so whoever reads this starts
+// over from a full table each time it runs; that is the resync. watch returns
+// when the stream ends — nil if the console closed it, an error if it broke
+// or went silent — and the caller reconnects by running it again.
+func watch(ctx context.Context, api, token string, out io.Writer) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(api, "/")+"/api/v1/endpoints/watch", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("watch: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var silent atomic.Bool
+	idle := time.AfterFunc(watchIdle, func() { silent.Store(true); cancel() })
+	defer idle.Stop()
+
+	sc := bufio.NewScanner(resp.Body)
+	// A snapshot is one event holding the whole table.
+	sc.Buffer(make([]byte, 64<<10), 4<<20)
+	for sc.Scan() {
+		idle.Reset(watchIdle)
+		data, ok := strings.CutPrefix(sc.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var ev watchEvent
+		if err := json.Unmarshal([]byte(data), &ev); err != nil {
+			return fmt.Errorf("watch: bad event: %w", err)
+		}
+		// One write per event, so a reader never sees half a snapshot.
+		if _, err := io.WriteString(out, renderEvent(ev)); err != nil {
+			return err
+		}
+	}
+	if silent.Load() {
+		return fmt.Errorf("watch: no event for %s", watchIdle)
+	}
+	if err := sc.Err(); err != nil && !errors.Is(err, context.Canceled) {
+		return fmt.Errorf("watch: %w", err)
+	}
+	return nil
+}
+
+// renderEvent turns ev into its lines. An entry whose name or address is not
+// safe to hand to the relay's shell is dropped with a log line; an event of an
+// unknown type renders as nothing, so a newer console can add one.
+func renderEvent(ev watchEvent) string {
+	var b strings.Builder
+	switch ev.Type {
+	case "snapshot":
+		fmt.Fprintf(&b, "reset %d\n", ev.Version)
+		for _, e := range ev.Endpoints {
+			if validEndpoint(e.Name, e.Address) {
+				fmt.Fprintf(&b, "set %d %s %s\n", ev.Version, e.Name, e.Address)
+			}
+		}
+		fmt.Fprintf(&b, "synced %d\n", ev.Version)
+	case "set":
+		if validEndpoint(ev.Name, ev.Address) {
+			fmt.Fprintf(&b, "set %d %s %s\n", ev.Version, ev.Name, ev.Address)
+		}
+	case "delete":
+		if validEndpoint(ev.Name, "") {
+			fmt.Fprintf(&b, "del %d %s\n", ev.Version, ev.Name)
+		}
+	case "ping":
+		fmt.Fprintf(&b, "ping %d\n", ev.Version)
+	}
+	return b.String()
+}
+
+// validEndpoint checks a name (and, unless empty, an address) before it goes
+// out as a QubesDB key and value.
+func validEndpoint(name, addr string) bool {
+	ok := transport.ValidName(name)
+	if ok && addr != "" {
+		_, _, err := net.SplitHostPort(addr)
+		ok = err == nil && !strings.ContainsAny(addr, " \t\n")
+	}
+	if !ok {
+		log.Printf("skipping endpoint %q %q", name, addr)
+	}
+	return ok
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWatchRendersLines(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/endpoints/watch" || r.Header.Get("Authorization") != "Bearer tok" {
+			http.Error(w, "no", http.StatusUnauthorized)
+			return
+		}
+		for _, ev := range []string{
+			`{"type":"snapshot","version":7,"endpoints":[{"name":"remote-a","address":"10.0.0.1:8443"},{"name":"bad;name","address":"10.0.0.2:8443"}]}`,
+			`{"type":"set","version":8,"name":"remote-b","address":"10.0.0.2:8443"}`,
+			`{"type":"set","version":9,"name":"remote-c","address":"10.0.0.3:8443 rm -rf"}`,
+			`{"type":"delete","version":10,"name":"remote-a"}`,
+			`{"type":"ping","version":10}`,
+			`{"type":"something-newer","version":11}`,
+		} {
+			fmt.Fprintf(w, "data: %s\n\n", ev)
+		}
+	}))
+	defer srv.Close()
+
+	var out strings.Builder
+	if err := watch(context.Background(), srv.URL+"/", "tok", &out); err != nil {
+		t.Fatal(err)
+	}
+	want := "reset 7\n" +
+		"set 7 remote-a 10.0.0.1:8443\n" +
+		"synced 7\n" +
+		"set 8 remote-b 10.0.0.2:8443\n" +
+		"del 10 remote-a\n" +
+		"ping 10\n"
+	if out.String() != want {
+		t.Errorf("watch printed\n%s\nwant\n%s", out.String(), want)
+	}
+
+	if err := watch(context.Background(), srv.URL, "wrong", &out); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("a refused watch = %v, want the status", err)
+	}
+}
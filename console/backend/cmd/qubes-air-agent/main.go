@@ -9,12 +9,15 @@
 // image but packaged by packaging/agent-deb/ and installed at first boot, which
 // is also where the systemd unit now lives.
 //
-// Connection direction: this process LISTENS and the local relay dials in,
-// matching the existing transport (internal/transport/grpc: client.go is the
-// local relay, server.go the remote). Note that this does NOT give the remote
-// zero inbound — a claim terraform/providers/proxmox/zero-inbound-firewall.md
-// makes while also stating the local side dials out, which cannot both be true.
-// Reversing it is a transport change, not an agent change.
+// Connection direction: by default this process LISTENS and the local relay
+// dials in (internal/transport/grpc: client.go is the local relay, server.go the
+// remote). That does NOT give the remote zero inbound, which is what
+// terraform/providers/proxmox/zero-inbound-firewall.md asks for. With
+// -dial-out the agent opens the connection to the relay instead and needs no
+// inbound port at all; once the tunnel is up nothing else differs, because the
+// relay still drives it. Given -dial-out, the agent listens only if -listen is
+// ALSO given explicitly — the default listen address would quietly reopen the
+// port dial-out exists to close.
 //
 // Security posture: this host is UNTRUSTED. The service allowlist here guards
 // against misconfiguration, not against an attacker who has the box — whoever
@@ -24,8 +27,11 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/signal"
@@ -34,6 +40,13 @@ import (
 	"time"
 
 	"github.com/slchris/qubes-air/console/internal/agent"
+	"github.com/slchris/qubes-air/console/internal/agent/agentconfig"
+	"github.com/slchris/qubes-air/console/internal/agent/privhelper"
+	"github.com/slchris/qubes-air/console/internal/agentstatus"
+	"github.com/slchris/qubes-air/console/internal/agentupdate"
+	"github.com/slchris/qubes-air/console/internal/deadman"
+	"github.com/slchris/qubes-air/console/internal/shell"
+	"github.com/slchris/qubes-air/console/internal/transfer"
 	transportgrpc "github.com/slchris/qubes-air/console/internal/transport/grpc"
 )
 
@@ -41,8 +54,9 @@ import (
 //
 //	go build -ldflags "-X main.buildVersion=$(git describe --tags --always)"
 //
-// It is reported in the handshake for observability and never participates in a
-// compatibility decision — see internal/transport/grpc/frames.go.
+// It is reported in the handshake, where it never participates in a protocol
+// compatibility decision (see internal/transport/grpc/frames.go) but is what
+// the console's agent version inventory and minimum version are judged on.
 var buildVersion = "dev"
 
 // defaultAllowedServices is the starting allowlist.
@@ -51,20 +65,24 @@ var buildVersion = "dev"
 // answers "pong <remote_name> <unix_ts>". Deliberately minimal: a probe should
 // answer "is this link up", not "is this host healthy", or one failure becomes
 // several indistinguishable ones.
-// qubesair.Status is deliberately NOT here. It was allowed before anything
-// implemented it, so every agent logged a warning on every start that the
-// service is allowed but missing. A warning that is always present is one
-// operators learn to scroll past, which costs more than the missing service.
-// Add it back in the same change that ships /etc/qubes-rpc/qubesair.Status.
+// qubesair.Status is the deeper question, asked separately (internal/
+// agentstatus). It was once allowed before anything implemented it, and every
+// agent warned on every start that it was missing; it is back now that it is
+// a builtin, which cannot be missing.
 var defaultAllowedServices = []string{
 	"qubesair.Ping",
+	"qubesair.Status",
 }
 
+// defaultForwardsFile is where the packaged agent looks for its forward policy.
+const defaultForwardsFile = "/etc/qubes-air/forwards.yaml"
+
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
 	var (
 		listen     = flag.String("listen", "0.0.0.0:8443", "host:port to listen on")
+		dialOut    = flag.String("dial-out", "", "relay attach endpoint (host:port) to dial instead of listening")
 		remoteName = flag.String("remote-name", "", "this remote's name (aligns with RemoteVM remote_name)")
 		serviceDir = flag.String("service-dir", agent.DefaultServiceDir, "directory holding qrexec service implementations")
 		allowedCSV = flag.String("allow", strings.Join(defaultAllowedServices, ","), "comma-separated services this agent may run")
@@ -73,6 +91,12 @@ func main() {
 		keyFile    = flag.String("key", "", "PEM server private key (required)")
 		tokenFile  = flag.String("bootstrap-token", "/etc/qubes-air/bootstrap-token",
 			"path to the one-shot bootstrap token; consulted only when no identity is installed yet")
+		forwardsFile = flag.String("forwards", defaultForwardsFile,
+			"YAML forward policy for qubesair.StreamTCP; absent means the loopback GUI ranges only")
+		configFile = flag.String("config", agentconfig.DefaultPath,
+			"YAML agent config (services, forwards, logging); when it exists, -allow, -service-dir and -forwards are ignored")
+		helperSocket = flag.String("helper-socket", privhelper.DefaultSocket,
+			"privileged helper socket, used by qubesair.Transfer, qubesair.Shell, qubesair.Status, qubesair.LockData and the dead man's switch")
 		showVersion = flag.Bool("version", false, "print version and exit")
 	)
 	flag.Parse()
@@ -81,6 +105,11 @@ func main() {
 		fmt.Printf("qubes-air-agent %s\n", buildVersion)
 		return
 	}
+	// The handshake reports the transport package's variable, which the
+	// package build never stamped: every agent told the console it was "dev".
+	transportgrpc.BuildVersion = buildVersion
+
+	listening := *dialOut == "" || flagGiven("listen")
 
 	if *remoteName == "" {
 		// Fall back to the hostname rather than refusing: a remote that has not
@@ -110,18 +139,25 @@ func main() {
 		log.Fatalf("TLS identity: %v", err)
 	}
 
-	// An empty allowlist is treated as allow-all by the invoker (len==0 skips the
-	// check), so refuse to start with one rather than silently exposing every
-	// service in ServiceDir. A locked-down agent sets --allow explicitly.
-	allowed := splitCSV(*allowedCSV)
-	if len(allowed) == 0 {
-		log.Fatal("--allow is empty: refusing to start (an empty allowlist would allow every service)")
+	inv := agent.NewLocalInvoker(*remoteName, nil)
+	cfg, cfgPath := loadConfig(*configFile, *serviceDir, *allowedCSV, *forwardsFile)
+	configs, err := agentconfig.NewManager(cfgPath, cfg, inv)
+	if err != nil {
+		log.Fatalf("agent config: %v", err)
+	}
+	// Registered before bootstrap and renewal so that a config naming one of
+	// their services fails here, loudly, rather than being shadowed.
+	if err := configs.RegisterBuiltins(inv); err != nil {
+		log.Fatalf("register config services: %v", err)
 	}
-
-	inv := agent.NewLocalInvoker(*remoteName, allowed)
-	inv.ServiceDir = *serviceDir
 
 	bootstrap := armBootstrapIfPending(identity, inv, *remoteName, *certFile, *tokenFile)
+	if bootstrap != nil && !listening {
+		// Bootstrap is the console dialing IN with the token; an agent that
+		// only dials out has no certificate to present yet and no port for the
+		// console to reach. Listen for the first boot, dial out afterwards.
+		log.Fatal("no identity installed and -dial-out without -listen: bootstrap needs a listener")
+	}
 
 	// Certificate renewal. Without it the only way to replace an expiring
 	// certificate is to rebuild the VM, because cloud-init delivers user-data
@@ -134,11 +170,67 @@ func main() {
 		log.Fatalf("register renewal services: %v", err)
 	}
 
+	// File transfer. A builtin rather than a script because a chunked,
+	// resumable push is many calls that share staged state, and that state —
+	// like every path it touches — belongs to the helper, which owns the file
+	// prefixes. Gated, unlike the builtins above: an agent trimmed to
+	// qubesair.Ping must not accept writes because a builtin exists.
+	helper := &privhelper.Client{Socket: *helperSocket}
+	if err := inv.RegisterGatedBuiltin(transfer.Service, helper.Transfer); err != nil {
+		log.Fatalf("register transfer service: %v", err)
+	}
+	// Agent self-update: the helper checks the package against the key the
+	// remote pinned and installs it as root; the agent only carries the steps.
+	if err := inv.RegisterGatedBuiltin(agentupdate.Service, helper.Update); err != nil {
+		log.Fatalf("register update service: %v", err)
+	}
+	// Closing the data disk. Gated: a lock refused by the allowlist is one
+	// the console reports, not one an agent grants because nothing asked it
+	// to refuse.
+	if err := inv.RegisterGatedBuiltin(privhelper.LockDataService, helper.LockData); err != nil {
+		log.Fatalf("register lock-data service: %v", err)
+	}
+	// The dead man's switch: off unless agent.yaml arms it, and then it locks
+	// the data disk when the console goes quiet or says this certificate is
+	// revoked. Not gated: an agent armed in its config but trimmed to
+	// qubesair.Ping would otherwise never hear the revocation notice it was
+	// armed for. It sees every call as the server's CallGate below.
+	deadMan := deadman.New(func() deadman.Policy { return configs.Current().DeadManPolicy() }, helper.CloseData)
+	if err := inv.RegisterBuiltin(deadman.Service, deadMan.Builtin); err != nil {
+		log.Fatalf("register dead man's switch: %v", err)
+	}
+	// The status report. Gated like the rest: an agent trimmed to
+	// qubesair.Ping says nothing about its host it was not allowed to. The
+	// units and disks are read per report, so a reload changes the next one.
+	status := agentstatus.NewCollector(time.Now(),
+		func() []string { return configs.Current().StatusUnits() },
+		func() []string { return configs.Current().StatusDisks() },
+		helper.DataStatus).WithDeadMan(deadMan.State)
+	if err := inv.RegisterGatedBuiltin(agentstatus.Service, status.Builtin); err != nil {
+		log.Fatalf("register status service: %v", err)
+	}
+	// The interactive terminal: a stream spliced to the helper, which owns the
+	// pseudo-terminal and the login command. The agent reads none of it.
+	if err := inv.RegisterStreamBuiltin(shell.Service, func(ctx context.Context, _ string) (io.ReadWriteCloser, error) {
+		return helper.Shell(ctx)
+	}); err != nil {
+		log.Fatalf("register shell service: %v", err)
+	}
+
 	log.Printf("qubes-air-agent %s starting", buildVersion)
 	log.Printf("  remote name : %s", *remoteName)
-	log.Printf("  listen      : %s", *listen)
-	log.Printf("  service dir : %s", inv.ServiceDir)
-	log.Printf("  allowed     : %s", *allowedCSV)
+	if listening {
+		log.Printf("  listen      : %s", *listen)
+	}
+	if *dialOut != "" {
+		log.Printf("  dial out    : %s", *dialOut)
+	}
+	log.Printf("  config      : %s", describeSource(cfg))
+	log.Printf("  service dir : %s", cfg.Policy.ServiceDir)
+	log.Printf("  allowed     : %s", strings.Join(cfg.Policy.Names(), ","))
+	if pol := cfg.DeadManPolicy(); pol.Enabled() {
+		log.Printf("  dead man    : silence %s, on revocation %v", pol.Silence, pol.OnRevocation)
+	}
 	if leaf, err := identity.Leaf(); err == nil {
 		// Say which identity is actually loaded and when it runs out. A fleet
 		// that stopped renewing has to be visible long before the certificates
@@ -148,7 +240,10 @@ func main() {
 	} else {
 		log.Printf("  identity    : none installed; bootstrap pending")
 	}
-	warnMissingServices(inv, inv.ServiceDir, splitCSV(*allowedCSV))
+	for _, f := range cfg.Forwards.Forwards {
+		log.Printf("  forward     : %s", describeForward(f))
+	}
+	warnMissingServices(inv, cfg.Policy.ServiceDir, cfg.Policy.Names())
 
 	// In bootstrap mode the certificate source falls back to the placeholder
 	// until Install succeeds; afterwards, and in every ordinary start, it is
@@ -165,6 +260,12 @@ func main() {
 		// next connection instead of the next restart — and without dropping
 		// the tunnels that are already up.
 		CertSource: certSource,
+		// Read per stream request, so a reload changes what the next stream
+		// may reach without touching the ones already spliced.
+		ForwardSource: configs,
+		// Every call passes the dead man's switch: the console's are its
+		// check-ins, and a tripped switch turns away unlocks from the rest.
+		CallGate: deadMan,
 		// No CertRegistry here: the registry lives with the issuer, on the
 		// trusted side. This agent verifies that the peer's certificate chains
 		// to the CA; deciding whether a given relay is still permitted is not
@@ -174,16 +275,74 @@ func main() {
 
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
+	go reloadOnHangup(ctx, configs)
+	go deadMan.Run(ctx)
 
-	if err := srv.Serve(ctx); err != nil {
+	if err := run(ctx, srv, listening, *dialOut, identity); err != nil {
 		// gocritic flags the skipped `defer stop()`. Accepted: stop() only
 		// detaches the signal handler, and the process is terminating anyway.
 		//nolint:gocritic // exitAfterDefer: the deferred work is moot at exit
 		log.Fatalf("serve: %v", err)
 	}
+	if st := srv.CompressionStats(); st.FramesCompressed+st.FramesDecompressed > 0 {
+		log.Printf("compression: %d frames sent compressed, %d received, %d bytes kept off the wire",
+			st.FramesCompressed, st.FramesDecompressed, st.BytesSaved())
+	}
 	log.Printf("qubes-air-agent stopped")
 }
 
+// run serves the tunnel in whichever directions were asked for until ctx is
+// canceled. If one direction fails the other is stopped too: an agent that is
+// half up looks healthy to systemd while being unreachable the way it was
+// configured to be reached.
+func run(ctx context.Context, srv *transportgrpc.Server, listening bool, dialOut string, identity *agent.Identity) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errs := make(chan error, 2)
+	n := 0
+	if listening {
+		n++
+		go func() { errs <- srv.Serve(ctx) }()
+	}
+	if dialOut != "" {
+		n++
+		go func() {
+			errs <- srv.DialOut(ctx, transportgrpc.DialOutConfig{
+				Endpoint: dialOut,
+				// Resolved per connection: until bootstrap installs an
+				// identity there is nothing to present, and the attempt is
+				// retried with backoff rather than made with no certificate.
+				TLSProvider: func() (*tls.Config, error) {
+					if !identity.HasCertificate() {
+						return nil, agent.ErrNoIdentity
+					}
+					return identity.ClientTLSConfig(), nil
+				},
+			})
+		}()
+	}
+	var first error
+	for range n {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+			cancel()
+		}
+	}
+	return first
+}
+
+// flagGiven reports whether the named flag was set on the command line, as
+// opposed to holding its default.
+func flagGiven(name string) bool {
+	given := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			given = true
+		}
+	})
+	return given
+}
+
 // armBootstrapIfPending puts the process into BOOTSTRAP mode when no identity
 // is installed, and returns nil when one is.
 //
@@ -229,6 +388,123 @@ func armBootstrapIfPending(identity *agent.Identity, inv *agent.LocalInvoker, re
 	return bootstrap
 }
 
+// loadConfig returns the agent's configuration and the file it came from,
+// which is empty when it came from flags.
+//
+// The file wins when it exists, and the flags it replaces are ignored — said
+// out loud, because the packaged unit passes -allow and -service-dir on every
+// start and refusing them would make installing a file a way to break the
+// agent. A missing file is only an error when -config named it; at the default
+// path it means an agent provisioned before the file existed, and the flags
+// apply as they always did.
+func loadConfig(path, serviceDir, allowedCSV, forwardsFile string) (*agentconfig.Config, string) {
+	_, statErr := os.Stat(path)
+	switch {
+	case path != "" && statErr == nil:
+		for _, f := range []string{"allow", "service-dir", "forwards"} {
+			if flagGiven(f) {
+				log.Printf("-%s ignored: %s configures this agent", f, path)
+			}
+		}
+		cfg, err := agentconfig.Load(path)
+		if err != nil {
+			log.Fatalf("agent config: %v", err)
+		}
+		return cfg, path
+	case flagGiven("config"):
+		log.Fatalf("agent config %s: %v", path, statErr)
+	}
+
+	// An empty allowlist is treated as allow-all by the invoker's flag mode,
+	// so refuse to start with one rather than silently exposing every service
+	// in ServiceDir. A locked-down agent sets --allow explicitly.
+	allowed := splitCSV(allowedCSV)
+	if len(allowed) == 0 {
+		log.Fatal("--allow is empty: refusing to start (an empty allowlist would allow every service)")
+	}
+	cfg, err := agentconfig.FromFlags(serviceDir, allowed, loadForwards(forwardsFile))
+	if err != nil {
+		log.Fatalf("agent flags: %v", err)
+	}
+	return cfg, ""
+}
+
+// reloadOnHangup reloads the configuration on every SIGHUP until ctx ends.
+//
+// A reload never restarts anything: the listener, the dial-out tunnel and the
+// streams on it stay up, and the next call or stream is decided by the new
+// file. A file that fails to load is logged and otherwise ignored — the agent
+// keeps what it had, and the console sees the error in qubesair.AgentConfig.
+func reloadOnHangup(ctx context.Context, configs *agentconfig.Manager) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		}
+		cfg, err := configs.Reload()
+		if err != nil {
+			log.Printf("reload: keeping the previous configuration: %v", err)
+			continue
+		}
+		log.Printf("reload: %s in force (%s)", describeSource(cfg), strings.Join(cfg.Policy.Names(), ","))
+	}
+}
+
+// describeSource names where a configuration came from for the log.
+func describeSource(cfg *agentconfig.Config) string {
+	if cfg.Digest == "" {
+		return cfg.Source
+	}
+	return fmt.Sprintf("%s (sha256 %s)", cfg.Source, cfg.Digest[:12])
+}
+
+// loadForwards reads the -forwards policy, falling back to the default GUI
+// ranges when the file does not exist.
+//
+// Absent is not an error because most agents forward nothing but GUI, and a
+// host that predates policies has no file. A file that exists and does not
+// parse IS fatal: the operator wrote something down, and serving the default
+// instead would quietly refuse what they asked for — or, worse, allow what they
+// meant to take away.
+func loadForwards(path string) *transportgrpc.ForwardPolicy {
+	if path == "" {
+		return transportgrpc.DefaultForwardPolicy()
+	}
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		log.Printf("no forward policy at %s; serving the default loopback GUI ranges", path)
+		return transportgrpc.DefaultForwardPolicy()
+	}
+	p, err := transportgrpc.LoadForwardPolicy(path)
+	if err != nil {
+		log.Fatalf("forward policy: %v", err)
+	}
+	return p
+}
+
+// describeForward renders one forward for the startup log.
+func describeForward(f transportgrpc.Forward) string {
+	target := f.Unix
+	if target == "" {
+		bind := f.Bind
+		if bind == "" {
+			bind = "127.0.0.1"
+		}
+		target = fmt.Sprintf("%s:%d", bind, f.Port)
+		if f.PortMax != 0 {
+			target += fmt.Sprintf("-%d", f.PortMax)
+		}
+	}
+	roles := "any role"
+	if len(f.Roles) > 0 {
+		roles = "roles " + strings.Join(f.Roles, ",")
+	}
+	return fmt.Sprintf("%s -> %s (%s)", f.Name, target, roles)
+}
+
 // warnMissingServices reports allowed services with no implementation.
 //
 // Worth saying at startup: an allowlisted service whose script was never
@@ -0,0 +1,230 @@
+// Command qubes-air-helper is the remote's privileged helper, and the thin
+// client the agent's qrexec services use to reach it.
+//
+// With -serve it runs as root (packaging/agent-deb/qubes-air-helper.service)
+// and answers internal/agent/privhelper requests on a unix socket: unlock and
+// lock the data disk, write and read files under configured prefixes, run
+// configured commands. That is everything the agent used to do as root, so
+// the agent itself now runs as the unprivileged qubes-air user — a bug in the
+// process that faces the network is no longer a root shell.
+//
+// Without -serve it makes one request and prints the answer, in the shape the
+// calling qrexec service has always answered in, so the services changed by a
+// line each and their callers not at all:
+//
+//	qubes-air-helper unlock-data        # key on stdin; {"unlocked":..,"detail":..}
+//	qubes-air-helper lock-data          # {"unlocked":..,"detail":..}
+//	qubes-air-helper push <path>        # content on stdin; "OK push <size> <sha256> <path>"
+//	qubes-air-helper pull <path>        # content on stdout
+//	qubes-air-helper run <name> [args]  # stdin to the command; its output, exit status passed on
+//
+// Client mode needs no privilege at all: it is the helper's peer-uid check,
+// not anything in this process, that decides.
+//
+// With -apply-update it is the install step of qubesair.Update: it installs
+// the package the helper staged and waits for the console's confirm, rolling
+// back without one. The helper starts it in a transient systemd unit of its
+// own, which the package's postinst restarting the helper cannot stop.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/slchris/qubes-air/console/internal/agent/privhelper"
+)
+
+// buildVersion is stamped at link time, as for the agent.
+var buildVersion = "dev"
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("qubes-air-helper: ")
+
+	var (
+		serve       = flag.Bool("serve", false, "run the helper daemon (as root)")
+		applyUpdate = flag.Bool("apply-update", false, "install the staged agent package and wait for its confirm (started by the helper)")
+		configFile  = flag.String("config", privhelper.DefaultConfigPath, "helper config (serve mode); absent means the defaults")
+		socket      = flag.String("socket", "", "helper socket (default from the config, or "+privhelper.DefaultSocket+")")
+		timeout     = flag.Duration("timeout", 5*time.Minute, "client mode: overall deadline")
+		showVersion = flag.Bool("version", false, "print version and exit")
+	)
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Printf("qubes-air-helper %s\n", buildVersion)
+		return
+	}
+	if *serve {
+		log.SetFlags(log.LstdFlags)
+		runServer(*configFile, *socket)
+		return
+	}
+	if *applyUpdate {
+		os.Exit(runApplyUpdate(*configFile))
+	}
+
+	args := flag.Args()
+	if len(args) == 0 {
+		log.Fatal("usage: qubes-air-helper -serve | unlock-data | lock-data | push <path> | pull <path> | run <name> [args...]")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	code := runClient(ctx, &privhelper.Client{Socket: *socket}, args)
+	cancel()
+	os.Exit(code)
+}
+
+// runServer serves until SIGINT or SIGTERM. Any failure to start is fatal:
+// systemd restarts it, and an agent whose helper is down says so on every
+// call that needs it rather than doing the work some other way.
+func runServer(configFile, socket string) {
+	if os.Geteuid() != 0 {
+		log.Print("WARNING not running as root: every privileged operation will fail")
+	}
+	cfg, err := privhelper.LoadConfig(configFile)
+	if err != nil {
+		log.Fatalf("config: %v", err)
+	}
+	if socket != "" {
+		cfg.Socket = socket
+	}
+	lis, err := privhelper.Listen(cfg.Socket, socketGroup(cfg))
+	if err != nil {
+		log.Fatalf("listen on %s: %v", cfg.Socket, err)
+	}
+	log.Printf("qubes-air-helper %s serving %s for %v", buildVersion, cfg.Socket, cfg.Callers)
+	for _, f := range cfg.Files {
+		mode := "read-write"
+		if f.ReadOnly {
+			mode = "read-only"
+		}
+		log.Printf("  files    : %s (%s)", f.Prefix, mode)
+	}
+	for _, c := range cfg.Commands {
+		log.Printf("  command  : %s -> %s as %s", c.Name, c.Path, c.User)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	// An update the remote rebooted in the middle of has no unit running it
+	// any more; started again, it rolls back at its deadline unless confirmed.
+	if resumed, err := cfg.Updater().Recover(ctx); err != nil {
+		log.Printf("update: could not resume an interrupted update: %v", err)
+	} else if resumed {
+		log.Print("update: resumed an interrupted update")
+	}
+	if err := privhelper.NewServer(cfg).Serve(ctx, lis); err != nil {
+		//nolint:gocritic // exitAfterDefer: the deferred work is moot at exit
+		log.Fatalf("serve: %v", err)
+	}
+}
+
+// runApplyUpdate runs the install step and returns the process exit status.
+// What happened is in the update's state, which the console reads; the
+// journal gets the same line.
+func runApplyUpdate(configFile string) int {
+	log.SetFlags(log.LstdFlags)
+	cfg, err := privhelper.LoadConfig(configFile)
+	if err != nil {
+		log.Printf("config: %v", err)
+		return 1
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	if err := cfg.Updater().Apply(ctx); err != nil {
+		log.Printf("update: %v", err)
+		return 1
+	}
+	log.Print("update: confirmed")
+	return 0
+}
+
+// socketGroup is the primary group of the first caller, which the socket is
+// handed to. -1 leaves the group alone, for a caller that cannot be resolved.
+func socketGroup(cfg *privhelper.Config) int {
+	for _, name := range cfg.Callers {
+		if gid, err := privhelper.PrimaryGID(name); err == nil && gid != 0 {
+			return gid
+		}
+	}
+	return -1
+}
+
+// runClient makes one request and returns the process exit status.
+func runClient(ctx context.Context, cli *privhelper.Client, args []string) int {
+	op, rest := args[0], args[1:]
+	switch {
+	case (op == "unlock-data" || op == "lock-data") && len(rest) == 0:
+		req := privhelper.Request{Op: privhelper.OpLockData}
+		if op == "unlock-data" {
+			key, err := io.ReadAll(os.Stdin)
+			if err != nil {
+				log.Fatalf("read key: %v", err)
+			}
+			req = privhelper.Request{Op: privhelper.OpUnlockData, Key: string(key)}
+		}
+		resp, err := cli.Do(ctx, req)
+		if err != nil {
+			resp = privhelper.Response{Detail: err.Error()}
+		}
+		// The services' contract: one JSON line, always, and exit 0.
+		_ = json.NewEncoder(os.Stdout).Encode(struct {
+			Unlocked bool   `json:"unlocked"`
+			Detail   string `json:"detail"`
+		}{resp.Unlocked, resp.Detail})
+		return 0
+
+	case op == "push" && len(rest) == 1:
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			log.Fatalf("read content: %v", err)
+		}
+		resp, err := cli.Do(ctx, privhelper.Request{Op: privhelper.OpWriteFile, Path: rest[0], Data: data})
+		if err != nil {
+			fmt.Printf("FileCopy: %v\n", err)
+			return 1
+		}
+		fmt.Printf("OK push %d %s %s\n", resp.Size, resp.SHA256, rest[0])
+		return 0
+
+	case op == "pull" && len(rest) == 1:
+		resp, err := cli.Do(ctx, privhelper.Request{Op: privhelper.OpReadFile, Path: rest[0]})
+		if err != nil {
+			fmt.Printf("FileCopy: %v\n", err)
+			return 1
+		}
+		_, _ = os.Stdout.Write(resp.Data)
+		return 0
+
+	case op == "run" && len(rest) >= 1:
+		stdin, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			log.Fatalf("read stdin: %v", err)
+		}
+		resp, err := cli.Do(ctx, privhelper.Request{Op: privhelper.OpRun, Command: rest[0], Args: rest[1:], Stdin: stdin})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 125
+		}
+		_, _ = os.Stdout.Write(resp.Data)
+		if resp.Detail != "" {
+			fmt.Fprintln(os.Stderr, resp.Detail)
+		}
+		if resp.ExitCode < 0 {
+			return 0 // detached: started, nothing to report yet
+		}
+		return resp.ExitCode
+
+	default:
+		log.Printf("unknown or malformed request %q", args)
+		return 2
+	}
+}
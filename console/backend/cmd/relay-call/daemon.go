@@ -0,0 +1,517 @@
+// daemon.go — warm tunnels, shared by every relay-call on the relay.
+//
+// A relay-call per qrexec call pays for a client certificate, a TCP connect, an
+// mTLS handshake and a protocol handshake before its first byte moves, and
+// throws all of it away when the call returns. For qubesair.Exec that is noise;
+// for qubes.StartApp and the appmenu sync, which make many small calls, it is
+// most of the latency.
+//
+// `relay-call -daemon -socket /run/qubesair/relay-call.sock` instead stays up
+// with one tunnel per RemoteVM endpoint, kept connected (reconnect, keepalive,
+// certificate renewal) by the same transport client every other relay path
+// uses. The endpoint list comes from where a per-call relay-call would look it
+// up — the console database in mint mode, QubesDB's /remote-endpoint/ keys
+// (written from list-endpoints) in provisioned mode — and is re-read on a
+// timer, and at once when a call names a target the daemon does not know.
+//
+// A relay-call given -socket is the thin client: it reads stdin, hands target,
+// service and body to the daemon over the socket, and writes back the reply.
+// When the daemon is not running, or does not know the target, the thin client
+// falls back to dialing directly, so the daemon is an accelerator and never a
+// new way for calls to fail.
+//
+// The socket is owner-only, like a forward socket: whoever can connect to it
+// makes calls with this relay's identity. Run the daemon as the user the
+// qubesair.GrpcProxy service runs as.
+//
+// With -attach host:port the daemon is also the relay end of dial-out: agents
+// started with `qubes-air-agent -dial-out` connect to that listener
+// (transportgrpc.AttachServer), and a call for a target attached there goes
+// over the agent's own connection — the only way to reach a remote behind NAT,
+// which has no endpoint to put in the list. The listener presents the daemon's
+// identity (the -cert/-key/-ca files, or a certificate minted from the console
+// CA) and admits agent certificates from the same CA, routed by the name in
+// the certificate. An attached agent is preferred over a dialed tunnel to the
+// same name: it is a connection the agent itself is keeping up.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/slchris/qubes-air/console/internal/models"
+	"github.com/slchris/qubes-air/console/internal/repository"
+	"github.com/slchris/qubes-air/console/internal/transport"
+	transportgrpc "github.com/slchris/qubes-air/console/internal/transport/grpc"
+)
+
+// Daemon-mode defaults.
+const (
+	// defaultEndpointsCmd lists the endpoints the relay's refresh wrote into
+	// QubesDB, one "<key> <ip:port>" per line.
+	defaultEndpointsCmd = "qubesdb-multiread /remote-endpoint/"
+	// defaultDaemonRefresh matches the relay's own endpoint refresh: a newly
+	// provisioned qube is warm within one interval, and before that the first
+	// call to it refreshes on the spot.
+	defaultDaemonRefresh = 30 * time.Second
+	// daemonMissRefresh bounds how often calls for unknown targets may
+	// re-read the endpoint list; a caller looping on a typo must not turn the
+	// daemon into a QubesDB hammer.
+	daemonMissRefresh = 2 * time.Second
+	// daemonShutdownGrace is how long calls in flight may finish on SIGTERM.
+	daemonShutdownGrace = 5 * time.Second
+)
+
+// errDaemonUnavailable means the daemon did not take the call: it is not
+// running, or it has no tunnel for the target. The call was not made, so the
+// thin client may safely make it another way.
+var errDaemonUnavailable = errors.New("relay daemon unavailable")
+
+// errUnknownTarget is the daemon's side of errDaemonUnavailable.
+var errUnknownTarget = errors.New("no endpoint known for target")
+
+// endpointSource lists the reachable RemoteVMs: name → ip:port.
+type endpointSource func(ctx context.Context) (map[string]string, error)
+
+// warmClient is what the daemon needs of a tunnel; *transportgrpc.Client in
+// production.
+type warmClient interface {
+	Call(ctx context.Context, target, service string, in []byte) ([]byte, error)
+	Status() transportgrpc.ClientStatus
+}
+
+// attachedAgents is what the daemon needs of the attach listener;
+// *transportgrpc.AttachServer in production.
+type attachedAgents interface {
+	Agent(name string) (*transportgrpc.Client, bool)
+	Agents() []string
+}
+
+// daemon holds a warm tunnel per endpoint and serves calls over them.
+type daemon struct {
+	endpoints endpointSource
+	// dial starts a tunnel to addr for name, kept up until ctx is canceled.
+	dial func(ctx context.Context, name, addr string) warmClient
+	// attached, when set, is the agents that dialed in (-attach).
+	attached attachedAgents
+
+	mu        sync.Mutex
+	warm      map[string]*warmTunnel
+	refreshed time.Time
+}
+
+// warmTunnel is one endpoint's tunnel.
+type warmTunnel struct {
+	addr   string
+	client warmClient
+	stop   context.CancelFunc
+}
+
+func newDaemon(endpoints endpointSource, dial func(ctx context.Context, name, addr string) warmClient) *daemon {
+	return &daemon{endpoints: endpoints, dial: dial, warm: make(map[string]*warmTunnel)}
+}
+
+// sync re-reads the endpoint list: a tunnel is started for each new endpoint,
+// and retired for each one gone or moved. Tunnels to endpoints that did not
+// change are left alone — that is the point of keeping them.
+func (d *daemon) sync(ctx context.Context) error {
+	eps, err := d.endpoints(ctx)
+	if err != nil {
+		return fmt.Errorf("list endpoints: %w", err)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.refreshed = time.Now()
+	for name, w := range d.warm {
+		if addr, ok := eps[name]; !ok || addr != w.addr {
+			log.Printf("daemon: %s: retiring tunnel to %s", name, w.addr)
+			w.stop()
+			delete(d.warm, name)
+		}
+	}
+	for name, addr := range eps {
+		if _, ok := d.warm[name]; ok {
+			continue
+		}
+		log.Printf("daemon: %s: warming tunnel to %s", name, addr)
+		// Not the caller's ctx: the tunnel outlives the refresh or call that
+		// started it, and ends only when retired or at shutdown.
+		tctx, stop := context.WithCancel(context.Background())
+		d.warm[name] = &warmTunnel{addr: addr, client: d.dial(tctx, name, addr), stop: stop}
+	}
+	return nil
+}
+
+// close retires every tunnel.
+func (d *daemon) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for name, w := range d.warm {
+		w.stop()
+		delete(d.warm, name)
+	}
+}
+
+// lookup returns target's tunnel — the agent's own when it is attached —
+// re-reading the endpoint list first when the target is unknown and the list
+// was not read a moment ago.
+func (d *daemon) lookup(ctx context.Context, target string) warmClient {
+	if d.attached != nil {
+		if cli, ok := d.attached.Agent(target); ok {
+			return cli
+		}
+	}
+	d.mu.Lock()
+	w := d.warm[target]
+	stale := time.Since(d.refreshed) >= daemonMissRefresh
+	d.mu.Unlock()
+	if w != nil {
+		return w.client
+	}
+	if !stale {
+		return nil
+	}
+	if err := d.sync(ctx); err != nil {
+		log.Printf("daemon: refresh for %s: %v", target, err)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if w := d.warm[target]; w != nil {
+		return w.client
+	}
+	return nil
+}
+
+// call makes one call over target's tunnel. As in dialAndCall, only "not
+// connected yet" is waited out; anything after the call left is final.
+func (d *daemon) call(ctx context.Context, target, service string, in []byte) ([]byte, error) {
+	cli := d.lookup(ctx, target)
+	if cli == nil {
+		return nil, fmt.Errorf("%w %q", errUnknownTarget, target)
+	}
+	for {
+		out, err := cli.Call(ctx, target, service, in)
+		if !errors.Is(err, transportgrpc.ErrNotConnected) {
+			return out, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("tunnel to %s never connected within deadline: %w", target, ctx.Err())
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// handler serves POST /call and GET /status.
+func (d *daemon) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /call", d.handleCall)
+	mux.HandleFunc("GET /status", d.handleStatus)
+	return mux
+}
+
+// handleCall is one thin-client call: target and service in the query, the
+// request body as the call's stdin, the reply as the response body. 404 is
+// reserved for "not taken" — the thin client falls back on it and on nothing
+// else.
+func (d *daemon) handleCall(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	target, service := q.Get("target"), q.Get("service")
+	if !transport.ValidName(target) || !transport.ValidName(service) {
+		http.Error(w, "invalid target or service name", http.StatusBadRequest)
+		return
+	}
+	ctx := r.Context()
+	if ms, err := strconv.ParseInt(q.Get("timeout_ms"), 10, 64); err == nil && ms > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(ms)*time.Millisecond)
+		defer cancel()
+	}
+	in, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	out, err := d.call(ctx, target, service, in)
+	switch {
+	case errors.Is(err, errUnknownTarget):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case err != nil:
+		log.Printf("daemon: %s %s: %v", target, service, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	default:
+		_, _ = w.Write(out)
+	}
+}
+
+// handleStatus reports every warm tunnel and attached agent, by target; an
+// attached agent hides a dialed tunnel to the same name, as it does in lookup.
+func (d *daemon) handleStatus(w http.ResponseWriter, _ *http.Request) {
+	d.mu.Lock()
+	st := make(map[string]transportgrpc.ClientStatus, len(d.warm))
+	for name, t := range d.warm {
+		st[name] = t.client.Status()
+	}
+	d.mu.Unlock()
+	if d.attached != nil {
+		for _, name := range d.attached.Agents() {
+			if cli, ok := d.attached.Agent(name); ok {
+				st[name] = cli.Status()
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(st)
+}
+
+// callViaDaemon hands one call to the daemon on socket. An error wrapping
+// errDaemonUnavailable means the call was not made; any other error is the
+// call's own, and it may have run.
+func callViaDaemon(ctx context.Context, socket, target, service string, in []byte) ([]byte, error) {
+	hc := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		},
+	}}
+	q := url.Values{"target": {target}, "service": {service}}
+	if dl, ok := ctx.Deadline(); ok {
+		q.Set("timeout_ms", strconv.FormatInt(time.Until(dl).Milliseconds(), 10))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://relay-daemon/call?"+q.Encode(), bytes.NewReader(in))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		// Not connecting to the socket is the one transport failure that
+		// proves the call never left this process.
+		var op *net.OpError
+		if errors.As(err, &op) && op.Op == "dial" {
+			return nil, fmt.Errorf("%w: %v", errDaemonUnavailable, err)
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+	out, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return out, nil
+	case http.StatusNotFound:
+		return nil, fmt.Errorf("%w: %s", errDaemonUnavailable, strings.TrimSpace(string(out)))
+	default:
+		return nil, errors.New(strings.TrimSpace(string(out)))
+	}
+}
+
+// loadIdentity sets up daemon mode's client identity and endpoint list from
+// the same flags a per-call relay-call takes: provisioned when the certificate
+// flags are given, mint otherwise. The returned func closes what it opened.
+func loadIdentity(dsn, certFile, keyFile, caFile, endpointsCmd, port string) (identityFunc, endpointSource, func()) {
+	if certFile != "" || keyFile != "" || caFile != "" {
+		if certFile == "" || keyFile == "" || caFile == "" {
+			log.Fatal("provisioned mode needs -cert, -key and -ca together")
+		}
+		argv := strings.Fields(endpointsCmd)
+		if len(argv) == 0 {
+			log.Fatal("provisioned daemon mode needs -endpoints-cmd")
+		}
+		return provisionedIdentity(certFile, keyFile, caFile), commandEndpoints(argv), func() {}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	db, ca := openMint(ctx, dsn)
+	identity := func() (tls.Certificate, *x509.CertPool, error) { return mintFromCA(ca) }
+	return identity, dbEndpoints(repository.NewQubeRepository(db), port), func() { _ = db.Close() }
+}
+
+// commandEndpoints runs argv (no shell) and parses its output.
+func commandEndpoints(argv []string) endpointSource {
+	return func(ctx context.Context) (map[string]string, error) {
+		out, err := exec.CommandContext(ctx, argv[0], argv[1:]...).Output() // #nosec G204 -- operator-supplied flag
+		if err != nil {
+			return nil, err
+		}
+		return parseEndpoints(bytes.NewReader(out)), nil
+	}
+}
+
+// parseEndpoints reads "<name> <ip:port>" lines, as list-endpoints prints them.
+// A name given as a QubesDB key ("/remote-endpoint/<name>") is reduced to its
+// last element. Malformed lines are skipped with a log line rather than
+// failing the list: one bad entry must not cool every other tunnel.
+func parseEndpoints(r io.Reader) map[string]string {
+	eps := make(map[string]string)
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			log.Printf("daemon: skipping endpoint line %q", sc.Text())
+			continue
+		}
+		name, addr := path.Base(fields[0]), fields[1]
+		if _, _, err := net.SplitHostPort(addr); err != nil || !transport.ValidName(name) {
+			log.Printf("daemon: skipping endpoint line %q", sc.Text())
+			continue
+		}
+		eps[name] = addr
+	}
+	return eps
+}
+
+// dbEndpoints lists running qubes from the console database, as list-endpoints
+// does.
+func dbEndpoints(repo repository.QubeRepository, port string) endpointSource {
+	return func(ctx context.Context) (map[string]string, error) {
+		qubes, err := repo.List(ctx, repository.DefaultQubeListOptions())
+		if err != nil {
+			return nil, err
+		}
+		eps := make(map[string]string)
+		for _, q := range qubes {
+			if q.Status == models.QubeStatusRunning && q.IPAddress != "" {
+				eps[q.Name] = net.JoinHostPort(q.IPAddress, port)
+			}
+		}
+		return eps, nil
+	}
+}
+
+// attachTLS is the attach listener's TLS: the daemon's identity as the server
+// certificate, resolved per handshake so a renewed (or, in mint mode, freshly
+// minted) one is presented, and agent certificates verified against the CA.
+// The agent checks the relay's chain by hand with any key usage, so the
+// client-auth certificate the daemon dials with serves here too.
+func attachTLS(identity identityFunc) (*tls.Config, error) {
+	_, pool, err := identity()
+	if err != nil {
+		return nil, fmt.Errorf("relay identity: %w", err)
+	}
+	return &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			pair, _, err := identity()
+			if err != nil {
+				return nil, fmt.Errorf("relay identity: %w", err)
+			}
+			return &pair, nil
+		},
+		ClientCAs:  pool,
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		MinVersion: tls.VersionTLS13,
+	}, nil
+}
+
+// serveAttach starts the attach listener on addr, for as long as ctx lives. A
+// listener that cannot start is fatal: an operator who asked for one has agents
+// that can be reached no other way.
+func serveAttach(ctx context.Context, addr string, identity identityFunc) *transportgrpc.AttachServer {
+	tlsCfg, err := attachTLS(identity)
+	if err != nil {
+		log.Fatalf("attach %s: %v", addr, err)
+	}
+	a := transportgrpc.NewAttachServer(transportgrpc.AttachConfig{
+		Listen:    addr,
+		TLS:       tlsCfg,
+		RelayName: "console-relay",
+	}, nil)
+	go func() {
+		if err := a.Serve(ctx); err != nil {
+			log.Fatalf("attach %s: %v", addr, err)
+		}
+	}()
+	log.Printf("daemon: accepting dial-out agents on %s", addr)
+	return a
+}
+
+// runDaemon serves daemon mode until SIGINT or SIGTERM. attach, when not
+// empty, is the host:port dial-out agents connect to.
+func runDaemon(socket, attach string, identity identityFunc, endpoints endpointSource, refresh time.Duration) {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	d := newDaemon(endpoints, func(ctx context.Context, name, addr string) warmClient {
+		cli := transportgrpc.NewClient(transportgrpc.ClientConfig{
+			RemoteEndpoint: addr,
+			RelayName:      "console-relay",
+			RemoteName:     name,
+			// Per connect, so a reconnect after renewal presents the new
+			// certificate, and a mint-mode certificate never ages out.
+			TLSProvider: func() (*tls.Config, error) {
+				pair, pool, err := identity()
+				if err != nil {
+					return nil, fmt.Errorf("client identity: %w", err)
+				}
+				return agentTLS(pair, pool), nil
+			},
+		}, nil)
+		go func() { _ = cli.Start(ctx) }()
+		return cli
+	})
+	defer d.close()
+	if attach != "" {
+		d.attached = serveAttach(ctx, attach, identity)
+	}
+	if err := d.sync(ctx); err != nil {
+		// Not fatal: the list may simply not be written yet, and the next
+		// refresh or the first call tries again.
+		log.Printf("daemon: %v", err)
+	}
+
+	lis, err := listenForward(ctx, "unix:"+socket)
+	if err != nil {
+		log.Fatalf("listen %s: %v", socket, err)
+	}
+	defer os.Remove(socket)
+	srv := &http.Server{Handler: d.handler(), ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		ticker := time.NewTicker(refresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				shutdown, cancel := context.WithTimeout(context.Background(), daemonShutdownGrace)
+				defer cancel()
+				_ = srv.Shutdown(shutdown)
+				return
+			case <-ticker.C:
+				if err := d.sync(ctx); err != nil {
+					log.Printf("daemon: %v", err)
+				}
+			}
+		}
+	}()
+
+	log.Printf("daemon: serving on %s, refreshing endpoints every %s", socket, refresh)
+	if err := srv.Serve(lis); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("daemon: %v", err)
+	}
+	log.Printf("daemon: stopped")
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/slchris/qubes-air/console/internal/pki"
+	transportgrpc "github.com/slchris/qubes-air/console/internal/transport/grpc"
+)
+
+// fakeWarm stands in for a tunnel: it answers "<name>:<service>", or err.
+type fakeWarm struct {
+	name string
+	err  error
+	// down counts calls answered with ErrNotConnected before it connects.
+	down int
+	mu   sync.Mutex
+}
+
+func (f *fakeWarm) Call(_ context.Context, _, service string, _ []byte) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.down > 0 {
+		f.down--
+		return nil, transportgrpc.ErrNotConnected
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	return []byte(f.name + ":" + service), nil
+}
+
+func (f *fakeWarm) Status() transportgrpc.ClientStatus {
+	return transportgrpc.ClientStatus{RemoteName: f.name}
+}
+
+// fakeEndpoints is an endpoint list the test can change.
+type fakeEndpoints struct {
+	mu    sync.Mutex
+	eps   map[string]string
+	reads int
+}
+
+func (f *fakeEndpoints) list(context.Context) (map[string]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.reads++
+	out := make(map[string]string, len(f.eps))
+	for k, v := range f.eps {
+		out[k] = v
+	}
+	return out, nil
+}
+
+func (f *fakeEndpoints) set(eps map[string]string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.eps = eps
+}
+
+// startDaemon serves d on a unix socket until the test ends.
+func startDaemon(t *testing.T, d *daemon) string {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "relay.sock")
+	ctx, cancel := context.WithCancel(context.Background())
+	lis, err := listenForward(ctx, "unix:"+socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: d.handler(), ReadHeaderTimeout: time.Second}
+	go func() { _ = srv.Serve(lis) }()
+	t.Cleanup(func() { cancel(); _ = srv.Close() })
+	return socket
+}
+
+func TestParseEndpoints(t *testing.T) {
+	got := parseEndpoints(strings.NewReader(
+		"/remote-endpoint/remote-a 10.0.0.1:8443\n" +
+			"remote-b 10.0.0.2:8443\n" +
+			"\n" +
+			"remote-c no-port\n" +
+			"remote;d 10.0.0.4:8443\n" +
+			"remote-e 10.0.0.5:8443 extra\n"))
+	want := map[string]string{"remote-a": "10.0.0.1:8443", "remote-b": "10.0.0.2:8443"}
+	if len(got) != len(want) {
+		t.Fatalf("parsed %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %q, want %q", k, got[k], v)
+		}
+	}
+}
+
+// TestDaemonKeepsTunnelsWarm — a refresh starts tunnels for new endpoints,
+// retires those gone or moved, and leaves the rest alone.
+func TestDaemonKeepsTunnelsWarm(t *testing.T) {
+	eps := &fakeEndpoints{eps: map[string]string{"remote-a": "10.0.0.1:8443", "remote-b": "10.0.0.2:8443"}}
+	dials := map[string]int{}
+	stopped := map[string]bool{}
+	var mu sync.Mutex
+	d := newDaemon(eps.list, func(ctx context.Context, name, addr string) warmClient {
+		mu.Lock()
+		dials[name]++
+		mu.Unlock()
+		go func() {
+			<-ctx.Done()
+			mu.Lock()
+			stopped[name+"@"+addr] = true
+			mu.Unlock()
+		}()
+		return &fakeWarm{name: name}
+	})
+	defer d.close()
+
+	if err := d.sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	eps.set(map[string]string{"remote-a": "10.0.0.1:8443", "remote-b": "10.0.0.9:8443", "remote-c": "10.0.0.3:8443"})
+	if err := d.sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	eps.set(map[string]string{"remote-b": "10.0.0.9:8443", "remote-c": "10.0.0.3:8443"})
+	if err := d.sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		mu.Lock()
+		done := stopped["remote-a@10.0.0.1:8443"] && stopped["remote-b@10.0.0.2:8443"]
+		mu.Unlock()
+		if done || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if dials["remote-a"] != 1 || dials["remote-b"] != 2 || dials["remote-c"] != 1 {
+		t.Errorf("dials = %v; an unchanged endpoint must keep its tunnel", dials)
+	}
+	if !stopped["remote-a@10.0.0.1:8443"] || !stopped["remote-b@10.0.0.2:8443"] || stopped["remote-b@10.0.0.9:8443"] {
+		t.Errorf("stopped = %v; want the removed and the moved tunnel retired", stopped)
+	}
+}
+
+// TestThinClientThroughDaemon — calls go over the daemon's tunnels; only a
+// daemon that is absent, or does not know the target, sends the thin client
+// down the direct path.
+func TestThinClientThroughDaemon(t *testing.T) {
+	eps := &fakeEndpoints{eps: map[string]string{"remote-a": "10.0.0.1:8443", "remote-b": "10.0.0.2:8443"}}
+	d := newDaemon(eps.list, func(_ context.Context, name, _ string) warmClient {
+		if name == "remote-b" {
+			return &fakeWarm{name: name, err: errors.New("remote: DENIED: policy")}
+		}
+		return &fakeWarm{name: name, down: 2}
+	})
+	defer d.close()
+	if err := d.sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	socket := startDaemon(t, d)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	out, err := callViaDaemon(ctx, socket, "remote-a", "qubes.StartApp+galculator", []byte("in"))
+	if err != nil || string(out) != "remote-a:qubes.StartApp+galculator" {
+		t.Fatalf("call = %q, %v", out, err)
+	}
+	if _, err := callViaDaemon(ctx, socket, "remote-b", "qubesair.Exec", nil); err == nil || errors.Is(err, errDaemonUnavailable) ||
+		!strings.Contains(err.Error(), "DENIED") {
+		t.Errorf("a call that failed remotely = %v; it must be final, not fall back", err)
+	}
+	if _, err := callViaDaemon(ctx, socket, "remote-zzz", "qubesair.Ping", nil); !errors.Is(err, errDaemonUnavailable) {
+		t.Errorf("unknown target = %v, want errDaemonUnavailable", err)
+	}
+	if _, err := callViaDaemon(ctx, filepath.Join(t.TempDir(), "absent.sock"), "remote-a", "qubesair.Ping", nil); !errors.Is(err, errDaemonUnavailable) {
+		t.Errorf("no daemon = %v, want errDaemonUnavailable", err)
+	}
+}
+
+// TestDaemonRefreshesOnMiss — a target that appeared since the last refresh is
+// picked up by the first call to it, not a refresh interval later.
+func TestDaemonRefreshesOnMiss(t *testing.T) {
+	eps := &fakeEndpoints{eps: map[string]string{}}
+	d := newDaemon(eps.list, func(_ context.Context, name, _ string) warmClient { return &fakeWarm{name: name} })
+	defer d.close()
+	// As if the last refresh was long ago.
+	d.refreshed = time.Now().Add(-time.Minute)
+
+	eps.set(map[string]string{"remote-new": "10.0.0.7:8443"})
+	out, err := d.call(context.Background(), "remote-new", "qubesair.Ping", nil)
+	if err != nil || string(out) != "remote-new:qubesair.Ping" {
+		t.Fatalf("call = %q, %v", out, err)
+	}
+	reads := eps.reads
+	if _, err := d.call(context.Background(), "remote-typo", "qubesair.Ping", nil); !errors.Is(err, errUnknownTarget) {
+		t.Fatalf("unknown target = %v", err)
+	}
+	if eps.reads != reads {
+		t.Error("a miss right after a refresh re-read the endpoint list")
+	}
+}
+
+// attachedInvoker is a dial-out agent's services: it answers
+// "attached:<service>:<body>".
+type attachedInvoker struct{}
+
+func (attachedInvoker) Invoke(_ context.Context, _, service string, in []byte) ([]byte, error) {
+	return []byte("attached:" + service + ":" + string(in)), nil
+}
+
+// TestDaemonServesDialOutAgents — end to end with real certificates: an agent
+// that dials the daemon's -attach listener is reachable through the socket by
+// the name in its certificate, in preference to a dialed tunnel to the same
+// name, and shows up in /status.
+func TestDaemonServesDialOutAgents(t *testing.T) {
+	ca, err := pki.NewCA("test-ca", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity := func() (tls.Certificate, *x509.CertPool, error) { return mintFromCA(ca) }
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lis.Addr().String()
+	_ = lis.Close()
+
+	eps := &fakeEndpoints{eps: map[string]string{"remote-nat": "10.0.0.9:8443"}}
+	d := newDaemon(eps.list, func(_ context.Context, name, _ string) warmClient { return &fakeWarm{name: name} })
+	defer d.close()
+	if err := d.sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d.attached = serveAttach(ctx, addr, identity)
+
+	bundle, err := ca.IssueAgentCert(pki.AgentCommonName("remote-nat"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair, err := tls.X509KeyPair([]byte(bundle.CertPEM), []byte(bundle.KeyPEM))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, pool, err := identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent := transportgrpc.NewServer(transportgrpc.ServerConfig{}, attachedInvoker{})
+	go func() {
+		_ = agent.DialOut(ctx, transportgrpc.DialOutConfig{Endpoint: addr, TLS: agentTLS(pair, pool)})
+	}()
+
+	socket := startDaemon(t, d)
+	callCtx, callCancel := context.WithTimeout(ctx, 10*time.Second)
+	defer callCancel()
+	for {
+		out, err := callViaDaemon(callCtx, socket, "remote-nat", "qubesair.Exec", []byte("uname"))
+		if err == nil && string(out) == "attached:qubesair.Exec:uname" {
+			break
+		}
+		if callCtx.Err() != nil {
+			t.Fatalf("call never reached the attached agent: last %q, %v", out, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	hc := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dl net.Dialer
+			return dl.DialContext(ctx, "unix", socket)
+		},
+	}}
+	resp, err := hc.Get("http://relay-daemon/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var st map[string]transportgrpc.ClientStatus
+	if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+		t.Fatal(err)
+	}
+	if got := st["remote-nat"]; !got.Connected || got.Peer == nil {
+		t.Errorf("status for the attached agent = %+v", got)
+	}
+}
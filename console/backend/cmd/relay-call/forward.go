@@ -0,0 +1,234 @@
+// forward.go — local port forwarding on top of -stream.
+//
+// `relay-call -forward -listen 127.0.0.1:15432 <target> postgres` accepts
+// connections on a local TCP port (or unix:/path socket) and splices each one
+// onto its own qubesair.StreamTCP call, so `psql -h localhost -p 15432` reaches
+// the remote's Postgres the way a VNC viewer reaches its display — without
+// anyone hand-wiring socat to qubesair.ConnectTCP.
+//
+// Each connection gets its own tunnel. That is deliberate, not lazy: against an
+// agent that predates flow control, the client can only push back on a stream
+// by blocking the tunnel's single receive loop, so one slow reader on a shared
+// tunnel stalls every other stream on it (see Client.appendForward). A tunnel
+// per connection keeps a stalled psql from freezing a neighbour's session
+// whichever agent build is on the other end.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Forward-mode defaults.
+const (
+	// defaultForwardMaxConns bounds concurrent connections. Every connection is
+	// a tunnel and a socket on the remote; a client that leaks connections
+	// should hit a ceiling here, not exhaust the agent.
+	defaultForwardMaxConns = 16
+	// defaultForwardIdle closes a connection that has moved no bytes for this
+	// long. A forgotten psql session otherwise pins a tunnel indefinitely.
+	defaultForwardIdle = 30 * time.Minute
+	// forwardDrainGrace is how long open connections may finish after shutdown
+	// starts before they are cut.
+	forwardDrainGrace = 5 * time.Second
+)
+
+// streamFunc splices one accepted connection onto one remote stream call and
+// returns when the call ends. Production opens a tunnel and calls CallStream;
+// tests substitute an in-process fake.
+type streamFunc func(ctx context.Context, conn io.ReadWriter) error
+
+// forwarder accepts local connections and hands each to a stream call.
+type forwarder struct {
+	stream   streamFunc
+	maxConns int
+	idle     time.Duration
+	// drain overrides forwardDrainGrace (zero means the default).
+	drain time.Duration
+
+	active atomic.Int64
+}
+
+// listenForward opens the local listener. "unix:/path" is a unix socket;
+// anything else is a TCP host:port.
+//
+// A stale socket file from a previous run is removed first — but only if it IS
+// a socket: unlinking whatever regular file someone pointed -listen at would
+// turn a typo into data loss.
+func listenForward(ctx context.Context, spec string) (net.Listener, error) {
+	var lc net.ListenConfig
+	path, isUnix := strings.CutPrefix(spec, "unix:")
+	if !isUnix {
+		return lc.Listen(ctx, "tcp", spec)
+	}
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("remove stale socket: %w", err)
+		}
+	}
+	lis, err := lc.Listen(ctx, "unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// Owner only: the socket is a door into the remote service, and anyone who
+	// can connect to it walks through with this relay's identity.
+	if err := os.Chmod(path, 0o600); err != nil {
+		_ = lis.Close()
+		return nil, fmt.Errorf("chmod socket: %w", err)
+	}
+	return lis, nil
+}
+
+// serve accepts until ctx is canceled, then stops accepting, gives open
+// connections the drain grace to finish, and cuts whatever is left.
+func (f *forwarder) serve(ctx context.Context, lis net.Listener) error {
+	connCtx, cutConns := context.WithCancel(context.Background())
+	defer cutConns()
+
+	var wg sync.WaitGroup
+	go func() {
+		<-ctx.Done()
+		_ = lis.Close()
+	}()
+
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return fmt.Errorf("accept: %w", err)
+		}
+		if f.maxConns > 0 && f.active.Load() >= int64(f.maxConns) {
+			// Refused with a log line rather than queued: a queued connection
+			// looks like a hung remote to the client holding it.
+			log.Printf("forward: refusing %s, %d connections already open", conn.RemoteAddr(), f.maxConns)
+			_ = conn.Close()
+			continue
+		}
+		f.active.Add(1)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer f.active.Add(-1)
+			f.handle(connCtx, conn)
+		}()
+	}
+
+	drain := f.drain
+	if drain <= 0 {
+		drain = forwardDrainGrace
+	}
+	done := make(chan struct{})
+	go func() { wg.Wait(); close(done) }()
+	select {
+	case <-done:
+	case <-time.After(drain):
+		log.Printf("forward: cutting %d connection(s) still open after %s", f.active.Load(), drain)
+		cutConns()
+		<-done
+	}
+	return nil
+}
+
+// handle runs one connection to completion. The connection is closed however
+// the call ends, and an idle watchdog closes it if no bytes move for f.idle —
+// closing the socket is what unblocks both directions of the splice.
+func (f *forwarder) handle(ctx context.Context, conn net.Conn) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ic := &idleConn{Conn: conn}
+	ic.touch()
+	defer ic.Close()
+
+	if f.idle > 0 {
+		go ic.watch(ctx, f.idle, cancel)
+	}
+	go func() {
+		<-ctx.Done()
+		_ = ic.Close()
+	}()
+
+	start := time.Now()
+	err := f.stream(ctx, ic)
+	switch {
+	case ic.timedOut.Load():
+		log.Printf("forward: %s closed after %s idle", conn.RemoteAddr(), f.idle)
+	case err != nil && ctx.Err() == nil:
+		log.Printf("forward: %s: %v", conn.RemoteAddr(), err)
+	default:
+		log.Printf("forward: %s done after %s", conn.RemoteAddr(), time.Since(start).Round(time.Millisecond))
+	}
+}
+
+// idleConn records when bytes last moved in either direction.
+type idleConn struct {
+	net.Conn
+	last     atomic.Int64 // unix nanos
+	timedOut atomic.Bool
+	once     sync.Once
+}
+
+func (c *idleConn) touch() { c.last.Store(time.Now().UnixNano()) }
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
+
+func (c *idleConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
+
+// Close is idempotent: the call, the watchdog and shutdown may all race to it.
+func (c *idleConn) Close() error {
+	var err error
+	c.once.Do(func() { err = c.Conn.Close() })
+	return err
+}
+
+// watch cancels the connection once it has been idle for longer than limit.
+func (c *idleConn) watch(ctx context.Context, limit time.Duration, cancel context.CancelFunc) {
+	tick := limit / 4
+	if tick > time.Minute {
+		tick = time.Minute
+	}
+	t := time.NewTicker(tick)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if time.Since(time.Unix(0, c.last.Load())) >= limit {
+				c.timedOut.Store(true)
+				cancel()
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// echoStream stands in for a remote forward: it copies the connection back to
+// itself, as an echo service behind qubesair.StreamTCP would.
+func echoStream(_ context.Context, conn io.ReadWriter) error {
+	_, err := io.Copy(conn, conn)
+	return err
+}
+
+// startForwarder serves f on a fresh loopback port until the test ends.
+func startForwarder(t *testing.T, f *forwarder) (addr string, stop func()) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	lis, err := listenForward(ctx, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() { _ = f.serve(ctx, lis); close(done) }()
+	stop = func() { cancel(); <-done }
+	t.Cleanup(stop)
+	return lis.Addr().String(), stop
+}
+
+func roundTrip(t *testing.T, c net.Conn, msg string) {
+	t.Helper()
+	_ = c.SetDeadline(time.Now().Add(3 * time.Second))
+	if _, err := c.Write([]byte(msg)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(c, got); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(got) != msg {
+		t.Fatalf("got %q, want %q", got, msg)
+	}
+}
+
+// waitClosed asserts the peer closed c within a few seconds.
+func waitClosed(t *testing.T, c net.Conn, why string) {
+	t.Helper()
+	_ = c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("%s: connection still delivering data", why)
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatalf("%s: connection was not closed", why)
+	}
+}
+
+func TestForwarderSplicesEachConnection(t *testing.T) {
+	var calls atomic.Int32
+	addr, _ := startForwarder(t, &forwarder{
+		stream: func(ctx context.Context, conn io.ReadWriter) error {
+			calls.Add(1)
+			return echoStream(ctx, conn)
+		},
+	})
+	for i := 0; i < 3; i++ {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		roundTrip(t, c, "select 1")
+		_ = c.Close()
+	}
+	// One stream call per connection, never shared.
+	deadline := time.Now().Add(3 * time.Second)
+	for calls.Load() != 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := calls.Load(); n != 3 {
+		t.Fatalf("stream calls = %d, want 3", n)
+	}
+}
+
+// TestForwarderConnectionLimit — past the limit a connection is refused at
+// once, not queued behind one that may never finish.
+func TestForwarderConnectionLimit(t *testing.T) {
+	addr, _ := startForwarder(t, &forwarder{stream: echoStream, maxConns: 1})
+
+	first, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	roundTrip(t, first, "hold")
+
+	second, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	waitClosed(t, second, "connection over the limit")
+
+	// The first is unaffected.
+	roundTrip(t, first, "still here")
+}
+
+func TestForwarderIdleTimeout(t *testing.T) {
+	addr, _ := startForwarder(t, &forwarder{stream: echoStream, idle: 150 * time.Millisecond})
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	roundTrip(t, c, "ping")
+	waitClosed(t, c, "idle connection")
+}
+
+// TestForwarderShutdownCutsConnections — stopping must not hang on a client
+// that never hangs up.
+func TestForwarderShutdownCutsConnections(t *testing.T) {
+	blocked := make(chan struct{})
+	addr, stop := startForwarder(t, &forwarder{
+		stream: func(ctx context.Context, conn io.ReadWriter) error {
+			close(blocked)
+			<-ctx.Done()
+			return ctx.Err()
+		},
+		drain: 100 * time.Millisecond,
+	})
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	<-blocked
+
+	stopped := make(chan struct{})
+	go func() { stop(); close(stopped) }()
+	select {
+	case <-stopped:
+	case <-time.After(3 * time.Second):
+		t.Fatal("serve did not return after shutdown")
+	}
+	waitClosed(t, c, "connection after shutdown")
+	if _, err := net.DialTimeout("tcp", addr, 200*time.Millisecond); err == nil {
+		t.Fatal("listener still accepting after shutdown")
+	}
+}
+
+func TestListenForwardUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pg.sock")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	lis, err := listenForward(ctx, "unix:"+path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &forwarder{stream: echoStream}
+	go func() { _ = f.serve(ctx, lis) }()
+
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	roundTrip(t, c, "over a socket")
+
+}
+
+// TestListenForwardStaleSocket — a socket left by a crashed run is replaced,
+// but a regular file at the path is never unlinked.
+func TestListenForwardStaleSocket(t *testing.T) {
+	dir := t.TempDir()
+	stale := filepath.Join(dir, "stale.sock")
+	l, err := net.Listen("unix", stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = l.Close()
+	lis, err := listenForward(context.Background(), "unix:"+stale)
+	if err != nil {
+		t.Fatalf("re-listen over a stale socket: %v", err)
+	}
+	_ = lis.Close()
+
+	regular := filepath.Join(dir, "notes.txt")
+	if err := os.WriteFile(regular, []byte("keep me"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listenForward(context.Background(), "unix:"+regular); err == nil {
+		t.Fatal("listening over a regular file must fail")
+	}
+	if b, err := os.ReadFile(regular); err != nil || string(b) != "keep me" {
+		t.Fatalf("regular file was disturbed: %q, %v", b, err)
+	}
+}
@@ -15,6 +15,18 @@
 // is deliberate: the health path is proven on hardware, so the transport a local
 // qube reaches is the same one the console already trusts.
 //
+// With -forward it instead stays up, listening on a local port or unix socket,
+// and streams each accepted connection to one of the agent's forwards — see
+// forward.go.
+//
+// With -push or -pull it moves a file or (with -tree) a directory through
+// qubesair.Transfer in resumable chunks — see transfer.go.
+//
+// With -daemon it stays up holding warm tunnels to every RemoteVM endpoint, and
+// a relay-call given -socket hands its call to that daemon instead of paying
+// for a certificate and an mTLS handshake of its own — see daemon.go. Given
+// -attach too, the daemon is also where agents started with -dial-out connect.
+//
 // stdout carries ONLY the agent's response bytes, so qrexec can forward it
 // verbatim; every diagnostic goes to stderr.
 package main
@@ -29,7 +41,9 @@ import (
 	"io"
 	"log"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/slchris/qubes-air/console/internal/database"
@@ -37,6 +51,7 @@ import (
 	"github.com/slchris/qubes-air/console/internal/models"
 	"github.com/slchris/qubes-air/console/internal/pki"
 	"github.com/slchris/qubes-air/console/internal/repository"
+	"github.com/slchris/qubes-air/console/internal/transfer"
 	transportgrpc "github.com/slchris/qubes-air/console/internal/transport/grpc"
 )
 
@@ -59,38 +74,105 @@ func main() {
 	// `apt-get install` easily outruns a short deadline. The deadline is
 	// propagated to the agent, which caps a single call at its own timeout.
 	timeout := flag.Duration("timeout", 180*time.Second, "overall deadline")
-	// Stream mode: a raw bidirectional TCP proxy to a loopback port on the remote
-	// (qubesair.ConnectTCP uses this for GUI). The positional service becomes the
-	// PORT, and stdin/stdout are piped live rather than buffered.
-	stream := flag.Bool("stream", false, "raw TCP stream to a remote loopback port (service arg is the port)")
+	// Stream mode: a raw bidirectional TCP proxy to one of the remote agent's
+	// forwards (qubesair.ConnectTCP uses this for GUI). The positional service
+	// becomes the PORT or forward name, and stdin/stdout are piped live rather
+	// than buffered.
+	stream := flag.Bool("stream", false, "raw stream to a remote forward (service arg is a port or forward name)")
+	// Forward mode: -stream for every connection accepted on a local listener.
+	// Long-running, so -timeout bounds only how long each connection may wait
+	// for its tunnel, not the process.
+	forward := flag.Bool("forward", false, "listen locally and stream each connection to the remote forward")
+	listen := flag.String("listen", "", "forward mode: local host:port or unix:/path to accept on")
+	maxConns := flag.Int("max-conns", defaultForwardMaxConns, "forward mode: concurrent connection limit (0 = unlimited)")
+	idle := flag.Duration("idle-timeout", defaultForwardIdle, "forward mode: close a connection idle this long (0 = never)")
+	// Daemon mode and its thin client: one long-lived relay-call keeps tunnels
+	// warm, per-call relay-calls hand their call to it over -socket.
+	daemonMode := flag.Bool("daemon", false, "keep warm tunnels to every endpoint and serve calls on -socket")
+	socket := flag.String("socket", "", "daemon's unix socket: served with -daemon, otherwise calls are handed to it")
+	endpointsCmd := flag.String("endpoints-cmd", defaultEndpointsCmd, "daemon, provisioned mode: command listing \"<name> <ip:port>\" lines")
+	refresh := flag.Duration("refresh", defaultDaemonRefresh, "daemon: how often the endpoint list is re-read")
+	attach := flag.String("attach", "", "daemon: host:port to accept dial-out agents on, with the daemon's identity as TLS")
+	// Transfer mode: the positional service becomes the remote path. Long-running
+	// like -forward, so -timeout bounds each chunk, not the transfer.
+	push := flag.String("push", "", "send this local file (or directory with -tree) to the remote path")
+	pull := flag.String("pull", "", "fetch the remote path into this local file (or directory with -tree)")
+	tree := flag.Bool("tree", false, "transfer: the paths are directories, moved as one tar")
+	chunk := flag.Int("chunk-size", transfer.DefaultChunkSize, "transfer: bytes per call")
 	flag.Parse()
 
+	if *attach != "" && !*daemonMode {
+		log.Fatal("-attach needs -daemon")
+	}
+	if *daemonMode {
+		if *socket == "" {
+			log.Fatal("-daemon needs -socket")
+		}
+		identity, endpoints, closeDB := loadIdentity(*dsn, *certFile, *keyFile, *caFile, *endpointsCmd, *port)
+		defer closeDB()
+		runDaemon(*socket, *attach, identity, endpoints, *refresh)
+		return
+	}
+
 	args := flag.Args()
 	if len(args) < 2 {
-		log.Fatal("usage: relay-call [flags] <target> <service>   (or -stream <target> <port>)")
+		log.Fatal("usage: relay-call [flags] <target> <service>   (or -stream <target> <port|forward>,\n" +
+			"       or -forward -listen <addr|unix:/path> <target> <port|forward>,\n" +
+			"       or -push|-pull <local> [-tree] <target> <remote-path>)")
+	}
+	transferring := *push != "" || *pull != ""
+	if *push != "" && *pull != "" {
+		log.Fatal("-push and -pull are exclusive")
+	}
+	if transferring && (*stream || *forward) {
+		log.Fatal("-push and -pull do not combine with -stream or -forward")
+	}
+	if *forward && *listen == "" {
+		log.Fatal("-forward needs -listen")
 	}
 	target := args[0]
 	service := args[1]
-	if *stream {
-		// The agent side dials 127.0.0.1:<port>; the service name carries the port.
+	if *stream || *forward {
+		// The agent resolves the port or name against its forward policy; the
+		// service name carries it.
 		service = "qubesair.StreamTCP+" + args[1]
 	}
 
 	// Buffered calls take their request body from stdin; a stream pipes stdin live
 	// (do NOT drain it here) inside dialAndStream.
 	var body []byte
-	if !*stream {
+	if !*stream && !*forward && !transferring {
 		var err error
 		body, err = io.ReadAll(os.Stdin)
 		must(err)
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	if transferring {
+		cancel()
+		ctx, cancel = signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	}
 	defer cancel()
 
+	// Thin client: a warm daemon answers without this process touching a
+	// certificate. Only a daemon that is not there, or does not know the
+	// target, sends the call down the direct path below — once the daemon has
+	// the call it may have run it, and running it twice is not ours to risk.
+	if *socket != "" && !*stream && !*forward && !transferring {
+		out, err := callViaDaemon(ctx, *socket, target, service, body)
+		switch {
+		case err == nil:
+			_, _ = os.Stdout.Write(out)
+			return
+		case errors.Is(err, errDaemonUnavailable):
+			log.Printf("%v; dialing directly", err)
+		default:
+			log.Fatalf("call failed: %v", err)
+		}
+	}
+
 	var (
-		pair     tls.Certificate
-		pool     *x509.CertPool
+		identity identityFunc
 		endpoint = *addr
 	)
 	if *certFile != "" || *keyFile != "" || *caFile != "" {
@@ -103,34 +185,41 @@ func main() {
 		if endpoint == "" {
 			log.Fatal("provisioned mode needs -addr")
 		}
-		pair, pool = loadProvisioned(*certFile, *keyFile, *caFile)
+		// Read from disk on every call, so a forward that outlives a relay
+		// certificate renewal presents the renewed one on its next connection.
+		identity = provisionedIdentity(*certFile, *keyFile, *caFile)
 	} else {
 		// Mint mode (console-as-relay): read the CA from the console database and
 		// sign a short-lived client certificate on the spot, resolving the
 		// endpoint from the database when -addr was not given.
-		encKey := os.Getenv("QUBES_AIR_ENCRYPTION_KEY")
-		if encKey == "" {
-			log.Fatal("QUBES_AIR_ENCRYPTION_KEY is required in mint mode")
-		}
-		db, err := database.New(&database.Config{DSN: *dsn})
-		must(err)
+		db, ca := openMint(ctx, *dsn)
 		defer db.Close()
-		kr, err := keyring.NewSingle([]byte(encKey))
-		must(err)
-		creds := repository.NewCredentialRepository(db, kr)
 		if endpoint == "" {
 			endpoint, target = resolveAgent(ctx, repository.NewQubeRepository(db), target, *port)
 		}
-		ca, err := pki.ParseCA(secretNamed(ctx, creds, "qubes-air-ca-cert"),
-			secretNamed(ctx, creds, "qubes-air-ca-key"))
-		must(err)
-		pair, pool = mintFromCA(ca)
+		// Minted per call: the certificate lives an hour, and a forward may run
+		// for days.
+		identity = func() (tls.Certificate, *x509.CertPool, error) { return mintFromCA(ca) }
 	}
 
-	log.Printf("target=%s service=%s endpoint=%s stream=%v", target, service, endpoint, *stream)
+	log.Printf("target=%s service=%s endpoint=%s stream=%v forward=%v", target, service, endpoint, *stream, *forward)
+	if transferring {
+		job := transferJob{local: *push, remote: args[1], tree: *tree, chunk: *chunk, progressEvery: time.Second}
+		if *pull != "" {
+			job.local, job.pull = *pull, true
+		}
+		runTransfer(ctx, identity, endpoint, target, job, *timeout)
+		return
+	}
+	if *forward {
+		runForward(*listen, identity, endpoint, target, service, *timeout, *maxConns, *idle)
+		return
+	}
+	pair, pool, err := identity()
+	must(err)
 	if *stream {
-		// Pipe stdin ↔ remote loopback port ↔ stdout over mTLS; no LAN port.
-		if err := dialAndStream(ctx, pair, pool, endpoint, target, service); err != nil {
+		// Pipe stdin ↔ remote forward ↔ stdout over mTLS; no LAN port.
+		if err := dialAndStream(ctx, pair, pool, endpoint, target, service, os.Stdin, os.Stdout, 0); err != nil {
 			log.Fatalf("stream failed: %v", err)
 		}
 		return
@@ -143,32 +232,65 @@ func main() {
 	_, _ = os.Stdout.Write(out)
 }
 
+// identityFunc produces the client certificate and CA pool for one
+// connection. Called per connection, not once, so that a long-running mode
+// picks up a renewed certificate.
+type identityFunc func() (tls.Certificate, *x509.CertPool, error)
+
+// openMint opens the console database and the CA in it, for mint mode.
+func openMint(ctx context.Context, dsn string) (*database.DB, *pki.CA) {
+	encKey := os.Getenv("QUBES_AIR_ENCRYPTION_KEY")
+	if encKey == "" {
+		log.Fatal("QUBES_AIR_ENCRYPTION_KEY is required in mint mode")
+	}
+	db, err := database.New(&database.Config{DSN: dsn})
+	must(err)
+	kr, err := keyring.NewSingle([]byte(encKey))
+	must(err)
+	creds := repository.NewCredentialRepository(db, kr)
+	ca, err := pki.ParseCA(secretNamed(ctx, creds, "qubes-air-ca-cert"),
+		secretNamed(ctx, creds, "qubes-air-ca-key"))
+	must(err)
+	return db, ca
+}
+
 // mintFromCA signs a fresh short-lived client certificate from the console CA —
 // the console-as-relay path, where the relay is the qube that holds the CA.
-func mintFromCA(ca *pki.CA) (tls.Certificate, *x509.CertPool) {
+func mintFromCA(ca *pki.CA) (tls.Certificate, *x509.CertPool, error) {
 	bundle, err := ca.IssueAgentCert("console-relay", time.Hour)
-	must(err)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
 	pair, err := tls.X509KeyPair([]byte(bundle.CertPEM), []byte(bundle.KeyPEM))
-	must(err)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
 	pool := x509.NewCertPool()
 	if !pool.AppendCertsFromPEM([]byte(bundle.CAPEM)) {
-		log.Fatal("CA PEM did not parse")
+		return tls.Certificate{}, nil, errors.New("CA PEM did not parse")
 	}
-	return pair, pool
+	return pair, pool, nil
 }
 
-// loadProvisioned reads a console-issued client certificate and the CA from
-// disk — the separate-relay path, where the relay holds only its own identity.
-func loadProvisioned(certFile, keyFile, caFile string) (tls.Certificate, *x509.CertPool) {
-	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
-	must(err)
-	caPEM, err := os.ReadFile(caFile)
-	must(err)
-	pool := x509.NewCertPool()
-	if !pool.AppendCertsFromPEM(caPEM) {
-		log.Fatalf("CA file %s did not parse", caFile)
+// provisionedIdentity reads a console-issued client certificate and the CA
+// from disk on every call — the separate-relay path, where the relay holds only
+// its own identity.
+func provisionedIdentity(certFile, keyFile, caFile string) identityFunc {
+	return func() (tls.Certificate, *x509.CertPool, error) {
+		pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return tls.Certificate{}, nil, err
+		}
+		caPEM, err := os.ReadFile(caFile)
+		if err != nil {
+			return tls.Certificate{}, nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return tls.Certificate{}, nil, fmt.Errorf("CA file %s did not parse", caFile)
+		}
+		return pair, pool, nil
 	}
-	return pair, pool
 }
 
 // resolveAgent finds the running target qube by name and returns its
@@ -234,47 +356,63 @@ func dialAndCall(ctx context.Context, pair tls.Certificate, pool *x509.CertPool,
 	}
 }
 
-// newClient builds the transport client with the console health-probe TLS setup:
-// the agent's certificate has no SAN for a bare IP, so the chain is verified by
-// hand in VerifyConnection.
+// newClient builds the transport client with the console health-probe TLS setup.
 func newClient(pair tls.Certificate, pool *x509.CertPool, endpoint, remoteName string) *transportgrpc.Client {
 	return transportgrpc.NewClient(transportgrpc.ClientConfig{
 		RemoteEndpoint: endpoint,
 		RelayName:      "console-relay",
 		RemoteName:     remoteName,
-		TLS: &tls.Config{
-			Certificates:       []tls.Certificate{pair},
-			RootCAs:            pool,
-			MinVersion:         tls.VersionTLS13,
-			InsecureSkipVerify: true, //nolint:gosec // chain checked in VerifyConnection
-			VerifyConnection: func(cs tls.ConnectionState) error {
-				if len(cs.PeerCertificates) == 0 {
-					return errors.New("agent presented no certificate")
-				}
-				_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
-					Roots:     pool,
-					KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
-				})
-				return err
-			},
-		},
+		TLS:            agentTLS(pair, pool),
 	}, nil)
 }
 
-// dialAndStream proxies a raw bidirectional stream: os.Stdin → the remote's
-// loopback port → os.Stdout, over the agent's mTLS Tunnel (service
-// qubesair.StreamTCP+<port>). This is how GUI rides mTLS with no port exposed on
-// the remote's LAN. Waits for the tunnel, then streams until either side closes.
-func dialAndStream(ctx context.Context, pair tls.Certificate, pool *x509.CertPool, endpoint, remoteName, service string) error {
+// agentTLS is the console health-probe TLS setup: the agent's certificate has
+// no SAN for a bare IP, so the chain is verified by hand in VerifyConnection.
+func agentTLS(pair tls.Certificate, pool *x509.CertPool) *tls.Config {
+	return &tls.Config{
+		Certificates:       []tls.Certificate{pair},
+		RootCAs:            pool,
+		MinVersion:         tls.VersionTLS13,
+		InsecureSkipVerify: true, //nolint:gosec // chain checked in VerifyConnection
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("agent presented no certificate")
+			}
+			_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+				Roots:     pool,
+				KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+			})
+			return err
+		},
+	}
+}
+
+// dialAndStream proxies a raw bidirectional stream: stdin → the remote agent's
+// forward → stdout, over the agent's mTLS Tunnel (service
+// qubesair.StreamTCP+<port|name>). This is how GUI rides mTLS with no port
+// exposed on the remote's LAN. Waits for the tunnel — at most connectWithin
+// when it is non-zero, otherwise until ctx ends — then streams until either
+// side closes. The tunnel is torn down on return.
+func dialAndStream(ctx context.Context, pair tls.Certificate, pool *x509.CertPool, endpoint, remoteName, service string,
+	stdin io.Reader, stdout io.Writer, connectWithin time.Duration) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	cli := newClient(pair, pool, endpoint, remoteName)
 	go func() { _ = cli.Start(ctx) }()
+	var connectBy time.Time
+	if connectWithin > 0 {
+		connectBy = time.Now().Add(connectWithin)
+	}
 	for {
 		// CallStream returns ErrNotConnected without touching stdin until the
 		// tunnel is up, so retrying it is safe.
-		err := cli.CallStream(ctx, remoteName, service, os.Stdin, os.Stdout)
+		err := cli.CallStream(ctx, remoteName, service, stdin, stdout)
 		if !errors.Is(err, transportgrpc.ErrNotConnected) {
 			return err
 		}
+		if !connectBy.IsZero() && time.Now().After(connectBy) {
+			return fmt.Errorf("tunnel never connected within %s", connectWithin)
+		}
 		select {
 		case <-ctx.Done():
 			return fmt.Errorf("tunnel never connected within deadline: %w", ctx.Err())
@@ -283,6 +421,39 @@ func dialAndStream(ctx context.Context, pair tls.Certificate, pool *x509.CertPoo
 	}
 }
 
+// runForward serves forward mode until SIGINT or SIGTERM.
+func runForward(listen string, identity identityFunc,
+	endpoint, remoteName, service string, connectWithin time.Duration, maxConns int, idle time.Duration) {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	lis, err := listenForward(ctx, listen)
+	if err != nil {
+		log.Fatalf("listen %s: %v", listen, err)
+	}
+	log.Printf("forward: %s -> %s %s (max %d connections, idle timeout %s)",
+		listen, remoteName, service, maxConns, idle)
+
+	f := &forwarder{
+		stream: func(ctx context.Context, conn io.ReadWriter) error {
+			pair, pool, err := identity()
+			if err != nil {
+				return fmt.Errorf("client identity: %w", err)
+			}
+			return dialAndStream(ctx, pair, pool, endpoint, remoteName, service, conn, conn, connectWithin)
+		},
+		maxConns: maxConns,
+		idle:     idle,
+	}
+	if err := f.serve(ctx, lis); err != nil {
+		log.Fatalf("forward: %v", err)
+	}
+	if path, ok := strings.CutPrefix(listen, "unix:"); ok {
+		_ = os.Remove(path)
+	}
+	log.Printf("forward: stopped")
+}
+
 func secretNamed(ctx context.Context, r *repository.CredentialRepository, name string) string {
 	list, err := r.List(ctx)
 	must(err)
@@ -0,0 +1,105 @@
+// transfer.go — chunked file and tree transfer on top of qubesair.Transfer.
+//
+// `relay-call -push ./build.tar <target> /home/user/build.tar` sends a local
+// file in chunks; `-pull` fetches one; `-tree` does either for a directory.
+// An interrupted transfer is resumed by running the same command again: a
+// push picks up from the bytes staged beside the target, a pull from the
+// ".part" file beside the local path. See internal/transfer for what each
+// step checks.
+//
+// One tunnel carries every chunk. A transfer is hundreds of calls, and paying
+// a certificate and an mTLS handshake for each would cost more than the bytes.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/slchris/qubes-air/console/internal/transfer"
+	transportgrpc "github.com/slchris/qubes-air/console/internal/transport/grpc"
+)
+
+// transferJob is one -push or -pull.
+type transferJob struct {
+	local  string
+	remote string
+	pull   bool
+	tree   bool
+	chunk  int
+	// progressEvery spaces the progress lines on stderr.
+	progressEvery time.Duration
+}
+
+// run carries the job out over call.
+func (j transferJob) run(ctx context.Context, call transfer.CallFunc) (transfer.Response, error) {
+	var last time.Time
+	cli := &transfer.Client{
+		Call:      call,
+		ChunkSize: j.chunk,
+		Progress: func(done, total int64) {
+			if done < total && time.Since(last) < j.progressEvery {
+				return
+			}
+			last = time.Now()
+			if total > 0 {
+				log.Printf("%d/%d bytes (%d%%)", done, total, done*100/total)
+			}
+		},
+	}
+	switch {
+	case j.pull && j.tree:
+		return cli.PullTree(ctx, j.remote, j.local)
+	case j.pull:
+		return cli.Pull(ctx, j.remote, j.local, transfer.PullOptions{})
+	case j.tree:
+		return cli.PushTree(ctx, j.local, j.remote)
+	default:
+		return cli.Push(ctx, j.local, j.remote, transfer.PushOptions{})
+	}
+}
+
+// tunnelCall makes each transfer step a call on cli, bounded by perCall.
+// Like dialAndCall it retries only while the tunnel is not connected: a step
+// that reached the agent is not sent again here. The transfer client copes
+// with the one case where that matters — a write whose answer was lost — by
+// asking the agent how far it got.
+func tunnelCall(cli warmClient, remoteName string, perCall time.Duration) transfer.CallFunc {
+	return func(ctx context.Context, in []byte) ([]byte, error) {
+		ctx, cancel := context.WithTimeout(ctx, perCall)
+		defer cancel()
+		for {
+			out, err := cli.Call(ctx, remoteName, transfer.Service, in)
+			if !errors.Is(err, transportgrpc.ErrNotConnected) {
+				return out, err
+			}
+			select {
+			case <-ctx.Done():
+				return nil, fmt.Errorf("tunnel not connected within %s: %w", perCall, ctx.Err())
+			case <-time.After(200 * time.Millisecond):
+			}
+		}
+	}
+}
+
+// runTransfer serves -push and -pull. -timeout bounds each step rather than
+// the whole transfer, whose length is the size of the file; the transfer runs
+// until it is done, fails, or is interrupted.
+func runTransfer(ctx context.Context, identity identityFunc, endpoint, remoteName string, job transferJob, perCall time.Duration) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	pair, pool, err := identity()
+	must(err)
+	cli := newClient(pair, pool, endpoint, remoteName)
+	go func() { _ = cli.Start(ctx) }()
+
+	resp, err := job.run(ctx, tunnelCall(cli, remoteName, perCall))
+	if err != nil {
+		log.Fatalf("transfer failed: %v (run the same command again to resume)", err)
+	}
+	// sha256sum's format, so a script can check what arrived.
+	fmt.Printf("%s  %s\n", resp.SHA256, job.remote)
+}
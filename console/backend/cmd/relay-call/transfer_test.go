@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/slchris/qubes-air/console/internal/transfer"
+	transportgrpc "github.com/slchris/qubes-air/console/internal/transport/grpc"
+)
+
+// storeTunnel is a tunnel whose agent is a transfer store in this process.
+type storeTunnel struct {
+	store *transfer.Store
+	// down counts calls answered with ErrNotConnected before it connects.
+	down int
+}
+
+func (s *storeTunnel) Call(ctx context.Context, _, service string, in []byte) ([]byte, error) {
+	if s.down > 0 {
+		s.down--
+		return nil, transportgrpc.ErrNotConnected
+	}
+	if service != transfer.Service {
+		return nil, os.ErrInvalid
+	}
+	var req transfer.Request
+	if err := json.Unmarshal(in, &req); err != nil {
+		return nil, err
+	}
+	resp, err := s.store.Handle(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(resp)
+}
+
+func (s *storeTunnel) Status() transportgrpc.ClientStatus { return transportgrpc.ClientStatus{} }
+
+func TestTransferJobPushAndPull(t *testing.T) {
+	dir := t.TempDir()
+	remote := filepath.Join(dir, "remote")
+	if err := os.MkdirAll(remote, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	tunnel := &storeTunnel{
+		store: transfer.NewStore([]transfer.Prefix{{Path: remote}}, filepath.Join(dir, "spool")),
+		down:  2,
+	}
+	call := tunnelCall(tunnel, "work", time.Second)
+	ctx := context.Background()
+
+	local := filepath.Join(dir, "local.bin")
+	if err := os.WriteFile(local, []byte("relay-call payload"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	job := transferJob{local: local, remote: filepath.Join(remote, "f"), chunk: 5}
+	if _, err := job.run(ctx, call); err != nil {
+		t.Fatalf("push through a tunnel that was still connecting: %v", err)
+	}
+
+	back := filepath.Join(dir, "back.bin")
+	job = transferJob{local: back, remote: filepath.Join(remote, "f"), pull: true, chunk: 5}
+	resp, err := job.run(ctx, call)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(back); string(b) != "relay-call payload" {
+		t.Errorf("pulled %q", b)
+	}
+	if resp.SHA256 == "" {
+		t.Error("pull reported no hash")
+	}
+
+	// A directory goes out and comes back as a tree.
+	src := filepath.Join(dir, "src")
+	if err := os.MkdirAll(filepath.Join(src, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "sub", "x"), []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	job = transferJob{local: src, remote: filepath.Join(remote, "tree"), tree: true}
+	if _, err := job.run(ctx, call); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(dir, "dst")
+	job = transferJob{local: dst, remote: filepath.Join(remote, "tree"), tree: true, pull: true}
+	if _, err := job.run(ctx, call); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(filepath.Join(dst, "sub", "x")); string(b) != "x" {
+		t.Errorf("tree came back with %q", b)
+	}
+}
@@ -50,11 +50,14 @@ func main() {
 
 	clientCfg := transportgrpc.ClientConfig{
 		RemoteEndpoint: tc.RemoteEndpoint,
+		Endpoints:      transportgrpc.PrioritizedEndpoints(append([]string{tc.RemoteEndpoint}, tc.FallbackEndpoints...)...),
+		Tunnels:        tc.Tunnels,
 		RelayName:      tc.RelayName,
 		RemoteName:     tc.RemoteName,
 		KeepAlive:      time.Duration(tc.KeepAliveSeconds) * time.Second,
 		ReconnectMin:   time.Duration(tc.ReconnectMinSeconds) * time.Second,
 		ReconnectMax:   time.Duration(tc.ReconnectMaxSeconds) * time.Second,
+		ReversePolicy:  reversePolicy(tc.ReversePolicy),
 	}
 	if tc.VaultCerts {
 		// Rotation-aware: re-fetch certs from vault on each reconnect, so a vault
@@ -89,6 +92,34 @@ func main() {
 	log.Printf("shutdown")
 }
 
+// reversePolicy builds the relay's reverse-call policy from config. With none
+// configured every service stays allowed, as before there was a policy, but
+// under the default rate, concurrency and size limits — and the gap is logged.
+func reversePolicy(pc config.ReversePolicyConfig) *transportgrpc.ReversePolicy {
+	limits := func(l config.ReverseLimitsConfig) transportgrpc.ReverseLimits {
+		return transportgrpc.ReverseLimits{
+			Allow: l.Allow, RatePerMinute: l.RatePerMinute, Burst: l.Burst,
+			MaxConcurrent: l.MaxConcurrent, MaxPayload: l.MaxPayloadBytes,
+		}
+	}
+	if !pc.Configured() {
+		log.Printf("WARNING: no reverse_policy configured — a remote may ask for ANY reverse service " +
+			"(dom0 policy C still prompts); set transport.reverse_policy or QUBES_AIR_TRANSPORT_REVERSE_ALLOW")
+		return transportgrpc.NewReversePolicy(transportgrpc.ReversePolicyConfig{
+			Default: &transportgrpc.ReverseLimits{Allow: []string{transportgrpc.AllowAnyService}},
+		})
+	}
+	cfg := transportgrpc.ReversePolicyConfig{Remotes: make(map[string]transportgrpc.ReverseLimits, len(pc.Remotes))}
+	if pc.Default != nil {
+		def := limits(*pc.Default)
+		cfg.Default = &def
+	}
+	for name, l := range pc.Remotes {
+		cfg.Remotes[name] = limits(l)
+	}
+	return transportgrpc.NewReversePolicy(cfg)
+}
+
 // obtainMTLS builds the client TLS config from vault-cloud (via qrexec ask) when
 // VaultCerts is set, otherwise from the configured cert/key/CA file paths.
 func obtainMTLS(ctx context.Context, tc config.TransportConfig) (*tls.Config, error) {
@@ -0,0 +1,51 @@
+//go:build chaos
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/slchris/qubes-air/console/internal/config"
+	"github.com/slchris/qubes-air/console/internal/service"
+	"github.com/slchris/qubes-air/console/internal/transport"
+	"github.com/slchris/qubes-air/console/internal/transport/chaos"
+)
+
+// applyChaos wraps the main transport and the agent dialer in the configured
+// fault rules. Only this build (-tags chaos) links the chaos package at all;
+// see chaos_off.go for every other build.
+//
+// A rule that does not parse fails startup: a chaos run whose rules were
+// quietly dropped would report a resilience it never tested.
+func applyChaos(cfg config.ChaosConfig, xport transport.Transport, dialer service.AgentDialer) (transport.Transport, service.AgentDialer, error) {
+	if !cfg.Enabled {
+		return xport, dialer, nil
+	}
+	rules := make([]chaos.Rule, 0, len(cfg.Rules))
+	for _, r := range cfg.Rules {
+		rules = append(rules, chaos.Rule{
+			Fault:          chaos.Fault(r.Fault),
+			Target:         r.Target,
+			Service:        r.Service,
+			Probability:    r.Probability,
+			Count:          r.Count,
+			Latency:        time.Duration(r.LatencyMS) * time.Millisecond,
+			AfterBytes:     r.AfterBytes,
+			BytesPerSecond: r.BytesPerSecond,
+		})
+	}
+	seed := cfg.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	inj, err := chaos.New(seed, rules...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("transport.chaos: %w", err)
+	}
+	// The seed is logged so a run that found something can be replayed.
+	log.Printf("WARNING: Transport: CHAOS ENABLED (%d rules, seed %d); agent links will fail on purpose",
+		len(rules), seed)
+	return inj.Transport(xport), inj.Dialer(dialer), nil
+}
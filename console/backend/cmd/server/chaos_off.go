@@ -0,0 +1,22 @@
+//go:build !chaos
+
+package main
+
+import (
+	"log"
+
+	"github.com/slchris/qubes-air/console/internal/config"
+	"github.com/slchris/qubes-air/console/internal/service"
+	"github.com/slchris/qubes-air/console/internal/transport"
+)
+
+// applyChaos is a no-op outside a chaos build: a release binary cannot be
+// talked into failing its own links by a config file. It says so, so that a
+// chaos config deployed against the wrong binary is not mistaken for a fleet
+// that survived it.
+func applyChaos(cfg config.ChaosConfig, xport transport.Transport, dialer service.AgentDialer) (transport.Transport, service.AgentDialer, error) {
+	if cfg.Enabled {
+		log.Printf("WARNING: transport.chaos.enabled is set but this binary was built without -tags chaos; ignoring it")
+	}
+	return xport, dialer, nil
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
@@ -30,6 +31,7 @@ import (
 	"github.com/slchris/qubes-air/console/internal/service"
 	"github.com/slchris/qubes-air/console/internal/transport"
 	transportgrpc "github.com/slchris/qubes-air/console/internal/transport/grpc"
+	transportssh "github.com/slchris/qubes-air/console/internal/transport/ssh"
 )
 
 const (
@@ -133,11 +135,19 @@ type Dependencies struct {
 	settingsHandler   *handler.SettingsHandler
 	// jobHandler serves the orchestration audit trail.
 	jobHandler *handler.JobHandler
+	// transportHandler shows operators the transport's tunnel state and
+	// pings the remote through it.
+	transportHandler *handler.TransportHandler
+	// endpointHandler streams the agent endpoint table to relays.
+	endpointHandler *handler.EndpointHandler
+	// agentUpdateHandler stages agent updates across the fleet.
+	agentUpdateHandler *handler.AgentUpdateHandler
+	// agentVersionHandler reports which agent builds the fleet runs.
+	agentVersionHandler *handler.AgentVersionHandler
 	// bootstrapTokens mints the tokens cloud-init delivers.
 	bootstrapTokens *repository.BootstrapTokenRepository
-	// transport is the cross-machine gRPC transport (NoopTransport by default).
-	// Held here so it stays a live, injectable dependency; a service will consume
-	// it in the next stage-T wiring step.
+	// transport is the cross-machine gRPC transport (NoopTransport by default),
+	// the same one QubeService and transportHandler use.
 	transport transport.Transport
 	// runner serializes terraform work onto one goroutine. Nil when
 	// orchestration is disabled, in which case the service runs inline.
@@ -175,6 +185,14 @@ func (d *Dependencies) Close() {
 	// token, in which case the next sweep starts over, or did, in which case the
 	// certificate is registered and the next sweep skips the qube.
 	d.bootstraps.Shutdown(agentHealthShutdownGrace)
+	// The transport once nothing above can call over it. Only some have a
+	// connection to release (SSH does; the gRPC client ends with its context),
+	// and a chaos build's wrapper passes Close through to whichever it wraps.
+	if c, ok := d.transport.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			log.Printf("Error closing transport: %v", err)
+		}
+	}
 	if d.db != nil {
 		if err := d.db.Close(); err != nil {
 			log.Printf("Error closing database: %v", err)
@@ -199,7 +217,26 @@ func initDependencies(cfg *config.Config) (*Dependencies, error) {
 	// Zone and Qube repositories and services
 	zoneRepo := repository.NewZoneRepository(db)
 	qubeRepo := repository.NewQubeRepository(db)
+	// Relays resolve RemoteVMs through an endpoint table pushed from here.
+	// Every qube write below goes through the feed's wrapper, so a new address,
+	// a release or a purge reaches the relays as it is written rather than at
+	// their next poll.
+	endpoints := service.NewEndpointFeed(qubeRepo, cfg.Orchestrator.AgentListen)
+	qubeRepo = endpoints.Track(qubeRepo)
+	go endpoints.Run(context.Background())
 	zoneSvc := service.NewZoneService(zoneRepo, qubeRepo)
+	// How each zone's agents are reached: directly, or through a relay or jump
+	// host for a zone we have no route to. Every flow that dials an agent
+	// below takes this as its dialer, so they all agree per zone.
+	zoneTransports := buildZoneTransports(context.Background(), cfg.Transport,
+		cfg.Orchestrator.AgentListen, zoneRepo, xport)
+	// Fault injection, in a chaos build only. The registry keeps the raw
+	// transports (its routes need to see what they are); what is wrapped is
+	// the main transport's calls and every agent dial.
+	xport, agentDialer, err := applyChaos(cfg.Transport.Chaos, xport, zoneTransports)
+	if err != nil {
+		return nil, err
+	}
 
 	// The keyring is validated in cfg.Validate() at load time, so a
 	// misconfigured key fails startup rather than silently falling back to the
@@ -223,15 +260,18 @@ func initDependencies(cfg *config.Config) (*Dependencies, error) {
 	// The agent package is pinned by digest: the artifact store it comes from is
 	// unauthenticated plain HTTP, so the hash carried in the identity document
 	// is the only thing that makes the download safe to install.
+	agentPkg := service.AgentPackage{
+		AptMirror:         cfg.Orchestrator.AptMirror,
+		AptSecurityMirror: cfg.Orchestrator.AptSecurityMirror,
+		URL:               cfg.Orchestrator.AgentPackageURL,
+		SHA256:            cfg.Orchestrator.AgentPackageSHA256,
+		Version:           cfg.Orchestrator.AgentPackageVersion,
+		UpdateKey:         cfg.Orchestrator.AgentUpdateKey,
+		ManifestURL:       cfg.Orchestrator.AgentManifestURL,
+	}
 	certIssuer := service.NewCertIssuer(credentialRepo, agentCertRepo,
 		cfg.Orchestrator.AgentIdentityDir, cfg.Orchestrator.AgentListen,
-		service.AgentPackage{
-			AptMirror:         cfg.Orchestrator.AptMirror,
-			AptSecurityMirror: cfg.Orchestrator.AptSecurityMirror,
-			URL:               cfg.Orchestrator.AgentPackageURL,
-			SHA256:            cfg.Orchestrator.AgentPackageSHA256,
-			Version:           cfg.Orchestrator.AgentPackageVersion,
-		}).WithSnippetDatastore(cfg.Orchestrator.AgentSnippetDatastore).
+		agentPkg).WithSnippetDatastore(cfg.Orchestrator.AgentSnippetDatastore).
 		WithBootstrapTokens(bootstrapTokenRepo, 0)
 	if ds := cfg.Orchestrator.AgentSnippetDatastore; ds != "" {
 		// Said at startup because the two delivery paths are invisible from the
@@ -241,7 +281,16 @@ func initDependencies(cfg *config.Config) (*Dependencies, error) {
 			"terraform will not upload snippets and needs no SSH to a node",
 			ds, cfg.Orchestrator.AgentIdentityDir)
 	}
-	if cfg.Orchestrator.AgentPackageURL == "" {
+	if cfg.Orchestrator.AgentManifestURL != "" {
+		// Checked now so a bad release shows up in the startup log; a failure
+		// is not fatal, because the fetch is retried on every provision and
+		// nothing is rendered until it verifies.
+		if pkg, err := certIssuer.AgentPackage(context.Background()); err != nil {
+			log.Printf("WARNING: agent release manifest: %v; new qubes will not be provisioned until it verifies", err)
+		} else {
+			log.Printf("agent release manifest %s verified: version %s", cfg.Orchestrator.AgentManifestURL, pkg.Version)
+		}
+	} else if cfg.Orchestrator.AgentPackageURL == "" {
 		log.Printf("WARNING: orchestrator.agent_package_url is not set; " +
 			"new qubes will boot without an agent (set QUBES_AIR_AGENT_PACKAGE_URL and _SHA256)")
 	}
@@ -256,20 +305,22 @@ func initDependencies(cfg *config.Config) (*Dependencies, error) {
 	clusterScheduler := service.NewClusterScheduler(zoneRepo,
 		service.NewZoneCredentialResolver(zoneRepo, credentialRepo))
 
-	// The prober dials each qube's OWN address. It is what makes agent health a
-	// per-qube fact; the global transport below is pinned to a single
-	// configured endpoint and cannot answer for an arbitrary qube.
+	// The prober dials each qube's OWN address, over its zone's route. It is
+	// what makes agent health a per-qube fact; the global transport below is
+	// pinned to a single configured endpoint and cannot answer for an
+	// arbitrary qube.
 	agentProber := service.NewAgentProber(certIssuer, agentCertRepo,
 		cfg.Orchestrator.AgentListen,
-		time.Duration(cfg.Orchestrator.AgentProbeTimeoutSeconds)*time.Second)
+		time.Duration(cfg.Orchestrator.AgentProbeTimeoutSeconds)*time.Second).
+		WithDialer(agentDialer)
 
 	// Certificate renewal over the agent's existing mTLS channel. Built before
 	// the qube service because the service publishes the monitor's warnings into
 	// agent health on every probe — a renewal failure recorded only once would be
 	// erased by the next successful probe, leaving the fleet reading healthy
 	// until the day its certificates ran out.
-	certRenewals := buildCertRenewals(cfg, certIssuer, qubeRepo, agentCertRepo)
-	bootstraps := buildBootstrapMonitor(cfg, certIssuer, bootstrapTokenRepo, agentCertRepo, qubeRepo)
+	certRenewals := buildCertRenewals(cfg, certIssuer, qubeRepo, agentCertRepo, agentDialer)
+	bootstraps := buildBootstrapMonitor(cfg, certIssuer, bootstrapTokenRepo, agentCertRepo, qubeRepo, agentDialer)
 
 	// Data-disk unlocking rides on bootstrap: after a qube installs its identity
 	// (first provision, and again on every resume) the console derives the qube's
@@ -277,14 +328,50 @@ func initDependencies(cfg *config.Config) (*Dependencies, error) {
 	// /data. The master lives in the same encrypted credential store as the CA
 	// key and never leaves the console, so an encrypted qube's disk is only ever
 	// ciphertext on the remote. Non-encrypted qubes never trigger it.
+	//
+	// A minimum agent version, when set, is checked on the unlock's own tunnel
+	// before the key is sent: the key is the one thing an agent with a known
+	// bug should not be handed.
+	versionPolicy := service.NewAgentVersionPolicy(cfg.Orchestrator.AgentMinVersion,
+		cfg.Orchestrator.AgentMinVersionPolicy != config.AgentMinVersionWarn)
 	dataUnlocker := service.NewAgentDataUnlocker(
 		certIssuer, service.NewDataKeyManager(credentialRepo),
-		cfg.Orchestrator.AgentListen, service.DefaultDataUnlockTimeout)
+		cfg.Orchestrator.AgentListen, service.DefaultDataUnlockTimeout).
+		WithDialer(agentDialer).
+		WithVersionPolicy(versionPolicy)
 	bootstraps.WithAfterBootstrap(dataUnlocker.UnlockData)
 
+	// Each agent's effective configuration is asked of the agent, on the same
+	// verified path, because it is edited and reloaded on the remote.
+	agentInspector := service.NewAgentInspector(
+		certIssuer, cfg.Orchestrator.AgentListen, service.DefaultAgentInspectTimeout).
+		WithDialer(agentDialer)
+
+	// Files move through the agent's qubesair.Transfer, on the same verified
+	// path; the agent's helper decides which paths, not the console.
+	fileTransfer := service.NewFileTransfer(certIssuer, cfg.Orchestrator.AgentListen).
+		WithDialer(agentDialer)
+
+	// Terminals are the agent's qubesair.Shell, streamed over the same path;
+	// the WebSocket handler audits each session.
+	agentShell := service.NewAgentShell(certIssuer, cfg.Orchestrator.AgentListen).
+		WithDialer(agentDialer)
+
+	// Agent updates go through the agent's qubesair.Update. The remote checks
+	// the package against the key cloud-init pinned, and rolls itself back
+	// unless the new agent answers here; the console only stages rollouts.
+	agentUpdater := service.NewAgentUpdater(certIssuer, qubeRepo, cfg.Orchestrator.AgentListen, agentPkg).
+		WithDialer(agentDialer).
+		WithPackageSource(certIssuer.AgentPackage)
+	if cfg.Orchestrator.AgentUpdateKey == "" {
+		log.Printf("WARNING: orchestrator.agent_update_key is not set; " +
+			"new qubes will refuse agent updates (set QUBES_AIR_AGENT_UPDATE_KEY)")
+	}
+
 	qubeSvcOpts := []service.QubeServiceOption{
 		service.WithExecutor(exec),
 		service.WithTransport(xport),
+		service.WithZoneTransports(zoneTransports),
 		service.WithAgentProber(agentProber),
 		// Keeps a renewal failure attached to the qube's health on every probe,
 		// so it stays visible for the weeks between "renewal broke" and "the
@@ -306,7 +393,7 @@ func initDependencies(cfg *config.Config) (*Dependencies, error) {
 
 	jobRepo := repository.NewJobRepository(db)
 	qubeSvc, runner, agents, jobLogs := startOrchestration(
-		cfg.Orchestrator, cfg.JobLogDir(), jobRepo, qubeRepo, zoneRepo, exec, qubeSvcOpts)
+		cfg.Orchestrator, cfg.JobLogDir(), jobRepo, qubeRepo, zoneRepo, exec, dataUnlocker, qubeSvcOpts)
 
 	certRenewals.Start()
 	bootstraps.Start()
@@ -331,22 +418,33 @@ func initDependencies(cfg *config.Config) (*Dependencies, error) {
 	settingsRepo := repository.NewSettingsRepository(db)
 	settingsSvc := service.NewSettingsService(settingsRepo)
 
+	qubeHandler := handler.NewQubeHandler(qubeSvc,
+		handler.WithCertRepository(agentCertRepo),
+		handler.WithAgentInspector(agentInspector),
+		handler.WithFileTransfer(fileTransfer),
+		handler.WithShell(agentShell),
+		handler.WithDataLocker(dataUnlocker))
+
 	return &Dependencies{
-		db:                db,
-		zoneHandler:       handler.NewZoneHandler(zoneSvc, handler.WithCapacityReader(clusterScheduler)),
-		qubeHandler:       handler.NewQubeHandler(qubeSvc, handler.WithCertRepository(agentCertRepo)),
-		infraHandler:      handler.NewInfraHandler(infraSvc),
-		credentialHandler: handler.NewCredentialHandler(credentialSvc),
-		billingHandler:    handler.NewBillingHandler(),
-		monitoringHandler: handler.NewMonitoringHandler(),
-		settingsHandler:   handler.NewSettingsHandler(settingsSvc),
-		jobHandler:        handler.NewJobHandler(jobRepo, jobLogs),
-		bootstraps:        bootstraps,
-		bootstrapTokens:   bootstrapTokenRepo,
-		transport:         xport,
-		runner:            runner,
-		agents:            agents,
-		certRenewals:      certRenewals,
+		db:                  db,
+		zoneHandler:         handler.NewZoneHandler(zoneSvc, handler.WithCapacityReader(clusterScheduler)),
+		qubeHandler:         qubeHandler,
+		infraHandler:        handler.NewInfraHandler(infraSvc),
+		credentialHandler:   handler.NewCredentialHandler(credentialSvc),
+		billingHandler:      handler.NewBillingHandler(),
+		monitoringHandler:   handler.NewMonitoringHandler(),
+		settingsHandler:     handler.NewSettingsHandler(settingsSvc),
+		jobHandler:          handler.NewJobHandler(jobRepo, jobLogs),
+		transportHandler:    handler.NewTransportHandler(service.NewTransportService(xport, cfg.Transport.RemoteName)),
+		endpointHandler:     handler.NewEndpointHandler(endpoints),
+		agentUpdateHandler:  handler.NewAgentUpdateHandler(agentUpdater),
+		agentVersionHandler: handler.NewAgentVersionHandler(service.NewAgentInventory(qubeRepo, versionPolicy)),
+		bootstraps:          bootstraps,
+		bootstrapTokens:     bootstrapTokenRepo,
+		transport:           xport,
+		runner:              runner,
+		agents:              agents,
+		certRenewals:        certRenewals,
 	}, nil
 }
 
@@ -368,6 +466,7 @@ func startOrchestration(
 	qubeRepo repository.QubeRepository,
 	zoneRepo repository.ZoneRepository,
 	exec orchestrator.Executor,
+	dataLocker *service.AgentDataUnlocker,
 	qubeSvcOpts []service.QubeServiceOption,
 ) (service.QubeService, *orchestrator.Runner, *service.AgentHealthMonitor, *orchestrator.JobLogStore) {
 	// agents is assigned below, once the service it probes through exists, but
@@ -417,6 +516,9 @@ func startOrchestration(
 		runner = orchestrator.NewRunner(orchestrator.RunnerConfig{
 			Executor: exec,
 			Store:    jobRepo,
+			// An encrypted qube's /data is closed by its agent before the
+			// suspend or release that destroys the VM holding its key.
+			BeforeRun: makeTeardownHook(qubeRepo, dataLocker),
 			OnDone: makeCompletionHook(qubeRepo,
 				func() *service.AgentHealthMonitor { return agents }, registrar),
 			Logs: jobLogs,
@@ -465,6 +567,30 @@ func buildAgentHealthMonitor(
 	}, opts...)
 }
 
+// makeTeardownHook returns the runner's BeforeRun callback: ahead of a suspend
+// or release it has the qube's agent sync, unmount and close its encrypted
+// /data, so the key leaves the remote's memory when the console says so and
+// the disk is kept consistent rather than cut off mid-write with the VM.
+//
+// Here, on the worker, and not in the HTTP request that queued the job: a
+// suspend can wait behind another qube's apply, and locking at submission
+// would leave the qube running without its data for as long as that takes.
+// Destroy is left out; it discards the disk, so there is nothing to keep
+// consistent, and the VM takes the key with it.
+func makeTeardownHook(qubeRepo repository.QubeRepository, locker *service.AgentDataUnlocker) orchestrator.Preparation {
+	return func(ctx context.Context, j *orchestrator.Job) string {
+		if j.Action != orchestrator.ActionSuspend && j.Action != orchestrator.ActionRelease {
+			return ""
+		}
+		qube, err := qubeRepo.GetByID(ctx, j.QubeID)
+		if err != nil {
+			log.Printf("orchestrator: job %s: cannot load qube to lock its data disk: %v", j.ID, err)
+			return ""
+		}
+		return locker.LockData(ctx, qube)
+	}
+}
+
 // makeCompletionHook returns the callback that records a job's outcome on the
 // qube. It is the only writer of a terminal status once operations are
 // asynchronous: nothing else is still around when terraform finishes.
@@ -624,6 +750,9 @@ func buildTransport(ctx context.Context, cfg config.TransportConfig) transport.T
 			"transport.remote_endpoint and mTLS material to drive cross-machine qrexec)")
 		return transport.NoopTransport{}
 	}
+	if cfg.Kind == config.TransportKindSSH {
+		return buildSSHTransport(cfg.SSH)
+	}
 
 	tlsCfg, err := obtainClientMTLS(ctx, cfg)
 	if err != nil {
@@ -639,12 +768,15 @@ func buildTransport(ctx context.Context, cfg config.TransportConfig) transport.T
 
 	client := transportgrpc.NewClient(transportgrpc.ClientConfig{
 		RemoteEndpoint: cfg.RemoteEndpoint,
+		Endpoints:      transportgrpc.PrioritizedEndpoints(append([]string{cfg.RemoteEndpoint}, cfg.FallbackEndpoints...)...),
+		Tunnels:        cfg.Tunnels,
 		RelayName:      cfg.RelayName,
 		RemoteName:     cfg.RemoteName,
 		KeepAlive:      time.Duration(cfg.KeepAliveSeconds) * time.Second,
 		ReconnectMin:   time.Duration(cfg.ReconnectMinSeconds) * time.Second,
 		ReconnectMax:   time.Duration(cfg.ReconnectMaxSeconds) * time.Second,
 		TLS:            tlsCfg,
+		ReversePolicy:  reversePolicy(cfg.ReversePolicy),
 	}, reverse)
 
 	go func() {
@@ -657,6 +789,101 @@ func buildTransport(ctx context.Context, cfg config.TransportConfig) transport.T
 	return client
 }
 
+// buildZoneTransports builds the relays and routes each configured zone.
+//
+// Zones not listed take the direct route over the main transport, which is
+// exactly the console's behaviour before zones could differ, so a config with
+// no zones changes nothing. A relay is built like the main transport and falls
+// back the same way when its material is unusable; its zones then fail every
+// dial with that reason instead of being dialed direct.
+func buildZoneTransports(
+	ctx context.Context, cfg config.TransportConfig, agentListen string,
+	zones service.ZoneGetter, main transport.Transport,
+) *service.ZoneTransports {
+	routes := service.NewZoneTransports(zones,
+		service.NewZoneRoute(service.ZoneRouteDirect, "", main, "", agentListen))
+	relays := make(map[string]transport.Transport, len(cfg.Relays))
+	for name, rc := range cfg.Relays {
+		rc.Enabled = true
+		log.Printf("Transport: building relay %q", name)
+		relays[name] = buildTransport(ctx, rc)
+	}
+	for zone, zc := range cfg.Zones {
+		xport := main
+		if zc.Relay != "" {
+			xport = relays[zc.Relay]
+		}
+		route := service.NewZoneRoute(zc.Kind, zc.Relay, xport, zc.Forward, agentListen)
+		routes.Route(zone, route)
+		log.Printf("Transport: zone %q → %s", zone, route)
+	}
+	return routes
+}
+
+// buildSSHTransport builds the SSH transport, for sites whose only egress is
+// SSH. Like the gRPC path, a key or host-key file that cannot be read falls
+// back to NoopTransport rather than failing startup: the console still manages
+// the fleet, and every cross-machine call says why it cannot.
+func buildSSHTransport(cfg config.SSHTransportConfig) transport.Transport {
+	signer, err := transportssh.LoadKey(cfg.KeyFile)
+	if err != nil {
+		log.Printf("Transport: SSH key %s unusable (%v); falling back to NoopTransport", cfg.KeyFile, err)
+		return transport.NoopTransport{}
+	}
+	hostKeys, err := transportssh.KnownHosts(cfg.KnownHostsFile)
+	if err != nil {
+		log.Printf("Transport: SSH known_hosts %s unusable (%v); falling back to NoopTransport", cfg.KnownHostsFile, err)
+		return transport.NoopTransport{}
+	}
+	t, err := transportssh.New(transportssh.Config{
+		Address:         cfg.Address,
+		User:            cfg.User,
+		Signer:          signer,
+		HostKeyCallback: hostKeys,
+		Command:         cfg.Command,
+		KeepAlive:       time.Duration(cfg.KeepAliveSeconds) * time.Second,
+	})
+	if err != nil {
+		log.Printf("Transport: %v; falling back to NoopTransport", err)
+		return transport.NoopTransport{}
+	}
+	helper := cfg.Command
+	if len(helper) == 0 {
+		helper = []string{transportssh.DefaultCommand}
+	}
+	log.Printf("Transport: ENABLED (SSH → %s@%s, helper=%v; no reverse calls over this transport)",
+		cfg.User, cfg.Address, helper)
+	return t
+}
+
+// reversePolicy builds the relay's reverse-call policy from config. With none
+// configured every service stays allowed, as before there was a policy, but
+// under the default rate, concurrency and size limits — and the gap is logged.
+func reversePolicy(pc config.ReversePolicyConfig) *transportgrpc.ReversePolicy {
+	limits := func(l config.ReverseLimitsConfig) transportgrpc.ReverseLimits {
+		return transportgrpc.ReverseLimits{
+			Allow: l.Allow, RatePerMinute: l.RatePerMinute, Burst: l.Burst,
+			MaxConcurrent: l.MaxConcurrent, MaxPayload: l.MaxPayloadBytes,
+		}
+	}
+	if !pc.Configured() {
+		log.Printf("WARNING: no reverse_policy configured — a remote may ask for ANY reverse service " +
+			"(dom0 policy C still prompts); set transport.reverse_policy or QUBES_AIR_TRANSPORT_REVERSE_ALLOW")
+		return transportgrpc.NewReversePolicy(transportgrpc.ReversePolicyConfig{
+			Default: &transportgrpc.ReverseLimits{Allow: []string{transportgrpc.AllowAnyService}},
+		})
+	}
+	cfg := transportgrpc.ReversePolicyConfig{Remotes: make(map[string]transportgrpc.ReverseLimits, len(pc.Remotes))}
+	if pc.Default != nil {
+		def := limits(*pc.Default)
+		cfg.Default = &def
+	}
+	for name, l := range pc.Remotes {
+		cfg.Remotes[name] = limits(l)
+	}
+	return transportgrpc.NewReversePolicy(cfg)
+}
+
 // obtainClientMTLS gets the client TLS config either from vault-cloud (via
 // qrexec ask, in memory) when VaultCerts is set, or from the configured files.
 func obtainClientMTLS(ctx context.Context, cfg config.TransportConfig) (*tls.Config, error) {
@@ -727,11 +954,12 @@ func buildCertRenewals(
 	certIssuer *service.CertIssuer,
 	qubeRepo repository.QubeRepository,
 	certs *repository.AgentCertRepository,
+	dialer service.AgentDialer,
 ) *service.CertRenewalMonitor {
 	return service.NewCertRenewalMonitor(
 		qubeRepo, certs,
 		service.NewCertRenewer(certIssuer, certIssuer, certs, certs,
-			cfg.Orchestrator.AgentListen, service.DefaultCertRenewalTimeout),
+			cfg.Orchestrator.AgentListen, service.DefaultCertRenewalTimeout).WithDialer(dialer),
 		qubeRepo,
 		service.CertRenewalConfig{
 			Interval:  time.Duration(cfg.Orchestrator.AgentCertRenewIntervalSeconds) * time.Second,
@@ -746,9 +974,10 @@ func buildBootstrapMonitor(
 	tokens *repository.BootstrapTokenRepository,
 	certs *repository.AgentCertRepository,
 	qubes repository.QubeRepository,
+	dialer service.AgentDialer,
 ) *service.BootstrapMonitor {
 	return service.NewBootstrapMonitor(qubes, certs,
-		buildBootstrapper(cfg, certIssuer, tokens, certs),
+		buildBootstrapper(cfg, certIssuer, tokens, certs).WithDialer(dialer),
 		time.Duration(cfg.Orchestrator.AgentBootstrapIntervalSeconds)*time.Second)
 }
 
@@ -805,6 +1034,10 @@ func setupRouter(cfg *config.Config, deps *Dependencies) *gin.Engine {
 	deps.billingHandler.RegisterRoutes(v1)
 	deps.monitoringHandler.RegisterRoutes(v1)
 	deps.settingsHandler.RegisterRoutes(v1)
+	deps.transportHandler.RegisterRoutes(v1)
+	deps.endpointHandler.RegisterRoutes(v1)
+	deps.agentUpdateHandler.RegisterRoutes(v1)
+	deps.agentVersionHandler.RegisterRoutes(v1)
 
 	v1.GET("/status", statusHandler(deps.db))
 
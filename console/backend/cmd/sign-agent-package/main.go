@@ -0,0 +1,191 @@
+// Command sign-agent-package makes the signatures qubesair.Update checks.
+//
+// A remote installs an agent package only when it comes with a detached
+// Ed25519 signature by a key pinned in its /etc/qubes-air/update.pub. The
+// private key belongs wherever packages are built, not on the console: a
+// console that could sign could also push anything it liked to every remote,
+// and the point of the signature is that it cannot.
+//
+//	sign-agent-package -genkey release.key
+//	    writes a new private key (mode 0600) and prints the public key — the
+//	    value of orchestrator.agent_update_key.
+//
+//	sign-agent-package -key release.key qubes-air-agent_1.4.0_amd64.deb
+//	    writes qubes-air-agent_1.4.0_amd64.deb.sig next to the package and
+//	    prints the package's SHA-256. Publish both files side by side.
+//
+//	sign-agent-package -key release.key -manifest release-manifest \
+//	        qubes-air-agent_1.4.0_amd64.deb qubes-air-agent_1.4.0_arm64.deb
+//	    signs each package as above and writes a signed release manifest
+//	    naming all of them, for orchestrator.agent_manifest_url. The packages
+//	    must be one version; publish the manifest, its .sig and the packages in
+//	    one directory.
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/slchris/qubes-air/console/internal/agentupdate"
+)
+
+func main() {
+	log.SetFlags(0)
+
+	genkey := flag.String("genkey", "", "Write a new private key to this file and print its public key")
+	keyFile := flag.String("key", "", "Private key to sign with")
+	manifest := flag.String("manifest", "", "Also write a signed release manifest for the packages to this file")
+	minProtocol := flag.String("min-protocol", "v1", "Lowest wire protocol (as the handshake names it: v1, v2) the packages in the manifest work with")
+	flag.Parse()
+
+	var err error
+	switch {
+	case *genkey != "":
+		err = generate(*genkey, os.Stdout)
+	case *keyFile != "" && *manifest != "" && flag.NArg() > 0:
+		err = release(*keyFile, *manifest, *minProtocol, flag.Args(), os.Stdout)
+	case *keyFile != "" && flag.NArg() > 0:
+		for _, pkg := range flag.Args() {
+			if err = sign(*keyFile, pkg, os.Stdout); err != nil {
+				break
+			}
+		}
+	default:
+		err = errors.New("usage: sign-agent-package -genkey <file> | -key <file> [-manifest <file>] <package.deb>...")
+	}
+	if err != nil {
+		log.Fatalf("sign-agent-package: %v", err)
+	}
+}
+
+// generate writes a new private key as its base64 seed and prints the public
+// half. It refuses to replace an existing key: the remotes pinned that one.
+func generate(path string, out io.Writer) error {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600) // #nosec G304 -- operator's path
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(f, base64.StdEncoding.EncodeToString(priv.Seed())); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(out, base64.StdEncoding.EncodeToString(pub))
+	return err
+}
+
+// sign writes pkg's detached signature to pkg+agentupdate.SignatureSuffix and
+// prints the package's digest, the other half of what a remote checks.
+func sign(keyPath, pkg string, out io.Writer) error {
+	priv, err := loadKey(keyPath)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(pkg) // #nosec G304 -- operator's path
+	if err != nil {
+		return err
+	}
+	if err := writeSignature(priv, pkg, data); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "%s  %s\n", digest(data), pkg)
+	return err
+}
+
+// packageName is how the Debian tooling names an agent package, and the only
+// place a manifest's version and architectures can honestly come from.
+var packageName = regexp.MustCompile(`^qubes-air-agent_([^_]+)_([^_]+)\.deb$`)
+
+// release signs every package and writes a manifest naming them, with its own
+// signature beside it. The manifest is parsed back before it is written: one
+// the console would refuse is better caught here than on the day it ships.
+func release(keyPath, manifestPath, minProtocol string, pkgs []string, out io.Writer) error {
+	m := agentupdate.Manifest{MinProtocol: minProtocol, Packages: map[string]agentupdate.ManifestPackage{}}
+	for _, pkg := range pkgs {
+		name := packageName.FindStringSubmatch(filepath.Base(pkg))
+		if name == nil {
+			return fmt.Errorf("%s is not named qubes-air-agent_<version>_<arch>.deb", pkg)
+		}
+		if m.Version != "" && m.Version != name[1] {
+			return fmt.Errorf("%s is not version %s: a manifest is one release", pkg, m.Version)
+		}
+		if _, dup := m.Packages[name[2]]; dup {
+			return fmt.Errorf("two %s packages", name[2])
+		}
+		m.Version = name[1]
+		data, err := os.ReadFile(pkg) // #nosec G304 -- operator's path
+		if err != nil {
+			return err
+		}
+		m.Packages[name[2]] = agentupdate.ManifestPackage{File: filepath.Base(pkg), SHA256: digest(data)}
+	}
+	data := m.Marshal()
+	if _, err := agentupdate.ParseManifest(data); err != nil {
+		return err
+	}
+	for _, pkg := range pkgs {
+		if err := sign(keyPath, pkg, out); err != nil {
+			return err
+		}
+	}
+	priv, err := loadKey(keyPath)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(manifestPath, data, 0o644); err != nil { // #nosec G306 -- a public manifest
+		return err
+	}
+	if err := writeSignature(priv, manifestPath, data); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "%s  %s\n", digest(data), manifestPath)
+	return err
+}
+
+func loadKey(keyPath string) (ed25519.PrivateKey, error) {
+	raw, err := os.ReadFile(keyPath) // #nosec G304 -- operator's path
+	if err != nil {
+		return nil, err
+	}
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(raw)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%s is not a key written by -genkey", keyPath)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// writeSignature signs data and writes the signature beside path.
+func writeSignature(priv ed25519.PrivateKey, path string, data []byte) error {
+	sig := ed25519.Sign(priv, data)
+	// Checked against the public half before it is written, as a remote will:
+	// a signature that does not verify is worse than none, because it looks
+	// like one.
+	if err := agentupdate.Verify([]ed25519.PublicKey{priv.Public().(ed25519.PublicKey)}, data, sig); err != nil {
+		return err
+	}
+	return os.WriteFile(path+agentupdate.SignatureSuffix,
+		[]byte(base64.StdEncoding.EncodeToString(sig)+"\n"), 0o644) // #nosec G306 -- a public signature
+}
+
+func digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/slchris/qubes-air/console/internal/agentupdate"
+)
+
+func TestSignedPackageVerifiesAgainstThePrintedKey(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "release.key")
+	var pubOut bytes.Buffer
+	if err := generate(keyFile, &pubOut); err != nil {
+		t.Fatal(err)
+	}
+	if err := generate(keyFile, &bytes.Buffer{}); err == nil {
+		t.Error("-genkey replaced an existing key")
+	}
+	keys, err := agentupdate.ParsePublicKeys(pubOut.Bytes())
+	if err != nil {
+		t.Fatalf("printed public key does not parse: %v", err)
+	}
+
+	pkg := filepath.Join(dir, "qubes-air-agent_1.4.0_amd64.deb")
+	if err := os.WriteFile(pkg, []byte("package"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var sumOut bytes.Buffer
+	if err := sign(keyFile, pkg, &sumOut); err != nil {
+		t.Fatal(err)
+	}
+	if f := strings.Fields(sumOut.String()); len(f) != 2 || len(f[0]) != 64 || f[1] != pkg {
+		t.Errorf("printed digest = %q", sumOut.String())
+	}
+	raw, err := os.ReadFile(pkg + agentupdate.SignatureSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := agentupdate.ParseSignature(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := agentupdate.Verify(keys, []byte("package"), sig); err != nil {
+		t.Errorf("signature does not verify: %v", err)
+	}
+}
+
+func TestReleaseManifestVerifiesAndNamesEveryPackage(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "release.key")
+	var pubOut bytes.Buffer
+	if err := generate(keyFile, &pubOut); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := agentupdate.ParsePublicKeys(pubOut.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pkgs []string
+	for _, arch := range []string{"amd64", "arm64"} {
+		pkg := filepath.Join(dir, "qubes-air-agent_1.4.0_"+arch+".deb")
+		if err := os.WriteFile(pkg, []byte("package "+arch), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		pkgs = append(pkgs, pkg)
+	}
+	manifestFile := filepath.Join(dir, "release-manifest")
+	if err := release(keyFile, manifestFile, "v1", pkgs, &bytes.Buffer{}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(manifestFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := os.ReadFile(manifestFile + agentupdate.SignatureSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := agentupdate.VerifyManifest(keys, data, sig)
+	if err != nil {
+		t.Fatalf("manifest does not verify: %v", err)
+	}
+	if m.Version != "1.4.0" || len(m.Packages) != 2 || m.Packages["arm64"].File != "qubes-air-agent_1.4.0_arm64.deb" {
+		t.Errorf("manifest = %+v", m)
+	}
+	for _, pkg := range pkgs {
+		if _, err := os.Stat(pkg + agentupdate.SignatureSuffix); err != nil {
+			t.Errorf("%s was not signed: %v", pkg, err)
+		}
+	}
+
+	// Two versions are two releases; one manifest naming both would say a
+	// qube's architecture decides which version it runs.
+	other := filepath.Join(dir, "qubes-air-agent_1.5.0_arm64.deb")
+	if err := os.WriteFile(other, []byte("package"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := release(keyFile, manifestFile, "v1", []string{pkgs[0], other}, &bytes.Buffer{}); err == nil {
+		t.Error("mixed versions made a manifest")
+	}
+}
@@ -0,0 +1,290 @@
+// Package agentconfig is the agent's configuration file: which services it
+// runs and how, what it forwards, and what it logs — one versioned YAML
+// document, validated as a whole and swapped as a whole.
+//
+// It sits beside internal/agent rather than inside it because it joins that
+// package to the transport's forward policy, and the transport's tests already
+// import internal/agent; a config type in either would close the cycle.
+//
+// Before this file the agent was configured by flags (-allow, -service-dir,
+// -forwards), and the flags are still honoured when no file exists. They are
+// read into the same Config, so the console sees one report whichever way an
+// agent was set up.
+package agentconfig
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/slchris/qubes-air/console/internal/agent"
+	"github.com/slchris/qubes-air/console/internal/deadman"
+	transportgrpc "github.com/slchris/qubes-air/console/internal/transport/grpc"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultPath is where the packaged agent looks for its configuration.
+const DefaultPath = "/etc/qubes-air/agent.yaml"
+
+// Version is the only file version this agent reads. A file written for a
+// later one is refused, not read as best it can: a newer field this agent
+// skipped could be the one that narrows what a service may do.
+const Version = 1
+
+// ErrInvalidConfig means a configuration failed validation.
+var ErrInvalidConfig = errors.New("invalid agent config")
+
+// File is the configuration file as written.
+type File struct {
+	// Version must be Version.
+	Version int `yaml:"version" json:"version"`
+	// ServiceDir holds the service implementations (default /etc/qubes-rpc).
+	ServiceDir string `yaml:"service_dir,omitempty" json:"service_dir,omitempty"`
+	// Services are the allowed services. At least one is required.
+	Services []Service `yaml:"services" json:"services"`
+	// Forwards is the qubesair.StreamTCP policy. Absent means the default
+	// loopback GUI ranges, as with no -forwards file; an explicit empty list
+	// means no forwards at all.
+	Forwards []transportgrpc.Forward `yaml:"forwards,omitempty" json:"forwards"`
+	// Logging says what the agent logs beyond its start-up summary.
+	Logging Logging `yaml:"logging,omitempty" json:"logging"`
+	// Status is what qubesair.Status reports on besides the agent itself.
+	Status Status `yaml:"status,omitempty" json:"status"`
+	// DeadMan is when the agent locks the data disk on its own. Absent is
+	// never.
+	DeadMan DeadMan `yaml:"dead_man,omitempty" json:"dead_man"`
+}
+
+// Service is how one allowed service runs.
+type Service struct {
+	// Name is the service's base name, without any "+argument".
+	Name string `yaml:"name" json:"name"`
+	// TimeoutSeconds bounds one execution (default 120).
+	TimeoutSeconds int `yaml:"timeout_seconds,omitempty" json:"timeout_seconds,omitempty"`
+	// MaxOutputBytes caps what the service may return (default 16 MiB).
+	MaxOutputBytes int `yaml:"max_output_bytes,omitempty" json:"max_output_bytes,omitempty"`
+	// RunAs is a local user to run the service as; empty is the agent's own.
+	RunAs string `yaml:"run_as,omitempty" json:"run_as,omitempty"`
+	// Arguments is a regular expression the "+argument" must match in full.
+	// Empty accepts any argument.
+	Arguments string `yaml:"arguments,omitempty" json:"arguments,omitempty"`
+}
+
+// Logging is what the agent logs.
+type Logging struct {
+	// Calls logs every service call with its caller, outcome and duration.
+	Calls bool `yaml:"calls,omitempty" json:"calls"`
+}
+
+// Status is what qubesair.Status looks at. Like forwards, an absent list is
+// the default and an explicit empty one is nothing.
+type Status struct {
+	// Units are the systemd units whose state is reported (default
+	// DefaultStatusUnits). They are meant to be running: the console counts
+	// one that is not as a problem with the qube.
+	Units []string `yaml:"units,omitempty" json:"units"`
+	// Disks are paths whose filesystem's free space is reported (default
+	// "/"). The data disk is reported whether or not it is listed.
+	Disks []string `yaml:"disks,omitempty" json:"disks"`
+}
+
+// DeadMan is the dead man's switch (internal/deadman).
+type DeadMan struct {
+	// SilenceHours locks the data disk when no call has come from the
+	// console for this many hours; 0 never. Hours, not minutes: the console
+	// probes every minute, and a limit short enough to trip on a console
+	// restart would lock remotes for nothing.
+	SilenceHours int `yaml:"silence_hours,omitempty" json:"silence_hours,omitempty"`
+	// OnRevocation locks it when the console reports this agent's
+	// certificate revoked.
+	OnRevocation bool `yaml:"on_revocation,omitempty" json:"on_revocation,omitempty"`
+}
+
+// DefaultStatusUnits are the units a packaged agent reports on: the agent and
+// its helper, without which every privileged service fails.
+var DefaultStatusUnits = []string{"qubes-air-agent.service", "qubes-air-helper.service"}
+
+// statusUnit is a unit name systemctl would take as one, and never as an
+// option.
+var statusUnit = regexp.MustCompile(`^[A-Za-z0-9:_.\\@-]+$`)
+
+// Config is a validated configuration, resolved into what the invoker and
+// the transport consume.
+type Config struct {
+	// Source is the file it was read from, or "flags".
+	Source string
+	// Digest is the SHA-256 of the file, so two agents with the same file can
+	// be told apart from two that merely look alike in a summary.
+	Digest string
+	File   File
+
+	Policy   *agent.Policy
+	Forwards *transportgrpc.ForwardPolicy
+}
+
+// StatusUnits are the units qubesair.Status reports on, default applied.
+func (c *Config) StatusUnits() []string {
+	if c.File.Status.Units == nil {
+		return DefaultStatusUnits
+	}
+	return c.File.Status.Units
+}
+
+// StatusDisks are the paths qubesair.Status reports free space for, default
+// applied.
+func (c *Config) StatusDisks() []string {
+	if c.File.Status.Disks == nil {
+		return []string{"/"}
+	}
+	return c.File.Status.Disks
+}
+
+// DeadManPolicy is the dead man's switch's policy.
+func (c *Config) DeadManPolicy() deadman.Policy {
+	return deadman.Policy{
+		Silence:      time.Duration(c.File.DeadMan.SilenceHours) * time.Hour,
+		OnRevocation: c.File.DeadMan.OnRevocation,
+	}
+}
+
+// Load reads and validates the file at path.
+//
+// Like the forward policy, a file that fails validation is an error, never a
+// partial load: serving the services that did parse would quietly drop the
+// restriction the operator got wrong.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path) // #nosec G304 -- operator-supplied path
+	if err != nil {
+		return nil, fmt.Errorf("read agent config: %w", err)
+	}
+	cfg, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	cfg.Source = path
+	return cfg, nil
+}
+
+// Parse validates a configuration document.
+func Parse(data []byte) (*Config, error) {
+	var f File
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	// Unknown keys are rejected: "run-as:" for "run_as:" would otherwise run
+	// the service as root without a word.
+	dec.KnownFields(true)
+	if err := dec.Decode(&f); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+	}
+	sum := sha256.Sum256(data)
+	return resolve(f, hex.EncodeToString(sum[:]))
+}
+
+// FromFlags builds the configuration an agent started with flags has, so it
+// is reported like any other.
+func FromFlags(serviceDir string, allowed []string, forwards *transportgrpc.ForwardPolicy) (*Config, error) {
+	f := File{Version: Version, ServiceDir: serviceDir, Forwards: forwards.Forwards}
+	if f.Forwards == nil {
+		f.Forwards = []transportgrpc.Forward{}
+	}
+	for _, name := range allowed {
+		f.Services = append(f.Services, Service{Name: name})
+	}
+	cfg, err := resolve(f, "")
+	if err != nil {
+		return nil, err
+	}
+	cfg.Source = "flags"
+	return cfg, nil
+}
+
+// resolve validates f and turns it into the invoker's and transport's terms.
+//
+//nolint:gocyclo // one check per field, each independent
+func resolve(f File, digest string) (*Config, error) {
+	bad := func(format string, args ...any) error {
+		return fmt.Errorf("%w: %s", ErrInvalidConfig, fmt.Sprintf(format, args...))
+	}
+	switch {
+	case f.Version == 0:
+		return nil, bad("version is required (this agent reads version %d)", Version)
+	case f.Version != Version:
+		return nil, bad("version %d is not supported (this agent reads version %d)", f.Version, Version)
+	case len(f.Services) == 0:
+		return nil, bad("no services: an agent that runs nothing is not configured, it is broken")
+	case f.ServiceDir != "" && !filepath.IsAbs(f.ServiceDir):
+		return nil, bad("service_dir %q is not an absolute path", f.ServiceDir)
+	}
+
+	pol := &agent.Policy{
+		ServiceDir: f.ServiceDir,
+		Services:   make(map[string]agent.ServicePolicy, len(f.Services)),
+		LogCalls:   f.Logging.Calls,
+	}
+	if pol.ServiceDir == "" {
+		pol.ServiceDir = agent.DefaultServiceDir
+	}
+	for i, s := range f.Services {
+		if s.Name == "" || strings.Contains(s.Name, "+") || strings.ContainsAny(s.Name, `/\`) || strings.Contains(s.Name, "..") {
+			return nil, bad("service %d: name %q is not a base service name", i, s.Name)
+		}
+		if _, dup := pol.Services[s.Name]; dup {
+			return nil, bad("service %q is listed twice", s.Name)
+		}
+		if s.TimeoutSeconds < 0 || s.MaxOutputBytes < 0 {
+			return nil, bad("service %q: timeout_seconds and max_output_bytes may not be negative", s.Name)
+		}
+		sp := agent.ServicePolicy{
+			Timeout:   time.Duration(s.TimeoutSeconds) * time.Second,
+			MaxOutput: s.MaxOutputBytes,
+		}
+		if s.Arguments != "" {
+			// Anchored here so that "[0-9]+" means a number, not "contains a
+			// digit" — the unanchored reading is the one that lets through
+			// what the author meant to keep out.
+			re, err := regexp.Compile(`^(?:` + s.Arguments + `)$`)
+			if err != nil {
+				return nil, bad("service %q: arguments: %v", s.Name, err)
+			}
+			sp.Args = re
+		}
+		if s.RunAs != "" {
+			acct, err := agent.LookupAccount(s.RunAs)
+			if err != nil {
+				return nil, bad("service %q: %v", s.Name, err)
+			}
+			sp.RunAs = acct
+		}
+		pol.Services[s.Name] = sp
+	}
+
+	for _, u := range f.Status.Units {
+		if !statusUnit.MatchString(u) || strings.HasPrefix(u, "-") {
+			return nil, bad("status unit %q is not a unit name", u)
+		}
+	}
+	for _, d := range f.Status.Disks {
+		if !filepath.IsAbs(d) {
+			return nil, bad("status disk %q is not an absolute path", d)
+		}
+	}
+
+	if f.DeadMan.SilenceHours < 0 {
+		return nil, bad("dead_man: silence_hours may not be negative")
+	}
+
+	forwards := transportgrpc.DefaultForwardPolicy()
+	if f.Forwards != nil {
+		forwards = &transportgrpc.ForwardPolicy{Forwards: f.Forwards}
+		if err := forwards.Validate(); err != nil {
+			return nil, bad("%v", err)
+		}
+	}
+	return &Config{Digest: digest, File: f, Policy: pol, Forwards: forwards}, nil
+}
@@ -0,0 +1,202 @@
+package agentconfig
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/slchris/qubes-air/console/internal/agent"
+)
+
+const sample = `version: 1
+service_dir: /srv/rpc
+services:
+  - name: qubesair.Ping
+  - name: qubesair.Backup
+    timeout_seconds: 600
+    max_output_bytes: 1024
+    arguments: "[a-z]+"
+forwards:
+  - name: ssh
+    port: 22
+logging:
+  calls: true
+status:
+  units: [sshd.service]
+dead_man:
+  silence_hours: 48
+  on_revocation: true
+`
+
+func TestParseResolves(t *testing.T) {
+	cfg, err := Parse([]byte(sample))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Policy.ServiceDir != "/srv/rpc" || !cfg.Policy.LogCalls || len(cfg.Policy.Services) != 2 {
+		t.Fatalf("policy = %+v", cfg.Policy)
+	}
+	backup := cfg.Policy.Services["qubesair.Backup"]
+	if backup.Timeout != 10*time.Minute || backup.MaxOutput != 1024 {
+		t.Errorf("qubesair.Backup = %+v", backup)
+	}
+	// Anchored: a pattern that only has to occur somewhere is not a restriction.
+	if backup.Args.MatchString("home; rm -rf /") || !backup.Args.MatchString("home") {
+		t.Errorf("arguments pattern %q is not matched in full", backup.Args)
+	}
+	if len(cfg.Forwards.Forwards) != 1 || cfg.Forwards.Forwards[0].Name != "ssh" {
+		t.Errorf("forwards = %+v", cfg.Forwards.Forwards)
+	}
+	if len(cfg.Digest) != 64 {
+		t.Errorf("digest = %q", cfg.Digest)
+	}
+
+	// No forwards key is the default GUI ranges; an empty list is none.
+	noKey, err := Parse([]byte("version: 1\nservices: [{name: qubesair.Ping}]\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(noKey.Forwards.Forwards) == 0 {
+		t.Error("an absent forwards key did not give the default policy")
+	}
+	// Likewise for what qubesair.Status looks at.
+	if got := strings.Join(cfg.StatusUnits(), ","); got != "sshd.service" || cfg.StatusDisks()[0] != "/" {
+		t.Errorf("status units %s, disks %v", got, cfg.StatusDisks())
+	}
+	if got := strings.Join(noKey.StatusUnits(), ","); got != strings.Join(DefaultStatusUnits, ",") {
+		t.Errorf("default status units = %s", got)
+	}
+	if pol := cfg.DeadManPolicy(); pol.Silence != 48*time.Hour || !pol.OnRevocation {
+		t.Errorf("dead man's switch = %+v", pol)
+	}
+	if noKey.DeadManPolicy().Enabled() {
+		t.Error("the dead man's switch is on without being configured")
+	}
+	empty, err := Parse([]byte("version: 1\nservices: [{name: qubesair.Ping}]\nforwards: []\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(empty.Forwards.Forwards) != 0 {
+		t.Errorf("forwards: [] gave %+v, want none", empty.Forwards.Forwards)
+	}
+}
+
+func TestParseRejects(t *testing.T) {
+	cases := map[string]string{
+		"no version":      "services: [{name: qubesair.Ping}]\n",
+		"future version":  "version: 2\nservices: [{name: qubesair.Ping}]\n",
+		"no services":     "version: 1\nservices: []\n",
+		"unknown key":     "version: 1\nservices: [{name: qubesair.Ping, run-as: nobody}]\n",
+		"argument name":   "version: 1\nservices: [{name: qubesair.Ping+x}]\n",
+		"duplicate":       "version: 1\nservices: [{name: qubesair.Ping}, {name: qubesair.Ping}]\n",
+		"negative limit":  "version: 1\nservices: [{name: qubesair.Ping, timeout_seconds: -1}]\n",
+		"bad pattern":     "version: 1\nservices: [{name: qubesair.Ping, arguments: \"(\"}]\n",
+		"relative dir":    "version: 1\nservice_dir: rpc\nservices: [{name: qubesair.Ping}]\n",
+		"unknown user":    "version: 1\nservices: [{name: qubesair.Ping, run_as: no-such-user-here}]\n",
+		"invalid forward": "version: 1\nservices: [{name: qubesair.Ping}]\nforwards: [{name: ssh}]\n",
+		"status option":   "version: 1\nservices: [{name: qubesair.Ping}]\nstatus: {units: [--root=/tmp]}\n",
+		"status disk":     "version: 1\nservices: [{name: qubesair.Ping}]\nstatus: {disks: [data]}\n",
+		"dead man":        "version: 1\nservices: [{name: qubesair.Ping}]\ndead_man: {silence_hours: -1}\n",
+	}
+	for name, doc := range cases {
+		t.Run(name, func(t *testing.T) {
+			if _, err := Parse([]byte(doc)); !errors.Is(err, ErrInvalidConfig) {
+				t.Errorf("Parse = %v, want ErrInvalidConfig", err)
+			}
+		})
+	}
+}
+
+// TestReloadKeepsPreviousOnError — a bad file is reported and ignored; the
+// agent keeps serving what it had.
+func TestReloadKeepsPreviousOnError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.yaml")
+	write := func(doc string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(doc), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(sample)
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv := agent.NewLocalInvoker("remote-a", nil)
+	m, err := NewManager(path, cfg, inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write("version: 1\nservices: [{name: qubesair.Ping, timeout: 5}]\n")
+	if _, err := m.Reload(); err == nil {
+		t.Fatal("Reload accepted a file with an unknown key")
+	}
+	if m.Current() != cfg {
+		t.Error("a failed reload replaced the configuration")
+	}
+	if got := strings.Join(inv.Services(), ","); !strings.Contains(got, "qubesair.Backup") {
+		t.Errorf("invoker lost the previous policy: %s", got)
+	}
+	if r := m.Report(); r.LastReloadError == "" || r.LastReloadAt == nil {
+		t.Errorf("report does not carry the failed reload: %+v", r)
+	}
+
+	write("version: 1\nservices: [{name: qubesair.Ping}]\nforwards: []\n")
+	if _, err := m.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := inv.Invoke(context.Background(), "relay", "qubesair.Backup", nil); !errors.Is(err, agent.ErrServiceNotAllowed) {
+		t.Errorf("a service the reload removed = %v, want not allowed", err)
+	}
+	if len(m.ForwardPolicy().Forwards) != 0 {
+		t.Errorf("forward source still serves %+v", m.ForwardPolicy().Forwards)
+	}
+	if r := m.Report(); r.LastReloadError != "" {
+		t.Errorf("a good reload left the error: %q", r.LastReloadError)
+	}
+}
+
+func TestBuiltinReportsEffectivePolicy(t *testing.T) {
+	cfg, err := Parse([]byte(sample))
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv := agent.NewLocalInvoker("remote-a", nil)
+	m, err := NewManager("", cfg, inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.RegisterBuiltins(inv); err != nil {
+		t.Fatal(err)
+	}
+	out, err := inv.Invoke(context.Background(), "console", ServiceAgentConfig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r Report
+	if err := json.Unmarshal(out, &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Version != Version || r.Digest != cfg.Digest || !r.Logging.Calls {
+		t.Errorf("report = %+v", r)
+	}
+	// Defaults are filled in: the console shows what a call gets.
+	ping := r.Services[0]
+	if ping.Name != "qubesair.Ping" || ping.TimeoutSeconds != 120 || ping.MaxOutputBytes != agent.DefaultMaxOutput {
+		t.Errorf("qubesair.Ping reported as %+v", ping)
+	}
+	if strings.Join(r.Builtins, ",") != "qubesair.AgentConfig,qubesair.ListForwards" {
+		t.Errorf("builtins = %v", r.Builtins)
+	}
+
+	// With no file there is nothing to reload, and the report says so.
+	if _, err := m.Reload(); err == nil {
+		t.Error("Reload with no file succeeded")
+	}
+}
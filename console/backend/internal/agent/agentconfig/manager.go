@@ -0,0 +1,180 @@
+package agentconfig
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/slchris/qubes-air/console/internal/agent"
+	transportgrpc "github.com/slchris/qubes-air/console/internal/transport/grpc"
+)
+
+// ServiceAgentConfig is the builtin through which the console asks an agent
+// for its effective configuration. BUILTIN for the reason ListForwards is:
+// the answer is this process's own state, which no script could know — least
+// of all whether the last reload took.
+const ServiceAgentConfig = "qubesair.AgentConfig"
+
+// Manager holds the running configuration and replaces it on Reload.
+//
+// A reload is all or nothing. The new file is loaded and validated in full
+// before anything changes; if it fails, the agent keeps serving the previous
+// configuration and the failure is kept for the report, so a typo pushed to a
+// fleet shows up on the console rather than as agents that stopped working.
+// Nothing is torn down either way: streams and calls already running carry on
+// under the configuration they started with, and the next one sees the new.
+type Manager struct {
+	path string
+	inv  *agent.LocalInvoker
+
+	mu  sync.Mutex // serializes reloads; readers never take it
+	cur atomic.Pointer[state]
+}
+
+// state is one applied configuration and what became of the last attempt to
+// replace it.
+type state struct {
+	cfg      *Config
+	loadedAt time.Time
+
+	lastErr   string
+	lastErrAt time.Time
+}
+
+// NewManager applies cfg to inv. path is the file Reload re-reads; empty for
+// an agent configured by flags, which has nothing to reload.
+func NewManager(path string, cfg *Config, inv *agent.LocalInvoker) (*Manager, error) {
+	m := &Manager{path: path, inv: inv}
+	if err := inv.SetPolicy(cfg.Policy); err != nil {
+		return nil, err
+	}
+	m.cur.Store(&state{cfg: cfg, loadedAt: time.Now()})
+	return m, nil
+}
+
+// Current is the configuration in force.
+func (m *Manager) Current() *Config { return m.cur.Load().cfg }
+
+// Reload re-reads the file and, if it is valid, puts it in force.
+func (m *Manager) Reload() (*Config, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	prev := m.cur.Load()
+
+	fail := func(err error) (*Config, error) {
+		m.cur.Store(&state{cfg: prev.cfg, loadedAt: prev.loadedAt, lastErr: err.Error(), lastErrAt: time.Now()})
+		return nil, err
+	}
+	if m.path == "" {
+		return fail(errors.New("started from flags: there is no config file to reload"))
+	}
+	cfg, err := Load(m.path)
+	if err != nil {
+		return fail(err)
+	}
+	// The invoker checks names the file format does not; it is the last
+	// validation, so it goes first of the two swaps.
+	if err := m.inv.SetPolicy(cfg.Policy); err != nil {
+		return fail(err)
+	}
+	m.cur.Store(&state{cfg: cfg, loadedAt: time.Now()})
+	return cfg, nil
+}
+
+// ForwardPolicy is the forward policy in force; it makes the Manager a
+// transportgrpc.ForwardSource, read on every stream request.
+func (m *Manager) ForwardPolicy() *transportgrpc.ForwardPolicy { return m.Current().Forwards }
+
+// ListForwards is the qubesair.ListForwards builtin over the policy in force.
+func (m *Manager) ListForwards(ctx context.Context, target string, in []byte) ([]byte, error) {
+	return m.ForwardPolicy().ListBuiltin(ctx, target, in)
+}
+
+// RegisterBuiltins registers qubesair.AgentConfig and qubesair.ListForwards.
+func (m *Manager) RegisterBuiltins(inv *agent.LocalInvoker) error {
+	if err := inv.RegisterBuiltin(ServiceAgentConfig, m.Builtin); err != nil {
+		return err
+	}
+	return inv.RegisterBuiltin(transportgrpc.ServiceListForwards, m.ListForwards)
+}
+
+// Report is the qubesair.AgentConfig answer.
+type Report struct {
+	Source   string    `json:"source"`
+	Version  int       `json:"version"`
+	Digest   string    `json:"digest,omitempty"`
+	LoadedAt time.Time `json:"loaded_at"`
+	// LastReloadError is why the most recent reload was refused, if it was.
+	// Cleared by the next one that succeeds.
+	LastReloadError string     `json:"last_reload_error,omitempty"`
+	LastReloadAt    *time.Time `json:"last_reload_at,omitempty"`
+
+	ServiceDir string `json:"service_dir"`
+	// Services are listed with their effective limits, defaults filled in, so
+	// the console shows what a call gets rather than what the file omitted.
+	Services []Service               `json:"services"`
+	Builtins []string                `json:"builtins"`
+	Forwards []transportgrpc.Forward `json:"forwards"`
+	Logging  Logging                 `json:"logging"`
+	// Status is what qubesair.Status reports on, defaults filled in.
+	Status Status `json:"status"`
+	// DeadMan is the dead man's switch as configured; its state is in
+	// qubesair.Status.
+	DeadMan DeadMan `json:"dead_man"`
+}
+
+// Report describes the configuration in force.
+func (m *Manager) Report() Report {
+	st := m.cur.Load()
+	cfg := st.cfg
+	r := Report{
+		Source:          cfg.Source,
+		Version:         cfg.File.Version,
+		Digest:          cfg.Digest,
+		LoadedAt:        st.loadedAt.UTC(),
+		LastReloadError: st.lastErr,
+		ServiceDir:      cfg.Policy.ServiceDir,
+		Forwards:        cfg.Forwards.Forwards,
+		Logging:         cfg.File.Logging,
+		Status:          Status{Units: cfg.StatusUnits(), Disks: cfg.StatusDisks()},
+		DeadMan:         cfg.File.DeadMan,
+		Builtins:        []string{},
+	}
+	if !st.lastErrAt.IsZero() {
+		at := st.lastErrAt.UTC()
+		r.LastReloadAt = &at
+	}
+	if r.Forwards == nil {
+		r.Forwards = []transportgrpc.Forward{}
+	}
+	for _, s := range cfg.File.Services {
+		if s.TimeoutSeconds == 0 {
+			s.TimeoutSeconds = int(m.defaultTimeout() / time.Second)
+		}
+		if s.MaxOutputBytes == 0 {
+			s.MaxOutputBytes = agent.DefaultMaxOutput
+		}
+		r.Services = append(r.Services, s)
+	}
+	for _, name := range m.inv.Services() {
+		if m.inv.IsBuiltin(name) {
+			r.Builtins = append(r.Builtins, name)
+		}
+	}
+	return r
+}
+
+func (m *Manager) defaultTimeout() time.Duration {
+	if m.inv.Timeout > 0 {
+		return m.inv.Timeout
+	}
+	return agent.DefaultCallTimeout
+}
+
+// Builtin is the qubesair.AgentConfig builtin.
+func (m *Manager) Builtin(_ context.Context, _ string, _ []byte) ([]byte, error) {
+	return json.Marshal(m.Report())
+}
@@ -15,6 +15,9 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"log"
+	"time"
 )
 
 // Builtin is a qrexec service implemented in-process.
@@ -24,6 +27,11 @@ import (
 // body.
 type Builtin func(ctx context.Context, target string, in []byte) ([]byte, error)
 
+// StreamBuiltin is a streaming service implemented in-process. It returns the
+// connection the call is spliced to: what the caller sends is written to it,
+// what it yields goes back, until either side closes.
+type StreamBuiltin func(ctx context.Context, target string) (io.ReadWriteCloser, error)
+
 // Builtin registration errors.
 var (
 	// ErrBuiltinExists means the name was already registered. Registering twice
@@ -33,6 +41,9 @@ var (
 	// ErrBuiltinTakesNoArgument means a "name+arg" form was used for a builtin
 	// that accepts none.
 	ErrBuiltinTakesNoArgument = errors.New("builtin service takes no argument")
+	// ErrStreamingOnly means a streaming builtin was called as an ordinary
+	// service, which it cannot answer.
+	ErrStreamingOnly = errors.New("builtin service answers streaming calls only")
 )
 
 // RegisterBuiltin binds name to an in-process implementation.
@@ -66,7 +77,7 @@ func (i *LocalInvoker) RegisterBuiltin(name string, fn Builtin) error {
 
 	i.mu.Lock()
 	defer i.mu.Unlock()
-	if _, exists := i.builtins[name]; exists {
+	if i.registered(name) {
 		return fmt.Errorf("%w: %q", ErrBuiltinExists, name)
 	}
 	if i.builtins == nil {
@@ -76,6 +87,109 @@ func (i *LocalInvoker) RegisterBuiltin(name string, fn Builtin) error {
 	return nil
 }
 
+// RegisterGatedBuiltin binds name to an in-process implementation that, unlike
+// RegisterBuiltin's, still has to be allowlisted.
+//
+// The argument above for skipping the allowlist is renewal's: a builtin whose
+// absence fails silently. A file transfer is the opposite case — in-process
+// because it needs state across calls, not because it must always be there —
+// and an operator who cut an agent down to qubesair.Ping must not find it
+// accepting writes because a newer binary compiled one in. It is still
+// resolved before ServiceDir, so a script cannot stand in for it either.
+func (i *LocalInvoker) RegisterGatedBuiltin(name string, fn Builtin) error {
+	if err := i.RegisterBuiltin(name, fn); err != nil {
+		return err
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.gated == nil {
+		i.gated = make(map[string]bool)
+	}
+	i.gated[name] = true
+	return nil
+}
+
+// RegisterStreamBuiltin binds name to an in-process streaming service,
+// allowlisted like a gated builtin. A streaming builtin is no call that must
+// always answer: qubesair.Shell, the first, is a terminal on the remote, and
+// it is the last thing that should appear on an agent its operator did not
+// list it on.
+func (i *LocalInvoker) RegisterStreamBuiltin(name string, fn StreamBuiltin) error {
+	if fn == nil {
+		return fmt.Errorf("builtin %q: nil implementation", name)
+	}
+	if !validServiceName(name) || name != baseService(name) {
+		return fmt.Errorf("%w: %q", ErrInvalidServiceName, name)
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.registered(name) {
+		return fmt.Errorf("%w: %q", ErrBuiltinExists, name)
+	}
+	if i.streams == nil {
+		i.streams = make(map[string]StreamBuiltin)
+	}
+	if i.gated == nil {
+		i.gated = make(map[string]bool)
+	}
+	i.streams[name] = fn
+	i.gated[name] = true
+	return nil
+}
+
+// registered reports whether name is taken by a builtin of either kind. The
+// caller holds mu.
+func (i *LocalInvoker) registered(name string) bool {
+	_, call := i.builtins[name]
+	_, stream := i.streams[name]
+	return call || stream
+}
+
+// OpenStream opens a streaming builtin for the transport's server (it
+// satisfies transportgrpc.StreamOpener). A service that is not one reports ok
+// false and goes on to Invoke, which answers for it as for any other call.
+func (i *LocalInvoker) OpenStream(ctx context.Context, target, service string) (io.ReadWriteCloser, bool, error) {
+	name, arg := splitServiceArg(service)
+	i.mu.RLock()
+	fn := i.streams[name]
+	i.mu.RUnlock()
+	if fn == nil {
+		return nil, false, nil
+	}
+	if arg != "" {
+		return nil, true, fmt.Errorf("%w: %q", ErrBuiltinTakesNoArgument, service)
+	}
+	pol := i.current()
+	if _, allowed := pol.Services[name]; pol.Services != nil && !allowed {
+		return nil, true, fmt.Errorf("%w: %q", ErrServiceNotAllowed, service)
+	}
+	started := time.Now()
+	conn, err := fn(ctx, target)
+	if pol.LogCalls {
+		outcome := "opened"
+		if err != nil {
+			outcome = err.Error()
+		}
+		log.Printf("stream %s from %s: %s (%s)", service, target, outcome, time.Since(started).Round(time.Millisecond))
+	}
+	return conn, true, err
+}
+
+// isGated reports whether the builtin name is subject to the allowlist.
+func (i *LocalInvoker) isGated(name string) bool {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.gated[name]
+}
+
+// isStream reports whether name is a streaming builtin.
+func (i *LocalInvoker) isStream(name string) bool {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.streams[name] != nil
+}
+
 // builtin returns the implementation registered for name, or nil.
 func (i *LocalInvoker) builtin(name string) Builtin {
 	i.mu.RLock()
@@ -89,5 +203,7 @@ func (i *LocalInvoker) builtin(name string) Builtin {
 // ServiceDir — it never will, and telling an operator to go install one would
 // send them looking for a script that must not exist.
 func (i *LocalInvoker) IsBuiltin(name string) bool {
-	return i.builtin(baseService(name)) != nil
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.registered(baseService(name))
 }
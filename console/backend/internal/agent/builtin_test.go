@@ -3,6 +3,8 @@ package agent
 import (
 	"context"
 	"errors"
+	"io"
+	"net"
 	"strings"
 	"testing"
 )
@@ -85,6 +87,82 @@ func TestBuiltinIgnoresAllowlist(t *testing.T) {
 	}
 }
 
+// TestGatedBuiltinNeedsAllowlist — a gated builtin is refused until listed,
+// and still cannot be stood in for by a file of the same name.
+func TestGatedBuiltinNeedsAllowlist(t *testing.T) {
+	dir := serviceDir(t, map[string]string{"qubesair.Gated": "#!/bin/sh\necho SHADOWED\n"})
+	gated := func(context.Context, string, []byte) ([]byte, error) { return []byte("BUILTIN"), nil }
+
+	inv := invokerOver(dir, "qubesair.Ping")
+	if err := inv.RegisterGatedBuiltin("qubesair.Gated", gated); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := inv.Invoke(context.Background(), "console", "qubesair.Gated", nil); !errors.Is(err, ErrServiceNotAllowed) {
+		t.Errorf("unlisted gated builtin = %v, want ErrServiceNotAllowed", err)
+	}
+	for _, name := range inv.Services() {
+		if name == "qubesair.Gated" {
+			t.Error("an unlisted gated builtin is advertised")
+		}
+	}
+
+	inv = invokerOver(dir, "qubesair.Ping", "qubesair.Gated")
+	if err := inv.RegisterGatedBuiltin("qubesair.Gated", gated); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := inv.Invoke(context.Background(), "console", "qubesair.Gated", nil); err != nil || string(out) != "BUILTIN" {
+		t.Errorf("listed gated builtin = %q, %v", out, err)
+	}
+}
+
+// TestStreamBuiltin — a streaming builtin opens only when listed, is the only
+// thing its name opens, and cannot be answered by a file as an ordinary call.
+func TestStreamBuiltin(t *testing.T) {
+	dir := serviceDir(t, map[string]string{"qubesair.Term": "#!/bin/sh\necho SHADOWED\n"})
+	var gotTarget string
+	open := func(_ context.Context, target string) (io.ReadWriteCloser, error) {
+		gotTarget = target
+		a, b := net.Pipe()
+		_ = b.Close()
+		return a, nil
+	}
+
+	inv := invokerOver(dir, "qubesair.Ping")
+	if err := inv.RegisterStreamBuiltin("qubesair.Term", open); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := inv.OpenStream(context.Background(), "console", "qubesair.Term"); !ok || !errors.Is(err, ErrServiceNotAllowed) {
+		t.Errorf("unlisted stream = ok %v, %v; want ErrServiceNotAllowed", ok, err)
+	}
+	if _, ok, err := inv.OpenStream(context.Background(), "console", "qubesair.Ping"); ok || err != nil {
+		t.Errorf("an ordinary service opened as a stream: ok %v, %v", ok, err)
+	}
+
+	inv = invokerOver(dir, "qubesair.Ping", "qubesair.Term")
+	if err := inv.RegisterStreamBuiltin("qubesair.Term", open); err != nil {
+		t.Fatal(err)
+	}
+	if err := inv.RegisterBuiltin("qubesair.Term", func(context.Context, string, []byte) ([]byte, error) {
+		return nil, nil
+	}); !errors.Is(err, ErrBuiltinExists) {
+		t.Errorf("a call builtin over a stream's name = %v, want ErrBuiltinExists", err)
+	}
+	conn, ok, err := inv.OpenStream(context.Background(), "console", "qubesair.Term")
+	if !ok || err != nil || gotTarget != "console" {
+		t.Fatalf("listed stream = ok %v, %v (target %q)", ok, err, gotTarget)
+	}
+	_ = conn.Close()
+	if _, _, err := inv.OpenStream(context.Background(), "console", "qubesair.Term+x"); !errors.Is(err, ErrBuiltinTakesNoArgument) {
+		t.Errorf("stream with an argument = %v", err)
+	}
+	if out, err := inv.Invoke(context.Background(), "console", "qubesair.Term", nil); !errors.Is(err, ErrStreamingOnly) {
+		t.Errorf("stream called as a call = %q, %v; want ErrStreamingOnly, not the file", out, err)
+	}
+	if !inv.IsBuiltin("qubesair.Term") {
+		t.Error("a streaming builtin is not reported as a builtin")
+	}
+}
+
 // TestBuiltinReceivesRequestBody — a builtin sees what a script would.
 func TestBuiltinReceivesRequestBody(t *testing.T) {
 	inv := invokerOver(t.TempDir())
@@ -216,6 +216,42 @@ func (id *Identity) ServerTLSConfig() *tls.Config {
 	return cfg
 }
 
+// ClientTLSConfig builds the mTLS config for dialing OUT to a relay
+// (transport/grpc.Server.DialOut).
+//
+// The certificate is fetched per handshake, as ServerCertificate is, so a
+// renewal is presented on the next reconnect. The relay is verified by
+// VerifyChain rather than by the TLS stack: relay certificates are client-auth
+// only and name no host, so the stack's ServerAuth and hostname checks would
+// refuse every genuine relay. What the chain cannot say is which KIND of
+// principal is on the other end, so a peer presenting another agent's
+// certificate is refused explicitly — a remote that redirected this agent's
+// dial to itself must not be able to drive it as though it were a relay.
+func (id *Identity) ClientTLSConfig() *tls.Config {
+	return &tls.Config{
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return id.ServerCertificate()
+		},
+		// Verification happens in VerifyConnection below; see above for why
+		// the stack's own cannot be used.
+		InsecureSkipVerify: true, //nolint:gosec // replaced by VerifyConnection
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return ErrUntrustedChain
+			}
+			leaf := cs.PeerCertificates[0]
+			if err := id.VerifyChain(leaf, cs.PeerCertificates[1:]); err != nil {
+				return err
+			}
+			if strings.HasPrefix(leaf.Subject.CommonName, pki.AgentCommonName("")) {
+				return fmt.Errorf("%w: %q is an agent, not a relay", ErrUntrustedChain, leaf.Subject.CommonName)
+			}
+			return nil
+		},
+		MinVersion: tls.VersionTLS13,
+	}
+}
+
 // TrustsCA reports whether der is a CA certificate this agent already trusts.
 func (id *Identity) TrustsCA(der []byte) bool {
 	for _, c := range id.rootCerts {
@@ -4,6 +4,7 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
@@ -403,3 +404,33 @@ func TestTrustsCA(t *testing.T) {
 		t.Error("an unrelated CA was reported as trusted")
 	}
 }
+
+// TestClientTLSConfigVerifiesRelay — dialing out, the agent accepts a relay
+// whose certificate chains to its CA even though it is client-auth only, and
+// refuses a foreign chain or another agent presenting as a relay.
+func TestClientTLSConfigVerifiesRelay(t *testing.T) {
+	id, ca, _ := installedIdentity(t, testAgentCN)
+	verify := id.ClientTLSConfig().VerifyConnection
+	peer := func(ca *pki.CA, cn string) tls.ConnectionState {
+		block, _ := pem.Decode([]byte(certFor(t, ca, &newKey(t).PublicKey, cn, time.Hour)))
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	}
+
+	if err := verify(peer(ca, pki.RelayCommonName("sys-relay"))); err != nil {
+		t.Errorf("a relay from our CA was refused: %v", err)
+	}
+	if err := verify(peer(ca, pki.AgentCommonName("qube-2"))); !errors.Is(err, ErrUntrustedChain) {
+		t.Errorf("another agent was accepted as a relay: %v", err)
+	}
+	other, err := pki.NewCA("other-ca", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verify(peer(other, pki.RelayCommonName("sys-relay"))); !errors.Is(err, ErrUntrustedChain) {
+		t.Errorf("a relay from a foreign CA was accepted: %v", err)
+	}
+}
@@ -16,11 +16,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -31,9 +34,9 @@ const DefaultServiceDir = "/etc/qubes-rpc"
 // DefaultCallTimeout bounds a single service execution.
 const DefaultCallTimeout = 2 * time.Minute
 
-// maxResponseBytes caps what one service may return, so a runaway script cannot
+// DefaultMaxOutput caps what one service may return, so a runaway script cannot
 // exhaust the agent's memory.
-const maxResponseBytes = 16 << 20 // 16 MiB
+const DefaultMaxOutput = 16 << 20 // 16 MiB
 
 // Invoker errors.
 var (
@@ -47,6 +50,9 @@ var (
 	ErrResponseTooLarge = errors.New("service response exceeded the size limit")
 )
 
+// errCallTimeout is the cause recorded when LocalInvoker.Timeout ends a call.
+var errCallTimeout = errors.New("agent call timeout")
+
 // LocalInvoker executes qrexec services implemented on this host.
 //
 // It satisfies the transport's QrexecInvoker, so the remote server runs local
@@ -69,7 +75,7 @@ type LocalInvoker struct {
 	// the Qubes RemoteVM remote_name property.
 	RemoteName string
 
-	// mu guards builtins. Registration happens at startup, but the map is read
+	// mu guards the builtins. Registration happens at startup, but the map is read
 	// on every call from the gRPC server's per-request goroutines, and an
 	// unsynchronized map read against a late registration is a data race with
 	// no upper bound on what it corrupts.
@@ -77,6 +83,13 @@ type LocalInvoker struct {
 	// builtins are services handled in-process; see builtin.go for why they
 	// cannot be files and why nothing in ServiceDir may shadow them.
 	builtins map[string]Builtin
+	// streams are the streaming builtins; see RegisterStreamBuiltin.
+	streams map[string]StreamBuiltin
+	// gated are the builtins the allowlist still applies to; see
+	// RegisterGatedBuiltin.
+	gated map[string]bool
+	// policy, once set, replaces ServiceDir, Allowed and Timeout; see policy.go.
+	policy atomic.Pointer[Policy]
 }
 
 // NewLocalInvoker builds an invoker over the standard service directory.
@@ -93,6 +106,49 @@ func NewLocalInvoker(remoteName string, allowed []string) *LocalInvoker {
 	}
 }
 
+// Services lists what this agent would run: every builtin, plus the allowlist
+// or — with no allowlist — every executable in ServiceDir. The transport
+// declares it in the handshake so an operator can see what an agent offers
+// without a shell on it. It is a description, not a promise: Invoke still
+// decides each call, and a listed script can be removed a second later.
+func (i *LocalInvoker) Services() []string {
+	seen := make(map[string]bool)
+	i.mu.RLock()
+	for name := range i.builtins {
+		if !i.gated[name] {
+			seen[name] = true // a gated one is listed below if it is allowed
+		}
+	}
+	i.mu.RUnlock()
+
+	pol := i.current()
+	if pol.Services != nil {
+		for name := range pol.Services {
+			seen[name] = true
+		}
+	} else {
+		dir := pol.ServiceDir
+		if dir == "" {
+			dir = DefaultServiceDir
+		}
+		entries, _ := os.ReadDir(dir) // an unreadable dir lists as empty; Invoke reports the real error
+		for _, e := range entries {
+			info, err := e.Info()
+			if err != nil || !info.Mode().IsRegular() || info.Mode()&0o111 == 0 || !validServiceName(e.Name()) {
+				continue
+			}
+			seen[e.Name()] = true
+		}
+	}
+
+	out := make([]string, 0, len(seen))
+	for name := range seen {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
 // validServiceName reports whether name is safe to resolve to a file.
 //
 // The name arrives over the network and becomes a path element, so it is
@@ -127,6 +183,23 @@ func validServiceName(name string) bool {
 // can run, and treating a network-supplied name as a routing decision would be
 // trusting the caller to address us correctly.
 func (i *LocalInvoker) Invoke(ctx context.Context, target, service string, in []byte) ([]byte, error) {
+	pol := i.current()
+	if !pol.LogCalls {
+		return i.invoke(ctx, pol, target, service, in)
+	}
+	started := time.Now()
+	out, err := i.invoke(ctx, pol, target, service, in)
+	outcome := fmt.Sprintf("ok, %d bytes", len(out))
+	if err != nil {
+		outcome = err.Error()
+	}
+	log.Printf("call %s from %s: %s (%s)", service, target, outcome, time.Since(started).Round(time.Millisecond))
+	return out, err
+}
+
+// invoke runs one call under pol, which is read once per call so a reload
+// mid-call cannot mix two policies.
+func (i *LocalInvoker) invoke(ctx context.Context, pol *Policy, target, service string, in []byte) ([]byte, error) {
 	if !validServiceName(service) {
 		return nil, fmt.Errorf("%w: %q", ErrInvalidServiceName, service)
 	}
@@ -143,14 +216,26 @@ func (i *LocalInvoker) Invoke(ctx context.Context, target, service string, in []
 		if arg != "" {
 			return nil, fmt.Errorf("%w: %q", ErrBuiltinTakesNoArgument, service)
 		}
+		if _, allowed := pol.Services[name]; i.isGated(name) && pol.Services != nil && !allowed {
+			return nil, fmt.Errorf("%w: %q", ErrServiceNotAllowed, service)
+		}
 		return fn(ctx, target, in)
 	}
+	// Nor may a script answer, as an ordinary call, the name of a streaming
+	// builtin.
+	if i.isStream(name) {
+		return nil, fmt.Errorf("%w: %q", ErrStreamingOnly, service)
+	}
 
-	if len(i.Allowed) > 0 && !i.Allowed[name] {
+	sp, allowed := pol.Services[name]
+	if pol.Services != nil && !allowed {
 		return nil, fmt.Errorf("%w: %q", ErrServiceNotAllowed, service)
 	}
+	if sp.Args != nil && !sp.Args.MatchString(arg) {
+		return nil, fmt.Errorf("%w: %q", ErrArgumentNotAllowed, service)
+	}
 
-	dir := i.ServiceDir
+	dir := pol.ServiceDir
 	if dir == "" {
 		dir = DefaultServiceDir
 	}
@@ -164,11 +249,17 @@ func (i *LocalInvoker) Invoke(ctx context.Context, target, service string, in []
 		return nil, fmt.Errorf("%w: %q exists but is not executable", ErrUnknownService, name)
 	}
 
-	timeout := i.Timeout
+	timeout := sp.Timeout
+	if timeout <= 0 {
+		timeout = i.Timeout
+	}
 	if timeout <= 0 {
 		timeout = DefaultCallTimeout
 	}
-	ctx, cancel := context.WithTimeout(ctx, timeout)
+	// The cause tells our own timeout apart from the caller's: a deadline the
+	// relay sent, or a Cancel frame, also ends ctx, and reporting either as
+	// "timed out after 2m" would send whoever reads it after the wrong limit.
+	ctx, cancel := context.WithTimeoutCause(ctx, timeout, errCallTimeout)
 	defer cancel()
 
 	// #nosec G204 -- path is ServiceDir joined with a name validated above to
@@ -178,6 +269,11 @@ func (i *LocalInvoker) Invoke(ctx context.Context, target, service string, in []
 		cmd.Args = append(cmd.Args, arg)
 	}
 	cmd.Stdin = bytes.NewReader(in)
+	// Cancellation kills the service's whole process group, not just the script:
+	// a service is usually a shell running something else, and killing only the
+	// shell would leave the real work running for a caller who has gone.
+	killProcessGroupOnCancel(cmd)
+	runAs(cmd, sp.RunAs)
 
 	// A deliberately minimal environment. The agent's own environment may hold
 	// credentials (its TLS key path, endpoints); a service script has no need
@@ -189,7 +285,12 @@ func (i *LocalInvoker) Invoke(ctx context.Context, target, service string, in []
 		"QREXEC_SERVICE_FULL_NAME=" + service,
 	}
 
-	var stdout, stderr bytes.Buffer
+	limit := sp.MaxOutput
+	if limit <= 0 {
+		limit = DefaultMaxOutput
+	}
+	stdout := cappedBuffer{limit: limit}
+	var stderr bytes.Buffer
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
 
@@ -197,11 +298,11 @@ func (i *LocalInvoker) Invoke(ctx context.Context, target, service string, in []
 	//
 	// Stdout/Stderr are buffers rather than *os.File, so exec creates an OS pipe
 	// and a copying goroutine, and Wait blocks until every writer closes. The
-	// context kills only the DIRECT child; any grandchild it left behind
-	// inherits the pipe's write end and holds it open. A service that
-	// backgrounds anything therefore pins this call for the grandchild's
-	// lifetime — measured at 30s against a 200ms timeout — and a hostile or
-	// merely careless service could hold an agent worker indefinitely.
+	// context kills the child's process group, but a grandchild that left the
+	// group (setsid, a double fork) inherits the pipe's write end and holds it
+	// open. Before the group kill, merely backgrounding anything pinned this
+	// call for the grandchild's lifetime — measured at 30s against a 200ms
+	// timeout — and a hostile service can still do it deliberately.
 	//
 	// WaitDelay bounds the drain: after cancellation, wait this long for I/O to
 	// finish, then force the pipes closed and return. The deadline is what
@@ -209,18 +310,40 @@ func (i *LocalInvoker) Invoke(ctx context.Context, target, service string, in []
 	cmd.WaitDelay = 2 * time.Second
 
 	if err := cmd.Run(); err != nil {
-		if ctx.Err() == context.DeadlineExceeded {
+		if errors.Is(context.Cause(ctx), errCallTimeout) {
 			return nil, fmt.Errorf("service %q timed out after %s", service, timeout)
 		}
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("service %q stopped: %w", service, context.Cause(ctx))
+		}
 		// stderr is the service's own diagnostic and is the most useful thing an
 		// operator can be shown, so it is surfaced rather than swallowed.
 		return nil, fmt.Errorf("service %q failed: %v: %s",
 			service, err, strings.TrimSpace(stderr.String()))
 	}
-	if stdout.Len() > maxResponseBytes {
-		return nil, fmt.Errorf("%w: %q returned %d bytes", ErrResponseTooLarge, service, stdout.Len())
+	if stdout.over {
+		return nil, fmt.Errorf("%w: %q returned more than %d bytes", ErrResponseTooLarge, service, limit)
+	}
+	return stdout.buf.Bytes(), nil
+}
+
+// cappedBuffer keeps the first limit bytes and notes that more came. The excess
+// is accepted and dropped rather than refused, so the service finishes instead
+// of dying on a broken pipe — its exit status still says how it went — while
+// the agent never holds more than the cap.
+type cappedBuffer struct {
+	buf   bytes.Buffer
+	limit int
+	over  bool
+}
+
+func (c *cappedBuffer) Write(p []byte) (int, error) {
+	if room := c.limit - c.buf.Len(); len(p) > room {
+		c.over = true
+		c.buf.Write(p[:max(room, 0)])
+		return len(p), nil
 	}
-	return stdout.Bytes(), nil
+	return c.buf.Write(p)
 }
 
 // splitServiceArg separates "service+argument" into its parts.
@@ -5,7 +5,9 @@ import (
 	"errors"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -257,3 +259,91 @@ func TestInvokeTimeoutSurvivesBackgroundedChild(t *testing.T) {
 		t.Errorf("a backgrounded grandchild held the call open for %s; WaitDelay is not bounding the drain", elapsed)
 	}
 }
+
+// TestInvokeCancelKillsProcessGroup — a caller that gives up (a Cancel frame
+// from the relay) must stop the work, not just the shell wrapping it. The
+// service backgrounds a sleep, records its pid and waits; after cancellation
+// that sleep must be gone too.
+func TestInvokeCancelKillsProcessGroup(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "child.pid")
+	dir := serviceDir(t, map[string]string{
+		"qubesair.Hang": "#!/bin/sh\nsleep 30 &\necho $! > " + pidFile + "\nwait\n",
+	})
+	inv := invokerOver(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := inv.Invoke(ctx, "t", "qubesair.Hang", nil)
+		done <- err
+	}()
+
+	var pid int
+	deadline := time.Now().Add(5 * time.Second)
+	for pid == 0 {
+		if b, err := os.ReadFile(pidFile); err == nil && len(b) > 0 && b[len(b)-1] == '\n' {
+			pid, _ = strconv.Atoi(strings.TrimSpace(string(b)))
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("service never started its child")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err == nil || strings.Contains(err.Error(), "timed out") {
+			t.Fatalf("a canceled call must fail as stopped, not %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Invoke did not return after cancellation")
+	}
+
+	// The grandchild is reaped by init once killed; poll until it is gone. A
+	// zombie counts as gone: it is dead, and whether it is reaped promptly is up
+	// to whatever runs as init in the test environment.
+	for deadline = time.Now().Add(5 * time.Second); ; {
+		if err := syscall.Kill(pid, 0); err != nil {
+			return
+		}
+		if stat, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat"); err == nil &&
+			strings.Contains(string(stat), ") Z ") {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("backgrounded child %d survived cancellation", pid)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// TestServicesListsWhatWouldRun — the list an agent declares in its handshake
+// must match what Invoke would actually run: builtins always, then the
+// allowlist if there is one, else the executables in the directory.
+func TestServicesListsWhatWouldRun(t *testing.T) {
+	dir := serviceDir(t, map[string]string{
+		"qubesair.Ping": "#!/bin/sh\n",
+		"qubesair.Exec": "#!/bin/sh\n",
+	})
+	if err := os.WriteFile(filepath.Join(dir, "README"), []byte("not a service"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	builtin := func(context.Context, string, []byte) ([]byte, error) { return nil, nil }
+
+	open := invokerOver(dir)
+	if err := open.RegisterBuiltin("qubesair.Status", builtin); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(open.Services(), ","), "qubesair.Exec,qubesair.Ping,qubesair.Status"; got != want {
+		t.Errorf("no allowlist: got %s, want %s", got, want)
+	}
+
+	listed := invokerOver(dir, "qubesair.Ping")
+	if err := listed.RegisterBuiltin("qubesair.Status", builtin); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(listed.Services(), ","), "qubesair.Ping,qubesair.Status"; got != want {
+		t.Errorf("with allowlist: got %s, want %s", got, want)
+	}
+}
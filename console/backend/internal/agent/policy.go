@@ -0,0 +1,135 @@
+// policy.go — per-service execution policy, swappable while the agent runs.
+//
+// The flags the agent started with (-allow, -service-dir) describe one
+// allowlist and nothing else: every service got the same timeout, the same
+// output cap and the agent's own account, and changing any of it meant editing
+// the unit and restarting, which drops every tunnel. A Policy says all of that
+// per service, and SetPolicy replaces it in one step. Calls already running
+// keep the policy they started under; the next call sees the new one.
+
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// ErrArgumentNotAllowed means the service is allowed but not with this argument.
+var ErrArgumentNotAllowed = errors.New("argument is not allowed for this qrexec service")
+
+// ServicePolicy is how one allowed service runs. Zero fields take the
+// invoker's defaults.
+type ServicePolicy struct {
+	// Timeout bounds one execution (default LocalInvoker.Timeout).
+	Timeout time.Duration
+	// MaxOutput caps the bytes the service may return (default 16 MiB).
+	MaxOutput int
+	// RunAs runs the service under another account; nil is the agent's own.
+	RunAs *Account
+	// Args, when set, is what the "+argument" must match in full — an absent
+	// argument is matched as "". Nil accepts any argument, as the allowlist
+	// always has.
+	Args *regexp.Regexp
+}
+
+// Account is a resolved local user a service runs as.
+type Account struct {
+	Name string
+	UID  uint32
+	GID  uint32
+}
+
+// LookupAccount resolves a user name to its uid and primary gid.
+//
+// Resolved when the policy is loaded, not per call: a typo should fail the
+// load that introduced it, not every call afterwards.
+func LookupAccount(name string) (*Account, error) {
+	if !runAsSupported {
+		return nil, fmt.Errorf("run_as %q: running a service as another user is not supported on this platform", name)
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, fmt.Errorf("run_as %q: %w", name, err)
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("run_as %q: uid %q: %w", name, u.Uid, err)
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("run_as %q: gid %q: %w", name, u.Gid, err)
+	}
+	// An agent that is not root cannot change user, and finding that out at
+	// the first call — as EPERM from fork — is later than it should be. The
+	// packaged agent runs as qubes-air; work that needs another account goes
+	// through the privileged helper (internal/agent/privhelper) instead.
+	if euid := os.Geteuid(); euid != 0 && uint64(euid) != uid {
+		return nil, fmt.Errorf("run_as %q: the agent runs as uid %d and cannot switch users; use a helper command instead", name, euid)
+	}
+	return &Account{Name: name, UID: uint32(uid), GID: uint32(gid)}, nil
+}
+
+// Policy is the invoker's reloadable configuration.
+type Policy struct {
+	// ServiceDir holds the service implementations (default DefaultServiceDir).
+	ServiceDir string
+	// Services are the allowed services, by name. A Policy always has some:
+	// unlike the flag allowlist, there is no "empty means every script".
+	Services map[string]ServicePolicy
+	// LogCalls logs every call: service, caller, duration and outcome.
+	LogCalls bool
+}
+
+// Names lists the allowed services, sorted.
+func (p *Policy) Names() []string {
+	out := make([]string, 0, len(p.Services))
+	for name := range p.Services {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// SetPolicy replaces the invoker's policy. It takes precedence over the
+// ServiceDir, Allowed and Timeout fields from then on.
+//
+// A nil or empty policy is refused rather than read as "allow everything":
+// that reading is the flag allowlist's, kept for compatibility, and a config
+// file that lost its services section must not inherit it.
+func (i *LocalInvoker) SetPolicy(p *Policy) error {
+	if p == nil || len(p.Services) == 0 {
+		return errors.New("policy allows no services")
+	}
+	for name := range p.Services {
+		if !validServiceName(name) || name != baseService(name) {
+			return fmt.Errorf("%w: %q", ErrInvalidServiceName, name)
+		}
+	}
+	i.policy.Store(p)
+	return nil
+}
+
+// current is the policy a call runs under: the one set, or one read off the
+// fields for an invoker configured the old way. Services is nil in the latter
+// when the allowlist is empty — every script allowed.
+func (i *LocalInvoker) current() *Policy {
+	if p := i.policy.Load(); p != nil {
+		return p
+	}
+	p := &Policy{ServiceDir: i.ServiceDir}
+	if len(i.Allowed) > 0 {
+		p.Services = make(map[string]ServicePolicy, len(i.Allowed))
+		for name, ok := range i.Allowed {
+			if ok {
+				p.Services[name] = ServicePolicy{}
+			}
+		}
+	}
+	return p
+}
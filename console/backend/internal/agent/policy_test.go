@@ -0,0 +1,119 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"os/user"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func policyOver(dir string, services map[string]ServicePolicy) *Policy {
+	return &Policy{ServiceDir: dir, Services: services}
+}
+
+// TestPolicyReplacesTheFlagAllowlist — once a policy is set, it alone decides
+// what runs; the allowlist the invoker was built with no longer counts.
+func TestPolicyReplacesTheFlagAllowlist(t *testing.T) {
+	dir := serviceDir(t, map[string]string{
+		"qubesair.Ping":  "#!/bin/sh\necho pong\n",
+		"qubesair.Other": "#!/bin/sh\necho other\n",
+	})
+	inv := invokerOver(dir, "qubesair.Ping")
+	if err := inv.SetPolicy(policyOver(dir, map[string]ServicePolicy{"qubesair.Other": {}})); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := inv.Invoke(context.Background(), "t", "qubesair.Ping", nil); !errors.Is(err, ErrServiceNotAllowed) {
+		t.Errorf("a service the policy dropped still ran: %v", err)
+	}
+	if out, err := inv.Invoke(context.Background(), "t", "qubesair.Other", nil); err != nil || strings.TrimSpace(string(out)) != "other" {
+		t.Errorf("Other = %q, %v", out, err)
+	}
+	if got := inv.Services(); len(got) != 1 || got[0] != "qubesair.Other" {
+		t.Errorf("Services() = %v, want the policy's", got)
+	}
+}
+
+func TestSetPolicyRefusesAllowAll(t *testing.T) {
+	inv := NewLocalInvoker("r", []string{"qubesair.Ping"})
+	for _, p := range []*Policy{nil, {}, {Services: map[string]ServicePolicy{"../x": {}}}} {
+		if err := inv.SetPolicy(p); err == nil {
+			t.Errorf("SetPolicy(%+v) accepted", p)
+		}
+	}
+}
+
+func TestPolicyArgumentPattern(t *testing.T) {
+	dir := serviceDir(t, map[string]string{"qubesair.Backup": "#!/bin/sh\necho \"$1\"\n"})
+	inv := invokerOver(dir)
+	if err := inv.SetPolicy(policyOver(dir, map[string]ServicePolicy{
+		"qubesair.Backup": {Args: regexp.MustCompile(`^(?:[a-z]+)$`)},
+	})); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := inv.Invoke(context.Background(), "t", "qubesair.Backup+home", nil); err != nil || strings.TrimSpace(string(out)) != "home" {
+		t.Errorf("a matching argument = %q, %v", out, err)
+	}
+	for _, svc := range []string{"qubesair.Backup+Home1", "qubesair.Backup"} {
+		if _, err := inv.Invoke(context.Background(), "t", svc, nil); !errors.Is(err, ErrArgumentNotAllowed) {
+			t.Errorf("%s = %v, want ErrArgumentNotAllowed", svc, err)
+		}
+	}
+}
+
+func TestPolicyPerServiceLimits(t *testing.T) {
+	dir := serviceDir(t, map[string]string{
+		"qubesair.Slow":   "#!/bin/sh\nsleep 5\n",
+		"qubesair.Chatty": "#!/bin/sh\nhead -c 4096 /dev/zero\n",
+	})
+	inv := invokerOver(dir)
+	if err := inv.SetPolicy(policyOver(dir, map[string]ServicePolicy{
+		"qubesair.Slow":   {Timeout: 200 * time.Millisecond},
+		"qubesair.Chatty": {MaxOutput: 1024},
+	})); err != nil {
+		t.Fatal(err)
+	}
+
+	started := time.Now()
+	if _, err := inv.Invoke(context.Background(), "t", "qubesair.Slow", nil); err == nil || !strings.Contains(err.Error(), "timed out after 200ms") {
+		t.Errorf("Slow = %v, want its own timeout", err)
+	}
+	if time.Since(started) > 4*time.Second {
+		t.Error("the per-service timeout did not apply")
+	}
+	if _, err := inv.Invoke(context.Background(), "t", "qubesair.Chatty", nil); !errors.Is(err, ErrResponseTooLarge) {
+		t.Errorf("Chatty = %v, want ErrResponseTooLarge", err)
+	}
+}
+
+// TestPolicyRunAs runs a service as the current user, the one account a test
+// can switch to without privileges, and checks the service sees it.
+func TestPolicyRunAs(t *testing.T) {
+	if !runAsSupported {
+		t.Skip("run_as is unix-only")
+	}
+	me, err := user.Current()
+	if err != nil {
+		t.Skip(err)
+	}
+	acct, err := LookupAccount(me.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LookupAccount("no-such-user-qubesair"); err == nil {
+		t.Error("an unknown account resolved")
+	}
+
+	dir := serviceDir(t, map[string]string{"qubesair.Whoami": "#!/bin/sh\nid -u\n"})
+	inv := invokerOver(dir)
+	if err := inv.SetPolicy(policyOver(dir, map[string]ServicePolicy{"qubesair.Whoami": {RunAs: acct}})); err != nil {
+		t.Fatal(err)
+	}
+	out, err := inv.Invoke(context.Background(), "t", "qubesair.Whoami", nil)
+	if err != nil || strings.TrimSpace(string(out)) != me.Uid {
+		t.Errorf("Whoami = %q, %v; want uid %s", out, err, me.Uid)
+	}
+}
@@ -0,0 +1,225 @@
+package privhelper
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/slchris/qubes-air/console/internal/agentstatus"
+	"github.com/slchris/qubes-air/console/internal/agentupdate"
+	"github.com/slchris/qubes-air/console/internal/transfer"
+)
+
+// Client calls the helper.
+type Client struct {
+	// Socket is the helper's socket (default DefaultSocket).
+	Socket string
+}
+
+// Do sends one request and returns the helper's answer. A refusal by the
+// helper comes back as an error wrapping the matching sentinel where there is
+// one, so a caller can tell "not allowed" from "did not work".
+func (c *Client) Do(ctx context.Context, req Request) (Response, error) {
+	socket := c.Socket
+	if socket == "" {
+		socket = DefaultSocket
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", socket)
+	if err != nil {
+		return Response{}, fmt.Errorf("privileged helper unavailable: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return Response{}, fmt.Errorf("send to helper: %w", err)
+	}
+	var resp Response
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		if ctx.Err() != nil {
+			return Response{}, ctx.Err()
+		}
+		return Response{}, fmt.Errorf("read helper reply: %w", err)
+	}
+	if resp.Error != "" {
+		return resp, remoteError(resp.Error)
+	}
+	return resp, nil
+}
+
+// Transfer is the agent's qubesair.Transfer builtin: it checks nothing and
+// decides nothing, only carries the step to the helper, which owns the
+// prefixes and runs as the user who can honour them.
+func (c *Client) Transfer(ctx context.Context, _ string, in []byte) ([]byte, error) {
+	var req transfer.Request
+	if err := json.Unmarshal(in, &req); err != nil {
+		return nil, fmt.Errorf("transfer request: %w", err)
+	}
+	resp, err := c.Do(ctx, Request{Op: OpTransfer, Transfer: &req})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Transfer == nil {
+		return nil, errors.New("helper sent no transfer answer")
+	}
+	return json.Marshal(resp.Transfer)
+}
+
+// Update is the agent's qubesair.Update builtin, a carrier like Transfer: the
+// helper checks the package's signature against its own pinned key, and
+// installs it as the root the agent is not.
+func (c *Client) Update(ctx context.Context, _ string, in []byte) ([]byte, error) {
+	var req agentupdate.Request
+	if err := json.Unmarshal(in, &req); err != nil {
+		return nil, fmt.Errorf("update request: %w", err)
+	}
+	resp, err := c.Do(ctx, Request{Op: OpUpdate, Update: &req})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Update == nil {
+		return nil, errors.New("helper sent no update answer")
+	}
+	return json.Marshal(resp.Update)
+}
+
+// DataStatus is the data disk's state, for the agent's qubesair.Status
+// report. The agent cannot see it for itself: the device pattern, the mapper
+// and the mount point are the helper's configuration.
+func (c *Client) DataStatus(ctx context.Context) (*agentstatus.Data, error) {
+	resp, err := c.Do(ctx, Request{Op: OpDataStatus})
+	if err != nil {
+		return nil, err
+	}
+	if resp.DataDisk == nil {
+		return nil, errors.New("helper sent no data disk state")
+	}
+	return resp.DataDisk, nil
+}
+
+// LockData is the agent's qubesair.LockData builtin. It answers the way
+// qubesair.UnlockData does, {"unlocked":bool,"detail":"..."}, so the console
+// reads both with one type; a helper that cannot be reached is an error rather
+// than a detail, because "locked" and "could not ask" must not look alike.
+func (c *Client) LockData(ctx context.Context, _ string, _ []byte) ([]byte, error) {
+	resp, err := c.Do(ctx, Request{Op: OpLockData})
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(struct {
+		Unlocked bool   `json:"unlocked"`
+		Detail   string `json:"detail"`
+	}{resp.Unlocked, resp.Detail})
+}
+
+// CloseData is the same lock taken for the agent's own reasons — the dead
+// man's switch — rather than a caller's: an error unless the disk is closed
+// when it returns, with the helper's detail as the reason.
+func (c *Client) CloseData(ctx context.Context) error {
+	resp, err := c.Do(ctx, Request{Op: OpLockData})
+	if err != nil {
+		return err
+	}
+	if resp.Unlocked {
+		return errors.New(resp.Detail)
+	}
+	return nil
+}
+
+// Shell is the agent's qubesair.Shell stream: it asks the helper for the
+// login terminal and returns the connection, which carries the caller's shell
+// frames to the terminal and its output back. The agent does not read either;
+// closing the connection hangs the terminal up.
+func (c *Client) Shell(ctx context.Context) (io.ReadWriteCloser, error) {
+	socket := c.Socket
+	if socket == "" {
+		socket = DefaultSocket
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("privileged helper unavailable: %w", err)
+	}
+	// Only the request and its answer are bounded by ctx; the terminal lasts
+	// as long as the call it serves.
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+	if err := json.NewEncoder(conn).Encode(Request{Op: OpShell, Command: ShellCommand}); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("send to helper: %w", err)
+	}
+	dec := json.NewDecoder(conn)
+	var resp Response
+	if err := dec.Decode(&resp); err != nil {
+		_ = conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("read helper reply: %w", err)
+	}
+	if resp.Error != "" {
+		_ = conn.Close()
+		return nil, remoteError(resp.Error)
+	}
+	out, err := afterJSON(dec, conn)
+	if !stop() {
+		return nil, ctx.Err() // ctx ended as the answer arrived, and closed conn
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("read helper reply: %w", err)
+	}
+	return &helperStream{Reader: out, conn: conn}, nil
+}
+
+// afterJSON is what follows the value dec just decoded from r: the rest of the
+// stream, past the newline json.Encoder ends every value with.
+func afterJSON(dec *json.Decoder, r io.Reader) (io.Reader, error) {
+	rest := io.MultiReader(dec.Buffered(), r)
+	var nl [1]byte
+	if _, err := io.ReadFull(rest, nl[:]); err != nil {
+		return nil, err
+	}
+	if nl[0] != '\n' {
+		return nil, fmt.Errorf("%q after the JSON value, want a newline", nl[0])
+	}
+	return rest, nil
+}
+
+// helperStream is a helper connection after its JSON answer: reads start with
+// whatever the decoder had already buffered.
+type helperStream struct {
+	io.Reader
+	conn net.Conn
+}
+
+func (h *helperStream) Write(p []byte) (int, error) { return h.conn.Write(p) }
+func (h *helperStream) Close() error                { return h.conn.Close() }
+
+// CloseWrite tells the helper there is no more input, which hangs the
+// terminal up; the transport calls it when the caller's input ends.
+func (h *helperStream) CloseWrite() error {
+	if uc, ok := h.conn.(*net.UnixConn); ok {
+		return uc.CloseWrite()
+	}
+	return h.conn.Close()
+}
+
+// remoteError rebuilds an error the helper sent as text.
+func remoteError(msg string) error {
+	for _, sentinel := range []error{ErrCallerRefused, ErrPathNotAllowed, ErrCommandNotAllowed, ErrUnknownOp} {
+		if strings.HasPrefix(msg, sentinel.Error()) {
+			return fmt.Errorf("%w%s", sentinel, strings.TrimPrefix(msg, sentinel.Error()))
+		}
+	}
+	return errors.New(msg)
+}
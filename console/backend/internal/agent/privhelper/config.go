@@ -0,0 +1,319 @@
+package privhelper
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/slchris/qubes-air/console/internal/agentupdate"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultConfigPath is where the packaged helper reads its configuration.
+const DefaultConfigPath = "/etc/qubes-air/helper.yaml"
+
+// ConfigVersion is the only file version this helper reads.
+const ConfigVersion = 1
+
+// DefaultSpool is where the packaged helper keeps staged tree pushes and
+// packed trees waiting to be pulled.
+const DefaultSpool = "/var/lib/qubes-air/transfer"
+
+// DefaultUpdateKeyFile is where the packaged helper finds the keys an agent
+// package must be signed with. cloud-init writes it when the console pins one.
+const DefaultUpdateKeyFile = "/etc/qubes-air/update.pub"
+
+// ShellCommand is the terminal command qubesair.Shell asks for.
+const ShellCommand = "login"
+
+// DefaultCommandTimeout bounds a command that sets no timeout of its own.
+const DefaultCommandTimeout = 2 * time.Minute
+
+// ErrInvalidConfig means a helper configuration failed validation.
+var ErrInvalidConfig = errors.New("invalid helper config")
+
+// Config is the helper's configuration. It lives in /etc, root-owned, next to
+// the agent's — readable by the agent, writable only by root, so the process it
+// constrains cannot loosen it.
+type Config struct {
+	Version int `yaml:"version"`
+	// Socket is where the helper listens (default DefaultSocket).
+	Socket string `yaml:"socket,omitempty"`
+	// Callers are the users allowed to connect, by name or uid. Root is always
+	// allowed: it can do all of this without the helper anyway.
+	Callers []string `yaml:"callers"`
+	// Files are the prefixes write_file, read_file and qubesair.Transfer may
+	// touch.
+	Files []FilePrefix `yaml:"files,omitempty"`
+	// Spool is where transfers keep what has no place beside its target
+	// (default DefaultSpool). Root's alone; not under any prefix.
+	Spool string `yaml:"spool,omitempty"`
+	// Data is the encrypted data disk.
+	Data DataDisk `yaml:"data,omitempty"`
+	// Commands are what run may start.
+	Commands []Command `yaml:"commands,omitempty"`
+	// Update is where qubesair.Update takes agent packages from, and what
+	// they must be signed with.
+	Update Update `yaml:"update,omitempty"`
+
+	callerUIDs map[uint32]bool
+	// path is the file the configuration was read from, which the install
+	// unit qubesair.Update starts reads it again from.
+	path string
+}
+
+// FilePrefix is a directory tree write_file and read_file may reach.
+type FilePrefix struct {
+	Prefix string `yaml:"prefix"`
+	// ReadOnly allows read_file only.
+	ReadOnly bool `yaml:"read_only,omitempty"`
+}
+
+// DataDisk is where the LUKS container is and where it is mounted.
+type DataDisk struct {
+	// Device is a glob for the block device (default the second SCSI disk by
+	// path, which is how the terraform modules attach it).
+	Device string `yaml:"device,omitempty"`
+	// Mapper is the device-mapper name (default qubesair-data).
+	Mapper string `yaml:"mapper,omitempty"`
+	// Mount is the mount point (default /data).
+	Mount string `yaml:"mount,omitempty"`
+}
+
+// Update configures qubesair.Update.
+type Update struct {
+	// KeyFile holds the pinned public keys, one base64 Ed25519 key per line
+	// (default DefaultUpdateKeyFile). It must be root's and writable by no
+	// one else: the agent's user can create files in /etc/qubes-air, and a key
+	// it wrote would let it install anything as root. Absent, no update is
+	// installed.
+	KeyFile string `yaml:"key_file,omitempty"`
+	// Dir keeps the update's state, the package being installed and the one
+	// to roll back to (default /var/lib/qubes-air/update).
+	Dir string `yaml:"dir,omitempty"`
+	// Sources, when set, are the URL prefixes packages may be fetched from —
+	// the apt mirror, the console's artifact store. A package URL must have a
+	// source's scheme and host and sit at or below its path. The signature is
+	// what is trusted; this only narrows where the helper will go to look.
+	Sources []string `yaml:"sources,omitempty"`
+	// AllowDowngrade lets an update install a package older than the one
+	// installed. Off by default: rolling a remote back to an older signed
+	// build is a decision for this file, not for whoever can send an apply.
+	// Each downgrade it lets through is logged.
+	AllowDowngrade bool `yaml:"allow_downgrade,omitempty"`
+}
+
+// Command is one thing run may start.
+type Command struct {
+	// Name is how a caller asks for it.
+	Name string `yaml:"name"`
+	// Path is the executable: absolute, or a name looked up on the helper's
+	// fixed PATH when the command runs.
+	Path string `yaml:"path"`
+	// Args come first; the caller's arguments follow them.
+	Args []string `yaml:"args,omitempty"`
+	// FixedArgs refuses caller arguments altogether.
+	FixedArgs bool `yaml:"fixed_args,omitempty"`
+	// User runs the command as this account, by name or uid. Required, and
+	// "root" must be written out: a command that runs as root should be a
+	// decision somebody can point at in this file.
+	User string `yaml:"user"`
+	// Env adds to the command's minimal environment.
+	Env map[string]string `yaml:"env,omitempty"`
+	// TimeoutSeconds bounds the command (default 120).
+	TimeoutSeconds int `yaml:"timeout_seconds,omitempty"`
+	// Detach starts the command and returns without waiting for it, for
+	// launching applications that outlive the call.
+	Detach bool `yaml:"detach,omitempty"`
+	// TTY makes the command a terminal session: it runs on a pseudo-terminal
+	// for as long as the caller stays connected (qubesair.Shell), and only
+	// shell may start it. TimeoutSeconds, when set, bounds the session.
+	TTY bool `yaml:"tty,omitempty"`
+}
+
+// DefaultConfig is what the helper serves when it has no file: the operations
+// the packaged qrexec services use, and nothing wider than they used before.
+//
+// The shell runs as the first regular user (uid 1000), not root. Under
+// systemd-run qubesair.Exec was a root shell; keeping that as a default would
+// make the helper a more roundabout way to be root. An operator who wants it
+// back writes "user: root" in helper.yaml.
+func DefaultConfig() *Config {
+	return &Config{
+		Version: ConfigVersion,
+		Callers: []string{"qubes-air"},
+		Files: []FilePrefix{
+			{Prefix: "/data"},
+			{Prefix: "/home"},
+			{Prefix: "/tmp"},
+		},
+		Commands: []Command{
+			{Name: "shell", Path: "/bin/bash", Args: []string{"-lc"}, User: "1000"},
+			{Name: ShellCommand, Path: "/bin/bash", Args: []string{"-l"}, FixedArgs: true, User: "1000", TTY: true},
+			{
+				Name: "start-app", Path: "qubes-desktop-run", User: "1000", Detach: true,
+				Env: map[string]string{"DISPLAY": ":100"},
+			},
+		},
+	}
+}
+
+// LoadConfig reads the configuration at path. A missing file is the default;
+// a file that exists and does not validate is an error, as with the agent's.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path) // #nosec G304 -- operator-supplied path
+	if errors.Is(err, os.ErrNotExist) {
+		cfg := DefaultConfig()
+		cfg.path = path
+		return cfg, cfg.Validate()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read helper config: %w", err)
+	}
+	var cfg Config
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrInvalidConfig, path, err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	cfg.path = path
+	return &cfg, nil
+}
+
+// Validate checks the configuration, fills its defaults and resolves its
+// callers.
+//
+// Command users are NOT resolved here: uid 1000 may not exist until cloud-init
+// creates it, after the helper has started, and a helper that refused to start
+// for that would take UnlockData down with it. They are resolved per run.
+//
+//nolint:gocyclo // one check per field, each independent
+func (c *Config) Validate() error {
+	bad := func(format string, args ...any) error {
+		return fmt.Errorf("%w: %s", ErrInvalidConfig, fmt.Sprintf(format, args...))
+	}
+	if c.Version != ConfigVersion {
+		return bad("version %d is not supported (this helper reads version %d)", c.Version, ConfigVersion)
+	}
+	if c.Socket == "" {
+		c.Socket = DefaultSocket
+	}
+	if c.Spool == "" {
+		c.Spool = DefaultSpool
+	}
+	if !filepath.IsAbs(c.Spool) {
+		return bad("spool %q must be absolute", c.Spool)
+	}
+	if c.Data.Device == "" {
+		c.Data.Device = "/dev/disk/by-path/*-scsi-0:0:0:1"
+	}
+	if c.Data.Mapper == "" {
+		c.Data.Mapper = "qubesair-data"
+	}
+	if c.Data.Mount == "" {
+		c.Data.Mount = "/data"
+	}
+	if !filepath.IsAbs(c.Data.Mount) || strings.ContainsAny(c.Data.Mapper, "/ ") {
+		return bad("data: mount must be absolute and mapper a plain name")
+	}
+	if c.Update.KeyFile == "" {
+		c.Update.KeyFile = DefaultUpdateKeyFile
+	}
+	if c.Update.Dir == "" {
+		c.Update.Dir = agentupdate.DefaultDir
+	}
+	if !filepath.IsAbs(c.Update.KeyFile) || !filepath.IsAbs(c.Update.Dir) {
+		return bad("update: key_file and dir must be absolute")
+	}
+	for i, src := range c.Update.Sources {
+		norm, err := agentupdate.NormalizeSource(src)
+		if err != nil {
+			return bad("update: %v", err)
+		}
+		c.Update.Sources[i] = norm
+	}
+
+	if len(c.Callers) == 0 {
+		return bad("no callers: nothing could use the helper")
+	}
+	c.callerUIDs = map[uint32]bool{0: true}
+	for _, name := range c.Callers {
+		uid, err := lookupUID(name)
+		if err != nil {
+			return bad("caller %q: %v", name, err)
+		}
+		c.callerUIDs[uid] = true
+	}
+
+	for i, f := range c.Files {
+		clean := filepath.Clean(f.Prefix)
+		if !filepath.IsAbs(f.Prefix) || clean == "/" {
+			return bad("files %d: prefix %q must be an absolute directory other than /", i, f.Prefix)
+		}
+		c.Files[i].Prefix = clean
+	}
+
+	names := make(map[string]bool, len(c.Commands))
+	for i, cmd := range c.Commands {
+		switch {
+		case cmd.Name == "" || names[cmd.Name]:
+			return bad("command %d: name %q is empty or repeated", i, cmd.Name)
+		case cmd.Path == "" || (!filepath.IsAbs(cmd.Path) && strings.Contains(cmd.Path, "/")):
+			return bad("command %q: path must be absolute or a bare name", cmd.Name)
+		case cmd.User == "":
+			return bad("command %q: user is required (write \"root\" if that is what you mean)", cmd.Name)
+		case cmd.TimeoutSeconds < 0:
+			return bad("command %q: negative timeout", cmd.Name)
+		case cmd.TTY && cmd.Detach:
+			return bad("command %q: a terminal command cannot be detached", cmd.Name)
+		}
+		names[cmd.Name] = true
+	}
+	return nil
+}
+
+// command finds a configured command by name.
+func (c *Config) command(name string) (Command, bool) {
+	for _, cmd := range c.Commands {
+		if cmd.Name == name {
+			return cmd, true
+		}
+	}
+	return Command{}, false
+}
+
+// PrimaryGID is the primary group of a user, by name or uid.
+func PrimaryGID(name string) (int, error) {
+	u, err := lookupUser(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(u.Gid)
+}
+
+// lookupUID resolves a user name, or a decimal uid, to a uid.
+func lookupUID(name string) (uint32, error) {
+	u, err := lookupUser(name)
+	if err != nil {
+		return 0, err
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	return uint32(uid), err
+}
+
+// lookupUser resolves a user by name, or by uid when name is all digits.
+func lookupUser(name string) (*user.User, error) {
+	if _, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return user.LookupId(name)
+	}
+	return user.Lookup(name)
+}
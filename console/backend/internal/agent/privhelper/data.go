@@ -0,0 +1,176 @@
+package privhelper
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/slchris/qubes-air/console/internal/agentstatus"
+)
+
+// system is what the data-disk operations do to the host: run a tool, find
+// the device, look at a path. An interface so the decisions around cryptsetup
+// can be tested without a block device.
+type system interface {
+	// run runs a system tool, stdin fed from in, and returns its combined
+	// output. A non-zero exit is an error.
+	run(ctx context.Context, in []byte, name string, args ...string) (string, error)
+	glob(pattern string) ([]string, error)
+	exists(path string) bool
+	mkdirAll(path string) error
+	diskUsage(path string) (agentstatus.Disk, error)
+}
+
+type hostSystem struct{}
+
+func (hostSystem) run(ctx context.Context, in []byte, name string, args ...string) (string, error) {
+	// #nosec G204 -- name is one of this file's fixed tools; args are built
+	// from the root-owned config and never from a request.
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Env = []string{"PATH=" + helperPath}
+	cmd.Stdin = bytes.NewReader(in)
+	out, err := cmd.CombinedOutput()
+	return strings.TrimSpace(string(out)), err
+}
+
+func (hostSystem) glob(pattern string) ([]string, error) { return filepath.Glob(pattern) }
+
+func (hostSystem) exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func (hostSystem) mkdirAll(path string) error { return os.MkdirAll(path, 0o755) }
+
+func (hostSystem) diskUsage(path string) (agentstatus.Disk, error) {
+	return agentstatus.DiskUsage(path)
+}
+
+// unlockData opens the LUKS container, formatting it first if the disk is
+// blank, and mounts it. The same steps qubesair.UnlockData ran under
+// systemd-run, with the same refusals: a disk that carries anything other
+// than LUKS is never formatted, and an already-mounted disk is success.
+//
+// The passphrase goes to cryptsetup on stdin, "--key-file=-", so it is never
+// in an argument list (visible in /proc) or a file. It is used byte for byte:
+// no trailing newline is added or stripped, so format and open agree.
+//
+// An answer the disk is not unlocked is a Response with Unlocked false, not an
+// error: "wrong key" is the disk's state, and the caller reports it as such.
+//
+//nolint:gocyclo // the steps of one procedure, each with its own refusal
+func unlockData(ctx context.Context, sys system, d DataDisk, key string) Response {
+	no := func(format string, args ...any) Response {
+		return Response{Detail: fmt.Sprintf(format, args...)}
+	}
+	if key == "" {
+		return no("empty passphrase")
+	}
+	devs, _ := sys.glob(d.Device)
+	if len(devs) == 0 {
+		return no("no data disk (%s) attached", d.Device)
+	}
+	dev := devs[0]
+	mapped := "/dev/mapper/" + d.Mapper
+
+	if sys.exists(mapped) && isMounted(ctx, sys, d.Mount) {
+		return Response{Unlocked: true, Detail: "already unlocked and mounted"}
+	}
+
+	if _, err := sys.run(ctx, nil, "cryptsetup", "isLuks", dev); err == nil {
+		if !sys.exists(mapped) {
+			if _, err := sys.run(ctx, []byte(key), "cryptsetup", "luksOpen", "--key-file=-", dev, d.Mapper); err != nil {
+				return no("luksOpen failed (wrong key?)")
+			}
+		}
+	} else {
+		if fstype, _ := sys.run(ctx, nil, "blkid", "-o", "value", "-s", "TYPE", dev); fstype != "" {
+			return no("disk carries a %s filesystem, not LUKS; refusing to overwrite", fstype)
+		}
+		// pbkdf2 at the minimum: the passphrase is 256 bits of HKDF output, so
+		// a slow KDF defends nothing and costs a 2 GB VM its memory.
+		if _, err := sys.run(ctx, []byte(key), "cryptsetup", "luksFormat", "--type", "luks2", "--batch-mode",
+			"--pbkdf", "pbkdf2", "--pbkdf-force-iterations", "1000", "--key-file=-", dev); err != nil {
+			return no("luksFormat failed")
+		}
+		if _, err := sys.run(ctx, []byte(key), "cryptsetup", "luksOpen", "--key-file=-", dev, d.Mapper); err != nil {
+			return no("luksOpen after format failed")
+		}
+	}
+
+	if fstype, _ := sys.run(ctx, nil, "blkid", "-o", "value", "-s", "TYPE", mapped); fstype == "" {
+		if out, err := sys.run(ctx, nil, "mkfs.ext4", "-q", "-L", "qubesair-data", mapped); err != nil {
+			return no("mkfs failed: %s", out)
+		}
+	}
+	if err := sys.mkdirAll(d.Mount); err != nil {
+		return no("create %s: %v", d.Mount, err)
+	}
+	if !isMounted(ctx, sys, d.Mount) {
+		if out, err := sys.run(ctx, nil, "mount", mapped, d.Mount); err != nil {
+			return no("opened but mount failed: %s", out)
+		}
+	}
+	return Response{Unlocked: true, Detail: "unlocked and mounted"}
+}
+
+// lockData unmounts the data disk and closes the container, leaving the key
+// nowhere on the host. Unlocked false with no error means it is locked now;
+// a busy mount is reported, and the container is then left open rather than
+// pulled from under the processes using it.
+//
+// The filesystem is synced first, on its own, although umount would flush it
+// anyway. The sync is what still happens when the unmount is refused: the
+// console locks before it tears the VM down, and a mount held busy by some
+// process should at least reach the disk with everything written so far.
+func lockData(ctx context.Context, sys system, d DataDisk) Response {
+	mapped := "/dev/mapper/" + d.Mapper
+	if isMounted(ctx, sys, d.Mount) {
+		if out, err := sys.run(ctx, nil, "sync", "--file-system", d.Mount); err != nil {
+			return Response{Unlocked: true, Detail: "sync failed: " + out}
+		}
+		if out, err := sys.run(ctx, nil, "umount", d.Mount); err != nil {
+			return Response{Unlocked: true, Detail: "unmount failed: " + out}
+		}
+	}
+	if sys.exists(mapped) {
+		if out, err := sys.run(ctx, nil, "cryptsetup", "close", d.Mapper); err != nil {
+			return Response{Unlocked: true, Detail: "close failed: " + out}
+		}
+		return Response{Detail: "unmounted and closed"}
+	}
+	return Response{Detail: "already locked"}
+}
+
+// dataStatus says whether the data disk is attached, open and mounted, without
+// touching it. It does not wait for the disk lock: a status asked during a
+// first unlock's luksFormat should come back with the half-done state, not
+// sit behind the format until the probe that asked has given up.
+//
+// Mounted is the mount point's, whatever is mounted there. A /data that is
+// mounted with the container closed is not the data disk, and the caller
+// knows it from Open.
+func dataStatus(ctx context.Context, sys system, d DataDisk) agentstatus.Data {
+	devs, _ := sys.glob(d.Device)
+	st := agentstatus.Data{
+		Attached: len(devs) > 0,
+		Open:     sys.exists("/dev/mapper/" + d.Mapper),
+		Mounted:  isMounted(ctx, sys, d.Mount),
+		Mount:    d.Mount,
+	}
+	if st.Mounted {
+		if u, err := sys.diskUsage(d.Mount); err == nil {
+			st.FreeBytes, st.TotalBytes = u.FreeBytes, u.TotalBytes
+		}
+	}
+	return st
+}
+
+func isMounted(ctx context.Context, sys system, path string) bool {
+	_, err := sys.run(ctx, nil, "mountpoint", "-q", path)
+	return err == nil
+}
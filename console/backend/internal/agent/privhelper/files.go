@@ -0,0 +1,131 @@
+package privhelper
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// resolve finds the prefix path falls under and path's name relative to it.
+// The longest matching prefix wins, so a read-only /home/user/keys under a
+// writable /home stays read-only.
+func (c *Config) resolve(path string, write bool) (prefix, rel string, err error) {
+	if !filepath.IsAbs(path) || strings.ContainsRune(path, 0) {
+		return "", "", fmt.Errorf("%w: %q is not an absolute path", ErrPathNotAllowed, path)
+	}
+	clean := filepath.Clean(path)
+	best := -1
+	for i, f := range c.Files {
+		if (clean == f.Prefix || strings.HasPrefix(clean, f.Prefix+"/")) &&
+			(best < 0 || len(f.Prefix) > len(c.Files[best].Prefix)) {
+			best = i
+		}
+	}
+	if best < 0 || clean == c.Files[best].Prefix {
+		return "", "", fmt.Errorf("%w: %q", ErrPathNotAllowed, path)
+	}
+	f := c.Files[best]
+	if write && f.ReadOnly {
+		return "", "", fmt.Errorf("%w: %q is under read-only %s", ErrPathNotAllowed, path, f.Prefix)
+	}
+	return f.Prefix, strings.TrimPrefix(clean, f.Prefix+"/"), nil
+}
+
+// writeFile writes data to path atomically: a temporary file beside it, then a
+// rename. The new file belongs to whoever owns its directory, so a file pushed
+// into a user's home is that user's to edit.
+//
+// Everything below the prefix is resolved inside an os.Root, which refuses
+// any step — a "..", a symlink — that would leave the prefix. Checking the
+// path as a string is not enough on its own: the agent's user may be able to
+// plant a symlink under /tmp, and the helper would follow it as root.
+func (c *Config) writeFile(path string, mode uint32, data []byte) (Response, error) {
+	prefix, rel, err := c.resolve(path, true)
+	if err != nil {
+		return Response{}, err
+	}
+	root, err := os.OpenRoot(prefix)
+	if err != nil {
+		return Response{}, err
+	}
+	defer root.Close()
+
+	dir := filepath.Dir(rel)
+	dirInfo, err := root.Stat(dir)
+	if err != nil {
+		return Response{}, fmt.Errorf("target directory: %w", err)
+	}
+	if !dirInfo.IsDir() {
+		return Response{}, fmt.Errorf("target directory %s is not a directory", filepath.Join(prefix, dir))
+	}
+	perm := fs.FileMode(mode) & fs.ModePerm
+	if perm == 0 {
+		perm = 0o644
+	}
+
+	var suffix [6]byte
+	_, _ = rand.Read(suffix[:])
+	tmp := rel + "." + hex.EncodeToString(suffix[:]) + ".part"
+	f, err := root.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return Response{}, err
+	}
+	_, werr := f.Write(data)
+	if werr == nil {
+		werr = f.Sync()
+	}
+	if cerr := f.Close(); werr == nil {
+		werr = cerr
+	}
+	if werr == nil {
+		werr = chownLike(root, tmp, dirInfo)
+	}
+	if werr == nil {
+		werr = root.Rename(tmp, rel)
+	}
+	if werr != nil {
+		_ = root.Remove(tmp)
+		return Response{}, werr
+	}
+	sum := sha256.Sum256(data)
+	return Response{Size: int64(len(data)), SHA256: hex.EncodeToString(sum[:])}, nil
+}
+
+// readFile reads a regular file under an allowed prefix.
+func (c *Config) readFile(path string, limit int) (Response, error) {
+	prefix, rel, err := c.resolve(path, false)
+	if err != nil {
+		return Response{}, err
+	}
+	root, err := os.OpenRoot(prefix)
+	if err != nil {
+		return Response{}, err
+	}
+	defer root.Close()
+
+	f, err := root.Open(rel)
+	if err != nil {
+		return Response{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return Response{}, err
+	}
+	if !info.Mode().IsRegular() {
+		return Response{}, fmt.Errorf("%s is not a regular file", path)
+	}
+	if info.Size() > int64(limit) {
+		return Response{}, fmt.Errorf("%s is %d bytes, more than the %d a read may return", path, info.Size(), limit)
+	}
+	data := make([]byte, info.Size())
+	if _, err := f.ReadAt(data, 0); err != nil && info.Size() > 0 {
+		return Response{}, err
+	}
+	return Response{Data: data, Size: info.Size()}, nil
+}
@@ -0,0 +1,11 @@
+//go:build unix && !linux
+
+package privhelper
+
+import "errors"
+
+// sockPeerUID is Linux-only: the helper runs on the remotes, which are Linux.
+// Elsewhere every caller is refused rather than trusted unchecked.
+func sockPeerUID(int) (uint32, error) {
+	return 0, errors.New("peer credentials are not supported on this platform")
+}
@@ -0,0 +1,140 @@
+// Package privhelper is the agent's privileged half: a small root daemon that
+// does the handful of things a remote needs root for, over a typed API on a
+// local socket, for the unprivileged agent and nobody else.
+//
+// Until this package, qubesair.Exec, FileCopy and UnlockData escaped the
+// agent's systemd sandbox with systemd-run, which the agent could do because it
+// ran as root. That made the network-facing process — the one parsing frames
+// from the tunnel — root in every way that mattered: any bug in it was a root
+// shell on the host. Now the agent runs as its own user and can ask for exactly
+// these operations, each with its arguments checked here, on the trusted side
+// of the socket:
+//
+//   - open and close the LUKS data disk and mount it on /data, close it again
+//     for qubesair.LockData, and say which of those it is for qubesair.Status
+//     (internal/agentstatus);
+//   - write and read files under configured prefixes;
+//   - run commands from a configured list, as a configured user;
+//   - serve qubesair.Transfer's chunked pushes and pulls (internal/transfer)
+//     under the same prefixes;
+//   - start a configured terminal command on a pseudo-terminal for
+//     qubesair.Shell (internal/shell);
+//   - install a signed agent package for qubesair.Update, and put the old
+//     one back when the new agent is not confirmed (internal/agentupdate).
+//
+// There is deliberately no "run this as root" operation. A command that needs
+// root is named in the helper's configuration by the operator, not chosen by
+// whoever reached the agent.
+//
+// The wire format is one JSON request and one JSON response per connection.
+// A shell request is the exception: after its response the connection is the
+// terminal — shell frames in, the terminal's output out — until one side
+// hangs up.
+// The socket is mode 0660 and the server also checks the peer's uid, so a
+// permissions mistake on the directory is not all that stands in the way.
+package privhelper
+
+import (
+	"errors"
+
+	"github.com/slchris/qubes-air/console/internal/agentstatus"
+	"github.com/slchris/qubes-air/console/internal/agentupdate"
+	"github.com/slchris/qubes-air/console/internal/transfer"
+)
+
+// DefaultSocket is where the packaged helper listens.
+const DefaultSocket = "/run/qubes-air/helper.sock"
+
+// LockDataService is the agent builtin that closes the data disk (see
+// Client.LockData). Its unlocking twin is still a script in ServiceDir, which
+// the key reaches on stdin; locking carries nothing and needs no script.
+const LockDataService = "qubesair.LockData"
+
+// maxRequestBytes bounds one request. The largest legitimate one is a file
+// write, which the agent already caps at its own 16 MiB response limit; the
+// base64 in JSON adds a third. A transfer chunk (at most
+// transfer.MaxChunkSize) fits with room to spare.
+const maxRequestBytes = 24 << 20
+
+// Operations.
+const (
+	OpUnlockData = "unlock_data"
+	OpLockData   = "lock_data"
+	OpDataStatus = "data_status"
+	OpWriteFile  = "write_file"
+	OpReadFile   = "read_file"
+	OpRun        = "run"
+	OpTransfer   = "transfer"
+	OpShell      = "shell"
+	OpUpdate     = "update"
+)
+
+// Errors the helper reports. They cross the socket as text; the client maps
+// the ones a caller may want to tell apart back to these values.
+var (
+	// ErrCallerRefused means the peer's uid is not one the helper serves.
+	ErrCallerRefused = errors.New("caller is not permitted to use the helper")
+	// ErrPathNotAllowed means a path falls outside every configured prefix.
+	ErrPathNotAllowed = errors.New("path is outside the helper's allowed prefixes")
+	// ErrCommandNotAllowed means a command is not in the helper's list.
+	ErrCommandNotAllowed = errors.New("command is not in the helper's list")
+	// ErrUnknownOp means the request named no operation the helper has.
+	ErrUnknownOp = errors.New("unknown helper operation")
+)
+
+// Request is one call to the helper. Only the fields of Op are read.
+type Request struct {
+	Op string `json:"op"`
+
+	// Key is the LUKS passphrase for unlock_data.
+	Key string `json:"key,omitempty"`
+
+	// Path, Mode and Data are for write_file and read_file.
+	Path string `json:"path,omitempty"`
+	Mode uint32 `json:"mode,omitempty"`
+	Data []byte `json:"data,omitempty"`
+
+	// Command, Args and Stdin are for run, and Command for shell. Args are
+	// appended to the command's configured arguments, never substituted into
+	// them.
+	Command string   `json:"command,omitempty"`
+	Args    []string `json:"args,omitempty"`
+	Stdin   []byte   `json:"stdin,omitempty"`
+
+	// Transfer is one qubesair.Transfer step, passed through as the agent
+	// received it.
+	Transfer *transfer.Request `json:"transfer,omitempty"`
+
+	// Update is one qubesair.Update step, passed through likewise.
+	Update *agentupdate.Request `json:"update,omitempty"`
+}
+
+// Response is the helper's answer. Error is set when the operation did not
+// happen; everything else describes what did.
+type Response struct {
+	Error string `json:"error,omitempty"`
+
+	// Unlocked and Detail are the data disk's state after unlock_data or
+	// lock_data, in the shape qubesair.UnlockData always answered with.
+	Unlocked bool   `json:"unlocked"`
+	Detail   string `json:"detail,omitempty"`
+
+	// DataDisk is the data disk's state after data_status.
+	DataDisk *agentstatus.Data `json:"data_disk,omitempty"`
+
+	// Size and SHA256 describe the file write_file wrote.
+	Size   int64  `json:"size,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+
+	// Data is the file read_file read, or the combined output of run.
+	Data []byte `json:"data,omitempty"`
+	// ExitCode is run's exit status: 124 when the command was killed at its
+	// timeout, as timeout(1) reports it, and -1 when it was started detached.
+	ExitCode int `json:"exit_code"`
+
+	// Transfer is the answer to a transfer step.
+	Transfer *transfer.Response `json:"transfer,omitempty"`
+
+	// Update is where the remote's update is after an update step.
+	Update *agentupdate.Status `json:"update,omitempty"`
+}
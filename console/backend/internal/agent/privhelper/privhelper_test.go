@@ -0,0 +1,422 @@
+package privhelper
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/slchris/qubes-air/console/internal/agentstatus"
+	"github.com/slchris/qubes-air/console/internal/agentupdate"
+	"github.com/slchris/qubes-air/console/internal/shell"
+	"github.com/slchris/qubes-air/console/internal/transfer"
+)
+
+// testConfig is a validated config whose callers and commands are the user
+// running the test, with one writable and one read-only prefix under dir.
+func testConfig(t *testing.T, dir string) *Config {
+	t.Helper()
+	me, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sub := range []string{"rw", "ro"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg := &Config{
+		Version: ConfigVersion,
+		Callers: []string{me.Uid},
+		Files: []FilePrefix{
+			{Prefix: filepath.Join(dir, "rw")},
+			{Prefix: filepath.Join(dir, "ro"), ReadOnly: true},
+		},
+		Commands: []Command{
+			{Name: "echo", Path: "echo", User: me.Uid},
+			{Name: "date", Path: "/bin/date", User: me.Uid, FixedArgs: true},
+			{Name: "sleep", Path: "sleep", User: me.Uid, TimeoutSeconds: 1},
+			{Name: ShellCommand, Path: "/bin/sh", User: me.Uid, TTY: true},
+		},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestConfigValidate(t *testing.T) {
+	for name, mutate := range map[string]func(*Config){
+		"future version":   func(c *Config) { c.Version = 2 },
+		"no callers":       func(c *Config) { c.Callers = nil },
+		"unknown caller":   func(c *Config) { c.Callers = []string{"no-such-user-here"} },
+		"root prefix":      func(c *Config) { c.Files = []FilePrefix{{Prefix: "/"}} },
+		"relative prefix":  func(c *Config) { c.Files = []FilePrefix{{Prefix: "data"}} },
+		"no command user":  func(c *Config) { c.Commands = []Command{{Name: "x", Path: "/bin/true"}} },
+		"relative command": func(c *Config) { c.Commands = []Command{{Name: "x", Path: "bin/true", User: "root"}} },
+		"detached terminal": func(c *Config) {
+			c.Commands = []Command{{Name: "x", Path: "/bin/sh", User: "root", TTY: true, Detach: true}}
+		},
+		"source not a URL":  func(c *Config) { c.Update.Sources = []string{"artifacts.example/agent"} },
+		"source with query": func(c *Config) { c.Update.Sources = []string{"https://artifacts.example/?token=x"} },
+		"repeated command": func(c *Config) {
+			c.Commands = []Command{{Name: "x", Path: "/bin/true", User: "root"}, {Name: "x", Path: "/bin/true", User: "root"}}
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.Callers = []string{"root"}
+			mutate(cfg)
+			if err := cfg.Validate(); !errors.Is(err, ErrInvalidConfig) {
+				t.Errorf("Validate = %v, want ErrInvalidConfig", err)
+			}
+		})
+	}
+	cfg := DefaultConfig()
+	cfg.Callers = []string{"root"}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("the default config (callers: root) = %v", err)
+	}
+	cfg.Update.Sources = []string{"https://Artifacts.Example/agent"}
+	if err := cfg.Validate(); err != nil || cfg.Update.Sources[0] != "https://artifacts.example/agent/" {
+		t.Errorf("source after Validate = %q, %v; want it normalized", cfg.Update.Sources, err)
+	}
+}
+
+func TestFilesStayUnderTheirPrefixes(t *testing.T) {
+	dir := t.TempDir()
+	cfg := testConfig(t, dir)
+	rw := filepath.Join(dir, "rw")
+
+	resp, err := cfg.writeFile(filepath.Join(rw, "notes.txt"), 0o600, []byte("hello"))
+	if err != nil || resp.Size != 5 || len(resp.SHA256) != 64 {
+		t.Fatalf("write = %+v, %v", resp, err)
+	}
+	got, err := cfg.readFile(filepath.Join(rw, "notes.txt"), 1<<20)
+	if err != nil || string(got.Data) != "hello" {
+		t.Fatalf("read = %q, %v", got.Data, err)
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(rw, "*.part")); len(leftovers) != 0 {
+		t.Errorf("temporary files left behind: %v", leftovers)
+	}
+
+	// A symlink under the prefix must not carry a root write out of it.
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(rw, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfg.writeFile(filepath.Join(rw, "escape", "owned"), 0, []byte("x")); err == nil {
+		t.Error("a write followed a symlink out of its prefix")
+	}
+	if _, err := os.Stat(filepath.Join(outside, "owned")); err == nil {
+		t.Error("the file landed outside the prefix")
+	}
+
+	for _, bad := range []string{
+		"/etc/passwd",
+		filepath.Join(rw, "..", "elsewhere"),
+		rw, // the prefix itself is not a file
+		"relative/path",
+	} {
+		if _, err := cfg.writeFile(bad, 0, []byte("x")); !errors.Is(err, ErrPathNotAllowed) {
+			t.Errorf("write %q = %v, want ErrPathNotAllowed", bad, err)
+		}
+	}
+	if _, err := cfg.writeFile(filepath.Join(dir, "ro", "x"), 0, []byte("x")); !errors.Is(err, ErrPathNotAllowed) {
+		t.Errorf("write under a read-only prefix = %v", err)
+	}
+	if _, err := cfg.readFile(rw+"/missing", 1<<20); err == nil {
+		t.Error("read of a missing file succeeded")
+	}
+	if _, err := cfg.readFile(filepath.Join(rw, "notes.txt"), 2); err == nil {
+		t.Error("read past the limit succeeded")
+	}
+}
+
+func TestRunOnlyListedCommands(t *testing.T) {
+	cfg := testConfig(t, t.TempDir())
+	ctx := context.Background()
+
+	resp, err := cfg.run(ctx, Request{Command: "echo", Args: []string{"hello", "; rm -rf /"}})
+	if err != nil || strings.TrimSpace(string(resp.Data)) != "hello ; rm -rf /" || resp.ExitCode != 0 {
+		t.Errorf("echo = %q (exit %d), %v; arguments must reach the program as arguments", resp.Data, resp.ExitCode, err)
+	}
+	if _, err := cfg.run(ctx, Request{Command: "bash"}); !errors.Is(err, ErrCommandNotAllowed) {
+		t.Errorf("unlisted command = %v", err)
+	}
+	if _, err := cfg.run(ctx, Request{Command: "date", Args: []string{"-s", "2000-01-01"}}); !errors.Is(err, ErrCommandNotAllowed) {
+		t.Errorf("arguments to a fixed command = %v", err)
+	}
+	if _, err := cfg.run(ctx, Request{Command: ShellCommand}); !errors.Is(err, ErrCommandNotAllowed) {
+		t.Errorf("a terminal command through run = %v", err)
+	}
+	if _, err := cfg.startShell(ctx, Request{Command: "echo"}); !errors.Is(err, ErrCommandNotAllowed) {
+		t.Errorf("a plain command through shell = %v", err)
+	}
+
+	started := time.Now()
+	resp, err = cfg.run(ctx, Request{Command: "sleep", Args: []string{"30"}})
+	if err != nil || resp.ExitCode != 124 || time.Since(started) > 10*time.Second {
+		t.Errorf("sleep past its timeout = exit %d after %s, %v", resp.ExitCode, time.Since(started), err)
+	}
+}
+
+// fakeSystem records what the data-disk operations run.
+type fakeSystem struct {
+	luks, mounted, mapped bool
+	// busy makes umount fail, as a mount with open files does.
+	busy   bool
+	fstype string
+	ran    []string
+}
+
+func (f *fakeSystem) run(_ context.Context, in []byte, name string, args ...string) (string, error) {
+	line := strings.Join(append([]string{name}, args...), " ")
+	f.ran = append(f.ran, line)
+	fail := errors.New("exit status 1")
+	switch {
+	case strings.HasPrefix(line, "cryptsetup isLuks"):
+		if !f.luks {
+			return "", fail
+		}
+	case strings.HasPrefix(line, "cryptsetup luksFormat"):
+		f.luks = true
+	case strings.HasPrefix(line, "cryptsetup luksOpen"):
+		if string(in) != "s3cret" {
+			return "", fail
+		}
+		f.mapped = true
+	case strings.HasPrefix(line, "blkid") && !strings.Contains(line, "/dev/mapper"):
+		return f.fstype, nil
+	case strings.HasPrefix(line, "mountpoint"):
+		if !f.mounted {
+			return "", fail
+		}
+	case name == "mount":
+		f.mounted = true
+	case name == "umount":
+		if f.busy {
+			return "umount: /data: target is busy.", fail
+		}
+		f.mounted = false
+	case strings.HasPrefix(line, "cryptsetup close"):
+		f.mapped = false
+	}
+	return "", nil
+}
+
+func (f *fakeSystem) glob(string) ([]string, error) { return []string{"/dev/sdb"}, nil }
+func (f *fakeSystem) exists(p string) bool          { return strings.HasPrefix(p, "/dev/mapper/") && f.mapped }
+func (f *fakeSystem) mkdirAll(string) error         { return nil }
+func (f *fakeSystem) diskUsage(p string) (agentstatus.Disk, error) {
+	return agentstatus.Disk{Path: p, FreeBytes: 1 << 30, TotalBytes: 4 << 30}, nil
+}
+
+func (f *fakeSystem) did(prefix string) bool {
+	for _, l := range f.ran {
+		if strings.HasPrefix(l, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestDataDisk(t *testing.T) {
+	ctx := context.Background()
+	d := DataDisk{Device: "/dev/disk/by-path/*", Mapper: "qubesair-data", Mount: "/data"}
+
+	blank := &fakeSystem{}
+	if r := unlockData(ctx, blank, d, "s3cret"); !r.Unlocked || !blank.did("cryptsetup luksFormat") || !blank.did("mkfs.ext4") {
+		t.Errorf("blank disk: %+v after %v", r, blank.ran)
+	}
+	for _, l := range blank.ran {
+		if strings.Contains(l, "s3cret") {
+			t.Errorf("the key reached an argument list: %q", l)
+		}
+	}
+	if r := unlockData(ctx, blank, d, "s3cret"); !r.Unlocked || r.Detail != "already unlocked and mounted" {
+		t.Errorf("second unlock: %+v", r)
+	}
+
+	plain := &fakeSystem{fstype: "ext4"}
+	if r := unlockData(ctx, plain, d, "s3cret"); r.Unlocked || plain.did("cryptsetup luksFormat") {
+		t.Errorf("a plaintext disk was formatted: %+v after %v", r, plain.ran)
+	}
+
+	wrong := &fakeSystem{luks: true}
+	if r := unlockData(ctx, wrong, d, "not-the-key"); r.Unlocked || wrong.did("mount") {
+		t.Errorf("wrong key: %+v", r)
+	}
+
+	if st := dataStatus(ctx, blank, d); !st.Attached || !st.Unlocked() || st.FreeBytes != 1<<30 {
+		t.Errorf("status of the unlocked disk = %+v", st)
+	}
+
+	// A busy mount stays mounted and open, and is synced regardless.
+	blank.busy = true
+	if r := lockData(ctx, blank, d); !r.Unlocked || !blank.mapped || !blank.did("sync --file-system /data") ||
+		!strings.Contains(r.Detail, "target is busy") {
+		t.Errorf("lock of a busy mount: %+v after %v", r, blank.ran)
+	}
+	blank.busy = false
+	if r := lockData(ctx, blank, d); r.Unlocked || blank.mounted || blank.mapped {
+		t.Errorf("lock: %+v, mounted %v, mapped %v", r, blank.mounted, blank.mapped)
+	}
+	if r := lockData(ctx, blank, d); r.Detail != "already locked" {
+		t.Errorf("second lock: %+v", r)
+	}
+	if st := dataStatus(ctx, blank, d); !st.Attached || st.Open || st.Mounted || st.TotalBytes != 0 {
+		t.Errorf("status of the locked disk = %+v", st)
+	}
+}
+
+func TestServerOverSocket(t *testing.T) {
+	dir := t.TempDir()
+	cfg := testConfig(t, dir)
+	sock := filepath.Join(dir, "helper.sock")
+	lis, err := Listen(sock, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(cfg)
+	srv.sys = &fakeSystem{}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() { _ = srv.Serve(ctx, lis) }()
+
+	cli := &Client{Socket: sock}
+	target := filepath.Join(dir, "rw", "pushed")
+	if _, err := cli.Do(ctx, Request{Op: OpWriteFile, Path: target, Data: []byte("data")}); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(target); string(b) != "data" {
+		t.Errorf("pushed file holds %q", b)
+	}
+	if _, err := cli.Do(ctx, Request{Op: OpWriteFile, Path: "/etc/shadow"}); !errors.Is(err, ErrPathNotAllowed) {
+		t.Errorf("write outside the prefixes = %v, want ErrPathNotAllowed across the socket", err)
+	}
+	if resp, err := cli.Do(ctx, Request{Op: OpUnlockData, Key: "s3cret"}); err != nil || !resp.Unlocked {
+		t.Errorf("unlock = %+v, %v", resp, err)
+	}
+	if st, err := cli.DataStatus(ctx); err != nil || !st.Unlocked() {
+		t.Errorf("data status after unlock = %+v, %v", st, err)
+	}
+	if _, err := cli.Do(ctx, Request{Op: "reboot"}); !errors.Is(err, ErrUnknownOp) {
+		t.Errorf("unknown op = %v", err)
+	}
+
+	// qubesair.Transfer goes through the same prefixes, one step per request.
+	local := filepath.Join(dir, "local")
+	if err := os.WriteFile(local, []byte("chunked payload"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	tc := &transfer.Client{ChunkSize: 4, Call: func(ctx context.Context, in []byte) ([]byte, error) {
+		return cli.Transfer(ctx, "", in)
+	}}
+	if _, err := tc.Push(ctx, local, filepath.Join(dir, "rw", "chunked"), transfer.PushOptions{}); err != nil {
+		t.Fatalf("transfer push: %v", err)
+	}
+	if b, _ := os.ReadFile(filepath.Join(dir, "rw", "chunked")); string(b) != "chunked payload" {
+		t.Errorf("transferred file holds %q", b)
+	}
+	if _, err := tc.Push(ctx, local, filepath.Join(dir, "ro", "chunked"), transfer.PushOptions{}); !errors.Is(err, transfer.ErrPathNotAllowed) {
+		t.Errorf("transfer into a read-only prefix = %v, want ErrPathNotAllowed", err)
+	}
+
+	// A peer whose uid is not a caller gets nothing but the refusal.
+	strict := *cfg
+	strict.callerUIDs = map[uint32]bool{4242: true}
+	strictSock := filepath.Join(dir, "strict.sock")
+	lis, err = Listen(strictSock, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = NewServer(&strict).Serve(ctx, lis) }()
+	cli = &Client{Socket: strictSock}
+	if _, err := cli.Do(ctx, Request{Op: OpReadFile, Path: target}); !errors.Is(err, ErrCallerRefused) {
+		t.Errorf("unlisted peer = %v, want ErrCallerRefused", err)
+	}
+}
+
+// TestShellOverSocket runs a terminal through the helper as the agent does:
+// the size a resize frame set is what the shell sees, and the connection ends
+// when the shell exits.
+func TestShellOverSocket(t *testing.T) {
+	if _, err := os.Stat("/dev/ptmx"); err != nil {
+		t.Skipf("no pseudo-terminals here: %v", err)
+	}
+	dir := t.TempDir()
+	sock := filepath.Join(dir, "helper.sock")
+	lis, err := Listen(sock, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() { _ = NewServer(testConfig(t, dir)).Serve(ctx, lis) }()
+
+	term, err := (&Client{Socket: sock}).Shell(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer term.Close()
+	if err := shell.WriteResize(term, 40, 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := shell.WriteData(term, []byte("stty size; exit\n")); err != nil {
+		t.Fatal(err)
+	}
+	out := make(chan []byte, 1)
+	go func() { b, _ := io.ReadAll(term); out <- b }()
+	select {
+	case b := <-out:
+		if !strings.Contains(string(b), "40 100") {
+			t.Errorf("terminal output %q does not report the size 40 100", b)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the connection outlived the shell")
+	}
+}
+
+func TestUpdateKeysMustBeRoots(t *testing.T) {
+	dir := t.TempDir()
+	cfg := testConfig(t, dir)
+	cfg.Update.KeyFile = filepath.Join(dir, "update.pub")
+	if keys, err := cfg.updateKeys(); keys != nil || err != nil {
+		t.Fatalf("no key file = %v, %v; want no keys and no error", keys, err)
+	}
+
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := "# release key\n" + base64.StdEncoding.EncodeToString(pub) + "\n"
+	if err := os.WriteFile(cfg.Update.KeyFile, []byte(line), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := cfg.updateKeys()
+	if os.Geteuid() != 0 {
+		// The test's own file is not root's, which is exactly what the
+		// agent's user could plant in /etc/qubes-air.
+		if !errors.Is(err, agentupdate.ErrNotConfigured) {
+			t.Fatalf("a key file not owned by root = %v, %v; want ErrNotConfigured", keys, err)
+		}
+		return
+	}
+	if err != nil || len(keys) != 1 {
+		t.Fatalf("root's key file = %v, %v", keys, err)
+	}
+	if err := os.Chmod(cfg.Update.KeyFile, 0o664); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfg.updateKeys(); !errors.Is(err, agentupdate.ErrNotConfigured) {
+		t.Errorf("a group-writable key file = %v, want ErrNotConfigured", err)
+	}
+}
@@ -0,0 +1,79 @@
+//go:build linux
+
+package privhelper
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// openPTY opens a new pseudo-terminal pair: the master, which the helper reads
+// and writes, and the terminal the command gets as its stdio. The terminal is
+// handed to uid:gid, as login(1) would, so what the user runs on it — tty,
+// mesg, an ssh-agent prompt — finds it their own.
+func openPTY(uid, gid uint32) (master, tty *os.File, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	var n uint32
+	unlock := int32(0)
+	err = ioctl(master, syscall.TIOCSPTLCK, unsafe.Pointer(&unlock))
+	if err == nil {
+		err = ioctl(master, syscall.TIOCGPTN, unsafe.Pointer(&n))
+	}
+	if err == nil {
+		// #nosec G304 -- the kernel named it, from the master just opened
+		tty, err = os.OpenFile("/dev/pts/"+strconv.FormatUint(uint64(n), 10), os.O_RDWR|syscall.O_NOCTTY, 0)
+	}
+	if err == nil && os.Geteuid() == 0 {
+		err = tty.Chown(int(uid), int(gid))
+	}
+	if err == nil {
+		err = setWinsize(master, defaultRows, defaultCols)
+	}
+	if err != nil {
+		_ = master.Close()
+		if tty != nil {
+			_ = tty.Close()
+		}
+		return nil, nil, err
+	}
+	return master, tty, nil
+}
+
+// setWinsize tells the terminal its size; the kernel signals the foreground
+// process group, which redraws.
+func setWinsize(master *os.File, rows, cols uint16) error {
+	ws := struct{ Row, Col, X, Y uint16 }{Row: rows, Col: cols}
+	return ioctl(master, syscall.TIOCSWINSZ, unsafe.Pointer(&ws))
+}
+
+// setControllingTTY makes the command's stdin its controlling terminal, in the
+// session setCredential already gives it, so job control and ^C work.
+func setControllingTTY(cmd *exec.Cmd) {
+	cmd.SysProcAttr.Setctty = true
+	cmd.SysProcAttr.Ctty = 0
+}
+
+// ioctl goes through the file's raw conn rather than Fd, which would switch
+// the master to blocking mode and keep Close from interrupting a Read.
+func ioctl(f *os.File, req uintptr, arg unsafe.Pointer) error {
+	raw, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errno syscall.Errno
+	if err := raw.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg))
+	}); err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package privhelper
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+// Terminals are opened the Linux way, which is the only way the remotes run.
+
+func openPTY(uint32, uint32) (*os.File, *os.File, error) {
+	return nil, nil, errors.New("terminals are not supported on this platform")
+}
+
+func setWinsize(*os.File, uint16, uint16) error { return nil }
+
+func setControllingTTY(*exec.Cmd) {}
@@ -0,0 +1,179 @@
+package privhelper
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// helperPath is the PATH commands run with, and where a bare command name is
+// looked up. Fixed, like the agent's: nothing about the caller decides it.
+const helperPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// maxOutputBytes caps what run returns, matching the agent's own response cap.
+const maxOutputBytes = 16 << 20
+
+// run starts a configured command as its configured user.
+//
+// The output is stdout and stderr combined, and the exit status comes back as
+// a field rather than an error: a command that ran and failed is an answer,
+// and qubesair.Exec has always reported it as one.
+func (c *Config) run(ctx context.Context, req Request) (Response, error) {
+	cmdCfg, err := c.allowed(req, false)
+	if err != nil {
+		return Response{}, err
+	}
+
+	timeout := time.Duration(cmdCfg.TimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = DefaultCommandTimeout
+	}
+	if !cmdCfg.Detach {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	} else {
+		// A detached command outlives the request that started it.
+		ctx = context.WithoutCancel(ctx)
+	}
+
+	cmd, err := cmdCfg.prepare(ctx, req.Args)
+	if err != nil {
+		return Response{}, err
+	}
+
+	if cmdCfg.Detach {
+		if err := cmd.Start(); err != nil {
+			return Response{}, fmt.Errorf("start %q: %w", cmdCfg.Name, err)
+		}
+		go func() { _ = cmd.Wait() }() // reap it
+		return Response{ExitCode: -1, Detail: fmt.Sprintf("started pid %d", cmd.Process.Pid)}, nil
+	}
+
+	cmd.Stdin = bytes.NewReader(req.Stdin)
+	out := limitedBuffer{limit: maxOutputBytes}
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	cmd.Cancel = func() error { return killGroup(cmd) }
+	cmd.WaitDelay = 2 * time.Second
+
+	err = cmd.Run()
+	resp := Response{Data: out.buf.Bytes()}
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+	case ctx.Err() != nil:
+		resp.ExitCode = 124
+		resp.Detail = fmt.Sprintf("killed after %s", timeout)
+	case errors.As(err, &exitErr):
+		resp.ExitCode = exitErr.ExitCode()
+	default:
+		return Response{}, fmt.Errorf("run %q: %w", cmdCfg.Name, err)
+	}
+	if out.over {
+		resp.Detail = fmt.Sprintf("output truncated at %d bytes", maxOutputBytes)
+	}
+	return resp, nil
+}
+
+// allowed finds the configured command req names and checks req against it.
+// A terminal command is started by shell and nothing else: run would hand it
+// no terminal, and shell must not become a way to run commands that were
+// listed to be run once, with their output returned.
+func (c *Config) allowed(req Request, tty bool) (Command, error) {
+	cmdCfg, ok := c.command(req.Command)
+	switch {
+	case !ok:
+		return Command{}, fmt.Errorf("%w: %q", ErrCommandNotAllowed, req.Command)
+	case tty && !cmdCfg.TTY:
+		return Command{}, fmt.Errorf("%w: %q is not a terminal command", ErrCommandNotAllowed, req.Command)
+	case !tty && cmdCfg.TTY:
+		return Command{}, fmt.Errorf("%w: %q runs on a terminal, through shell", ErrCommandNotAllowed, req.Command)
+	case cmdCfg.FixedArgs && len(req.Args) > 0:
+		return Command{}, fmt.Errorf("%w: %q takes no arguments", ErrCommandNotAllowed, req.Command)
+	}
+	return cmdCfg, nil
+}
+
+// prepare builds cmdCfg with the caller's trailing arguments, to run as its
+// configured user with a minimal environment.
+func (cmdCfg Command) prepare(ctx context.Context, extra []string) (*exec.Cmd, error) {
+	path := cmdCfg.Path
+	if !filepath.IsAbs(path) {
+		found, err := lookPath(path)
+		if err != nil {
+			return nil, fmt.Errorf("command %q: %w", cmdCfg.Name, err)
+		}
+		path = found
+	}
+	u, err := lookupUser(cmdCfg.User)
+	if err != nil {
+		return nil, fmt.Errorf("command %q: user %q: %w", cmdCfg.Name, cmdCfg.User, err)
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	args := append(append([]string{}, cmdCfg.Args...), extra...)
+	// #nosec G204 -- path and leading args come from the root-owned config;
+	// the caller supplies trailing arguments only, never the program.
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Dir = u.HomeDir
+	cmd.Env = []string{
+		"PATH=" + helperPath,
+		"HOME=" + u.HomeDir,
+		"USER=" + u.Username,
+		"LOGNAME=" + u.Username,
+		"XDG_RUNTIME_DIR=/run/user/" + u.Uid,
+	}
+	keys := make([]string, 0, len(cmdCfg.Env))
+	for k := range cmdCfg.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		cmd.Env = append(cmd.Env, k+"="+cmdCfg.Env[k])
+	}
+	setCredential(cmd, uint32(uid), uint32(gid))
+	return cmd, nil
+}
+
+// lookPath finds a bare command name on helperPath, not on the helper's own
+// PATH, which systemd sets and the config does not describe.
+func lookPath(name string) (string, error) {
+	for _, dir := range filepath.SplitList(helperPath) {
+		p := filepath.Join(dir, name)
+		if _, err := exec.LookPath(p); err == nil {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("%q not found on %s", name, helperPath)
+}
+
+// limitedBuffer keeps the first limit bytes and drops the rest, so a chatty
+// command finishes rather than dying on a broken pipe.
+type limitedBuffer struct {
+	buf   bytes.Buffer
+	limit int
+	over  bool
+}
+
+func (l *limitedBuffer) Write(p []byte) (int, error) {
+	if room := l.limit - l.buf.Len(); len(p) > room {
+		l.over = true
+		l.buf.Write(p[:max(room, 0)])
+		return len(p), nil
+	}
+	return l.buf.Write(p)
+}
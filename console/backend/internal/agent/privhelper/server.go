@@ -0,0 +1,219 @@
+package privhelper
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/slchris/qubes-air/console/internal/agentupdate"
+	"github.com/slchris/qubes-air/console/internal/transfer"
+)
+
+// requestReadTimeout bounds how long a connection may take to send its
+// request. The agent writes it in one go; a peer that dawdles is not the agent.
+const requestReadTimeout = 30 * time.Second
+
+// Server answers helper requests.
+type Server struct {
+	cfg *Config
+	sys system
+	// disk serializes the data-disk operations: an unlock racing a lock would
+	// leave the disk in whichever state lost, with both callers told otherwise.
+	disk sync.Mutex
+	// transfers serves qubesair.Transfer over the configured prefixes.
+	transfers *transfer.Store
+	// updates serves qubesair.Update.
+	updates *agentupdate.Updater
+}
+
+// NewServer serves cfg, which must have been validated.
+func NewServer(cfg *Config) *Server {
+	prefixes := make([]transfer.Prefix, 0, len(cfg.Files))
+	for _, f := range cfg.Files {
+		prefixes = append(prefixes, transfer.Prefix{Path: f.Prefix, ReadOnly: f.ReadOnly})
+	}
+	return &Server{
+		cfg:       cfg,
+		sys:       hostSystem{},
+		transfers: transfer.NewStore(prefixes, cfg.Spool),
+		updates:   cfg.Updater(),
+	}
+}
+
+// Listen creates the helper's socket at path, replacing a stale one, readable
+// and writable by root and group gid only. The directory is handed to gid as
+// well: a 0660 socket in a directory the group cannot enter is no socket.
+func Listen(path string, gid int) (net.Listener, error) {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	if gid >= 0 {
+		if err := os.Chown(dir, 0, gid); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	lis, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o660); err != nil {
+		_ = lis.Close()
+		return nil, err
+	}
+	if gid >= 0 {
+		if err := os.Chown(path, 0, gid); err != nil {
+			_ = lis.Close()
+			return nil, err
+		}
+	}
+	return lis, nil
+}
+
+// Serve answers connections on lis until ctx ends.
+func (s *Server) Serve(ctx context.Context, lis net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		_ = lis.Close()
+	}()
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go s.serveConn(ctx, conn)
+	}
+}
+
+func (s *Server) serveConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	uid, err := peerUID(conn)
+	if err == nil && !s.cfg.callerUIDs[uid] {
+		err = fmt.Errorf("%w: uid %d", ErrCallerRefused, uid)
+	}
+	if err != nil {
+		log.Printf("helper: refused connection: %v", err)
+		_ = json.NewEncoder(conn).Encode(Response{Error: err.Error()})
+		return
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(requestReadTimeout))
+	var req Request
+	dec := json.NewDecoder(io.LimitReader(conn, maxRequestBytes))
+	if err := dec.Decode(&req); err != nil {
+		_ = json.NewEncoder(conn).Encode(Response{Error: "bad request: " + err.Error()})
+		return
+	}
+	if req.Op == OpShell {
+		// The connection outlives the request: it is the terminal now, and
+		// whatever the decoder read past the request is its first input.
+		in, err := afterJSON(dec, conn)
+		_ = conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			_ = json.NewEncoder(conn).Encode(Response{Error: "bad request: " + err.Error()})
+			return
+		}
+		s.serveShell(ctx, conn, in, uid, req)
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	started := time.Now()
+	resp, err := s.handle(ctx, req)
+	outcome := "ok"
+	if err != nil {
+		resp = Response{Error: err.Error()}
+		outcome = err.Error()
+	}
+	// The request is logged by operation and target, never by content: the
+	// key of an unlock_data must not reach the journal. A data_status that
+	// worked is not logged at all: every console probe asks for one, and a
+	// journal of them would bury the requests that changed something.
+	if req.Op == OpDataStatus && err == nil {
+		_ = json.NewEncoder(conn).Encode(resp)
+		return
+	}
+	log.Printf("helper: uid %d %s %s: %s (%s)", uid, req.Op, describe(req), outcome,
+		time.Since(started).Round(time.Millisecond))
+	_ = json.NewEncoder(conn).Encode(resp)
+}
+
+// handle dispatches one request.
+func (s *Server) handle(ctx context.Context, req Request) (Response, error) {
+	switch req.Op {
+	case OpUnlockData:
+		s.disk.Lock()
+		defer s.disk.Unlock()
+		return unlockData(ctx, s.sys, s.cfg.Data, req.Key), nil
+	case OpLockData:
+		s.disk.Lock()
+		defer s.disk.Unlock()
+		return lockData(ctx, s.sys, s.cfg.Data), nil
+	case OpDataStatus:
+		st := dataStatus(ctx, s.sys, s.cfg.Data)
+		return Response{DataDisk: &st}, nil
+	case OpWriteFile:
+		return s.cfg.writeFile(req.Path, req.Mode, req.Data)
+	case OpReadFile:
+		return s.cfg.readFile(req.Path, maxOutputBytes)
+	case OpRun:
+		return s.cfg.run(ctx, req)
+	case OpTransfer:
+		if req.Transfer == nil {
+			return Response{}, errors.New("transfer: empty request")
+		}
+		resp, err := s.transfers.Handle(ctx, *req.Transfer)
+		if err != nil {
+			return Response{}, err
+		}
+		return Response{Transfer: &resp}, nil
+	case OpUpdate:
+		if req.Update == nil {
+			return Response{}, errors.New("update: empty request")
+		}
+		st, err := s.updates.Handle(ctx, *req.Update)
+		if err != nil {
+			return Response{}, err
+		}
+		return Response{Update: &st}, nil
+	default:
+		return Response{}, fmt.Errorf("%w: %q", ErrUnknownOp, req.Op)
+	}
+}
+
+// describe names what a request is about, for the log.
+func describe(req Request) string {
+	switch req.Op {
+	case OpWriteFile, OpReadFile:
+		return req.Path
+	case OpRun:
+		return req.Command
+	case OpTransfer:
+		if req.Transfer != nil {
+			return req.Transfer.Op + " " + req.Transfer.Path + req.Transfer.Handle
+		}
+		return ""
+	case OpUpdate:
+		if req.Update != nil {
+			return req.Update.Op + " " + req.Update.URL
+		}
+		return ""
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,154 @@
+package privhelper
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/slchris/qubes-air/console/internal/shell"
+)
+
+// A new terminal's size, until the caller sends its own.
+const (
+	defaultRows = 24
+	defaultCols = 80
+)
+
+// shellDrainTimeout is how long, once the command has exited, its last output
+// may take to reach the caller before the terminal is closed under it. Only a
+// background job that kept the terminal open takes that long.
+const shellDrainTimeout = time.Second
+
+// session is one terminal command running on its pseudo-terminal.
+type session struct {
+	cmd    *exec.Cmd
+	master *os.File
+	cancel context.CancelFunc
+}
+
+// startShell starts the terminal command req names on a new pseudo-terminal.
+// The session lasts until the command exits or ctx ends — the caller hanging
+// up ends it — or, when the command sets one, until its timeout.
+func (c *Config) startShell(ctx context.Context, req Request) (*session, error) {
+	cmdCfg, err := c.allowed(req, true)
+	if err != nil {
+		return nil, err
+	}
+	uid, err := lookupUID(cmdCfg.User)
+	if err != nil {
+		return nil, fmt.Errorf("command %q: user %q: %w", cmdCfg.Name, cmdCfg.User, err)
+	}
+	gid, err := PrimaryGID(cmdCfg.User)
+	if err != nil {
+		return nil, fmt.Errorf("command %q: user %q: %w", cmdCfg.Name, cmdCfg.User, err)
+	}
+
+	var cancel context.CancelFunc
+	if cmdCfg.TimeoutSeconds > 0 {
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(cmdCfg.TimeoutSeconds)*time.Second)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	cmd, err := cmdCfg.prepare(ctx, req.Args)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	master, tty, err := openPTY(uid, uint32(gid)) // #nosec G115 -- a gid from the user database
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("command %q: terminal: %w", cmdCfg.Name, err)
+	}
+	defer tty.Close() // the command has its own copy once started
+
+	cmd.Env = append(cmd.Env, "TERM=xterm-256color")
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = tty, tty, tty
+	setControllingTTY(cmd)
+	// A hangup is what a terminal going away has always meant; a shell that
+	// ignores it is killed when WaitDelay runs out.
+	cmd.Cancel = func() error { return hangupGroup(cmd) }
+	cmd.WaitDelay = 5 * time.Second
+	if err := cmd.Start(); err != nil {
+		cancel()
+		_ = master.Close()
+		return nil, fmt.Errorf("start %q: %w", cmdCfg.Name, err)
+	}
+	return &session{cmd: cmd, master: master, cancel: cancel}, nil
+}
+
+// serve carries the session over conn: frames from in to the terminal, the
+// terminal's output to conn. It returns once the command has exited, with how
+// it exited.
+func (s *session) serve(in io.Reader, conn io.Writer) error {
+	defer s.cancel()
+	go func() {
+		// Whatever ends the input — the caller hanging up, or sending
+		// something that is not a frame — ends the session.
+		defer s.cancel()
+		for {
+			f, err := shell.ReadFrame(in)
+			if err != nil {
+				return
+			}
+			switch f.Kind {
+			case shell.KindData:
+				if _, err := s.master.Write(f.Data); err != nil {
+					return
+				}
+			case shell.KindResize:
+				_ = setWinsize(s.master, f.Rows, f.Cols)
+			}
+		}
+	}()
+	drained := make(chan struct{})
+	go func() {
+		// Ends with EIO once nothing holds the terminal open any more.
+		_, _ = io.Copy(conn, s.master)
+		close(drained)
+	}()
+
+	err := s.cmd.Wait()
+	select {
+	case <-drained:
+	case <-time.After(shellDrainTimeout):
+	}
+	_ = s.master.Close()
+	<-drained
+	return err
+}
+
+// serveShell runs a shell request to its end: the response says whether the
+// command started, and the connection is its terminal after that.
+func (s *Server) serveShell(ctx context.Context, conn net.Conn, in io.Reader, uid uint32, req Request) {
+	started := time.Now()
+	sess, err := s.cfg.startShell(ctx, req)
+	if err != nil {
+		log.Printf("helper: uid %d %s %s: %v", uid, req.Op, req.Command, err)
+		_ = json.NewEncoder(conn).Encode(Response{Error: err.Error()})
+		return
+	}
+	pid := sess.cmd.Process.Pid
+	log.Printf("helper: uid %d %s %s: started pid %d", uid, req.Op, req.Command, pid)
+	if err := json.NewEncoder(conn).Encode(Response{ExitCode: -1, Detail: fmt.Sprintf("started pid %d", pid)}); err != nil {
+		sess.cancel()
+	}
+
+	err = sess.serve(in, conn)
+	outcome := "exited"
+	var exitErr *exec.ExitError
+	switch {
+	case errors.As(err, &exitErr):
+		outcome = exitErr.String()
+	case err != nil:
+		outcome = err.Error()
+	}
+	log.Printf("helper: uid %d %s %s: pid %d %s after %s", uid, req.Op, req.Command, pid, outcome,
+		time.Since(started).Round(time.Second))
+}
@@ -0,0 +1,28 @@
+//go:build !unix
+
+package privhelper
+
+import (
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+	"os/exec"
+)
+
+// The helper needs unix sockets and account switching; on other platforms it
+// builds, so the packages that import it do, and refuses every caller.
+
+func peerUID(net.Conn) (uint32, error) {
+	return 0, errors.New("the privileged helper is not supported on this platform")
+}
+
+func chownLike(*os.Root, string, fs.FileInfo) error { return nil }
+
+func setCredential(*exec.Cmd, uint32, uint32) {}
+
+func killGroup(cmd *exec.Cmd) error { return cmd.Process.Kill() }
+
+func hangupGroup(cmd *exec.Cmd) error { return cmd.Process.Kill() }
+
+func ownerUID(fs.FileInfo) (uint32, bool) { return 0, false }
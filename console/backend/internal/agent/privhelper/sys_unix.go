@@ -0,0 +1,73 @@
+//go:build unix
+
+package privhelper
+
+import (
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// peerUID is the uid of the process at the other end of a unix socket, as the
+// kernel recorded it at connect — not anything the peer says about itself.
+func peerUID(c net.Conn) (uint32, error) {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return 0, errors.New("not a unix socket")
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var uid uint32
+	var credErr error
+	err = raw.Control(func(fd uintptr) { uid, credErr = sockPeerUID(int(fd)) })
+	if err != nil {
+		return 0, err
+	}
+	return uid, credErr
+}
+
+// chownLike gives name the owner and group of like. Only root can chown, and
+// only root needs to: a helper run unprivileged in a test writes files that
+// are already its own.
+func chownLike(root *os.Root, name string, like fs.FileInfo) error {
+	st, ok := like.Sys().(*syscall.Stat_t)
+	if !ok || os.Geteuid() != 0 {
+		return nil
+	}
+	return root.Lchown(name, int(st.Uid), int(st.Gid))
+}
+
+// setCredential makes cmd run as uid:gid in its own session, so a detached
+// command is not killed with the helper's process group and a waited one can
+// be killed as a group.
+func setCredential(cmd *exec.Cmd, uid, gid uint32) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if uint32(os.Geteuid()) != uid {
+		cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uid, Gid: gid}
+	}
+}
+
+// killGroup kills the session cmd leads.
+func killGroup(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
+
+// hangupGroup sends SIGHUP to the session cmd leads, as a terminal closing
+// would.
+func hangupGroup(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGHUP)
+}
+
+// ownerUID is who owns a file, as the kernel says.
+func ownerUID(info fs.FileInfo) (uint32, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return st.Uid, true
+}
@@ -0,0 +1,86 @@
+package privhelper
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/slchris/qubes-air/console/internal/agentupdate"
+)
+
+// maxKeyFileBytes bounds the key file: a few keys and their comments.
+const maxKeyFileBytes = 64 << 10
+
+// Updater is qubesair.Update over this configuration. The helper serves its
+// requests; the install unit it starts ("qubes-air-helper -apply-update")
+// runs its Apply.
+func (c *Config) Updater() *agentupdate.Updater {
+	return c.updater(hostSystem{})
+}
+
+func (c *Config) updater(sys system) *agentupdate.Updater {
+	return &agentupdate.Updater{
+		Dir:            c.Update.Dir,
+		Keys:           c.updateKeys,
+		Sources:        c.Update.Sources,
+		AllowDowngrade: c.Update.AllowDowngrade,
+		Launch:         c.launchUpdate,
+		Run: func(ctx context.Context, name string, args ...string) (string, error) {
+			return sys.run(ctx, nil, name, args...)
+		},
+	}
+}
+
+// updateKeys reads the pinned keys. A missing file is no keys, and no update;
+// a file anyone but root could have written is refused outright, not read.
+func (c *Config) updateKeys() ([]ed25519.PublicKey, error) {
+	path := c.Update.KeyFile
+	f, err := os.Open(path) // #nosec G304 -- from the root-owned config
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if uid, ok := ownerUID(info); !ok || uid != 0 || !info.Mode().IsRegular() || info.Mode().Perm()&0o022 != 0 {
+		return nil, fmt.Errorf("%w: %s is not a root-owned file only root can write", agentupdate.ErrNotConfigured, path)
+	}
+	data, err := io.ReadAll(io.LimitReader(f, maxKeyFileBytes))
+	if err != nil {
+		return nil, err
+	}
+	keys, err := agentupdate.ParsePublicKeys(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return keys, nil
+}
+
+// launchUpdate starts the install in a transient unit of its own. Not a
+// child of the helper: the package's postinst restarts qubes-air-helper, and
+// systemd stops everything in a unit's cgroup with it — dpkg included, half
+// way through, with the rollback that was meant to catch it.
+func (c *Config) launchUpdate(ctx context.Context) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	args := []string{"--unit=" + agentupdate.ApplyUnit, "--collect", "--quiet", exe}
+	if c.path != "" {
+		args = append(args, "-config", c.path)
+	}
+	args = append(args, "-apply-update")
+	out, err := hostSystem{}.run(ctx, nil, "systemd-run", args...)
+	if err != nil {
+		return fmt.Errorf("systemd-run: %v: %s", err, out)
+	}
+	return nil
+}
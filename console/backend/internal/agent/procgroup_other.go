@@ -0,0 +1,10 @@
+//go:build !unix
+
+package agent
+
+import "os/exec"
+
+// killProcessGroupOnCancel is a no-op where process groups do not exist:
+// cancellation kills the direct child only, exec's default. The agent ships for
+// Linux; this keeps the package building elsewhere.
+func killProcessGroupOnCancel(*exec.Cmd) {}
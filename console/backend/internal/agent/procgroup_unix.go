@@ -0,0 +1,21 @@
+//go:build unix
+
+package agent
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// killProcessGroupOnCancel starts the service as the leader of its own process
+// group and makes context cancellation kill the group. Anything the script
+// started — including children it backgrounded — is in that group and dies
+// with it. A child that deliberately leaves the group (setsid) escapes; that is
+// what cmd.WaitDelay still bounds.
+func killProcessGroupOnCancel(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		// The negative pid addresses the group, whose id is the leader's pid.
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
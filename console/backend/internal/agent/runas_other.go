@@ -0,0 +1,11 @@
+//go:build !unix
+
+package agent
+
+import "os/exec"
+
+// runAs is never reached where accounts cannot be switched: LookupAccount
+// refuses run_as at load, so no policy here carries one.
+const runAsSupported = false
+
+func runAs(*exec.Cmd, *Account) {}
@@ -0,0 +1,25 @@
+//go:build unix
+
+package agent
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+const runAsSupported = true
+
+// runAs makes the service run under a. It runs after killProcessGroupOnCancel,
+// whose SysProcAttr it extends. Supplementary groups are dropped: the account's
+// primary group is all the service gets. Switching accounts needs the agent to
+// hold CAP_SETUID and CAP_SETGID; without them every call to the service fails
+// at exec with EPERM, which is the honest outcome.
+func runAs(cmd *exec.Cmd, a *Account) {
+	if a == nil {
+		return
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = &syscall.Credential{Uid: a.UID, Gid: a.GID}
+}
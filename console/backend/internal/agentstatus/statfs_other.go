@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package agentstatus
+
+import "errors"
+
+// DiskUsage is unsupported off Linux and macOS; a report says so per disk.
+func DiskUsage(string) (Disk, error) {
+	return Disk{}, errors.New("disk usage is not supported on this platform")
+}
@@ -0,0 +1,17 @@
+//go:build linux || darwin
+
+package agentstatus
+
+import "syscall"
+
+// DiskUsage is the free and total space of the filesystem holding path. Free
+// is what an unprivileged process may still write, not counting the blocks
+// reserved for root: it is the agent's services that run out first.
+func DiskUsage(path string) (Disk, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return Disk{}, err
+	}
+	bs := uint64(st.Bsize) // #nosec G115 -- a block size is never negative
+	return Disk{Path: path, FreeBytes: uint64(st.Bavail) * bs, TotalBytes: uint64(st.Blocks) * bs}, nil
+}
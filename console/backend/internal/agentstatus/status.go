@@ -0,0 +1,366 @@
+// Package agentstatus is qubesair.Status: what a remote says about its own
+// state when asked, beyond "the agent answered".
+//
+// qubesair.Ping proves the tunnel and the agent are up and nothing else, on
+// purpose — a probe that also judged the host would turn one failure into
+// several indistinguishable ones. That left the console unable to tell a qube
+// that is ready from one whose agent answers while /data is still locked, a
+// unit has failed or cloud-init gave up half way. This report is the second,
+// separate question, asked on the same tunnel after Ping has answered:
+//
+//   - how long the agent and the host have been up;
+//   - the state of the systemd units the agent's config names;
+//   - whether the data disk is attached, its LUKS container open and /data
+//     mounted, and how full it is;
+//   - free space on the configured filesystems;
+//   - whether the clock is synchronised, and the agent's clock itself, so the
+//     caller can measure the offset against its own;
+//   - whether a package upgrade is waiting for a reboot;
+//   - how cloud-init finished;
+//   - the dead man's switch's configuration, the console's last check-in and
+//     whether the switch has fired (internal/deadman).
+//
+// It reports and never judges. What counts as degraded is the console's call,
+// since only the console knows, for one, whether this qube's data is meant to
+// be encrypted at all.
+//
+// The agent collects everything an unprivileged process can read itself; the
+// data disk's state comes from the privileged helper, which owns the disk's
+// configuration (internal/agent/privhelper).
+package agentstatus
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Service is the agent builtin that answers with a Report.
+const Service = "qubesair.Status"
+
+// Cloud-init outcomes.
+const (
+	// CloudInitDone means cloud-init finished without errors.
+	CloudInitDone = "done"
+	// CloudInitError means cloud-init finished and reported errors.
+	CloudInitError = "error"
+	// CloudInitRunning means cloud-init started and has not finished.
+	CloudInitRunning = "running"
+	// CloudInitAbsent means there is no sign of cloud-init on this boot.
+	CloudInitAbsent = "absent"
+)
+
+// Report is one answer to qubesair.Status.
+type Report struct {
+	// Time is the agent's clock when the report was made. The caller compares
+	// it with its own clock around the call; the offset is the caller's to
+	// compute, because it is the caller's clock the certificates are judged
+	// against.
+	Time time.Time `json:"time"`
+	// AgentStartedAt and AgentUptimeSeconds are this agent process's.
+	AgentStartedAt     time.Time `json:"agent_started_at"`
+	AgentUptimeSeconds int64     `json:"agent_uptime_seconds"`
+	// SystemUptimeSeconds is the host's, from /proc/uptime; 0 when unknown.
+	SystemUptimeSeconds int64 `json:"system_uptime_seconds,omitempty"`
+	// Units are the configured systemd units, in the configured order.
+	Units []Unit `json:"units"`
+	// Data is the data disk's state. Nil when the helper could not be asked;
+	// the reason is in Errors.
+	Data *Data `json:"data,omitempty"`
+	// Disks is free space on the configured filesystems.
+	Disks []Disk `json:"disks"`
+	// ClockSynchronized is systemd's NTPSynchronized; nil when unknown.
+	ClockSynchronized *bool `json:"clock_synchronized,omitempty"`
+	// RebootRequired is whether /run/reboot-required exists.
+	RebootRequired bool      `json:"reboot_required"`
+	CloudInit      CloudInit `json:"cloud_init"`
+	// DeadMan is the dead man's switch; nil from an agent without one.
+	DeadMan *DeadMan `json:"dead_man,omitempty"`
+	// Errors lists what could not be found out. A check that failed is said
+	// here rather than failing the report: the rest of it is still true, and
+	// a status call that errors whenever timedatectl is missing would tell the
+	// console less than one that says so.
+	Errors []string `json:"errors,omitempty"`
+}
+
+// Unit is one systemd unit's state as systemctl show reports it.
+type Unit struct {
+	Name        string `json:"name"`
+	LoadState   string `json:"load_state"`
+	ActiveState string `json:"active_state"`
+	SubState    string `json:"sub_state"`
+}
+
+// Data is the LUKS data disk's state.
+type Data struct {
+	// Attached is whether a device matches the helper's data disk pattern.
+	Attached bool `json:"attached"`
+	// Open is whether the LUKS container is mapped.
+	Open bool `json:"open"`
+	// Mounted is whether the data mount point is a mount point.
+	Mounted bool   `json:"mounted"`
+	Mount   string `json:"mount"`
+	// FreeBytes and TotalBytes are the mounted filesystem's; 0 when it is not
+	// mounted.
+	FreeBytes  uint64 `json:"free_bytes,omitempty"`
+	TotalBytes uint64 `json:"total_bytes,omitempty"`
+}
+
+// Unlocked is whether the data disk is open and mounted: usable.
+func (d *Data) Unlocked() bool { return d != nil && d.Open && d.Mounted }
+
+// Disk is one filesystem's free space.
+type Disk struct {
+	Path       string `json:"path"`
+	FreeBytes  uint64 `json:"free_bytes"`
+	TotalBytes uint64 `json:"total_bytes"`
+}
+
+// CloudInit is how cloud-init finished on this boot.
+type CloudInit struct {
+	// Status is one of the CloudInit* constants.
+	Status string `json:"status"`
+	// Errors are cloud-init's own, when Status is CloudInitError.
+	Errors []string `json:"errors,omitempty"`
+}
+
+// DeadMan is the dead man's switch as the agent holds it: whether it is armed,
+// on what, and how close it is to firing.
+type DeadMan struct {
+	// Enabled is whether either trigger is configured.
+	Enabled bool `json:"enabled"`
+	// SilenceSeconds is how long the agent waits for a call from the console
+	// before it locks the data disk; 0 never.
+	SilenceSeconds int64 `json:"silence_seconds,omitempty"`
+	// OnRevocation is whether the console saying this agent's certificate is
+	// revoked locks it.
+	OnRevocation bool `json:"on_revocation,omitempty"`
+	// LastCheckIn is the console's last call, or the agent's start when there
+	// has been none since.
+	LastCheckIn time.Time `json:"last_check_in"`
+	// Tripped is whether the switch has fired and not been re-armed by the
+	// console pushing the key again.
+	Tripped   bool       `json:"tripped,omitempty"`
+	TrippedAt *time.Time `json:"tripped_at,omitempty"`
+	Reason    string     `json:"reason,omitempty"`
+	// LockError is why the lock a trip asked for has not happened yet; empty
+	// once it has. The agent keeps retrying.
+	LockError string `json:"lock_error,omitempty"`
+}
+
+// Collector makes Reports.
+type Collector struct {
+	started time.Time
+	units   func() []string
+	disks   func() []string
+	data    func(context.Context) (*Data, error)
+	deadMan func() *DeadMan
+
+	// root, run and now are the host; tests replace them.
+	root string
+	run  func(ctx context.Context, name string, args ...string) (string, error)
+	now  func() time.Time
+}
+
+// NewCollector builds a collector for an agent started at started. units and
+// disks are read on every report, so a configuration reload changes the next
+// one. data asks the helper for the data disk's state; nil leaves it out.
+func NewCollector(started time.Time, units, disks func() []string, data func(context.Context) (*Data, error)) *Collector {
+	return &Collector{
+		started: started,
+		units:   units,
+		disks:   disks,
+		data:    data,
+		root:    "/",
+		run:     runTool,
+		now:     time.Now,
+	}
+}
+
+// WithDeadMan adds the dead man's switch's state to every report.
+func (c *Collector) WithDeadMan(state func() *DeadMan) *Collector {
+	c.deadMan = state
+	return c
+}
+
+// Builtin is qubesair.Status. The request is ignored: there is one report.
+func (c *Collector) Builtin(ctx context.Context, _ string, _ []byte) ([]byte, error) {
+	return json.Marshal(c.Collect(ctx))
+}
+
+// Collect makes one report.
+func (c *Collector) Collect(ctx context.Context) Report {
+	now := c.now()
+	r := Report{
+		Time:               now.UTC(),
+		AgentStartedAt:     c.started.UTC(),
+		AgentUptimeSeconds: int64(now.Sub(c.started).Seconds()),
+		Units:              []Unit{},
+		Disks:              []Disk{},
+	}
+	fail := func(what string, err error) { r.Errors = append(r.Errors, what+": "+err.Error()) }
+
+	if up, err := c.systemUptime(); err != nil {
+		fail("uptime", err)
+	} else {
+		r.SystemUptimeSeconds = up
+	}
+	if names := c.units(); len(names) > 0 {
+		if units, err := c.unitStates(ctx, names); err != nil {
+			fail("units", err)
+		} else {
+			r.Units = units
+		}
+	}
+	if c.data != nil {
+		d, err := c.data(ctx)
+		if err != nil {
+			fail("data disk", err)
+		}
+		r.Data = d
+	}
+	for _, p := range c.disks() {
+		d, err := DiskUsage(p)
+		if err != nil {
+			fail("disk "+p, err)
+			continue
+		}
+		r.Disks = append(r.Disks, d)
+	}
+	if out, err := c.run(ctx, "timedatectl", "show", "--property=NTPSynchronized", "--value"); err != nil {
+		fail("clock", err)
+	} else {
+		synced := out == "yes"
+		r.ClockSynchronized = &synced
+	}
+	r.RebootRequired = c.exists("run/reboot-required")
+	r.CloudInit = c.cloudInit()
+	if c.deadMan != nil {
+		r.DeadMan = c.deadMan()
+	}
+	return r
+}
+
+// systemUptime is the first field of /proc/uptime, in whole seconds.
+func (c *Collector) systemUptime() (int64, error) {
+	b, err := os.ReadFile(filepath.Join(c.root, "proc/uptime"))
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) == 0 {
+		return 0, errors.New("/proc/uptime is empty")
+	}
+	secs, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, fmt.Errorf("/proc/uptime: %w", err)
+	}
+	return int64(secs), nil
+}
+
+// unitStates asks systemctl about every unit at once. systemctl show answers
+// in the order asked, one block per unit, and answers for a unit that does not
+// exist too (LoadState not-found), so the blocks pair with the names by
+// position: the Id in a block is the unit's canonical name, which for an alias
+// is not the name the config used.
+func (c *Collector) unitStates(ctx context.Context, units []string) ([]Unit, error) {
+	args := append([]string{"show", "--no-pager", "--property=LoadState,ActiveState,SubState", "--"}, units...)
+	out, err := c.run(ctx, "systemctl", args...)
+	if err != nil {
+		return nil, err
+	}
+	states := parseShow(out)
+	if len(states) != len(units) {
+		return nil, fmt.Errorf("systemctl show described %d units, asked about %d", len(states), len(units))
+	}
+	for i := range states {
+		states[i].Name = units[i]
+	}
+	return states, nil
+}
+
+// parseShow reads systemctl show's blank-line-separated KEY=value blocks.
+func parseShow(out string) []Unit {
+	var (
+		units []Unit
+		cur   *Unit
+	)
+	sc := bufio.NewScanner(strings.NewReader(out))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			cur = nil
+			continue
+		}
+		if cur == nil {
+			units = append(units, Unit{})
+			cur = &units[len(units)-1]
+		}
+		key, value, _ := strings.Cut(line, "=")
+		switch key {
+		case "LoadState":
+			cur.LoadState = value
+		case "ActiveState":
+			cur.ActiveState = value
+		case "SubState":
+			cur.SubState = value
+		}
+	}
+	return units
+}
+
+// cloudInit reads cloud-init's own record of this boot. result.json is
+// written when the final stage ends; status.json as soon as it starts. Both
+// live under /run, so neither survives from a previous boot.
+func (c *Collector) cloudInit() CloudInit {
+	b, err := os.ReadFile(filepath.Join(c.root, "run/cloud-init/result.json"))
+	if err != nil {
+		if c.exists("run/cloud-init/status.json") {
+			return CloudInit{Status: CloudInitRunning}
+		}
+		return CloudInit{Status: CloudInitAbsent}
+	}
+	var result struct {
+		V1 struct {
+			Errors []string `json:"errors"`
+		} `json:"v1"`
+	}
+	if err := json.Unmarshal(b, &result); err != nil {
+		return CloudInit{Status: CloudInitError, Errors: []string{"unreadable result.json: " + err.Error()}}
+	}
+	if len(result.V1.Errors) > 0 {
+		return CloudInit{Status: CloudInitError, Errors: result.V1.Errors}
+	}
+	return CloudInit{Status: CloudInitDone}
+}
+
+func (c *Collector) exists(rel string) bool {
+	_, err := os.Stat(filepath.Join(c.root, rel))
+	return err == nil
+}
+
+// runTool runs a system tool and returns its trimmed standard output.
+func runTool(ctx context.Context, name string, args ...string) (string, error) {
+	// #nosec G204 -- name is one of this file's fixed tools; args are unit
+	// names the agent's config validated.
+	cmd := exec.CommandContext(ctx, name, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%s: %w: %s", name, err, msg)
+		}
+		return "", fmt.Errorf("%s: %w", name, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
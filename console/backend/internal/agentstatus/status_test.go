@@ -0,0 +1,135 @@
+package agentstatus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeHost is a root directory and the tools' answers.
+func fakeHost(t *testing.T, files map[string]string, tools map[string]string) *Collector {
+	t.Helper()
+	root := t.TempDir()
+	for rel, body := range files {
+		p := filepath.Join(root, rel)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	started := time.Date(2026, 1, 2, 3, 0, 0, 0, time.UTC)
+	c := NewCollector(started,
+		func() []string { return []string{"qubes-air-agent.service", "sshd.service", "gone.service"} },
+		func() []string { return []string{root} },
+		func(context.Context) (*Data, error) { return &Data{Attached: true, Open: true, Mount: "/data"}, nil })
+	c.root = root
+	c.now = func() time.Time { return started.Add(90 * time.Second) }
+	c.run = func(_ context.Context, name string, _ ...string) (string, error) {
+		out, ok := tools[name]
+		if !ok {
+			return "", errors.New(name + ": executable file not found in $PATH")
+		}
+		return out, nil
+	}
+	return c
+}
+
+func TestCollectReportsWhatTheHostSays(t *testing.T) {
+	c := fakeHost(t, map[string]string{
+		"proc/uptime":                "3600.52 7000.10\n",
+		"run/reboot-required":        "*** System restart required ***\n",
+		"run/cloud-init/status.json": "{}",
+		"run/cloud-init/result.json": `{"v1": {"datasource": "DataSourceNoCloud", "errors": []}}`,
+	}, map[string]string{
+		// sshd.service is an alias; systemctl still answers in the order asked.
+		"systemctl": "LoadState=loaded\nActiveState=active\nSubState=running\n\n" +
+			"LoadState=loaded\nActiveState=failed\nSubState=failed\n\n" +
+			"LoadState=not-found\nActiveState=inactive\nSubState=dead\n",
+		"timedatectl": "no",
+	})
+
+	out, err := c.Builtin(context.Background(), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r Report
+	if err := json.Unmarshal(out, &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.AgentUptimeSeconds != 90 || r.SystemUptimeSeconds != 3600 {
+		t.Errorf("uptimes = agent %d, system %d", r.AgentUptimeSeconds, r.SystemUptimeSeconds)
+	}
+	want := []Unit{
+		{"qubes-air-agent.service", "loaded", "active", "running"},
+		{"sshd.service", "loaded", "failed", "failed"},
+		{"gone.service", "not-found", "inactive", "dead"},
+	}
+	if len(r.Units) != len(want) {
+		t.Fatalf("units = %+v", r.Units)
+	}
+	for i := range want {
+		if r.Units[i] != want[i] {
+			t.Errorf("unit %d = %+v, want %+v", i, r.Units[i], want[i])
+		}
+	}
+	if r.Data == nil || !r.Data.Open || r.Data.Unlocked() {
+		t.Errorf("data = %+v: open but not mounted is not unlocked", r.Data)
+	}
+	if len(r.Disks) != 1 || r.Disks[0].TotalBytes == 0 {
+		t.Errorf("disks = %+v", r.Disks)
+	}
+	if r.ClockSynchronized == nil || *r.ClockSynchronized {
+		t.Errorf("clock synchronized = %v, want false", r.ClockSynchronized)
+	}
+	if !r.RebootRequired || r.CloudInit.Status != CloudInitDone || len(r.Errors) != 0 {
+		t.Errorf("reboot %v, cloud-init %+v, errors %v", r.RebootRequired, r.CloudInit, r.Errors)
+	}
+}
+
+// A check that cannot be made is named in the report and leaves the rest of
+// it standing.
+func TestCollectSaysWhatItCouldNotFindOut(t *testing.T) {
+	c := fakeHost(t, map[string]string{
+		"run/cloud-init/status.json": "{}",
+	}, map[string]string{"systemctl": "LoadState=loaded\nActiveState=active\nSubState=running\n"})
+	c.data = func(context.Context) (*Data, error) { return nil, errors.New("privileged helper unavailable") }
+
+	r := c.Collect(context.Background())
+	joined := strings.Join(r.Errors, "\n")
+	for _, want := range []string{"uptime:", "units: systemctl show described 1 units, asked about 3", "data disk: privileged helper unavailable", "clock: timedatectl"} {
+		if !strings.Contains(joined, want) {
+			t.Errorf("errors %q do not mention %q", joined, want)
+		}
+	}
+	if r.Data != nil || r.ClockSynchronized != nil || len(r.Units) != 0 {
+		t.Errorf("unknowns were reported as facts: data %+v, clock %v, units %+v", r.Data, r.ClockSynchronized, r.Units)
+	}
+	if r.CloudInit.Status != CloudInitRunning || len(r.Disks) != 1 {
+		t.Errorf("cloud-init %+v, disks %+v", r.CloudInit, r.Disks)
+	}
+}
+
+func TestCloudInitOutcomes(t *testing.T) {
+	for name, tc := range map[string]struct {
+		files map[string]string
+		want  string
+	}{
+		"absent":  {nil, CloudInitAbsent},
+		"running": {map[string]string{"run/cloud-init/status.json": "{}"}, CloudInitRunning},
+		"error": {map[string]string{"run/cloud-init/result.json": `{"v1": {"errors": ["module scripts_user failed"]}}`},
+			CloudInitError},
+		"garbled": {map[string]string{"run/cloud-init/result.json": "{"}, CloudInitError},
+	} {
+		got := fakeHost(t, tc.files, nil).cloudInit()
+		if got.Status != tc.want || (tc.want == CloudInitError) != (len(got.Errors) > 0) {
+			t.Errorf("%s: %+v, want %s", name, got, tc.want)
+		}
+	}
+}
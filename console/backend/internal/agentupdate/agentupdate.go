@@ -0,0 +1,225 @@
+// Package agentupdate replaces a remote's agent package with a newer one,
+// over the agent, and puts the old one back when the new one does not come
+// up.
+//
+// Until this package the only way to change the agent on a remote was to
+// rebuild the qube: the .deb is installed once, by cloud-init, at first boot.
+// qubesair.Update is a small protocol for doing it in place:
+//
+//   - apply downloads a package, checks its SHA-256 and a detached Ed25519
+//     signature against a key the remote pinned, and installs it outside the
+//     helper, in a transient systemd unit — the package's postinst restarts
+//     the helper, which must not take the install down with it;
+//   - the unit then waits for confirm, which the console sends only once the
+//     NEW agent has answered qubesair.Ping; an agent that cannot answer cannot
+//     deliver the confirm either, so nothing short of a working agent stops
+//     the clock;
+//   - with no confirm by the deadline, the unit reinstalls the package that
+//     was there before, which the remote kept for exactly this;
+//   - status reports where all of that is.
+//
+// The signature is what makes this safe to expose at all. The digest comes
+// from the console, like the one cloud-init checks; the key does not. A
+// console that has been taken over can ask a remote to install anything, and
+// the remote will install only what the release key signed.
+//
+// The updater (updater.go) runs in the privileged helper. The console drives
+// it through the agent (internal/service/agentupdate.go).
+package agentupdate
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Service is the agent builtin that answers update requests.
+const Service = "qubesair.Update"
+
+// Operations.
+const (
+	OpApply   = "apply"
+	OpStatus  = "status"
+	OpConfirm = "confirm"
+)
+
+// SignatureSuffix is appended to a package's URL to find its detached
+// signature, as for a .sig beside a release tarball.
+const SignatureSuffix = ".sig"
+
+// MaxPackageBytes bounds a download. The agent package is a few tens of MiB;
+// the signature is checked over the whole file, which is held in memory.
+const MaxPackageBytes = 128 << 20
+
+// DefaultConfirmWithin is how long the new agent has to be confirmed: long
+// enough for the restart, the tunnel to come back and the console's poll to
+// notice, short enough that a broken agent is not left in place for long.
+const DefaultConfirmWithin = 5 * time.Minute
+
+// MaxConfirmWithin bounds what a caller may ask for.
+const MaxConfirmWithin = time.Hour
+
+// State is where an update is.
+type State string
+
+// Update states.
+const (
+	// StateIdle means no update has run on this remote.
+	StateIdle State = "idle"
+	// StateInstalling means the package is verified and the install unit has
+	// been started.
+	StateInstalling State = "installing"
+	// StateAwaitingConfirm means the new package is installed and the unit is
+	// waiting for the console's confirm.
+	StateAwaitingConfirm State = "awaiting-confirm"
+	// StateConfirmed means the new package is installed and kept.
+	StateConfirmed State = "confirmed"
+	// StateCurrent means the package asked for is the one already installed;
+	// nothing was done.
+	StateCurrent State = "current"
+	// StateRolledBack means the new package did not come up and the previous
+	// one is installed again. Detail says why.
+	StateRolledBack State = "rolled-back"
+	// StateFailed means the update failed and so did putting the previous
+	// package back: the remote needs a person.
+	StateFailed State = "failed"
+)
+
+// Pending reports whether an update is still under way.
+func (s State) Pending() bool {
+	return s == StateInstalling || s == StateAwaitingConfirm
+}
+
+// Errors an updater reports. They cross the wire as text; the console maps
+// them back by that text.
+var (
+	// ErrNotConfigured means the remote has no pinned key, so it will install
+	// nothing.
+	ErrNotConfigured = errors.New("no update key is pinned on this remote")
+	// ErrBadSignature means the package's signature does not verify under any
+	// pinned key.
+	ErrBadSignature = errors.New("package signature does not verify")
+	// ErrDigestMismatch means the package is not the one the caller named.
+	ErrDigestMismatch = errors.New("package digest does not match")
+	// ErrNoRollback means the remote has no copy of its installed package to
+	// go back to, and will not update without one.
+	ErrNoRollback = errors.New("no rollback package on this remote")
+	// ErrInProgress means another update has not finished.
+	ErrInProgress = errors.New("an update is already in progress")
+	// ErrSourceNotAllowed means the package URL is not under a configured
+	// source.
+	ErrSourceNotAllowed = errors.New("package URL is not an allowed source")
+	// ErrDowngrade means the package is older than the installed one and the
+	// remote does not allow downgrades.
+	ErrDowngrade = errors.New("package is older than the installed agent")
+)
+
+// Request is one update step.
+type Request struct {
+	Op string `json:"op"`
+	// URL, SHA256 and Version name the package for apply. Version, when set,
+	// must be what the package says it is.
+	URL     string `json:"url,omitempty"`
+	SHA256  string `json:"sha256,omitempty"`
+	Version string `json:"version,omitempty"`
+	// ConfirmSeconds is how long the new agent has to be confirmed (default
+	// DefaultConfirmWithin).
+	ConfirmSeconds int `json:"confirm_seconds,omitempty"`
+}
+
+// Status is where the remote's last update is.
+type Status struct {
+	State State `json:"state"`
+	// From and To are the package versions before and after.
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+	// Detail is why an update was rolled back or failed.
+	Detail         string     `json:"detail,omitempty"`
+	ConfirmSeconds int        `json:"confirm_seconds,omitempty"`
+	StartedAt      *time.Time `json:"started_at,omitempty"`
+	// Deadline is when an awaiting update is rolled back.
+	Deadline   *time.Time `json:"deadline,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// ParsePublicKey reads an Ed25519 public key written as base64, the way
+// cmd/sign-agent-package prints it.
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("public key: %w", err)
+	}
+	if len(raw) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("public key is %d bytes, want %d", len(raw), ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+// ParsePublicKeys reads a key file: one base64 key per line, blank lines and
+// lines starting with # ignored. More than one key lets a release key be
+// rotated without a window in which nothing verifies.
+func ParsePublicKeys(data []byte) ([]ed25519.PublicKey, error) {
+	var keys []ed25519.PublicKey
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, err := ParsePublicKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, sc.Err()
+}
+
+// ParseSignature reads a detached signature: the raw 64 bytes, or base64 of
+// them.
+func ParseSignature(data []byte) ([]byte, error) {
+	if len(data) == ed25519.SignatureSize {
+		return data, nil
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return nil, fmt.Errorf("%w: not an Ed25519 signature", ErrBadSignature)
+	}
+	return sig, nil
+}
+
+// Verify checks sig over pkg against each key, and succeeds if any accepts it.
+func Verify(keys []ed25519.PublicKey, pkg, sig []byte) error {
+	if len(keys) == 0 {
+		return ErrNotConfigured
+	}
+	for _, key := range keys {
+		if ed25519.Verify(key, pkg, sig) {
+			return nil
+		}
+	}
+	return ErrBadSignature
+}
+
+// sentinels are the errors RemoteError recognizes.
+var sentinels = []error{
+	ErrNotConfigured, ErrBadSignature, ErrDigestMismatch, ErrNoRollback, ErrInProgress, ErrSourceNotAllowed,
+	ErrDowngrade,
+}
+
+// RemoteError maps an error that crossed the helper and the agent as text
+// back to the sentinel it carries, so a caller can tell "this remote will
+// never take the package" from a failed download.
+func RemoteError(err error) error {
+	for _, sentinel := range sentinels {
+		if !errors.Is(err, sentinel) && strings.Contains(err.Error(), sentinel.Error()) {
+			return fmt.Errorf("%w (%v)", sentinel, err)
+		}
+	}
+	return err
+}
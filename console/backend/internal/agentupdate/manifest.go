@@ -0,0 +1,183 @@
+package agentupdate
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ManifestHeader is a release manifest's first line.
+const ManifestHeader = "qubes-air-agent release"
+
+// ErrBadManifest means a manifest did not parse. A manifest that parses but
+// is not signed by a pinned key is ErrBadSignature.
+var ErrBadManifest = errors.New("malformed release manifest")
+
+// A release manifest is what a release signs, instead of each qube trusting a
+// URL and a digest the console handed it. It is text, one fact per line, so
+// that a booting guest can read it with awk and check it with openssl — the
+// guest has neither the agent nor a JSON parser yet:
+//
+//	qubes-air-agent release
+//	version 1.4.0
+//	min-protocol v1
+//	sha256 amd64 <64 hex> qubes-air-agent_1.4.0_amd64.deb
+//
+// File names are relative to the manifest's own URL; the guest fetches the
+// one for its architecture from beside it.
+//
+// min-protocol is a wire version as the transport's Handshake carries it
+// ("v1", "v2"): the lowest one the packaged agent can run a tunnel at. It is
+// the same version the console negotiates and the agent reports, not a second
+// numbering beside it, so a console checks it against what it and the agent
+// actually speak.
+type Manifest struct {
+	Version     string
+	MinProtocol string
+	// Packages are keyed by Debian architecture.
+	Packages map[string]ManifestPackage
+}
+
+// ManifestPackage is one architecture's package.
+type ManifestPackage struct {
+	File   string
+	SHA256 string
+}
+
+var (
+	// manifestVersion and manifestFile are what a Debian version and a
+	// package file name may contain, and nothing a shell would read as more
+	// than a word: the guest substitutes the file name into a URL unquoted.
+	manifestVersion = regexp.MustCompile(`^[0-9][A-Za-z0-9.+~-]*$`)
+	manifestFile    = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._+~-]*\.deb$`)
+	manifestArch    = regexp.MustCompile(`^[a-z0-9]+$`)
+	manifestSHA     = regexp.MustCompile(`^[0-9a-f]{64}$`)
+)
+
+// ProtocolAtLeast reports whether the wire version have is min or newer.
+// Anything not of the form "v<n>", an empty have included, is not: a version
+// nobody reported is not evidence of one high enough.
+func ProtocolAtLeast(have, min string) bool {
+	h, ok := protocolNumber(have)
+	if !ok {
+		return false
+	}
+	m, ok := protocolNumber(min)
+	return ok && h >= m
+}
+
+// protocolNumber is n of a wire version "v<n>", n ≥ 1.
+func protocolNumber(v string) (int, bool) {
+	digits, ok := strings.CutPrefix(v, "v")
+	if !ok || digits == "" || digits[0] == '0' {
+		return 0, false
+	}
+	n, err := strconv.Atoi(digits)
+	if err != nil || n < 1 {
+		return 0, false
+	}
+	return n, true
+}
+
+// ParseManifest reads a manifest. It is strict: an unknown line, a repeated
+// one or a missing version is an error, not something to skip — a release
+// tool that writes something this does not know is a release this console
+// does not understand.
+//
+// It must end in exactly one newline, as Marshal writes it: the guest gets
+// the manifest as a cloud-config literal block, which ends in one, and the
+// signature is over the bytes.
+func ParseManifest(data []byte) (Manifest, error) {
+	if !strings.HasSuffix(string(data), "\n") {
+		return Manifest{}, fmt.Errorf("%w: does not end in a newline", ErrBadManifest)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if lines[0] != ManifestHeader {
+		return Manifest{}, fmt.Errorf("%w: first line is not %q", ErrBadManifest, ManifestHeader)
+	}
+	m := Manifest{Packages: map[string]ManifestPackage{}}
+	seen := map[string]bool{}
+	for i, line := range lines[1:] {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.Join(fields, " ") != line {
+			return Manifest{}, fmt.Errorf("%w: line %d is not single-space separated", ErrBadManifest, i+2)
+		}
+		key := fields[0]
+		if key == "sha256" && len(fields) > 1 {
+			key += " " + fields[1]
+		}
+		if seen[key] {
+			return Manifest{}, fmt.Errorf("%w: %q appears twice", ErrBadManifest, key)
+		}
+		seen[key] = true
+		switch {
+		case fields[0] == "version" && len(fields) == 2 && manifestVersion.MatchString(fields[1]):
+			m.Version = fields[1]
+		case fields[0] == "min-protocol" && len(fields) == 2:
+			if _, ok := protocolNumber(fields[1]); !ok {
+				return Manifest{}, fmt.Errorf("%w: min-protocol %q is not a wire version like v1", ErrBadManifest, fields[1])
+			}
+			m.MinProtocol = fields[1]
+		case fields[0] == "sha256" && len(fields) == 4 && manifestArch.MatchString(fields[1]) &&
+			manifestSHA.MatchString(fields[2]) && manifestFile.MatchString(fields[3]):
+			m.Packages[fields[1]] = ManifestPackage{SHA256: fields[2], File: fields[3]}
+		default:
+			return Manifest{}, fmt.Errorf("%w: line %d: %q", ErrBadManifest, i+2, line)
+		}
+	}
+	switch {
+	case m.Version == "":
+		return Manifest{}, fmt.Errorf("%w: no version", ErrBadManifest)
+	case m.MinProtocol == "":
+		return Manifest{}, fmt.Errorf("%w: no min-protocol", ErrBadManifest)
+	case len(m.Packages) == 0:
+		return Manifest{}, fmt.Errorf("%w: no packages", ErrBadManifest)
+	}
+	return m, nil
+}
+
+// Marshal writes the manifest in the form ParseManifest reads, architectures
+// sorted, so the same release always signs the same bytes.
+func (m Manifest) Marshal() []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\nversion %s\nmin-protocol %s\n", ManifestHeader, m.Version, m.MinProtocol)
+	arches := make([]string, 0, len(m.Packages))
+	for arch := range m.Packages {
+		arches = append(arches, arch)
+	}
+	slices.Sort(arches)
+	for _, arch := range arches {
+		p := m.Packages[arch]
+		fmt.Fprintf(&b, "sha256 %s %s %s\n", arch, p.SHA256, p.File)
+	}
+	return []byte(b.String())
+}
+
+// VerifyManifest checks data's signature against keys and only then parses
+// it: nothing from an unsigned manifest is worth reading.
+func VerifyManifest(keys []ed25519.PublicKey, data, sig []byte) (Manifest, error) {
+	parsed, err := ParseSignature(sig)
+	if err != nil {
+		return Manifest{}, err
+	}
+	if err := Verify(keys, data, parsed); err != nil {
+		return Manifest{}, err
+	}
+	return ParseManifest(data)
+}
+
+// PublicKeyPEM writes key the way openssl reads it, for a guest that checks a
+// manifest before any of this code is on it.
+func PublicKeyPEM(key ed25519.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})), nil
+}
@@ -0,0 +1,79 @@
+package agentupdate
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestManifestRoundTripsAndVerifies(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	m := Manifest{Version: "1.4.0", MinProtocol: "v1", Packages: map[string]ManifestPackage{
+		"arm64": {File: "qubes-air-agent_1.4.0_arm64.deb", SHA256: strings.Repeat("b", 64)},
+		"amd64": {File: "qubes-air-agent_1.4.0_amd64.deb", SHA256: strings.Repeat("a", 64)},
+	}}
+	data := m.Marshal()
+	if !strings.Contains(string(data), "amd64 "+strings.Repeat("a", 64)+" qubes-air-agent_1.4.0_amd64.deb\nsha256 arm64") {
+		t.Errorf("architectures not sorted:\n%s", data)
+	}
+	got, err := VerifyManifest([]ed25519.PublicKey{pub}, data, ed25519.Sign(priv, data))
+	if err != nil || got.Version != "1.4.0" || got.Packages["amd64"] != m.Packages["amd64"] {
+		t.Fatalf("VerifyManifest = %+v, %v", got, err)
+	}
+
+	_, other, _ := ed25519.GenerateKey(nil)
+	if _, err := VerifyManifest([]ed25519.PublicKey{pub}, data, ed25519.Sign(other, data)); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("manifest signed by another key = %v, want ErrBadSignature", err)
+	}
+	tampered := []byte(strings.Replace(string(data), "1.4.0", "1.4.1", 1))
+	if _, err := VerifyManifest([]ed25519.PublicKey{pub}, tampered, ed25519.Sign(priv, data)); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("tampered manifest = %v, want ErrBadSignature", err)
+	}
+}
+
+func TestParseManifestIsStrict(t *testing.T) {
+	sha := strings.Repeat("a", 64)
+	good := ManifestHeader + "\nversion 1.0\nmin-protocol v1\nsha256 amd64 " + sha + " a_1.0_amd64.deb\n"
+	if _, err := ParseManifest([]byte(good)); err != nil {
+		t.Fatalf("good manifest: %v", err)
+	}
+	for name, text := range map[string]string{
+		"no header":     "version 1.0\n",
+		"unknown line":  good + "signer me\n",
+		"repeated arch": good + "sha256 amd64 " + sha + " b_1.0_amd64.deb\n",
+		"no packages":   ManifestHeader + "\nversion 1.0\nmin-protocol v1\n",
+		"shell in file": ManifestHeader + "\nversion 1.0\nmin-protocol v1\nsha256 amd64 " + sha + " $(reboot).deb\n",
+		"path in file":  ManifestHeader + "\nversion 1.0\nmin-protocol v1\nsha256 amd64 " + sha + " ../a.deb\n",
+		"upper digest":  ManifestHeader + "\nversion 1.0\nmin-protocol v1\nsha256 amd64 " + strings.ToUpper(sha) + " a.deb\n",
+		"double space":  ManifestHeader + "\nversion  1.0\nmin-protocol v1\nsha256 amd64 " + sha + " a.deb\n",
+		"zero protocol": ManifestHeader + "\nversion 1.0\nmin-protocol v0\nsha256 amd64 " + sha + " a.deb\n",
+		"bare number":   ManifestHeader + "\nversion 1.0\nmin-protocol 1\nsha256 amd64 " + sha + " a.deb\n",
+	} {
+		if _, err := ParseManifest([]byte(text)); !errors.Is(err, ErrBadManifest) {
+			t.Errorf("%s: err = %v, want ErrBadManifest", name, err)
+		}
+	}
+}
+
+// TestProtocolAtLeast — wire versions compare by number, not as strings, and
+// a version that is missing or malformed satisfies no minimum.
+func TestProtocolAtLeast(t *testing.T) {
+	for _, c := range []struct {
+		have, min string
+		want      bool
+	}{
+		{"v2", "v1", true},
+		{"v2", "v2", true},
+		{"v1", "v2", false},
+		{"v10", "v9", true},
+		{"", "v1", false},
+		{"2", "v1", false},
+		{"v2", "2", false},
+		{"v02", "v1", false},
+	} {
+		if got := ProtocolAtLeast(c.have, c.min); got != c.want {
+			t.Errorf("ProtocolAtLeast(%q, %q) = %v, want %v", c.have, c.min, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,482 @@
+package agentupdate
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultDir is where the packaged helper keeps an update's state and
+// packages. Root's alone.
+const DefaultDir = "/var/lib/qubes-air/update"
+
+// InstalledFile is the copy of the installed package an update rolls back
+// to, in the updater's directory. The cloud-init installer leaves the package
+// it installed there, and every confirmed update replaces it with its own.
+const InstalledFile = "installed.deb"
+
+// ApplyUnit is the transient systemd unit an install runs in.
+const ApplyUnit = "qubes-air-update"
+
+// PackageName is the package an update may replace. A package signed by the
+// release key but named otherwise is still not this one.
+const PackageName = "qubes-air-agent"
+
+// Files beside InstalledFile.
+const (
+	stateFile     = "state.json"
+	stagedFile    = "staged.deb"
+	confirmedFile = "confirmed"
+)
+
+// maxSignatureBytes bounds the signature download: base64 of 64 bytes and a
+// newline, with room to spare.
+const maxSignatureBytes = 4 << 10
+
+var sha256Hex = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
+
+// Runner runs a system tool and returns its combined output. A non-zero exit
+// is an error.
+type Runner func(ctx context.Context, name string, args ...string) (string, error)
+
+// Updater serves update requests on the remote. Handle runs in the helper;
+// Apply, which installs and waits, runs in the unit Launch starts.
+type Updater struct {
+	// Dir holds the state and the packages (default DefaultDir).
+	Dir string
+	// Keys returns the pinned keys. It is called on every apply, so a key
+	// delivered after the helper started is the one checked.
+	Keys func() ([]ed25519.PublicKey, error)
+	// Sources, when set, are the URL prefixes packages may come from.
+	Sources []string
+	// AllowDowngrade lets apply install a package older than the installed
+	// one. Off, an older package is refused: the signature says who built a
+	// package, not that it is still fit to run, and whoever can reach apply
+	// could otherwise roll a remote back to any signed build — the one with
+	// the bug the next release fixed included.
+	AllowDowngrade bool
+	// Launch starts Apply outside the caller's process.
+	Launch func(ctx context.Context) error
+	// Run runs dpkg, dpkg-deb, dpkg-query and systemctl.
+	Run Runner
+	// HTTP fetches packages (default a client with a 10-minute timeout).
+	HTTP *http.Client
+	// PollEvery is how often Apply looks for the confirm (default a second).
+	PollEvery time.Duration
+
+	mu sync.Mutex
+}
+
+// Handle answers one update request.
+func (u *Updater) Handle(ctx context.Context, req Request) (Status, error) {
+	switch req.Op {
+	case OpStatus:
+		return u.status()
+	case OpApply:
+		return u.apply(ctx, req)
+	case OpConfirm:
+		return u.confirm()
+	default:
+		return Status{}, fmt.Errorf("unknown update operation %q", req.Op)
+	}
+}
+
+// apply fetches and checks the package, stages it and starts the install.
+// Everything that can refuse the package refuses it here, before the remote's
+// state changes: the helper answers the caller, and the install unit only
+// installs.
+//
+//nolint:gocyclo // the checks of one request, in the order they can fail
+func (u *Updater) apply(ctx context.Context, req Request) (Status, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	prev, err := u.status()
+	if err != nil {
+		return Status{}, err
+	}
+	if prev.State.Pending() {
+		return Status{}, fmt.Errorf("%w: %s to %s is %s", ErrInProgress, prev.From, prev.To, prev.State)
+	}
+	keys, err := u.Keys()
+	if err != nil {
+		return Status{}, err
+	}
+	if len(keys) == 0 {
+		return Status{}, ErrNotConfigured
+	}
+	if err := u.checkSource(req.URL); err != nil {
+		return Status{}, err
+	}
+	if !sha256Hex.MatchString(req.SHA256) {
+		return Status{}, errors.New("sha256 must be 64 hex characters")
+	}
+	confirm := DefaultConfirmWithin
+	if req.ConfirmSeconds > 0 {
+		confirm = time.Duration(req.ConfirmSeconds) * time.Second
+	}
+	if confirm > MaxConfirmWithin {
+		return Status{}, fmt.Errorf("confirm_seconds %d is more than %s", req.ConfirmSeconds, MaxConfirmWithin)
+	}
+	// No update without a way back: the whole point of the confirm is that a
+	// bad package is replaced by the good one, and "the good one" has to be
+	// on disk when the new agent turns out not to answer.
+	if _, err := os.Stat(u.path(InstalledFile)); err != nil {
+		return Status{}, fmt.Errorf("%w (%s): rebuild the qube or put the installed package there", ErrNoRollback, u.path(InstalledFile))
+	}
+
+	pkg, err := u.fetch(ctx, req.URL, MaxPackageBytes)
+	if err != nil {
+		return Status{}, fmt.Errorf("download package: %w", err)
+	}
+	sum := sha256.Sum256(pkg)
+	if got := hex.EncodeToString(sum[:]); got != strings.ToLower(req.SHA256) {
+		return Status{}, fmt.Errorf("%w: got %s, want %s", ErrDigestMismatch, got, strings.ToLower(req.SHA256))
+	}
+	rawSig, err := u.fetch(ctx, req.URL+SignatureSuffix, maxSignatureBytes)
+	if err != nil {
+		return Status{}, fmt.Errorf("download signature: %w", err)
+	}
+	sig, err := ParseSignature(rawSig)
+	if err != nil {
+		return Status{}, err
+	}
+	if err := Verify(keys, pkg, sig); err != nil {
+		return Status{}, err
+	}
+
+	staged := u.path(stagedFile)
+	if err := writeAtomic(staged, pkg, 0o600); err != nil {
+		return Status{}, fmt.Errorf("stage package: %w", err)
+	}
+	name, to, err := u.packageVersion(ctx, staged)
+	switch {
+	case err == nil && name != PackageName:
+		err = fmt.Errorf("package is %s, not %s", name, PackageName)
+	case err == nil && req.Version != "" && to != req.Version:
+		err = fmt.Errorf("package is version %s, not the %s asked for", to, req.Version)
+	}
+	if err != nil {
+		_ = os.Remove(staged)
+		return Status{}, err
+	}
+	from, err := u.installedVersion(ctx)
+	if err != nil {
+		_ = os.Remove(staged)
+		return Status{}, err
+	}
+
+	if CompareVersions(to, from) < 0 {
+		if !u.AllowDowngrade {
+			_ = os.Remove(staged)
+			return Status{}, fmt.Errorf("%w: %s is older than %s", ErrDowngrade, to, from)
+		}
+		log.Printf("agentupdate: downgrading %s to %s: allow_downgrade is set", from, to)
+	}
+
+	now := time.Now().UTC()
+	if to == from {
+		_ = os.Remove(staged)
+		st := Status{State: StateCurrent, From: from, To: to, StartedAt: &now, FinishedAt: &now}
+		return st, u.save(st)
+	}
+	_ = os.Remove(u.path(confirmedFile))
+	st := Status{State: StateInstalling, From: from, To: to, ConfirmSeconds: int(confirm / time.Second), StartedAt: &now}
+	if err := u.save(st); err != nil {
+		return Status{}, err
+	}
+	if err := u.Launch(ctx); err != nil {
+		// Nothing was installed: the remote is as it was, and says so.
+		_ = os.Remove(staged)
+		_ = u.save(prev)
+		return Status{}, fmt.Errorf("start the install: %w", err)
+	}
+	return st, nil
+}
+
+// confirm tells a waiting install that the new agent answered.
+func (u *Updater) confirm() (Status, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	st, err := u.status()
+	if err != nil {
+		return Status{}, err
+	}
+	if st.State != StateAwaitingConfirm {
+		return st, fmt.Errorf("nothing to confirm: the update is %s", st.State)
+	}
+	if err := os.WriteFile(u.path(confirmedFile), nil, 0o600); err != nil {
+		return Status{}, err
+	}
+	return st, nil
+}
+
+// Apply installs the staged package and waits for the confirm, rolling back
+// when none comes. It runs in ApplyUnit, where the package's postinst
+// restarting the helper and the agent cannot reach it.
+//
+// An install found waiting — the unit was stopped, or the remote rebooted —
+// carries on waiting until its original deadline.
+func (u *Updater) Apply(ctx context.Context) error {
+	st, err := u.status()
+	if err != nil {
+		return err
+	}
+	switch st.State {
+	case StateInstalling:
+		out, err := u.Run(ctx, "dpkg", "-i", u.path(stagedFile))
+		if err != nil {
+			return u.rollback(ctx, st, fmt.Sprintf("installing %s failed: %v: %s", st.To, err, lastLine(out)))
+		}
+		deadline := time.Now().UTC().Add(time.Duration(st.ConfirmSeconds) * time.Second)
+		st.State, st.Deadline = StateAwaitingConfirm, &deadline
+		if err := u.save(st); err != nil {
+			return u.rollback(ctx, st, err.Error())
+		}
+	case StateAwaitingConfirm:
+	default:
+		return fmt.Errorf("nothing to apply: the update is %s", st.State)
+	}
+
+	poll := u.PollEvery
+	if poll <= 0 {
+		poll = time.Second
+	}
+	tick := time.NewTicker(poll)
+	defer tick.Stop()
+	for {
+		if _, err := os.Stat(u.path(confirmedFile)); err == nil {
+			if err := os.Rename(u.path(stagedFile), u.path(InstalledFile)); err != nil {
+				return fmt.Errorf("keep %s for the next rollback: %w", st.To, err)
+			}
+			_ = os.Remove(u.path(confirmedFile))
+			now := time.Now().UTC()
+			st.State, st.FinishedAt = StateConfirmed, &now
+			return u.save(st)
+		}
+		if st.Deadline == nil || !time.Now().Before(*st.Deadline) {
+			return u.rollback(ctx, st,
+				fmt.Sprintf("%s was not confirmed within %ds of installing", st.To, st.ConfirmSeconds))
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-tick.C:
+		}
+	}
+}
+
+// rollback reinstalls the package that was there before, and records why.
+func (u *Updater) rollback(ctx context.Context, st Status, reason string) error {
+	out, err := u.Run(ctx, "dpkg", "-i", u.path(InstalledFile))
+	now := time.Now().UTC()
+	st.FinishedAt = &now
+	if err != nil {
+		st.State = StateFailed
+		st.Detail = fmt.Sprintf("%s; reinstalling %s failed too: %v: %s", reason, st.From, err, lastLine(out))
+	} else {
+		st.State = StateRolledBack
+		st.Detail = reason
+	}
+	_ = os.Remove(u.path(stagedFile))
+	_ = os.Remove(u.path(confirmedFile))
+	if err := u.save(st); err != nil {
+		return err
+	}
+	return errors.New(st.Detail)
+}
+
+// Recover restarts an install the helper finds pending with no unit running
+// it — a reboot in the middle — and reports whether it did.
+func (u *Updater) Recover(ctx context.Context) (bool, error) {
+	st, err := u.status()
+	if err != nil || !st.State.Pending() {
+		return false, err
+	}
+	if _, err := u.Run(ctx, "systemctl", "is-active", "--quiet", ApplyUnit+".service"); err == nil {
+		return false, nil
+	}
+	return true, u.Launch(ctx)
+}
+
+// status reads the state; a remote that never updated is idle.
+func (u *Updater) status() (Status, error) {
+	data, err := os.ReadFile(u.path(stateFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return Status{State: StateIdle}, nil
+	}
+	if err != nil {
+		return Status{}, err
+	}
+	var st Status
+	if err := json.Unmarshal(data, &st); err != nil {
+		return Status{}, fmt.Errorf("update state %s: %w", u.path(stateFile), err)
+	}
+	return st, nil
+}
+
+func (u *Updater) save(st Status) error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeAtomic(u.path(stateFile), append(data, '\n'), 0o644)
+}
+
+func (u *Updater) path(name string) string {
+	dir := u.Dir
+	if dir == "" {
+		dir = DefaultDir
+	}
+	return filepath.Join(dir, name)
+}
+
+// checkSource accepts an http(s) URL under one of the configured sources: the
+// same scheme and host, and a path at or below the source's, compared a whole
+// segment at a time. A string prefix would let
+// https://mirror.example.org.evil.net/ pass for https://mirror.example.org,
+// and /agent-evil/ for /agent.
+func (u *Updater) checkSource(raw string) error {
+	parsed, err := url.Parse(raw)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("package URL %q is not an http(s) URL", raw)
+	}
+	if len(u.Sources) == 0 {
+		return nil
+	}
+	// Cleaned, so /agent/../evil is judged where a server would serve it from.
+	p := path.Clean("/" + parsed.Path)
+	for _, s := range u.Sources {
+		src, err := parseSource(s)
+		if err != nil {
+			continue
+		}
+		if parsed.Scheme == src.Scheme && strings.EqualFold(parsed.Host, src.Host) &&
+			(src.Path == "" || p == src.Path || strings.HasPrefix(p, src.Path+"/")) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrSourceNotAllowed, raw)
+}
+
+// NormalizeSource checks a configured package source and returns it in the
+// form checkSource matches against: scheme and host lowercased, the path
+// cleaned and ending in "/". A source with credentials, a query or a fragment
+// is refused; none of them can be part of a prefix.
+func NormalizeSource(raw string) (string, error) {
+	src, err := parseSource(raw)
+	if err != nil {
+		return "", err
+	}
+	return src.Scheme + "://" + src.Host + src.Path + "/", nil
+}
+
+// parseSource parses a source with its path cleaned and without a trailing
+// "/" — empty for a whole host.
+func parseSource(raw string) (*url.URL, error) {
+	src, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("source %q: %w", raw, err)
+	}
+	switch {
+	case (src.Scheme != "http" && src.Scheme != "https") || src.Host == "":
+		return nil, fmt.Errorf("source %q is not an http(s) URL", raw)
+	case src.User != nil || src.RawQuery != "" || src.ForceQuery || src.Fragment != "":
+		return nil, fmt.Errorf("source %q has credentials, a query or a fragment", raw)
+	}
+	src.Host = strings.ToLower(src.Host)
+	src.Path = strings.TrimSuffix(path.Clean("/"+src.Path), "/")
+	return src, nil
+}
+
+// fetch downloads at most limit bytes. Plain HTTP is fine: nothing fetched is
+// trusted before its digest and signature are checked.
+func (u *Updater) fetch(ctx context.Context, raw string, limit int64) ([]byte, error) {
+	client := u.HTTP
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Minute}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, raw, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", raw, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("%s is larger than %d bytes", raw, limit)
+	}
+	return data, nil
+}
+
+// packageVersion is the name and version a package file declares.
+func (u *Updater) packageVersion(ctx context.Context, path string) (name, version string, err error) {
+	out, err := u.Run(ctx, "dpkg-deb", "--show", "--showformat=${Package} ${Version}", path)
+	if err != nil {
+		return "", "", fmt.Errorf("not a readable package: %v: %s", err, lastLine(out))
+	}
+	name, version, ok := strings.Cut(strings.TrimSpace(out), " ")
+	if !ok || version == "" {
+		return "", "", fmt.Errorf("not a readable package: %q", out)
+	}
+	return name, version, nil
+}
+
+// installedVersion is the version of PackageName dpkg has installed.
+func (u *Updater) installedVersion(ctx context.Context) (string, error) {
+	out, err := u.Run(ctx, "dpkg-query", "--show", "--showformat=${Version}", PackageName)
+	if err != nil {
+		return "", fmt.Errorf("installed %s version: %v: %s", PackageName, err, lastLine(out))
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// writeAtomic writes data beside path and renames it into place.
+func writeAtomic(path string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	tmp := path + ".part"
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// lastLine is the end of a tool's output, which is where dpkg says what went
+// wrong.
+func lastLine(out string) string {
+	out = strings.TrimSpace(out)
+	if i := strings.LastIndexByte(out, '\n'); i >= 0 {
+		return out[i+1:]
+	}
+	return out
+}
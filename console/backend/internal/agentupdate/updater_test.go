@@ -0,0 +1,319 @@
+package agentupdate
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDpkg stands in for dpkg: it "installs" a file by remembering its
+// content, and reports versions from it.
+type fakeDpkg struct {
+	mu        sync.Mutex
+	installed string
+	failOn    string // content whose install fails
+}
+
+func (f *fakeDpkg) run(_ context.Context, name string, args ...string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch name {
+	case "dpkg-deb":
+		data, err := os.ReadFile(args[len(args)-1])
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil // the fake package's content is "name version"
+	case "dpkg-query":
+		_, v, _ := strings.Cut(f.installed, " ")
+		return v, nil
+	case "dpkg":
+		data, err := os.ReadFile(args[1])
+		if err != nil {
+			return "", err
+		}
+		if string(data) == f.failOn {
+			return "dpkg: error processing package", errors.New("exit status 1")
+		}
+		f.installed = string(data)
+		return "", nil
+	case "systemctl":
+		return "", errors.New("exit status 3") // the unit is not running
+	}
+	return "", errors.New("unexpected tool " + name)
+}
+
+func (f *fakeDpkg) version() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.installed
+}
+
+type release struct {
+	url, sha string
+}
+
+func TestUpdater(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherPriv, _ := ed25519.GenerateKey(nil)
+
+	files := map[string][]byte{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write(data)
+	}))
+	defer srv.Close()
+	publish := func(name, content string, key ed25519.PrivateKey) release {
+		files["/"+name] = []byte(content)
+		files["/"+name+SignatureSuffix] = []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(key, []byte(content))))
+		sum := sha256.Sum256([]byte(content))
+		return release{url: srv.URL + "/" + name, sha: hex.EncodeToString(sum[:])}
+	}
+	v1 := publish("v1.deb", "qubes-air-agent 1.0", priv)
+	v2 := publish("v2.deb", "qubes-air-agent 2.0", priv)
+	v3 := publish("v3.deb", "qubes-air-agent 3.0", priv)
+	forged := publish("forged.deb", "qubes-air-agent 9.9", otherPriv)
+	other := publish("other.deb", "openssh-server 9.9", priv)
+
+	dir := t.TempDir()
+	dpkg := &fakeDpkg{installed: "qubes-air-agent 1.0"}
+	launched := make(chan struct{}, 1)
+	u := &Updater{
+		Dir:       dir,
+		Keys:      func() ([]ed25519.PublicKey, error) { return []ed25519.PublicKey{pub}, nil },
+		Launch:    func(context.Context) error { launched <- struct{}{}; return nil },
+		Run:       dpkg.run,
+		PollEvery: 10 * time.Millisecond,
+	}
+	ctx := context.Background()
+	apply := func(r release, version string) (Status, error) {
+		return u.Handle(ctx, Request{Op: OpApply, URL: r.url, SHA256: r.sha, Version: version, ConfirmSeconds: 1})
+	}
+
+	// Without a package to roll back to, nothing is installed.
+	if _, err := apply(v2, ""); !errors.Is(err, ErrNoRollback) {
+		t.Fatalf("apply without a rollback package = %v, want ErrNoRollback", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, InstalledFile), []byte("qubes-air-agent 1.0"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, tc := range map[string]struct {
+		r       release
+		version string
+		want    error
+	}{
+		"forged":          {r: forged, want: ErrBadSignature},
+		"wrong digest":    {r: release{url: v2.url, sha: v1.sha}, want: ErrDigestMismatch},
+		"other package":   {r: other},
+		"wrong version":   {r: v2, version: "2.1"},
+		"not http":        {r: release{url: "file:///tmp/v2.deb", sha: v2.sha}},
+		"missing sig":     {r: release{url: srv.URL + "/nothing.deb", sha: v2.sha}},
+		"already current": {r: v1},
+	} {
+		st, err := apply(tc.r, tc.version)
+		switch {
+		case name == "already current":
+			if err != nil || st.State != StateCurrent {
+				t.Errorf("%s: %+v, %v; want current", name, st, err)
+			}
+		case err == nil:
+			t.Errorf("%s: applied (%+v)", name, st)
+		case tc.want != nil && !errors.Is(err, tc.want):
+			t.Errorf("%s: err = %v, want %v", name, err, tc.want)
+		}
+	}
+	if len(launched) != 0 || dpkg.version() != "qubes-air-agent 1.0" {
+		t.Fatalf("a refused package was installed: %q", dpkg.version())
+	}
+
+	// A confirmed update keeps the new package, and makes it the next
+	// rollback target.
+	st, err := apply(v2, "2.0")
+	if err != nil || st.State != StateInstalling || st.From != "1.0" || st.To != "2.0" {
+		t.Fatalf("apply v2 = %+v, %v", st, err)
+	}
+	<-launched
+	if _, err := apply(v3, ""); !errors.Is(err, ErrInProgress) {
+		t.Errorf("second apply while installing = %v, want ErrInProgress", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- u.Apply(ctx) }()
+	waitFor(t, u, StateAwaitingConfirm)
+	if st, err := u.Handle(ctx, Request{Op: OpConfirm}); err != nil || st.State != StateAwaitingConfirm {
+		t.Fatalf("confirm = %+v, %v", st, err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Apply = %v", err)
+	}
+	if st, _ := u.Handle(ctx, Request{Op: OpStatus}); st.State != StateConfirmed || dpkg.version() != "qubes-air-agent 2.0" {
+		t.Fatalf("after confirm: %+v, installed %q", st, dpkg.version())
+	}
+	if kept, _ := os.ReadFile(filepath.Join(dir, InstalledFile)); string(kept) != "qubes-air-agent 2.0" {
+		t.Errorf("rollback package after confirm = %q, want v2", kept)
+	}
+
+	// Nobody confirms v3: it is replaced by v2 at the deadline.
+	if _, err := apply(v3, ""); err != nil {
+		t.Fatal(err)
+	}
+	<-launched
+	if err := u.Apply(ctx); err == nil {
+		t.Fatal("an unconfirmed Apply reported success")
+	}
+	st, _ = u.Handle(ctx, Request{Op: OpStatus})
+	if st.State != StateRolledBack || dpkg.version() != "qubes-air-agent 2.0" || !strings.Contains(st.Detail, "not confirmed") {
+		t.Fatalf("after the deadline: %+v, installed %q", st, dpkg.version())
+	}
+	if _, err := u.Handle(ctx, Request{Op: OpConfirm}); err == nil {
+		t.Error("a rolled-back update accepted a confirm")
+	}
+
+	// A package dpkg refuses is rolled back at once.
+	dpkg.failOn = "qubes-air-agent 3.0"
+	if _, err := apply(v3, ""); err != nil {
+		t.Fatal(err)
+	}
+	<-launched
+	_ = u.Apply(ctx)
+	if st, _ := u.Handle(ctx, Request{Op: OpStatus}); st.State != StateRolledBack || !strings.Contains(st.Detail, "installing 3.0 failed") {
+		t.Errorf("after a failed install: %+v", st)
+	}
+
+	// An older package is refused unless the remote allows downgrades.
+	if _, err := apply(v1, ""); !errors.Is(err, ErrDowngrade) {
+		t.Fatalf("apply of an older package = %v, want ErrDowngrade", err)
+	}
+	if len(launched) != 0 || dpkg.version() != "qubes-air-agent 2.0" {
+		t.Fatalf("a downgrade was installed: %q", dpkg.version())
+	}
+	u.AllowDowngrade = true
+	st, err = apply(v1, "")
+	if err != nil || st.State != StateInstalling || st.From != "2.0" || st.To != "1.0" {
+		t.Fatalf("apply of an older package with downgrades allowed = %+v, %v", st, err)
+	}
+	<-launched
+	go func() { done <- u.Apply(ctx) }()
+	waitFor(t, u, StateAwaitingConfirm)
+	if _, err := u.Handle(ctx, Request{Op: OpConfirm}); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil || dpkg.version() != "qubes-air-agent 1.0" {
+		t.Fatalf("allowed downgrade: Apply = %v, installed %q", err, dpkg.version())
+	}
+
+	// With no pinned key the remote installs nothing at all.
+	u.Keys = func() ([]ed25519.PublicKey, error) { return nil, nil }
+	if _, err := apply(v3, ""); !errors.Is(err, ErrNotConfigured) {
+		t.Errorf("apply with no key = %v, want ErrNotConfigured", err)
+	}
+}
+
+// TestCheckSourceMatchesWholeHostsAndSegments — a source admits URLs on its
+// own scheme and host, at or below its path; a longer host or a sibling
+// directory that merely shares its spelling is not under it.
+func TestCheckSourceMatchesWholeHostsAndSegments(t *testing.T) {
+	u := &Updater{Sources: []string{"https://mirror.example.org", "https://Artifacts.example/agent/"}}
+	for raw, ok := range map[string]bool{
+		"https://mirror.example.org/pool/a.deb":          true,
+		"https://MIRROR.example.org/a.deb":               true,
+		"https://artifacts.example/agent/a.deb":          true,
+		"https://artifacts.example/agent/1.4/a.deb":      true,
+		"https://mirror.example.org.evil.net/a.deb":      false,
+		"https://mirror.example.org:8443/a.deb":          false,
+		"http://mirror.example.org/a.deb":                false,
+		"https://mirror.example.org@evil.net/a.deb":      false,
+		"https://artifacts.example/agent-evil/a.deb":     false,
+		"https://artifacts.example/agent/../other/a.deb": false,
+		"https://artifacts.example/a.deb":                false,
+	} {
+		err := u.checkSource(raw)
+		if ok && err != nil {
+			t.Errorf("checkSource(%q) = %v, want accepted", raw, err)
+		}
+		if !ok && !errors.Is(err, ErrSourceNotAllowed) {
+			t.Errorf("checkSource(%q) = %v, want ErrSourceNotAllowed", raw, err)
+		}
+	}
+
+	for raw, want := range map[string]string{
+		"https://Mirror.Example.org":   "https://mirror.example.org/",
+		"https://artifacts.example/a/": "https://artifacts.example/a/",
+		"http://host/a/./b//":          "http://host/a/b/",
+	} {
+		if got, err := NormalizeSource(raw); err != nil || got != want {
+			t.Errorf("NormalizeSource(%q) = %q, %v; want %q", raw, got, err, want)
+		}
+	}
+	for _, raw := range []string{"ftp://host/", "https://", "https://user:pw@host/", "https://host/?x=1", "https://host/#a", "host/path"} {
+		if _, err := NormalizeSource(raw); err == nil {
+			t.Errorf("NormalizeSource(%q) accepted", raw)
+		}
+	}
+}
+
+func waitFor(t *testing.T, u *Updater, want State) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if st, err := u.status(); err == nil && st.State == want {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("update never reached %s", want)
+}
+
+func TestRecoverRelaunchesAnInterruptedInstall(t *testing.T) {
+	dpkg := &fakeDpkg{installed: "qubes-air-agent 1.0"}
+	relaunched := false
+	u := &Updater{Dir: t.TempDir(), Run: dpkg.run, Launch: func(context.Context) error { relaunched = true; return nil }}
+	if ok, err := u.Recover(context.Background()); ok || err != nil || relaunched {
+		t.Fatalf("Recover with nothing pending = %v, %v", ok, err)
+	}
+	if err := u.save(Status{State: StateAwaitingConfirm, From: "1.0", To: "2.0"}); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := u.Recover(context.Background()); !ok || err != nil || !relaunched {
+		t.Fatalf("Recover with an install pending = %v, %v (relaunched %v)", ok, err, relaunched)
+	}
+}
+
+func TestParseKeysAndSignatures(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	keys, err := ParsePublicKeys([]byte("# release key\n\n" + base64.StdEncoding.EncodeToString(pub) + "\n"))
+	if err != nil || len(keys) != 1 {
+		t.Fatalf("ParsePublicKeys = %v, %v", keys, err)
+	}
+	if _, err := ParsePublicKeys([]byte("not-a-key\n")); err == nil {
+		t.Error("a malformed key file parsed")
+	}
+	raw := ed25519.Sign(priv, []byte("pkg"))
+	for _, form := range [][]byte{raw, []byte(base64.StdEncoding.EncodeToString(raw) + "\n")} {
+		sig, err := ParseSignature(form)
+		if err != nil || Verify(keys, []byte("pkg"), sig) != nil {
+			t.Errorf("signature %q did not verify: %v", form, err)
+		}
+	}
+	if err := RemoteError(errors.New("call qubesair.Update on q: " + ErrBadSignature.Error())); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("RemoteError lost the sentinel: %v", err)
+	}
+}
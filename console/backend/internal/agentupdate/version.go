@@ -0,0 +1,112 @@
+package agentupdate
+
+import (
+	"strconv"
+	"strings"
+)
+
+// ValidVersion reports whether v is a release version: what
+// scripts/build-agent-deb.sh stamps into both the package and the agent's
+// handshake. "dev", the version of a binary nobody stamped, is not one.
+func ValidVersion(v string) bool {
+	return manifestVersion.MatchString(v)
+}
+
+// CompareVersions orders two Debian versions as dpkg does, returning -1, 0 or
+// +1. It is dpkg's order and not semver's because the versions being compared
+// are package versions: "1.4.0~rc1" must come before "1.4.0", and a console
+// that disagreed with dpkg about which of two packages is newer would enforce
+// a minimum the package manager does not recognise.
+func CompareVersions(a, b string) int {
+	ea, ua, ra := splitVersion(a)
+	eb, ub, rb := splitVersion(b)
+	if ea != eb {
+		if ea < eb {
+			return -1
+		}
+		return 1
+	}
+	if c := compareVersionPart(ua, ub); c != 0 {
+		return c
+	}
+	return compareVersionPart(ra, rb)
+}
+
+// splitVersion splits [epoch:]upstream[-revision]. An epoch that is not a
+// number counts as none, as dpkg would refuse the version outright.
+func splitVersion(v string) (epoch int, upstream, revision string) {
+	if i := strings.IndexByte(v, ':'); i >= 0 {
+		epoch, _ = strconv.Atoi(v[:i])
+		v = v[i+1:]
+	}
+	if i := strings.LastIndexByte(v, '-'); i >= 0 {
+		return epoch, v[:i], v[i+1:]
+	}
+	return epoch, v, ""
+}
+
+// compareVersionPart is dpkg's verrevcmp: alternating runs of non-digits,
+// compared character by character with '~' before everything (even the end
+// of the string) and letters before other symbols, and digits, compared as
+// numbers.
+func compareVersionPart(a, b string) int {
+	for a != "" || b != "" {
+		for (a != "" && !isDigit(a[0])) || (b != "" && !isDigit(b[0])) {
+			ac, bc := versionOrder(a), versionOrder(b)
+			if ac != bc {
+				return sign(ac - bc)
+			}
+			a, b = advance(a), advance(b)
+		}
+		a, b = strings.TrimLeft(a, "0"), strings.TrimLeft(b, "0")
+		firstDiff := 0
+		for a != "" && isDigit(a[0]) && b != "" && isDigit(b[0]) {
+			if firstDiff == 0 {
+				firstDiff = int(a[0]) - int(b[0])
+			}
+			a, b = a[1:], b[1:]
+		}
+		if a != "" && isDigit(a[0]) {
+			return 1
+		}
+		if b != "" && isDigit(b[0]) {
+			return -1
+		}
+		if firstDiff != 0 {
+			return sign(firstDiff)
+		}
+	}
+	return 0
+}
+
+func versionOrder(s string) int {
+	switch {
+	case s == "" || isDigit(s[0]):
+		return 0
+	case s[0] == '~':
+		return -1
+	case ('a' <= s[0] && s[0] <= 'z') || ('A' <= s[0] && s[0] <= 'Z'):
+		return int(s[0])
+	default:
+		return int(s[0]) + 256
+	}
+}
+
+func advance(s string) string {
+	if s == "" {
+		return s
+	}
+	return s[1:]
+}
+
+func isDigit(c byte) bool { return '0' <= c && c <= '9' }
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,47 @@
+package agentupdate
+
+import "testing"
+
+// TestCompareVersionsAgreesWithDpkg — each pair is ordered the way
+// `dpkg --compare-versions a lt b` orders it. A minimum version is only as
+// good as its agreement with the package manager that installs the agents.
+func TestCompareVersionsAgreesWithDpkg(t *testing.T) {
+	for _, c := range [][2]string{
+		{"1.3.9", "1.4.0"},
+		{"1.4.0~rc1", "1.4.0"},
+		{"1.4.0~rc1", "1.4.0~rc2"},
+		{"1.4.0", "1.4.0+1"},
+		{"1.4.0", "1.4.0.1"},
+		{"1.9.0", "1.10.0"},
+		{"1.4.0", "1.4.0a"},
+		{"1.4.0-1", "1.4.0-2"},
+		{"9.9", "1:0.1"},
+		{"0.1.0+12+gabc1234", "0.1.0+13+g0000000"},
+	} {
+		if got := CompareVersions(c[0], c[1]); got != -1 {
+			t.Errorf("CompareVersions(%q, %q) = %d, want -1", c[0], c[1], got)
+		}
+		if got := CompareVersions(c[1], c[0]); got != 1 {
+			t.Errorf("CompareVersions(%q, %q) = %d, want 1", c[1], c[0], got)
+		}
+	}
+	for _, v := range []string{"1.4.0", "1.04.0", "1.4.0~rc1"} {
+		if CompareVersions(v, v) != 0 {
+			t.Errorf("CompareVersions(%q, itself) != 0", v)
+		}
+	}
+	if CompareVersions("1.4", "1.04") != 0 {
+		t.Error("leading zeros are numbers to dpkg, not characters")
+	}
+}
+
+func TestValidVersionRejectsUnstampedBuilds(t *testing.T) {
+	for _, v := range []string{"dev", "", "v1.4.0", "1.4 .0"} {
+		if ValidVersion(v) {
+			t.Errorf("ValidVersion(%q) = true", v)
+		}
+	}
+	if !ValidVersion("0.1.0+12+gabc1234") {
+		t.Error("a build-agent-deb.sh version is not valid")
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"strings"
 
 	"github.com/gin-gonic/gin"
+	"github.com/slchris/qubes-air/console/internal/agentupdate"
 	"github.com/slchris/qubes-air/console/internal/keyring"
 	"gopkg.in/yaml.v3"
 )
@@ -37,9 +38,20 @@ type Config struct {
 type TransportConfig struct {
 	// Enabled turns on the real gRPC transport. Env: QUBES_AIR_TRANSPORT_ENABLED.
 	Enabled bool `yaml:"enabled"`
+	// Kind selects the transport when Enabled: TransportKindGRPC (the default)
+	// or TransportKindSSH, for sites whose only egress is SSH. The fields below
+	// up to SSH configure the gRPC transport. Env: QUBES_AIR_TRANSPORT_KIND.
+	Kind string `yaml:"kind"`
 	// RemoteEndpoint is the remote Remote-Relay host:port to dial outbound
 	// (required when Enabled). Env: QUBES_AIR_TRANSPORT_REMOTE_ENDPOINT.
 	RemoteEndpoint string `yaml:"remote_endpoint"`
+	// FallbackEndpoints are further host:port endpoints for the same remote,
+	// tried in the order listed when RemoteEndpoint cannot be reached.
+	// Env: QUBES_AIR_TRANSPORT_FALLBACK_ENDPOINTS (comma-separated).
+	FallbackEndpoints []string `yaml:"fallback_endpoints"`
+	// Tunnels is how many tunnels to keep open to the remote; calls are spread
+	// across them (default 1). Env: QUBES_AIR_TRANSPORT_TUNNELS.
+	Tunnels int `yaml:"tunnels"`
 	// RelayName / RemoteName identify this relay and the target remote
 	// (aligns with Qubes RemoteVM remote_name). Env: QUBES_AIR_TRANSPORT_RELAY_NAME
 	// / QUBES_AIR_TRANSPORT_REMOTE_NAME.
@@ -61,6 +73,11 @@ type TransportConfig struct {
 	// delivered to, e.g. "vault-cloud"; dom0 policy C (ask) still gates it. Empty
 	// disables reverse calls. Env: QUBES_AIR_TRANSPORT_REVERSE_LOCAL_TARGET.
 	ReverseLocalTarget string `yaml:"reverse_local_target"`
+	// ReversePolicy narrows which reverse calls reach the local dom0 prompt at
+	// all: per remote, allowlisted services, rate, concurrency and size. Left
+	// unconfigured, every service is allowed under default limits, with a
+	// warning at startup.
+	ReversePolicy ReversePolicyConfig `yaml:"reverse_policy"`
 	// VaultCerts, when true, fetches mTLS cert/key/CA from vault-cloud via qrexec
 	// ask (in memory, not from *File paths). VaultCertName/KeyName/CAName are the
 	// credential names. Env: QUBES_AIR_TRANSPORT_VAULT_CERTS (+ _VAULT_CERT_NAME etc).
@@ -69,6 +86,124 @@ type TransportConfig struct {
 	VaultCertName string `yaml:"vault_cert_name"`
 	VaultKeyName  string `yaml:"vault_key_name"`
 	VaultCAName   string `yaml:"vault_ca_name"`
+	// SSH configures the SSH transport (Kind TransportKindSSH).
+	SSH SSHTransportConfig `yaml:"ssh"`
+	// Relays are further transports, by name, each configured like this one
+	// (gRPC or SSH) and always enabled. Zones route through them. YAML only.
+	Relays map[string]TransportConfig `yaml:"relays"`
+	// Zones says how each zone's agents are reached, keyed by zone name or
+	// ID. A zone not listed is dialed directly and calls go over the main
+	// transport, which is how the console behaved before zones could differ.
+	// YAML only.
+	Zones map[string]ZoneTransportConfig `yaml:"zones"`
+	// Chaos injects faults into the links to agents, to see how the monitors
+	// cope with a flaky network. Only a binary built with the "chaos" tag
+	// honours it; any other build logs that it is ignored.
+	Chaos ChaosConfig `yaml:"chaos"`
+}
+
+// ChaosConfig is the fault-injection rule set (internal/transport/chaos).
+type ChaosConfig struct {
+	// Enabled wraps the main transport and every agent dial in the rules.
+	// Env: QUBES_AIR_TRANSPORT_CHAOS_ENABLED.
+	Enabled bool `yaml:"enabled"`
+	// Seed makes probabilistic rules repeatable; 0 picks one from the clock,
+	// which is logged so a run can be replayed. Env: QUBES_AIR_TRANSPORT_CHAOS_SEED.
+	Seed int64 `yaml:"seed"`
+	// Rules are applied in order. YAML only.
+	Rules []ChaosRuleConfig `yaml:"rules"`
+}
+
+// ChaosRuleConfig is one chaos.Rule; see that type for what each field means.
+type ChaosRuleConfig struct {
+	// Fault is latency, drop, reset, truncate or slow.
+	Fault string `yaml:"fault"`
+	// Target and Service are globs on the qube and the qrexec service.
+	Target  string `yaml:"target"`
+	Service string `yaml:"service"`
+	// Probability is the chance a matching call fires the rule (0 = always).
+	Probability float64 `yaml:"probability"`
+	// Count retires the rule after that many firings (0 = never).
+	Count          int `yaml:"count"`
+	LatencyMS      int `yaml:"latency_ms"`
+	AfterBytes     int `yaml:"after_bytes"`
+	BytesPerSecond int `yaml:"bytes_per_second"`
+}
+
+// Transport kinds. TransportKindDirect is a zone route only: the console
+// dials the agents itself, with no transport in between.
+const (
+	TransportKindDirect = "direct"
+	TransportKindGRPC   = "grpc"
+	TransportKindSSH    = "ssh"
+)
+
+// Agent minimum-version policies (OrchestratorConfig.AgentMinVersionPolicy).
+const (
+	AgentMinVersionRefuse = "refuse"
+	AgentMinVersionWarn   = "warn"
+)
+
+// ZoneTransportConfig routes one zone.
+type ZoneTransportConfig struct {
+	// Kind is TransportKindDirect (a route to the zone exists, e.g. our LAN),
+	// TransportKindGRPC (through a relay's gateway forward) or
+	// TransportKindSSH (through a jump host). Required.
+	Kind string `yaml:"kind"`
+	// Relay names the transport in Relays to use; empty means the main one.
+	// Its kind must match Kind.
+	Relay string `yaml:"relay"`
+	// Forward is the gateway forward on the relay's side that reaches the
+	// zone's agents (gRPC only; default "agents"). See the relay's forward
+	// policy: it needs an entry with hosts covering the zone's network.
+	Forward string `yaml:"forward"`
+}
+
+// SSHTransportConfig configures the SSH transport: one outbound connection to
+// Address, authenticated with KeyFile, the host key pinned by KnownHostsFile,
+// each call running Command (default qubesair-ssh-call) with the target and
+// service appended. Like the mTLS fields, it only points at key material.
+type SSHTransportConfig struct {
+	// Address is host:port (port 22 if omitted). Env: QUBES_AIR_TRANSPORT_SSH_ADDRESS.
+	Address string `yaml:"address"`
+	// User is the remote account. Env: QUBES_AIR_TRANSPORT_SSH_USER.
+	User string `yaml:"user"`
+	// KeyFile is the client private key. Env: QUBES_AIR_TRANSPORT_SSH_KEY_FILE.
+	KeyFile string `yaml:"key_file"`
+	// KnownHostsFile pins the remote's host key; there is no trust on first
+	// use. Env: QUBES_AIR_TRANSPORT_SSH_KNOWN_HOSTS_FILE.
+	KnownHostsFile string `yaml:"known_hosts_file"`
+	// Command is the remote helper and its leading arguments.
+	// Env: QUBES_AIR_TRANSPORT_SSH_COMMAND (space-separated).
+	Command []string `yaml:"command"`
+	// KeepAliveSeconds is how often the idle connection is checked (default 30).
+	KeepAliveSeconds int `yaml:"keepalive_seconds"`
+}
+
+// ReversePolicyConfig is the relay's reverse-call policy.
+type ReversePolicyConfig struct {
+	// Default applies to remotes not listed in Remotes. Env:
+	// QUBES_AIR_TRANSPORT_REVERSE_ALLOW (comma-separated services),
+	// _REVERSE_RATE_PER_MINUTE, _REVERSE_MAX_CONCURRENT, _REVERSE_MAX_PAYLOAD_BYTES.
+	Default *ReverseLimitsConfig `yaml:"default"`
+	// Remotes are per-remote limits, keyed by remote name.
+	Remotes map[string]ReverseLimitsConfig `yaml:"remotes"`
+}
+
+// Configured reports whether any reverse policy was written down.
+func (p ReversePolicyConfig) Configured() bool {
+	return p.Default != nil || len(p.Remotes) > 0
+}
+
+// ReverseLimitsConfig is what one remote may ask for. Allow entries are
+// service names, with or without a "+argument"; "*" allows any. Zero limits
+// take the transport's defaults.
+type ReverseLimitsConfig struct {
+	Allow           []string `yaml:"allow"`
+	RatePerMinute   int      `yaml:"rate_per_minute"`
+	Burst           int      `yaml:"burst"`
+	MaxConcurrent   int      `yaml:"max_concurrent"`
+	MaxPayloadBytes int      `yaml:"max_payload_bytes"`
 }
 
 // OrchestratorConfig configures how start/stop actions map to real
@@ -218,6 +353,37 @@ type OrchestratorConfig struct {
 	// guest log line and an audit trail name a specific build.
 	// Env: QUBES_AIR_AGENT_PACKAGE_VERSION.
 	AgentPackageVersion string `yaml:"agent_package_version"`
+	// AgentUpdateKey is the release key, an Ed25519 public key in base64, that
+	// an agent package must be signed with before a running qube installs it
+	// through qubesair.Update. cloud-init pins it on each new qube as
+	// /etc/qubes-air/update.pub, where the console cannot change it later:
+	// the console names a package, the qube checks it against this key. Empty
+	// pins nothing, and those qubes refuse every update.
+	// Env: QUBES_AIR_AGENT_UPDATE_KEY.
+	AgentUpdateKey string `yaml:"agent_update_key"`
+	// AgentManifestURL is a signed release manifest to take the agent package
+	// from instead of agent_package_url and agent_package_sha256: the release
+	// key (agent_update_key) signs the manifest, which names each
+	// architecture's package and digest, and both the console and the booting
+	// guest check that signature before anything is installed. With it, what
+	// runs on a new qube is decided by whoever holds the release key rather
+	// than by whoever can edit this file.
+	// Env: QUBES_AIR_AGENT_MANIFEST_URL.
+	AgentManifestURL string `yaml:"agent_manifest_url"`
+	// AgentMinVersion is the oldest agent build this console trusts with
+	// sensitive operations, compared as dpkg compares package versions. An
+	// agent that reports an older build, or none it can compare ("dev"), is
+	// flagged in the version inventory, and AgentMinVersionPolicy decides what
+	// else happens to it. Empty sets no minimum.
+	// Env: QUBES_AIR_AGENT_MIN_VERSION.
+	AgentMinVersion string `yaml:"agent_min_version"`
+	// AgentMinVersionPolicy is what an agent below AgentMinVersion is refused:
+	// "refuse" (the default) withholds its data-disk key, so /data stays locked
+	// until the agent is updated; "warn" only flags it. warn exists for the
+	// day a minimum is raised — to see who is outdated and update them before
+	// anything is refused.
+	// Env: QUBES_AIR_AGENT_MIN_VERSION_POLICY.
+	AgentMinVersionPolicy string `yaml:"agent_min_version_policy"`
 	// AgentProbeIntervalSeconds is how often every running qube's agent is
 	// re-probed (default 60). Zero or negative DISABLES the periodic reconciler,
 	// which leaves agent health frozen at whatever the last probe found.
@@ -623,6 +789,18 @@ func (c *Config) loadFromEnv() {
 	if v := os.Getenv("QUBES_AIR_AGENT_PACKAGE_VERSION"); v != "" {
 		c.Orchestrator.AgentPackageVersion = v
 	}
+	if v := os.Getenv("QUBES_AIR_AGENT_UPDATE_KEY"); v != "" {
+		c.Orchestrator.AgentUpdateKey = v
+	}
+	if v := os.Getenv("QUBES_AIR_AGENT_MANIFEST_URL"); v != "" {
+		c.Orchestrator.AgentManifestURL = v
+	}
+	if v := os.Getenv("QUBES_AIR_AGENT_MIN_VERSION"); v != "" {
+		c.Orchestrator.AgentMinVersion = v
+	}
+	if v := os.Getenv("QUBES_AIR_AGENT_MIN_VERSION_POLICY"); v != "" {
+		c.Orchestrator.AgentMinVersionPolicy = v
+	}
 	// Parsed with Atoi and applied only on success, matching the transport
 	// timings below. A typo therefore keeps the default rather than silently
 	// resolving to 0, which for the interval would disable probing outright.
@@ -660,9 +838,43 @@ func (c *Config) loadFromEnv() {
 	if enabled := os.Getenv("QUBES_AIR_TRANSPORT_ENABLED"); enabled != "" {
 		c.Transport.Enabled = strings.ToLower(enabled) == "true"
 	}
+	if v := os.Getenv("QUBES_AIR_TRANSPORT_CHAOS_ENABLED"); v != "" {
+		c.Transport.Chaos.Enabled = strings.ToLower(v) == "true"
+	}
+	if v := os.Getenv("QUBES_AIR_TRANSPORT_CHAOS_SEED"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			c.Transport.Chaos.Seed = n
+		}
+	}
+	if v := os.Getenv("QUBES_AIR_TRANSPORT_KIND"); v != "" {
+		c.Transport.Kind = strings.ToLower(v)
+	}
+	if v := os.Getenv("QUBES_AIR_TRANSPORT_SSH_ADDRESS"); v != "" {
+		c.Transport.SSH.Address = v
+	}
+	if v := os.Getenv("QUBES_AIR_TRANSPORT_SSH_USER"); v != "" {
+		c.Transport.SSH.User = v
+	}
+	if v := os.Getenv("QUBES_AIR_TRANSPORT_SSH_KEY_FILE"); v != "" {
+		c.Transport.SSH.KeyFile = v
+	}
+	if v := os.Getenv("QUBES_AIR_TRANSPORT_SSH_KNOWN_HOSTS_FILE"); v != "" {
+		c.Transport.SSH.KnownHostsFile = v
+	}
+	if v := os.Getenv("QUBES_AIR_TRANSPORT_SSH_COMMAND"); v != "" {
+		c.Transport.SSH.Command = strings.Fields(v)
+	}
 	if v := os.Getenv("QUBES_AIR_TRANSPORT_REMOTE_ENDPOINT"); v != "" {
 		c.Transport.RemoteEndpoint = v
 	}
+	if v := os.Getenv("QUBES_AIR_TRANSPORT_FALLBACK_ENDPOINTS"); v != "" {
+		c.Transport.FallbackEndpoints = strings.Split(v, ",")
+	}
+	if v := os.Getenv("QUBES_AIR_TRANSPORT_TUNNELS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			c.Transport.Tunnels = n
+		}
+	}
 	if v := os.Getenv("QUBES_AIR_TRANSPORT_RELAY_NAME"); v != "" {
 		c.Transport.RelayName = v
 	}
@@ -696,6 +908,7 @@ func (c *Config) loadFromEnv() {
 	if v := os.Getenv("QUBES_AIR_TRANSPORT_REVERSE_LOCAL_TARGET"); v != "" {
 		c.Transport.ReverseLocalTarget = v
 	}
+	c.loadReversePolicyFromEnv()
 	if v := os.Getenv("QUBES_AIR_TRANSPORT_VAULT_CERTS"); v != "" {
 		c.Transport.VaultCerts = strings.ToLower(v) == "true"
 	}
@@ -713,6 +926,35 @@ func (c *Config) loadFromEnv() {
 	}
 }
 
+// loadReversePolicyFromEnv overrides the default reverse limits from the
+// environment, the only configuration a relay without a config file has.
+func (c *Config) loadReversePolicyFromEnv() {
+	def := func() *ReverseLimitsConfig {
+		if c.Transport.ReversePolicy.Default == nil {
+			c.Transport.ReversePolicy.Default = &ReverseLimitsConfig{}
+		}
+		return c.Transport.ReversePolicy.Default
+	}
+	if v := os.Getenv("QUBES_AIR_TRANSPORT_REVERSE_ALLOW"); v != "" {
+		def().Allow = strings.Split(v, ",")
+	}
+	if v := os.Getenv("QUBES_AIR_TRANSPORT_REVERSE_RATE_PER_MINUTE"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			def().RatePerMinute = n
+		}
+	}
+	if v := os.Getenv("QUBES_AIR_TRANSPORT_REVERSE_MAX_CONCURRENT"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			def().MaxConcurrent = n
+		}
+	}
+	if v := os.Getenv("QUBES_AIR_TRANSPORT_REVERSE_MAX_PAYLOAD_BYTES"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			def().MaxPayloadBytes = n
+		}
+	}
+}
+
 // Validate checks if the configuration is valid.
 // Same shape as loadFromEnv: one check per field, no interaction between them.
 //
@@ -759,28 +1001,138 @@ func (c *Config) Validate() error {
 	if err := validateAgentPackage(c.Orchestrator.AgentPackageURL, c.Orchestrator.AgentPackageSHA256); err != nil {
 		return err
 	}
+	// A malformed key would be written to every new qube, which would then
+	// refuse every update for the rest of its life.
+	if c.Orchestrator.AgentUpdateKey != "" {
+		if _, err := agentupdate.ParsePublicKey(c.Orchestrator.AgentUpdateKey); err != nil {
+			return fmt.Errorf("orchestrator.agent_update_key: %w", err)
+		}
+	}
+	if err := validateAgentManifest(c.Orchestrator); err != nil {
+		return err
+	}
+	// A minimum that does not parse as a version would compare as something,
+	// and which agents that locks out would be an accident of dpkg's ordering.
+	if v := c.Orchestrator.AgentMinVersion; v != "" && !agentupdate.ValidVersion(v) {
+		return fmt.Errorf("orchestrator.agent_min_version must be a package version like 1.4.0, got %q", v)
+	}
+	switch c.Orchestrator.AgentMinVersionPolicy {
+	case "", AgentMinVersionWarn, AgentMinVersionRefuse:
+	default:
+		return fmt.Errorf("orchestrator.agent_min_version_policy must be %q or %q, got %q",
+			AgentMinVersionRefuse, AgentMinVersionWarn, c.Orchestrator.AgentMinVersionPolicy)
+	}
+
+	if err := c.Transport.validate("transport", c.Transport.Enabled); err != nil {
+		return err
+	}
+	if err := c.Transport.validateZones(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// validate checks one transport's settings. field names it in errors:
+// "transport" for the main one, "transport.relays.<name>" for a relay. A relay
+// has no enabled flag of its own — listing it is enabling it.
+func (t TransportConfig) validate(field string, enabled bool) error {
+	// An SSH transport needs somewhere to connect, a key, and a pinned host
+	// key; without the last it would have to trust whatever answered.
+	if enabled && t.Kind == TransportKindSSH {
+		ssh := t.SSH
+		if ssh.Address == "" || ssh.User == "" || ssh.KeyFile == "" {
+			return fmt.Errorf("%s.kind is ssh but %s.ssh.address/user/key_file are not set", field, field)
+		}
+		if ssh.KnownHostsFile == "" {
+			return fmt.Errorf("%s.kind is ssh but %s.ssh.known_hosts_file is not set (host keys are pinned, never trusted on first use)", field, field)
+		}
+	}
+	if t.Kind != "" && t.Kind != TransportKindGRPC && t.Kind != TransportKindSSH {
+		return fmt.Errorf("invalid %s.kind %q (want %q or %q)", field, t.Kind, TransportKindGRPC, TransportKindSSH)
+	}
 
 	// If the gRPC transport is enabled, the remote endpoint and mTLS material
 	// are mandatory — otherwise the outbound tunnel would fail at runtime.
-	if c.Transport.Enabled {
-		if c.Transport.RemoteEndpoint == "" {
-			return fmt.Errorf("transport.enabled is true but transport.remote_endpoint is not set")
+	if enabled && t.Kind != TransportKindSSH {
+		if t.RemoteEndpoint == "" {
+			return fmt.Errorf("%s is enabled but %s.remote_endpoint is not set", field, field)
 		}
 		// mTLS material is required, from vault (names) or from files.
-		if c.Transport.VaultCerts {
-			if c.Transport.VaultCertName == "" || c.Transport.VaultKeyName == "" {
-				return fmt.Errorf("transport.vault_certs is true but transport.vault_cert_name/vault_key_name are not set")
+		if t.VaultCerts {
+			if t.VaultCertName == "" || t.VaultKeyName == "" {
+				return fmt.Errorf("%s.vault_certs is true but %s.vault_cert_name/vault_key_name are not set", field, field)
 			}
-		} else if c.Transport.CertFile == "" || c.Transport.KeyFile == "" {
-			return fmt.Errorf("transport.enabled is true but transport.cert_file/key_file (mTLS) are not set (or set transport.vault_certs)")
+		} else if t.CertFile == "" || t.KeyFile == "" {
+			return fmt.Errorf("%s is enabled but %s.cert_file/key_file (mTLS) are not set (or set %s.vault_certs)", field, field, field)
 		}
-		if c.Transport.ReconnectMinSeconds > 0 && c.Transport.ReconnectMaxSeconds > 0 &&
-			c.Transport.ReconnectMinSeconds > c.Transport.ReconnectMaxSeconds {
-			return fmt.Errorf("transport.reconnect_min_seconds (%d) must not exceed reconnect_max_seconds (%d)",
-				c.Transport.ReconnectMinSeconds, c.Transport.ReconnectMaxSeconds)
+		if t.ReconnectMinSeconds > 0 && t.ReconnectMaxSeconds > 0 &&
+			t.ReconnectMinSeconds > t.ReconnectMaxSeconds {
+			return fmt.Errorf("%s.reconnect_min_seconds (%d) must not exceed reconnect_max_seconds (%d)",
+				field, t.ReconnectMinSeconds, t.ReconnectMaxSeconds)
 		}
 	}
+	return nil
+}
 
+// validateZones checks the relays and the zone routes that use them.
+//
+// A zone routed through a relay that does not exist, or through one of the
+// wrong kind, is refused at startup: at runtime it would only show up as every
+// qube in that zone reading unreachable, which looks like a zone outage rather
+// than a typo.
+func (t TransportConfig) validateZones() error {
+	for name, r := range t.Relays {
+		field := "transport.relays." + name
+		if name == "" {
+			return fmt.Errorf("transport.relays has an entry with no name")
+		}
+		if len(r.Relays) > 0 || len(r.Zones) > 0 {
+			return fmt.Errorf("%s may not list relays or zones of its own", field)
+		}
+		// Chaos wraps the dials and the main transport as a whole; rules on a
+		// relay would be silently ignored, so they are refused instead. Target
+		// a relay's zones with rule targets.
+		if r.Chaos.Enabled || len(r.Chaos.Rules) > 0 {
+			return fmt.Errorf("%s may not configure chaos (use transport.chaos with a target)", field)
+		}
+		if err := r.validate(field, true); err != nil {
+			return err
+		}
+	}
+	for zone, z := range t.Zones {
+		field := "transport.zones." + zone
+		switch z.Kind {
+		case TransportKindDirect:
+			if z.Relay != "" {
+				return fmt.Errorf("%s is direct but names relay %q", field, z.Relay)
+			}
+			continue
+		case TransportKindGRPC, TransportKindSSH:
+		default:
+			return fmt.Errorf("invalid %s.kind %q (want %q, %q or %q)",
+				field, z.Kind, TransportKindDirect, TransportKindGRPC, TransportKindSSH)
+		}
+		// No relay named means the main transport, which must then be on.
+		relay, enabled := t, t.Enabled
+		if z.Relay != "" {
+			var ok bool
+			if relay, ok = t.Relays[z.Relay]; !ok {
+				return fmt.Errorf("%s names relay %q, which is not in transport.relays", field, z.Relay)
+			}
+			enabled = true
+		}
+		if !enabled {
+			return fmt.Errorf("%s routes through the main transport, which is not enabled", field)
+		}
+		kind := relay.Kind
+		if kind == "" {
+			kind = TransportKindGRPC
+		}
+		if kind != z.Kind {
+			return fmt.Errorf("%s is %s but its transport is %s", field, z.Kind, kind)
+		}
+	}
 	return nil
 }
 
@@ -788,6 +1140,30 @@ func (c *Config) Validate() error {
 // accepts in the guest's verification step.
 var sha256Hex = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
 
+// validateAgentManifest checks a release manifest URL against the settings it
+// replaces and the key it needs. The manifest itself is fetched and checked
+// later, when there is a network to fetch it over.
+func validateAgentManifest(o OrchestratorConfig) error {
+	url := o.AgentManifestURL
+	switch {
+	case url == "":
+		return nil
+	case o.AgentPackageURL != "" || o.AgentPackageSHA256 != "":
+		// Two sources for one package would leave which one a qube got to
+		// the order of checks in code nobody reads while provisioning.
+		return fmt.Errorf("orchestrator.agent_manifest_url replaces agent_package_url and agent_package_sha256; set one or the other")
+	case o.AgentUpdateKey == "":
+		return fmt.Errorf("orchestrator.agent_manifest_url needs orchestrator.agent_update_key to check it with")
+	case !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://"):
+		return fmt.Errorf("orchestrator.agent_manifest_url must be an http(s) URL, got %q", url)
+	case strings.ContainsAny(url, "'\"`\\ \t\r\n"):
+		return fmt.Errorf("orchestrator.agent_manifest_url must not contain quotes or whitespace, got %q", url)
+	case strings.HasSuffix(url, "/"):
+		return fmt.Errorf("orchestrator.agent_manifest_url must name a file, got %q", url)
+	}
+	return nil
+}
+
 // validateAgentPackage checks the URL/digest pair before the console can start.
 //
 // Both halves are checked here rather than only at render time because a
@@ -85,6 +85,90 @@ func TestConfig_Validate(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "ssh transport without pinned host key",
+			modify: func(c *Config) {
+				c.Transport.Enabled = true
+				c.Transport.Kind = TransportKindSSH
+				c.Transport.SSH = SSHTransportConfig{Address: "203.0.113.7", User: "relay", KeyFile: "/k"}
+			},
+			wantErr: true,
+		},
+		{
+			name: "ssh transport needs no mTLS material",
+			modify: func(c *Config) {
+				c.Transport.Enabled = true
+				c.Transport.Kind = TransportKindSSH
+				c.Transport.SSH = SSHTransportConfig{
+					Address: "203.0.113.7", User: "relay", KeyFile: "/k", KnownHostsFile: "/known_hosts",
+				}
+			},
+			wantErr: false,
+		},
+		{
+			name: "unknown transport kind",
+			modify: func(c *Config) {
+				c.Transport.Kind = "carrier-pigeon"
+			},
+			wantErr: true,
+		},
+		{
+			name: "zones routed direct and through an ssh relay",
+			modify: func(c *Config) {
+				c.Transport.Relays = map[string]TransportConfig{"branch": {
+					Kind: TransportKindSSH,
+					SSH: SSHTransportConfig{
+						Address: "203.0.113.7", User: "relay", KeyFile: "/k", KnownHostsFile: "/known_hosts",
+					},
+				}}
+				c.Transport.Zones = map[string]ZoneTransportConfig{
+					"lan":    {Kind: TransportKindDirect},
+					"branch": {Kind: TransportKindSSH, Relay: "branch"},
+				}
+			},
+			wantErr: false,
+		},
+		{
+			name: "zone routed through an unknown relay",
+			modify: func(c *Config) {
+				c.Transport.Zones = map[string]ZoneTransportConfig{"nat": {Kind: TransportKindGRPC, Relay: "missing"}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "zone kind does not match its relay",
+			modify: func(c *Config) {
+				c.Transport.Relays = map[string]TransportConfig{"nat": {
+					RemoteEndpoint: "203.0.113.9:8443", CertFile: "/c", KeyFile: "/k",
+				}}
+				c.Transport.Zones = map[string]ZoneTransportConfig{"nat": {Kind: TransportKindSSH, Relay: "nat"}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "zone routed through the disabled main transport",
+			modify: func(c *Config) {
+				c.Transport.Zones = map[string]ZoneTransportConfig{"nat": {Kind: TransportKindGRPC}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "relay missing its mTLS material",
+			modify: func(c *Config) {
+				c.Transport.Relays = map[string]TransportConfig{"nat": {RemoteEndpoint: "203.0.113.9:8443"}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "chaos on a relay",
+			modify: func(c *Config) {
+				c.Transport.Relays = map[string]TransportConfig{"nat": {
+					RemoteEndpoint: "203.0.113.9:8443", CertFile: "/c", KeyFile: "/k",
+					Chaos: ChaosConfig{Enabled: true},
+				}}
+			},
+			wantErr: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -344,6 +428,59 @@ func TestConfig_LoadFromEnvAgentPackage(t *testing.T) {
 	assert.Equal(t, "0.1.0", cfg.Orchestrator.AgentPackageVersion)
 }
 
+// TestConfig_AgentUpdateKey — a key that does not parse would be pinned on
+// every new qube, each of which would then refuse every update it is sent.
+func TestConfig_AgentUpdateKey(t *testing.T) {
+	t.Setenv("QUBES_AIR_AGENT_UPDATE_KEY", "11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo=")
+	cfg, err := Load("")
+	require.NoError(t, err)
+	assert.Equal(t, "11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo=", cfg.Orchestrator.AgentUpdateKey)
+
+	cfg.Orchestrator.AgentUpdateKey = "not-a-key"
+	assert.Error(t, cfg.Validate())
+}
+
+// TestConfig_AgentManifestURL — a manifest is only worth configuring with the
+// key that checks it, and never alongside the unsigned URL/digest pair it
+// replaces.
+func TestConfig_AgentManifestURL(t *testing.T) {
+	t.Setenv("QUBES_AIR_AGENT_MANIFEST_URL", "https://artifacts.example/agent/release-manifest")
+	t.Setenv("QUBES_AIR_AGENT_UPDATE_KEY", "11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo=")
+	cfg, err := Load("")
+	require.NoError(t, err)
+	assert.Equal(t, "https://artifacts.example/agent/release-manifest", cfg.Orchestrator.AgentManifestURL)
+
+	for name, mutate := range map[string]func(*OrchestratorConfig){
+		"no key":        func(o *OrchestratorConfig) { o.AgentUpdateKey = "" },
+		"also a URL":    func(o *OrchestratorConfig) { o.AgentPackageURL = "https://artifacts.example/agent.deb" },
+		"not http":      func(o *OrchestratorConfig) { o.AgentManifestURL = "file:///srv/release-manifest" },
+		"a directory":   func(o *OrchestratorConfig) { o.AgentManifestURL = "https://artifacts.example/agent/" },
+		"shell quoting": func(o *OrchestratorConfig) { o.AgentManifestURL = "https://artifacts.example/x'y" },
+	} {
+		bad := *cfg
+		mutate(&bad.Orchestrator)
+		assert.Error(t, bad.Validate(), name)
+	}
+}
+
+// TestConfig_AgentMinVersion — the minimum is compared as a package version,
+// so one that is not a version would lock out agents by accident of ordering.
+func TestConfig_AgentMinVersion(t *testing.T) {
+	t.Setenv("QUBES_AIR_AGENT_MIN_VERSION", "1.4.0")
+	t.Setenv("QUBES_AIR_AGENT_MIN_VERSION_POLICY", "warn")
+	cfg, err := Load("")
+	require.NoError(t, err)
+	assert.Equal(t, "1.4.0", cfg.Orchestrator.AgentMinVersion)
+	assert.Equal(t, AgentMinVersionWarn, cfg.Orchestrator.AgentMinVersionPolicy)
+
+	bad := *cfg
+	bad.Orchestrator.AgentMinVersion = "v1.4"
+	assert.Error(t, bad.Validate())
+	bad = *cfg
+	bad.Orchestrator.AgentMinVersionPolicy = "block"
+	assert.Error(t, bad.Validate())
+}
+
 // TestConfig_AgentProbeDefaults — probing must be on out of the box. A console
 // that only reports agent health when someone remembered to configure it is a
 // console that reports nothing on the day an agent dies.
@@ -386,3 +523,35 @@ func TestConfig_AgentProbeEnvGarbageKeepsTheDefault(t *testing.T) {
 	assert.Equal(t, DefaultConfig().Orchestrator.AgentProbeIntervalSeconds,
 		cfg.Orchestrator.AgentProbeIntervalSeconds)
 }
+
+func TestConfig_LoadReversePolicy(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "config-*.yaml")
+	require.NoError(t, err)
+	defer os.Remove(tmpFile.Name())
+	_, err = tmpFile.WriteString(`
+transport:
+  reverse_policy:
+    remotes:
+      remote-dev:
+        allow: ["qubesair.GetCredential"]
+        max_concurrent: 2
+`)
+	require.NoError(t, err)
+	tmpFile.Close()
+
+	cfg, err := Load(tmpFile.Name())
+	require.NoError(t, err)
+	rp := cfg.Transport.ReversePolicy
+	assert.True(t, rp.Configured())
+	assert.Nil(t, rp.Default)
+	assert.Equal(t, []string{"qubesair.GetCredential"}, rp.Remotes["remote-dev"].Allow)
+	assert.Equal(t, 2, rp.Remotes["remote-dev"].MaxConcurrent)
+
+	t.Setenv("QUBES_AIR_TRANSPORT_REVERSE_ALLOW", "qubesair.GetCredential,qubesair.Notify")
+	t.Setenv("QUBES_AIR_TRANSPORT_REVERSE_RATE_PER_MINUTE", "6")
+	cfg, err = Load("")
+	require.NoError(t, err)
+	require.NotNil(t, cfg.Transport.ReversePolicy.Default)
+	assert.Equal(t, []string{"qubesair.GetCredential", "qubesair.Notify"}, cfg.Transport.ReversePolicy.Default.Allow)
+	assert.Equal(t, 6, cfg.Transport.ReversePolicy.Default.RatePerMinute)
+}
@@ -122,6 +122,10 @@ func (d *DB) migrate() error {
 		{"agent_last_probed_at", "DATETIME"},
 		{"agent_last_healthy_at", "DATETIME"},
 		{"agent_last_error", "TEXT NOT NULL DEFAULT ''"},
+		// JSON of models.AgentInfo; empty until the agent has answered once.
+		{"agent_info", "TEXT NOT NULL DEFAULT ''"},
+		// JSON of models.AgentStatus; empty until a status report has arrived.
+		{"agent_status", "TEXT NOT NULL DEFAULT ''"},
 	} {
 		if err := d.addColumnIfMissing("qubes", c.column, c.definition); err != nil {
 			return err
@@ -217,6 +221,8 @@ CREATE TABLE IF NOT EXISTS qubes (
 	agent_last_probed_at DATETIME,
 	agent_last_healthy_at DATETIME,
 	agent_last_error TEXT NOT NULL DEFAULT '',
+	agent_info TEXT NOT NULL DEFAULT '',
+	agent_status TEXT NOT NULL DEFAULT '',
 	created_at DATETIME NOT NULL,
 	updated_at DATETIME NOT NULL
 )`
@@ -0,0 +1,248 @@
+// Package deadman is the agent's dead man's switch: it locks the data disk
+// when the console stops calling, or when the console says this agent's
+// certificate has been revoked, and keeps it locked until the console pushes
+// the key again.
+//
+// Without it a remote seized while running keeps /data unlocked for as long as
+// it keeps power. Revoking the agent's certificate cuts the console off, and
+// cuts off nothing else: the disk stays open under whoever now holds the
+// machine. The switch turns the console's absence into the signal. It is
+// optional and off by default (agent.yaml's dead_man section), because a
+// console outage longer than the limit locks every armed remote, and only an
+// operator knows whether that is the trade they want.
+//
+// What counts as a check-in is any call made with a console certificate
+// ("console-*"), Ping included, seen by the transport's CallGate. The console's
+// health monitor pings every running qube each minute, so a silence limit of
+// hours is many missed probes, not one. Calls from relays do not count: an
+// agent reached only through a relay (-dial-out) hears from the console
+// through none of them, and must not enable the silence trigger.
+//
+// Tripped, the switch refuses qubesair.UnlockData from anyone but the console,
+// and a console unlock re-arms it. That rules out an unlock from a relay or a
+// certificate the attacker kept; it cannot rule out root on the machine
+// itself, which could run the helper's unlock directly — but root on a seized
+// machine has no key to give it, which is the point.
+//
+// State lives in memory: an agent restart starts the silence count again and
+// forgets a trip. A restart does not reopen the disk, though — the lock
+// already happened, and opening needs the key.
+package deadman
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/slchris/qubes-air/console/internal/agentstatus"
+	transportgrpc "github.com/slchris/qubes-air/console/internal/transport/grpc"
+)
+
+// Service is the agent builtin that reports the switch and takes the
+// console's revocation notice.
+const Service = "qubesair.DeadMan"
+
+// unlockService is what a tripped switch refuses to anyone but the console.
+const unlockService = "qubesair.UnlockData"
+
+// consoleRole is the certificate role whose calls are check-ins.
+const consoleRole = "console"
+
+// checkInterval is how often the silence limit is checked, and a lock that
+// failed retried. The limit is in hours; a minute late is nothing.
+const checkInterval = time.Minute
+
+// lockTimeout bounds one attempt at the lock.
+const lockTimeout = time.Minute
+
+// ErrTripped is the refusal of an unlock while the switch is tripped.
+var ErrTripped = errors.New("the dead man's switch has locked the data disk; only the console can unlock it")
+
+// Policy is when the switch trips.
+type Policy struct {
+	// Silence trips it when the console has not called for this long; 0
+	// never.
+	Silence time.Duration
+	// OnRevocation trips it when the console says the certificate is revoked.
+	OnRevocation bool
+}
+
+// Enabled is whether either trigger is configured.
+func (p Policy) Enabled() bool { return p.Silence > 0 || p.OnRevocation }
+
+// Request is the qubesair.DeadMan request. Empty asks for the state.
+type Request struct {
+	// Revoked says the console refused this agent's certificate.
+	Revoked bool `json:"revoked,omitempty"`
+}
+
+// Switch is one agent's dead man's switch.
+type Switch struct {
+	policy func() Policy
+	lock   func(context.Context) error
+
+	// now and caller are the clock and the call's certificate name; tests
+	// replace them.
+	now    func() time.Time
+	caller func(context.Context) string
+
+	mu        sync.Mutex
+	last      time.Time
+	tripped   bool
+	trippedAt time.Time
+	reason    string
+	locked    bool
+	lockErr   string
+}
+
+// New builds a switch. policy is read on every check, so a reloaded
+// configuration applies to the next one. lock closes the data disk and
+// returns an error unless it is closed when it returns.
+func New(policy func() Policy, lock func(context.Context) error) *Switch {
+	return &Switch{
+		policy: policy,
+		lock:   lock,
+		now:    time.Now,
+		caller: transportgrpc.CallerCommonName,
+		last:   time.Now(),
+	}
+}
+
+// Admit is the transport's CallGate: every call passes through it. A console
+// call is a check-in; an unlock is refused while tripped unless the console
+// makes it, and the console making it re-arms the switch.
+func (s *Switch) Admit(peerCN, service string) error {
+	console := transportgrpc.CallerRole(peerCN) == consoleRole
+	name, _, _ := strings.Cut(service, "+")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if console {
+		s.last = s.now()
+	}
+	if name != unlockService || !s.tripped {
+		return nil
+	}
+	if !console {
+		return ErrTripped
+	}
+	log.Printf("dead man's switch: re-armed by %s pushing the key again (tripped %s: %s)",
+		peerCN, s.trippedAt.UTC().Format(time.RFC3339), s.reason)
+	s.tripped, s.locked, s.reason, s.lockErr = false, false, "", ""
+	return nil
+}
+
+// Run checks the silence limit and retries a failed lock until ctx ends.
+func (s *Switch) Run(ctx context.Context) {
+	t := time.NewTicker(checkInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			s.check(ctx)
+		}
+	}
+}
+
+// check is one tick of Run.
+func (s *Switch) check(ctx context.Context) {
+	pol := s.policy()
+	s.mu.Lock()
+	if silent := s.now().Sub(s.last); !s.tripped && pol.Silence > 0 && silent > pol.Silence {
+		s.trip(fmt.Sprintf("no call from the console for %s", silent.Round(time.Minute)))
+	}
+	pending := s.tripped && !s.locked
+	s.mu.Unlock()
+	if pending {
+		s.lockNow(ctx)
+	}
+}
+
+// trip records why the switch fired. s.mu is held.
+func (s *Switch) trip(reason string) {
+	s.tripped, s.trippedAt, s.reason = true, s.now(), reason
+	log.Printf("dead man's switch: tripped: %s; locking the data disk", reason)
+}
+
+// lockNow makes one attempt at the lock and records how it went. A lock
+// refused — /data busy, the helper down — is retried on the next tick: the
+// switch does not give up on a disk it has decided to close.
+func (s *Switch) lockNow(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, lockTimeout)
+	defer cancel()
+	err := s.lock(ctx)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.tripped {
+		// Re-armed while the lock ran; the console's unlock wins.
+		return
+	}
+	if err != nil {
+		s.lockErr = err.Error()
+		log.Printf("dead man's switch: the data disk is still open: %v (retrying)", err)
+		return
+	}
+	s.locked, s.lockErr = true, ""
+	log.Printf("dead man's switch: data disk locked")
+}
+
+// State is the switch as qubesair.Status reports it.
+func (s *Switch) State() *agentstatus.DeadMan {
+	pol := s.policy()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := &agentstatus.DeadMan{
+		Enabled:        pol.Enabled(),
+		SilenceSeconds: int64(pol.Silence / time.Second),
+		OnRevocation:   pol.OnRevocation,
+		LastCheckIn:    s.last.UTC(),
+		Tripped:        s.tripped,
+		Reason:         s.reason,
+		LockError:      s.lockErr,
+	}
+	if s.tripped {
+		at := s.trippedAt.UTC()
+		st.TrippedAt = &at
+	}
+	return st
+}
+
+// Builtin is qubesair.DeadMan. It answers with State; a revocation notice
+// from the console trips the switch first, when the policy says it should.
+// The notice is heeded from the console only: a relay that could say
+// "revoked" could lock any disk it can reach.
+func (s *Switch) Builtin(ctx context.Context, _ string, in []byte) ([]byte, error) {
+	var req Request
+	if len(bytes.TrimSpace(in)) > 0 {
+		if err := json.Unmarshal(in, &req); err != nil {
+			return nil, fmt.Errorf("%s: bad request: %w", Service, err)
+		}
+	}
+	if req.Revoked {
+		caller := s.caller(ctx)
+		switch {
+		case transportgrpc.CallerRole(caller) != consoleRole:
+			return nil, fmt.Errorf("%s: only the console may report a revocation, not %q", Service, caller)
+		case s.policy().OnRevocation:
+			s.mu.Lock()
+			fresh := !s.tripped
+			if fresh {
+				s.trip("the console reports this agent's certificate revoked")
+			}
+			s.mu.Unlock()
+			if fresh {
+				s.lockNow(ctx)
+			}
+		default:
+			log.Printf("dead man's switch: the console reports this agent's certificate revoked; on_revocation is off")
+		}
+	}
+	return json.Marshal(s.State())
+}
@@ -0,0 +1,134 @@
+package deadman
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+// fakeDisk is the lock: it fails while busy and counts attempts.
+type fakeDisk struct {
+	busy     bool
+	attempts int
+	locked   bool
+}
+
+func (d *fakeDisk) lock(context.Context) error {
+	d.attempts++
+	if d.busy {
+		return errors.New("umount: /data: target is busy.")
+	}
+	d.locked = true
+	return nil
+}
+
+// newSwitch is a switch on a clock the test moves.
+func newSwitch(pol Policy, disk *fakeDisk) (*Switch, *time.Time) {
+	clock := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	s := New(func() Policy { return pol }, disk.lock)
+	s.now = func() time.Time { return clock }
+	s.last = clock
+	return s, &clock
+}
+
+// TestSilenceTripsAndOnlyTheConsoleCounts — relay calls do not keep the switch
+// from firing, console calls do, and a lock refused is retried until it takes.
+func TestSilenceTripsAndOnlyTheConsoleCounts(t *testing.T) {
+	disk := &fakeDisk{busy: true}
+	s, clock := newSwitch(Policy{Silence: 2 * time.Hour}, disk)
+	ctx := context.Background()
+
+	*clock = clock.Add(90 * time.Minute)
+	if err := s.Admit("console-probe", "qubesair.Ping"); err != nil {
+		t.Fatal(err)
+	}
+	*clock = clock.Add(90 * time.Minute)
+	s.check(ctx)
+	if s.State().Tripped {
+		t.Fatal("tripped 90 minutes after a console call, with a 2h limit")
+	}
+
+	_ = s.Admit("relay-work", "qubesair.Ping")
+	*clock = clock.Add(time.Hour)
+	s.check(ctx)
+	st := s.State()
+	if !st.Tripped || st.TrippedAt == nil || st.LockError == "" {
+		t.Fatalf("state = %+v: want tripped, with the busy lock said", st)
+	}
+	if !st.LastCheckIn.Equal(clock.Add(-time.Hour - 90*time.Minute)) {
+		t.Errorf("last check-in = %s: the relay's call counted", st.LastCheckIn)
+	}
+
+	disk.busy = false
+	s.check(ctx)
+	if !disk.locked || s.State().LockError != "" {
+		t.Errorf("the lock was not retried: %+v", s.State())
+	}
+	s.check(ctx)
+	if disk.attempts != 2 {
+		t.Errorf("lock attempts = %d: a disk already locked was locked again", disk.attempts)
+	}
+}
+
+// TestTrippedRefusesUnlockUntilTheConsoleRearms — while tripped, only the
+// console may push the key, and pushing it re-arms the switch.
+func TestTrippedRefusesUnlockUntilTheConsoleRearms(t *testing.T) {
+	s, clock := newSwitch(Policy{Silence: time.Hour}, &fakeDisk{})
+	*clock = clock.Add(2 * time.Hour)
+	s.check(context.Background())
+
+	if err := s.Admit("relay-work", "qubesair.UnlockData"); !errors.Is(err, ErrTripped) {
+		t.Errorf("relay unlock = %v, want ErrTripped", err)
+	}
+	if err := s.Admit("relay-work", "qubesair.Ping"); err != nil {
+		t.Errorf("a tripped switch refused something other than unlock: %v", err)
+	}
+	if err := s.Admit("console-unlock", "qubesair.UnlockData"); err != nil {
+		t.Fatalf("console unlock = %v", err)
+	}
+	if st := s.State(); st.Tripped || st.Reason != "" || !st.LastCheckIn.Equal(*clock) {
+		t.Errorf("state after the console's unlock = %+v", st)
+	}
+}
+
+// TestRevocationNoticeIsTheConsoles — the notice trips the switch only from
+// the console and only when the policy asks for it.
+func TestRevocationNoticeIsTheConsoles(t *testing.T) {
+	revoked, _ := json.Marshal(Request{Revoked: true})
+	call := func(s *Switch, cn string) (*Switch, error) {
+		s.caller = func(context.Context) string { return cn }
+		_, err := s.Builtin(context.Background(), "", revoked)
+		return s, err
+	}
+
+	disk := &fakeDisk{}
+	s, _ := newSwitch(Policy{OnRevocation: true}, disk)
+	if _, err := call(s, "relay-work"); err == nil || s.State().Tripped {
+		t.Errorf("a relay's notice was heeded: %v", err)
+	}
+	if _, err := call(s, "console-probe"); err != nil {
+		t.Fatal(err)
+	}
+	if st := s.State(); !st.Tripped || !disk.locked {
+		t.Errorf("state after the console's notice = %+v, locked %v", st, disk.locked)
+	}
+
+	off := &fakeDisk{}
+	s, _ = newSwitch(Policy{Silence: time.Hour}, off)
+	out, err := s.Builtin(context.Background(), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var st struct {
+		Enabled        bool  `json:"enabled"`
+		SilenceSeconds int64 `json:"silence_seconds"`
+	}
+	if err := json.Unmarshal(out, &st); err != nil || !st.Enabled || st.SilenceSeconds != 3600 {
+		t.Errorf("report = %s, %v", out, err)
+	}
+	if _, err := call(s, "console-probe"); err != nil || s.State().Tripped || off.attempts != 0 {
+		t.Errorf("on_revocation off, the notice still tripped the switch: %v", err)
+	}
+}
@@ -0,0 +1,77 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/slchris/qubes-air/console/internal/middleware"
+	"github.com/slchris/qubes-air/console/internal/repository"
+	"github.com/slchris/qubes-air/console/internal/service"
+)
+
+// AgentRollouts starts and reports staged agent updates;
+// *service.AgentUpdater is the implementation.
+type AgentRollouts interface {
+	Start(ctx context.Context, spec service.RolloutSpec, operator string) (service.Rollout, error)
+	Get(id string) (service.Rollout, error)
+	List() []service.Rollout
+}
+
+// AgentUpdateHandler serves agent update rollouts.
+type AgentUpdateHandler struct {
+	rollouts AgentRollouts
+}
+
+// NewAgentUpdateHandler creates a new AgentUpdateHandler.
+func NewAgentUpdateHandler(rollouts AgentRollouts) *AgentUpdateHandler {
+	return &AgentUpdateHandler{rollouts: rollouts}
+}
+
+// RegisterRoutes registers agent update routes on the router group.
+func (h *AgentUpdateHandler) RegisterRoutes(rg *gin.RouterGroup) {
+	updates := rg.Group("/agent-updates")
+	{
+		updates.GET("", h.List)
+		updates.POST("", h.Start)
+		updates.GET("/:id", h.Get)
+	}
+}
+
+// Start handles POST /agent-updates. The rollout runs in the background; the
+// answer is 202 with its first snapshot, and GET /agent-updates/:id follows it.
+func (h *AgentUpdateHandler) Start(c *gin.Context) {
+	var spec service.RolloutSpec
+	if err := c.ShouldBindJSON(&spec); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	r, err := h.rollouts.Start(c.Request.Context(), spec, middleware.Operator(c))
+	switch {
+	case errors.Is(err, repository.ErrQubeNotFound):
+		respondError(c, http.StatusNotFound, err)
+	case errors.Is(err, service.ErrNoUpdatePackage), errors.Is(err, service.ErrEmptyRollout):
+		respondError(c, http.StatusUnprocessableEntity, err)
+	case err != nil:
+		respondError(c, http.StatusBadRequest, err)
+	default:
+		c.JSON(http.StatusAccepted, r)
+	}
+}
+
+// List handles GET /agent-updates: this console's rollouts, newest first.
+func (h *AgentUpdateHandler) List(c *gin.Context) {
+	rollouts := h.rollouts.List()
+	c.JSON(http.StatusOK, gin.H{"rollouts": rollouts, "count": len(rollouts)})
+}
+
+// Get handles GET /agent-updates/:id.
+func (h *AgentUpdateHandler) Get(c *gin.Context) {
+	r, err := h.rollouts.Get(c.Param("id"))
+	if err != nil {
+		respondError(c, http.StatusNotFound, err)
+		return
+	}
+	c.JSON(http.StatusOK, r)
+}
@@ -0,0 +1,72 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/slchris/qubes-air/console/internal/repository"
+	"github.com/slchris/qubes-air/console/internal/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeRollouts struct {
+	started []service.RolloutSpec
+}
+
+func (f *fakeRollouts) Start(_ context.Context, spec service.RolloutSpec, operator string) (service.Rollout, error) {
+	switch {
+	case len(spec.QubeIDs) > 0 && spec.QubeIDs[0] == "missing":
+		return service.Rollout{}, repository.ErrQubeNotFound
+	case spec.ZoneID == "empty":
+		return service.Rollout{}, service.ErrEmptyRollout
+	}
+	f.started = append(f.started, spec)
+	return service.Rollout{ID: "rollout-1", Spec: spec, Operator: operator, State: service.RolloutRunning}, nil
+}
+
+func (f *fakeRollouts) Get(id string) (service.Rollout, error) {
+	if id != "rollout-1" {
+		return service.Rollout{}, service.ErrRolloutNotFound
+	}
+	return service.Rollout{ID: id, State: service.RolloutCompleted}, nil
+}
+
+func (f *fakeRollouts) List() []service.Rollout {
+	return []service.Rollout{{ID: "rollout-1"}}
+}
+
+func TestAgentUpdateHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	rollouts := &fakeRollouts{}
+	router := gin.New()
+	NewAgentUpdateHandler(rollouts).RegisterRoutes(router.Group("/api/v1"))
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+
+	w := do(http.MethodPost, "/api/v1/agent-updates", `{"zone_id":"z1","batch_size":2}`)
+	require.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+	var r service.Rollout
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &r))
+	assert.Equal(t, "rollout-1", r.ID)
+	require.Len(t, rollouts.started, 1)
+	assert.Equal(t, 2, rollouts.started[0].BatchSize)
+
+	assert.Equal(t, http.StatusNotFound, do(http.MethodPost, "/api/v1/agent-updates", `{"qube_ids":["missing"]}`).Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, do(http.MethodPost, "/api/v1/agent-updates", `{"zone_id":"empty"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/api/v1/agent-updates", `{`).Code)
+
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/api/v1/agent-updates/rollout-1", "").Code)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/api/v1/agent-updates/rollout-2", "").Code)
+	w = do(http.MethodGet, "/api/v1/agent-updates", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"count":1`)
+}
@@ -0,0 +1,43 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/slchris/qubes-air/console/internal/repository"
+	"github.com/slchris/qubes-air/console/internal/service"
+)
+
+// AgentVersions reports the fleet's agent builds; *service.AgentInventory is
+// the implementation.
+type AgentVersions interface {
+	Inventory(ctx context.Context, opts repository.QubeListOptions) (service.AgentVersionInventory, error)
+}
+
+// AgentVersionHandler serves the agent version inventory.
+type AgentVersionHandler struct {
+	versions AgentVersions
+}
+
+// NewAgentVersionHandler creates a new AgentVersionHandler.
+func NewAgentVersionHandler(versions AgentVersions) *AgentVersionHandler {
+	return &AgentVersionHandler{versions: versions}
+}
+
+// RegisterRoutes registers agent version routes on the router group.
+func (h *AgentVersionHandler) RegisterRoutes(rg *gin.RouterGroup) {
+	rg.GET("/agent-versions", h.Inventory)
+}
+
+// Inventory handles GET /agent-versions: every qube's agent build as last
+// probed, counted per build and judged against the configured minimum.
+// zone_id, type and status narrow it as they do GET /qubes.
+func (h *AgentVersionHandler) Inventory(c *gin.Context) {
+	inv, err := h.versions.Inventory(c.Request.Context(), parseQubeListOptions(c))
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, inv)
+}
@@ -0,0 +1,50 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/slchris/qubes-air/console/internal/repository"
+	"github.com/slchris/qubes-air/console/internal/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeVersions struct {
+	opts repository.QubeListOptions
+}
+
+func (f *fakeVersions) Inventory(_ context.Context, opts repository.QubeListOptions) (service.AgentVersionInventory, error) {
+	f.opts = opts
+	return service.AgentVersionInventory{
+		MinVersion: "1.4.0",
+		Enforced:   true,
+		Versions:   []service.AgentBuildCount{{BuildVersion: "1.3.0", Count: 1, Outdated: true}},
+		Agents:     []service.AgentVersionEntry{{QubeID: "q-1", BuildVersion: "1.3.0", Outdated: true}},
+		Outdated:   1,
+	}, nil
+}
+
+func TestAgentVersionHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	versions := &fakeVersions{}
+	router := gin.New()
+	NewAgentVersionHandler(versions).RegisterRoutes(router.Group("/api/v1"))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/agent-versions?zone_id=z1&type=app", nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "z1", versions.opts.ZoneID)
+	assert.Equal(t, "app", versions.opts.Type)
+
+	var inv service.AgentVersionInventory
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &inv))
+	assert.Equal(t, "1.4.0", inv.MinVersion)
+	assert.Equal(t, 1, inv.Outdated)
+	require.Len(t, inv.Agents, 1)
+	assert.True(t, inv.Agents[0].Outdated)
+}
@@ -0,0 +1,128 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/slchris/qubes-air/console/internal/service"
+)
+
+// endpointWatchHeartbeat is how often an idle watch stream says it is alive.
+// The relay treats a stream silent for several of these as dead and
+// reconnects, so a forward that dropped without closing is noticed.
+const endpointWatchHeartbeat = 30 * time.Second
+
+// endpointWatchMaxDuration bounds one watch connection. The relay reconnects
+// and starts from a fresh snapshot, which is the full resync doing its job:
+// whatever a long-lived stream might have missed, the next one repairs.
+const endpointWatchMaxDuration = 30 * time.Minute
+
+// endpointWatchWriteTimeout is how long one event may take to write. The
+// server's WriteTimeout covers a whole response and would cut every stream at
+// fifteen seconds; a watch instead extends the deadline event by event, so a
+// relay that stops reading is still let go.
+const endpointWatchWriteTimeout = 15 * time.Second
+
+// EndpointHandler serves the endpoint table relays forward through.
+type EndpointHandler struct {
+	feed *service.EndpointFeed
+}
+
+// NewEndpointHandler creates a new EndpointHandler.
+func NewEndpointHandler(feed *service.EndpointFeed) *EndpointHandler {
+	return &EndpointHandler{feed: feed}
+}
+
+// RegisterRoutes registers endpoint routes on the router group.
+func (h *EndpointHandler) RegisterRoutes(rg *gin.RouterGroup) {
+	eps := rg.Group("/endpoints")
+	{
+		eps.GET("", h.List)
+		eps.GET("/watch", h.Watch)
+	}
+}
+
+// List handles GET /endpoints: the table as of now, with its version.
+func (h *EndpointHandler) List(c *gin.Context) {
+	// A subscription that ends with this request: the snapshot is all that
+	// is wanted.
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+	snap, _, err := h.feed.Subscribe(ctx)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, snap)
+}
+
+// Watch handles GET /endpoints/watch: Server-Sent Events, starting with the
+// whole table and then one event per change.
+//
+// Events are JSON objects with a "type":
+//
+//	{"type":"snapshot","version":V,"endpoints":[{"name":..,"address":..},..]}
+//	{"type":"set","version":V,"name":..,"address":"ip:port"}
+//	{"type":"delete","version":V,"name":..}
+//	{"type":"ping","version":V}
+//
+// The snapshot replaces whatever the client held; it comes first on every
+// connection, which is what makes reconnecting a full resync. The stream ends
+// when the client falls behind or at endpointWatchMaxDuration, and the client
+// reconnects.
+func (h *EndpointHandler) Watch(c *gin.Context) {
+	flusher, ok := c.Writer.(http.Flusher)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "streaming unsupported"})
+		return
+	}
+	ctx := c.Request.Context()
+	snap, events, err := h.feed.Subscribe(ctx)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+
+	rc := http.NewResponseController(c.Writer)
+	send := func(payload gin.H) {
+		// Not every writer supports deadlines (a test recorder does not); one
+		// that does not has no WriteTimeout to outlive either.
+		_ = rc.SetWriteDeadline(time.Now().Add(endpointWatchWriteTimeout))
+		writeSSE(c, flusher, payload)
+	}
+
+	send(gin.H{"type": "snapshot", "version": snap.Version, "endpoints": snap.Endpoints})
+
+	deadline := time.NewTimer(endpointWatchMaxDuration)
+	defer deadline.Stop()
+	heartbeat := time.NewTicker(endpointWatchHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-deadline.C:
+			return
+		case <-heartbeat.C:
+			send(gin.H{"type": "ping", "version": h.feed.Version()})
+		case ev, ok := <-events:
+			if !ok {
+				// Dropped for falling behind. Ending the stream is the signal;
+				// the reconnect brings a fresh snapshot.
+				return
+			}
+			if ev.Address == "" {
+				send(gin.H{"type": "delete", "version": ev.Version, "name": ev.Name})
+			} else {
+				send(gin.H{"type": "set", "version": ev.Version, "name": ev.Name, "address": ev.Address})
+			}
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/slchris/qubes-air/console/internal/models"
+	"github.com/slchris/qubes-air/console/internal/repository"
+	"github.com/slchris/qubes-air/console/internal/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// endpointRepo is a qube table of running qubes, by id.
+type endpointRepo struct {
+	repository.QubeRepository
+	qubes map[string]*models.Qube
+}
+
+func (r *endpointRepo) ListByStatus(context.Context, []models.QubeStatus) ([]*models.Qube, error) {
+	var out []*models.Qube
+	for _, q := range r.qubes {
+		copied := *q
+		out = append(out, &copied)
+	}
+	return out, nil
+}
+
+func (r *endpointRepo) UpdateIPAddress(_ context.Context, id, ip string) error {
+	r.qubes[id].IPAddress = ip
+	return nil
+}
+
+func endpointRouter(feed *service.EndpointFeed) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	NewEndpointHandler(feed).RegisterRoutes(router.Group("/api/v1"))
+	return router
+}
+
+func TestEndpointHandler_List(t *testing.T) {
+	repo := &endpointRepo{qubes: map[string]*models.Qube{
+		"q1": {ID: "q1", Name: "remote-a", Status: models.QubeStatusRunning, IPAddress: "10.0.0.1"},
+	}}
+	w := httptest.NewRecorder()
+	endpointRouter(service.NewEndpointFeed(repo, "0.0.0.0:8443")).
+		ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/endpoints", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var snap service.EndpointSnapshot
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &snap))
+	assert.NotZero(t, snap.Version)
+	assert.Equal(t, []service.Endpoint{{Name: "remote-a", Address: "10.0.0.1:8443"}}, snap.Endpoints)
+}
+
+// TestEndpointHandler_Watch — the stream opens with the whole table and then
+// carries each change as it is written.
+func TestEndpointHandler_Watch(t *testing.T) {
+	repo := &endpointRepo{qubes: map[string]*models.Qube{
+		"q1": {ID: "q1", Name: "remote-a", Status: models.QubeStatusRunning, IPAddress: "10.0.0.1"},
+	}}
+	feed := service.NewEndpointFeed(repo, "0.0.0.0:8443")
+	tracked := feed.Track(repo)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go feed.Run(ctx)
+	srv := httptest.NewServer(endpointRouter(feed))
+	defer srv.Close()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/api/v1/endpoints/watch", nil)
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	events := bufio.NewScanner(resp.Body)
+	next := func() map[string]any {
+		t.Helper()
+		for events.Scan() {
+			if data, ok := strings.CutPrefix(events.Text(), "data: "); ok {
+				var ev map[string]any
+				require.NoError(t, json.Unmarshal([]byte(data), &ev))
+				return ev
+			}
+		}
+		t.Fatalf("stream ended: %v", events.Err())
+		return nil
+	}
+
+	snap := next()
+	assert.Equal(t, "snapshot", snap["type"])
+	assert.Len(t, snap["endpoints"], 1)
+
+	require.NoError(t, tracked.UpdateIPAddress(ctx, "q1", "10.0.0.7"))
+	ev := next()
+	assert.Equal(t, "set", ev["type"])
+	assert.Equal(t, "10.0.0.7:8443", ev["address"])
+	assert.Equal(t, snap["version"].(float64)+1, ev["version"])
+
+	require.NoError(t, tracked.UpdateIPAddress(ctx, "q1", ""))
+	ev = next()
+	assert.Equal(t, "delete", ev["type"])
+	assert.Equal(t, "remote-a", ev["name"])
+}
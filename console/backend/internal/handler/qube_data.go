@@ -0,0 +1,99 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/slchris/qubes-air/console/internal/models"
+	"github.com/slchris/qubes-air/console/internal/service"
+)
+
+// DataLocker closes and reopens a qube's encrypted data disk through its
+// agent; *service.AgentDataUnlocker is the implementation.
+type DataLocker interface {
+	Lock(ctx context.Context, qube *models.Qube) (service.UnlockResult, error)
+	Unlock(ctx context.Context, qube *models.Qube) (service.UnlockResult, error)
+}
+
+// LockData handles POST /qubes/:id/lock-data: the qube's agent syncs and
+// unmounts /data and closes the LUKS mapping, so the key leaves the remote's
+// memory now rather than when the VM goes. The same call the orchestrator
+// makes before a suspend or release, for an operator who wants it without one.
+//
+// 409 when there is nothing to lock (a qube that does not encrypt its data,
+// or one with no running VM) and when the agent declines because /data is in
+// use; 502 when the agent cannot be asked. UnlockData opens it again.
+func (h *QubeHandler) LockData(c *gin.Context) {
+	qube, ok := h.dataQube(c)
+	if !ok {
+		return
+	}
+	res, err := h.data.Lock(c.Request.Context(), qube)
+	if err != nil {
+		respondError(c, http.StatusBadGateway, err)
+		return
+	}
+	if res.Unlocked {
+		respondError(c, http.StatusConflict, fmt.Errorf("data disk of %q not locked: %s", qube.Name, res.Detail))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"locked": true, "detail": res.Detail})
+}
+
+// UnlockData handles POST /qubes/:id/unlock-data: the console derives the
+// qube's key and pushes it to the agent again, as it does after every
+// bootstrap. It is how an operator reopens a disk closed by LockData, and the
+// only way to reopen one the agent's dead man's switch closed — the switch
+// refuses an unlock from anyone but the console, and the console unlocking
+// re-arms it.
+//
+// 409 as for LockData, when the agent declines (a wrong key, no disk
+// attached) and when its build is below the minimum the key is handed to;
+// 502 when it cannot be asked.
+func (h *QubeHandler) UnlockData(c *gin.Context) {
+	qube, ok := h.dataQube(c)
+	if !ok {
+		return
+	}
+	res, err := h.data.Unlock(c.Request.Context(), qube)
+	switch {
+	case errors.Is(err, service.ErrAgentOutdated):
+		respondError(c, http.StatusConflict, err)
+		return
+	case err != nil:
+		respondError(c, http.StatusBadGateway, err)
+		return
+	}
+	if !res.Unlocked {
+		respondError(c, http.StatusConflict, fmt.Errorf("data disk of %q not unlocked: %s", qube.Name, res.Detail))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"unlocked": true, "detail": res.Detail})
+}
+
+// dataQube loads the qube a data disk call names and checks there is a disk
+// to act on, answering the request itself when not.
+func (h *QubeHandler) dataQube(c *gin.Context) (*models.Qube, bool) {
+	if h.data == nil {
+		respondError(c, http.StatusNotImplemented, errors.New("data disk locking is not configured"))
+		return nil, false
+	}
+	qube, err := h.qubeSvc.GetByID(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		handleQubeError(c, err)
+		return nil, false
+	}
+	if !qube.Spec.EncryptsData() {
+		respondError(c, http.StatusConflict, fmt.Errorf("qube %q does not encrypt its data", qube.Name))
+		return nil, false
+	}
+	if qube.Status != models.QubeStatusRunning {
+		respondError(c, http.StatusConflict,
+			fmt.Errorf("qube %q is %s; its data disk is open only while it runs", qube.Name, qube.Status))
+		return nil, false
+	}
+	return qube, true
+}
@@ -0,0 +1,190 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/slchris/qubes-air/console/internal/models"
+	"github.com/slchris/qubes-air/console/internal/service"
+	"github.com/slchris/qubes-air/console/internal/transfer"
+)
+
+// FileTransferer moves files to and from a qube's agent;
+// *service.FileTransfer is the implementation.
+type FileTransferer interface {
+	Stat(ctx context.Context, qube *models.Qube, path string, tree bool) (*transfer.Response, error)
+	Upload(ctx context.Context, qube *models.Qube, up service.FileUpload, body io.Reader) (*transfer.Response, error)
+	Download(ctx context.Context, qube *models.Qube, path string, tree bool, offset int64,
+		w io.Writer, ready func(transfer.Response) error) error
+}
+
+// Headers describing a download. The body alone cannot say whether it is
+// whole, so a client checks it against these.
+const (
+	headerTransferSize   = "X-Transfer-Size"
+	headerTransferSHA256 = "X-Transfer-Sha256"
+	headerTransferMode   = "X-Transfer-Mode"
+	headerTransferMtime  = "X-Transfer-Mtime"
+)
+
+// fileQube resolves the qube of a file request, answering for it when it
+// cannot.
+func (h *QubeHandler) fileQube(c *gin.Context) (*models.Qube, string, bool) {
+	if h.files == nil {
+		respondError(c, http.StatusNotImplemented, errors.New("file transfer is not configured"))
+		return nil, "", false
+	}
+	path := c.Query("path")
+	if path == "" {
+		respondError(c, http.StatusBadRequest, errors.New("path is required"))
+		return nil, "", false
+	}
+	qube, err := h.qubeSvc.GetByID(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		handleQubeError(c, err)
+		return nil, "", false
+	}
+	return qube, path, true
+}
+
+// StatFile handles GET /qubes/:id/files/stat?path=…[&tree=true]: what is at
+// path on the qube — size, mode, owner, modification time and SHA-256 — and
+// how many bytes of an interrupted upload to it are staged.
+func (h *QubeHandler) StatFile(c *gin.Context) {
+	qube, path, ok := h.fileQube(c)
+	if !ok {
+		return
+	}
+	st, err := h.files.Stat(c.Request.Context(), qube, path, c.Query("tree") == "true")
+	if err != nil {
+		respondTransferError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, st)
+}
+
+// UploadFile handles PUT /qubes/:id/files?path=…&size=…&sha256=…: the body
+// is the file from offset (default 0) on, or with tree=true a tar to unpack
+// into the directory at path. mode (octal) sets the permission bits.
+//
+// The file is installed, atomically and only if the whole of it hashes to
+// sha256, once offset plus the body reach size. A body that stops short is
+// kept staged and answered 202 with how many bytes are staged; sending the
+// rest from there completes it. An offset that does not match what is staged
+// is 409, with the staged count, so a client that lost track can find it.
+// offset=0 always starts over.
+func (h *QubeHandler) UploadFile(c *gin.Context) {
+	qube, path, ok := h.fileQube(c)
+	if !ok {
+		return
+	}
+	up := service.FileUpload{Path: path, Tree: c.Query("tree") == "true", SHA256: c.Query("sha256")}
+	var err error
+	if up.Size, err = strconv.ParseInt(c.Query("size"), 10, 64); err != nil {
+		respondError(c, http.StatusBadRequest, fmt.Errorf("size: %w", err))
+		return
+	}
+	if s := c.Query("offset"); s != "" {
+		if up.Offset, err = strconv.ParseInt(s, 10, 64); err != nil {
+			respondError(c, http.StatusBadRequest, fmt.Errorf("offset: %w", err))
+			return
+		}
+	}
+	if s := c.Query("mode"); s != "" {
+		mode, err := strconv.ParseUint(s, 8, 32)
+		if err != nil || mode > 0o7777 {
+			respondError(c, http.StatusBadRequest, fmt.Errorf("mode %q is not octal permission bits", s))
+			return
+		}
+		up.Mode = uint32(mode)
+	}
+	if up.Offset < 0 || up.Offset > up.Size {
+		respondError(c, http.StatusBadRequest, fmt.Errorf("offset %d does not fit a file of %d bytes", up.Offset, up.Size))
+		return
+	}
+	if up.SHA256 == "" {
+		respondError(c, http.StatusBadRequest, errors.New("sha256 of the whole file is required"))
+		return
+	}
+
+	resp, err := h.files.Upload(c.Request.Context(), qube, up, c.Request.Body)
+	switch {
+	case err == nil:
+		c.JSON(http.StatusOK, resp)
+	case errors.Is(err, service.ErrUploadIncomplete):
+		c.JSON(http.StatusAccepted, gin.H{"staged": resp.Staged, "message": err.Error()})
+	case errors.Is(err, transfer.ErrOffsetMismatch) && resp != nil:
+		c.JSON(http.StatusConflict, gin.H{"staged": resp.Staged, "message": err.Error()})
+	default:
+		respondTransferError(c, err)
+	}
+}
+
+// DownloadFile handles GET /qubes/:id/files?path=…[&offset=…]: the file from
+// offset on, with its whole size, mode, modification time and SHA-256 in
+// X-Transfer-* headers. With tree=true it is a tar of the directory, packed
+// when the request arrives, and cannot be resumed.
+//
+// Every chunk is checked on its way from the agent, but once the body has
+// started a failure can only cut it short; the Content-Length and the
+// SHA-256 header are how the client knows.
+func (h *QubeHandler) DownloadFile(c *gin.Context) {
+	qube, path, ok := h.fileQube(c)
+	if !ok {
+		return
+	}
+	var offset int64
+	if s := c.Query("offset"); s != "" {
+		var err error
+		if offset, err = strconv.ParseInt(s, 10, 64); err != nil || offset < 0 {
+			respondError(c, http.StatusBadRequest, fmt.Errorf("offset %q is not a byte count", s))
+			return
+		}
+	}
+	tree := c.Query("tree") == "true"
+	started := false
+	ready := func(r transfer.Response) error {
+		started = true
+		hdr := c.Writer.Header()
+		hdr.Set(headerTransferSize, strconv.FormatInt(r.Size, 10))
+		hdr.Set(headerTransferSHA256, r.SHA256)
+		if !tree {
+			hdr.Set(headerTransferMode, strconv.FormatUint(uint64(r.Mode&0o7777), 8))
+			hdr.Set(headerTransferMtime, time.Unix(0, r.ModTime).UTC().Format(time.RFC3339Nano))
+		}
+		hdr.Set("Content-Type", "application/octet-stream")
+		hdr.Set("Content-Length", strconv.FormatInt(r.Size-offset, 10))
+		c.Status(http.StatusOK)
+		return nil
+	}
+	err := h.files.Download(c.Request.Context(), qube, path, tree, offset, c.Writer, ready)
+	switch {
+	case err == nil:
+	case !started:
+		respondTransferError(c, err)
+	default:
+		// Too late for a status; gin's request log shows it.
+		_ = c.Error(fmt.Errorf("download %s from %s cut short: %w", path, qube.Name, err))
+	}
+}
+
+// respondTransferError maps a transfer failure to a status: the agent's
+// refusals to 403, 409 and 422, anything else as the agent being unreachable.
+func respondTransferError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, transfer.ErrPathNotAllowed):
+		respondError(c, http.StatusForbidden, err)
+	case errors.Is(err, transfer.ErrOffsetMismatch):
+		respondError(c, http.StatusConflict, err)
+	case errors.Is(err, transfer.ErrChecksum), errors.Is(err, transfer.ErrChanged):
+		respondError(c, http.StatusUnprocessableEntity, err)
+	default:
+		respondError(c, http.StatusBadGateway, err)
+	}
+}
@@ -2,6 +2,7 @@
 package handler
 
 import (
+	"context"
 	"errors"
 	"net/http"
 
@@ -17,6 +18,20 @@ type QubeHandler struct {
 	qubeSvc service.QubeService
 	// certs exposes issued agent certificates (metadata only).
 	certs *repository.AgentCertRepository
+	// inspector asks a qube's agent for its effective configuration.
+	inspector AgentConfigInspector
+	// files moves files to and from a qube through its agent.
+	files FileTransferer
+	// shell runs interactive terminals on qubes through their agents.
+	shell ShellRunner
+	// data closes and reopens encrypted data disks through their agents.
+	data DataLocker
+}
+
+// AgentConfigInspector fetches an agent's configuration report;
+// *service.AgentInspector is the implementation.
+type AgentConfigInspector interface {
+	AgentConfig(ctx context.Context, qube *models.Qube) (*service.AgentConfigReport, error)
 }
 
 // NewQubeHandler creates a new QubeHandler.
@@ -28,6 +43,26 @@ func WithCertRepository(r *repository.AgentCertRepository) QubeHandlerOption {
 	return func(h *QubeHandler) { h.certs = r }
 }
 
+// WithAgentInspector enables the per-qube agent configuration endpoint.
+func WithAgentInspector(i AgentConfigInspector) QubeHandlerOption {
+	return func(h *QubeHandler) { h.inspector = i }
+}
+
+// WithFileTransfer enables the per-qube file endpoints.
+func WithFileTransfer(f FileTransferer) QubeHandlerOption {
+	return func(h *QubeHandler) { h.files = f }
+}
+
+// WithShell enables the per-qube terminal endpoint.
+func WithShell(s ShellRunner) QubeHandlerOption {
+	return func(h *QubeHandler) { h.shell = s }
+}
+
+// WithDataLocker enables the per-qube data disk lock and unlock endpoints.
+func WithDataLocker(l DataLocker) QubeHandlerOption {
+	return func(h *QubeHandler) { h.data = l }
+}
+
 func NewQubeHandler(qubeSvc service.QubeService, opts ...QubeHandlerOption) *QubeHandler {
 	h := &QubeHandler{qubeSvc: qubeSvc}
 	for _, opt := range opts {
@@ -49,6 +84,13 @@ func (h *QubeHandler) RegisterRoutes(rg *gin.RouterGroup) {
 		qubes.POST("/:id/stop", h.Stop)
 		qubes.GET("/:id/reachable", h.CheckReachable)
 		qubes.GET("/:id/certs", h.ListCerts)
+		qubes.GET("/:id/agent-config", h.AgentConfig)
+		qubes.GET("/:id/files/stat", h.StatFile)
+		qubes.GET("/:id/files", h.DownloadFile)
+		qubes.PUT("/:id/files", h.UploadFile)
+		qubes.GET("/:id/shell", h.Shell)
+		qubes.POST("/:id/lock-data", h.LockData)
+		qubes.POST("/:id/unlock-data", h.UnlockData)
 	}
 }
 
@@ -230,6 +272,31 @@ func (h *QubeHandler) ListCerts(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"certs": certs, "count": len(certs)})
 }
 
+// AgentConfig handles GET /qubes/:id/agent-config: the configuration the
+// qube's agent says it is running — services and their limits, forwards,
+// logging, and whether its last reload was refused.
+//
+// Asked live rather than recorded: the file is edited on the remote and
+// reloaded there, so anything the console stored would be a guess about the
+// past. 502 when the agent cannot be asked, as for CheckReachable.
+func (h *QubeHandler) AgentConfig(c *gin.Context) {
+	if h.inspector == nil {
+		respondError(c, http.StatusNotImplemented, errors.New("agent inspection is not configured"))
+		return
+	}
+	qube, err := h.qubeSvc.GetByID(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		handleQubeError(c, err)
+		return
+	}
+	report, err := h.inspector.AgentConfig(c.Request.Context(), qube)
+	if err != nil {
+		respondError(c, http.StatusBadGateway, err)
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
 // respondOperation writes an async operation result. The Location header points
 // at the job so a client can poll without having to know how to build the URL.
 func respondOperation(c *gin.Context, status int, op *service.Operation) {
@@ -4,18 +4,26 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/gin-gonic/gin"
 	"github.com/slchris/qubes-air/console/internal/database"
+	"github.com/slchris/qubes-air/console/internal/middleware"
 	"github.com/slchris/qubes-air/console/internal/models"
 	"github.com/slchris/qubes-air/console/internal/repository"
 	"github.com/slchris/qubes-air/console/internal/service"
+	"github.com/slchris/qubes-air/console/internal/shell"
+	"github.com/slchris/qubes-air/console/internal/transfer"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/net/websocket"
 )
 
 func setupQubeTestRouter(t *testing.T) (*gin.Engine, service.ZoneService, service.QubeService, func()) {
@@ -275,3 +283,332 @@ func TestQubeHandler_Stop(t *testing.T) {
 	// Stop suspends: compute released, data retained.
 	assert.Equal(t, models.QubeStatusSuspended, qube.Status)
 }
+
+// fakeInspector answers for one qube by name.
+type fakeInspector struct {
+	report *service.AgentConfigReport
+	err    error
+	asked  string
+}
+
+func (f *fakeInspector) AgentConfig(_ context.Context, qube *models.Qube) (*service.AgentConfigReport, error) {
+	f.asked = qube.Name
+	return f.report, f.err
+}
+
+func TestQubeHandler_AgentConfig(t *testing.T) {
+	_, zoneSvc, qubeSvc, cleanup := setupQubeTestRouter(t)
+	defer cleanup()
+
+	zone := createTestZoneForHandler(t, zoneSvc)
+	createdOp, err := qubeSvc.Create(context.Background(), &models.QubeCreateRequest{
+		Name:   "inspected-qube",
+		Type:   models.QubeTypeApp,
+		ZoneID: zone.ID,
+	})
+	require.NoError(t, err)
+
+	get := func(h *QubeHandler, id string) *httptest.ResponseRecorder {
+		router := gin.New()
+		h.RegisterRoutes(router.Group("/api/v1"))
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/v1/qubes/"+id+"/agent-config", nil)
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusNotImplemented, get(NewQubeHandler(qubeSvc), createdOp.Qube.ID).Code)
+
+	inspector := &fakeInspector{report: &service.AgentConfigReport{
+		Source: "/etc/qubes-air/agent.yaml", Version: 1, LastReloadError: "unknown field",
+	}}
+	h := NewQubeHandler(qubeSvc, WithAgentInspector(inspector))
+	w := get(h, createdOp.Qube.ID)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "inspected-qube", inspector.asked)
+	var got service.AgentConfigReport
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+	assert.Equal(t, "unknown field", got.LastReloadError)
+
+	assert.Equal(t, http.StatusNotFound, get(h, "no-such-qube").Code)
+
+	inspector.err = errors.New("tunnel never established")
+	assert.Equal(t, http.StatusBadGateway, get(h, createdOp.Qube.ID).Code)
+}
+
+// fakeLocker answers a lock or an unlock with res, or err.
+type fakeLocker struct {
+	res   service.UnlockResult
+	err   error
+	asked []string
+}
+
+func (f *fakeLocker) Lock(_ context.Context, qube *models.Qube) (service.UnlockResult, error) {
+	f.asked = append(f.asked, qube.Name)
+	return f.res, f.err
+}
+
+func (f *fakeLocker) Unlock(_ context.Context, qube *models.Qube) (service.UnlockResult, error) {
+	f.asked = append(f.asked, "unlock "+qube.Name)
+	return f.res, f.err
+}
+
+// TestQubeHandler_UnlockData — the console pushing the key again, which is
+// what reopens a disk the dead man's switch closed.
+func TestQubeHandler_UnlockData(t *testing.T) {
+	_, zoneSvc, qubeSvc, cleanup := setupQubeTestRouter(t)
+	defer cleanup()
+
+	zone := createTestZoneForHandler(t, zoneSvc)
+	yes := true
+	vault, err := qubeSvc.Create(context.Background(), &models.QubeCreateRequest{
+		Name: "vault", Type: models.QubeTypeApp, ZoneID: zone.ID,
+		Spec: models.QubeSpec{EncryptData: &yes},
+	})
+	require.NoError(t, err)
+
+	locker := &fakeLocker{res: service.UnlockResult{Unlocked: true, Detail: "unlocked and mounted"}}
+	router := gin.New()
+	NewQubeHandler(qubeSvc, WithDataLocker(locker)).RegisterRoutes(router.Group("/api/v1"))
+	post := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/qubes/"+vault.Qube.ID+"/unlock-data", nil)
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := post()
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.JSONEq(t, `{"unlocked": true, "detail": "unlocked and mounted"}`, w.Body.String())
+	assert.Equal(t, []string{"unlock vault"}, locker.asked)
+
+	locker.res = service.UnlockResult{Detail: "luksOpen failed (wrong key?)"}
+	w = post()
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), "wrong key")
+
+	locker.err = fmt.Errorf("%w: 0.9.0 is below 1.0.0", service.ErrAgentOutdated)
+	assert.Equal(t, http.StatusConflict, post().Code, "an outdated agent is refused the key, not unreachable")
+	locker.err = errors.New("tunnel never established")
+	assert.Equal(t, http.StatusBadGateway, post().Code)
+}
+
+func TestQubeHandler_LockData(t *testing.T) {
+	_, zoneSvc, qubeSvc, cleanup := setupQubeTestRouter(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	zone := createTestZoneForHandler(t, zoneSvc)
+	yes := true
+	vault, err := qubeSvc.Create(ctx, &models.QubeCreateRequest{
+		Name: "vault", Type: models.QubeTypeApp, ZoneID: zone.ID,
+		Spec: models.QubeSpec{EncryptData: &yes},
+	})
+	require.NoError(t, err)
+	plain, err := qubeSvc.Create(ctx, &models.QubeCreateRequest{
+		Name: "plain", Type: models.QubeTypeApp, ZoneID: zone.ID,
+	})
+	require.NoError(t, err)
+
+	post := func(h *QubeHandler, id string) *httptest.ResponseRecorder {
+		router := gin.New()
+		h.RegisterRoutes(router.Group("/api/v1"))
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/qubes/"+id+"/lock-data", nil)
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusNotImplemented, post(NewQubeHandler(qubeSvc), vault.Qube.ID).Code)
+
+	locker := &fakeLocker{res: service.UnlockResult{Detail: "unmounted and closed"}}
+	h := NewQubeHandler(qubeSvc, WithDataLocker(locker))
+	w := post(h, vault.Qube.ID)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.JSONEq(t, `{"locked": true, "detail": "unmounted and closed"}`, w.Body.String())
+
+	assert.Equal(t, http.StatusNotFound, post(h, "no-such-qube").Code)
+	assert.Equal(t, http.StatusConflict, post(h, plain.Qube.ID).Code, "nothing to lock")
+
+	locker.res = service.UnlockResult{Unlocked: true, Detail: "unmount failed: target is busy"}
+	w = post(h, vault.Qube.ID)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), "target is busy")
+
+	locker.err = errors.New("tunnel never established")
+	assert.Equal(t, http.StatusBadGateway, post(h, vault.Qube.ID).Code)
+
+	// A suspended qube has no VM holding the key, and its agent is not asked.
+	_, err = qubeSvc.Stop(ctx, vault.Qube.ID)
+	require.NoError(t, err)
+	asked := len(locker.asked)
+	assert.Equal(t, http.StatusConflict, post(h, vault.Qube.ID).Code)
+	assert.Len(t, locker.asked, asked)
+	assert.Equal(t, []string{"vault", "vault", "vault"}, locker.asked)
+}
+
+// fakeFiles keeps one file in memory and stages uploads like the agent does.
+type fakeFiles struct {
+	content []byte
+	staged  []byte
+	err     error
+}
+
+func (f *fakeFiles) Stat(_ context.Context, _ *models.Qube, _ string, _ bool) (*transfer.Response, error) {
+	return &transfer.Response{Exists: f.content != nil, Size: int64(len(f.content)), Staged: int64(len(f.staged))}, f.err
+}
+
+func (f *fakeFiles) Upload(_ context.Context, _ *models.Qube, up service.FileUpload, body io.Reader) (*transfer.Response, error) {
+	if up.Offset != int64(len(f.staged)) {
+		return &transfer.Response{Staged: int64(len(f.staged))}, transfer.ErrOffsetMismatch
+	}
+	b, _ := io.ReadAll(body)
+	f.staged = append(f.staged, b...)
+	if int64(len(f.staged)) < up.Size {
+		return &transfer.Response{Staged: int64(len(f.staged))}, service.ErrUploadIncomplete
+	}
+	f.content, f.staged = f.staged, nil
+	return &transfer.Response{Exists: true, Size: int64(len(f.content)), SHA256: up.SHA256}, nil
+}
+
+func (f *fakeFiles) Download(_ context.Context, _ *models.Qube, _ string, _ bool, offset int64,
+	w io.Writer, ready func(transfer.Response) error) error {
+	if f.err != nil {
+		return f.err
+	}
+	if err := ready(transfer.Response{Size: int64(len(f.content)), SHA256: "abc", Mode: 0o100640}); err != nil {
+		return err
+	}
+	_, err := w.Write(f.content[offset:])
+	return err
+}
+
+func TestQubeHandler_Files(t *testing.T) {
+	_, zoneSvc, qubeSvc, cleanup := setupQubeTestRouter(t)
+	defer cleanup()
+
+	zone := createTestZoneForHandler(t, zoneSvc)
+	createdOp, err := qubeSvc.Create(context.Background(), &models.QubeCreateRequest{
+		Name:   "files-qube",
+		Type:   models.QubeTypeApp,
+		ZoneID: zone.ID,
+	})
+	require.NoError(t, err)
+	base := "/api/v1/qubes/" + createdOp.Qube.ID + "/files"
+
+	do := func(h *QubeHandler, method, url, body string) *httptest.ResponseRecorder {
+		router := gin.New()
+		h.RegisterRoutes(router.Group("/api/v1"))
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, url, strings.NewReader(body))
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusNotImplemented, do(NewQubeHandler(qubeSvc), "GET", base+"/stat?path=/home/user/f", "").Code)
+
+	files := &fakeFiles{}
+	h := NewQubeHandler(qubeSvc, WithFileTransfer(files))
+	assert.Equal(t, http.StatusBadRequest, do(h, "GET", base+"/stat", "").Code, "path is required")
+	assert.Equal(t, http.StatusBadRequest, do(h, "PUT", base+"?path=/f&size=4", "data").Code, "sha256 is required")
+	assert.Equal(t, http.StatusBadRequest, do(h, "PUT", base+"?path=/f&size=4&sha256=x&mode=999", "data").Code)
+
+	// Half a file is staged, the wrong offset says where to resume, the rest
+	// completes it.
+	w := do(h, "PUT", base+"?path=/f&size=8&sha256=x", "data")
+	require.Equal(t, http.StatusAccepted, w.Code)
+	assert.Contains(t, w.Body.String(), `"staged":4`)
+	w = do(h, "PUT", base+"?path=/f&size=8&sha256=x&offset=2", "ta")
+	require.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), `"staged":4`)
+	require.Equal(t, http.StatusOK, do(h, "PUT", base+"?path=/f&size=8&sha256=x&offset=4", "more").Code)
+
+	w = do(h, "GET", base+"?path=/f&offset=2", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "tamore", w.Body.String())
+	assert.Equal(t, "8", w.Header().Get("X-Transfer-Size"))
+	assert.Equal(t, "640", w.Header().Get("X-Transfer-Mode"))
+	assert.Equal(t, "abc", w.Header().Get("X-Transfer-Sha256"))
+
+	files.err = transfer.ErrPathNotAllowed
+	assert.Equal(t, http.StatusForbidden, do(h, "GET", base+"?path=/etc/shadow", "").Code)
+	files.err = errors.New("tunnel never established")
+	assert.Equal(t, http.StatusBadGateway, do(h, "GET", base+"/stat?path=/f", "").Code)
+	assert.Equal(t, http.StatusNotFound, do(h, "GET", "/api/v1/qubes/no-such-qube/files?path=/f", "").Code)
+}
+
+// fakeShell is a terminal that describes each frame it reads, and exits when
+// it is typed "exit".
+type fakeShell struct{ qube string }
+
+func (f *fakeShell) Run(_ context.Context, qube *models.Qube, in io.Reader, out io.Writer) error {
+	f.qube = qube.Name
+	for {
+		fr, err := shell.ReadFrame(in)
+		if err != nil {
+			return err
+		}
+		switch {
+		case fr.Kind == shell.KindResize:
+			_, _ = fmt.Fprintf(out, "[%dx%d]", fr.Rows, fr.Cols)
+		case string(fr.Data) == "exit":
+			return nil
+		default:
+			_, _ = fmt.Fprintf(out, "<%s>", fr.Data)
+		}
+	}
+}
+
+func TestQubeHandler_Shell(t *testing.T) {
+	_, zoneSvc, qubeSvc, cleanup := setupQubeTestRouter(t)
+	defer cleanup()
+
+	zone := createTestZoneForHandler(t, zoneSvc)
+	createdOp, err := qubeSvc.Create(context.Background(), &models.QubeCreateRequest{
+		Name:   "shell-qube",
+		Type:   models.QubeTypeApp,
+		ZoneID: zone.ID,
+	})
+	require.NoError(t, err)
+
+	term := &fakeShell{}
+	router := gin.New()
+	v1 := router.Group("/api/v1")
+	v1.Use(middleware.Auth("s3cr3t"))
+	NewQubeHandler(qubeSvc, WithShell(term)).RegisterRoutes(v1)
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/api/v1/qubes/" + createdOp.Qube.ID + "/shell"
+
+	dial := func(origin string, protocols ...string) (*websocket.Conn, error) {
+		cfg, err := websocket.NewConfig(wsURL, origin)
+		require.NoError(t, err)
+		cfg.Protocol = protocols
+		return websocket.DialConfig(cfg)
+	}
+	_, err = dial(srv.URL, ShellProtocol)
+	assert.Error(t, err, "a handshake without the token is refused")
+	_, err = dial("http://elsewhere.example", ShellProtocol, middleware.WebSocketTokenPrefix+"s3cr3t")
+	assert.Error(t, err, "a page from another origin is refused")
+
+	ws, err := dial(srv.URL, ShellProtocol, middleware.WebSocketTokenPrefix+"s3cr3t")
+	require.NoError(t, err)
+	defer ws.Close()
+	assert.Equal(t, []string{ShellProtocol}, ws.Config().Protocol, "the server selects the shell protocol, never the token")
+
+	require.NoError(t, websocket.Message.Send(ws, `{"type":"resize","rows":30,"cols":90}`))
+	require.NoError(t, websocket.Message.Send(ws, []byte("ls")))
+	var got string
+	for got != "[30x90]<ls>" {
+		var chunk []byte
+		require.NoError(t, websocket.Message.Receive(ws, &chunk), "output so far %q", got)
+		got += string(chunk)
+		require.LessOrEqual(t, len(got), len("[30x90]<ls>"), "output %q", got)
+	}
+	assert.Equal(t, "shell-qube", term.qube)
+
+	// The shell exiting closes the socket.
+	require.NoError(t, websocket.Message.Send(ws, []byte("exit")))
+	var rest []byte
+	assert.Error(t, websocket.Message.Receive(ws, &rest))
+}
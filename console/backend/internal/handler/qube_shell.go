@@ -0,0 +1,194 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/slchris/qubes-air/console/internal/middleware"
+	"github.com/slchris/qubes-air/console/internal/models"
+	"github.com/slchris/qubes-air/console/internal/shell"
+	"golang.org/x/net/websocket"
+)
+
+// ShellRunner runs a terminal on a qube's agent; *service.AgentShell is the
+// implementation.
+type ShellRunner interface {
+	Run(ctx context.Context, qube *models.Qube, in io.Reader, out io.Writer) error
+}
+
+// ShellProtocol is the WebSocket subprotocol the terminal endpoint speaks.
+// A browser offers it together with its token (middleware.WebSocketTokenPrefix),
+// and the server selects it.
+const ShellProtocol = "qubes-air.shell"
+
+// maxShellMessageBytes bounds one message from the terminal: a paste, at most.
+const maxShellMessageBytes = 1 << 20
+
+// shellControl is a text message from the terminal. The only one is a resize.
+type shellControl struct {
+	Type string `json:"type"`
+	Rows uint16 `json:"rows"`
+	Cols uint16 `json:"cols"`
+}
+
+// shellMessage is one message from the terminal, with its frame type.
+type shellMessage struct {
+	binary bool
+	data   []byte
+}
+
+// shellCodec receives a message and whether it was binary, which
+// websocket.Message does not say.
+var shellCodec = websocket.Codec{
+	Unmarshal: func(data []byte, payloadType byte, v any) error {
+		m, ok := v.(*shellMessage)
+		if !ok {
+			return fmt.Errorf("shell codec cannot decode into %T", v)
+		}
+		m.binary = payloadType == websocket.BinaryFrame
+		m.data = data
+		return nil
+	},
+}
+
+// Shell handles GET /qubes/:id/shell: a WebSocket carrying an interactive
+// terminal on the qube, for an xterm-style client.
+//
+// Binary messages from the client are keystrokes; a text message is a JSON
+// control, {"type":"resize","rows":R,"cols":C}, sent whenever the terminal's
+// size changes (and once at the start). Binary messages from the server are
+// the terminal's output. The socket closes when the shell exits; closing it
+// hangs the shell up.
+//
+// Each session is logged when it opens and when it ends, with the operator
+// identity middleware.Auth recorded, the client's address and what was
+// carried each way: a terminal on a remote is the widest thing the console
+// hands out, and the one that must leave a trail.
+func (h *QubeHandler) Shell(c *gin.Context) {
+	if h.shell == nil {
+		respondError(c, http.StatusNotImplemented, errors.New("remote shell is not configured"))
+		return
+	}
+	qube, err := h.qubeSvc.GetByID(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		handleQubeError(c, err)
+		return
+	}
+	if !strings.EqualFold(c.GetHeader("Upgrade"), "websocket") {
+		respondError(c, http.StatusBadRequest, errors.New("the shell is a WebSocket endpoint"))
+		return
+	}
+
+	operator, client := middleware.Operator(c), c.ClientIP()
+	srv := websocket.Server{
+		Handshake: shellHandshake,
+		Handler: func(ws *websocket.Conn) {
+			ws.PayloadType = websocket.BinaryFrame
+			ws.MaxPayloadBytes = maxShellMessageBytes
+			h.runShell(ws, qube, operator, client)
+		},
+	}
+	srv.ServeHTTP(c.Writer, c.Request)
+}
+
+// shellHandshake refuses a page from another origin — the token travels in
+// the handshake, but a browser is still the wrong place to be lax — and
+// selects ShellProtocol when the client offered it. A client without an
+// Origin is not a browser, and has nothing to be protected from.
+func shellHandshake(cfg *websocket.Config, req *http.Request) error {
+	if origin := req.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil || !strings.EqualFold(u.Host, req.Host) {
+			return fmt.Errorf("origin %q is not this console", origin)
+		}
+	}
+	if slices.Contains(cfg.Protocol, ShellProtocol) {
+		cfg.Protocol = []string{ShellProtocol}
+	} else {
+		cfg.Protocol = nil
+	}
+	return nil
+}
+
+// runShell bridges one WebSocket to a terminal on qube until either ends.
+func (h *QubeHandler) runShell(ws *websocket.Conn, qube *models.Qube, operator, client string) {
+	started := time.Now()
+	log.Printf("shell: %s opened a terminal on qube %q (%s) from %s", operator, qube.Name, qube.ID, client)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	in, toShell := io.Pipe()
+	var sent atomic.Int64
+	go func() {
+		// The client going away ends the session: there is no one left to
+		// type, and no one to read what the shell would still write.
+		defer cancel()
+		err := readShellInput(ws, toShell, &sent)
+		_ = toShell.CloseWithError(err)
+	}()
+
+	out := &countingWriter{w: ws}
+	err := h.shell.Run(ctx, qube, in, out)
+	hungUp := ctx.Err() != nil // before Close, which ends the reader too
+	_ = ws.Close()
+
+	outcome := "shell exited"
+	switch {
+	case hungUp:
+		outcome = "client disconnected"
+	case err != nil:
+		outcome = err.Error()
+	}
+	log.Printf("shell: %s closed the terminal on qube %q (%s) from %s after %s: %s; %d bytes in, %d bytes out",
+		operator, qube.Name, qube.ID, client, time.Since(started).Round(time.Second), outcome, sent.Load(), out.n.Load())
+}
+
+// readShellInput turns the client's messages into shell frames on w until the
+// socket closes or sends something that is not a terminal's.
+func readShellInput(ws *websocket.Conn, w io.Writer, sent *atomic.Int64) error {
+	for {
+		var msg shellMessage
+		if err := shellCodec.Receive(ws, &msg); err != nil {
+			return err
+		}
+		if msg.binary {
+			if err := shell.WriteData(w, msg.data); err != nil {
+				return err
+			}
+			sent.Add(int64(len(msg.data)))
+			continue
+		}
+		var ctl shellControl
+		if err := json.Unmarshal(msg.data, &ctl); err != nil {
+			return fmt.Errorf("control message: %w", err)
+		}
+		if ctl.Type == "resize" && ctl.Rows > 0 && ctl.Cols > 0 {
+			if err := shell.WriteResize(w, ctl.Rows, ctl.Cols); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// countingWriter counts what passes through it.
+type countingWriter struct {
+	w io.Writer
+	n atomic.Int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n.Add(int64(n))
+	return n, err
+}
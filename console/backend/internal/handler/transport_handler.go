@@ -0,0 +1,48 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/slchris/qubes-air/console/internal/service"
+)
+
+// TransportHandler serves the state of the cross-machine transport.
+type TransportHandler struct {
+	svc service.TransportService
+}
+
+// NewTransportHandler creates a new TransportHandler.
+func NewTransportHandler(svc service.TransportService) *TransportHandler {
+	return &TransportHandler{svc: svc}
+}
+
+// RegisterRoutes registers transport routes on the router group.
+func (h *TransportHandler) RegisterRoutes(rg *gin.RouterGroup) {
+	xport := rg.Group("/transport")
+	{
+		xport.GET("", h.Status)
+		xport.POST("/test", h.Test)
+	}
+}
+
+// Status handles GET /transport.
+func (h *TransportHandler) Status(c *gin.Context) {
+	c.JSON(http.StatusOK, h.svc.Status())
+}
+
+// Test handles POST /transport/test. The result is the body whatever the
+// outcome; the status code says whose fault a failure is — 503 when there is
+// no transport to test, 502 when there is one and the remote did not answer.
+func (h *TransportHandler) Test(c *gin.Context) {
+	if !h.svc.Status().Enabled {
+		c.JSON(http.StatusServiceUnavailable, h.svc.Test(c.Request.Context()))
+		return
+	}
+	res := h.svc.Test(c.Request.Context())
+	if !res.OK {
+		c.JSON(http.StatusBadGateway, res)
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
@@ -0,0 +1,58 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/slchris/qubes-air/console/internal/service"
+	"github.com/slchris/qubes-air/console/internal/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func transportRouter(xport transport.Transport) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	NewTransportHandler(service.NewTransportService(xport, "remote-dev")).RegisterRoutes(router.Group("/api/v1"))
+	return router
+}
+
+func TestTransportHandler_Status(t *testing.T) {
+	w := httptest.NewRecorder()
+	transportRouter(transport.NoopTransport{}).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/transport", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var st service.TransportStatus
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &st))
+	assert.False(t, st.Enabled)
+}
+
+func TestTransportHandler_Test(t *testing.T) {
+	tests := []struct {
+		name  string
+		xport transport.Transport
+		code  int
+	}{
+		{"answered", &transport.FakeTransport{}, http.StatusOK},
+		{"remote silent", &transport.FakeTransport{RespFn: func(string, string, []byte) ([]byte, error) {
+			return nil, errors.New("tunnel down")
+		}}, http.StatusBadGateway},
+		{"no transport", transport.NoopTransport{}, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			transportRouter(tt.xport).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/transport/test", nil))
+
+			assert.Equal(t, tt.code, w.Code)
+			var res service.TransportTestResult
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.Equal(t, tt.code == http.StatusOK, res.OK)
+			assert.Equal(t, "remote-dev", res.Target)
+		})
+	}
+}
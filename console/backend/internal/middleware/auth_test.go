@@ -100,3 +100,42 @@ func TestBearerToken(t *testing.T) {
 		assert.Equal(t, tt.want, got, "header=%q", tt.header)
 	}
 }
+
+// TestAuth_WebSocketSubprotocolToken — a browser's WebSocket carries the
+// token as a subprotocol, and only an upgrade may.
+func TestAuth_WebSocketSubprotocolToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(Auth("s3cr3t-token"))
+	r.GET("/protected", func(c *gin.Context) {
+		c.String(http.StatusOK, Operator(c))
+	})
+	get := func(upgrade, protocols string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/protected", nil)
+		if upgrade != "" {
+			req.Header.Set("Upgrade", upgrade)
+		}
+		req.Header.Set("Sec-WebSocket-Protocol", protocols)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("websocket", "qubes-air.shell, bearer.s3cr3t-token")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, TokenIdentity("s3cr3t-token"), w.Body.String())
+	assert.NotContains(t, w.Body.String(), "s3cr3t")
+
+	assert.Equal(t, http.StatusUnauthorized, get("websocket", "qubes-air.shell, bearer.wrong").Code)
+	assert.Equal(t, http.StatusUnauthorized, get("", "bearer.s3cr3t-token").Code)
+}
+
+func TestOperator_AnonymousWhenDisabled(t *testing.T) {
+	r := gin.New()
+	r.Use(Auth(""))
+	r.GET("/protected", func(c *gin.Context) { c.String(http.StatusOK, Operator(c)) })
+	req := httptest.NewRequest(http.MethodGet, "/protected", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, "anonymous", w.Body.String())
+}
@@ -49,6 +49,109 @@ type Qube struct {
 	// Carrying the real error is the point: "unreachable" alone sends an
 	// operator to SSH, "x509: certificate signed by unknown authority" does not.
 	AgentLastError string `json:"agent_last_error,omitempty"`
+	// Agent is what the agent said about itself the last time it answered:
+	// protocol version, build and capabilities. Nil until a probe has got that
+	// far. Unlike the health fields it is NOT cleared by a failed probe — an
+	// agent that stopped answering is still, as far as anyone knows, the build
+	// it last reported, and that is exactly what an operator chasing the outage
+	// wants to see.
+	Agent *AgentInfo `json:"agent,omitempty"`
+	// AgentStatus is the agent's last qubesair.Status report, nil until one
+	// has arrived. Kept across failed probes for the reason Agent is: the last
+	// thing the host said about itself is the best guess at why it went quiet.
+	AgentStatus *AgentStatus `json:"agent_status,omitempty"`
+}
+
+// AgentInfo is an agent's self-description from its transport handshake.
+type AgentInfo struct {
+	// ProtocolVersion is the wire version the console's tunnel ran at, which is
+	// the lower of the two sides' when the agent is older.
+	ProtocolVersion string `json:"protocol_version"`
+	// BuildVersion is the agent binary's version string. It never decides
+	// protocol compatibility; the console's minimum agent version is judged
+	// on it.
+	BuildVersion string            `json:"build_version,omitempty"`
+	Capabilities AgentCapabilities `json:"capabilities"`
+	// ReportedAt is when the agent last said this.
+	ReportedAt time.Time `json:"reported_at"`
+}
+
+// AgentCapabilities is the optional protocol features an agent declared, and
+// the services it exposes. An agent from before capability negotiation reports
+// none, which is accurate: it has none of them.
+type AgentCapabilities struct {
+	FrameKinds        []string `json:"frame_kinds,omitempty"`
+	FlowControl       bool     `json:"flow_control"`
+	Compression       []string `json:"compression,omitempty"`
+	Cancel            bool     `json:"cancel"`
+	StructuredResults bool     `json:"structured_results"`
+	MaxFrameSize      int      `json:"max_frame_size,omitempty"`
+	Services          []string `json:"services,omitempty"`
+}
+
+// AgentStatus is the agent's qubesair.Status report as the console stores it:
+// the wire report (internal/agentstatus) plus the console's own reading of it.
+type AgentStatus struct {
+	// ReportedAt is when the probe that fetched it ran.
+	ReportedAt          time.Time `json:"reported_at"`
+	AgentUptimeSeconds  int64     `json:"agent_uptime_seconds"`
+	SystemUptimeSeconds int64     `json:"system_uptime_seconds,omitempty"`
+	// ClockOffsetMS is the agent's clock minus the console's, measured against
+	// the middle of the call. Positive means the agent is ahead.
+	ClockOffsetMS     int64            `json:"clock_offset_ms"`
+	ClockSynchronized *bool            `json:"clock_synchronized,omitempty"`
+	RebootRequired    bool             `json:"reboot_required"`
+	CloudInit         string           `json:"cloud_init"`
+	CloudInitErrors   []string         `json:"cloud_init_errors,omitempty"`
+	Units             []AgentUnitState `json:"units"`
+	Data              *AgentDataState  `json:"data,omitempty"`
+	Disks             []AgentDiskUsage `json:"disks"`
+	// DeadMan is the agent's dead man's switch; nil from an agent without
+	// one.
+	DeadMan *AgentDeadMan `json:"dead_man,omitempty"`
+	// Problems is what made the console call this agent degraded; empty when
+	// nothing did.
+	Problems []string `json:"problems,omitempty"`
+	// Errors is what the agent could not find out.
+	Errors []string `json:"errors,omitempty"`
+}
+
+// AgentUnitState is one systemd unit on the remote.
+type AgentUnitState struct {
+	Name        string `json:"name"`
+	LoadState   string `json:"load_state"`
+	ActiveState string `json:"active_state"`
+	SubState    string `json:"sub_state"`
+}
+
+// AgentDataState is the remote's LUKS data disk.
+type AgentDataState struct {
+	Attached   bool   `json:"attached"`
+	Open       bool   `json:"open"`
+	Mounted    bool   `json:"mounted"`
+	Mount      string `json:"mount"`
+	FreeBytes  uint64 `json:"free_bytes,omitempty"`
+	TotalBytes uint64 `json:"total_bytes,omitempty"`
+}
+
+// AgentDeadMan is the remote's dead man's switch: how it is armed, when the
+// console last checked in as the agent counts it, and whether it has fired.
+type AgentDeadMan struct {
+	Enabled        bool       `json:"enabled"`
+	SilenceSeconds int64      `json:"silence_seconds,omitempty"`
+	OnRevocation   bool       `json:"on_revocation,omitempty"`
+	LastCheckIn    time.Time  `json:"last_check_in"`
+	Tripped        bool       `json:"tripped,omitempty"`
+	TrippedAt      *time.Time `json:"tripped_at,omitempty"`
+	Reason         string     `json:"reason,omitempty"`
+	LockError      string     `json:"lock_error,omitempty"`
+}
+
+// AgentDiskUsage is one filesystem's free space on the remote.
+type AgentDiskUsage struct {
+	Path       string `json:"path"`
+	FreeBytes  uint64 `json:"free_bytes"`
+	TotalBytes uint64 `json:"total_bytes"`
 }
 
 // AgentHealth is what the console knows about the agent inside a qube, as
@@ -58,8 +161,11 @@ type AgentHealth string
 // Agent health constants.
 //
 // Deliberately a small set. Every value here is something the console has
-// actually observed or honestly admits it has not; there is no "degraded" or
-// "warning" state, because nothing in the probe path can distinguish one.
+// actually observed or honestly admits it has not. For a long time there was
+// no "degraded", because nothing in the probe path could tell one apart: Ping
+// answers the same on a qube that is ready and one whose /data is still
+// locked. The qubesair.Status report can, so degraded exists now, and means
+// exactly the problems it names — never "something felt slow".
 const (
 	// AgentHealthUnknown means no probe has completed for this qube yet — a
 	// brand new qube, or one whose probes have never run. It is NOT a synonym
@@ -67,6 +173,12 @@ const (
 	AgentHealthUnknown AgentHealth = "unknown"
 	// AgentHealthHealthy means the agent answered a probe.
 	AgentHealthHealthy AgentHealth = "healthy"
+	// AgentHealthDegraded means the agent answered, and its status report
+	// shows the qube is not fit for use: /data locked on a qube that encrypts
+	// it, a configured unit not running, cloud-init failed, a disk nearly
+	// full or a clock far off. The problems are in AgentLastError, and in
+	// AgentStatus.Problems.
+	AgentHealthDegraded AgentHealth = "degraded"
 	// AgentHealthUnreachable means a probe ran and did not get an answer. The
 	// reason is in AgentLastError.
 	AgentHealthUnreachable AgentHealth = "unreachable"
@@ -87,7 +199,7 @@ const (
 // IsValid checks if the agent health value is valid.
 func (h AgentHealth) IsValid() bool {
 	switch h {
-	case AgentHealthUnknown, AgentHealthHealthy, AgentHealthUnreachable, AgentHealthStarting:
+	case AgentHealthUnknown, AgentHealthHealthy, AgentHealthDegraded, AgentHealthUnreachable, AgentHealthStarting:
 		return true
 	default:
 		return false
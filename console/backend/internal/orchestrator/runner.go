@@ -70,6 +70,16 @@ type JobStore interface {
 // finishes.
 type Completion func(ctx context.Context, j *Job)
 
+// Preparation runs on the worker goroutine immediately before a job's
+// executor call, with the job's context. What it returns is written to the
+// job's log; "" writes nothing.
+//
+// It cannot stop the job. Its use is work that should precede a teardown when
+// it can — closing an encrypted data disk before suspend destroys the VM — and
+// a teardown that waited on such work would turn a wedged agent into a qube
+// that cannot be suspended.
+type Preparation func(ctx context.Context, j *Job) string
+
 // Runner errors.
 var (
 	ErrQueueFull    = errors.New("orchestration queue is full")
@@ -88,6 +98,7 @@ var (
 type Runner struct {
 	exec    Executor
 	store   JobStore
+	before  Preparation
 	onDone  Completion
 	timeout time.Duration
 	// logs captures each job's terraform output. Nil disables it, which costs
@@ -114,8 +125,10 @@ type Runner struct {
 
 // RunnerConfig configures a Runner.
 type RunnerConfig struct {
-	Executor  Executor
-	Store     JobStore
+	Executor Executor
+	Store    JobStore
+	// BeforeRun is called before each job's executor call. Optional.
+	BeforeRun Preparation
 	OnDone    Completion
 	QueueSize int
 	Timeout   time.Duration
@@ -140,6 +153,7 @@ func NewRunner(cfg RunnerConfig) *Runner {
 	return &Runner{
 		exec:    cfg.Executor,
 		store:   cfg.Store,
+		before:  cfg.BeforeRun,
 		onDone:  cfg.OnDone,
 		timeout: cfg.Timeout,
 		logs:    cfg.Logs,
@@ -235,6 +249,14 @@ func (r *Runner) run(job *Job) {
 		}
 	}
 
+	if r.before != nil {
+		if note := r.before(ctx, job); note != "" {
+			if sink := logSinkFrom(ctx); sink != nil {
+				_, _ = fmt.Fprintf(sink, "qubes-air: %s\n", note)
+			}
+		}
+	}
+
 	var err error
 	switch job.Action {
 	case ActionProvision:
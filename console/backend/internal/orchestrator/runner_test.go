@@ -268,3 +268,46 @@ func TestRunnerQueueFullFailsFast(t *testing.T) {
 		t.Errorf("want ErrQueueFull once the queue saturates, got %v", lastErr)
 	}
 }
+
+// TestRunnerBeforeRunPrecedesTheExecutor — the lock before a suspend is only
+// worth anything if it happens while the VM still exists, and what it says
+// belongs in the job's log beside terraform's output.
+func TestRunnerBeforeRunPrecedesTheExecutor(t *testing.T) {
+	fe := NewFakeExecutor()
+	logs := newStore(t)
+	got := make(chan *Job, 1)
+	var callsBefore int
+
+	r := NewRunner(RunnerConfig{
+		Executor: fe,
+		Store:    newMemJobStore(),
+		BeforeRun: func(_ context.Context, j *Job) string {
+			callsBefore = len(fe.Calls())
+			return "data disk locked before " + string(j.Action)
+		},
+		OnDone: func(_ context.Context, j *Job) { got <- j },
+		Logs:   logs,
+	})
+	r.Start()
+	defer r.Shutdown(2 * time.Second)
+
+	job, err := r.Submit(context.Background(), "q1", "vault", ActionSuspend)
+	if err != nil {
+		t.Fatalf("submit: %v", err)
+	}
+	select {
+	case j := <-got:
+		if j.State != JobSucceeded {
+			t.Errorf("want JobSucceeded, got %q", j.State)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out")
+	}
+	if callsBefore != 0 || len(fe.Calls()) != 1 {
+		t.Errorf("executor calls: %d before the hook, %d after the job", callsBefore, len(fe.Calls()))
+	}
+	data, _, err := logs.ReadFrom(job.ID, 0, 0)
+	if err != nil || string(data) != "qubes-air: data disk locked before suspend\n" {
+		t.Errorf("job log = %q, %v", data, err)
+	}
+}
@@ -15,11 +15,22 @@ package qrexec
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"os/exec"
+	"strings"
 	"time"
 )
 
+// ErrRefused is wrapped by a Call that dom0 policy refused, as opposed to one
+// that ran and failed. The distinction matters to callers that account for
+// calls: a refusal is policy doing its job, a failure is something broken.
+var ErrRefused = errors.New("qrexec: request refused by dom0 policy")
+
+// refusedExitCode is what qrexec-client-vm exits with when dom0 refuses the
+// call; it also prints "Request refused" on stderr.
+const refusedExitCode = 126
+
 // Runner executes a single qrexec call and returns its stdout. The default
 // implementation shells out to qrexec-client-vm; tests inject a fake.
 type Runner interface {
@@ -112,7 +123,17 @@ func (execRunner) Run(ctx context.Context, target, service string, input []byte)
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
 	if err := cmd.Run(); err != nil {
-		return nil, fmt.Errorf("qrexec call failed: %v, stderr: %s", err, stderr.String())
+		return nil, runError(err, stderr.String())
 	}
 	return stdout.Bytes(), nil
 }
+
+// runError describes a failed qrexec-client-vm run, wrapping ErrRefused when
+// dom0 refused the call.
+func runError(err error, stderr string) error {
+	var exit *exec.ExitError
+	if (errors.As(err, &exit) && exit.ExitCode() == refusedExitCode) || strings.Contains(stderr, "Request refused") {
+		return fmt.Errorf("%w: %v, stderr: %s", ErrRefused, err, stderr)
+	}
+	return fmt.Errorf("qrexec call failed: %v, stderr: %s", err, stderr)
+}
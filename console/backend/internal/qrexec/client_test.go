@@ -75,3 +75,12 @@ func TestCallPropagatesRunnerError(t *testing.T) {
 		t.Errorf("err = %v, want %v", err, wantErr)
 	}
 }
+
+func TestRunErrorTellsRefusalFromFailure(t *testing.T) {
+	if err := runError(errors.New("exit status 126"), "Request refused\n"); !errors.Is(err, ErrRefused) {
+		t.Errorf("refusal not recognized: %v", err)
+	}
+	if err := runError(errors.New("exit status 1"), "service crashed"); errors.Is(err, ErrRefused) {
+		t.Errorf("failure reported as a refusal: %v", err)
+	}
+}
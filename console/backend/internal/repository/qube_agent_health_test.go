@@ -398,3 +398,89 @@ func TestMigrationIsRepeatable(t *testing.T) {
 		}
 	}
 }
+
+// TestUpdateAgentInfoSurvivesFailedProbes — what an agent declared about itself
+// round-trips, and a later failed probe does not erase it: the build that went
+// dark is the first thing an operator wants to know.
+func TestUpdateAgentInfoSurvivesFailedProbes(t *testing.T) {
+	repo, id := agentHealthEnv(t, "described", models.QubeStatusRunning)
+	ctx := context.Background()
+
+	if got, _ := repo.GetByID(ctx, id); got.Agent != nil {
+		t.Fatalf("a qube whose agent never answered must have no description, got %+v", got.Agent)
+	}
+
+	info := models.AgentInfo{
+		ProtocolVersion: "v2",
+		BuildVersion:    "1.4.0",
+		Capabilities: models.AgentCapabilities{
+			FlowControl: true, Cancel: true, MaxFrameSize: 1 << 20,
+			Services: []string{"qubesair.Exec", "qubesair.Ping"},
+		},
+		ReportedAt: time.Now().UTC().Truncate(time.Second),
+	}
+	if err := repo.UpdateAgentInfo(ctx, id, info); err != nil {
+		t.Fatalf("UpdateAgentInfo: %v", err)
+	}
+	if err := repo.UpdateAgentHealth(ctx, id, models.AgentHealthUnreachable, time.Now(), "refused"); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := repo.GetByID(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Agent == nil || got.Agent.ProtocolVersion != "v2" || got.Agent.BuildVersion != "1.4.0" ||
+		!got.Agent.Capabilities.Cancel || len(got.Agent.Capabilities.Services) != 2 ||
+		!got.Agent.ReportedAt.Equal(info.ReportedAt) {
+		t.Errorf("agent info did not survive: %+v", got.Agent)
+	}
+
+	if err := repo.UpdateAgentInfo(ctx, "no-such-qube", info); !errors.Is(err, ErrQubeNotFound) {
+		t.Errorf("unknown qube: want ErrQubeNotFound, got %v", err)
+	}
+}
+
+// TestUpdateAgentStatusAndDegradedHealth — the status report round-trips and
+// outlives a failed probe like the description does, and a degraded probe
+// counts as the agent answering: "last healthy" is when it last talked, and a
+// degraded agent talks.
+func TestUpdateAgentStatusAndDegradedHealth(t *testing.T) {
+	repo, id := agentHealthEnv(t, "reported", models.QubeStatusRunning)
+	ctx := context.Background()
+
+	st := models.AgentStatus{
+		ReportedAt:    time.Now().UTC().Truncate(time.Second),
+		ClockOffsetMS: -1200,
+		CloudInit:     "done",
+		Units:         []models.AgentUnitState{{Name: "qubes-air-helper.service", LoadState: "loaded", ActiveState: "active", SubState: "running"}},
+		Data:          &models.AgentDataState{Attached: true, Open: false, Mount: "/data"},
+		Disks:         []models.AgentDiskUsage{{Path: "/", FreeBytes: 1 << 30, TotalBytes: 8 << 30}},
+		Problems:      []string{"/data is locked"},
+	}
+	if err := repo.UpdateAgentStatus(ctx, id, st); err != nil {
+		t.Fatalf("UpdateAgentStatus: %v", err)
+	}
+	degradedAt := time.Now().UTC().Truncate(time.Second)
+	if err := repo.UpdateAgentHealth(ctx, id, models.AgentHealthDegraded, degradedAt, "/data is locked"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := repo.GetByID(ctx, id); got.AgentLastHealthyAt == nil || !got.AgentLastHealthyAt.Equal(degradedAt) {
+		t.Errorf("a degraded probe left last-healthy at %v, want %v", got.AgentLastHealthyAt, degradedAt)
+	}
+	if err := repo.UpdateAgentHealth(ctx, id, models.AgentHealthUnreachable, degradedAt.Add(time.Minute), "refused"); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := repo.GetByID(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.AgentStatus == nil || got.AgentStatus.ClockOffsetMS != -1200 || got.AgentStatus.Data == nil ||
+		got.AgentStatus.Data.Open || len(got.AgentStatus.Units) != 1 || len(got.AgentStatus.Problems) != 1 {
+		t.Errorf("agent status did not survive: %+v", got.AgentStatus)
+	}
+	if err := repo.UpdateAgentStatus(ctx, "no-such-qube", st); !errors.Is(err, ErrQubeNotFound) {
+		t.Errorf("unknown qube: want ErrQubeNotFound, got %v", err)
+	}
+}
@@ -34,6 +34,12 @@ type QubeRepository interface {
 	UpdateAgentHealth(
 		ctx context.Context, id string, health models.AgentHealth, probedAt time.Time, failure string,
 	) error
+	// UpdateAgentInfo records what the agent declared in its handshake,
+	// touching only agent_info.
+	UpdateAgentInfo(ctx context.Context, id string, info models.AgentInfo) error
+	// UpdateAgentStatus records the agent's qubesair.Status report, touching
+	// only agent_status.
+	UpdateAgentStatus(ctx context.Context, id string, st models.AgentStatus) error
 }
 
 // ErrQubeNotFound means no row exists for the given id.
@@ -46,7 +52,7 @@ var ErrQubeNotFound = errors.New("qube not found")
 // agent_* timestamp ends up scanned into the wrong field.
 const qubeColumns = `id, name, type, zone_id, status, spec, ip_address,
 		agent_health, agent_last_probed_at, agent_last_healthy_at, agent_last_error,
-		created_at, updated_at`
+		agent_info, agent_status, created_at, updated_at`
 
 // QubeListOptions contains filtering options for listing qubes.
 type QubeListOptions struct {
@@ -138,9 +144,11 @@ func (r *qubeRepository) GetByID(ctx context.Context, id string) (*models.Qube,
 func scanQube(row rowScanner) (*models.Qube, error) {
 	qube := &models.Qube{}
 	var (
-		specJSON  []byte
-		probedAt  sql.NullTime
-		healthyAt sql.NullTime
+		specJSON   []byte
+		probedAt   sql.NullTime
+		healthyAt  sql.NullTime
+		agentJSON  string
+		statusJSON string
 	)
 
 	if err := row.Scan(
@@ -155,6 +163,8 @@ func scanQube(row rowScanner) (*models.Qube, error) {
 		&probedAt,
 		&healthyAt,
 		&qube.AgentLastError,
+		&agentJSON,
+		&statusJSON,
 		&qube.CreatedAt,
 		&qube.UpdatedAt,
 	); err != nil {
@@ -166,6 +176,21 @@ func scanQube(row rowScanner) (*models.Qube, error) {
 			return nil, err
 		}
 	}
+	if agentJSON != "" {
+		// A row that cannot be decoded loses only the agent description, not
+		// the qube: it is a cache of what the agent last said, and the next
+		// probe rewrites it.
+		var info models.AgentInfo
+		if err := json.Unmarshal([]byte(agentJSON), &info); err == nil {
+			qube.Agent = &info
+		}
+	}
+	if statusJSON != "" {
+		var st models.AgentStatus
+		if err := json.Unmarshal([]byte(statusJSON), &st); err == nil {
+			qube.AgentStatus = &st
+		}
+	}
 	if probedAt.Valid {
 		t := probedAt.Time
 		qube.AgentLastProbedAt = &t
@@ -365,9 +390,10 @@ func (r *qubeRepository) ListByStatus(ctx context.Context, statuses []models.Qub
 // would quietly revert the qube to its pre-apply status. Same reasoning as
 // ClaimTransition — let SQLite arbitrate rather than a Go-side check-then-write.
 //
-// agent_last_healthy_at only advances on a healthy probe, which is what makes
-// "unreachable for the last 40 minutes" answerable. It is computed in SQL
-// rather than by reading the old value first, for the reason above.
+// agent_last_healthy_at only advances on a probe the agent answered — healthy
+// or degraded, since a degraded agent is there and talking — which is what
+// makes "unreachable for the last 40 minutes" answerable. It is computed in
+// SQL rather than by reading the old value first, for the reason above.
 //
 // updated_at is deliberately left alone. Probes run continuously, and bumping
 // it on every one would destroy its meaning as "when this qube last actually
@@ -387,14 +413,14 @@ func (r *qubeRepository) UpdateAgentHealth(
 		UPDATE qubes SET
 			agent_health = ?,
 			agent_last_probed_at = ?,
-			agent_last_healthy_at = CASE WHEN ? = ? THEN ? ELSE agent_last_healthy_at END,
+			agent_last_healthy_at = CASE WHEN ? IN (?, ?) THEN ? ELSE agent_last_healthy_at END,
 			agent_last_error = ?
 		WHERE id = ?`
 
 	res, err := r.db.DB().ExecContext(ctx, query,
 		string(health),
 		probedAt.UTC(),
-		string(health), string(models.AgentHealthHealthy), probedAt.UTC(),
+		string(health), string(models.AgentHealthHealthy), string(models.AgentHealthDegraded), probedAt.UTC(),
 		failure,
 		id,
 	)
@@ -414,6 +440,54 @@ func (r *qubeRepository) UpdateAgentHealth(
 	return nil
 }
 
+// UpdateAgentInfo records what an agent said about itself in its handshake.
+//
+// A separate writer from UpdateAgentHealth rather than another parameter to it:
+// health is written after every probe, including the ones that never reached
+// the agent, while this is written only when the agent actually answered — and
+// a failed probe must not erase the last known description. Like the health
+// columns it leaves status and updated_at alone.
+func (r *qubeRepository) UpdateAgentInfo(ctx context.Context, id string, info models.AgentInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	res, err := r.db.DB().ExecContext(ctx, `UPDATE qubes SET agent_info = ? WHERE id = ?`, string(data), id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrQubeNotFound
+	}
+	return nil
+}
+
+// UpdateAgentStatus records an agent's qubesair.Status report. A writer of its
+// own for the reason UpdateAgentInfo is: only a probe that got a report writes
+// it, and one that did not must leave the last report in place.
+func (r *qubeRepository) UpdateAgentStatus(ctx context.Context, id string, st models.AgentStatus) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	res, err := r.db.DB().ExecContext(ctx, `UPDATE qubes SET agent_status = ? WHERE id = ?`, string(data), id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrQubeNotFound
+	}
+	return nil
+}
+
 // UpdateIPAddress updates qube IP address.
 func (r *qubeRepository) UpdateIPAddress(ctx context.Context, id, ipAddress string) error {
 	query := `UPDATE qubes SET ip_address = ?, updated_at = ? WHERE id = ?`
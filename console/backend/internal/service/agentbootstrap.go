@@ -158,6 +158,15 @@ func NewAgentBootstrapper(ca CAProvider, issuer FirstCertificateIssuer, agentLis
 	}
 }
 
+// WithDialer replaces the direct dialer, e.g. with the zone registry. Nil is
+// ignored.
+func (b *AgentBootstrapper) WithDialer(d AgentDialer) *AgentBootstrapper {
+	if d != nil {
+		b.dialer = d
+	}
+	return b
+}
+
 // beginBootstrapReply is what qubesair.BeginBootstrap returns.
 type beginBootstrapReply struct {
 	Nonce  string `json:"nonce"`
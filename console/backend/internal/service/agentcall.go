@@ -0,0 +1,116 @@
+// agentcall.go — one call to a qube's agent over a verified tunnel.
+//
+// The unlocker was the first console feature that had to call an agent service
+// other than the probe's Ping, and did it inline. The config inspector is the
+// second; the dial, the short-lived client certificate and the CN pin are the
+// same for both, and the pin is exactly the part that must not drift between
+// copies. File transfer is the third, and the first to keep one tunnel for
+// many calls; the shell the first to stream over one.
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/slchris/qubes-air/console/internal/models"
+	transportgrpc "github.com/slchris/qubes-air/console/internal/transport/grpc"
+)
+
+// agentCall is who the console says it is when calling an agent, and for how
+// long its certificate is good.
+type agentCall struct {
+	ca       CAProvider
+	dialer   AgentDialer
+	relay    string
+	lifetime time.Duration
+}
+
+// call runs service on qube's agent and returns its output. The agent's
+// certificate must name agent-<qube>: whatever is sent or believed must come
+// from THIS qube's agent and no impostor at its address.
+func (a agentCall) call(ctx context.Context, qube *models.Qube, service string, in []byte) ([]byte, error) {
+	sess, err := a.open(ctx, qube)
+	if err != nil {
+		return nil, err
+	}
+	defer sess.close() // ends the client's reconnect loop with the call
+	out, err := sess.call(ctx, qube.Name, service, in)
+	if err != nil {
+		return nil, fmt.Errorf("call %s on %q: %w", service, qube.Name, err)
+	}
+	return out, nil
+}
+
+// stream runs a streaming service over the session until either side ends
+// it, waiting for the tunnel to come up first as call does. Retrying is safe:
+// CallStream refuses before it reads a byte of in.
+func (s *agentSession) stream(ctx context.Context, target, service string, in io.Reader, out io.Writer) error {
+	const retryEvery = 25 * time.Millisecond
+	for {
+		err := s.cli.CallStream(ctx, target, service, in, out)
+		if !errors.Is(err, transportgrpc.ErrNotConnected) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("tunnel to %s never established: %w", s.addr, err)
+		case <-time.After(retryEvery):
+		}
+	}
+}
+
+// peer is what the agent said about itself in this session's handshake,
+// waiting for the tunnel to come up as call does.
+func (s *agentSession) peer(ctx context.Context) (transportgrpc.PeerInfo, error) {
+	const retryEvery = 25 * time.Millisecond
+	for {
+		if info, ok := s.cli.Peer(); ok {
+			return info, nil
+		}
+		select {
+		case <-ctx.Done():
+			return transportgrpc.PeerInfo{}, fmt.Errorf("tunnel to %s never established: %w", s.addr, ctx.Err())
+		case <-time.After(retryEvery):
+		}
+	}
+}
+
+// open starts a pinned tunnel to qube's agent for a caller that makes many
+// calls — a file transfer makes hundreds — and should not pay for a
+// certificate and a handshake on each. ctx bounds the session; close ends it
+// sooner.
+func (a agentCall) open(ctx context.Context, qube *models.Qube) (*agentSession, error) {
+	if strings.TrimSpace(qube.IPAddress) == "" {
+		return nil, fmt.Errorf("qube %q has no address", qube.Name)
+	}
+	ca, err := a.ca.CA(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("no usable CA to reach %q: %w", qube.Name, err)
+	}
+	bundle, err := ca.IssueAgentCert(a.relay, a.lifetime)
+	if err != nil {
+		return nil, fmt.Errorf("mint %s client certificate: %w", a.relay, err)
+	}
+	tlsCfg, err := probeTLSConfig(bundle, AgentCommonName(qube.Name))
+	if err != nil {
+		return nil, fmt.Errorf("%s client certificate unusable: %w", a.relay, err)
+	}
+
+	addr := a.dialer.Address(qube)
+	ctx, cancel := context.WithCancel(ctx)
+	cli := transportgrpc.NewClient(transportgrpc.ClientConfig{
+		RemoteEndpoint: addr,
+		RelayName:      a.relay,
+		RemoteName:     qube.Name,
+		Dialer:         dialFuncFor(a.dialer, qube),
+		ReconnectMin:   20 * time.Millisecond,
+		ReconnectMax:   200 * time.Millisecond,
+		TLS:            tlsCfg.Clone(),
+	}, nil)
+	go func() { _ = cli.Start(ctx) }()
+	return &agentSession{cli: cli, addr: addr, cancel: cancel}, nil
+}
@@ -19,7 +19,9 @@
 //     with no inbound rule and no gateway host, authorized by IAM rather than a
 //     shared key. Those are not routes; each connection is its own tunnel.
 //
-// Only the routed dialer exists today. The interface takes the QUBE rather than
+// The routed dialer is DirectDialer. Zones we have no route to are reached
+// through a relay or jump host instead, per zone — see zonetransport.go; each
+// of those connections is its own tunnel too. The interface takes the QUBE rather than
 // a pre-formatted address on purpose: IAP addresses an instance by
 // project/zone/instance and never sees an IP, so an `addr string` parameter
 // would be the exact decision that has to be undone when the second
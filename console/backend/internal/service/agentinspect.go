@@ -0,0 +1,112 @@
+// agentinspect.go — asks a qube's agent what configuration it is running.
+//
+// An agent's configuration lives on the agent, edited by whoever provisions
+// the host and reloaded on SIGHUP, so the console cannot know it from its own
+// records. It asks instead, over the same verified channel the unlocker uses:
+// a report from an impostor at the qube's address would be worse than none.
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/slchris/qubes-air/console/internal/models"
+	transportgrpc "github.com/slchris/qubes-air/console/internal/transport/grpc"
+)
+
+const (
+	inspectRelayName    = "console-inspect"
+	inspectCertLifetime = 5 * time.Minute
+	agentConfigService  = "qubesair.AgentConfig"
+
+	// DefaultAgentInspectTimeout bounds one report: dial, handshake and a
+	// builtin that answers from memory.
+	DefaultAgentInspectTimeout = 15 * time.Second
+)
+
+// AgentConfigReport is an agent's effective configuration, as it reports it.
+// Field for field the agent's qubesair.AgentConfig answer; restated here so the
+// console does not import the agent's packages.
+type AgentConfigReport struct {
+	Source          string     `json:"source"`
+	Version         int        `json:"version"`
+	Digest          string     `json:"digest,omitempty"`
+	LoadedAt        time.Time  `json:"loaded_at"`
+	LastReloadError string     `json:"last_reload_error,omitempty"`
+	LastReloadAt    *time.Time `json:"last_reload_at,omitempty"`
+
+	ServiceDir string                  `json:"service_dir"`
+	Services   []AgentServicePolicy    `json:"services"`
+	Builtins   []string                `json:"builtins"`
+	Forwards   []transportgrpc.Forward `json:"forwards"`
+	Logging    AgentLogging            `json:"logging"`
+}
+
+// AgentLogging is what the agent logs.
+type AgentLogging struct {
+	Calls bool `json:"calls"`
+}
+
+// AgentServicePolicy is how one service runs on the agent, defaults filled in.
+type AgentServicePolicy struct {
+	Name           string `json:"name"`
+	TimeoutSeconds int    `json:"timeout_seconds"`
+	MaxOutputBytes int    `json:"max_output_bytes"`
+	RunAs          string `json:"run_as,omitempty"`
+	Arguments      string `json:"arguments,omitempty"`
+}
+
+// AgentInspector fetches agents' configuration reports.
+type AgentInspector struct {
+	ca      CAProvider
+	dialer  AgentDialer
+	timeout time.Duration
+}
+
+// NewAgentInspector builds an inspector that dials agents at agentListen.
+func NewAgentInspector(ca CAProvider, agentListen string, timeout time.Duration) *AgentInspector {
+	if timeout <= 0 {
+		timeout = DefaultAgentInspectTimeout
+	}
+	return &AgentInspector{ca: ca, dialer: NewDirectDialer(agentListen), timeout: timeout}
+}
+
+// WithDialer replaces the direct dialer, e.g. with the zone registry. Nil is
+// ignored.
+func (i *AgentInspector) WithDialer(d AgentDialer) *AgentInspector {
+	if d != nil {
+		i.dialer = d
+	}
+	return i
+}
+
+// AgentConfig asks qube's agent for its effective configuration.
+//
+// An agent too old to have the builtin answers that it has no such service;
+// that comes back as an error like any other, and says which.
+func (i *AgentInspector) AgentConfig(ctx context.Context, qube *models.Qube) (*AgentConfigReport, error) {
+	if i == nil || i.ca == nil {
+		return nil, errors.New("no agent inspector configured")
+	}
+	if qube == nil {
+		return nil, errors.New("no qube given")
+	}
+	ctx, cancel := context.WithTimeout(ctx, i.timeout)
+	defer cancel()
+
+	out, err := agentCall{ca: i.ca, dialer: i.dialer, relay: inspectRelayName, lifetime: inspectCertLifetime}.
+		call(ctx, qube, agentConfigService, nil)
+	if err != nil {
+		return nil, err
+	}
+	var r AgentConfigReport
+	if err := json.Unmarshal(out, &r); err != nil {
+		return nil, fmt.Errorf("unparseable %s reply from %q: %v (%q)",
+			agentConfigService, qube.Name, err, strings.TrimSpace(string(out)))
+	}
+	return &r, nil
+}
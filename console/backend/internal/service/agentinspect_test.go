@@ -0,0 +1,63 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/slchris/qubes-air/console/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// configInvoker answers qubesair.AgentConfig with a fixed report.
+type configInvoker struct{ report string }
+
+func (c configInvoker) Invoke(_ context.Context, _, service string, _ []byte) ([]byte, error) {
+	if service != agentConfigService {
+		return nil, errors.New("no such qrexec service")
+	}
+	return []byte(c.report), nil
+}
+
+func TestAgentInspector_ReadsTheReport(t *testing.T) {
+	ca := newCA(t)
+	addr, _ := startAgent(t, ca, ca, "agent-inspected", configInvoker{report: `{
+		"source": "/etc/qubes-air/agent.yaml", "version": 1, "digest": "abc",
+		"last_reload_error": "unknown field timeout",
+		"services": [{"name": "qubesair.Ping", "timeout_seconds": 120, "max_output_bytes": 16777216}],
+		"forwards": [{"name": "ssh", "port": 22}],
+		"logging": {"calls": true}
+	}`})
+	host, port := hostPort(t, addr)
+
+	r, err := NewAgentInspector(staticCA{ca: ca}, "0.0.0.0:"+port, 10*time.Second).
+		AgentConfig(context.Background(), &models.Qube{Name: "inspected", IPAddress: host})
+	require.NoError(t, err)
+	assert.Equal(t, "/etc/qubes-air/agent.yaml", r.Source)
+	assert.Equal(t, "unknown field timeout", r.LastReloadError)
+	require.Len(t, r.Services, 1)
+	assert.Equal(t, 120, r.Services[0].TimeoutSeconds)
+	require.Len(t, r.Forwards, 1)
+	assert.Equal(t, 22, r.Forwards[0].Port)
+	assert.True(t, r.Logging.Calls)
+}
+
+// TestAgentInspector_PinsTheAgent — a report is only worth showing if it came
+// from the qube's own agent.
+func TestAgentInspector_PinsTheAgent(t *testing.T) {
+	ca := newCA(t)
+	addr, _ := startAgent(t, ca, ca, "agent-someone-else", configInvoker{report: `{}`})
+	host, port := hostPort(t, addr)
+
+	_, err := NewAgentInspector(staticCA{ca: ca}, "0.0.0.0:"+port, 2*time.Second).
+		AgentConfig(context.Background(), &models.Qube{Name: "inspected", IPAddress: host})
+	require.Error(t, err)
+}
+
+func TestAgentInspector_RefusesWithoutAddress(t *testing.T) {
+	_, err := NewAgentInspector(unreachedCA{t}, "0.0.0.0:8443", time.Second).
+		AgentConfig(context.Background(), &models.Qube{Name: "no-ip"})
+	require.Error(t, err)
+}
@@ -6,9 +6,11 @@ import (
 	"crypto/x509"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/slchris/qubes-air/console/internal/models"
@@ -35,7 +37,8 @@ const (
 	// being built, or terraform never learned its address.
 	AgentProbeNoAddress AgentProbeStatus = "no_address"
 	// AgentProbeUnreachable means the address exists but TCP did not connect:
-	// refused, filtered, or timed out. The agent is not listening.
+	// refused, filtered, or timed out — or the link dropped before TLS was
+	// through. The agent is not listening, or cannot be reached.
 	AgentProbeUnreachable AgentProbeStatus = "unreachable"
 	// AgentProbeTLSRejected means TCP connected but the TLS handshake failed.
 	// Something IS listening, so this is a trust problem — a wrong CA, an
@@ -156,6 +159,17 @@ type AgentProbeResult struct {
 	// string. Identity is established cryptographically by the common-name check
 	// in verifyAgentChain; this payload is a configuration cross-check.
 	Pong string `json:"pong,omitempty"`
+	// Agent is what the agent declared in its handshake — protocol version,
+	// build, capabilities and exposed services. Set only when the tunnel came
+	// up, which on a failed Ping can still be the case.
+	Agent *transportgrpc.PeerInfo `json:"agent,omitempty"`
+	// Report is the agent's qubesair.Status report, read after Ping answered
+	// when the agent advertises the service. Its Problems are what makes a
+	// reachable agent degraded rather than healthy.
+	Report *models.AgentStatus `json:"agent_status,omitempty"`
+	// ReportError is why there is no Report from an agent that offers one. It
+	// never fails the probe: Ping answered, and that is what reachable means.
+	ReportError string `json:"agent_status_error,omitempty"`
 	// Reason explains a non-ok status in terms an operator can act on. Empty on
 	// success.
 	Reason string `json:"reason,omitempty"`
@@ -219,6 +233,15 @@ func NewAgentProber(ca CAProvider, certs LastSeenRecorder, agentListen string, t
 	}
 }
 
+// WithDialer replaces the direct dialer, e.g. with the zone registry. Nil is
+// ignored.
+func (p *AgentProber) WithDialer(d AgentDialer) *AgentProber {
+	if d != nil {
+		p.dialer = d
+	}
+	return p
+}
+
 // Probe checks one qube's agent and returns what it found.
 //
 // It deliberately returns no error. A probe that says "no answer" has succeeded
@@ -318,7 +341,8 @@ func (p *AgentProber) Probe(ctx context.Context, qube *models.Qube) AgentProbeRe
 	// is the part that a "running" status derived from intent can never tell
 	// you: the package can be missing, the unit dead, the service script absent,
 	// and everything up to this line still succeeds.
-	out, err := p.ping(ctx, qube, addr, tlsCfg, qube.Name)
+	cli, out, peer, err := p.ping(ctx, qube, addr, tlsCfg, qube.Name)
+	res.Agent = peer
 	if err != nil {
 		return done(AgentProbeRPCFailed,
 			"mTLS to %s succeeded but %s did not answer: %v", addr, pingService, err)
@@ -332,13 +356,20 @@ func (p *AgentProber) Probe(ctx context.Context, qube *models.Qube) AgentProbeRe
 	// one signal that is supposed to reveal it.
 	if p.authz != nil && res.AgentCertFingerprint != "" {
 		if _, err := p.authz.Authorize(ctx, res.AgentCertFingerprint); err != nil {
+			told := ""
+			if errors.Is(err, repository.ErrCertRevoked) {
+				told = p.tellRevoked(ctx, cli, qube, peer)
+			}
 			return done(AgentProbeTLSRejected,
-				"agent at %s presented certificate %s which the registry refuses: %v",
-				addr, res.AgentCertFingerprint[:16], err)
+				"agent at %s presented certificate %s which the registry refuses: %v%s",
+				addr, res.AgentCertFingerprint[:16], err, told)
 		}
 	}
 
 	p.touchLastSeen(ctx, res)
+	// Only now, with the agent answering and its certificate authorized: a
+	// report from an agent the registry refuses is not worth reading.
+	res.Report, res.ReportError = p.report(ctx, cli, qube, peer)
 	return done(AgentProbeOK, "")
 }
 
@@ -365,6 +396,20 @@ func (p *AgentProber) connect(ctx context.Context, qube *models.Qube, addr strin
 			return nil, AgentProbeUnreachable, fmt.Sprintf(
 				"%s accepted TCP but the TLS handshake never completed within %s: %v", addr, p.timeout, err)
 		}
+		// A relayed dial only learns the far end failed once it reads; that is
+		// still nothing listening, not a rejected certificate.
+		if errors.Is(err, ErrAgentUnreachable) {
+			return nil, AgentProbeUnreachable, fmt.Sprintf(
+				"nothing is listening on %s: %v (the agent unit is not running, or the relay cannot reach it)", addr, err)
+		}
+		// A handshake cut off mid-record, or reset, is the link failing, not
+		// the peer refusing us: a TLS peer that rejects says so with an alert.
+		// A clean EOF between records is left a rejection — that is what a
+		// non-TLS service hanging up on us looks like.
+		if isLinkCut(err) {
+			return nil, AgentProbeUnreachable, fmt.Sprintf(
+				"%s accepted TCP but the link was cut during the TLS handshake: %v (a flaky network, not a certificate problem)", addr, err)
+		}
 		return nil, AgentProbeTLSRejected, fmt.Sprintf(
 			"%s is listening but the mTLS handshake failed: %v "+
 				"(something IS running there — check the agent's certificate and CA, not the unit)", addr, err)
@@ -379,8 +424,13 @@ func (p *AgentProber) connect(ctx context.Context, qube *models.Qube, addr strin
 	return state.PeerCertificates[0], AgentProbeOK, ""
 }
 
-// ping runs qubesair.Ping over a tunnel to this one qube.
-func (p *AgentProber) ping(ctx context.Context, qube *models.Qube, addr string, tlsCfg *tls.Config, remoteName string) ([]byte, error) {
+// ping runs qubesair.Ping over a tunnel to this one qube. It also returns what
+// the agent said about itself in the handshake, nil if the tunnel never came
+// up, and the client, whose tunnel lasts as long as ctx for the status call
+// that follows.
+func (p *AgentProber) ping(
+	ctx context.Context, qube *models.Qube, addr string, tlsCfg *tls.Config, remoteName string,
+) (*transportgrpc.Client, []byte, *transportgrpc.PeerInfo, error) {
 	cli := transportgrpc.NewClient(transportgrpc.ClientConfig{
 		RemoteEndpoint: addr,
 		RelayName:      probeRelayName,
@@ -408,20 +458,29 @@ func (p *AgentProber) ping(ctx context.Context, qube *models.Qube, addr string,
 	for {
 		out, err := cli.Call(ctx, remoteName, pingService, nil)
 		if err == nil {
-			return out, nil
+			return cli, out, peerOf(cli), nil
 		}
 		lastErr = err
 		if !errors.Is(err, transportgrpc.ErrNotConnected) {
-			return nil, err
+			return cli, nil, peerOf(cli), err
 		}
 		select {
 		case <-ctx.Done():
-			return nil, fmt.Errorf("tunnel never established: %w", lastErr)
+			return cli, nil, nil, fmt.Errorf("tunnel never established: %w", lastErr)
 		case <-time.After(retryEvery):
 		}
 	}
 }
 
+// peerOf returns the client's current peer, nil when it has no tunnel.
+func peerOf(cli *transportgrpc.Client) *transportgrpc.PeerInfo {
+	peer, ok := cli.Peer()
+	if !ok {
+		return nil
+	}
+	return &peer
+}
+
 // touchLastSeen records that this agent's certificate was observed working.
 //
 // Only on a full success, and deliberately so. A handshake alone proves the
@@ -597,6 +656,13 @@ func isTimeout(err error) bool {
 	return errors.As(err, &nerr) && nerr.Timeout()
 }
 
+// isLinkCut reports whether err is the connection dying under us rather than
+// anything the peer said.
+func isLinkCut(err error) bool {
+	return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNABORTED) || errors.Is(err, syscall.EPIPE)
+}
+
 // shortFingerprint abbreviates a fingerprint for logs. The full value is a
 // database key, not a secret, but 64 hex characters per line buries everything
 // around it.
@@ -179,6 +179,10 @@ func TestProbe_AgentAnswers(t *testing.T) {
 	assert.Contains(t, res.Pong, "probe-qube")
 	assert.Equal(t, addr, res.Address)
 	assert.Positive(t, res.Duration)
+	// The agent's handshake self-description comes back with the answer.
+	require.NotNil(t, res.Agent)
+	assert.NotEmpty(t, res.Agent.ProtocolVersion)
+	assert.True(t, res.Agent.Capabilities.Cancel)
 
 	// The fingerprint must identify the AGENT's certificate — the one in the
 	// registry — not the throwaway client certificate the probe minted.
@@ -0,0 +1,149 @@
+package service
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/slchris/qubes-air/console/internal/agentupdate"
+	transportgrpc "github.com/slchris/qubes-air/console/internal/transport/grpc"
+)
+
+// agentArch is the architecture the console provisions qubes for. A guest
+// picks its own package out of a manifest; this is only which one the console
+// names as "the" package — the default for updates, and what resolve checks.
+const agentArch = "amd64"
+
+// manifestFetchTimeout bounds one fetch of a release manifest and its
+// signature. Both are a few hundred bytes.
+const manifestFetchTimeout = 30 * time.Second
+
+// maxManifestBytes bounds a manifest: a handful of lines.
+const maxManifestBytes = 64 << 10
+
+// resolveManifest returns p with URL, SHA256 and Version taken from its
+// release manifest, after checking the manifest's signature against the
+// release key. Without a ManifestURL p is returned as it is.
+//
+// Every way a manifest can be wrong is an error rather than a reason for
+// resolve: a console configured with a manifest and unable to stand behind
+// it must not quietly fall back to the unsigned path.
+func (p AgentPackage) resolveManifest() (AgentPackage, error) {
+	if p.ManifestURL == "" {
+		return p, nil
+	}
+	if len(p.Manifest) == 0 {
+		return p, fmt.Errorf("%s has not been fetched", p.ManifestURL)
+	}
+	key, err := agentupdate.ParsePublicKey(p.UpdateKey)
+	if err != nil {
+		return p, fmt.Errorf("release key: %w", err)
+	}
+	m, err := agentupdate.VerifyManifest([]ed25519.PublicKey{key}, p.Manifest, p.ManifestSig)
+	if err != nil {
+		return p, fmt.Errorf("%s: %w", p.ManifestURL, err)
+	}
+	// A package whose agent cannot run a tunnel at any version this console
+	// offers would boot into an agent nobody can reach. Whether a given qube's
+	// link gets there is the updater's check, against what its agent reports.
+	if !agentupdate.ProtocolAtLeast(transportgrpc.ProtocolVersion, m.MinProtocol) {
+		return p, fmt.Errorf("%s needs wire protocol %s; this console speaks up to %s",
+			p.ManifestURL, m.MinProtocol, transportgrpc.ProtocolVersion)
+	}
+	if p.Version != "" && p.Version != m.Version {
+		return p, fmt.Errorf("%s is version %s, not the configured %s", p.ManifestURL, m.Version, p.Version)
+	}
+	pkg, ok := m.Packages[agentArch]
+	if !ok {
+		return p, fmt.Errorf("%s has no %s package", p.ManifestURL, agentArch)
+	}
+	p.URL = manifestBaseURL(p.ManifestURL) + pkg.File
+	p.SHA256 = pkg.SHA256
+	p.Version = m.Version
+	p.MinProtocol = m.MinProtocol
+	return p, nil
+}
+
+// manifestBaseURL is the directory a manifest's file names are relative to.
+func manifestBaseURL(manifestURL string) string {
+	return manifestURL[:strings.LastIndex(manifestURL, "/")+1]
+}
+
+// releaseKeyPEM is the release key in the form the guest's openssl reads.
+func releaseKeyPEM(b64 string) (string, error) {
+	key, err := agentupdate.ParsePublicKey(b64)
+	if err != nil {
+		return "", fmt.Errorf("release key: %w", err)
+	}
+	return agentupdate.PublicKeyPEM(key)
+}
+
+// FetchAgentManifest downloads a release manifest and its detached signature.
+// Neither is trusted here; resolveManifest is what checks them.
+func FetchAgentManifest(ctx context.Context, client *http.Client, url string) (manifest, sig []byte, err error) {
+	if client == nil {
+		client = &http.Client{Timeout: manifestFetchTimeout}
+	}
+	if manifest, err = fetchSmall(ctx, client, url); err != nil {
+		return nil, nil, err
+	}
+	if sig, err = fetchSmall(ctx, client, url+agentupdate.SignatureSuffix); err != nil {
+		return nil, nil, err
+	}
+	return manifest, sig, nil
+}
+
+func fetchSmall(ctx context.Context, client *http.Client, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxManifestBytes {
+		return nil, errors.New(url + " is larger than a release manifest can be")
+	}
+	return data, nil
+}
+
+// AgentPackage is the package new qubes get, with a release manifest fetched
+// and checked when one is configured.
+//
+// The manifest is fetched the first time it is needed and kept once it
+// verifies, so a console started while the artifact store was down recovers
+// on the next provision rather than on the next restart. One that does not
+// verify is not kept, and nothing is rendered until one does.
+func (c *CertIssuer) AgentPackage(ctx context.Context) (AgentPackage, error) {
+	c.pkgMu.Lock()
+	defer c.pkgMu.Unlock()
+	pkg := c.agentPkg
+	if pkg.ManifestURL == "" || len(pkg.Manifest) > 0 {
+		return pkg.resolveManifest()
+	}
+	manifest, sig, err := FetchAgentManifest(ctx, nil, pkg.ManifestURL)
+	if err != nil {
+		return pkg, fmt.Errorf("fetch release manifest: %w", err)
+	}
+	pkg.Manifest, pkg.ManifestSig = manifest, sig
+	resolved, err := pkg.resolveManifest()
+	if err != nil {
+		return pkg, err
+	}
+	c.agentPkg = pkg
+	return resolved, nil
+}
@@ -0,0 +1,162 @@
+package service
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/slchris/qubes-air/console/internal/agentupdate"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testManifestURL = "http://10.31.0.2/local/qubes-air/release-manifest"
+
+// testRelease signs a manifest for testPkgPayload, the way
+// sign-agent-package -manifest does.
+type testRelease struct {
+	pub      string
+	priv     ed25519.PrivateKey
+	manifest []byte
+	sig      []byte
+}
+
+func newTestRelease(t *testing.T, minProtocol string) testRelease {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	m := agentupdate.Manifest{Version: "0.2.0", MinProtocol: minProtocol, Packages: map[string]agentupdate.ManifestPackage{
+		"amd64": {File: "qubes-air-agent_0.2.0_amd64.deb", SHA256: testPkgSHA()},
+	}}
+	data := m.Marshal()
+	return testRelease{
+		pub:      base64.StdEncoding.EncodeToString(pub),
+		priv:     priv,
+		manifest: data,
+		sig:      []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(priv, data)) + "\n"),
+	}
+}
+
+func (r testRelease) pkg() AgentPackage {
+	return AgentPackage{UpdateKey: r.pub, ManifestURL: testManifestURL, Manifest: r.manifest, ManifestSig: r.sig}
+}
+
+func (r testRelease) keyPEM(t *testing.T) string {
+	t.Helper()
+	pem, err := releaseKeyPEM(r.pub)
+	require.NoError(t, err)
+	return pem
+}
+
+func requireOpenSSL(t *testing.T) {
+	t.Helper()
+	if _, err := exec.LookPath("openssl"); err != nil {
+		t.Skip("no openssl to check the manifest with")
+	}
+}
+
+// TestSignedManifestDecidesThePackage — with a manifest, the console's URL and
+// digest are replaced by the signed ones, and the guest checks the signature
+// itself before it downloads anything.
+func TestSignedManifestDecidesThePackage(t *testing.T) {
+	requireOpenSSL(t)
+	rel := newTestRelease(t, "v1")
+	out, _ := renderWith(t, rel.pkg())
+	cc := parseConfig(t, out)
+	assert.Equal(t, string(rel.manifest), fileContent(t, cc, agentManifestPath),
+		"the manifest must arrive byte for byte, or its signature cannot verify")
+	assert.Contains(t, out, "  - openssl\n")
+
+	run := runInstaller(t, out, "0")
+	assert.Equal(t, 0, run.code, "a verified manifest must install: %s", run.output)
+	assert.True(t, run.installed(), run.calls)
+	assert.Contains(t, run.calls, "http://10.31.0.2/local/qubes-air/qubes-air-agent_0.2.0_amd64.deb",
+		"the package is fetched from beside the manifest")
+	assert.Contains(t, run.output, "release manifest verified")
+}
+
+// TestTamperedManifestNeverReachesDpkg — a snippet edited after the console
+// rendered it: the digest in the manifest no longer matches its signature.
+func TestTamperedManifestNeverReachesDpkg(t *testing.T) {
+	requireOpenSSL(t)
+	rel := newTestRelease(t, "v1")
+	out, _ := renderWith(t, rel.pkg())
+	out = strings.Replace(out, "sha256 amd64 "+testPkgSHA(), "sha256 amd64 "+strings.Repeat("ab", 32), 1)
+
+	run := runInstaller(t, out, "0")
+	assert.NotEqual(t, 0, run.code)
+	assert.False(t, run.installed(), "dpkg must never see a package from a forged manifest: %s", run.calls)
+	assert.NotContains(t, run.calls, "curl", "nothing is downloaded on a forged manifest's say-so")
+	assert.Contains(t, run.marker, "does not verify")
+}
+
+// TestImageKeyWinsOverTheDeliveredOne — whoever can rewrite the snippet can
+// replace the manifest, its signature and the delivered key together. Only a
+// key the image carries stops that.
+func TestImageKeyWinsOverTheDeliveredOne(t *testing.T) {
+	requireOpenSSL(t)
+	genuine := newTestRelease(t, "v1")
+	forger := newTestRelease(t, "v1")
+	out, _ := renderWith(t, forger.pkg())
+
+	run := runInstallerWithImageKey(t, out, "0", "", genuine.keyPEM(t))
+	assert.NotEqual(t, 0, run.code)
+	assert.False(t, run.installed(), run.calls)
+	assert.Contains(t, run.marker, "image-release-key.pem", "the refusal names the key that was used")
+}
+
+// TestConsoleRefusesToRenderAnUnverifiedManifest — the console is the first
+// place to catch it, before a qube boots into a loud failure.
+func TestConsoleRefusesToRenderAnUnverifiedManifest(t *testing.T) {
+	id, _ := testIdentityDoc(t)
+	rel := newTestRelease(t, "v1")
+	other := newTestRelease(t, "v1")
+
+	for name, pkg := range map[string]AgentPackage{
+		"signed by another key": func() AgentPackage { p := rel.pkg(); p.UpdateKey = other.pub; return p }(),
+		"signature missing":     func() AgentPackage { p := rel.pkg(); p.ManifestSig = nil; return p }(),
+		"not fetched":           func() AgentPackage { p := rel.pkg(); p.Manifest = nil; return p }(),
+		"newer protocol":        newTestRelease(t, "v3").pkg(),
+		"other version pinned":  func() AgentPackage { p := rel.pkg(); p.Version = "0.1.0"; return p }(),
+	} {
+		_, err := RenderAgentUserData("remote-dev", id, "0.0.0.0:8443", pkg, false)
+		assert.Error(t, err, name)
+	}
+}
+
+// TestAgentPackageFetchesTheManifestOnce — fetched on first use, kept once it
+// verifies, so the artifact store is not asked on every provision.
+func TestAgentPackageFetchesTheManifestOnce(t *testing.T) {
+	rel := newTestRelease(t, "v1")
+	fetches := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		switch r.URL.Path {
+		case "/qubes-air/release-manifest":
+			_, _ = w.Write(rel.manifest)
+		case "/qubes-air/release-manifest.sig":
+			_, _ = w.Write(rel.sig)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	issuer := NewCertIssuer(nil, nil, "", "", AgentPackage{
+		UpdateKey: rel.pub, ManifestURL: srv.URL + "/qubes-air/release-manifest",
+	})
+	for range 2 {
+		pkg, err := issuer.AgentPackage(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, srv.URL+"/qubes-air/qubes-air-agent_0.2.0_amd64.deb", pkg.URL)
+		assert.Equal(t, testPkgSHA(), pkg.SHA256)
+		assert.Equal(t, "0.2.0", pkg.Version)
+		assert.Equal(t, "v1", pkg.MinProtocol, "the minimum travels with the package to the updater")
+	}
+	assert.Equal(t, 2, fetches, "the manifest and its signature, once")
+}
@@ -0,0 +1,202 @@
+// agentreport.go — what a probe learns past "the agent answered".
+//
+// Ping says the agent is up and nothing about the host it runs on, and so the
+// console could not tell a qube that is ready from one whose agent answers
+// while /data is still locked. The prober now asks qubesair.Status on the same
+// tunnel, after Ping, of an agent that advertises it, and this file reads the
+// report: which of what it says makes the qube unfit for use. Those problems
+// are what turns healthy into degraded; nothing else does.
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/slchris/qubes-air/console/internal/agentstatus"
+	"github.com/slchris/qubes-air/console/internal/deadman"
+	"github.com/slchris/qubes-air/console/internal/models"
+	transportgrpc "github.com/slchris/qubes-air/console/internal/transport/grpc"
+)
+
+const (
+	// minFreeFraction is the free space below which a filesystem is a
+	// problem. A fraction rather than a size: 5% of a 20 GB root disk and of
+	// a 2 TB data disk are both "about to fill".
+	minFreeFraction = 0.05
+	// maxClockOffset is the clock difference that is a problem. Certificates
+	// are minted five minutes backdated to absorb skew (internal/pki); a
+	// minute is well inside that, and early enough to fix before a renewed
+	// certificate is refused as not yet valid.
+	maxClockOffset = time.Minute
+)
+
+// report asks the agent for its status over the probe's tunnel. It returns
+// nil and no error for an agent that does not advertise the service — an
+// older build, or one trimmed to Ping — since there is nothing wrong with it.
+func (p *AgentProber) report(
+	ctx context.Context, cli *transportgrpc.Client, qube *models.Qube, peer *transportgrpc.PeerInfo,
+) (*models.AgentStatus, string) {
+	if cli == nil || peer == nil || !slices.Contains(peer.Capabilities.Services, agentstatus.Service) {
+		return nil, ""
+	}
+	before := time.Now()
+	out, err := cli.Call(ctx, qube.Name, agentstatus.Service, nil)
+	after := time.Now()
+	if err != nil {
+		log.Printf("agentprobe: qube %q answered %s but not %s: %v", qube.Name, pingService, agentstatus.Service, err)
+		return nil, fmt.Sprintf("%s failed: %v", agentstatus.Service, err)
+	}
+	var r agentstatus.Report
+	if err := json.Unmarshal(out, &r); err != nil {
+		return nil, fmt.Sprintf("%s answered with an unreadable report: %v", agentstatus.Service, err)
+	}
+	// The agent read its clock somewhere inside the call; the middle is the
+	// best guess at where, and is off by at most half the round trip.
+	mid := before.Add(after.Sub(before) / 2)
+	st := agentStatusFrom(r, r.Time.Sub(mid), after.UTC())
+	st.Problems = statusProblems(qube, st)
+	return st, ""
+}
+
+// tellRevoked tells an agent whose certificate the registry has revoked, over
+// the tunnel the probe already holds, so that its dead man's switch can lock
+// the data disk (internal/deadman). It is the last thing the console says to
+// that agent, and the only way the agent learns it: an agent keeps no
+// revocation list, and a revoked one is otherwise simply never called again —
+// which its switch would only notice after the silence limit, if it has one.
+// What the agent answered is returned for the probe's reason.
+func (p *AgentProber) tellRevoked(
+	ctx context.Context, cli *transportgrpc.Client, qube *models.Qube, peer *transportgrpc.PeerInfo,
+) string {
+	if cli == nil || peer == nil || !slices.Contains(peer.Capabilities.Services, deadman.Service) {
+		return ""
+	}
+	in, _ := json.Marshal(deadman.Request{Revoked: true})
+	out, err := cli.Call(ctx, qube.Name, deadman.Service, in)
+	if err != nil {
+		log.Printf("agentprobe: qube %q: telling the agent its certificate is revoked: %v", qube.Name, err)
+		return fmt.Sprintf("; telling the agent failed: %v", err)
+	}
+	var st agentstatus.DeadMan
+	if err := json.Unmarshal(out, &st); err != nil {
+		return fmt.Sprintf("; the agent was told and answered unreadably: %v", err)
+	}
+	switch {
+	case st.Tripped && st.LockError != "":
+		return "; the agent was told, and its dead man's switch has tripped but not yet locked the data disk: " + st.LockError
+	case st.Tripped:
+		log.Printf("agentprobe: qube %q: told of its revocation, the agent locked its data disk", qube.Name)
+		return "; the agent was told, and its dead man's switch has locked the data disk"
+	default:
+		return "; the agent was told, and its dead man's switch does not lock on revocation"
+	}
+}
+
+// agentStatusFrom is the report in the console's terms.
+func agentStatusFrom(r agentstatus.Report, offset time.Duration, reportedAt time.Time) *models.AgentStatus {
+	st := &models.AgentStatus{
+		ReportedAt:          reportedAt,
+		AgentUptimeSeconds:  r.AgentUptimeSeconds,
+		SystemUptimeSeconds: r.SystemUptimeSeconds,
+		ClockOffsetMS:       offset.Milliseconds(),
+		ClockSynchronized:   r.ClockSynchronized,
+		RebootRequired:      r.RebootRequired,
+		CloudInit:           r.CloudInit.Status,
+		CloudInitErrors:     r.CloudInit.Errors,
+		Units:               make([]models.AgentUnitState, 0, len(r.Units)),
+		Disks:               make([]models.AgentDiskUsage, 0, len(r.Disks)),
+		Errors:              r.Errors,
+	}
+	for _, u := range r.Units {
+		st.Units = append(st.Units, models.AgentUnitState(u))
+	}
+	for _, d := range r.Disks {
+		st.Disks = append(st.Disks, models.AgentDiskUsage(d))
+	}
+	if r.Data != nil {
+		d := models.AgentDataState(*r.Data)
+		st.Data = &d
+	}
+	if r.DeadMan != nil {
+		dm := models.AgentDeadMan(*r.DeadMan)
+		st.DeadMan = &dm
+	}
+	return st
+}
+
+// statusProblems is what in a report makes qube unfit for use, in words an
+// operator can act on.
+//
+// A tripped dead man's switch is one, and said apart from the locked disk it
+// caused: "/data is locked" alone would send an operator to unlock a disk the
+// agent locked on purpose, without asking why.
+//
+// Deliberately not here: a pending reboot (the qube works, and rebooting it is
+// the operator's call), an unsynchronised clock that is nonetheless close (the
+// offset is what matters), and what the agent could not find out (a check
+// that could not run is not a problem found). A data disk on a qube that does
+// not encrypt its data is not judged either — there is nothing to unlock.
+func statusProblems(qube *models.Qube, st *models.AgentStatus) []string {
+	var problems []string
+	if d := st.Data; d != nil && qube.Spec.EncryptsData() {
+		switch {
+		case !d.Attached:
+			problems = append(problems, "no data disk is attached")
+		case !d.Open:
+			problems = append(problems, d.Mount+" is locked")
+		case !d.Mounted:
+			problems = append(problems, "the data disk is unlocked but "+d.Mount+" is not mounted")
+		}
+	}
+	if dm := st.DeadMan; dm != nil && dm.Tripped {
+		msg := "the dead man's switch tripped: " + dm.Reason
+		if dm.LockError != "" {
+			msg += "; the data disk is still open: " + dm.LockError
+		}
+		problems = append(problems, msg)
+	}
+	for _, u := range st.Units {
+		switch {
+		case u.LoadState == "not-found":
+			problems = append(problems, "unit "+u.Name+" is not installed")
+		case u.ActiveState != "active" && u.ActiveState != "reloading":
+			problems = append(problems, fmt.Sprintf("unit %s is %s (%s)", u.Name, u.ActiveState, u.SubState))
+		}
+	}
+	if st.CloudInit == agentstatus.CloudInitError {
+		msg := "cloud-init finished with errors"
+		if len(st.CloudInitErrors) > 0 {
+			msg += ": " + st.CloudInitErrors[0]
+		}
+		problems = append(problems, msg)
+	}
+	full := func(path string, free, total uint64) {
+		if total > 0 && float64(free) < minFreeFraction*float64(total) {
+			problems = append(problems, fmt.Sprintf("%s is %.0f%% full", path, 100-100*float64(free)/float64(total)))
+		}
+	}
+	for _, d := range st.Disks {
+		full(d.Path, d.FreeBytes, d.TotalBytes)
+	}
+	if d := st.Data; d != nil && d.Mounted && !slices.ContainsFunc(st.Disks, func(u models.AgentDiskUsage) bool { return u.Path == d.Mount }) {
+		full(d.Mount, d.FreeBytes, d.TotalBytes)
+	}
+	if offset := time.Duration(st.ClockOffsetMS) * time.Millisecond; offset > maxClockOffset || offset < -maxClockOffset {
+		dir := "ahead of"
+		if offset < 0 {
+			dir, offset = "behind", -offset
+		}
+		problems = append(problems, fmt.Sprintf("clock is %s %s the console's", offset.Round(time.Second), dir))
+	}
+	return problems
+}
+
+// degradedReason is the agent_last_error of a degraded qube.
+func degradedReason(st *models.AgentStatus) string {
+	return strings.Join(st.Problems, "; ")
+}
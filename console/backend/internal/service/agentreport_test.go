@@ -0,0 +1,221 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/slchris/qubes-air/console/internal/agentstatus"
+	"github.com/slchris/qubes-air/console/internal/deadman"
+	"github.com/slchris/qubes-air/console/internal/models"
+	"github.com/slchris/qubes-air/console/internal/repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// statusInvoker is an agent that answers Ping and, unless statusErr is set,
+// qubesair.Status with report. It advertises both.
+type statusInvoker struct {
+	report    agentstatus.Report
+	statusErr error
+}
+
+func (s *statusInvoker) Invoke(_ context.Context, target, service string, _ []byte) ([]byte, error) {
+	switch service {
+	case pingService:
+		return []byte("pong " + target), nil
+	case agentstatus.Service:
+		if s.statusErr != nil {
+			return nil, s.statusErr
+		}
+		r := s.report
+		r.Time = time.Now().UTC()
+		return json.Marshal(r)
+	}
+	return nil, errors.New("no such qrexec service")
+}
+
+func (s *statusInvoker) Services() []string { return []string{pingService, agentstatus.Service} }
+
+func encrypted() models.QubeSpec {
+	yes := true
+	return models.QubeSpec{EncryptData: &yes}
+}
+
+// TestProbeTellsLockedDataFromHealthy — the case Ping could never see: the
+// agent answers, and the qube is still not usable because /data is locked.
+func TestProbeTellsLockedDataFromHealthy(t *testing.T) {
+	ca := newCA(t)
+	inv := &statusInvoker{report: agentstatus.Report{
+		Units:     []agentstatus.Unit{{Name: "qubes-air-helper.service", LoadState: "loaded", ActiveState: "active", SubState: "running"}},
+		Data:      &agentstatus.Data{Attached: true, Mount: "/data"},
+		Disks:     []agentstatus.Disk{{Path: "/", FreeBytes: 4 << 30, TotalBytes: 8 << 30}},
+		CloudInit: agentstatus.CloudInit{Status: agentstatus.CloudInitDone},
+	}}
+	addr, _ := startAgent(t, ca, ca, "agent-vault", inv)
+	host, port := hostPort(t, addr)
+	p := NewAgentProber(staticCA{ca: ca}, nil, "0.0.0.0:"+port, 10*time.Second)
+	qube := &models.Qube{ID: "q1", Name: "vault", IPAddress: host, Spec: encrypted()}
+
+	res := p.Probe(context.Background(), qube)
+	require.True(t, res.Reachable, res.Reason)
+	require.NotNil(t, res.Report, res.ReportError)
+	assert.Equal(t, []string{"/data is locked"}, res.Report.Problems)
+	assert.Less(t, abs64(res.Report.ClockOffsetMS), int64(5000), "same clock, so the offset is the round trip at most")
+	assert.Equal(t, models.AgentHealthDegraded, agentHealthForResult(res, AgentProbeSteady))
+
+	// Unlocked, the same qube is healthy.
+	inv.report.Data = &agentstatus.Data{Attached: true, Open: true, Mounted: true, Mount: "/data", FreeBytes: 1 << 30, TotalBytes: 2 << 30}
+	res = p.Probe(context.Background(), qube)
+	require.NotNil(t, res.Report, res.ReportError)
+	assert.Empty(t, res.Report.Problems)
+	assert.Equal(t, models.AgentHealthHealthy, agentHealthForResult(res, AgentProbeSteady))
+}
+
+// TestProbeWithoutAReportIsStillReachable — an agent that does not offer the
+// report, or fails it, answered Ping: reachable and healthy, with the failure
+// said rather than turned into a verdict.
+func TestProbeWithoutAReportIsStillReachable(t *testing.T) {
+	ca := newCA(t)
+	addr, _ := startAgent(t, ca, ca, "agent-old", &fakeInvoker{resp: []byte("pong")})
+	host, port := hostPort(t, addr)
+	p := NewAgentProber(staticCA{ca: ca}, nil, "0.0.0.0:"+port, 10*time.Second)
+	res := p.Probe(context.Background(), &models.Qube{ID: "q1", Name: "old", IPAddress: host, Spec: encrypted()})
+	require.True(t, res.Reachable, res.Reason)
+	assert.Nil(t, res.Report)
+	assert.Empty(t, res.ReportError, "not offering the service is not a failure")
+	assert.Equal(t, models.AgentHealthHealthy, agentHealthForResult(res, AgentProbeSteady))
+
+	addr, _ = startAgent(t, ca, ca, "agent-broken", &statusInvoker{statusErr: errors.New("helper socket gone")})
+	host, port = hostPort(t, addr)
+	p = NewAgentProber(staticCA{ca: ca}, nil, "0.0.0.0:"+port, 10*time.Second)
+	res = p.Probe(context.Background(), &models.Qube{ID: "q2", Name: "broken", IPAddress: host})
+	require.True(t, res.Reachable, res.Reason)
+	assert.Nil(t, res.Report)
+	assert.Contains(t, res.ReportError, "helper socket gone")
+	assert.Equal(t, models.AgentHealthHealthy, agentHealthForResult(res, AgentProbeSteady))
+}
+
+// deadManInvoker is an agent with a dead man's switch that locks on
+// revocation, and remembers what it was told.
+type deadManInvoker struct {
+	mu  sync.Mutex
+	req string
+}
+
+func (d *deadManInvoker) Invoke(_ context.Context, target, service string, in []byte) ([]byte, error) {
+	switch service {
+	case pingService:
+		return []byte("pong " + target), nil
+	case deadman.Service:
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		d.req = string(in)
+		return json.Marshal(agentstatus.DeadMan{Enabled: true, OnRevocation: true, Tripped: true,
+			Reason: "the console reports this agent's certificate revoked"})
+	}
+	return nil, errors.New("no such qrexec service")
+}
+
+func (d *deadManInvoker) Services() []string { return []string{pingService, deadman.Service} }
+
+func (d *deadManInvoker) told() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.req
+}
+
+// revokedAuthz is a registry that has revoked every certificate.
+type revokedAuthz struct{}
+
+func (revokedAuthz) Authorize(context.Context, string) (*repository.AgentCert, error) {
+	return nil, repository.ErrCertRevoked
+}
+
+// TestProbeTellsARevokedAgent — the probe that finds an agent's certificate
+// revoked says so to the agent, on the tunnel it holds, before it hangs up.
+func TestProbeTellsARevokedAgent(t *testing.T) {
+	ca := newCA(t)
+	inv := &deadManInvoker{}
+	addr, _ := startAgent(t, ca, ca, "agent-seized", inv)
+	host, port := hostPort(t, addr)
+	p := NewAgentProber(staticCA{ca: ca}, nil, "0.0.0.0:"+port, 10*time.Second)
+	p.authz = revokedAuthz{}
+
+	res := p.Probe(context.Background(), &models.Qube{ID: "q1", Name: "seized", IPAddress: host, Spec: encrypted()})
+	assert.Equal(t, AgentProbeTLSRejected, res.Status)
+	assert.Contains(t, res.Reason, "its dead man's switch has locked the data disk")
+	assert.JSONEq(t, `{"revoked":true}`, inv.told())
+
+	// An agent without the switch is left alone.
+	addr, _ = startAgent(t, ca, ca, "agent-plain", &fakeInvoker{resp: []byte("pong")})
+	host, port = hostPort(t, addr)
+	p = NewAgentProber(staticCA{ca: ca}, nil, "0.0.0.0:"+port, 10*time.Second)
+	p.authz = revokedAuthz{}
+	res = p.Probe(context.Background(), &models.Qube{ID: "q2", Name: "plain", IPAddress: host})
+	assert.Equal(t, AgentProbeTLSRejected, res.Status)
+	assert.NotContains(t, res.Reason, "told")
+}
+
+func TestStatusProblems(t *testing.T) {
+	ok := func() *models.AgentStatus {
+		return &models.AgentStatus{
+			CloudInit: agentstatus.CloudInitDone,
+			Units:     []models.AgentUnitState{{Name: "qubes-air-agent.service", LoadState: "loaded", ActiveState: "active", SubState: "running"}},
+			Data:      &models.AgentDataState{Attached: true, Open: true, Mounted: true, Mount: "/data", FreeBytes: 50, TotalBytes: 100},
+			Disks:     []models.AgentDiskUsage{{Path: "/", FreeBytes: 50, TotalBytes: 100}},
+			// A pending reboot is the operator's to schedule, not a fault.
+			RebootRequired: true,
+		}
+	}
+	cases := map[string]struct {
+		plaintext bool
+		edit      func(*models.AgentStatus)
+		want      string
+	}{
+		"fine":           {edit: func(*models.AgentStatus) {}},
+		"no disk":        {edit: func(s *models.AgentStatus) { s.Data = &models.AgentDataState{Mount: "/data"} }, want: "no data disk is attached"},
+		"open unmounted": {edit: func(s *models.AgentStatus) { s.Data.Mounted = false }, want: "the data disk is unlocked but /data is not mounted"},
+		"plaintext":      {plaintext: true, edit: func(s *models.AgentStatus) { s.Data.Open, s.Data.Mounted = false, false }},
+		"unit failed": {edit: func(s *models.AgentStatus) { s.Units[0].ActiveState, s.Units[0].SubState = "failed", "failed" },
+			want: "unit qubes-air-agent.service is failed (failed)"},
+		"unit missing": {edit: func(s *models.AgentStatus) { s.Units[0].LoadState = "not-found" },
+			want: "unit qubes-air-agent.service is not installed"},
+		"cloud-init": {edit: func(s *models.AgentStatus) {
+			s.CloudInit, s.CloudInitErrors = agentstatus.CloudInitError, []string{"scripts_user failed"}
+		}, want: "cloud-init finished with errors: scripts_user failed"},
+		"root full":  {edit: func(s *models.AgentStatus) { s.Disks[0].FreeBytes = 2 }, want: "/ is 98% full"},
+		"data full":  {edit: func(s *models.AgentStatus) { s.Data.FreeBytes = 1 }, want: "/data is 99% full"},
+		"clock":      {edit: func(s *models.AgentStatus) { s.ClockOffsetMS = -90_000 }, want: "clock is 1m30s behind the console's"},
+		"clock near": {edit: func(s *models.AgentStatus) { s.ClockOffsetMS = 20_000 }},
+		"dead man": {edit: func(s *models.AgentStatus) {
+			s.DeadMan = &models.AgentDeadMan{Enabled: true, Tripped: true, Reason: "no call from the console for 25h0m0s",
+				LockError: "umount: /data: target is busy."}
+		}, want: "the dead man's switch tripped: no call from the console for 25h0m0s; the data disk is still open: umount: /data: target is busy."},
+		"dead man armed": {edit: func(s *models.AgentStatus) {
+			s.DeadMan = &models.AgentDeadMan{Enabled: true, SilenceSeconds: 86400, LastCheckIn: time.Now()}
+		}},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			qube := &models.Qube{Name: "q", Spec: encrypted()}
+			if tc.plaintext {
+				qube.Spec = models.QubeSpec{}
+			}
+			st := ok()
+			tc.edit(st)
+			assert.Equal(t, tc.want, strings.Join(statusProblems(qube, st), "; "))
+		})
+	}
+}
+
+func abs64(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
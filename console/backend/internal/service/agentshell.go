@@ -0,0 +1,69 @@
+// agentshell.go — an interactive terminal on a qube, through its agent's
+// qubesair.Shell.
+//
+// The console is a pipe here. The terminal is the agent's helper's, the
+// frames are written by whoever drives the terminal (the WebSocket handler),
+// and the output comes back unframed; all this does is pin a tunnel to the
+// qube's own agent and keep the stream on it for as long as the session runs.
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/slchris/qubes-air/console/internal/models"
+	"github.com/slchris/qubes-air/console/internal/shell"
+)
+
+const (
+	shellRelayName = "console-shell"
+	// shellCertLifetime need only outlive the tunnel's handshake: a session
+	// that loses its tunnel has lost its terminal, and reconnecting with a
+	// fresh certificate would not bring the shell back.
+	shellCertLifetime = time.Hour
+)
+
+// AgentShell opens terminals on qubes' agents.
+type AgentShell struct {
+	ca     CAProvider
+	dialer AgentDialer
+}
+
+// NewAgentShell builds a shell opener that dials agents at agentListen.
+func NewAgentShell(ca CAProvider, agentListen string) *AgentShell {
+	return &AgentShell{ca: ca, dialer: NewDirectDialer(agentListen)}
+}
+
+// WithDialer replaces the direct dialer, e.g. with the zone registry. Nil is
+// ignored.
+func (a *AgentShell) WithDialer(d AgentDialer) *AgentShell {
+	if d != nil {
+		a.dialer = d
+	}
+	return a
+}
+
+// Run opens a terminal on qube and runs it until the shell exits or ctx ends:
+// in carries shell frames (internal/shell) to it, and its output is written to
+// out as it comes. The end of in hangs the terminal up.
+func (a *AgentShell) Run(ctx context.Context, qube *models.Qube, in io.Reader, out io.Writer) error {
+	if a == nil || a.ca == nil {
+		return errors.New("no shell configured")
+	}
+	if qube == nil {
+		return errors.New("no qube given")
+	}
+	sess, err := agentCall{ca: a.ca, dialer: a.dialer, relay: shellRelayName, lifetime: shellCertLifetime}.
+		open(ctx, qube)
+	if err != nil {
+		return err
+	}
+	defer sess.close()
+	if err := sess.stream(ctx, qube.Name, shell.Service, in, out); err != nil {
+		return fmt.Errorf("%s on %q: %w", shell.Service, qube.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/slchris/qubes-air/console/internal/models"
+	"github.com/slchris/qubes-air/console/internal/shell"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// shellInvoker serves qubesair.Shell as the agent's helper would, with a
+// terminal that describes each frame it reads.
+type shellInvoker struct{}
+
+func (shellInvoker) Invoke(context.Context, string, string, []byte) ([]byte, error) {
+	return nil, errors.New("no such qrexec service")
+}
+
+func (shellInvoker) OpenStream(_ context.Context, _, service string) (io.ReadWriteCloser, bool, error) {
+	if service != shell.Service {
+		return nil, false, nil
+	}
+	toTerm, input := io.Pipe()
+	output, fromTerm := io.Pipe()
+	go func() {
+		defer fromTerm.Close() // the shell exits when its input ends
+		for {
+			f, err := shell.ReadFrame(toTerm)
+			if err != nil {
+				return
+			}
+			if f.Kind == shell.KindResize {
+				_, _ = fmt.Fprintf(fromTerm, "[%dx%d]", f.Rows, f.Cols)
+			} else {
+				_, _ = fmt.Fprintf(fromTerm, "<%s>", f.Data)
+			}
+		}
+	}()
+	return &termConn{Reader: output, input: input}, true, nil
+}
+
+// termConn is the agent's end of a fake terminal, half-closable like the
+// helper's socket.
+type termConn struct {
+	io.Reader
+	input *io.PipeWriter
+}
+
+func (c *termConn) Write(p []byte) (int, error) { return c.input.Write(p) }
+func (c *termConn) CloseWrite() error           { return c.input.Close() }
+func (c *termConn) Close() error                { return c.input.Close() }
+
+// syncBuffer is a bytes.Buffer the stream's goroutine may write while the
+// test reads it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// TestAgentShell_Run — frames reach the qube's terminal in order, its output
+// comes back as it is written, and ending the input ends the session.
+func TestAgentShell_Run(t *testing.T) {
+	ca := newCA(t)
+	addr, _ := startAgent(t, ca, ca, "agent-term", shellInvoker{})
+	host, port := hostPort(t, addr)
+	sh := NewAgentShell(staticCA{ca: ca}, "0.0.0.0:"+port)
+
+	inR, inW := io.Pipe()
+	var out syncBuffer
+	done := make(chan error, 1)
+	go func() { done <- sh.Run(context.Background(), &models.Qube{Name: "term", IPAddress: host}, inR, &out) }()
+
+	require.NoError(t, shell.WriteResize(inW, 30, 90))
+	require.NoError(t, shell.WriteData(inW, []byte("ls\r")))
+	assert.Eventually(t, func() bool { return out.String() == "[30x90]<ls\r>" },
+		3*time.Second, 10*time.Millisecond, "terminal output %q", out.String())
+
+	require.NoError(t, inW.Close())
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(3 * time.Second):
+		t.Fatal("the session outlived its input")
+	}
+}
@@ -1,5 +1,5 @@
 // agentunlock.go — pushes a qube's data-disk key to its agent to open the
-// encrypted /data.
+// encrypted /data, and asks the agent to close it again.
 //
 // This runs after bootstrap succeeds, so the agent already holds its real
 // identity and the channel is VERIFIED (the agent's certificate CN is pinned to
@@ -15,6 +15,7 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"slices"
 	"strings"
 	"time"
 
@@ -26,12 +27,19 @@ const (
 	unlockRelayName    = "console-unlock"
 	unlockCertLifetime = 5 * time.Minute
 	unlockDataService  = "qubesair.UnlockData"
+	lockDataService    = "qubesair.LockData"
 
 	// DefaultDataUnlockTimeout bounds one unlock attempt: dial, verified
 	// handshake, and the agent's luksFormat/luksOpen/mkfs/mount. Generous because
 	// first-boot formatting of a fresh container is the slow case, still short
 	// enough that a wedged agent does not pin the bootstrap sweep.
 	DefaultDataUnlockTimeout = 60 * time.Second
+
+	// DefaultDataLockTimeout bounds one lock: sync, unmount and close. Shorter
+	// than an unlock because there is no formatting, and because the lock
+	// before a suspend runs on the terraform worker, where every queued apply
+	// waits behind it.
+	DefaultDataLockTimeout = 30 * time.Second
 )
 
 // DataKeyProvider derives a qube's data-disk passphrase.
@@ -43,11 +51,13 @@ type DataKeyProvider interface {
 // pushing it to qubesair.UnlockData over verified mTLS. The key is derived on
 // demand and never stored anywhere but the request; the agent holds it only in
 // RAM. Idempotent on the agent, so calling it after every bootstrap is safe.
+// Lock takes the key back out of RAM through qubesair.LockData.
 type AgentDataUnlocker struct {
 	ca      CAProvider
 	keys    DataKeyProvider
 	dialer  AgentDialer
 	timeout time.Duration
+	policy  *AgentVersionPolicy
 }
 
 // NewAgentDataUnlocker builds an unlocker. A nil return of ca or keys makes
@@ -64,6 +74,22 @@ func NewAgentDataUnlocker(ca CAProvider, keys DataKeyProvider, agentListen strin
 	}
 }
 
+// WithDialer replaces the direct dialer, e.g. with the zone registry. Nil is
+// ignored.
+func (u *AgentDataUnlocker) WithDialer(d AgentDialer) *AgentDataUnlocker {
+	if d != nil {
+		u.dialer = d
+	}
+	return u
+}
+
+// WithVersionPolicy sets the minimum agent build the key is handed to. Nil
+// sets none.
+func (u *AgentDataUnlocker) WithVersionPolicy(p *AgentVersionPolicy) *AgentDataUnlocker {
+	u.policy = p
+	return u
+}
+
 // UnlockResult is the agent's answer: whether /data is now open, and why not.
 type UnlockResult struct {
 	Unlocked bool
@@ -92,45 +118,83 @@ func (u *AgentDataUnlocker) Unlock(ctx context.Context, qube *models.Qube) (Unlo
 	ctx, cancel := context.WithTimeout(ctx, u.timeout)
 	defer cancel()
 
-	ca, err := u.ca.CA(ctx)
+	sess, err := agentCall{ca: u.ca, dialer: u.dialer, relay: unlockRelayName, lifetime: unlockCertLifetime}.
+		open(ctx, qube)
 	if err != nil {
-		return UnlockResult{}, fmt.Errorf("no usable CA to reach %q: %w", qube.Name, err)
+		return UnlockResult{}, err
 	}
-	bundle, err := ca.IssueAgentCert(unlockRelayName, unlockCertLifetime)
+	defer sess.close()
+	// The build is checked on this tunnel, before the key is written to it:
+	// an outdated agent refused after it already holds the key has not been
+	// refused anything.
+	peer, err := sess.peer(ctx)
 	if err != nil {
-		return UnlockResult{}, fmt.Errorf("mint unlock client certificate: %w", err)
+		return UnlockResult{}, fmt.Errorf("call %s on %q: %w", unlockDataService, qube.Name, err)
 	}
-	// Pin the peer to agent-<qube>: the key must reach THIS qube's agent and no
-	// impostor at its address. Same binding the prober enforces.
-	tlsCfg, err := probeTLSConfig(bundle, AgentCommonName(qube.Name))
-	if err != nil {
-		return UnlockResult{}, fmt.Errorf("unlock client certificate unusable: %w", err)
-	}
-
-	addr := u.dialer.Address(qube)
-	cli := transportgrpc.NewClient(transportgrpc.ClientConfig{
-		RemoteEndpoint: addr,
-		RelayName:      unlockRelayName,
-		RemoteName:     qube.Name,
-		Dialer:         dialFuncFor(u.dialer, qube),
-		ReconnectMin:   20 * time.Millisecond,
-		ReconnectMax:   200 * time.Millisecond,
-		TLS:            tlsCfg.Clone(),
-	}, nil)
-	go func() { _ = cli.Start(ctx) }()
-
-	out, err := callWhenConnected(ctx, cli, qube.Name, unlockDataService, []byte(key))
+	if err := u.policy.admit(qube, unlockDataService, peer); err != nil {
+		return UnlockResult{}, err
+	}
+	out, err := sess.call(ctx, qube.Name, unlockDataService, []byte(key))
 	if err != nil {
 		return UnlockResult{}, fmt.Errorf("call %s on %q: %w", unlockDataService, qube.Name, err)
 	}
+	return parseDataReply(qube, unlockDataService, out)
+}
+
+// Lock asks the qube's agent to close /data: sync, unmount and close the LUKS
+// mapping, so the key is no longer in the remote's memory. No key is derived
+// or sent, so there is no version check either — an outdated agent is exactly
+// one to take the key back from.
+//
+// Unlocked true in the result is the agent declining, typically because
+// something still holds /data open; the container is left as it was rather
+// than pulled from under the processes using it.
+func (u *AgentDataUnlocker) Lock(ctx context.Context, qube *models.Qube) (UnlockResult, error) {
+	if u == nil || u.ca == nil {
+		return UnlockResult{}, errors.New("no data unlocker configured")
+	}
+	if qube == nil {
+		return UnlockResult{}, errors.New("no qube given")
+	}
+	if strings.TrimSpace(qube.IPAddress) == "" {
+		return UnlockResult{}, fmt.Errorf("qube %q has no address to lock", qube.Name)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, DefaultDataLockTimeout)
+	defer cancel()
 
+	sess, err := agentCall{ca: u.ca, dialer: u.dialer, relay: unlockRelayName, lifetime: unlockCertLifetime}.
+		open(ctx, qube)
+	if err != nil {
+		return UnlockResult{}, err
+	}
+	defer sess.close()
+	// Said plainly for an agent built before the service existed, rather than
+	// as whatever "no such service" reads like by the time it is logged.
+	peer, err := sess.peer(ctx)
+	if err != nil {
+		return UnlockResult{}, fmt.Errorf("call %s on %q: %w", lockDataService, qube.Name, err)
+	}
+	if !slices.Contains(peer.Capabilities.Services, lockDataService) {
+		return UnlockResult{}, fmt.Errorf("agent on %q does not offer %s", qube.Name, lockDataService)
+	}
+	out, err := sess.call(ctx, qube.Name, lockDataService, nil)
+	if err != nil {
+		return UnlockResult{}, fmt.Errorf("call %s on %q: %w", lockDataService, qube.Name, err)
+	}
+	return parseDataReply(qube, lockDataService, out)
+}
+
+// parseDataReply reads the {"unlocked":bool,"detail":"..."} line both data
+// services answer with.
+func parseDataReply(qube *models.Qube, service string, out []byte) (UnlockResult, error) {
 	var reply struct {
 		Unlocked bool   `json:"unlocked"`
 		Detail   string `json:"detail"`
 	}
 	if err := json.Unmarshal(out, &reply); err != nil {
 		return UnlockResult{}, fmt.Errorf("unparseable %s reply from %q: %v (%q)",
-			unlockDataService, qube.Name, err, strings.TrimSpace(string(out)))
+			service, qube.Name, err, strings.TrimSpace(string(out)))
 	}
 	return UnlockResult{Unlocked: reply.Unlocked, Detail: reply.Detail}, nil
 }
@@ -178,3 +242,36 @@ func (u *AgentDataUnlocker) UnlockData(ctx context.Context, qube *models.Qube) {
 		log.Printf("unlock: qube %q data disk opened and mounted (%s)", qube.Name, res.Detail)
 	}
 }
+
+// LockData is the callback shape the orchestrator's BeforeRun hook wants,
+// the counterpart of UnlockData: it closes /data on a qube whose spec
+// encrypts it, ahead of the suspend or release that destroys its compute VM,
+// and returns a line for the job's log.
+//
+// It never stops the teardown. Destroying the VM takes the key out of memory
+// regardless, so a lock that fails — an agent already gone, a busy mount —
+// costs the orderly shutdown of the disk, not its secrecy; refusing to suspend
+// a qube whose agent is wedged would cost the operator the one action that
+// fixes it.
+func (u *AgentDataUnlocker) LockData(ctx context.Context, qube *models.Qube) string {
+	if qube == nil || !qube.Spec.EncryptsData() {
+		return ""
+	}
+	if strings.TrimSpace(qube.IPAddress) == "" {
+		// No address means no compute VM the console knows of, hence nothing
+		// holding the key.
+		return ""
+	}
+	res, err := u.Lock(ctx, qube)
+	var msg string
+	switch {
+	case err != nil:
+		msg = fmt.Sprintf("data disk NOT locked before teardown: %v", err)
+	case res.Unlocked:
+		msg = fmt.Sprintf("data disk NOT locked before teardown: %s", res.Detail)
+	default:
+		msg = fmt.Sprintf("data disk locked before teardown (%s)", res.Detail)
+	}
+	log.Printf("lock: qube %q %s", qube.Name, msg)
+	return msg
+}
@@ -3,6 +3,7 @@ package service
 import (
 	"context"
 	"errors"
+	"sync"
 	"testing"
 	"time"
 
@@ -67,3 +68,75 @@ func TestUnlockNilReceiverErrs(t *testing.T) {
 	_, err := u.Unlock(context.Background(), &models.Qube{Name: "q", IPAddress: "1.2.3.4"})
 	require.Error(t, err)
 }
+
+// lockInvoker answers qubesair.LockData with reply, and says it offers it.
+type lockInvoker struct {
+	mu    sync.Mutex
+	reply string
+	calls int
+}
+
+func (l *lockInvoker) Invoke(_ context.Context, _, service string, in []byte) ([]byte, error) {
+	if service != lockDataService {
+		return nil, errors.New("no such qrexec service")
+	}
+	if len(in) != 0 {
+		return nil, errors.New("LockData takes no input")
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.calls++
+	return []byte(l.reply), nil
+}
+
+func (l *lockInvoker) answer(reply string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.reply = reply
+}
+
+func (l *lockInvoker) called() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.calls
+}
+
+func (l *lockInvoker) Services() []string { return []string{pingService, lockDataService} }
+
+func TestLockAsksTheAgentToCloseData(t *testing.T) {
+	ca := newCA(t)
+	inv := &lockInvoker{reply: `{"unlocked":false,"detail":"unmounted and closed"}`}
+	addr, _ := startAgent(t, ca, ca, "agent-vault", inv)
+	host, port := hostPort(t, addr)
+	yes := true
+	qube := &models.Qube{ID: "q-1", Name: "vault", IPAddress: host, Spec: models.QubeSpec{EncryptData: &yes}}
+	// No key provider: locking hands the agent nothing, so it needs none.
+	u := NewAgentDataUnlocker(staticCA{ca: ca}, nil, "0.0.0.0:"+port, 10*time.Second)
+
+	res, err := u.Lock(context.Background(), qube)
+	require.NoError(t, err)
+	assert.Equal(t, UnlockResult{Detail: "unmounted and closed"}, res)
+
+	inv.answer(`{"unlocked":true,"detail":"unmount failed: target is busy"}`)
+	assert.Equal(t, "data disk NOT locked before teardown: unmount failed: target is busy",
+		u.LockData(context.Background(), qube))
+	assert.Equal(t, 2, inv.called())
+
+	// A plaintext qube, or one with no VM, is not dialed at all.
+	no := false
+	assert.Empty(t, u.LockData(context.Background(), &models.Qube{Name: "plain", IPAddress: host, Spec: models.QubeSpec{EncryptData: &no}}))
+	assert.Empty(t, u.LockData(context.Background(), &models.Qube{Name: "gone", Spec: qube.Spec}))
+	assert.Equal(t, 2, inv.called())
+}
+
+// An agent built before the service existed is told apart from one that
+// failed it.
+func TestLockSaysWhenTheAgentDoesNotOfferIt(t *testing.T) {
+	ca := newCA(t)
+	addr, _ := startAgent(t, ca, ca, "agent-old", &fakeInvoker{resp: []byte("pong")})
+	host, port := hostPort(t, addr)
+	u := NewAgentDataUnlocker(staticCA{ca: ca}, nil, "0.0.0.0:"+port, 10*time.Second)
+	_, err := u.Lock(context.Background(), &models.Qube{ID: "q-1", Name: "old", IPAddress: host})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "does not offer qubesair.LockData")
+}
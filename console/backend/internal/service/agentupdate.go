@@ -0,0 +1,575 @@
+// agentupdate.go — replaces the agent package on running qubes through their
+// agents' qubesair.Update, in stages.
+//
+// One qube's update is four steps over the verified path: apply (the remote
+// downloads the package and checks it against its own pinned key), a wait
+// while the new agent restarts, a qubesair.Ping to the NEW agent, and the
+// confirm that tells the remote to keep it. The console never says "roll
+// back": a remote that hears nothing rolls itself back, which is what makes a
+// console crash or a dead link in the middle of an update safe.
+//
+// A rollout is that, over a selection of qubes — a zone, a qube type, a list
+// — a batch at a time, stopping when more qubes fail than the operator
+// allowed. Rollouts are kept in memory: they are an operator watching a
+// fleet move, not an audit record, and each qube's outcome is also on the
+// qube (its agent reports its build on the next probe) and in this log.
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/slchris/qubes-air/console/internal/agentupdate"
+	"github.com/slchris/qubes-air/console/internal/models"
+	"github.com/slchris/qubes-air/console/internal/repository"
+)
+
+const (
+	updateRelayName = "console-update"
+	// updateCertLifetime need only outlive one call; every poll mints its own.
+	updateCertLifetime = 10 * time.Minute
+
+	// DefaultAgentUpdateStepTimeout bounds one call: an apply downloads and
+	// verifies the package on the remote before it answers.
+	DefaultAgentUpdateStepTimeout = 3 * time.Minute
+
+	// agentUpdatePollEvery is how often a qube mid-update is asked where it is.
+	agentUpdatePollEvery = 5 * time.Second
+
+	// maxRolloutsKept bounds the finished rollouts held in memory.
+	maxRolloutsKept = 50
+
+	// maxRolloutQubes bounds one selection.
+	maxRolloutQubes = 1000
+)
+
+// Rollout errors.
+var (
+	// ErrRolloutNotFound means no rollout has the ID.
+	ErrRolloutNotFound = errors.New("rollout not found")
+	// ErrNoUpdatePackage means neither the request nor the console's
+	// configuration names a package.
+	ErrNoUpdatePackage = errors.New("no agent package to roll out")
+	// ErrEmptyRollout means the selection matched no qube.
+	ErrEmptyRollout = errors.New("the selection matches no qube")
+	// ErrProtocolTooOld means the package needs a newer wire protocol than
+	// the qube's agent reports its link running at.
+	ErrProtocolTooOld = errors.New("the agent's link runs below the package's minimum protocol")
+)
+
+// UpdatePackage is the package an update installs. The SHA-256 is checked
+// by the remote; so is a signature the console has no part in.
+type UpdatePackage struct {
+	URL     string `json:"url"`
+	SHA256  string `json:"sha256"`
+	Version string `json:"version,omitempty"`
+	// MinProtocol is the release manifest's min-protocol ("v2"); empty when
+	// the package did not come from one, which checks nothing.
+	MinProtocol string `json:"min_protocol,omitempty"`
+}
+
+// RolloutSpec is what an operator asks for: which qubes, which package, how
+// many at a time and how many may fail.
+type RolloutSpec struct {
+	// Package defaults to the console's configured agent package, the one
+	// new qubes get.
+	Package UpdatePackage `json:"package"`
+	// ZoneID and Type narrow the selection to running qubes in that zone and
+	// of that type; QubeIDs names qubes outright. All three may be combined,
+	// and must all match.
+	ZoneID  string          `json:"zone_id,omitempty"`
+	Type    models.QubeType `json:"type,omitempty"`
+	QubeIDs []string        `json:"qube_ids,omitempty"`
+	// BatchSize is how many qubes update at once (default 1).
+	BatchSize int `json:"batch_size,omitempty"`
+	// MaxFailures is how many qubes may fail before the rollout halts
+	// (default 0: the first failure halts it).
+	MaxFailures int `json:"max_failures,omitempty"`
+	// ConfirmSeconds is how long each new agent has to answer before its
+	// remote rolls it back (default agentupdate.DefaultConfirmWithin).
+	ConfirmSeconds int `json:"confirm_seconds,omitempty"`
+}
+
+// RolloutState is where a rollout is.
+type RolloutState string
+
+// Rollout states.
+const (
+	RolloutRunning   RolloutState = "running"
+	RolloutCompleted RolloutState = "completed"
+	// RolloutHalted means more qubes failed than the spec allowed; the rest
+	// were not touched.
+	RolloutHalted RolloutState = "halted"
+)
+
+// QubeUpdateState is where one qube is in a rollout.
+type QubeUpdateState string
+
+// Per-qube states. Updated, current, rolled-back and failed are the remote's
+// own answers; skipped means the qube was never asked.
+const (
+	QubeUpdatePending    QubeUpdateState = "pending"
+	QubeUpdateUpdating   QubeUpdateState = "updating"
+	QubeUpdateUpdated    QubeUpdateState = "updated"
+	QubeUpdateCurrent    QubeUpdateState = "current"
+	QubeUpdateRolledBack QubeUpdateState = "rolled-back"
+	QubeUpdateFailed     QubeUpdateState = "failed"
+	QubeUpdateSkipped    QubeUpdateState = "skipped"
+)
+
+// failed reports whether the state counts against MaxFailures.
+func (s QubeUpdateState) failed() bool {
+	return s == QubeUpdateRolledBack || s == QubeUpdateFailed
+}
+
+// QubeUpdate is one qube's part in a rollout.
+type QubeUpdate struct {
+	QubeID     string          `json:"qube_id"`
+	QubeName   string          `json:"qube_name"`
+	Batch      int             `json:"batch"`
+	State      QubeUpdateState `json:"state"`
+	From       string          `json:"from,omitempty"`
+	To         string          `json:"to,omitempty"`
+	Detail     string          `json:"detail,omitempty"`
+	StartedAt  *time.Time      `json:"started_at,omitempty"`
+	FinishedAt *time.Time      `json:"finished_at,omitempty"`
+}
+
+// Rollout is one staged update and where each of its qubes is.
+type Rollout struct {
+	ID         string       `json:"id"`
+	Spec       RolloutSpec  `json:"spec"`
+	Operator   string       `json:"operator"`
+	State      RolloutState `json:"state"`
+	Detail     string       `json:"detail,omitempty"`
+	CreatedAt  time.Time    `json:"created_at"`
+	FinishedAt *time.Time   `json:"finished_at,omitempty"`
+	Qubes      []QubeUpdate `json:"qubes"`
+}
+
+// UpdateTargets is where a rollout finds its qubes; the qube repository is
+// the implementation.
+type UpdateTargets interface {
+	GetByID(ctx context.Context, id string) (*models.Qube, error)
+	List(ctx context.Context, opts repository.QubeListOptions) ([]*models.Qube, error)
+}
+
+// AgentUpdater updates agents on qubes, one at a time or in rollouts.
+type AgentUpdater struct {
+	ca     CAProvider
+	dialer AgentDialer
+	qubes  UpdateTargets
+	pkg    UpdatePackage
+	source func(context.Context) (AgentPackage, error)
+	step   time.Duration
+	poll   time.Duration
+
+	mu       sync.Mutex
+	rollouts map[string]*Rollout
+	order    []string
+}
+
+// NewAgentUpdater builds an updater that dials agents at agentListen and
+// rolls out pkg when a request names no package.
+func NewAgentUpdater(ca CAProvider, qubes UpdateTargets, agentListen string, pkg AgentPackage) *AgentUpdater {
+	return &AgentUpdater{
+		ca:       ca,
+		dialer:   NewDirectDialer(agentListen),
+		qubes:    qubes,
+		pkg:      UpdatePackage{URL: pkg.URL, SHA256: pkg.SHA256, Version: pkg.Version, MinProtocol: pkg.MinProtocol},
+		step:     DefaultAgentUpdateStepTimeout,
+		poll:     agentUpdatePollEvery,
+		rollouts: map[string]*Rollout{},
+	}
+}
+
+// WithDialer replaces the direct dialer, e.g. with the zone registry. Nil is
+// ignored.
+func (u *AgentUpdater) WithDialer(d AgentDialer) *AgentUpdater {
+	if d != nil {
+		u.dialer = d
+	}
+	return u
+}
+
+// WithPackageSource makes the default package whatever source returns when a
+// rollout starts — *CertIssuer.AgentPackage, so that a release manifest is
+// fetched and checked before the fleet is pointed at it. Nil is ignored.
+func (u *AgentUpdater) WithPackageSource(source func(context.Context) (AgentPackage, error)) *AgentUpdater {
+	if source != nil {
+		u.source = source
+	}
+	return u
+}
+
+// Update replaces the agent on one qube and returns where the remote ended
+// up: confirmed, current, rolled back or failed. An error means the console
+// could not find out — the remote still decides for itself.
+func (u *AgentUpdater) Update(
+	ctx context.Context, qube *models.Qube, pkg UpdatePackage, confirmSeconds int,
+) (agentupdate.Status, error) {
+	if u == nil || u.ca == nil {
+		return agentupdate.Status{}, errors.New("no agent updater configured")
+	}
+	// The version the agent reported in its last handshake is the one its
+	// link runs at — through whatever relay the qube is reached by. A package
+	// that needs more would come up behind a link that cannot carry it, and
+	// the confirm that follows could never reach it.
+	if pkg.MinProtocol != "" {
+		have := ""
+		if qube.Agent != nil {
+			have = qube.Agent.ProtocolVersion
+		}
+		if !agentupdate.ProtocolAtLeast(have, pkg.MinProtocol) {
+			if have == "" {
+				have = "none reported"
+			}
+			return agentupdate.Status{}, fmt.Errorf("%w: %q needs %s, the agent on %q reports %s",
+				ErrProtocolTooOld, pkg.Version, pkg.MinProtocol, qube.Name, have)
+		}
+	}
+	st, err := u.call(ctx, qube, agentupdate.Request{
+		Op: agentupdate.OpApply, URL: pkg.URL, SHA256: pkg.SHA256, Version: pkg.Version, ConfirmSeconds: confirmSeconds,
+	})
+	if err != nil || st.State != agentupdate.StateInstalling {
+		return st, err
+	}
+	log.Printf("agent update: %q installing %s (was %s)", qube.Name, st.To, st.From)
+
+	// The remote decides when the window closes; the console waits a little
+	// longer so it is there to read the outcome.
+	window := time.Duration(st.ConfirmSeconds)*time.Second + 2*u.step
+	ctx, cancel := context.WithTimeout(ctx, window)
+	defer cancel()
+
+	confirmed := false
+	var lastErr error
+	for {
+		// Errors are expected here, for a while: the agent restarts under the
+		// call. Only the deadline ends the wait.
+		st, err = u.call(ctx, qube, agentupdate.Request{Op: agentupdate.OpStatus})
+		switch {
+		case err != nil:
+			lastErr = err
+		case !st.State.Pending():
+			return st, nil
+		case st.State == agentupdate.StateAwaitingConfirm && !confirmed:
+			if err := u.confirm(ctx, qube); err != nil {
+				lastErr = err
+			} else {
+				confirmed = true
+			}
+		}
+		select {
+		case <-ctx.Done():
+			if lastErr == nil {
+				lastErr = ctx.Err()
+			}
+			return st, fmt.Errorf("%q did not finish updating: %w", qube.Name, lastErr)
+		case <-time.After(u.poll):
+		}
+	}
+}
+
+// confirm pings the new agent and, when it answers, tells its remote to keep
+// it. Both go through the new agent: one that cannot answer cannot confirm.
+func (u *AgentUpdater) confirm(ctx context.Context, qube *models.Qube) error {
+	sess, err := u.open(ctx, qube)
+	if err != nil {
+		return err
+	}
+	defer sess.close()
+	callCtx, cancel := context.WithTimeout(ctx, u.step)
+	defer cancel()
+	if _, err := sess.call(callCtx, qube.Name, pingService, nil); err != nil {
+		return fmt.Errorf("new agent on %q did not answer %s: %w", qube.Name, pingService, err)
+	}
+	in, _ := json.Marshal(agentupdate.Request{Op: agentupdate.OpConfirm})
+	if _, err := sess.call(callCtx, qube.Name, agentupdate.Service, in); err != nil {
+		return fmt.Errorf("confirm on %q: %w", qube.Name, agentupdate.RemoteError(err))
+	}
+	log.Printf("agent update: %q answered after the update; confirmed", qube.Name)
+	return nil
+}
+
+// call runs one update step on qube's agent.
+func (u *AgentUpdater) call(ctx context.Context, qube *models.Qube, req agentupdate.Request) (agentupdate.Status, error) {
+	in, err := json.Marshal(req)
+	if err != nil {
+		return agentupdate.Status{}, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, u.step)
+	defer cancel()
+	out, err := agentCall{ca: u.ca, dialer: u.dialer, relay: updateRelayName, lifetime: updateCertLifetime}.
+		call(ctx, qube, agentupdate.Service, in)
+	if err != nil {
+		return agentupdate.Status{}, agentupdate.RemoteError(err)
+	}
+	var st agentupdate.Status
+	if err := json.Unmarshal(out, &st); err != nil {
+		return agentupdate.Status{}, fmt.Errorf("unparseable %s reply from %q: %v (%q)",
+			agentupdate.Service, qube.Name, err, strings.TrimSpace(string(out)))
+	}
+	return st, nil
+}
+
+func (u *AgentUpdater) open(ctx context.Context, qube *models.Qube) (*agentSession, error) {
+	return agentCall{ca: u.ca, dialer: u.dialer, relay: updateRelayName, lifetime: updateCertLifetime}.open(ctx, qube)
+}
+
+// Start selects the spec's qubes and updates them in the background, a batch
+// at a time. The rollout it returns is the first snapshot; Get has the rest.
+func (u *AgentUpdater) Start(ctx context.Context, spec RolloutSpec, operator string) (Rollout, error) {
+	if u == nil || u.ca == nil || u.qubes == nil {
+		return Rollout{}, errors.New("no agent updater configured")
+	}
+	if spec.Package.URL == "" && spec.Package.SHA256 == "" {
+		spec.Package = u.pkg
+		if u.source != nil {
+			pkg, err := u.source(ctx)
+			if err != nil {
+				return Rollout{}, fmt.Errorf("%w: %v", ErrNoUpdatePackage, err)
+			}
+			spec.Package = UpdatePackage{URL: pkg.URL, SHA256: pkg.SHA256, Version: pkg.Version, MinProtocol: pkg.MinProtocol}
+		}
+	}
+	if spec.Package.URL == "" || spec.Package.SHA256 == "" {
+		return Rollout{}, ErrNoUpdatePackage
+	}
+	if spec.BatchSize <= 0 {
+		spec.BatchSize = 1
+	}
+	if spec.MaxFailures < 0 {
+		spec.MaxFailures = 0
+	}
+	if spec.Type != "" && !spec.Type.IsValid() {
+		return Rollout{}, fmt.Errorf("invalid qube type %q", spec.Type)
+	}
+	if max := int(agentupdate.MaxConfirmWithin / time.Second); spec.ConfirmSeconds < 0 || spec.ConfirmSeconds > max {
+		return Rollout{}, fmt.Errorf("confirm_seconds must be between 0 and %d", max)
+	}
+	qubes, err := u.selectQubes(ctx, spec)
+	if err != nil {
+		return Rollout{}, err
+	}
+
+	r := &Rollout{
+		ID:        newRolloutID(),
+		Spec:      spec,
+		Operator:  operator,
+		State:     RolloutRunning,
+		CreatedAt: time.Now().UTC(),
+	}
+	targets := make([]*models.Qube, 0, len(qubes))
+	for _, q := range qubes {
+		qu := QubeUpdate{QubeID: q.ID, QubeName: q.Name, State: QubeUpdatePending}
+		if q.Status != models.QubeStatusRunning || strings.TrimSpace(q.IPAddress) == "" {
+			qu.State, qu.Detail = QubeUpdateSkipped, fmt.Sprintf("qube is %s", q.Status)
+		} else {
+			qu.Batch = len(targets)/spec.BatchSize + 1
+			targets = append(targets, q)
+		}
+		r.Qubes = append(r.Qubes, qu)
+	}
+	if len(targets) == 0 {
+		return Rollout{}, fmt.Errorf("%w that is running", ErrEmptyRollout)
+	}
+
+	u.mu.Lock()
+	u.rollouts[r.ID] = r
+	u.order = append(u.order, r.ID)
+	u.pruneLocked()
+	snapshot := r.clone()
+	u.mu.Unlock()
+
+	log.Printf("agent update: %s started rollout %s of %s (%s) to %d qube(s), %d at a time",
+		operator, r.ID, spec.Package.URL, spec.Package.Version, len(targets), spec.BatchSize)
+	go u.run(r, targets)
+	return snapshot, nil
+}
+
+// selectQubes finds the qubes a spec names.
+func (u *AgentUpdater) selectQubes(ctx context.Context, spec RolloutSpec) ([]*models.Qube, error) {
+	matches := func(q *models.Qube) bool {
+		return (spec.ZoneID == "" || q.ZoneID == spec.ZoneID) && (spec.Type == "" || q.Type == spec.Type)
+	}
+	var out []*models.Qube
+	if len(spec.QubeIDs) > 0 {
+		seen := map[string]bool{}
+		for _, id := range spec.QubeIDs {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			q, err := u.qubes.GetByID(ctx, id)
+			if err != nil {
+				return nil, fmt.Errorf("qube %q: %w", id, err)
+			}
+			if matches(q) {
+				out = append(out, q)
+			}
+		}
+	} else {
+		// Running qubes only: a qube selected by zone or type that is stopped
+		// has no agent to update, and listing it would only add noise.
+		qubes, err := u.qubes.List(ctx, repository.QubeListOptions{
+			ZoneID: spec.ZoneID, Type: string(spec.Type),
+			Status: string(models.QubeStatusRunning), Limit: maxRolloutQubes,
+		})
+		if err != nil {
+			return nil, err
+		}
+		out = qubes
+	}
+	if len(out) == 0 {
+		return nil, ErrEmptyRollout
+	}
+	// Oldest first, so a rerun of the same selection goes in the same order.
+	slices.SortStableFunc(out, func(a, b *models.Qube) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	return out, nil
+}
+
+// run updates the rollout's targets a batch at a time.
+func (u *AgentUpdater) run(r *Rollout, targets []*models.Qube) {
+	ctx := context.Background()
+	spec := r.Spec
+	failures := 0
+	for start := 0; start < len(targets); start += spec.BatchSize {
+		batch := targets[start:min(start+spec.BatchSize, len(targets))]
+		var wg sync.WaitGroup
+		for _, q := range batch {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				u.updateOne(ctx, r, q)
+			}()
+		}
+		wg.Wait()
+
+		u.mu.Lock()
+		failures = 0
+		for _, qu := range r.Qubes {
+			if qu.State.failed() {
+				failures++
+			}
+		}
+		halted := failures > spec.MaxFailures && start+spec.BatchSize < len(targets)
+		if halted {
+			r.State = RolloutHalted
+			r.Detail = fmt.Sprintf("%d qube(s) failed, more than the %d allowed", failures, spec.MaxFailures)
+			for i := range r.Qubes {
+				if r.Qubes[i].State == QubeUpdatePending {
+					r.Qubes[i].State, r.Qubes[i].Detail = QubeUpdateSkipped, "rollout halted"
+				}
+			}
+		}
+		u.mu.Unlock()
+		if halted {
+			break
+		}
+	}
+
+	u.mu.Lock()
+	now := time.Now().UTC()
+	r.FinishedAt = &now
+	if r.State == RolloutRunning {
+		r.State = RolloutCompleted
+	}
+	state, detail := r.State, r.Detail
+	u.mu.Unlock()
+	log.Printf("agent update: rollout %s %s with %d failure(s) %s", r.ID, state, failures, detail)
+}
+
+// updateOne updates one qube and records the outcome in the rollout.
+func (u *AgentUpdater) updateOne(ctx context.Context, r *Rollout, q *models.Qube) {
+	started := time.Now().UTC()
+	u.setQube(r, q.ID, func(qu *QubeUpdate) {
+		qu.State, qu.StartedAt = QubeUpdateUpdating, &started
+	})
+	st, err := u.Update(ctx, q, r.Spec.Package, r.Spec.ConfirmSeconds)
+	finished := time.Now().UTC()
+	u.setQube(r, q.ID, func(qu *QubeUpdate) {
+		qu.From, qu.To, qu.Detail, qu.FinishedAt = st.From, st.To, st.Detail, &finished
+		switch {
+		case err != nil:
+			qu.State, qu.Detail = QubeUpdateFailed, err.Error()
+		case st.State == agentupdate.StateConfirmed:
+			qu.State = QubeUpdateUpdated
+		case st.State == agentupdate.StateCurrent:
+			qu.State = QubeUpdateCurrent
+		case st.State == agentupdate.StateRolledBack:
+			qu.State = QubeUpdateRolledBack
+		default:
+			qu.State = QubeUpdateFailed
+		}
+		log.Printf("agent update: rollout %s: %q %s %s -> %s %s", r.ID, q.Name, qu.State, qu.From, qu.To, qu.Detail)
+	})
+}
+
+func (u *AgentUpdater) setQube(r *Rollout, id string, f func(*QubeUpdate)) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for i := range r.Qubes {
+		if r.Qubes[i].QubeID == id {
+			f(&r.Qubes[i])
+			return
+		}
+	}
+}
+
+// Get returns a rollout as it stands.
+func (u *AgentUpdater) Get(id string) (Rollout, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	r, ok := u.rollouts[id]
+	if !ok {
+		return Rollout{}, ErrRolloutNotFound
+	}
+	return r.clone(), nil
+}
+
+// List returns the rollouts this console has run since it started, newest
+// first.
+func (u *AgentUpdater) List() []Rollout {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	out := make([]Rollout, 0, len(u.order))
+	for i := len(u.order) - 1; i >= 0; i-- {
+		out = append(out, u.rollouts[u.order[i]].clone())
+	}
+	return out
+}
+
+// pruneLocked drops the oldest finished rollouts beyond maxRolloutsKept.
+func (u *AgentUpdater) pruneLocked() {
+	for i := 0; len(u.order) > maxRolloutsKept && i < len(u.order); {
+		if r := u.rollouts[u.order[i]]; r.State != RolloutRunning {
+			delete(u.rollouts, r.ID)
+			u.order = append(u.order[:i], u.order[i+1:]...)
+			continue
+		}
+		i++
+	}
+}
+
+func (r *Rollout) clone() Rollout {
+	c := *r
+	c.Qubes = slices.Clone(r.Qubes)
+	c.Spec.QubeIDs = slices.Clone(r.Spec.QubeIDs)
+	return c
+}
+
+func newRolloutID() string {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return "rollout-" + hex.EncodeToString(b[:])
+}
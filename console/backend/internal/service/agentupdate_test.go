@@ -0,0 +1,209 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/slchris/qubes-air/console/internal/agentupdate"
+	"github.com/slchris/qubes-air/console/internal/models"
+	"github.com/slchris/qubes-air/console/internal/repository"
+)
+
+// updateInvoker plays a remote's qubesair.Update: an apply starts an install
+// that reaches awaiting-confirm on the next status, and a confirm finishes
+// it — unless rollBack is set, in which case the window "passes" instead.
+type updateInvoker struct {
+	mu       sync.Mutex
+	st       agentupdate.Status
+	rollBack bool
+	applies  int
+	pings    int
+}
+
+func (f *updateInvoker) Invoke(_ context.Context, _, service string, in []byte) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if service == pingService {
+		f.pings++
+		return []byte("pong"), nil
+	}
+	if service != agentupdate.Service {
+		return nil, errors.New("unexpected service " + service)
+	}
+	var req agentupdate.Request
+	if err := json.Unmarshal(in, &req); err != nil {
+		return nil, err
+	}
+	switch req.Op {
+	case agentupdate.OpApply:
+		if req.SHA256 == "bad" {
+			return nil, agentupdate.ErrBadSignature
+		}
+		f.applies++
+		f.st = agentupdate.Status{State: agentupdate.StateInstalling, From: "1.0", To: req.Version, ConfirmSeconds: 1}
+	case agentupdate.OpStatus:
+		switch {
+		case f.st.State == agentupdate.StateInstalling:
+			f.st.State = agentupdate.StateAwaitingConfirm
+		case f.st.State == agentupdate.StateAwaitingConfirm && f.rollBack:
+			f.st.State, f.st.Detail = agentupdate.StateRolledBack, "2.0 was not confirmed in time"
+		}
+	case agentupdate.OpConfirm:
+		if f.st.State != agentupdate.StateAwaitingConfirm {
+			return nil, errors.New("nothing to confirm")
+		}
+		if !f.rollBack {
+			f.st.State = agentupdate.StateConfirmed
+		}
+	}
+	return json.Marshal(f.st)
+}
+
+type updateTargets map[string]*models.Qube
+
+func (m updateTargets) GetByID(_ context.Context, id string) (*models.Qube, error) {
+	if q, ok := m[id]; ok {
+		return q, nil
+	}
+	return nil, repository.ErrQubeNotFound
+}
+
+func (m updateTargets) List(_ context.Context, opts repository.QubeListOptions) ([]*models.Qube, error) {
+	var out []*models.Qube
+	for _, q := range m {
+		if (opts.ZoneID == "" || q.ZoneID == opts.ZoneID) && (opts.Status == "" || string(q.Status) == opts.Status) {
+			out = append(out, q)
+		}
+	}
+	return out, nil
+}
+
+func newTestUpdater(t *testing.T, inv *updateInvoker) (*AgentUpdater, updateTargets) {
+	t.Helper()
+	ca := newCA(t)
+	addr, _ := startAgent(t, ca, ca, "agent-update", inv)
+	host, port := hostPort(t, addr)
+	now := time.Now()
+	// Both running qubes are the one test agent, whose certificate names
+	// "update"; the dial checks the name.
+	qubes := updateTargets{
+		"q1": {ID: "q1", Name: "update", ZoneID: "z1", Status: models.QubeStatusRunning, IPAddress: host, CreatedAt: now},
+		"q2": {ID: "q2", Name: "update", ZoneID: "z1", Status: models.QubeStatusRunning, IPAddress: host, CreatedAt: now.Add(time.Second)},
+		"q3": {ID: "q3", Name: "cold", ZoneID: "z1", Status: models.QubeStatusStopped, CreatedAt: now.Add(2 * time.Second)},
+	}
+	u := NewAgentUpdater(staticCA{ca: ca}, qubes, "0.0.0.0:"+port,
+		AgentPackage{URL: "https://example.invalid/agent.deb", SHA256: "abc", Version: "2.0"})
+	u.poll = 10 * time.Millisecond
+	return u, qubes
+}
+
+func waitRollout(t *testing.T, u *AgentUpdater, id string) Rollout {
+	t.Helper()
+	deadline := time.Now().Add(20 * time.Second)
+	for time.Now().Before(deadline) {
+		r, err := u.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.State != RolloutRunning {
+			return r
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("rollout %s never finished", id)
+	return Rollout{}
+}
+
+func TestAgentUpdater_RolloutConfirmsEachQube(t *testing.T) {
+	inv := &updateInvoker{}
+	u, _ := newTestUpdater(t, inv)
+
+	r, err := u.Start(context.Background(), RolloutSpec{QubeIDs: []string{"q1", "q2", "q3"}}, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Spec.Package.URL == "" || r.Spec.BatchSize != 1 {
+		t.Errorf("spec defaults not applied: %+v", r.Spec)
+	}
+	r = waitRollout(t, u, r.ID)
+	if r.State != RolloutCompleted {
+		t.Fatalf("rollout = %s (%s)", r.State, r.Detail)
+	}
+	want := map[string]QubeUpdateState{"q1": QubeUpdateUpdated, "q2": QubeUpdateUpdated, "q3": QubeUpdateSkipped}
+	for _, qu := range r.Qubes {
+		if qu.State != want[qu.QubeID] {
+			t.Errorf("%s: %s (%s), want %s", qu.QubeName, qu.State, qu.Detail, want[qu.QubeID])
+		}
+	}
+	if inv.applies != 2 || inv.pings < 2 {
+		t.Errorf("applies = %d, pings = %d; every updated qube must be pinged before its confirm", inv.applies, inv.pings)
+	}
+	if list := u.List(); len(list) != 1 || list[0].ID != r.ID {
+		t.Errorf("List = %+v", list)
+	}
+}
+
+func TestAgentUpdater_RollbackHaltsTheRollout(t *testing.T) {
+	inv := &updateInvoker{rollBack: true}
+	u, _ := newTestUpdater(t, inv)
+
+	r, err := u.Start(context.Background(), RolloutSpec{ZoneID: "z1"}, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = waitRollout(t, u, r.ID)
+	if r.State != RolloutHalted {
+		t.Fatalf("rollout = %s, want halted", r.State)
+	}
+	if len(r.Qubes) != 2 || r.Qubes[0].State != QubeUpdateRolledBack || r.Qubes[1].State != QubeUpdateSkipped {
+		t.Fatalf("qubes = %+v; the first rolls back and the second is never touched", r.Qubes)
+	}
+	if inv.applies != 1 {
+		t.Errorf("applies = %d, want 1", inv.applies)
+	}
+}
+
+func TestAgentUpdater_RefusalsComeBackAsSentinels(t *testing.T) {
+	u, qubes := newTestUpdater(t, &updateInvoker{})
+	_, err := u.Update(context.Background(), qubes["q1"], UpdatePackage{URL: "https://x/a.deb", SHA256: "bad"}, 0)
+	if !errors.Is(err, agentupdate.ErrBadSignature) {
+		t.Errorf("Update = %v, want ErrBadSignature", err)
+	}
+	if _, err := u.Start(context.Background(), RolloutSpec{QubeIDs: []string{"q3"}}, "admin"); !errors.Is(err, ErrEmptyRollout) {
+		t.Errorf("Start over stopped qubes = %v, want ErrEmptyRollout", err)
+	}
+	if _, err := u.Get("rollout-none"); !errors.Is(err, ErrRolloutNotFound) {
+		t.Errorf("Get = %v", err)
+	}
+}
+
+// TestAgentUpdater_RefusesAPackageAboveTheAgentsProtocol — the manifest's
+// minimum is checked against the wire version the qube's agent reported, and
+// a qube whose link runs below it, or that never reported one, is not sent
+// the package at all.
+func TestAgentUpdater_RefusesAPackageAboveTheAgentsProtocol(t *testing.T) {
+	inv := &updateInvoker{}
+	u, qubes := newTestUpdater(t, inv)
+	pkg := UpdatePackage{URL: "https://x/a.deb", SHA256: "abc", Version: "2.0", MinProtocol: "v2"}
+
+	if _, err := u.Update(context.Background(), qubes["q1"], pkg, 0); !errors.Is(err, ErrProtocolTooOld) {
+		t.Errorf("Update with no reported protocol = %v, want ErrProtocolTooOld", err)
+	}
+	qubes["q1"].Agent = &models.AgentInfo{ProtocolVersion: "v1"}
+	if _, err := u.Update(context.Background(), qubes["q1"], pkg, 0); !errors.Is(err, ErrProtocolTooOld) {
+		t.Errorf("Update over a v1 link = %v, want ErrProtocolTooOld", err)
+	}
+	if inv.applies != 0 {
+		t.Fatalf("applies = %d; a refused package must not reach the agent", inv.applies)
+	}
+
+	qubes["q1"].Agent.ProtocolVersion = "v2"
+	st, err := u.Update(context.Background(), qubes["q1"], pkg, 0)
+	if err != nil || st.State != agentupdate.StateConfirmed {
+		t.Errorf("Update over a v2 link = %+v, %v", st, err)
+	}
+}
@@ -0,0 +1,199 @@
+// agentversion.go — which agent builds are running, and which are too old to
+// be trusted with a secret.
+//
+// The handshake has always carried the agent's build, and the prober has
+// stored it since capability negotiation; nothing acted on it. A fleet where a
+// fixed agent bug is still live on the qubes nobody rebuilt is exactly the
+// fleet a stored build version should be able to show, and a console about to
+// hand a data-disk key to one of those agents should be able to say no.
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/slchris/qubes-air/console/internal/agentupdate"
+	"github.com/slchris/qubes-air/console/internal/models"
+	"github.com/slchris/qubes-air/console/internal/repository"
+	transportgrpc "github.com/slchris/qubes-air/console/internal/transport/grpc"
+)
+
+// ErrAgentOutdated means an agent's build is below the configured minimum and
+// the operation was refused because of it.
+var ErrAgentOutdated = errors.New("agent is older than the minimum version")
+
+// AgentVersionPolicy is the configured minimum agent build, and whether an
+// agent below it is refused or only flagged. A nil policy sets no minimum.
+type AgentVersionPolicy struct {
+	min     string
+	enforce bool
+}
+
+// NewAgentVersionPolicy builds a policy. An empty min returns nil: no
+// minimum. enforce false is the "warn" policy.
+func NewAgentVersionPolicy(min string, enforce bool) *AgentVersionPolicy {
+	if min == "" {
+		return nil
+	}
+	return &AgentVersionPolicy{min: min, enforce: enforce}
+}
+
+// outdated reports whether build is below the minimum, and why in words. A
+// build that is not a release version ("dev", or nothing at all, from an agent
+// that predates reporting one) is outdated: nothing says it has the fix the
+// minimum was raised for.
+func (p *AgentVersionPolicy) outdated(build string) (bool, string) {
+	if p == nil {
+		return false, ""
+	}
+	if !agentupdate.ValidVersion(build) {
+		if build == "" {
+			build = "no build"
+		}
+		return true, fmt.Sprintf("reports %s, not a release version; minimum is %s", build, p.min)
+	}
+	if agentupdate.CompareVersions(build, p.min) < 0 {
+		return true, fmt.Sprintf("build %s is below the minimum %s", build, p.min)
+	}
+	return false, ""
+}
+
+// admit decides whether an agent that just reported build in its handshake
+// may be given service's request. Under "warn" an outdated agent is logged and
+// admitted; under "refuse" it gets ErrAgentOutdated.
+//
+// It is the live handshake that is checked, not the build the prober stored:
+// a secret goes to whatever answered this tunnel, and the stored build is from
+// a probe that may predate a rollback or a rebuild of the qube.
+func (p *AgentVersionPolicy) admit(qube *models.Qube, service string, peer transportgrpc.PeerInfo) error {
+	old, why := p.outdated(peer.BuildVersion)
+	if !old {
+		return nil
+	}
+	if !p.enforce {
+		log.Printf("agentversion: qube %q %s; %s allowed by the warn policy", qube.Name, why, service)
+		return nil
+	}
+	return fmt.Errorf("%w: qube %q %s; %s refused until it is updated", ErrAgentOutdated, qube.Name, why, service)
+}
+
+// AgentVersionSource lists qubes with the agent description the prober
+// recorded. Implemented by the qube repository.
+type AgentVersionSource interface {
+	List(ctx context.Context, opts repository.QubeListOptions) ([]*models.Qube, error)
+}
+
+// AgentInventory reports the fleet's agent builds against the policy.
+type AgentInventory struct {
+	qubes  AgentVersionSource
+	policy *AgentVersionPolicy
+}
+
+// NewAgentInventory builds an inventory. policy may be nil.
+func NewAgentInventory(qubes AgentVersionSource, policy *AgentVersionPolicy) *AgentInventory {
+	return &AgentInventory{qubes: qubes, policy: policy}
+}
+
+// AgentVersionInventory is the fleet's agents by build.
+type AgentVersionInventory struct {
+	// MinVersion is the configured minimum; empty when there is none.
+	MinVersion string `json:"min_version,omitempty"`
+	// Enforced is whether an outdated agent is refused, rather than only
+	// flagged here.
+	Enforced bool `json:"enforced"`
+	// Versions counts agents per reported build, newest first and unnumbered
+	// builds last. Qubes whose
+	// agent has never reported are not in it; they are Unreported.
+	Versions []AgentBuildCount `json:"versions"`
+	// Agents is one entry per qube.
+	Agents []AgentVersionEntry `json:"agents"`
+	// Outdated counts the agents below the minimum.
+	Outdated int `json:"outdated"`
+	// Unreported counts the qubes no probe has had a description from.
+	Unreported int `json:"unreported"`
+}
+
+// AgentBuildCount is how many agents run one build.
+type AgentBuildCount struct {
+	BuildVersion string `json:"build_version"`
+	Count        int    `json:"count"`
+	Outdated     bool   `json:"outdated"`
+}
+
+// AgentVersionEntry is one qube's agent as last reported.
+type AgentVersionEntry struct {
+	QubeID          string             `json:"qube_id"`
+	QubeName        string             `json:"qube_name"`
+	Status          models.QubeStatus  `json:"status"`
+	AgentHealth     models.AgentHealth `json:"agent_health"`
+	BuildVersion    string             `json:"build_version,omitempty"`
+	ProtocolVersion string             `json:"protocol_version,omitempty"`
+	Services        []string           `json:"services,omitempty"`
+	ReportedAt      *time.Time         `json:"reported_at,omitempty"`
+	// Outdated and Reason are judged against the minimum. An agent that has
+	// never reported is neither outdated nor current: there is nothing to
+	// judge yet, and calling it outdated would bury the agents that are.
+	Outdated bool   `json:"outdated"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// Inventory lists the qubes opts selects with their agents' last reported
+// builds. opts' paging is replaced: counts over one page of the fleet would
+// be counts of nothing in particular.
+func (i *AgentInventory) Inventory(ctx context.Context, opts repository.QubeListOptions) (AgentVersionInventory, error) {
+	opts.Limit, opts.Offset = maxRolloutQubes, 0
+	qubes, err := i.qubes.List(ctx, opts)
+	if err != nil {
+		return AgentVersionInventory{}, err
+	}
+	inv := AgentVersionInventory{Versions: []AgentBuildCount{}, Agents: make([]AgentVersionEntry, 0, len(qubes))}
+	if i.policy != nil {
+		inv.MinVersion, inv.Enforced = i.policy.min, i.policy.enforce
+	}
+	counts := map[string]*AgentBuildCount{}
+	for _, q := range qubes {
+		e := AgentVersionEntry{QubeID: q.ID, QubeName: q.Name, Status: q.Status, AgentHealth: q.AgentHealth}
+		if q.Agent == nil {
+			inv.Unreported++
+			inv.Agents = append(inv.Agents, e)
+			continue
+		}
+		reported := q.Agent.ReportedAt
+		e.BuildVersion, e.ProtocolVersion = q.Agent.BuildVersion, q.Agent.ProtocolVersion
+		e.Services, e.ReportedAt = q.Agent.Capabilities.Services, &reported
+		e.Outdated, e.Reason = i.policy.outdated(e.BuildVersion)
+		if e.Outdated {
+			inv.Outdated++
+		}
+		c, ok := counts[e.BuildVersion]
+		if !ok {
+			c = &AgentBuildCount{BuildVersion: e.BuildVersion, Outdated: e.Outdated}
+			counts[e.BuildVersion] = c
+		}
+		c.Count++
+		inv.Agents = append(inv.Agents, e)
+	}
+	for _, c := range counts {
+		inv.Versions = append(inv.Versions, *c)
+	}
+	// Builds that are not versions ("dev") last: dpkg would put them above
+	// every numbered release, which is not where anyone looks for them.
+	slices.SortFunc(inv.Versions, func(a, b AgentBuildCount) int {
+		if va, vb := agentupdate.ValidVersion(a.BuildVersion), agentupdate.ValidVersion(b.BuildVersion); va != vb {
+			if va {
+				return -1
+			}
+			return 1
+		}
+		if c := agentupdate.CompareVersions(b.BuildVersion, a.BuildVersion); c != 0 {
+			return c
+		}
+		return strings.Compare(a.BuildVersion, b.BuildVersion)
+	})
+	return inv, nil
+}
@@ -0,0 +1,126 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/slchris/qubes-air/console/internal/models"
+	"github.com/slchris/qubes-air/console/internal/repository"
+	transportgrpc "github.com/slchris/qubes-air/console/internal/transport/grpc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// unlockInvoker answers qubesair.UnlockData and remembers every key it was
+// handed.
+type unlockInvoker struct {
+	mu   sync.Mutex
+	keys []string
+}
+
+func (u *unlockInvoker) Invoke(_ context.Context, _, service string, in []byte) ([]byte, error) {
+	if service != unlockDataService {
+		return nil, errors.New("no such qrexec service")
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.keys = append(u.keys, string(in))
+	return []byte(`{"unlocked":true,"detail":"mounted"}`), nil
+}
+
+func (u *unlockInvoker) received() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return len(u.keys)
+}
+
+// TestUnlockWithholdsTheKeyFromAnOutdatedAgent — the check is only worth
+// anything if it happens before the key is on the wire: an agent refused after
+// it already holds the key has been refused nothing.
+func TestUnlockWithholdsTheKeyFromAnOutdatedAgent(t *testing.T) {
+	original := transportgrpc.BuildVersion
+	defer func() { transportgrpc.BuildVersion = original }()
+
+	ca := newCA(t)
+	invoker := &unlockInvoker{}
+	addr, _ := startAgent(t, ca, ca, "agent-locked", invoker)
+	host, port := hostPort(t, addr)
+	qube := &models.Qube{ID: "q-1", Name: "locked", IPAddress: host}
+	unlocker := func(p *AgentVersionPolicy) *AgentDataUnlocker {
+		return NewAgentDataUnlocker(staticCA{ca: ca}, &recordingKeys{}, "0.0.0.0:"+port, 10*time.Second).
+			WithVersionPolicy(p)
+	}
+
+	// The in-process agent reports this package's BuildVersion in its handshake.
+	transportgrpc.BuildVersion = "1.3.2"
+	_, err := unlocker(NewAgentVersionPolicy("1.4.0", true)).Unlock(context.Background(), qube)
+	require.ErrorIs(t, err, ErrAgentOutdated)
+	assert.Contains(t, err.Error(), "1.3.2")
+	assert.Zero(t, invoker.received(), "an outdated agent was handed the key")
+
+	// An unstamped build is as good as outdated: nothing says it has the fix.
+	transportgrpc.BuildVersion = "dev"
+	_, err = unlocker(NewAgentVersionPolicy("1.4.0", true)).Unlock(context.Background(), qube)
+	require.ErrorIs(t, err, ErrAgentOutdated)
+	assert.Zero(t, invoker.received())
+
+	// warn flags and goes ahead.
+	res, err := unlocker(NewAgentVersionPolicy("1.4.0", false)).Unlock(context.Background(), qube)
+	require.NoError(t, err)
+	assert.True(t, res.Unlocked)
+
+	transportgrpc.BuildVersion = "1.4.0"
+	res, err = unlocker(NewAgentVersionPolicy("1.4.0~rc1", true)).Unlock(context.Background(), qube)
+	require.NoError(t, err)
+	assert.True(t, res.Unlocked)
+	assert.Equal(t, 2, invoker.received())
+}
+
+type listedQubes []*models.Qube
+
+func (l listedQubes) List(_ context.Context, opts repository.QubeListOptions) ([]*models.Qube, error) {
+	if opts.Limit < len(l) {
+		return l[:opts.Limit], nil
+	}
+	return l, nil
+}
+
+func TestAgentInventoryJudgesTheReportedBuilds(t *testing.T) {
+	reported := func(build string) *models.AgentInfo {
+		return &models.AgentInfo{ProtocolVersion: "v2", BuildVersion: build, ReportedAt: time.Now()}
+	}
+	qubes := listedQubes{
+		{ID: "1", Name: "a", Agent: reported("1.4.0")},
+		{ID: "2", Name: "b", Agent: reported("1.10.0")},
+		{ID: "3", Name: "c", Agent: reported("1.4.0")},
+		{ID: "4", Name: "d", Agent: reported("1.3.9")},
+		{ID: "5", Name: "e", Agent: reported("dev")},
+		{ID: "6", Name: "f"},
+	}
+
+	inv, err := NewAgentInventory(qubes, NewAgentVersionPolicy("1.4.0", true)).
+		Inventory(context.Background(), repository.DefaultQubeListOptions())
+	require.NoError(t, err)
+	assert.Equal(t, "1.4.0", inv.MinVersion)
+	assert.True(t, inv.Enforced)
+	assert.Len(t, inv.Agents, 6)
+	assert.Equal(t, 2, inv.Outdated)
+	assert.Equal(t, 1, inv.Unreported, "a qube that never reported is unknown, not outdated")
+	require.Len(t, inv.Versions, 4)
+	assert.Equal(t, AgentBuildCount{BuildVersion: "1.10.0", Count: 1}, inv.Versions[0], "newest first, by dpkg's order")
+	assert.Equal(t, AgentBuildCount{BuildVersion: "1.4.0", Count: 2}, inv.Versions[1])
+	assert.True(t, inv.Versions[2].Outdated)
+	assert.Equal(t, "1.3.9", inv.Agents[3].BuildVersion)
+	assert.True(t, inv.Agents[3].Outdated)
+	assert.NotEmpty(t, inv.Agents[3].Reason)
+	assert.False(t, inv.Agents[5].Outdated)
+
+	// Without a minimum nothing is outdated, and the counts are still there.
+	inv, err = NewAgentInventory(qubes, nil).Inventory(context.Background(), repository.QubeListOptions{Limit: 2})
+	require.NoError(t, err)
+	assert.Zero(t, inv.Outdated)
+	assert.Len(t, inv.Agents, 6, "a page of the fleet is not an inventory of it")
+}
@@ -413,6 +413,15 @@ func NewCertRenewer(
 	}
 }
 
+// WithDialer replaces the direct dialer, e.g. with the zone registry. Nil is
+// ignored.
+func (r *CertRenewer) WithDialer(d AgentDialer) *CertRenewer {
+	if d != nil {
+		r.dialer = d
+	}
+	return r
+}
+
 // Renew runs the two-call renewal against one qube.
 //
 // The order — BeginRenewal, verify, sign, REGISTER, CompleteRenewal — is chosen
@@ -822,6 +822,18 @@ func (m *CertRenewalMonitor) publishHealth(ctx context.Context, q *models.Qube,
 	if res.Status != CertRenewalOK {
 		failure = renewalWarningText(res.Status, res.Reason, res.PreviousNotAfter, m.now())
 	}
+	// The renewal learned the agent answers, not that the qube is fine: a
+	// degraded reading from the last status report stands, problems first,
+	// until a probe with a newer report says otherwise.
+	if health == models.AgentHealthHealthy && q.AgentHealth == models.AgentHealthDegraded &&
+		q.AgentStatus != nil && len(q.AgentStatus.Problems) > 0 {
+		health = models.AgentHealthDegraded
+		if failure == "" {
+			failure = degradedReason(q.AgentStatus)
+		} else {
+			failure = degradedReason(q.AgentStatus) + "; " + failure
+		}
+	}
 
 	// Detached from the sweep's deadline: the attempt already happened, and
 	// losing the record because a shutdown landed a millisecond later would hide
@@ -64,6 +64,8 @@ type CertIssuer struct {
 	// Unset means the rendered document has no package to install, and says so
 	// loudly in the guest rather than producing a qube with a dead unit.
 	agentPkg AgentPackage
+	// pkgMu guards agentPkg's manifest, fetched on first use.
+	pkgMu sync.Mutex
 
 	// tokens mints the one-shot bootstrap credentials cloud-init delivers.
 	// Without it a qube can be created but has no way to ever obtain an
@@ -216,10 +218,14 @@ func (c *CertIssuer) IssueFor(ctx context.Context, qube *models.Qube) error {
 	// but has no way to reach the remote, which is exactly the state this whole
 	// chain existed to leave behind.
 	if c.identityDir != "" {
+		pkg, err := c.AgentPackage(ctx)
+		if err != nil {
+			return fmt.Errorf("agent package for %q: %w", qube.Name, err)
+		}
 		userData, err := RenderAgentUserData(qube.Name, AgentIdentityDoc{
 			CAPEM:          pki.EncodeCACertPEM(ca),
 			BootstrapToken: token,
-		}, c.agentListen, c.agentPkg, qube.Spec.EncryptsData())
+		}, c.agentListen, pkg, qube.Spec.EncryptsData())
 		if err != nil {
 			return fmt.Errorf("render identity for %q: %w", qube.Name, err)
 		}
@@ -9,11 +9,26 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+
+	"github.com/slchris/qubes-air/console/internal/agentupdate"
 )
 
 // agentInstallDir is where the agent's mTLS material lands on the remote.
 const agentInstallDir = "/etc/qubes-air"
 
+// agentManifestPath is where the signed release manifest lands, its detached
+// signature beside it; agentReleaseKeyPath is the key this document delivers
+// to check it with, and imageReleaseKeyPath the key a cloud image may carry
+// instead, which wins when present.
+const (
+	// agentRollbackPackage is the copy of the installed package qubesair.Update
+	// rolls back to.
+	agentRollbackPackage = agentupdate.DefaultDir + "/" + agentupdate.InstalledFile
+	agentManifestPath    = agentInstallDir + "/release-manifest"
+	agentReleaseKeyPath  = agentInstallDir + "/release-key.pem"
+	imageReleaseKeyPath  = "/usr/share/qubes-air/release-key.pem"
+)
+
 // agentInstallerPath is the package installer this document delivers, and
 // agentFailureMarker is where that installer records why a qube ended up with
 // no agent. The marker is a file rather than only a log line because it
@@ -62,6 +77,20 @@ type AgentPackage struct {
 	// own sources alone.
 	AptMirror         string
 	AptSecurityMirror string
+	// UpdateKey is the release key qubesair.Update checks packages against,
+	// base64 Ed25519. Pinned on the qube by this document and by nothing
+	// later, so the console that names an update cannot also vouch for it.
+	UpdateKey string
+	// ManifestURL names a signed release manifest (agentupdate.Manifest)
+	// that decides the package instead of URL and SHA256, which then come
+	// from it. Manifest and ManifestSig are its bytes and detached
+	// signature, fetched by the console; see resolveManifest.
+	ManifestURL string
+	Manifest    []byte
+	ManifestSig []byte
+	// MinProtocol is the manifest's min-protocol once resolved: the lowest
+	// wire version the package's agent runs at. Empty without a manifest.
+	MinProtocol string
 }
 
 // sha256Hex matches the bare 64-character digest sha256sum(1) expects.
@@ -153,6 +182,13 @@ func RenderAgentUserData(remoteName string, id AgentIdentityDoc, listen string,
 	if err := id.validate(); err != nil {
 		return "", err
 	}
+	// Unlike a missing package, a manifest that does not verify is refused
+	// here, not rendered into a guest that would refuse it: it means the
+	// console was told to deliver something the release key did not sign.
+	pkg, err := pkg.resolveManifest()
+	if err != nil {
+		return "", fmt.Errorf("agent release manifest: %w", err)
+	}
 	if remoteName == "" {
 		return "", fmt.Errorf("remote name is required: the agent reports it and qubesair.Ping returns it")
 	}
@@ -218,6 +254,11 @@ func RenderAgentUserData(remoteName string, id AgentIdentityDoc, listen string,
 		// image can still open its LUKS disk; the console pushes the key later.
 		b.WriteString("  - cryptsetup\n")
 	}
+	if pkg.ManifestURL != "" {
+		// openssl checks the release manifest's signature; the image normally
+		// has it, as it does curl.
+		b.WriteString("  - openssl\n")
+	}
 	b.WriteString("write_files:\n")
 
 	// The CA is public — it is what the agent verifies the console WITH, not a
@@ -236,6 +277,25 @@ func RenderAgentUserData(remoteName string, id AgentIdentityDoc, listen string,
 	writeFile(&b, agentInstallDir+"/agent.env",
 		"0644", fmt.Sprintf("QUBESAIR_REMOTE_NAME=%s\nQUBESAIR_LISTEN=%s\n", remoteName, listen))
 
+	// The release key, when the console has one. Root's and 0644: public, but
+	// the helper refuses a key file anyone else could have written.
+	if pkg.UpdateKey != "" {
+		writeFile(&b, agentInstallDir+"/update.pub", "0644", pkg.UpdateKey+"\n")
+	}
+
+	// The signed manifest, its signature and the key to check it with. The
+	// installer prefers a key the image carries: one that arrives in the same
+	// document as the manifest proves only that the two arrived together.
+	if pkg.ManifestURL != "" {
+		writeFile(&b, agentManifestPath, "0644", string(pkg.Manifest))
+		writeFile(&b, agentManifestPath+agentupdate.SignatureSuffix, "0644", string(pkg.ManifestSig))
+		keyPEM, err := releaseKeyPEM(pkg.UpdateKey)
+		if err != nil {
+			return "", err
+		}
+		writeFile(&b, agentReleaseKeyPath, "0644", keyPEM)
+	}
+
 	// The installer is delivered as a file rather than inlined into runcmd so
 	// its quoting is YAML's problem, not a shell-inside-a-flow-sequence problem.
 	// 0700: it is the thing that installs a root-owned service.
@@ -297,7 +357,16 @@ func RenderAgentUserData(remoteName string, id AgentIdentityDoc, listen string,
 // not exist succeeds quietly enough to miss.
 func agentInstallerScript(pkg AgentPackage) string {
 	url, sha, reason := pkg.resolve()
+	manifestBase := ""
+	if pkg.ManifestURL != "" && reason == "" {
+		manifestBase = manifestBaseURL(pkg.ManifestURL)
+	}
 	return strings.NewReplacer(
+		"@MANIFEST_BASE@", manifestBase,
+		"@MANIFEST@", agentManifestPath,
+		"@ROLLBACK@", agentRollbackPackage,
+		"@IMAGE_KEY@", imageReleaseKeyPath,
+		"@RELEASE_KEY@", agentReleaseKeyPath,
 		"@URL@", url,
 		"@SHA@", sha,
 		"@VERSION@", strings.Map(dropShellQuoting, pkg.Version),
@@ -423,6 +492,8 @@ PKG_SHA='@SHA@'
 PKG_VERSION='@VERSION@'
 SKIP_REASON='@REASON@'
 MARKER='@MARKER@'
+MANIFEST_BASE='@MANIFEST_BASE@'
+MANIFEST='@MANIFEST@'
 # /run is tmpfs: an unverified download never reaches persistent storage.
 DEB=/run/qubes-air-agent.deb
 
@@ -464,6 +535,32 @@ if [ -z "$PKG_URL" ] || [ -z "$PKG_SHA" ]; then
     fail "qubes-air-agent unit not present and no package URL to install one from"
 fi
 
+# A signed release manifest, when the console names one, decides the package:
+# the URL and digest above are only what the console says, and the manifest is
+# what the release key signed. The key the image carries wins over the one
+# this document delivered, which proves only that it came with the manifest.
+if [ -n "$MANIFEST_BASE" ]; then
+    KEY='@IMAGE_KEY@'
+    [ -f "$KEY" ] || KEY='@RELEASE_KEY@'
+    SIG=/run/qubes-air-release.sig
+    base64 -d "$MANIFEST.sig" > "$SIG" 2>/dev/null ||
+        fail "release manifest signature is not base64"
+    # pkeyutl -rawin is how OpenSSL 3 checks an Ed25519 signature over a file.
+    openssl pkeyutl -verify -pubin -inkey "$KEY" -rawin -in "$MANIFEST" -sigfile "$SIG" >/dev/null 2>&1 ||
+        fail "release manifest signature does not verify against $KEY; refusing to install"
+    rm -f "$SIG"
+    ARCH="$(dpkg --print-architecture)"
+    # The console already refused a manifest that names an architecture twice
+    # or a file name with anything a shell would split, so two words or none.
+    # shellcheck disable=SC2046
+    set -- $(awk -v a="$ARCH" '$1 == "sha256" && $2 == a { print $3, $4 }' "$MANIFEST")
+    [ $# -eq 2 ] || fail "the signed release manifest has no single package for $ARCH"
+    PKG_SHA="$1"
+    PKG_URL="$MANIFEST_BASE$2"
+    PKG_VERSION="$(awk '$1 == "version" { print $2 }' "$MANIFEST")"
+    say "release manifest verified against $KEY; installing $2"
+fi
+
 fetch() {
     if command -v curl >/dev/null 2>&1; then
         curl -fsS --retry 3 --retry-delay 2 --max-time 120 -o "$DEB" "$PKG_URL"
@@ -487,6 +584,10 @@ if ! printf '%s  %s\n' "$PKG_SHA" "$DEB" | sha256sum -c - >/dev/null 2>&1; then
 fi
 
 dpkg -i "$DEB" >/dev/null 2>&1 || fail "dpkg -i failed for $PKG_URL"
+# Kept, root's alone, as what qubesair.Update rolls back to: a remote with no
+# copy of its installed package refuses to be updated at all.
+install -D -m 0600 "$DEB" '@ROLLBACK@' 2>/dev/null ||
+    say "could not keep the package for rollback; qubesair.Update will refuse this qube"
 rm -f "$DEB"
 
 # The package ships the unit under /lib/systemd/system; reload so systemd sees
@@ -460,6 +460,12 @@ func runInstaller(t *testing.T, userData string, systemctlExit string) installer
 // runInstallerWithStates drives the sequence systemctl is-active reports, so a
 // test can reproduce "forked, then died" rather than only steady states.
 func runInstallerWithStates(t *testing.T, userData, systemctlExit, states string) installerRun {
+	return runInstallerWithImageKey(t, userData, systemctlExit, states, "")
+}
+
+// runInstallerWithImageKey also gives the "image" a release key, as a cloud
+// image built with one pinned would have.
+func runInstallerWithImageKey(t *testing.T, userData, systemctlExit, states, imageKey string) installerRun {
 	t.Helper()
 	if _, err := exec.LookPath("sh"); err != nil {
 		t.Skip("no sh available")
@@ -474,9 +480,27 @@ func runInstallerWithStates(t *testing.T, userData, systemctlExit, states string
 	// instead of quietly running an unredirected script.
 	require.Contains(t, script, "DEB=/run/qubes-air-agent.deb")
 	require.Contains(t, script, "MARKER='"+agentFailureMarker+"'")
+	require.Contains(t, script, agentRollbackPackage)
 	marker := filepath.Join(dir, "marker")
 	script = strings.ReplaceAll(script, "DEB=/run/qubes-air-agent.deb", "DEB="+dir+"/download.deb")
 	script = strings.ReplaceAll(script, "MARKER='"+agentFailureMarker+"'", "MARKER='"+marker+"'")
+	script = strings.ReplaceAll(script, agentRollbackPackage, dir+"/installed.deb")
+	// The manifest, its signature and both keys are the guest's files too,
+	// delivered beside the installer; they land in dir as cloud-init would
+	// land them in /etc/qubes-air.
+	script = strings.ReplaceAll(script, "SIG=/run/qubes-air-release.sig", "SIG="+dir+"/release.sig")
+	script = strings.ReplaceAll(script, imageReleaseKeyPath, dir+"/image-release-key.pem")
+	cc := parseConfig(t, userData)
+	for _, path := range []string{agentManifestPath, agentManifestPath + ".sig", agentReleaseKeyPath} {
+		if content := fileContent(t, cc, path); content != "" {
+			local := filepath.Join(dir, filepath.Base(path))
+			require.NoError(t, os.WriteFile(local, []byte(content), 0o644))
+			script = strings.ReplaceAll(script, "'"+path+"'", "'"+local+"'")
+		}
+	}
+	if imageKey != "" {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "image-release-key.pem"), []byte(imageKey), 0o644))
+	}
 
 	scriptPath := filepath.Join(dir, "install")
 	require.NoError(t, os.WriteFile(scriptPath, []byte(script), 0o700))
@@ -553,6 +577,7 @@ digest "$@"
 `)
 	write("dpkg", `#!/bin/sh
 echo "dpkg $*" >> "$STUB_LOG"
+if [ "$1" = "--print-architecture" ]; then echo amd64; fi
 `)
 	// is-active must answer on STDOUT: the installer captures the state rather
 	// than sampling a single exit code, because Type=simple reports "active" at
@@ -0,0 +1,289 @@
+// endpoints.go — the endpoint table relays resolve RemoteVMs through, pushed.
+//
+// A relay forwards a call for RemoteVM X to X's agent at the address in its
+// own QubesDB (/remote-endpoint/X). It used to fill that table by polling
+// qubesair.RemoteEndpoints on a timer, so a freshly provisioned qube was
+// unreachable for up to one interval and a qube whose address changed kept
+// being dialed at the old one for as long. EndpointFeed turns the poll into a
+// subscription: every write to the qube table that can change an endpoint —
+// an address recorded by UpdateIPAddress, a release clearing it, a purge
+// deleting the row — pokes the feed, which recomputes the table and pushes
+// the difference to every subscriber.
+//
+// The table is always recomputed from the database, never patched from the
+// write that poked it. A write does not carry enough to say what changed (a
+// status flip alone can add or remove an endpoint), and recomputing keeps the
+// database the one source of truth: whatever the feed pushed is what
+// list-endpoints would have printed at that moment.
+//
+// Every change bumps a version. A subscriber starts with a full snapshot at
+// some version and then receives each later change in order; one that falls
+// behind is dropped rather than waited for, and resubscribing — which the
+// relay does on any disconnect — hands it a full snapshot again. There is no
+// "changes since version N": a snapshot is a handful of lines, and a resync
+// that is always complete cannot drift.
+
+package service
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/slchris/qubes-air/console/internal/models"
+	"github.com/slchris/qubes-air/console/internal/repository"
+)
+
+// endpointResyncInterval is how often the feed recomputes the table without
+// being poked. It catches writes that did not go through Track — the CLI
+// tools open the database directly — and is the only path by which they
+// reach relays.
+const endpointResyncInterval = time.Minute
+
+// endpointSubscriberBuffer is how many events a subscriber may have unread
+// before it is dropped. Endpoint changes come in handfuls; a subscriber this
+// far behind is not reading at all.
+const endpointSubscriberBuffer = 64
+
+// Endpoint is one RemoteVM's agent address.
+type Endpoint struct {
+	Name    string `json:"name"`
+	Address string `json:"address"` // ip:port
+}
+
+// EndpointSnapshot is the whole table at one version.
+type EndpointSnapshot struct {
+	Version   uint64     `json:"version"`
+	Endpoints []Endpoint `json:"endpoints"` // sorted by name
+}
+
+// EndpointEvent is one change to the table. An empty Address means the
+// endpoint is gone: the qube was released, stopped or purged.
+type EndpointEvent struct {
+	Version uint64 `json:"version"`
+	Name    string `json:"name"`
+	Address string `json:"address,omitempty"`
+}
+
+// EndpointFeed keeps the endpoint table and publishes its changes.
+type EndpointFeed struct {
+	qubes repository.QubeRepository
+	port  string
+	poke  chan struct{}
+
+	// refreshMu serializes refreshes, so two of them cannot apply their
+	// reads out of order.
+	refreshMu sync.Mutex
+
+	mu      sync.Mutex
+	version uint64
+	current map[string]string
+	loaded  bool
+	subs    map[chan EndpointEvent]struct{}
+}
+
+// NewEndpointFeed builds a feed over qubes. agentListen is the address handed
+// to agents (e.g. "0.0.0.0:8443"); only its port is used.
+//
+// The version starts at the current time in milliseconds rather than zero, so
+// a relay that reconnects to a restarted console never sees it go backwards.
+func NewEndpointFeed(qubes repository.QubeRepository, agentListen string) *EndpointFeed {
+	return &EndpointFeed{
+		qubes:   qubes,
+		port:    agentPortFrom(agentListen),
+		poke:    make(chan struct{}, 1),
+		version: uint64(time.Now().UnixMilli()),
+		current: make(map[string]string),
+		subs:    make(map[chan EndpointEvent]struct{}),
+	}
+}
+
+// Track wraps repo so that every write which can change an endpoint pokes the
+// feed. Everything that writes qubes in the console should go through the
+// returned repository; reads pass straight through.
+func (f *EndpointFeed) Track(repo repository.QubeRepository) repository.QubeRepository {
+	return &trackedQubes{QubeRepository: repo, feed: f}
+}
+
+// Poke asks for a recompute. It never blocks: pokes that arrive while one is
+// pending fold into it.
+func (f *EndpointFeed) Poke() {
+	select {
+	case f.poke <- struct{}{}:
+	default:
+	}
+}
+
+// Run recomputes the table on every poke and every endpointResyncInterval
+// until ctx ends.
+func (f *EndpointFeed) Run(ctx context.Context) {
+	ticker := time.NewTicker(endpointResyncInterval)
+	defer ticker.Stop()
+	for {
+		if err := f.refresh(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("endpoints: refresh: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-f.poke:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Subscribe returns the table as of now and a channel of every change after
+// it. The channel is closed when ctx ends or the subscriber falls behind;
+// either way, subscribing again is the way back.
+//
+// The table is recomputed first, so a snapshot is never older than the
+// subscription — even one taken before Run's first pass.
+func (f *EndpointFeed) Subscribe(ctx context.Context) (EndpointSnapshot, <-chan EndpointEvent, error) {
+	if err := f.refresh(ctx); err != nil {
+		return EndpointSnapshot{}, nil, err
+	}
+	ch := make(chan EndpointEvent, endpointSubscriberBuffer)
+
+	f.mu.Lock()
+	snap := EndpointSnapshot{Version: f.version, Endpoints: make([]Endpoint, 0, len(f.current))}
+	for name, addr := range f.current {
+		snap.Endpoints = append(snap.Endpoints, Endpoint{Name: name, Address: addr})
+	}
+	f.subs[ch] = struct{}{}
+	f.mu.Unlock()
+
+	sort.Slice(snap.Endpoints, func(i, j int) bool { return snap.Endpoints[i].Name < snap.Endpoints[j].Name })
+	go func() {
+		<-ctx.Done()
+		f.unsubscribe(ch)
+	}()
+	return snap, ch, nil
+}
+
+// Version is the table's current version.
+func (f *EndpointFeed) Version() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.version
+}
+
+func (f *EndpointFeed) unsubscribe(ch chan EndpointEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.subs[ch]; ok {
+		delete(f.subs, ch)
+		close(ch)
+	}
+}
+
+// refresh recomputes the table from the database and publishes what changed.
+func (f *EndpointFeed) refresh(ctx context.Context) error {
+	f.refreshMu.Lock()
+	defer f.refreshMu.Unlock()
+
+	qubes, err := f.qubes.ListByStatus(ctx, []models.QubeStatus{models.QubeStatusRunning})
+	if err != nil {
+		return err
+	}
+	next := make(map[string]string, len(qubes))
+	for _, q := range qubes {
+		// Same rule as list-endpoints: a qube with no address has nothing to
+		// forward to and must not shadow a live one.
+		if q.IPAddress != "" {
+			next[q.Name] = q.IPAddress + ":" + f.port
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var events []EndpointEvent
+	for name, addr := range next {
+		if f.current[name] != addr {
+			events = append(events, EndpointEvent{Name: name, Address: addr})
+		}
+	}
+	for name := range f.current {
+		if _, ok := next[name]; !ok {
+			events = append(events, EndpointEvent{Name: name})
+		}
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Name < events[j].Name })
+	for i := range events {
+		f.version++
+		events[i].Version = f.version
+	}
+	f.current = next
+	if f.loaded {
+		f.publish(events)
+	}
+	// The first load is not news: nobody has seen a table to change yet.
+	f.loaded = true
+	return nil
+}
+
+// publish hands events to every subscriber. Called with mu held; it never
+// blocks, because one stalled relay must not hold up the rest.
+func (f *EndpointFeed) publish(events []EndpointEvent) {
+	for _, ev := range events {
+		if ev.Address == "" {
+			log.Printf("endpoints: v%d %s removed", ev.Version, ev.Name)
+		} else {
+			log.Printf("endpoints: v%d %s -> %s", ev.Version, ev.Name, ev.Address)
+		}
+	}
+	for ch := range f.subs {
+		for _, ev := range events {
+			select {
+			case ch <- ev:
+				continue
+			default:
+			}
+			log.Printf("endpoints: dropping a subscriber %d events behind; it will resync on reconnect", len(ch))
+			delete(f.subs, ch)
+			close(ch)
+			break
+		}
+	}
+}
+
+// trackedQubes is a QubeRepository whose endpoint-changing writes poke the
+// feed once they have succeeded.
+type trackedQubes struct {
+	repository.QubeRepository
+	feed *EndpointFeed
+}
+
+func (t *trackedQubes) poked(err error) error {
+	if err == nil {
+		t.feed.Poke()
+	}
+	return err
+}
+
+func (t *trackedQubes) Create(ctx context.Context, qube *models.Qube) error {
+	return t.poked(t.QubeRepository.Create(ctx, qube))
+}
+
+func (t *trackedQubes) Update(ctx context.Context, qube *models.Qube) error {
+	return t.poked(t.QubeRepository.Update(ctx, qube))
+}
+
+func (t *trackedQubes) Delete(ctx context.Context, id string) error {
+	return t.poked(t.QubeRepository.Delete(ctx, id))
+}
+
+func (t *trackedQubes) UpdateStatus(ctx context.Context, id string, status models.QubeStatus) error {
+	return t.poked(t.QubeRepository.UpdateStatus(ctx, id, status))
+}
+
+func (t *trackedQubes) UpdateIPAddress(ctx context.Context, id, ipAddress string) error {
+	return t.poked(t.QubeRepository.UpdateIPAddress(ctx, id, ipAddress))
+}
+
+func (t *trackedQubes) ClaimTransition(
+	ctx context.Context, id string, from []models.QubeStatus, to models.QubeStatus,
+) error {
+	return t.poked(t.QubeRepository.ClaimTransition(ctx, id, from, to))
+}
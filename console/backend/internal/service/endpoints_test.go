@@ -0,0 +1,194 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/slchris/qubes-air/console/internal/database"
+	"github.com/slchris/qubes-air/console/internal/models"
+	"github.com/slchris/qubes-air/console/internal/repository"
+	transportgrpc "github.com/slchris/qubes-air/console/internal/transport/grpc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// endpointQubes is a qube table holding just what the feed reads and the
+// writes the tests make.
+type endpointQubes struct {
+	repository.QubeRepository
+	mu    sync.Mutex
+	qubes map[string]*models.Qube
+}
+
+func newEndpointQubes(qubes ...*models.Qube) *endpointQubes {
+	e := &endpointQubes{qubes: map[string]*models.Qube{}}
+	for _, q := range qubes {
+		e.qubes[q.ID] = q
+	}
+	return e
+}
+
+func (e *endpointQubes) ListByStatus(_ context.Context, statuses []models.QubeStatus) ([]*models.Qube, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var out []*models.Qube
+	for _, q := range e.qubes {
+		for _, s := range statuses {
+			if q.Status == s {
+				copied := *q
+				out = append(out, &copied)
+			}
+		}
+	}
+	return out, nil
+}
+
+func (e *endpointQubes) UpdateIPAddress(_ context.Context, id, ip string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.qubes[id].IPAddress = ip
+	return nil
+}
+
+func (e *endpointQubes) Delete(_ context.Context, id string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.qubes, id)
+	return nil
+}
+
+func endpointQube(id, name, ip string) *models.Qube {
+	return &models.Qube{ID: id, Name: name, Status: models.QubeStatusRunning, IPAddress: ip}
+}
+
+// nextEvent waits for one event, failing the test if none comes.
+func nextEvent(t *testing.T, events <-chan EndpointEvent) EndpointEvent {
+	t.Helper()
+	select {
+	case ev, ok := <-events:
+		require.True(t, ok, "subscription closed")
+		return ev
+	case <-time.After(3 * time.Second):
+		t.Fatal("no endpoint event")
+		return EndpointEvent{}
+	}
+}
+
+// TestEndpointFeedPushesWrites — an address recorded, a release and a purge
+// each reach a subscriber as they are written, in version order, after a
+// snapshot that reflects the table at subscription.
+func TestEndpointFeedPushesWrites(t *testing.T) {
+	db := newEndpointQubes(
+		endpointQube("q1", "remote-a", "10.0.0.1"),
+		endpointQube("q2", "remote-b", ""),
+		&models.Qube{ID: "q3", Name: "remote-c", Status: models.QubeStatusStopped, IPAddress: "10.0.0.3"},
+	)
+	feed := NewEndpointFeed(db, "0.0.0.0:8443")
+	repo := feed.Track(db)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go feed.Run(ctx)
+
+	snap, events, err := feed.Subscribe(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []Endpoint{{Name: "remote-a", Address: "10.0.0.1:8443"}}, snap.Endpoints,
+		"only running qubes with an address are endpoints")
+
+	require.NoError(t, repo.UpdateIPAddress(ctx, "q2", "10.0.0.2"))
+	ev := nextEvent(t, events)
+	assert.Equal(t, EndpointEvent{Version: snap.Version + 1, Name: "remote-b", Address: "10.0.0.2:8443"}, ev)
+
+	require.NoError(t, repo.UpdateIPAddress(ctx, "q1", ""))
+	ev = nextEvent(t, events)
+	assert.Equal(t, EndpointEvent{Version: snap.Version + 2, Name: "remote-a"}, ev, "a release removes the endpoint")
+
+	require.NoError(t, repo.Delete(ctx, "q2"))
+	ev = nextEvent(t, events)
+	assert.Equal(t, EndpointEvent{Version: snap.Version + 3, Name: "remote-b"}, ev, "a purge removes the endpoint")
+
+	// Resubscribing is a full resync at the current version.
+	snap2, _, err := feed.Subscribe(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, snap.Version+3, snap2.Version)
+	assert.Empty(t, snap2.Endpoints)
+}
+
+// TestEndpointFeedDropsSlowSubscriber — a subscriber that stops reading is
+// cut loose rather than stalling the feed, and resubscribing gets it back in
+// step.
+func TestEndpointFeedDropsSlowSubscriber(t *testing.T) {
+	db := newEndpointQubes()
+	n := endpointSubscriberBuffer + 1
+	for i := 0; i < n; i++ {
+		q := endpointQube(fmt.Sprintf("q%d", i), fmt.Sprintf("remote-%d", i), "")
+		db.qubes[q.ID] = q
+	}
+	feed := NewEndpointFeed(db, "0.0.0.0:8443")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, slow, err := feed.Subscribe(ctx)
+	require.NoError(t, err)
+
+	// More changes in one refresh than the subscriber's buffer holds.
+	for i := 0; i < n; i++ {
+		require.NoError(t, db.UpdateIPAddress(ctx, fmt.Sprintf("q%d", i), "10.0.0.9"))
+	}
+	require.NoError(t, feed.refresh(ctx))
+	got := 0
+	for range slow {
+		got++
+	}
+	assert.Equal(t, endpointSubscriberBuffer, got, "the slow subscriber was not dropped")
+
+	snap, events, err := feed.Subscribe(ctx)
+	require.NoError(t, err)
+	assert.Len(t, snap.Endpoints, n, "resubscribing did not resync the whole table")
+	require.NoError(t, db.UpdateIPAddress(ctx, "q0", ""))
+	require.NoError(t, feed.refresh(ctx))
+	assert.Equal(t, EndpointEvent{Version: snap.Version + 1, Name: "remote-0"}, nextEvent(t, events))
+}
+
+// TestTrackedRepositoryRecordsAgentReports — the console hands every service
+// the tracked repository, so a probe's handshake description and status report
+// must reach the table through it. A wrapper that hid the writers once made
+// every agent read as unreported without a single error.
+func TestTrackedRepositoryRecordsAgentReports(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "tracked-qubes-test-*.db")
+	require.NoError(t, err)
+	tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+	cfg := database.DefaultConfig()
+	cfg.DSN = tmpFile.Name()
+	db, err := database.New(cfg)
+	require.NoError(t, err)
+	defer db.Close()
+
+	zoneRepo := repository.NewZoneRepository(db)
+	raw := repository.NewQubeRepository(db)
+	tracked := NewEndpointFeed(raw, "0.0.0.0:8443").Track(raw)
+	svc := NewQubeService(tracked, zoneRepo).(*QubeServiceImpl)
+	zone := createConnectedZone(t, NewZoneService(zoneRepo, tracked))
+	ctx := context.Background()
+	op, err := svc.Create(ctx, &models.QubeCreateRequest{Name: "remote-dev", Type: models.QubeTypeApp, ZoneID: zone.ID})
+	require.NoError(t, err)
+	qube := op.Qube
+
+	svc.recordAgentHealth(ctx, qube, AgentProbeResult{
+		Status: AgentProbeOK, Reachable: true, Authoritative: true,
+		Agent:  &transportgrpc.PeerInfo{ProtocolVersion: "v2", BuildVersion: "1.6.0"},
+		Report: &models.AgentStatus{CloudInit: "done", Problems: []string{"/data is locked"}},
+	}, AgentProbeSteady)
+
+	got, err := raw.GetByID(ctx, qube.ID)
+	require.NoError(t, err)
+	require.NotNil(t, got.Agent, "the handshake description was not stored")
+	assert.Equal(t, "v2", got.Agent.ProtocolVersion)
+	assert.Equal(t, "1.6.0", got.Agent.BuildVersion)
+	require.NotNil(t, got.AgentStatus, "the status report was not stored")
+	assert.Equal(t, []string{"/data is locked"}, got.AgentStatus.Problems)
+}
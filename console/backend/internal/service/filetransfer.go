@@ -0,0 +1,201 @@
+// filetransfer.go — moves files to and from a qube through its agent's
+// qubesair.Transfer builtin.
+//
+// The console drives the same client relay-call does (internal/transfer), over
+// one pinned tunnel per request: an upload or download is a run of bounded
+// steps, and each must reach the qube's own agent. Every step is checked by
+// the agent's helper against its configured prefixes; the console decides
+// nothing about paths, so an operator cannot reach further through the API
+// than a relay can.
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/slchris/qubes-air/console/internal/models"
+	"github.com/slchris/qubes-air/console/internal/transfer"
+)
+
+const (
+	transferRelayName = "console-transfer"
+	// transferCertLifetime need only outlive the tunnel's handshakes. A
+	// transfer long enough to lose its tunnel after that fails the step, and
+	// the caller resumes it.
+	transferCertLifetime = time.Hour
+
+	// DefaultFileTransferStepTimeout bounds one step: a stat, one chunk, a
+	// commit. Not the whole transfer — its length is the file's size, and the
+	// caller's context bounds it.
+	DefaultFileTransferStepTimeout = 2 * time.Minute
+)
+
+// ErrUploadIncomplete means an upload ended before its stated size; what
+// arrived is staged, and the upload can resume from Response.Staged.
+var ErrUploadIncomplete = errors.New("upload incomplete")
+
+// FileUpload is one upload to a qube: the body that follows starts at Offset
+// of a file whose whole Size and SHA256 are given up front, so the agent can
+// check the file it installs no matter how many requests delivered it.
+type FileUpload struct {
+	Path string
+	// Tree means the body is a tar to unpack into the directory at Path.
+	Tree bool
+	// Offset is where the body starts. Zero starts over, dropping whatever an
+	// earlier upload staged; anything else must be exactly what is staged.
+	Offset int64
+	Size   int64
+	SHA256 string
+	// Mode is the file's permission bits; zero keeps the replaced file's.
+	Mode uint32
+}
+
+// FileTransfer moves files to and from qubes' agents.
+type FileTransfer struct {
+	ca     CAProvider
+	dialer AgentDialer
+	step   time.Duration
+}
+
+// NewFileTransfer builds a file transfer that dials agents at agentListen.
+func NewFileTransfer(ca CAProvider, agentListen string) *FileTransfer {
+	return &FileTransfer{ca: ca, dialer: NewDirectDialer(agentListen), step: DefaultFileTransferStepTimeout}
+}
+
+// WithDialer replaces the direct dialer, e.g. with the zone registry. Nil is
+// ignored.
+func (f *FileTransfer) WithDialer(d AgentDialer) *FileTransfer {
+	if d != nil {
+		f.dialer = d
+	}
+	return f
+}
+
+// client opens a session to qube's agent and returns a transfer client on
+// it, and the function that closes it.
+func (f *FileTransfer) client(ctx context.Context, qube *models.Qube) (*transfer.Client, func(), error) {
+	if f == nil || f.ca == nil {
+		return nil, nil, errors.New("no file transfer configured")
+	}
+	if qube == nil {
+		return nil, nil, errors.New("no qube given")
+	}
+	sess, err := agentCall{ca: f.ca, dialer: f.dialer, relay: transferRelayName, lifetime: transferCertLifetime}.
+		open(ctx, qube)
+	if err != nil {
+		return nil, nil, err
+	}
+	cli := &transfer.Client{Call: func(ctx context.Context, in []byte) ([]byte, error) {
+		ctx, cancel := context.WithTimeout(ctx, f.step)
+		defer cancel()
+		return sess.call(ctx, qube.Name, transfer.Service, in)
+	}}
+	return cli, sess.close, nil
+}
+
+// Stat describes path on qube, with its SHA-256 when it is a file, and how
+// much of an upload to it is staged.
+func (f *FileTransfer) Stat(ctx context.Context, qube *models.Qube, path string, tree bool) (*transfer.Response, error) {
+	cli, done, err := f.client(ctx, qube)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	st, err := cli.Stat(ctx, path, true, tree)
+	if err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// Upload stages body at up.Offset and, once the staged file reaches up.Size,
+// commits it. A body that ends short is kept staged and reported as
+// ErrUploadIncomplete with how much is staged, so the caller can send the
+// rest; a body at the wrong offset is ErrOffsetMismatch, likewise with the
+// staged size.
+func (f *FileTransfer) Upload(ctx context.Context, qube *models.Qube, up FileUpload, body io.Reader) (*transfer.Response, error) {
+	if up.Size < 0 || up.Offset < 0 || up.Offset > up.Size {
+		return nil, fmt.Errorf("offset %d does not fit a file of %d bytes", up.Offset, up.Size)
+	}
+	if up.SHA256 == "" {
+		return nil, errors.New("an upload needs the whole file's sha256")
+	}
+	cli, done, err := f.client(ctx, qube)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	if up.Offset == 0 {
+		if _, err := cli.Do(ctx, transfer.Request{Op: transfer.OpAbort, Path: up.Path, Tree: up.Tree}); err != nil {
+			return nil, err
+		}
+	}
+	staged, err := cli.Upload(ctx, up.Path, io.LimitReader(body, up.Size-up.Offset), up.Offset, up.Size, up.Tree)
+	if errors.Is(err, transfer.ErrOffsetMismatch) {
+		if st, serr := cli.Stat(ctx, up.Path, false, up.Tree); serr == nil {
+			return &transfer.Response{Staged: st.Staged}, err
+		}
+	}
+	if err != nil {
+		return &transfer.Response{Staged: staged}, err
+	}
+	if staged < up.Size {
+		return &transfer.Response{Staged: staged}, fmt.Errorf("%w: %d of %d bytes staged", ErrUploadIncomplete, staged, up.Size)
+	}
+	resp, err := cli.Do(ctx, transfer.Request{
+		Op: transfer.OpCommit, Path: up.Path, Tree: up.Tree, Size: up.Size, SHA256: up.SHA256, Mode: up.Mode,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Download writes path on qube to w from offset — or, with tree, a tar of
+// the directory, which always starts at zero since every download packs a
+// fresh snapshot. ready is told what is coming before the first byte is
+// written, so an HTTP handler can still set headers; an error it returns
+// stops the download.
+func (f *FileTransfer) Download(ctx context.Context, qube *models.Qube, path string, tree bool, offset int64,
+	w io.Writer, ready func(transfer.Response) error) error {
+	if tree && offset != 0 {
+		return errors.New("a tree download cannot resume: each one packs a new snapshot")
+	}
+	cli, done, err := f.client(ctx, qube)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	src := transfer.Request{Path: path}
+	var want transfer.Response
+	if tree {
+		if want, err = cli.Do(ctx, transfer.Request{Op: transfer.OpPack, Path: path}); err != nil {
+			return err
+		}
+		src.Handle = want.Handle
+		defer func() {
+			rctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+			defer cancel()
+			_, _ = cli.Do(rctx, transfer.Request{Op: transfer.OpRelease, Handle: want.Handle})
+		}()
+	} else {
+		if want, err = cli.Stat(ctx, path, true, false); err != nil {
+			return err
+		}
+		if !want.Exists || want.Dir {
+			return fmt.Errorf("%s is not a regular file on %q", path, qube.Name)
+		}
+		if offset > want.Size {
+			return fmt.Errorf("offset %d is past the end of %s (%d bytes)", offset, path, want.Size)
+		}
+	}
+	if err := ready(want); err != nil {
+		return err
+	}
+	return cli.Download(ctx, src, want, offset, w)
+}
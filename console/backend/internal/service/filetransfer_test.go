@@ -0,0 +1,125 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/slchris/qubes-air/console/internal/models"
+	"github.com/slchris/qubes-air/console/internal/transfer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// transferInvoker answers qubesair.Transfer from a store in this process, as
+// the agent's helper would.
+type transferInvoker struct{ store *transfer.Store }
+
+func (s transferInvoker) Invoke(ctx context.Context, _, service string, in []byte) ([]byte, error) {
+	if service != transfer.Service {
+		return nil, errors.New("no such qrexec service")
+	}
+	var req transfer.Request
+	if err := json.Unmarshal(in, &req); err != nil {
+		return nil, err
+	}
+	resp, err := s.store.Handle(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(resp)
+}
+
+func startTransferAgent(t *testing.T) (*FileTransfer, *models.Qube, string) {
+	t.Helper()
+	dir := t.TempDir()
+	files := filepath.Join(dir, "files")
+	require.NoError(t, os.MkdirAll(files, 0o755))
+	ca := newCA(t)
+	addr, _ := startAgent(t, ca, ca, "agent-files",
+		transferInvoker{store: transfer.NewStore([]transfer.Prefix{{Path: files}}, filepath.Join(dir, "spool"))})
+	host, port := hostPort(t, addr)
+	return NewFileTransfer(staticCA{ca: ca}, "0.0.0.0:"+port), &models.Qube{Name: "files", IPAddress: host}, files
+}
+
+func sha(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// TestFileTransfer_UploadResumes — an upload cut short stays staged, and the
+// rest, sent from where it stopped, completes the same file.
+func TestFileTransfer_UploadResumes(t *testing.T) {
+	ft, qube, files := startTransferAgent(t)
+	ctx := context.Background()
+	payload := []byte(strings.Repeat("0123456789", 100))
+	up := FileUpload{Path: filepath.Join(files, "up.bin"), Size: int64(len(payload)), SHA256: sha(payload), Mode: 0o640}
+
+	resp, err := ft.Upload(ctx, qube, up, bytes.NewReader(payload[:300]))
+	require.ErrorIs(t, err, ErrUploadIncomplete)
+	assert.Equal(t, int64(300), resp.Staged)
+	_, err = os.Stat(up.Path)
+	assert.True(t, os.IsNotExist(err), "nothing is installed before the commit")
+
+	// The wrong offset is refused, and says where to resume.
+	wrong := up
+	wrong.Offset = 200
+	resp, err = ft.Upload(ctx, qube, wrong, bytes.NewReader(payload[200:]))
+	require.ErrorIs(t, err, transfer.ErrOffsetMismatch)
+	assert.Equal(t, int64(300), resp.Staged)
+
+	up.Offset = 300
+	resp, err = ft.Upload(ctx, qube, up, bytes.NewReader(payload[300:]))
+	require.NoError(t, err)
+	assert.Equal(t, sha(payload), resp.SHA256)
+	got, err := os.ReadFile(up.Path)
+	require.NoError(t, err)
+	assert.Equal(t, payload, got)
+
+	st, err := ft.Stat(ctx, qube, up.Path, false)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(0o640), st.Mode&0o777)
+	assert.Equal(t, sha(payload), st.SHA256)
+}
+
+func TestFileTransfer_UploadChecksTheWholeFile(t *testing.T) {
+	ft, qube, files := startTransferAgent(t)
+	up := FileUpload{Path: filepath.Join(files, "bad.bin"), Size: 4, SHA256: sha([]byte("good"))}
+	_, err := ft.Upload(context.Background(), qube, up, strings.NewReader("evil"))
+	require.ErrorIs(t, err, transfer.ErrChecksum)
+	_, err = os.Stat(up.Path)
+	assert.True(t, os.IsNotExist(err))
+
+	up.Path = "/etc/passwd"
+	_, err = ft.Upload(context.Background(), qube, up, strings.NewReader("good"))
+	require.ErrorIs(t, err, transfer.ErrPathNotAllowed)
+}
+
+func TestFileTransfer_Download(t *testing.T) {
+	ft, qube, files := startTransferAgent(t)
+	ctx := context.Background()
+	path := filepath.Join(files, "down.txt")
+	require.NoError(t, os.WriteFile(path, []byte("hello, download"), 0o600))
+
+	var buf bytes.Buffer
+	var told transfer.Response
+	ready := func(r transfer.Response) error { told = r; return nil }
+	require.NoError(t, ft.Download(ctx, qube, path, false, 7, &buf, ready))
+	assert.Equal(t, "download", buf.String())
+	assert.Equal(t, int64(15), told.Size)
+	assert.Equal(t, sha([]byte("hello, download")), told.SHA256)
+
+	// A tree arrives as a tar of a fresh snapshot.
+	buf.Reset()
+	require.NoError(t, ft.Download(ctx, qube, files, true, 0, &buf, ready))
+	assert.Equal(t, told.Size, int64(buf.Len()))
+	assert.Contains(t, buf.String(), "down.txt")
+	require.Error(t, ft.Download(ctx, qube, files, true, 1, &buf, ready))
+}
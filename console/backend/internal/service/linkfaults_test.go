@@ -0,0 +1,333 @@
+package service
+
+// The monitors driven through a flaky link.
+//
+// Every other monitor test gives them a link that works or one that refuses at
+// once. Neither is what a NAT'd zone does: it resets a few dials and recovers,
+// cuts a handshake in half, trickles, or goes silent. These tests put the real
+// prober, renewer exchange and bootstrap exchange behind the chaos wrappers and
+// check that each of those ends in the right diagnosis, that nothing wedges,
+// and that a link which recovers is noticed.
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/slchris/qubes-air/console/internal/models"
+	"github.com/slchris/qubes-air/console/internal/pki"
+	"github.com/slchris/qubes-air/console/internal/repository"
+	"github.com/slchris/qubes-air/console/internal/transport"
+	"github.com/slchris/qubes-air/console/internal/transport/chaos"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// --- test doubles -----------------------------------------------------------
+
+// proberRunner puts a real AgentProber behind the monitor, recording what each
+// probe concluded. The monitor's own runner is QubeServiceImpl, which also
+// writes the result to the qube; that part is not what is under test here.
+type proberRunner struct {
+	p *AgentProber
+
+	mu       sync.Mutex
+	statuses []AgentProbeStatus
+}
+
+func (r *proberRunner) ProbeAgent(ctx context.Context, q *models.Qube, _ AgentProbePhase) AgentProbeResult {
+	res := r.p.Probe(ctx, q)
+	r.mu.Lock()
+	r.statuses = append(r.statuses, res.Status)
+	r.mu.Unlock()
+	return res
+}
+
+func (r *proberRunner) seen() []AgentProbeStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]AgentProbeStatus(nil), r.statuses...)
+}
+
+// callerTransport presents a fake agent as a transport, so a chaos.Transport
+// can sit between it and the exchange.
+type callerTransport struct{ agent agentCaller }
+
+func (c callerTransport) Call(ctx context.Context, target, service string, in []byte) ([]byte, error) {
+	return c.agent.call(ctx, target, service, in)
+}
+
+// transportCaller is the other half: an agentCaller over a transport.
+type transportCaller struct {
+	xport transport.Transport
+	addr  string
+}
+
+func (t transportCaller) call(ctx context.Context, target, service string, in []byte) ([]byte, error) {
+	return t.xport.Call(ctx, target, service, in)
+}
+
+func (t transportCaller) address() string { return t.addr }
+
+// faultyCaller wraps agent in inj's call faults.
+func faultyCaller(inj *chaos.Injector, agent agentCaller) agentCaller {
+	return transportCaller{xport: inj.Transport(callerTransport{agent: agent}), addr: agent.address()}
+}
+
+// exchangeBootstrapper runs the bootstrap exchange over an agentCaller, as
+// exchangeRenewer does for renewal: the dial and handshake are skipped, the
+// protocol and the monitor's reaction to it are not. Bounded by timeout, as
+// Bootstrap bounds the real thing.
+type exchangeBootstrapper struct {
+	inner   *AgentBootstrapper
+	agent   agentCaller
+	timeout time.Duration
+}
+
+func (e *exchangeBootstrapper) Bootstrap(ctx context.Context, qube *models.Qube) BootstrapResult {
+	ctx, cancel := context.WithTimeout(ctx, e.timeout)
+	defer cancel()
+	started := time.Now()
+	res := BootstrapResult{At: started.UTC(), QubeID: qube.ID, QubeName: qube.Name}
+	done := func(status BootstrapStatus, format string, args ...any) BootstrapResult {
+		res.Status = status
+		res.Duration = time.Since(started)
+		if format != "" {
+			res.Reason = fmt.Sprintf(format, args...)
+		}
+		return res
+	}
+	return e.inner.exchange(ctx, qube, e.agent, done)
+}
+
+// --- helpers ----------------------------------------------------------------
+
+func mustInjector(t *testing.T, rules ...chaos.Rule) *chaos.Injector {
+	t.Helper()
+	inj, err := chaos.New(1, rules...)
+	require.NoError(t, err)
+	return inj
+}
+
+// faultyAgent starts a real agent for qubeName and returns a prober that
+// reaches it through inj's dial faults.
+func faultyAgent(t *testing.T, qubeName string, inj *chaos.Injector, timeout time.Duration) (*AgentProber, *models.Qube) {
+	t.Helper()
+	ca := newCA(t)
+	addr, _ := startAgent(t, ca, ca, AgentCommonName(qubeName), &fakeInvoker{resp: []byte("pong")})
+	host, port := hostPort(t, addr)
+	listen := "0.0.0.0:" + port
+	p := NewAgentProber(staticCA{ca: ca}, &recordingCerts{}, listen, timeout).
+		WithDialer(inj.Dialer(NewDirectDialer(listen)))
+	return p, runningQube("q-"+qubeName, qubeName, host)
+}
+
+// --- agent health -----------------------------------------------------------
+
+// TestLinkFaults_SettleRidesOutResets — a link that resets its first dials and
+// then recovers is a qube that came up late, not one that is broken. The settle
+// loop must keep trying through the resets and end healthy.
+func TestLinkFaults_SettleRidesOutResets(t *testing.T) {
+	inj := mustInjector(t, chaos.Rule{Fault: chaos.FaultReset, Target: "flaky", Count: 3})
+	p, qube := faultyAgent(t, "flaky", inj, 5*time.Second)
+	runner := &proberRunner{p: p}
+
+	m := NewAgentHealthMonitor(newFakeQubes(qube), runner, AgentHealthConfig{
+		SettleBudget: 30 * time.Second,
+		SettleRetry:  20 * time.Millisecond,
+	})
+	m.Start()
+	defer m.Shutdown(time.Second)
+
+	m.Settle(qube.ID, qube.Name, "provision")
+	waitFor(t, 20*time.Second, "the agent to answer once the link recovered", func() bool {
+		s := runner.seen()
+		return len(s) > 0 && s[len(s)-1] == AgentProbeOK
+	})
+
+	assert.Equal(t, []AgentProbeStatus{
+		AgentProbeUnreachable, AgentProbeUnreachable, AgentProbeUnreachable, AgentProbeOK,
+	}, runner.seen(), "each reset is one unreachable attempt, and the first clean dial answers")
+	assert.Equal(t, 3, inj.Injected(chaos.FaultReset))
+}
+
+// TestLinkFaults_CutHandshakeIsNotATrustProblem — a link that dies in the
+// middle of the TLS handshake says nothing about certificates. Reporting it as
+// a rejection would send an operator to audit the PKI of a qube whose only
+// problem is the network between us.
+func TestLinkFaults_CutHandshakeIsNotATrustProblem(t *testing.T) {
+	for _, fault := range []chaos.Fault{chaos.FaultTruncate, chaos.FaultReset, chaos.FaultDrop} {
+		t.Run(string(fault), func(t *testing.T) {
+			// 40 bytes is inside the agent's first handshake record.
+			inj := mustInjector(t, chaos.Rule{Fault: fault, AfterBytes: 40})
+			p, qube := faultyAgent(t, "cut", inj, 500*time.Millisecond)
+
+			started := time.Now()
+			res := p.Probe(context.Background(), qube)
+
+			assert.Equal(t, AgentProbeUnreachable, res.Status, "reason: %s", res.Reason)
+			assert.Less(t, time.Since(started), 5*time.Second, "a cut link must not outlast the probe timeout")
+		})
+	}
+}
+
+// TestLinkFaults_SlowLinksAreNotDeadAgents — latency and a trickle that fit in
+// the probe budget still read healthy; one that does not is unreachable, never
+// rejected, and never longer than the budget.
+func TestLinkFaults_SlowLinksAreNotDeadAgents(t *testing.T) {
+	t.Run("laggy but within budget", func(t *testing.T) {
+		inj := mustInjector(t,
+			chaos.Rule{Fault: chaos.FaultLatency, Latency: 10 * time.Millisecond},
+			chaos.Rule{Fault: chaos.FaultSlow, BytesPerSecond: 64 << 10},
+		)
+		p, qube := faultyAgent(t, "laggy", inj, 10*time.Second)
+		res := p.Probe(context.Background(), qube)
+		assert.Equal(t, AgentProbeOK, res.Status, "reason: %s", res.Reason)
+	})
+
+	t.Run("slower than the budget", func(t *testing.T) {
+		inj := mustInjector(t, chaos.Rule{Fault: chaos.FaultSlow, BytesPerSecond: 100})
+		p, qube := faultyAgent(t, "trickle", inj, 400*time.Millisecond)
+		started := time.Now()
+		res := p.Probe(context.Background(), qube)
+		assert.Equal(t, AgentProbeUnreachable, res.Status, "reason: %s", res.Reason)
+		assert.Less(t, time.Since(started), 5*time.Second)
+	})
+}
+
+// TestLinkFaults_BlackHoledFleetDoesNotWedgeTheMonitor — with every dial going
+// nowhere, each sweep must still end on the probe timeout, the next sweep must
+// still run, and shutdown must not wait for the network to come back.
+func TestLinkFaults_BlackHoledFleetDoesNotWedgeTheMonitor(t *testing.T) {
+	inj := mustInjector(t, chaos.Rule{Fault: chaos.FaultDrop})
+	p, qube := faultyAgent(t, "void", inj, 100*time.Millisecond)
+	runner := &proberRunner{p: p}
+
+	m := NewAgentHealthMonitor(newFakeQubes(qube), runner, AgentHealthConfig{Interval: 20 * time.Millisecond})
+	m.Start()
+
+	waitFor(t, 10*time.Second, "sweeps to keep coming through a black hole", func() bool {
+		return len(runner.seen()) >= 3
+	})
+	for _, s := range runner.seen() {
+		assert.Equal(t, AgentProbeUnreachable, s)
+	}
+
+	started := time.Now()
+	m.Shutdown(5 * time.Second)
+	assert.Less(t, time.Since(started), 2*time.Second, "shutdown waited on a dropped link")
+}
+
+// --- certificate renewal ----------------------------------------------------
+
+// TestLinkFaults_RenewalRecoversFromAFlakyLink — a garbled reply and then a
+// reset mid-install, each once, against the real registry. Each failure is a
+// warning and a backoff; neither may leave the qube looking renewed; once the
+// link is clean the qube renews and goes quiet.
+func TestLinkFaults_RenewalRecoversFromAFlakyLink(t *testing.T) {
+	certs := repository.NewAgentCertRepository(certTestDB(t))
+	qube := renewableQube("q-flaky")
+	ctx := context.Background()
+
+	expires := time.Now().Add(20 * 24 * time.Hour).UTC()
+	oldFP := "e" + strings.Repeat("7", 63)
+	require.NoError(t, certs.Register(ctx, &repository.AgentCert{
+		Fingerprint: oldFP, QubeID: qube.ID, SubjectCN: AgentCommonName(qube.Name),
+		IssuedAt: expires.Add(-pki.DefaultAgentCertLifetime), ExpiresAt: &expires,
+	}))
+	require.NoError(t, certs.TouchLastSeen(ctx, oldFP))
+
+	inj := mustInjector(t,
+		chaos.Rule{Fault: chaos.FaultTruncate, Service: beginRenewalService, AfterBytes: 12, Count: 1},
+		chaos.Rule{Fault: chaos.FaultReset, Service: completeRenewalService, Count: 1},
+	)
+	agent := &fakeAgent{nonce: "n1", csrPEM: makeCSR(t, AgentCommonName(qube.Name))}
+	renewer := &exchangeRenewer{
+		inner: NewCertRenewer(nil, &fakeSigner{}, certs, certs, "0.0.0.0:8443", time.Second),
+		agent: faultyCaller(inj, agent),
+	}
+	clock := time.Now().UTC()
+	m := newTestMonitor(&clock, &fakeQubeLister{qubes: []*models.Qube{qube}}, certs, renewer, &fakeHealthWriter{})
+
+	// Sweep one: the reply is cut short. Nothing was signed, so nothing is
+	// registered.
+	m.Sweep(ctx)
+	assert.Contains(t, m.RenewalWarning(qube.ID), certRenewalWarningPrefix)
+	list, err := certs.ListByQube(ctx, qube.ID)
+	require.NoError(t, err)
+	assert.Len(t, list, 1, "a renewal that never got a CSR must not register anything")
+
+	// Sweep two: signed and registered, then the install is reset.
+	clock = clock.Add(certRenewalRetryBase + time.Minute)
+	m.Sweep(ctx)
+	assert.Contains(t, m.RenewalWarning(qube.ID), string(CertRenewalInstallFailed))
+	list, err = certs.ListByQube(ctx, qube.ID)
+	require.NoError(t, err)
+	assert.Equal(t, oldFP, newestUsableCert(list).Fingerprint,
+		"a certificate the agent never received must not make the qube look renewed")
+
+	// Sweep three, after the longer backoff, over a clean link.
+	clock = clock.Add(2*certRenewalRetryBase + time.Minute)
+	m.Sweep(ctx)
+	assert.Empty(t, m.RenewalWarning(qube.ID), "a qube that renewed must stop warning")
+	list, err = certs.ListByQube(ctx, qube.ID)
+	require.NoError(t, err)
+	assert.Greater(t, time.Until(*newestUsableCert(list).ExpiresAt), 80*24*time.Hour)
+	assert.Equal(t, 1, inj.Injected(chaos.FaultTruncate))
+	assert.Equal(t, 1, inj.Injected(chaos.FaultReset))
+}
+
+// --- bootstrap --------------------------------------------------------------
+
+// TestLinkFaults_BootstrapBacksOffThroughAnOutage — a dropped call and then a
+// reset are both "unreachable": the fast backoff, not the refused-token one,
+// and a bounded wait rather than a sweep stuck on a silent agent. Once the
+// link recovers the qube is bootstrapped and its history cleared.
+func TestLinkFaults_BootstrapBacksOffThroughAnOutage(t *testing.T) {
+	const fp = "abcdef0123456789abcdef"
+	qube := uncertifiedQube("q1", "remote-dev")
+	inj := mustInjector(t,
+		chaos.Rule{Fault: chaos.FaultDrop, Service: beginBootstrapService, Count: 1},
+		chaos.Rule{Fault: chaos.FaultReset, Service: beginBootstrapService, Count: 2},
+	)
+	agent := &fakeBootstrapAgent{
+		beginReply:  beginBootstrapReply{Nonce: "n1", Token: "tok", CSRPEM: "csr"},
+		installedFP: fp,
+	}
+	bs := &exchangeBootstrapper{
+		inner:   NewAgentBootstrapper(nil, &fakeIssuer{issued: issuedFor(qube.Name, fp)}, "", 0),
+		agent:   faultyCaller(inj, agent),
+		timeout: 200 * time.Millisecond,
+	}
+	now := time.Now().UTC()
+	m := NewBootstrapMonitor(&fakeBootstrapQubes{qubes: []*models.Qube{qube}}, &fakeCertLister{}, bs, time.Minute)
+	m.now = func() time.Time { return now }
+
+	// Sweep one: the first call is both dropped and reset; the drop holds it
+	// until the bootstrapper's own deadline.
+	started := time.Now()
+	m.Sweep(context.Background())
+	assert.Less(t, time.Since(started), 5*time.Second, "a silent agent held the sweep")
+	status, _ := m.Failure(qube.ID)
+	assert.Equal(t, BootstrapUnreachable, status)
+
+	m.Sweep(context.Background())
+	assert.Equal(t, 1, inj.Injected(chaos.FaultReset), "retried inside its backoff")
+
+	// Sweep two, past the backoff: reset again.
+	now = now.Add(bootstrapRetryBase + time.Second)
+	m.Sweep(context.Background())
+	status, _ = m.Failure(qube.ID)
+	assert.Equal(t, BootstrapUnreachable, status)
+
+	// Past the grown backoff the link is clean.
+	now = now.Add(bootstrapRetryMax)
+	m.Sweep(context.Background())
+	status, _ = m.Failure(qube.ID)
+	assert.Empty(t, status, "a bootstrapped qube kept its failure history")
+	assert.Equal(t, []string{beginBootstrapService, completeBootstrapService}, agent.calls,
+		"no faulted call may reach the agent, and the clean one runs the whole exchange")
+}
@@ -17,7 +17,7 @@ import (
 
 // setupWithTransport builds a QubeService with an injected transport plus a
 // connected zone and a qube in it, returning the qube id.
-func setupWithTransport(t *testing.T, xport transport.Transport) (QubeService, string, func()) {
+func setupWithTransport(t *testing.T, xport transport.Transport, opts ...QubeServiceOption) (QubeService, string, func()) {
 	t.Helper()
 
 	tmpFile, err := os.CreateTemp("", "qube-reachable-test-*.db")
@@ -32,7 +32,7 @@ func setupWithTransport(t *testing.T, xport transport.Transport) (QubeService, s
 	zoneRepo := repository.NewZoneRepository(db)
 	qubeRepo := repository.NewQubeRepository(db)
 	zoneSvc := NewZoneService(zoneRepo, qubeRepo)
-	qubeSvc := NewQubeService(qubeRepo, zoneRepo, WithTransport(xport))
+	qubeSvc := NewQubeService(qubeRepo, zoneRepo, append([]QubeServiceOption{WithTransport(xport)}, opts...)...)
 
 	ctx := context.Background()
 	zone := createConnectedZone(t, zoneSvc)
@@ -71,6 +71,26 @@ func TestCheckReachable_OK(t *testing.T) {
 	assert.Equal(t, pingService, fake.Calls[0].Service)
 }
 
+// TestCheckReachable_ZoneTransport — with no prober, the ping goes over the
+// qube's zone's transport, not the global one.
+func TestCheckReachable_ZoneTransport(t *testing.T) {
+	global := &transport.FakeTransport{}
+	zoned := &transport.FakeTransport{RespFn: func(string, string, []byte) ([]byte, error) {
+		return []byte("pong from the relay"), nil
+	}}
+	routes := NewZoneTransports(fixedZone{name: "Test Zone"},
+		NewZoneRoute(ZoneRouteDirect, "", global, "", "0.0.0.0:8443")).
+		Route("Test Zone", ZoneRoute{Kind: ZoneRouteGRPC, Relay: "nat", Transport: zoned})
+	svc, id, cleanup := setupWithTransport(t, global, WithZoneTransports(routes))
+	defer cleanup()
+
+	resp, err := svc.CheckReachable(context.Background(), id)
+	require.NoError(t, err)
+	assert.Equal(t, "pong from the relay", resp)
+	assert.Equal(t, 1, zoned.CallCount())
+	assert.Zero(t, global.CallCount(), "the global transport answered for a routed zone")
+}
+
 func TestCheckReachable_TransportError(t *testing.T) {
 	fake := &transport.FakeTransport{
 		RespFn: func(_, _ string, _ []byte) ([]byte, error) {
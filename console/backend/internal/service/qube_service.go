@@ -104,6 +104,9 @@ type QubeServiceImpl struct {
 	// that one remote. It is kept as the FALLBACK for a console with no CA
 	// wired; prober is what can actually ask "is THIS qube's agent alive".
 	transport transport.Transport
+	// zones picks the transport for a qube's zone when the fallback below
+	// runs. Nil means every zone uses transport.
+	zones *ZoneTransports
 	// prober dials each qube's own address to check its agent. Nil falls back
 	// to transport, which cannot address an arbitrary qube — a degradation, so
 	// it is logged when it happens rather than passing for a real answer.
@@ -197,6 +200,12 @@ func WithTransport(t transport.Transport) QubeServiceOption {
 	}
 }
 
+// WithZoneTransports routes the transport fallback through each qube's zone.
+// The prober is routed separately, through its dialer.
+func WithZoneTransports(z *ZoneTransports) QubeServiceOption {
+	return func(s *QubeServiceImpl) { s.zones = z }
+}
+
 // WithAgentProber enables per-qube agent probing. Without it agent health falls
 // back to the single global transport, which is pinned to one endpoint and so
 // cannot answer the question for an arbitrary qube.
@@ -852,19 +861,24 @@ func (s *QubeServiceImpl) runAgentProbe(ctx context.Context, qube *models.Qube)
 		return s.prober.Probe(ctx, qube)
 	}
 
-	// Fallback: the single global transport. It is pinned to one configured
-	// RemoteEndpoint, so it answers for THAT remote regardless of which qube was
-	// asked about — useful only in the single-remote deployment it was built
-	// for. Said out loud on every use: a wrong answer that looks like a right
-	// one is the failure mode this whole feature exists to remove.
-	log.Printf("agentprobe: no per-qube prober configured, falling back to the global transport for qube %q; "+
-		"the result describes the configured remote endpoint, not necessarily this qube", qube.Name)
+	// Fallback: the zone's transport, or the single global one. Either is
+	// pinned to one configured endpoint, so it answers for THAT remote
+	// regardless of which qube was asked about — useful only where a zone is
+	// one remote. Said out loud on every use: a wrong answer that looks like a
+	// right one is the failure mode this whole feature exists to remove.
+	xport, via := s.transport, "the global transport"
+	if s.zones != nil {
+		route := s.zones.For(ctx, qube)
+		xport, via = route.Transport, "the zone's "+route.String()+" transport"
+	}
+	log.Printf("agentprobe: no per-qube prober configured, falling back to %s for qube %q; "+
+		"the result describes the configured remote endpoint, not necessarily this qube", via, qube.Name)
 
 	started := time.Now()
 	res := AgentProbeResult{
 		QubeID: qube.ID, QubeName: qube.Name, CheckedAt: started.UTC(),
 	}
-	resp, err := s.transport.Call(ctx, qube.Name, pingService, nil)
+	resp, err := xport.Call(ctx, qube.Name, pingService, nil)
 	res.Duration = time.Since(started)
 	res.LatencyMS = res.Duration.Milliseconds()
 	if err != nil {
@@ -874,7 +888,7 @@ func (s *QubeServiceImpl) runAgentProbe(ctx context.Context, qube *models.Qube)
 		if errors.Is(err, transport.ErrNoTransport) {
 			res.Status = AgentProbeNotConfigured
 		}
-		res.Reason = fmt.Sprintf("ping %q over the global transport failed: %v", qube.Name, err)
+		res.Reason = fmt.Sprintf("ping %q over %s failed: %v", qube.Name, via, err)
 		return res
 	}
 	res.Reachable = true
@@ -919,6 +933,9 @@ func (s *QubeServiceImpl) recordAgentHealth(
 	// would be erased by the next successful probe, and the fleet would look
 	// perfectly healthy until the certificates ran out.
 	failure := res.Reason
+	if health == models.AgentHealthDegraded {
+		failure = degradedReason(res.Report)
+	}
 	// ...but only while there is a compute instance for the warning to be about.
 	// A suspended qube has no agent to renew against, so whatever the monitor
 	// last remembered describes an instance that no longer exists — and it will
@@ -952,6 +969,42 @@ func (s *QubeServiceImpl) recordAgentHealth(
 		}
 		log.Printf("agentprobe: qube %q probed %s but recording it failed: %v", qube.Name, health, err)
 	}
+	s.recordAgentInfo(ctx, qube, res)
+	s.recordAgentStatus(ctx, qube, res)
+}
+
+// recordAgentInfo stores the agent's handshake description, when the probe got
+// one and it can be attributed to this qube. A probe that never reached the
+// agent writes nothing, so the last known description stays.
+func (s *QubeServiceImpl) recordAgentInfo(ctx context.Context, qube *models.Qube, res AgentProbeResult) {
+	if res.Agent == nil || !res.Authoritative {
+		return
+	}
+	reportedAt := res.CheckedAt
+	if reportedAt.IsZero() {
+		reportedAt = time.Now().UTC()
+	}
+	info := models.AgentInfo{
+		ProtocolVersion: res.Agent.ProtocolVersion,
+		BuildVersion:    res.Agent.BuildVersion,
+		Capabilities:    models.AgentCapabilities(res.Agent.Capabilities),
+		ReportedAt:      reportedAt,
+	}
+	if err := s.qubeRepo.UpdateAgentInfo(ctx, qube.ID, info); err != nil && !errors.Is(err, repository.ErrQubeNotFound) {
+		log.Printf("agentprobe: qube %q answered as %s but recording its capabilities failed: %v",
+			qube.Name, info.ProtocolVersion, err)
+	}
+}
+
+// recordAgentStatus stores the probe's status report when it got one. Like
+// the description, a probe without one leaves the last report in place.
+func (s *QubeServiceImpl) recordAgentStatus(ctx context.Context, qube *models.Qube, res AgentProbeResult) {
+	if res.Report == nil || !res.Authoritative {
+		return
+	}
+	if err := s.qubeRepo.UpdateAgentStatus(ctx, qube.ID, *res.Report); err != nil && !errors.Is(err, repository.ErrQubeNotFound) {
+		log.Printf("agentprobe: qube %q reported its status but recording it failed: %v", qube.Name, err)
+	}
 }
 
 // renewalWarning is the outstanding certificate-renewal problem for a qube.
@@ -980,6 +1033,12 @@ func agentHealthForResult(res AgentProbeResult, phase AgentProbePhase) models.Ag
 	if h == models.AgentHealthHealthy && !res.Authoritative {
 		return models.AgentHealthUnknown
 	}
+	// Answered, and said what is wrong: degraded, not healthy. Only ever from
+	// a report, so an agent too old to give one stays healthy rather than
+	// being judged on silence.
+	if h == models.AgentHealthHealthy && res.Report != nil && len(res.Report.Problems) > 0 {
+		return models.AgentHealthDegraded
+	}
 	return h
 }
 
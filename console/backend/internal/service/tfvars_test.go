@@ -242,6 +242,10 @@ func (s *stubQubeLister) UpdateAgentHealth(
 ) error {
 	return nil
 }
+func (s *stubQubeLister) UpdateAgentInfo(context.Context, string, models.AgentInfo) error { return nil }
+func (s *stubQubeLister) UpdateAgentStatus(context.Context, string, models.AgentStatus) error {
+	return nil
+}
 
 // TestSnapshot_NameCollisionKeepsNewestRow — the qube NAME is the terraform map
 // key, but rows are not unique by name: deleting and recreating a qube leaves
@@ -0,0 +1,110 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/slchris/qubes-air/console/internal/transport"
+	transportgrpc "github.com/slchris/qubes-air/console/internal/transport/grpc"
+)
+
+// transportTestTimeout bounds POST /transport/test. A healthy tunnel answers a
+// ping in well under a second; past this the operator is better served by
+// "timed out" than by a spinner.
+const transportTestTimeout = 10 * time.Second
+
+// TransportStatusReporter is implemented by transports that can describe
+// their own state — the gRPC client does. Checked by type assertion so that
+// the Transport interface stays the one-method seam every fake implements.
+type TransportStatusReporter interface {
+	Status() transportgrpc.ClientStatus
+}
+
+// TransportService exposes the console's global cross-machine transport to
+// operators: is the tunnel up, to what, and does a call actually get through.
+type TransportService interface {
+	// Status reports the transport's state. It never fails: a disabled
+	// transport is a state too.
+	Status() TransportStatus
+	// Test drives one qubesair.Ping round trip to the configured remote.
+	Test(ctx context.Context) TransportTestResult
+}
+
+// TransportStatus is the answer to GET /transport.
+type TransportStatus struct {
+	// Enabled is false when no transport is configured (NoopTransport): every
+	// cross-machine call fails with transport.ErrNoTransport.
+	Enabled bool `json:"enabled"`
+	// Client is the gRPC client's tunnel, handshake, keepalive and call state;
+	// nil when disabled, or when the transport cannot report one.
+	Client *transportgrpc.ClientStatus `json:"client,omitempty"`
+}
+
+// TransportTestResult is the outcome of one ping through the transport.
+type TransportTestResult struct {
+	OK     bool   `json:"ok"`
+	Target string `json:"target"`
+	// Response is what the remote's qubesair.Ping answered.
+	Response  string        `json:"response,omitempty"`
+	Error     string        `json:"error,omitempty"`
+	Duration  time.Duration `json:"-"`
+	LatencyMS int64         `json:"latency_ms"`
+	CheckedAt time.Time     `json:"checked_at"`
+}
+
+// TransportServiceImpl implements TransportService.
+type TransportServiceImpl struct {
+	transport transport.Transport
+	// remoteName is the qube the test ping targets: the transport's
+	// configured remote, the one every call on it reaches anyway.
+	remoteName string
+}
+
+// NewTransportService creates a TransportService over xport, testing it
+// against remoteName.
+func NewTransportService(xport transport.Transport, remoteName string) TransportService {
+	if xport == nil {
+		xport = transport.NoopTransport{}
+	}
+	return &TransportServiceImpl{transport: xport, remoteName: remoteName}
+}
+
+// Enabled reports whether a real transport is configured.
+func (s *TransportServiceImpl) Enabled() bool {
+	_, noop := s.transport.(transport.NoopTransport)
+	return !noop
+}
+
+// Status implements TransportService.
+func (s *TransportServiceImpl) Status() TransportStatus {
+	st := TransportStatus{Enabled: s.Enabled()}
+	if r, ok := s.transport.(TransportStatusReporter); ok && st.Enabled {
+		cs := r.Status()
+		st.Client = &cs
+	}
+	return st
+}
+
+// Test implements TransportService.
+func (s *TransportServiceImpl) Test(ctx context.Context) TransportTestResult {
+	ctx, cancel := context.WithTimeout(ctx, transportTestTimeout)
+	defer cancel()
+
+	started := time.Now()
+	res := TransportTestResult{Target: s.remoteName, CheckedAt: started.UTC()}
+	resp, err := s.transport.Call(ctx, s.remoteName, pingService, nil)
+	res.Duration = time.Since(started)
+	res.LatencyMS = res.Duration.Milliseconds()
+	if err != nil {
+		res.Error = fmt.Sprintf("ping %q: %v", s.remoteName, err)
+		if errors.Is(err, transport.ErrNoTransport) {
+			res.Error = "transport disabled: " + err.Error()
+		}
+		return res
+	}
+	res.OK = true
+	res.Response = string(resp)
+	return res
+}
@@ -0,0 +1,53 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/slchris/qubes-air/console/internal/transport"
+	transportgrpc "github.com/slchris/qubes-air/console/internal/transport/grpc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// reportingTransport is a FakeTransport that also reports a status, as the
+// gRPC client does.
+type reportingTransport struct {
+	transport.FakeTransport
+	status transportgrpc.ClientStatus
+}
+
+func (r *reportingTransport) Status() transportgrpc.ClientStatus { return r.status }
+
+func TestTransportStatus(t *testing.T) {
+	disabled := NewTransportService(transport.NoopTransport{}, "remote-dev").Status()
+	assert.False(t, disabled.Enabled)
+	assert.Nil(t, disabled.Client)
+
+	xport := &reportingTransport{status: transportgrpc.ClientStatus{RemoteName: "remote-dev", Connected: true, Tunnels: 1}}
+	st := NewTransportService(xport, "remote-dev").Status()
+	assert.True(t, st.Enabled)
+	require.NotNil(t, st.Client)
+	assert.True(t, st.Client.Connected)
+}
+
+func TestTransportTestPingsTheRemote(t *testing.T) {
+	xport := &transport.FakeTransport{RespFn: func(string, string, []byte) ([]byte, error) {
+		return []byte("pong"), nil
+	}}
+	res := NewTransportService(xport, "remote-dev").Test(context.Background())
+	assert.True(t, res.OK)
+	assert.Equal(t, "pong", res.Response)
+	require.Equal(t, 1, xport.CallCount())
+	assert.Equal(t, transport.FakeCall{Target: "remote-dev", Service: pingService}, xport.Calls[0])
+
+	xport.RespFn = func(string, string, []byte) ([]byte, error) { return nil, errors.New("tunnel down") }
+	res = NewTransportService(xport, "remote-dev").Test(context.Background())
+	assert.False(t, res.OK)
+	assert.Contains(t, res.Error, "tunnel down")
+
+	res = NewTransportService(transport.NoopTransport{}, "remote-dev").Test(context.Background())
+	assert.False(t, res.OK)
+	assert.Contains(t, res.Error, "transport disabled")
+}
@@ -0,0 +1,321 @@
+// zonetransport.go — which transport reaches which zone.
+//
+// The console used to build exactly one transport, and every flow that talks to
+// an agent dialed the qube's address directly. That is one network shape: every
+// zone routed from here. A zone behind NAT breaks it — its agents have private
+// addresses the console cannot dial — and switching the global transport to a
+// relay for that zone would break every zone that was working.
+//
+// So reachability is decided per zone. A zone is reached one of three ways:
+//
+//   - direct — a route exists (our LAN, a VPN). The DirectDialer, as before.
+//   - grpc — through a relay on the zone's network. Each agent connection is a
+//     stream on the relay's tunnel, spliced by the relay's gateway forward onto
+//     the agent's address. The console's mTLS runs end to end inside it, so the
+//     relay carries ciphertext and cannot impersonate either side.
+//   - ssh — through a jump host, as a direct-tcpip channel on the SSH
+//     transport's connection. Same end-to-end property.
+//
+// Everything that dials an agent — prober, unlocker, renewer, bootstrapper —
+// takes the registry as its AgentDialer, and the qrexec fallback in
+// QubeService asks it for the zone's transport. One table, so the four cannot
+// disagree about how a zone is reached, for the reason agentdial.go gives.
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/slchris/qubes-air/console/internal/models"
+	"github.com/slchris/qubes-air/console/internal/transport"
+	transportgrpc "github.com/slchris/qubes-air/console/internal/transport/grpc"
+	transportssh "github.com/slchris/qubes-air/console/internal/transport/ssh"
+)
+
+// Zone route kinds. They match the config's transport kinds.
+const (
+	ZoneRouteDirect = "direct"
+	ZoneRouteGRPC   = "grpc"
+	ZoneRouteSSH    = "ssh"
+)
+
+// DefaultAgentForward is the gateway forward a relay serves agents through
+// when a zone does not name one.
+const DefaultAgentForward = "agents"
+
+// agentStreamService opens a stream through a relay's forward policy; the
+// gRPC server answers it (transport/grpc's streamServicePrefix).
+const agentStreamService = "qubesair.StreamTCP+"
+
+// zoneLookupTimeout bounds the zone read behind Address, which has no context
+// of its own.
+const zoneLookupTimeout = 5 * time.Second
+
+// ErrAgentUnreachable marks a relayed connection that the relay could not
+// open. A relay dial "succeeds" locally before the far end has tried, so the
+// failure surfaces on the first read; this is what lets the prober still call
+// it "nothing is listening" rather than a TLS rejection.
+var ErrAgentUnreachable = errors.New("agent unreachable through the relay")
+
+// ZoneGetter reads a zone. Implemented by repository.ZoneRepository.
+type ZoneGetter interface {
+	GetByID(ctx context.Context, id string) (*models.Zone, error)
+}
+
+// ContextDialer opens connections from somewhere else — the far end of a
+// tunnel. Implemented by the SSH transport.
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// StreamCaller opens byte streams through a relay. Implemented by the gRPC
+// transport client.
+type StreamCaller interface {
+	CallStream(ctx context.Context, target, service string, stdin io.Reader, stdout io.Writer) error
+}
+
+// The two real transports are what NewZoneRoute looks for; if either stopped
+// matching, its zones would fail every dial rather than fail to build.
+var (
+	_ StreamCaller  = (*transportgrpc.Client)(nil)
+	_ ContextDialer = (*transportssh.Transport)(nil)
+)
+
+// ZoneRoute is how one zone is reached.
+type ZoneRoute struct {
+	// Kind is ZoneRouteDirect, ZoneRouteGRPC or ZoneRouteSSH.
+	Kind string
+	// Relay names the transport, for logs; empty is the main one.
+	Relay string
+	// Transport carries qrexec calls to the zone.
+	Transport transport.Transport
+	// Dialer opens connections to the zone's agents.
+	Dialer AgentDialer
+}
+
+// String describes the route for logs and probe results.
+func (r ZoneRoute) String() string {
+	if r.Relay == "" {
+		return r.Kind
+	}
+	return r.Kind + " via " + r.Relay
+}
+
+// NewZoneRoute builds the route for a zone of the given kind over xport.
+//
+// The dialer comes from what xport can do: an SSH transport dials through its
+// connection, a gRPC one streams through the relay's forward. A transport that
+// cannot — the NoopTransport a broken relay config falls back to — yields a
+// route whose every dial says so, rather than one that quietly dials direct
+// into a network the console has no route to.
+func NewZoneRoute(kind, relay string, xport transport.Transport, forward, agentListen string) ZoneRoute {
+	route := ZoneRoute{Kind: kind, Relay: relay, Transport: xport}
+	switch kind {
+	case ZoneRouteSSH:
+		if d, ok := xport.(ContextDialer); ok {
+			route.Dialer = NewTunnelDialer(d, agentListen)
+		}
+	case ZoneRouteGRPC:
+		if s, ok := xport.(StreamCaller); ok {
+			route.Dialer = NewRelayDialer(s, forward, agentListen)
+		}
+	default:
+		route.Dialer = NewDirectDialer(agentListen)
+	}
+	if route.Dialer == nil {
+		route.Dialer = unroutedDialer{route: route.String(), port: agentPortFrom(agentListen)}
+	}
+	return route
+}
+
+// ZoneTransports maps zones to routes. Zones without an entry take the
+// fallback: a direct dial and the main transport.
+//
+// Routes are added while wiring and never after, so lookups take no lock.
+type ZoneTransports struct {
+	zones    ZoneGetter
+	fallback ZoneRoute
+	routes   map[string]ZoneRoute
+}
+
+var _ AgentDialer = (*ZoneTransports)(nil)
+
+// NewZoneTransports builds a registry whose unlisted zones use fallback.
+func NewZoneTransports(zones ZoneGetter, fallback ZoneRoute) *ZoneTransports {
+	return &ZoneTransports{zones: zones, fallback: fallback, routes: map[string]ZoneRoute{}}
+}
+
+// Route sets how a zone, by name or ID, is reached.
+func (z *ZoneTransports) Route(zone string, route ZoneRoute) *ZoneTransports {
+	z.routes[zone] = route
+	return z
+}
+
+// For returns the route for qube's zone.
+//
+// A route keyed by ID wins over one keyed by name, so a renamed zone keeps the
+// route an operator pinned to its ID. A zone that cannot be read takes the
+// fallback, loudly: the qube may still be reachable that way, and mTLS pins
+// who answers whichever way the connection goes.
+func (z *ZoneTransports) For(ctx context.Context, qube *models.Qube) ZoneRoute {
+	if qube == nil || qube.ZoneID == "" || len(z.routes) == 0 {
+		return z.fallback
+	}
+	if r, ok := z.routes[qube.ZoneID]; ok {
+		return r
+	}
+	zone, err := z.zones.GetByID(ctx, qube.ZoneID)
+	if err != nil || zone == nil {
+		log.Printf("zonetransport: zone %s of qube %q unreadable (%v); using the %s route",
+			qube.ZoneID, qube.Name, err, z.fallback)
+		return z.fallback
+	}
+	if r, ok := z.routes[zone.Name]; ok {
+		return r
+	}
+	return z.fallback
+}
+
+// DialAgent dials the qube's agent over its zone's route.
+func (z *ZoneTransports) DialAgent(ctx context.Context, qube *models.Qube) (net.Conn, error) {
+	return z.For(ctx, qube).Dialer.DialAgent(ctx, qube)
+}
+
+// Address labels the qube's agent as its zone's dialer does.
+func (z *ZoneTransports) Address(qube *models.Qube) string {
+	ctx, cancel := context.WithTimeout(context.Background(), zoneLookupTimeout)
+	defer cancel()
+	return z.For(ctx, qube).Dialer.Address(qube)
+}
+
+// TunnelDialer reaches a qube's recorded address from the far end of a
+// tunnel, as a jump host would.
+type TunnelDialer struct {
+	tunnel ContextDialer
+	port   string
+}
+
+// NewTunnelDialer builds a dialer that connects through tunnel.
+func NewTunnelDialer(tunnel ContextDialer, agentListen string) *TunnelDialer {
+	return &TunnelDialer{tunnel: tunnel, port: agentPortFrom(agentListen)}
+}
+
+// DialAgent opens TCP to the qube's address from the tunnel's far end.
+func (d *TunnelDialer) DialAgent(ctx context.Context, qube *models.Qube) (net.Conn, error) {
+	return d.tunnel.DialContext(ctx, "tcp", net.JoinHostPort(qube.IPAddress, d.port))
+}
+
+// Address is host:port, as seen from the tunnel's far end.
+func (d *TunnelDialer) Address(qube *models.Qube) string {
+	if qube == nil {
+		return ""
+	}
+	return net.JoinHostPort(qube.IPAddress, d.port)
+}
+
+// RelayDialer reaches a qube's agent as a stream through a relay's gateway
+// forward: "qubesair.StreamTCP+<forward>+<ip>".
+type RelayDialer struct {
+	relay   StreamCaller
+	forward string
+	port    string
+}
+
+// NewRelayDialer builds a dialer that streams through relay. An empty forward
+// is DefaultAgentForward.
+func NewRelayDialer(relay StreamCaller, forward, agentListen string) *RelayDialer {
+	if forward == "" {
+		forward = DefaultAgentForward
+	}
+	return &RelayDialer{relay: relay, forward: forward, port: agentPortFrom(agentListen)}
+}
+
+// DialAgent opens a stream to the qube's agent and returns its local end.
+//
+// The stream lives as long as the connection, not as long as ctx: ctx bounds
+// a dial, and the callers hold the connection well past theirs. Closing the
+// connection ends the stream. The port the relay dials is its forward's, not
+// ours; the two are configured from the same agent listen address.
+func (d *RelayDialer) DialAgent(_ context.Context, qube *models.Qube) (net.Conn, error) {
+	service := agentStreamService + d.forward + "+" + qube.IPAddress
+	if !transport.ValidName(service) {
+		return nil, fmt.Errorf("%w: %q cannot be addressed through a relay", transport.ErrInvalidName, qube.IPAddress)
+	}
+	local, remote := net.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	conn := &relayConn{Conn: local, cancel: cancel}
+	go func() {
+		err := d.relay.CallStream(ctx, qube.Name, service, remote, remote)
+		if err != nil && ctx.Err() == nil {
+			conn.fail(err)
+		}
+		_ = remote.Close()
+		cancel()
+	}()
+	return conn, nil
+}
+
+// Address labels the agent by the address the relay dials.
+func (d *RelayDialer) Address(qube *models.Qube) string {
+	if qube == nil {
+		return ""
+	}
+	return net.JoinHostPort(qube.IPAddress, d.port)
+}
+
+// relayConn is the local end of a relayed stream. Reads after the stream
+// failed return why, marked ErrAgentUnreachable, instead of a bare EOF.
+type relayConn struct {
+	net.Conn
+	cancel context.CancelFunc
+
+	mu  sync.Mutex
+	err error
+}
+
+func (c *relayConn) fail(err error) {
+	c.mu.Lock()
+	c.err = err
+	c.mu.Unlock()
+}
+
+func (c *relayConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if errors.Is(err, io.EOF) {
+		c.mu.Lock()
+		failed := c.err
+		c.mu.Unlock()
+		if failed != nil {
+			return n, fmt.Errorf("%w: %v", ErrAgentUnreachable, failed)
+		}
+	}
+	return n, err
+}
+
+func (c *relayConn) Close() error {
+	c.cancel()
+	return c.Conn.Close()
+}
+
+// unroutedDialer stands in for a route whose transport cannot reach agents.
+type unroutedDialer struct {
+	route string
+	port  string
+}
+
+func (d unroutedDialer) DialAgent(context.Context, *models.Qube) (net.Conn, error) {
+	return nil, fmt.Errorf("the %s route cannot open agent connections (its transport is not configured)", d.route)
+}
+
+func (d unroutedDialer) Address(qube *models.Qube) string {
+	if qube == nil {
+		return ""
+	}
+	return net.JoinHostPort(qube.IPAddress, d.port)
+}
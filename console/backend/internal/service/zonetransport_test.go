@@ -0,0 +1,120 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/slchris/qubes-air/console/internal/models"
+	"github.com/slchris/qubes-air/console/internal/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fixedZone answers every zone lookup with one zone, or with err.
+type fixedZone struct {
+	name string
+	err  error
+}
+
+func (z fixedZone) GetByID(_ context.Context, id string) (*models.Zone, error) {
+	if z.err != nil {
+		return nil, z.err
+	}
+	return &models.Zone{ID: id, Name: z.name}, nil
+}
+
+// echoRelay is a relay whose streams echo their input, recording the service
+// each was opened for; fail makes every stream end with that error instead.
+type echoRelay struct {
+	mu       sync.Mutex
+	services []string
+	fail     error
+}
+
+func (r *echoRelay) CallStream(_ context.Context, _, service string, stdin io.Reader, stdout io.Writer) error {
+	r.mu.Lock()
+	r.services = append(r.services, service)
+	r.mu.Unlock()
+	if r.fail != nil {
+		return r.fail
+	}
+	_, err := io.Copy(stdout, stdin)
+	return err
+}
+
+// TestZoneTransportsRoutesByZone — a zone's route is found by ID or by name,
+// and a zone with none, or one that cannot be read, takes the fallback.
+func TestZoneTransportsRoutesByZone(t *testing.T) {
+	fallback := NewZoneRoute(ZoneRouteDirect, "", transport.NoopTransport{}, "", "0.0.0.0:8443")
+	byName := ZoneRoute{Kind: ZoneRouteSSH, Relay: "branch"}
+	byID := ZoneRoute{Kind: ZoneRouteGRPC, Relay: "nat"}
+	qube := &models.Qube{Name: "remote-a", ZoneID: "z1", IPAddress: "10.0.0.1"}
+	ctx := context.Background()
+
+	routes := NewZoneTransports(fixedZone{name: "branch-office"}, fallback).
+		Route("branch-office", byName)
+	assert.Equal(t, byName, routes.For(ctx, qube))
+
+	routes.Route("z1", byID)
+	assert.Equal(t, byID, routes.For(ctx, qube), "a route pinned to the zone ID wins over its name")
+
+	other := &models.Qube{Name: "remote-b", ZoneID: "z2"}
+	assert.Equal(t, ZoneRouteDirect, NewZoneTransports(fixedZone{name: "lan"}, fallback).
+		Route("branch-office", byName).For(ctx, other).Kind)
+	assert.Equal(t, ZoneRouteDirect, NewZoneTransports(fixedZone{err: errors.New("db down")}, fallback).
+		Route("branch-office", byName).For(ctx, other).Kind)
+	assert.Equal(t, "10.0.0.1:8443", routes.Address(&models.Qube{IPAddress: "10.0.0.1"}))
+}
+
+// TestRelayDialerSplicesStream — a relayed dial is a stream through the
+// relay's gateway forward to the qube's address, carrying bytes both ways.
+func TestRelayDialerSplicesStream(t *testing.T) {
+	relay := &echoRelay{}
+	route := NewZoneRoute(ZoneRouteGRPC, "nat", struct {
+		transport.Transport
+		StreamCaller
+	}{transport.NoopTransport{}, relay}, "", "0.0.0.0:8443")
+	qube := &models.Qube{Name: "remote-a", IPAddress: "10.20.0.5"}
+
+	conn, err := route.Dialer.DialAgent(context.Background(), qube)
+	require.NoError(t, err)
+	defer conn.Close()
+	go func() { _, _ = conn.Write([]byte("hello")) }()
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+	assert.Equal(t, "10.20.0.5:8443", route.Dialer.Address(qube))
+
+	relay.mu.Lock()
+	defer relay.mu.Unlock()
+	assert.Equal(t, []string{"qubesair.StreamTCP+agents+10.20.0.5"}, relay.services)
+}
+
+// TestRelayDialerReportsUnreachable — a stream the relay refuses reads as
+// ErrAgentUnreachable, not a bare EOF a TLS handshake would call a rejection.
+func TestRelayDialerReportsUnreachable(t *testing.T) {
+	relay := &echoRelay{fail: errors.New("stream request not permitted by this agent's forward policy")}
+	conn, err := NewRelayDialer(relay, "lab", "0.0.0.0:8443").
+		DialAgent(context.Background(), &models.Qube{Name: "remote-a", IPAddress: "10.20.0.5"})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, ErrAgentUnreachable)
+	assert.Contains(t, err.Error(), "forward policy")
+}
+
+// TestZoneRouteWithoutTunnel — a route whose transport cannot open agent
+// connections fails every dial instead of dialing direct.
+func TestZoneRouteWithoutTunnel(t *testing.T) {
+	route := NewZoneRoute(ZoneRouteSSH, "branch", transport.NoopTransport{}, "", "0.0.0.0:8443")
+	_, err := route.Dialer.DialAgent(context.Background(), &models.Qube{IPAddress: "127.0.0.1"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "ssh via branch")
+
+	assert.IsType(t, &DirectDialer{}, NewZoneRoute(ZoneRouteDirect, "", transport.NoopTransport{}, "", "0.0.0.0:8443").Dialer)
+}
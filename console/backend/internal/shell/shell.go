@@ -0,0 +1,127 @@
+// Package shell is the wire format of qubesair.Shell, the interactive terminal
+// on a remote.
+//
+// qubesair.Exec runs one command and returns its output when it exits, which
+// is no use for anything that wants a terminal: an editor, top, a password
+// prompt. qubesair.Shell is a streaming call instead. The remote runs a login
+// shell on a pseudo-terminal and the call's two directions carry it:
+//
+//   - towards the remote, frames (see WriteData and WriteResize): keystrokes,
+//     and the terminal's size whenever it changes, since a full-screen program
+//     must be told when the window it draws in is resized;
+//   - back from the remote, the terminal's output, raw, until the shell exits.
+//
+// The frames exist only for the resize. Without it input could be raw too;
+// with it, input needs a kind and a length, and output — which never has
+// anything to say but bytes — stays unframed.
+//
+// The agent does not read the frames. It splices the call to the privileged
+// helper, which owns the terminal (internal/agent/privhelper); the console
+// and relay write them.
+package shell
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Service is the streaming service that opens a terminal.
+const Service = "qubesair.Shell"
+
+// Frame kinds.
+const (
+	// KindData is input for the terminal.
+	KindData byte = 0
+	// KindResize is the terminal's new size: rows then columns, two bytes
+	// each, big-endian.
+	KindResize byte = 1
+)
+
+// MaxFrameBytes bounds a frame's payload. Input is typed or pasted; WriteData
+// splits anything larger.
+const MaxFrameBytes = 32 << 10
+
+// headerBytes is a frame's kind and length.
+const headerBytes = 5
+
+// ErrFrameTooLarge means a frame claimed more than MaxFrameBytes.
+var ErrFrameTooLarge = errors.New("shell frame too large")
+
+// Frame is one decoded frame.
+type Frame struct {
+	Kind byte
+	// Data is a KindData frame's input.
+	Data []byte
+	// Rows and Cols are a KindResize frame's size.
+	Rows, Cols uint16
+}
+
+// WriteData writes p to w as one or more data frames.
+func WriteData(w io.Writer, p []byte) error {
+	for len(p) > 0 {
+		n := min(len(p), MaxFrameBytes)
+		if err := writeFrame(w, KindData, p[:n]); err != nil {
+			return err
+		}
+		p = p[n:]
+	}
+	return nil
+}
+
+// WriteResize writes a resize frame to w.
+func WriteResize(w io.Writer, rows, cols uint16) error {
+	var size [4]byte
+	binary.BigEndian.PutUint16(size[0:], rows)
+	binary.BigEndian.PutUint16(size[2:], cols)
+	return writeFrame(w, KindResize, size[:])
+}
+
+func writeFrame(w io.Writer, kind byte, payload []byte) error {
+	buf := make([]byte, headerBytes+len(payload))
+	buf[0] = kind
+	binary.BigEndian.PutUint32(buf[1:], uint32(len(payload))) // #nosec G115 -- bounded by MaxFrameBytes
+	copy(buf[headerBytes:], payload)
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadFrame reads the next frame from r. A frame of a kind this package does
+// not know is returned with its payload in Data, for the caller to skip: a
+// newer console may send what an older helper does not act on, and a
+// terminal that dies over it would be worse than one that ignores it.
+func ReadFrame(r io.Reader) (Frame, error) {
+	var hdr [headerBytes]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return Frame{}, err
+	}
+	n := binary.BigEndian.Uint32(hdr[1:])
+	if n > MaxFrameBytes {
+		return Frame{}, fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, n)
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return Frame{}, unexpected(err)
+	}
+	f := Frame{Kind: hdr[0]}
+	switch f.Kind {
+	case KindResize:
+		if n != 4 {
+			return Frame{}, fmt.Errorf("resize frame of %d bytes", n)
+		}
+		f.Rows = binary.BigEndian.Uint16(payload[0:])
+		f.Cols = binary.BigEndian.Uint16(payload[2:])
+	default:
+		f.Data = payload
+	}
+	return f, nil
+}
+
+// unexpected reports a stream that ended inside a frame as such.
+func unexpected(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
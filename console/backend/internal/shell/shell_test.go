@@ -0,0 +1,63 @@
+package shell
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestFramesRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	big := bytes.Repeat([]byte("x"), MaxFrameBytes+10)
+	if err := WriteResize(&buf, 24, 80); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteData(&buf, []byte("ls -l\r")); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteData(&buf, big); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := ReadFrame(&buf)
+	if err != nil || f.Kind != KindResize || f.Rows != 24 || f.Cols != 80 {
+		t.Fatalf("resize = %+v, %v", f, err)
+	}
+	f, err = ReadFrame(&buf)
+	if err != nil || f.Kind != KindData || string(f.Data) != "ls -l\r" {
+		t.Fatalf("data = %+v, %v", f, err)
+	}
+	var got []byte
+	for range 2 {
+		f, err = ReadFrame(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, f.Data...)
+	}
+	if !bytes.Equal(got, big) {
+		t.Errorf("large input came back as %d bytes, want %d", len(got), len(big))
+	}
+	if _, err := ReadFrame(&buf); !errors.Is(err, io.EOF) {
+		t.Errorf("end of stream = %v, want io.EOF", err)
+	}
+}
+
+func TestReadFrameRefusesBadFrames(t *testing.T) {
+	for name, raw := range map[string][]byte{
+		"oversized":    {KindData, 0xff, 0xff, 0xff, 0xff},
+		"short resize": {KindResize, 0, 0, 0, 2, 0, 24},
+		"truncated":    {KindData, 0, 0, 0, 9, 'a'},
+	} {
+		if _, err := ReadFrame(bytes.NewReader(raw)); err == nil || errors.Is(err, io.EOF) {
+			t.Errorf("%s: err = %v, want a framing error", name, err)
+		}
+	}
+
+	// An unknown kind is handed back, not fatal.
+	f, err := ReadFrame(bytes.NewReader([]byte{9, 0, 0, 0, 1, 'z'}))
+	if err != nil || f.Kind != 9 || string(f.Data) != "z" {
+		t.Errorf("unknown kind = %+v, %v", f, err)
+	}
+}
@@ -0,0 +1,375 @@
+package transfer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// CallFunc makes one qubesair.Transfer call and returns the answer's bytes.
+// Calls of one transfer should share a tunnel: there are many of them.
+type CallFunc func(ctx context.Context, in []byte) ([]byte, error)
+
+// Client drives transfers over a CallFunc.
+type Client struct {
+	Call CallFunc
+	// ChunkSize is the bytes per call (default DefaultChunkSize).
+	ChunkSize int
+	// Progress, when set, is told the bytes done so far after every chunk.
+	Progress func(done, total int64)
+}
+
+// PushOptions describe the file a push installs; see Request for the
+// defaults when left zero.
+type PushOptions struct {
+	Mode uint32
+	UID  *int
+	GID  *int
+}
+
+// PullOptions describe how a pulled file is installed locally.
+type PullOptions struct {
+	// Owner restores the remote uid and gid. Only meaningful as root, and
+	// only when the two machines agree on what the numbers mean.
+	Owner bool
+}
+
+// Do makes one call.
+func (c *Client) Do(ctx context.Context, req Request) (Response, error) {
+	in, err := json.Marshal(req)
+	if err != nil {
+		return Response{}, err
+	}
+	out, err := c.Call(ctx, in)
+	if err != nil {
+		return Response{}, remoteError(err)
+	}
+	var resp Response
+	if err := json.Unmarshal(out, &resp); err != nil {
+		return Response{}, fmt.Errorf("transfer answer: %w", err)
+	}
+	return resp, nil
+}
+
+// remoteError maps the text of a store's error back to its sentinel. The
+// error arrives wrapped by the transport and the helper, so it is matched
+// anywhere in the message rather than as a prefix.
+func remoteError(err error) error {
+	for _, sentinel := range sentinels {
+		if !errors.Is(err, sentinel) && strings.Contains(err.Error(), sentinel.Error()) {
+			return fmt.Errorf("%w (%v)", sentinel, err)
+		}
+	}
+	return err
+}
+
+func (c *Client) chunk() int {
+	if c.ChunkSize <= 0 {
+		return DefaultChunkSize
+	}
+	return min(c.ChunkSize, MaxChunkSize)
+}
+
+// Stat describes remote and any push staged for it.
+func (c *Client) Stat(ctx context.Context, remote string, hash, tree bool) (Response, error) {
+	return c.Do(ctx, Request{Op: OpStat, Path: remote, Hash: hash, Tree: tree})
+}
+
+// Upload writes r to remote's staged push, starting at offset — which must be
+// exactly what is staged already — and returns the staged size it reached.
+// It does not commit.
+//
+// When r is also an io.Seeker, a write refused for its offset is answered by
+// asking where the staged file really ends and seeking there: a chunk whose
+// answer was lost on the way back was still written, and sending it again
+// would otherwise fail the whole push. Every chunk carries its own hash and
+// the commit checks the whole file, so skipping ahead can never install
+// bytes nobody sent.
+func (c *Client) Upload(ctx context.Context, remote string, r io.Reader, offset, total int64, tree bool) (int64, error) {
+	buf := make([]byte, c.chunk())
+	for first := true; ; first = false {
+		n, rerr := io.ReadFull(r, buf)
+		// An empty file is still one (empty) write: it is what creates the
+		// staged file the commit installs.
+		if n > 0 || (first && offset == 0) {
+			sum := sha256.Sum256(buf[:n])
+			_, err := c.Do(ctx, Request{
+				Op: OpWrite, Path: remote, Tree: tree, Offset: offset,
+				Data: buf[:n], SHA256: hex.EncodeToString(sum[:]),
+			})
+			seeker, canSeek := r.(io.Seeker)
+			switch {
+			case err == nil:
+				offset += int64(n)
+			case errors.Is(err, ErrOffsetMismatch) && canSeek:
+				st, serr := c.Stat(ctx, remote, false, tree)
+				if serr != nil {
+					return offset, serr
+				}
+				if st.Staged < offset || (total > 0 && st.Staged > total) {
+					return offset, err
+				}
+				if _, serr := seeker.Seek(st.Staged, io.SeekStart); serr != nil {
+					return offset, serr
+				}
+				offset = st.Staged
+				continue
+			default:
+				return offset, err
+			}
+			if c.Progress != nil {
+				c.Progress(offset, total)
+			}
+		}
+		switch {
+		case errors.Is(rerr, io.EOF) || errors.Is(rerr, io.ErrUnexpectedEOF):
+			return offset, nil
+		case rerr != nil:
+			return offset, rerr
+		}
+	}
+}
+
+// Push copies the local file to remote, resuming a push of the same content
+// that was interrupted. The local mode is kept unless opts sets one.
+func (c *Client) Push(ctx context.Context, local, remote string, opts PushOptions) (Response, error) {
+	return c.push(ctx, local, remote, opts, false)
+}
+
+// PushTree copies the local directory's contents into the remote directory,
+// creating it if need be, as one tar.
+func (c *Client) PushTree(ctx context.Context, local, remote string) (Response, error) {
+	root, err := os.OpenRoot(local)
+	if err != nil {
+		return Response{}, err
+	}
+	defer root.Close()
+	tmp, err := os.CreateTemp("", "qubesair-push-*.tar")
+	if err != nil {
+		return Response{}, err
+	}
+	defer os.Remove(tmp.Name())
+	werr := writeTree(root, tmp)
+	if cerr := tmp.Close(); werr == nil {
+		werr = cerr
+	}
+	if werr != nil {
+		return Response{}, fmt.Errorf("pack %s: %w", local, werr)
+	}
+	return c.push(ctx, tmp.Name(), remote, PushOptions{}, true)
+}
+
+func (c *Client) push(ctx context.Context, local, remote string, opts PushOptions, tree bool) (Response, error) {
+	f, err := os.Open(local) // #nosec G304 -- the caller's own file
+	if err != nil {
+		return Response{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return Response{}, err
+	}
+	if !info.Mode().IsRegular() {
+		return Response{}, fmt.Errorf("%s is not a regular file", local)
+	}
+	size := info.Size()
+	if opts.Mode == 0 && !tree {
+		opts.Mode = uint32(info.Mode().Perm())
+	}
+	sum, err := hashPrefix(f, size)
+	if err != nil {
+		return Response{}, err
+	}
+
+	// Resume only onto bytes that are provably ours: a staged push whose
+	// hash matches the same length of this file. Anything else staged there
+	// — another version, someone else's — is dropped and the push restarts.
+	st, err := c.Stat(ctx, remote, true, tree)
+	if err != nil {
+		return Response{}, err
+	}
+	var from int64
+	if st.Staged > 0 && st.Staged <= size {
+		if mine, err := hashPrefix(f, st.Staged); err == nil && mine == st.StagedSHA256 {
+			from = st.Staged
+		}
+	}
+	if st.Staged > 0 && from == 0 {
+		if _, err := c.Do(ctx, Request{Op: OpAbort, Path: remote, Tree: tree}); err != nil {
+			return Response{}, err
+		}
+	}
+	if _, err := f.Seek(from, io.SeekStart); err != nil {
+		return Response{}, err
+	}
+	if _, err := c.Upload(ctx, remote, f, from, size, tree); err != nil {
+		return Response{}, err
+	}
+	return c.Do(ctx, Request{
+		Op: OpCommit, Path: remote, Tree: tree, Size: size, SHA256: sum,
+		Mode: opts.Mode, UID: opts.UID, GID: opts.GID,
+	})
+}
+
+// Download streams a remote file, or a packed tree when src has a Handle,
+// from offset to w. want is what a stat or pack said about it; every chunk
+// is checked against its own hash, and a file whose size or modification time
+// moves under the reader is reported as ErrChanged rather than stitched
+// together from two versions.
+func (c *Client) Download(ctx context.Context, src Request, want Response, offset int64, w io.Writer) error {
+	for offset < want.Size || (offset == 0 && want.Size == 0) {
+		resp, err := c.Do(ctx, Request{Op: OpRead, Path: src.Path, Handle: src.Handle, Offset: offset, Length: c.chunk()})
+		if err != nil {
+			return err
+		}
+		if resp.Size != want.Size || (src.Handle == "" && resp.ModTime != want.ModTime) {
+			return fmt.Errorf("%w: %s", ErrChanged, src.Path)
+		}
+		if sum := sha256.Sum256(resp.Data); hex.EncodeToString(sum[:]) != resp.SHA256 {
+			return fmt.Errorf("%w: chunk at %d", ErrChecksum, offset)
+		}
+		if _, err := w.Write(resp.Data); err != nil {
+			return err
+		}
+		offset += int64(len(resp.Data))
+		if c.Progress != nil {
+			c.Progress(offset, want.Size)
+		}
+		if resp.EOF {
+			break
+		}
+		if len(resp.Data) == 0 {
+			return fmt.Errorf("read at %d of %s returned nothing", offset, src.Path)
+		}
+	}
+	return nil
+}
+
+// Pull copies remote to the local file. An interrupted pull leaves
+// <local>.part behind, and the next pull of the same path continues from it;
+// if the remote file changed in between, the whole-file hash says so and the
+// partial copy is discarded.
+func (c *Client) Pull(ctx context.Context, remote, local string, opts PullOptions) (Response, error) {
+	st, err := c.Stat(ctx, remote, true, false)
+	if err != nil {
+		return Response{}, err
+	}
+	if !st.Exists || st.Dir {
+		return Response{}, fmt.Errorf("%s is not a regular file on the remote", remote)
+	}
+	part := local + ".part"
+	f, err := os.OpenFile(part, os.O_RDWR|os.O_CREATE, 0o600) // #nosec G304 -- the caller's own path
+	if err != nil {
+		return Response{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return Response{}, err
+	}
+	from := info.Size()
+	if from > st.Size {
+		if err := f.Truncate(0); err != nil {
+			return Response{}, err
+		}
+		from = 0
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(f, 0, from)); err != nil {
+		return Response{}, err
+	}
+	if _, err := f.Seek(from, io.SeekStart); err != nil {
+		return Response{}, err
+	}
+	if err := c.Download(ctx, Request{Path: remote}, st, from, io.MultiWriter(f, h)); err != nil {
+		return Response{}, err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != st.SHA256 {
+		_ = f.Close()
+		_ = os.Remove(part)
+		return Response{}, fmt.Errorf("%w: %s hashes to %s, the remote said %s", ErrChecksum, remote, got, st.SHA256)
+	}
+	if err := f.Chmod(os.FileMode(st.Mode).Perm()); err != nil {
+		return Response{}, err
+	}
+	if opts.Owner {
+		if err := f.Chown(st.UID, st.GID); err != nil {
+			return Response{}, err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		return Response{}, err
+	}
+	if err := f.Close(); err != nil {
+		return Response{}, err
+	}
+	mtime := time.Unix(0, st.ModTime)
+	if err := os.Chtimes(part, mtime, mtime); err != nil {
+		return Response{}, err
+	}
+	return st, os.Rename(part, local)
+}
+
+// PullTree copies the remote directory's contents into the local one,
+// creating it if need be. The remote packs a snapshot first, so what arrives
+// is the tree as it was at one moment rather than whatever each file was
+// when its turn came.
+func (c *Client) PullTree(ctx context.Context, remote, local string) (Response, error) {
+	packed, err := c.Do(ctx, Request{Op: OpPack, Path: remote})
+	if err != nil {
+		return Response{}, err
+	}
+	defer func() {
+		// Best effort, on a context of its own: a pull cut short by its
+		// deadline should still not leave the snapshot for the sweep.
+		rctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+		defer cancel()
+		_, _ = c.Do(rctx, Request{Op: OpRelease, Handle: packed.Handle})
+	}()
+
+	tmp, err := os.CreateTemp("", "qubesair-pull-*.tar")
+	if err != nil {
+		return Response{}, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	h := sha256.New()
+	if err := c.Download(ctx, Request{Path: remote, Handle: packed.Handle}, packed, 0, io.MultiWriter(tmp, h)); err != nil {
+		return Response{}, err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != packed.SHA256 {
+		return Response{}, fmt.Errorf("%w: tree of %s hashes to %s, the remote said %s", ErrChecksum, remote, got, packed.SHA256)
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return Response{}, err
+	}
+	if err := os.MkdirAll(local, 0o755); err != nil {
+		return Response{}, err
+	}
+	root, err := os.OpenRoot(filepath.Clean(local))
+	if err != nil {
+		return Response{}, err
+	}
+	defer root.Close()
+	if err := extractTree(root, tmp); err != nil {
+		return Response{}, fmt.Errorf("unpack into %s: %w", local, err)
+	}
+	return packed, nil
+}
+
+// hashPrefix hashes the first n bytes of f.
+func hashPrefix(f *os.File, n int64) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(f, 0, n)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
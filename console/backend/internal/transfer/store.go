@@ -0,0 +1,566 @@
+package transfer
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stagedSuffix marks a push in progress beside its target. It stays after an
+// interrupted push — that is what makes the push resumable — and is replaced
+// by the target on commit.
+const stagedSuffix = ".qubesair-partial"
+
+// Prefix is a directory tree a store may reach.
+type Prefix struct {
+	Path string
+	// ReadOnly allows stat, read and pack only.
+	ReadOnly bool
+}
+
+// Store answers transfer requests against the local filesystem.
+//
+// Every path is confined twice: as a string, to the longest configured prefix
+// it falls under, and then by resolving it inside an os.Root opened at that
+// prefix, which refuses any step — a "..", a symlink — that would leave it.
+// The second is the one that matters when the store runs as root and a less
+// trusted user can plant symlinks under /tmp or /home.
+type Store struct {
+	prefixes []Prefix
+	// spool holds what has no place beside its target: a tree push's staged
+	// tar, and the tars pack makes. Root-only, created on first use.
+	spool string
+
+	mu    sync.Mutex
+	packs map[string]*pack
+	now   func() time.Time
+}
+
+// pack is a snapshot of a tree, waiting to be read.
+type pack struct {
+	name    string // in spool
+	size    int64
+	sum     string
+	created time.Time
+}
+
+// NewStore serves prefixes, keeping staged trees and packs under spool.
+func NewStore(prefixes []Prefix, spool string) *Store {
+	clean := make([]Prefix, 0, len(prefixes))
+	for _, p := range prefixes {
+		clean = append(clean, Prefix{Path: filepath.Clean(p.Path), ReadOnly: p.ReadOnly})
+	}
+	return &Store{prefixes: clean, spool: spool, packs: make(map[string]*pack), now: time.Now}
+}
+
+// Handle answers one request.
+func (s *Store) Handle(_ context.Context, req Request) (Response, error) {
+	switch req.Op {
+	case OpStat:
+		return s.stat(req)
+	case OpWrite:
+		return s.write(req)
+	case OpCommit:
+		if req.Tree {
+			return s.commitTree(req)
+		}
+		return s.commitFile(req)
+	case OpAbort:
+		return s.abort(req)
+	case OpRead:
+		return s.read(req)
+	case OpPack:
+		return s.pack(req)
+	case OpRelease:
+		return Response{}, s.release(req.Handle)
+	default:
+		return Response{}, fmt.Errorf("%w: %q", ErrUnknownOp, req.Op)
+	}
+}
+
+// resolve finds the prefix path falls under and path's name relative to it.
+// The longest matching prefix wins. The prefix itself resolves to "." only
+// for a tree, which may be unpacked into or packed from it; a file cannot be
+// the prefix.
+func (s *Store) resolve(path string, write, tree bool) (*os.Root, string, error) {
+	if !filepath.IsAbs(path) || strings.ContainsRune(path, 0) {
+		return nil, "", fmt.Errorf("%w: %q is not an absolute path", ErrPathNotAllowed, path)
+	}
+	clean := filepath.Clean(path)
+	best := -1
+	for i, p := range s.prefixes {
+		if (clean == p.Path || strings.HasPrefix(clean, p.Path+"/")) &&
+			(best < 0 || len(p.Path) > len(s.prefixes[best].Path)) {
+			best = i
+		}
+	}
+	if best < 0 || (clean == s.prefixes[best].Path && !tree) {
+		return nil, "", fmt.Errorf("%w: %q", ErrPathNotAllowed, path)
+	}
+	p := s.prefixes[best]
+	if write && p.ReadOnly {
+		return nil, "", fmt.Errorf("%w: %q is under read-only %s", ErrPathNotAllowed, path, p.Path)
+	}
+	root, err := os.OpenRoot(p.Path)
+	if err != nil {
+		return nil, "", err
+	}
+	rel := "."
+	if clean != p.Path {
+		rel = strings.TrimPrefix(clean, p.Path+"/")
+	}
+	return root, rel, nil
+}
+
+// staged opens the root holding path's staged push and its name there: beside
+// the target for a file, so the commit is a rename; in the spool for a tree,
+// which is unpacked rather than renamed.
+func (s *Store) staged(root *os.Root, path, rel string, tree bool) (*os.Root, string, error) {
+	if !tree {
+		return root, filepath.Join(filepath.Dir(rel), "."+filepath.Base(rel)+stagedSuffix), nil
+	}
+	spool, err := s.openSpool()
+	if err != nil {
+		return nil, "", err
+	}
+	sum := sha256.Sum256([]byte(filepath.Clean(path)))
+	return spool, "tree-" + hex.EncodeToString(sum[:16]) + ".tar" + stagedSuffix, nil
+}
+
+func (s *Store) openSpool() (*os.Root, error) {
+	if err := os.MkdirAll(s.spool, 0o700); err != nil {
+		return nil, fmt.Errorf("transfer spool: %w", err)
+	}
+	return os.OpenRoot(s.spool)
+}
+
+// stat describes path and any push staged for it.
+func (s *Store) stat(req Request) (Response, error) {
+	root, rel, err := s.resolve(req.Path, false, req.Tree)
+	if err != nil {
+		return Response{}, err
+	}
+	defer root.Close()
+
+	var resp Response
+	info, err := root.Stat(rel)
+	switch {
+	case err == nil:
+		describe(&resp, info)
+		if req.Hash && info.Mode().IsRegular() {
+			if resp.SHA256, err = hashFile(root, rel); err != nil {
+				return Response{}, err
+			}
+		}
+	case !os.IsNotExist(err):
+		return Response{}, err
+	}
+
+	sroot, name, err := s.staged(root, req.Path, rel, req.Tree)
+	if err != nil {
+		return Response{}, err
+	}
+	if sroot != root {
+		defer sroot.Close()
+	}
+	if si, err := sroot.Lstat(name); err == nil && si.Mode().IsRegular() {
+		resp.Staged = si.Size()
+		if req.Hash {
+			if resp.StagedSHA256, err = hashFile(sroot, name); err != nil {
+				return Response{}, err
+			}
+		}
+	}
+	return resp, nil
+}
+
+// write appends one chunk to path's staged push.
+func (s *Store) write(req Request) (Response, error) {
+	if len(req.Data) > MaxChunkSize {
+		return Response{}, fmt.Errorf("chunk of %d bytes is over the %d limit", len(req.Data), MaxChunkSize)
+	}
+	if sum := sha256.Sum256(req.Data); hex.EncodeToString(sum[:]) != req.SHA256 {
+		return Response{}, fmt.Errorf("%w: chunk at %d", ErrChecksum, req.Offset)
+	}
+	root, rel, err := s.resolve(req.Path, true, req.Tree)
+	if err != nil {
+		return Response{}, err
+	}
+	defer root.Close()
+	sroot, name, err := s.staged(root, req.Path, rel, req.Tree)
+	if err != nil {
+		return Response{}, err
+	}
+	if sroot != root {
+		defer sroot.Close()
+	}
+
+	f, err := sroot.OpenFile(name, os.O_WRONLY|os.O_CREATE, 0o600)
+	if err != nil {
+		return Response{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return Response{}, err
+	}
+	if !info.Mode().IsRegular() {
+		return Response{}, fmt.Errorf("staged push for %s is not a regular file", req.Path)
+	}
+	if info.Size() != req.Offset {
+		return Response{}, fmt.Errorf("%w: %d bytes staged, write at %d", ErrOffsetMismatch, info.Size(), req.Offset)
+	}
+	if _, err := f.WriteAt(req.Data, req.Offset); err != nil {
+		return Response{}, err
+	}
+	return Response{Staged: req.Offset + int64(len(req.Data))}, nil
+}
+
+// checkStaged verifies a staged push against the size and hash its commit
+// claims, and removes it when the bytes are wrong — resuming on top of them
+// could never succeed.
+func checkStaged(sroot *os.Root, name string, req Request) (*os.File, string, error) {
+	f, err := sroot.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		return nil, "", fmt.Errorf("nothing staged to commit: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, "", err
+	}
+	if info.Size() != req.Size {
+		_ = f.Close()
+		return nil, "", fmt.Errorf("%w: %d bytes staged, commit of %d", ErrOffsetMismatch, info.Size(), req.Size)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		_ = f.Close()
+		return nil, "", err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if req.SHA256 != "" && sum != req.SHA256 {
+		_ = f.Close()
+		_ = sroot.Remove(name)
+		return nil, "", fmt.Errorf("%w: staged file hashes to %s, expected %s", ErrChecksum, sum, req.SHA256)
+	}
+	return f, sum, nil
+}
+
+// commitFile installs a staged push at its target: mode and owner set, synced,
+// renamed over whatever was there.
+func (s *Store) commitFile(req Request) (Response, error) {
+	root, rel, err := s.resolve(req.Path, true, false)
+	if err != nil {
+		return Response{}, err
+	}
+	defer root.Close()
+	_, name, _ := s.staged(root, req.Path, rel, false)
+
+	f, sum, err := checkStaged(root, name, req)
+	if err != nil {
+		return Response{}, err
+	}
+	defer f.Close()
+
+	// What the file is replacing decides anything the request leaves open; a
+	// new file takes its directory's owner, as qubesair.FileCopy's did.
+	perm := fs.FileMode(req.Mode) & fs.ModePerm
+	uid, gid := -1, -1
+	if old, err := root.Stat(rel); err == nil {
+		if perm == 0 {
+			perm = old.Mode().Perm()
+		}
+		uid, gid, _ = owner(old)
+	} else if dir, err := root.Stat(filepath.Dir(rel)); err == nil {
+		uid, gid, _ = owner(dir)
+	}
+	if perm == 0 {
+		perm = 0o644
+	}
+	if req.UID != nil {
+		uid = *req.UID
+	}
+	if req.GID != nil {
+		gid = *req.GID
+	}
+	if err := f.Chmod(perm); err != nil {
+		return Response{}, err
+	}
+	if os.Geteuid() == 0 && (uid >= 0 || gid >= 0) {
+		if err := f.Chown(uid, gid); err != nil {
+			return Response{}, err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		return Response{}, err
+	}
+	if err := root.Rename(name, rel); err != nil {
+		return Response{}, err
+	}
+	info, err := root.Stat(rel)
+	if err != nil {
+		return Response{}, err
+	}
+	resp := Response{SHA256: sum}
+	describe(&resp, info)
+	return resp, nil
+}
+
+// commitTree unpacks a staged tar into its target directory, creating it if
+// need be. Each file lands atomically; the tree as a whole does not — a
+// failure part way leaves the files already unpacked in place.
+func (s *Store) commitTree(req Request) (Response, error) {
+	root, rel, err := s.resolve(req.Path, true, true)
+	if err != nil {
+		return Response{}, err
+	}
+	defer root.Close()
+	spool, name, err := s.staged(root, req.Path, rel, true)
+	if err != nil {
+		return Response{}, err
+	}
+	defer spool.Close()
+
+	f, sum, err := checkStaged(spool, name, req)
+	if err != nil {
+		return Response{}, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return Response{}, err
+	}
+	if err := root.MkdirAll(rel, 0o755); err != nil {
+		return Response{}, err
+	}
+	dir, err := root.OpenRoot(rel)
+	if err != nil {
+		return Response{}, err
+	}
+	defer dir.Close()
+	if err := extractTree(dir, f); err != nil {
+		return Response{}, fmt.Errorf("unpack into %s: %w", req.Path, err)
+	}
+	_ = spool.Remove(name)
+
+	info, err := root.Stat(rel)
+	if err != nil {
+		return Response{}, err
+	}
+	resp := Response{SHA256: sum}
+	describe(&resp, info)
+	resp.Size = req.Size
+	return resp, nil
+}
+
+// abort drops path's staged push, if there is one.
+func (s *Store) abort(req Request) (Response, error) {
+	root, rel, err := s.resolve(req.Path, true, req.Tree)
+	if err != nil {
+		return Response{}, err
+	}
+	defer root.Close()
+	sroot, name, err := s.staged(root, req.Path, rel, req.Tree)
+	if err != nil {
+		return Response{}, err
+	}
+	if sroot != root {
+		defer sroot.Close()
+	}
+	if err := sroot.Remove(name); err != nil && !os.IsNotExist(err) {
+		return Response{}, err
+	}
+	return Response{}, nil
+}
+
+// read returns one chunk of a file, or of a packed tree when Handle is set.
+func (s *Store) read(req Request) (Response, error) {
+	var (
+		f   *os.File
+		err error
+	)
+	if req.Handle != "" {
+		f, err = s.openPack(req.Handle)
+	} else {
+		var root *os.Root
+		var rel string
+		if root, rel, err = s.resolve(req.Path, false, false); err != nil {
+			return Response{}, err
+		}
+		f, err = root.Open(rel)
+		_ = root.Close()
+	}
+	if err != nil {
+		return Response{}, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return Response{}, err
+	}
+	if !info.Mode().IsRegular() {
+		return Response{}, fmt.Errorf("%s is not a regular file", req.Path)
+	}
+	if req.Offset < 0 || req.Offset > info.Size() {
+		return Response{}, fmt.Errorf("offset %d is outside a file of %d bytes", req.Offset, info.Size())
+	}
+	n := req.Length
+	if n <= 0 || n > MaxChunkSize {
+		n = MaxChunkSize
+	}
+	n = int(min(int64(n), info.Size()-req.Offset))
+	buf := make([]byte, n)
+	if _, err := f.ReadAt(buf, req.Offset); err != nil && err != io.EOF {
+		return Response{}, err
+	}
+	sum := sha256.Sum256(buf)
+	resp := Response{Data: buf, EOF: req.Offset+int64(n) >= info.Size()}
+	describe(&resp, info)
+	resp.SHA256 = hex.EncodeToString(sum[:])
+	return resp, nil
+}
+
+// pack snapshots the tree at path into a tar in the spool, for reads by
+// handle. A snapshot rather than a tar streamed across calls: it has a size
+// and a hash up front, and a read that resumes at an offset reads the same
+// bytes it would have the first time.
+func (s *Store) pack(req Request) (Response, error) {
+	root, rel, err := s.resolve(req.Path, false, true)
+	if err != nil {
+		return Response{}, err
+	}
+	defer root.Close()
+	if info, err := root.Stat(rel); err != nil {
+		return Response{}, err
+	} else if !info.IsDir() {
+		return Response{}, fmt.Errorf("%s is not a directory", req.Path)
+	}
+	dir, err := root.OpenRoot(rel)
+	if err != nil {
+		return Response{}, err
+	}
+	defer dir.Close()
+
+	s.sweep()
+	spool, err := s.openSpool()
+	if err != nil {
+		return Response{}, err
+	}
+	defer spool.Close()
+	var id [16]byte
+	_, _ = rand.Read(id[:])
+	handle := hex.EncodeToString(id[:])
+	name := "pack-" + handle + ".tar"
+	f, err := spool.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return Response{}, err
+	}
+	h := sha256.New()
+	cw := &countingWriter{w: io.MultiWriter(f, h)}
+	werr := writeTree(dir, cw)
+	if cerr := f.Close(); werr == nil {
+		werr = cerr
+	}
+	if werr != nil {
+		_ = spool.Remove(name)
+		return Response{}, fmt.Errorf("pack %s: %w", req.Path, werr)
+	}
+
+	p := &pack{name: name, size: cw.n, sum: hex.EncodeToString(h.Sum(nil)), created: s.now()}
+	s.mu.Lock()
+	s.packs[handle] = p
+	s.mu.Unlock()
+	return Response{Handle: handle, Size: p.size, SHA256: p.sum, Dir: true, Exists: true}, nil
+}
+
+func (s *Store) openPack(handle string) (*os.File, error) {
+	s.mu.Lock()
+	p, ok := s.packs[handle]
+	s.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownHandle, handle)
+	}
+	spool, err := s.openSpool()
+	if err != nil {
+		return nil, err
+	}
+	defer spool.Close()
+	return spool.Open(p.name)
+}
+
+// release removes a packed tree.
+func (s *Store) release(handle string) error {
+	s.mu.Lock()
+	p, ok := s.packs[handle]
+	delete(s.packs, handle)
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrUnknownHandle, handle)
+	}
+	spool, err := s.openSpool()
+	if err != nil {
+		return err
+	}
+	defer spool.Close()
+	return spool.Remove(p.name)
+}
+
+// sweep removes packs nobody released within PackTTL: a client that died
+// half way through a pull must not leave a copy of the tree behind for good.
+func (s *Store) sweep() {
+	s.mu.Lock()
+	var stale []string
+	for handle, p := range s.packs {
+		if s.now().Sub(p.created) > PackTTL {
+			stale = append(stale, handle)
+		}
+	}
+	s.mu.Unlock()
+	for _, handle := range stale {
+		_ = s.release(handle)
+	}
+}
+
+// describe fills resp with what info says about a file.
+func describe(resp *Response, info fs.FileInfo) {
+	resp.Exists = true
+	resp.Dir = info.IsDir()
+	resp.Size = info.Size()
+	resp.Mode = uint32(info.Mode().Perm())
+	resp.ModTime = info.ModTime().UnixNano()
+	resp.UID, resp.GID, _ = owner(info)
+}
+
+func hashFile(root *os.Root, name string) (string, error) {
+	f, err := root.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,17 @@
+//go:build unix
+
+package transfer
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// owner is the uid and gid a file belongs to.
+func owner(info fs.FileInfo) (uid, gid int, ok bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return -1, -1, false
+	}
+	return int(st.Uid), int(st.Gid), true
+}
@@ -0,0 +1,187 @@
+package transfer
+
+import (
+	"archive/tar"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// writeTree writes the tree under root to w as a tar: directories, regular
+// files and symlinks, with their modes, owners and times. Anything else — a
+// socket, a device — is left out, since there is nothing useful to recreate
+// on the other side.
+//
+// The walk is in lexical order and the headers carry nothing that varies
+// between runs, so packing an unchanged tree twice gives the same bytes. A
+// push of a tree relies on that to resume: the staged prefix is only reused
+// when the new tar starts with exactly the same bytes.
+func writeTree(root *os.Root, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	err := fs.WalkDir(root.FS(), ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if name == "." {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		link := ""
+		switch {
+		case info.Mode()&fs.ModeSymlink != 0:
+			if link, err = root.Readlink(name); err != nil {
+				return err
+			}
+		case !info.IsDir() && !info.Mode().IsRegular():
+			return nil
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		hdr.Format = tar.FormatPAX
+		hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := root.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.CopyN(tw, f, info.Size())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// extractTree unpacks the tar in r into root.
+//
+// Entry names are checked to be local, and everything is created through
+// root, so neither a "../" name nor a symlink unpacked earlier in the same tar
+// can put a file outside it. Regular files are written to a temporary name
+// and renamed, like a single push. Modes keep their permission bits only —
+// no setuid from a tar — and owners are restored only when running as root.
+// Hard links and special files are refused: writeTree never makes them, so a
+// tar that has them did not come from a client of this package.
+func extractTree(root *os.Root, r io.Reader) error {
+	asRoot := os.Geteuid() == 0
+	tr := tar.NewReader(r)
+	var dirs []*tar.Header
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.FromSlash(path.Clean(hdr.Name))
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("%w: tar entry %q", ErrPathNotAllowed, hdr.Name)
+		}
+		perm := fs.FileMode(hdr.Mode) & fs.ModePerm
+		if hdr.Typeflag != tar.TypeDir {
+			if err := root.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+				return err
+			}
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := root.MkdirAll(name, 0o700); err != nil {
+				return err
+			}
+			dirs = append(dirs, hdr)
+			continue
+		case tar.TypeReg:
+			if err := extractFile(root, name, tr, perm); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := root.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			if err := root.Symlink(hdr.Linkname, name); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("tar entry %q: type %q is not supported", hdr.Name, hdr.Typeflag)
+		}
+		if asRoot {
+			if err := root.Lchown(name, hdr.Uid, hdr.Gid); err != nil {
+				return err
+			}
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			if err := root.Chtimes(name, hdr.ModTime, hdr.ModTime); err != nil {
+				return err
+			}
+		}
+	}
+	// Directories last, deepest first: a read-only directory can only be made
+	// so once its contents are in, and unpacking a file bumps its parent's time.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		hdr := dirs[i]
+		name := filepath.FromSlash(path.Clean(hdr.Name))
+		if err := root.Chmod(name, fs.FileMode(hdr.Mode)&fs.ModePerm); err != nil {
+			return err
+		}
+		if asRoot {
+			if err := root.Lchown(name, hdr.Uid, hdr.Gid); err != nil {
+				return err
+			}
+		}
+		if err := root.Chtimes(name, hdr.ModTime, hdr.ModTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractFile writes one regular file atomically.
+func extractFile(root *os.Root, name string, r io.Reader, perm fs.FileMode) error {
+	var suffix [6]byte
+	_, _ = rand.Read(suffix[:])
+	tmp := filepath.Join(filepath.Dir(name), "."+filepath.Base(name)+"."+hex.EncodeToString(suffix[:])+".part")
+	f, err := root.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	_, werr := io.Copy(f, r)
+	if werr == nil {
+		werr = f.Chmod(perm)
+	}
+	if werr == nil {
+		werr = f.Sync()
+	}
+	if cerr := f.Close(); werr == nil {
+		werr = cerr
+	}
+	if werr == nil {
+		werr = root.Rename(tmp, name)
+	}
+	if werr != nil {
+		_ = root.Remove(tmp)
+	}
+	return werr
+}
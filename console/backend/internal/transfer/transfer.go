@@ -0,0 +1,137 @@
+// Package transfer moves files and directory trees to and from a remote in
+// chunks, over any number of ordinary agent calls.
+//
+// qubesair.FileCopy moved a whole file in one call, which put every file under
+// the invoker's 16 MiB and two-minute limits, lost all progress when a WAN link
+// dropped at 90%, and accepted any absolute path. qubesair.Transfer replaces it
+// with a small protocol in which every call is one bounded step:
+//
+//   - stat reports what is at a path, and how much of an interrupted push is
+//     already staged beside it, so a client knows where to resume;
+//   - write appends one chunk to the staged file, at an offset the client
+//     states and the store checks, with the chunk's SHA-256;
+//   - commit checks the whole file's size and SHA-256 and renames it into
+//     place — or, for a tree, unpacks the staged tar into the directory;
+//   - read returns one chunk of a file or a packed tree, with its SHA-256;
+//   - pack snapshots a directory tree into a tar the client then reads.
+//
+// Only the store (store.go) touches the filesystem, and it runs in the
+// privileged helper, which confines every path to configured prefixes. The
+// client (client.go) is what relay-call and the console drive.
+package transfer
+
+import (
+	"errors"
+	"time"
+)
+
+// Service is the agent builtin that answers transfer requests.
+const Service = "qubesair.Transfer"
+
+// Chunk sizes. A chunk is one agent call, base64 in the helper's JSON: 4 MiB
+// keeps each call far from the transport's and helper's caps, and is large
+// enough that a WAN round trip per chunk is not the bottleneck.
+const (
+	DefaultChunkSize = 4 << 20
+	MaxChunkSize     = 8 << 20
+)
+
+// PackTTL is how long a packed tree waits to be read before it is removed.
+const PackTTL = time.Hour
+
+// Operations.
+const (
+	OpStat    = "stat"
+	OpWrite   = "write"
+	OpCommit  = "commit"
+	OpAbort   = "abort"
+	OpRead    = "read"
+	OpPack    = "pack"
+	OpRelease = "release"
+)
+
+// Errors a store reports. Like the helper's, they cross the wire as text and
+// the client maps them back by that text.
+var (
+	// ErrPathNotAllowed means a path falls outside every configured prefix, or
+	// is under a read-only one and the request would write.
+	ErrPathNotAllowed = errors.New("path is outside the transfer prefixes")
+	// ErrOffsetMismatch means a write did not continue the staged file where
+	// it ends. The client answers it with a stat and resumes from there.
+	ErrOffsetMismatch = errors.New("write offset does not match the staged size")
+	// ErrChecksum means a chunk or a whole file did not hash to what the
+	// client said it would.
+	ErrChecksum = errors.New("sha256 mismatch")
+	// ErrChanged means a file changed while it was being read.
+	ErrChanged = errors.New("file changed during transfer")
+	// ErrUnknownHandle means a read or release named no live packed tree.
+	ErrUnknownHandle = errors.New("unknown or expired pack handle")
+	// ErrUnknownOp means the request named no operation.
+	ErrUnknownOp = errors.New("unknown transfer operation")
+)
+
+// sentinels are the errors mapped back from text, in match order.
+var sentinels = []error{
+	ErrPathNotAllowed, ErrOffsetMismatch, ErrChecksum, ErrChanged, ErrUnknownHandle, ErrUnknownOp,
+}
+
+// Request is one transfer call. Only the fields of Op are read.
+type Request struct {
+	Op   string `json:"op"`
+	Path string `json:"path,omitempty"`
+
+	// Offset is where a write appends or a read starts; Length bounds a read
+	// (default and maximum MaxChunkSize).
+	Offset int64 `json:"offset,omitempty"`
+	Length int   `json:"length,omitempty"`
+	// Data is a write's chunk.
+	Data []byte `json:"data,omitempty"`
+	// SHA256 is the chunk's hash on a write and the whole file's on a commit.
+	// On a commit it may be empty, when the caller has nothing to check it
+	// against; the store still reports what it committed.
+	SHA256 string `json:"sha256,omitempty"`
+	// Hash asks stat for the SHA-256 of the file and of any staged push.
+	Hash bool `json:"hash,omitempty"`
+
+	// Size, Mode, UID and GID describe the file a commit installs. A zero
+	// Mode keeps the mode of the file being replaced, or 0644 for a new one;
+	// nil UID and GID keep its owner, or give a new file to the owner of its
+	// directory. An owner is only ever applied by a store running as root.
+	Size int64  `json:"size,omitempty"`
+	Mode uint32 `json:"mode,omitempty"`
+	UID  *int   `json:"uid,omitempty"`
+	GID  *int   `json:"gid,omitempty"`
+	// Tree makes a commit unpack the staged file, a tar, into Path.
+	Tree bool `json:"tree,omitempty"`
+
+	// Handle names a packed tree, for read and release.
+	Handle string `json:"handle,omitempty"`
+}
+
+// Response is a store's answer.
+type Response struct {
+	// Exists, Dir, Size, Mode, UID, GID and ModTime describe Path (stat,
+	// commit) or the file a read came from.
+	Exists  bool   `json:"exists,omitempty"`
+	Dir     bool   `json:"dir,omitempty"`
+	Size    int64  `json:"size,omitempty"`
+	Mode    uint32 `json:"mode,omitempty"`
+	UID     int    `json:"uid,omitempty"`
+	GID     int    `json:"gid,omitempty"`
+	ModTime int64  `json:"mtime,omitempty"` // unix nanoseconds
+	// SHA256 is the whole file's on stat (when asked), commit and pack, and the
+	// chunk's on read.
+	SHA256 string `json:"sha256,omitempty"`
+
+	// Staged and StagedSHA256 describe an interrupted push waiting beside
+	// Path: how far it got, and (when asked) what those bytes hash to.
+	Staged       int64  `json:"staged,omitempty"`
+	StagedSHA256 string `json:"staged_sha256,omitempty"`
+
+	// Data is a read's chunk; EOF says it is the last.
+	Data []byte `json:"data,omitempty"`
+	EOF  bool   `json:"eof,omitempty"`
+
+	// Handle names the tree a pack made.
+	Handle string `json:"handle,omitempty"`
+}
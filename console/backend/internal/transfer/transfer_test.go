@@ -0,0 +1,331 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newPair is a store over dir/rw (writable) and dir/ro (read-only), and a
+// client that reaches it through JSON, as it would through the agent. The
+// returned counter counts calls.
+func newPair(t *testing.T) (dir string, store *Store, cli *Client, calls *int) {
+	t.Helper()
+	dir = t.TempDir()
+	for _, sub := range []string{"rw", "ro"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store = NewStore([]Prefix{
+		{Path: filepath.Join(dir, "rw")},
+		{Path: filepath.Join(dir, "ro"), ReadOnly: true},
+	}, filepath.Join(dir, "spool"))
+	calls = new(int)
+	cli = &Client{ChunkSize: 1024, Call: func(ctx context.Context, in []byte) ([]byte, error) {
+		*calls++
+		var req Request
+		if err := json.Unmarshal(in, &req); err != nil {
+			return nil, err
+		}
+		resp, err := store.Handle(ctx, req)
+		if err != nil {
+			// Only the text crosses the wire.
+			return nil, errors.New("agent: " + err.Error())
+		}
+		return json.Marshal(resp)
+	}}
+	return dir, store, cli, calls
+}
+
+func writeLocal(t *testing.T, path string, data []byte, mode os.FileMode) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, mode); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPushResumesAndCommitsAtomically(t *testing.T) {
+	dir, _, cli, calls := newPair(t)
+	ctx := context.Background()
+	data := bytes.Repeat([]byte("0123456789abcdef"), 300) // 4800 bytes, five chunks
+	local := filepath.Join(t.TempDir(), "payload")
+	writeLocal(t, local, data, 0o640)
+	remote := filepath.Join(dir, "rw", "payload")
+
+	// A push that dies after two chunks.
+	f, err := os.Open(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	staged, err := cli.Upload(ctx, remote, io.LimitReader(f, 2048), 0, int64(len(data)), false)
+	_ = f.Close()
+	if err != nil || staged != 2048 {
+		t.Fatalf("partial upload = %d, %v", staged, err)
+	}
+	if _, err := os.Stat(remote); !os.IsNotExist(err) {
+		t.Fatal("an uncommitted push is visible at its target")
+	}
+
+	*calls = 0
+	resp, err := cli.Push(ctx, local, remote, PushOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// stat, three remaining chunks (2048..4800), commit.
+	if *calls != 5 {
+		t.Errorf("resumed push took %d calls, want 5: it did not resume", *calls)
+	}
+	got, _ := os.ReadFile(remote)
+	sum := sha256.Sum256(data)
+	if !bytes.Equal(got, data) || resp.SHA256 != hex.EncodeToString(sum[:]) || resp.Size != int64(len(data)) {
+		t.Fatalf("committed %d bytes (%s), want %d", len(got), resp.SHA256, len(data))
+	}
+	if info, _ := os.Stat(remote); info.Mode().Perm() != 0o640 {
+		t.Errorf("mode = %v, want the local 0640", info.Mode().Perm())
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(dir, "rw", ".*"+stagedSuffix)); len(leftovers) != 0 {
+		t.Errorf("staged file left behind: %v", leftovers)
+	}
+
+	// A commit that sets no mode keeps the mode of the file it replaces.
+	if err := os.Chmod(remote, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cli.Upload(ctx, remote, bytes.NewReader([]byte("v2")), 0, 2, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cli.Do(ctx, Request{Op: OpCommit, Path: remote, Size: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(remote); info.Mode().Perm() != 0o600 {
+		t.Errorf("mode after a modeless commit = %v, want the replaced file's 0600", info.Mode().Perm())
+	}
+
+	// An empty file is a file.
+	empty := filepath.Join(t.TempDir(), "empty")
+	writeLocal(t, empty, nil, 0o644)
+	if _, err := cli.Push(ctx, empty, filepath.Join(dir, "rw", "empty"), PushOptions{}); err != nil {
+		t.Errorf("empty push: %v", err)
+	}
+}
+
+func TestPushRestartsOnForeignStagedBytes(t *testing.T) {
+	dir, _, cli, _ := newPair(t)
+	ctx := context.Background()
+	remote := filepath.Join(dir, "rw", "f")
+	if err := os.WriteFile(filepath.Join(dir, "rw", ".f"+stagedSuffix), []byte("not the same file"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	local := filepath.Join(t.TempDir(), "f")
+	writeLocal(t, local, []byte("the real content, longer than the staged bytes"), 0o644)
+	if _, err := cli.Push(ctx, local, remote, PushOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(remote); string(got) != "the real content, longer than the staged bytes" {
+		t.Errorf("got %q: a push resumed onto bytes that were not its own", got)
+	}
+}
+
+func TestStoreRefusesBadWrites(t *testing.T) {
+	dir, store, _, _ := newPair(t)
+	ctx := context.Background()
+	chunk := func(path string, offset int64, data []byte, sum string) error {
+		if sum == "" {
+			s := sha256.Sum256(data)
+			sum = hex.EncodeToString(s[:])
+		}
+		_, err := store.Handle(ctx, Request{Op: OpWrite, Path: path, Offset: offset, Data: data, SHA256: sum})
+		return err
+	}
+	target := filepath.Join(dir, "rw", "x")
+
+	if err := chunk(target, 0, []byte("abc"), "00"); !errors.Is(err, ErrChecksum) {
+		t.Errorf("bad chunk hash = %v", err)
+	}
+	if err := chunk(target, 0, []byte("abc"), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := chunk(target, 0, []byte("abc"), ""); !errors.Is(err, ErrOffsetMismatch) {
+		t.Errorf("rewrite at 0 = %v, want ErrOffsetMismatch", err)
+	}
+	if _, err := store.Handle(ctx, Request{Op: OpCommit, Path: target, Size: 3, SHA256: "00"}); !errors.Is(err, ErrChecksum) {
+		t.Errorf("commit with the wrong hash = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "rw", ".x"+stagedSuffix)); !os.IsNotExist(err) {
+		t.Error("bytes that failed their commit were kept for a resume that could never succeed")
+	}
+
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(dir, "rw", "escape")); err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range []string{
+		"/etc/passwd",
+		filepath.Join(dir, "rw", "..", "elsewhere"),
+		filepath.Join(dir, "rw"), // a prefix is not a file
+		filepath.Join(dir, "ro", "x"),
+		"relative",
+	} {
+		if err := chunk(bad, 0, []byte("x"), ""); !errors.Is(err, ErrPathNotAllowed) {
+			t.Errorf("write %q = %v, want ErrPathNotAllowed", bad, err)
+		}
+	}
+	if err := chunk(filepath.Join(dir, "rw", "escape", "owned"), 0, []byte("x"), ""); err == nil {
+		t.Error("a write followed a symlink out of its prefix")
+	}
+	if entries, _ := os.ReadDir(outside); len(entries) != 0 {
+		t.Errorf("files landed outside the prefix: %v", entries)
+	}
+}
+
+func TestPullResumesAndNoticesChanges(t *testing.T) {
+	dir, _, cli, _ := newPair(t)
+	ctx := context.Background()
+	data := bytes.Repeat([]byte("pull me "), 500)
+	remote := filepath.Join(dir, "ro", "report")
+	writeLocal(t, remote, data, 0o604)
+	local := filepath.Join(t.TempDir(), "report")
+
+	// What an interrupted pull leaves behind.
+	if err := os.WriteFile(local+".part", data[:1500], 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cli.Pull(ctx, remote, local, PullOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := os.ReadFile(local)
+	if !bytes.Equal(got, data) {
+		t.Fatalf("pulled %d bytes, want %d", len(got), len(data))
+	}
+	if info, _ := os.Stat(local); info.Mode().Perm() != 0o604 {
+		t.Errorf("mode = %v, want the remote 0604", info.Mode().Perm())
+	}
+
+	// A stale .part from another version is caught by the whole-file hash.
+	if err := os.WriteFile(local+".part", []byte("something else"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cli.Pull(ctx, remote, local, PullOptions{}); !errors.Is(err, ErrChecksum) {
+		t.Errorf("pull onto a foreign .part = %v, want ErrChecksum", err)
+	}
+	if _, err := cli.Pull(ctx, remote, local, PullOptions{}); err != nil {
+		t.Errorf("the retry after a discarded .part = %v", err)
+	}
+
+	// A file rewritten mid-pull is not stitched from two versions.
+	st, err := cli.Stat(ctx, remote, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeLocal(t, remote, append(data, "more"...), 0o604)
+	if err := cli.Download(ctx, Request{Path: remote}, st, 0, &bytes.Buffer{}); !errors.Is(err, ErrChanged) {
+		t.Errorf("download of a changed file = %v, want ErrChanged", err)
+	}
+}
+
+func TestTreeRoundTrip(t *testing.T) {
+	dir, store, cli, _ := newPair(t)
+	ctx := context.Background()
+	src := t.TempDir()
+	writeLocal(t, filepath.Join(src, "a.txt"), []byte("alpha"), 0o600)
+	writeLocal(t, filepath.Join(src, "sub", "b.sh"), []byte("#!/bin/sh\n"), 0o755)
+	if err := os.Symlink("a.txt", filepath.Join(src, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(src, "sub"), 0o750); err != nil {
+		t.Fatal(err)
+	}
+
+	remote := filepath.Join(dir, "rw", "tree")
+	if _, err := cli.PushTree(ctx, src, remote); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(filepath.Join(remote, "sub", "b.sh")); string(b) != "#!/bin/sh\n" {
+		t.Errorf("b.sh = %q", b)
+	}
+	if info, _ := os.Stat(filepath.Join(remote, "sub", "b.sh")); info.Mode().Perm() != 0o755 {
+		t.Errorf("b.sh mode = %v", info.Mode().Perm())
+	}
+	if info, _ := os.Stat(filepath.Join(remote, "sub")); info.Mode().Perm() != 0o750 {
+		t.Errorf("sub mode = %v", info.Mode().Perm())
+	}
+	if l, _ := os.Readlink(filepath.Join(remote, "link")); l != "a.txt" {
+		t.Errorf("link -> %q", l)
+	}
+
+	back := filepath.Join(t.TempDir(), "back")
+	if _, err := cli.PullTree(ctx, remote, back); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(filepath.Join(back, "a.txt")); string(b) != "alpha" {
+		t.Errorf("pulled a.txt = %q", b)
+	}
+	if len(store.packs) != 0 {
+		t.Errorf("%d packs left after the pull released its own", len(store.packs))
+	}
+	if entries, _ := os.ReadDir(filepath.Join(dir, "spool")); len(entries) != 0 {
+		t.Errorf("spool not empty: %v", entries)
+	}
+}
+
+func TestTreeCannotEscape(t *testing.T) {
+	dir, store, _, _ := newPair(t)
+	root, err := os.OpenRoot(filepath.Join(dir, "rw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Close()
+
+	// A tar whose symlink points out, followed by a file through it.
+	outside := t.TempDir()
+	src := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(src, "out")); err != nil {
+		t.Fatal(err)
+	}
+	var tarball bytes.Buffer
+	srcRoot, _ := os.OpenRoot(src)
+	if err := writeTree(srcRoot, &tarball); err != nil {
+		t.Fatal(err)
+	}
+	_ = srcRoot.Close()
+	if err := extractTree(root, &tarball); err != nil {
+		t.Fatal(err) // the link itself is harmless
+	}
+	writeLocal(t, filepath.Join(src, "real", "owned"), []byte("x"), 0o644)
+	if err := os.Remove(filepath.Join(src, "out")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(src, "real"), filepath.Join(src, "out")); err != nil {
+		t.Fatal(err)
+	}
+	tarball.Reset()
+	srcRoot, _ = os.OpenRoot(src)
+	if err := writeTree(srcRoot, &tarball); err != nil {
+		t.Fatal(err)
+	}
+	_ = srcRoot.Close()
+	if err := extractTree(root, &tarball); err == nil {
+		t.Error("a file was unpacked through a symlink leading out of the tree")
+	}
+	if entries, _ := os.ReadDir(outside); len(entries) != 0 {
+		t.Errorf("files landed outside: %v", entries)
+	}
+
+	if _, err := store.Handle(context.Background(), Request{Op: OpPack, Path: filepath.Join(dir, "rw", "..")}); !errors.Is(err, ErrPathNotAllowed) {
+		t.Errorf("pack above the prefix = %v", err)
+	}
+}
@@ -0,0 +1,195 @@
+// Package chaos injects faults into the console's links to its agents, by
+// rule: latency, drops, resets, truncated frames and slow readers.
+//
+// It exists because the monitors that keep the fleet honest — agent health,
+// certificate renewal, bootstrap — were only ever exercised over links that
+// either worked or refused outright. A real link to a NAT'd zone does neither:
+// it stalls, cuts a TLS record in half, trickles, or resets after the first
+// few kilobytes. Each of those has its own way of wedging a sweep, and none of
+// them can be produced on demand with a real network.
+//
+// Two wrappers share one Injector, so a single rule set shapes both kinds of
+// traffic: Transport wraps a transport.Transport (qrexec calls, faults applied
+// per call), Dialer wraps an agent dialer (faults applied to the dial and then
+// to the connection's bytes).
+//
+// The package itself is inert: nothing wraps anything unless asked. The server
+// only asks in a build with the "chaos" tag (cmd/server/chaos.go), so a
+// production binary cannot turn it on from config however the file reads.
+package chaos
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Fault is one kind of injected failure.
+type Fault string
+
+// Faults. AfterBytes, where a fault takes it, counts bytes read from the
+// connection (or of a call's response); zero means at once.
+const (
+	// FaultLatency delays a call, a dial, and every read on the connection.
+	FaultLatency Fault = "latency"
+	// FaultDrop is a black hole: the call or dial never answers, or the
+	// connection goes silent after AfterBytes, until the caller's context or
+	// deadline ends it — the way a dropped SYN or a dead NAT mapping behaves.
+	FaultDrop Fault = "drop"
+	// FaultReset fails the call or refuses the dial with ECONNRESET, or resets
+	// the connection after AfterBytes.
+	FaultReset Fault = "reset"
+	// FaultTruncate cuts the response, or the connection's stream, at
+	// AfterBytes: what arrives is a clean EOF in the middle of a frame.
+	FaultTruncate Fault = "truncate"
+	// FaultSlow makes the reader trickle at BytesPerSecond.
+	FaultSlow Fault = "slow"
+)
+
+// ErrInjected marks every error this package makes up, so a test can tell an
+// injected failure from a real one.
+var ErrInjected = errors.New("chaos: injected fault")
+
+// Rule says which fault to inject into what.
+type Rule struct {
+	Fault Fault
+	// Target matches the qube (call target, or the dialed qube's name) as a
+	// path.Match glob; empty matches any.
+	Target string
+	// Service matches the qrexec service as a glob; empty matches any. A dial
+	// has no service, so a rule with one never touches dials.
+	Service string
+	// Probability is the chance the rule fires on a match; 0 means always.
+	Probability float64
+	// Count retires the rule after it has fired that many times; 0 never
+	// does. "The first three dials reset" is how a test models a link that
+	// recovers.
+	Count int
+	// Latency is FaultLatency's delay.
+	Latency time.Duration
+	// AfterBytes is where FaultDrop, FaultReset and FaultTruncate strike.
+	AfterBytes int
+	// BytesPerSecond is FaultSlow's rate.
+	BytesPerSecond int
+}
+
+func (r Rule) validate() error {
+	switch r.Fault {
+	case FaultLatency:
+		if r.Latency <= 0 {
+			return fmt.Errorf("chaos: a latency rule needs a latency")
+		}
+	case FaultSlow:
+		if r.BytesPerSecond <= 0 {
+			return fmt.Errorf("chaos: a slow rule needs bytes_per_second")
+		}
+	case FaultDrop, FaultReset, FaultTruncate:
+	default:
+		return fmt.Errorf("chaos: unknown fault %q", r.Fault)
+	}
+	for _, glob := range []string{r.Target, r.Service} {
+		if _, err := path.Match(glob, ""); err != nil {
+			return fmt.Errorf("chaos: bad pattern %q: %w", glob, err)
+		}
+	}
+	if r.Probability < 0 || r.Probability > 1 || r.Count < 0 || r.AfterBytes < 0 {
+		return fmt.Errorf("chaos: %s rule has a negative count or size, or a probability outside 0..1", r.Fault)
+	}
+	return nil
+}
+
+// Injector decides, per call or dial, which rules fire.
+type Injector struct {
+	mu    sync.Mutex
+	rules []Rule
+	fired []int
+	rng   *rand.Rand
+	total map[Fault]int
+}
+
+// New builds an Injector. The seed makes the probabilistic rules repeatable:
+// a flaky run can be replayed exactly.
+func New(seed int64, rules ...Rule) (*Injector, error) {
+	for _, r := range rules {
+		if err := r.validate(); err != nil {
+			return nil, err
+		}
+	}
+	return &Injector{
+		rules: append([]Rule(nil), rules...),
+		fired: make([]int, len(rules)),
+		rng:   rand.New(rand.NewSource(seed)), // #nosec G404 -- fault injection, not security
+		total: map[Fault]int{},
+	}, nil
+}
+
+// Injected reports how many times a fault has fired.
+func (i *Injector) Injected(f Fault) int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.total[f]
+}
+
+// match returns the rules that fire for target and service, in order, and
+// counts them as fired.
+func (i *Injector) match(target, service string) []Rule {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	var out []Rule
+	for n, r := range i.rules {
+		if r.Count > 0 && i.fired[n] >= r.Count {
+			continue
+		}
+		if !globMatch(r.Target, target) || (r.Service != "" && !globMatch(r.Service, service)) {
+			continue
+		}
+		if r.Probability > 0 && i.rng.Float64() >= r.Probability {
+			continue
+		}
+		i.fired[n]++
+		i.total[r.Fault]++
+		out = append(out, r)
+	}
+	return out
+}
+
+func globMatch(pattern, s string) bool {
+	if pattern == "" {
+		return true
+	}
+	ok, _ := path.Match(pattern, s)
+	return ok
+}
+
+// resetError is what a reset looks like to the caller: ECONNRESET, marked.
+func resetError(what string) error {
+	return fmt.Errorf("%w: %s: %w", ErrInjected, what, syscall.ECONNRESET)
+}
+
+// sleep waits d or until ctx ends.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// blackHole waits for ctx to end, as a call into a dropped link does.
+func blackHole(ctx context.Context, what string) error {
+	<-ctx.Done()
+	return fmt.Errorf("%w: %s dropped: %w", ErrInjected, what, ctx.Err())
+}
+
+// slowDelay is how long n bytes take at rate bytes per second.
+func slowDelay(n, rate int) time.Duration {
+	return time.Duration(n) * time.Second / time.Duration(rate)
+}
@@ -0,0 +1,274 @@
+package chaos
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/slchris/qubes-air/console/internal/models"
+	"github.com/slchris/qubes-air/console/internal/transport"
+	transportgrpc "github.com/slchris/qubes-air/console/internal/transport/grpc"
+)
+
+// payloadDialer connects to a listener that writes payload and then echoes.
+type payloadDialer struct{ addr string }
+
+func (d payloadDialer) DialAgent(ctx context.Context, _ *models.Qube) (net.Conn, error) {
+	return (&net.Dialer{}).DialContext(ctx, "tcp", d.addr)
+}
+
+func (d payloadDialer) Address(*models.Qube) string { return d.addr }
+
+func startPayloadServer(t *testing.T, payload []byte) payloadDialer {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = lis.Close() })
+	go func() {
+		for {
+			c, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_, _ = c.Write(payload)
+				_, _ = io.Copy(c, c)
+			}()
+		}
+	}()
+	return payloadDialer{addr: lis.Addr().String()}
+}
+
+func mustInjector(t *testing.T, rules ...Rule) *Injector {
+	t.Helper()
+	inj, err := New(1, rules...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return inj
+}
+
+var qube = &models.Qube{Name: "remote-a"}
+
+func TestRulesMatchAndRetire(t *testing.T) {
+	inj := mustInjector(t,
+		Rule{Fault: FaultReset, Target: "remote-*", Service: "qubesair.Begin*", Count: 2},
+		Rule{Fault: FaultTruncate, Target: "other"},
+	)
+	xport := inj.Transport(&transport.FakeTransport{})
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if _, err := xport.Call(ctx, "remote-a", "qubesair.BeginRenewal", nil); !errors.Is(err, syscall.ECONNRESET) {
+			t.Fatalf("call %d = %v, want an injected reset", i, err)
+		}
+	}
+	if _, err := xport.Call(ctx, "remote-a", "qubesair.BeginRenewal", nil); err != nil {
+		t.Errorf("a retired rule still fired: %v", err)
+	}
+	if _, err := xport.Call(ctx, "remote-a", "qubesair.Ping", nil); err != nil {
+		t.Errorf("a rule fired for another service: %v", err)
+	}
+	if got := inj.Injected(FaultReset); got != 2 {
+		t.Errorf("Injected(reset) = %d, want 2", got)
+	}
+
+	for _, bad := range []Rule{{Fault: "gremlins"}, {Fault: FaultLatency}, {Fault: FaultSlow}, {Fault: FaultDrop, Probability: 2}} {
+		if _, err := New(1, bad); err == nil {
+			t.Errorf("New accepted %+v", bad)
+		}
+	}
+}
+
+// TestProbabilityIsRepeatable — the same seed fires the same calls, so a
+// failure found at random can be replayed.
+func TestProbabilityIsRepeatable(t *testing.T) {
+	run := func() []bool {
+		inj, _ := New(42, Rule{Fault: FaultReset, Probability: 0.5})
+		xport := inj.Transport(&transport.FakeTransport{})
+		var out []bool
+		for i := 0; i < 32; i++ {
+			_, err := xport.Call(context.Background(), "remote-a", "qubesair.Ping", nil)
+			out = append(out, err != nil)
+		}
+		return out
+	}
+	a, b := run(), run()
+	fired := 0
+	for i := range a {
+		if a[i] != b[i] {
+			t.Fatalf("call %d differed between runs with one seed", i)
+		}
+		if a[i] {
+			fired++
+		}
+	}
+	if fired == 0 || fired == len(a) {
+		t.Errorf("a 0.5 rule fired %d of %d times", fired, len(a))
+	}
+}
+
+func TestTransportFaults(t *testing.T) {
+	inner := &transport.FakeTransport{RespFn: func(string, string, []byte) ([]byte, error) {
+		return []byte(`{"nonce":"n1","csr_pem":"..."}`), nil
+	}}
+	ctx := context.Background()
+
+	out, err := mustInjector(t, Rule{Fault: FaultTruncate, AfterBytes: 8}).Transport(inner).
+		Call(ctx, "remote-a", "qubesair.BeginRenewal", nil)
+	if err != nil || string(out) != `{"nonce"` {
+		t.Errorf("truncated call = %q, %v", out, err)
+	}
+
+	dctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	before := inner.CallCount()
+	if _, err := mustInjector(t, Rule{Fault: FaultDrop}).Transport(inner).
+		Call(dctx, "remote-a", "qubesair.Ping", nil); !errors.Is(err, context.DeadlineExceeded) || !errors.Is(err, ErrInjected) {
+		t.Errorf("a dropped call = %v, want the caller's deadline, marked injected", err)
+	}
+	if inner.CallCount() != before {
+		t.Error("a dropped call reached the agent")
+	}
+
+	started := time.Now()
+	if _, err := mustInjector(t, Rule{Fault: FaultLatency, Latency: 30 * time.Millisecond}).Transport(inner).
+		Call(ctx, "remote-a", "qubesair.Ping", nil); err != nil || time.Since(started) < 30*time.Millisecond {
+		t.Errorf("a delayed call = %v after %s", err, time.Since(started))
+	}
+}
+
+func TestDialerFaults(t *testing.T) {
+	payload := bytes.Repeat([]byte("x"), 64)
+	agent := startPayloadServer(t, payload)
+	ctx := context.Background()
+
+	t.Run("reset at dial", func(t *testing.T) {
+		_, err := mustInjector(t, Rule{Fault: FaultReset}).Dialer(agent).DialAgent(ctx, qube)
+		if !errors.Is(err, syscall.ECONNRESET) {
+			t.Errorf("dial = %v, want a reset", err)
+		}
+	})
+
+	t.Run("drop at dial waits for the caller", func(t *testing.T) {
+		dctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		if _, err := mustInjector(t, Rule{Fault: FaultDrop}).Dialer(agent).DialAgent(dctx, qube); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("dial = %v, want the deadline", err)
+		}
+	})
+
+	t.Run("truncate mid-stream", func(t *testing.T) {
+		conn, err := mustInjector(t, Rule{Fault: FaultTruncate, AfterBytes: 10}).Dialer(agent).DialAgent(ctx, qube)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		got, err := io.ReadAll(conn)
+		if err != nil || len(got) != 10 {
+			t.Errorf("read %d bytes, %v; want a clean EOF after 10", len(got), err)
+		}
+	})
+
+	t.Run("reset mid-stream fails writes too", func(t *testing.T) {
+		conn, err := mustInjector(t, Rule{Fault: FaultReset, AfterBytes: 10}).Dialer(agent).DialAgent(ctx, qube)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		got, err := io.ReadAll(conn)
+		if !errors.Is(err, syscall.ECONNRESET) || len(got) != 10 {
+			t.Errorf("read %d bytes, %v; want a reset after 10", len(got), err)
+		}
+		if _, err := conn.Write([]byte("more")); !errors.Is(err, syscall.ECONNRESET) {
+			t.Errorf("write after a reset = %v", err)
+		}
+	})
+
+	t.Run("drop mid-stream honours the read deadline", func(t *testing.T) {
+		conn, err := mustInjector(t, Rule{Fault: FaultDrop, AfterBytes: 10}).Dialer(agent).DialAgent(ctx, qube)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(100 * time.Millisecond))
+		got, err := io.ReadAll(conn)
+		if !errors.Is(err, os.ErrDeadlineExceeded) || len(got) != 10 {
+			t.Errorf("read %d bytes, %v; want silence after 10 until the deadline", len(got), err)
+		}
+	})
+
+	t.Run("slow reader trickles", func(t *testing.T) {
+		conn, err := mustInjector(t, Rule{Fault: FaultSlow, BytesPerSecond: 320}).Dialer(agent).DialAgent(ctx, qube)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		started := time.Now()
+		buf := make([]byte, len(payload))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatal(err)
+		}
+		// 64 bytes at 320 B/s is 200ms, give or take a chunk.
+		if elapsed := time.Since(started); elapsed < 150*time.Millisecond {
+			t.Errorf("64 bytes at 320 B/s arrived in %s", elapsed)
+		}
+	})
+}
+
+// reportingInner is a transport that describes itself and can be closed, as
+// the gRPC client and the SSH transport respectively do.
+type reportingInner struct {
+	transport.FakeTransport
+	closed bool
+}
+
+func (r *reportingInner) Status() transportgrpc.ClientStatus {
+	return transportgrpc.ClientStatus{RemoteName: "remote-relay", Connected: true}
+}
+
+func (r *reportingInner) Close() error {
+	r.closed = true
+	return nil
+}
+
+// TestTransportForwardsStatusAndClose — the wrapper is invisible to GET
+// /transport and to shutdown: it reports the inner status when there is one,
+// claims none when there is not, and closes what it wraps.
+func TestTransportForwardsStatusAndClose(t *testing.T) {
+	inj := mustInjector(t, Rule{Fault: FaultReset})
+	inner := &reportingInner{}
+	wrapped := inj.Transport(inner)
+
+	r, ok := wrapped.(interface {
+		Status() transportgrpc.ClientStatus
+	})
+	if !ok {
+		t.Fatal("the wrapper hides the inner transport's status")
+	}
+	if st := r.Status(); st.RemoteName != "remote-relay" || !st.Connected {
+		t.Errorf("status = %+v", st)
+	}
+	if err := wrapped.(io.Closer).Close(); err != nil || !inner.closed {
+		t.Errorf("close = %v, inner closed %v", err, inner.closed)
+	}
+
+	plain := inj.Transport(&transport.FakeTransport{})
+	if _, ok := plain.(interface {
+		Status() transportgrpc.ClientStatus
+	}); ok {
+		t.Error("the wrapper reports a status its inner transport does not have")
+	}
+	if err := plain.(io.Closer).Close(); err != nil {
+		t.Errorf("closing around a transport without Close = %v", err)
+	}
+}
@@ -0,0 +1,215 @@
+package chaos
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/slchris/qubes-air/console/internal/models"
+)
+
+// AgentDialer is the console's agent dialer (service.AgentDialer), restated
+// here so this package does not import the services it is used to test.
+type AgentDialer interface {
+	DialAgent(ctx context.Context, qube *models.Qube) (net.Conn, error)
+	Address(qube *models.Qube) string
+}
+
+// Dialer is an agent dialer with faults injected into its dials and into the
+// connections it returns. Rules are matched on the qube's name with no
+// service.
+type Dialer struct {
+	inner AgentDialer
+	inj   *Injector
+}
+
+var _ AgentDialer = (*Dialer)(nil)
+
+// Dialer wraps inner.
+func (i *Injector) Dialer(inner AgentDialer) *Dialer {
+	return &Dialer{inner: inner, inj: i}
+}
+
+// Address is inner's: a fault changes what happens on the way, not where to.
+func (d *Dialer) Address(qube *models.Qube) string { return d.inner.Address(qube) }
+
+// DialAgent dials through the faults that strike at dial time, then wraps the
+// connection in the ones that strike on its bytes.
+func (d *Dialer) DialAgent(ctx context.Context, qube *models.Qube) (net.Conn, error) {
+	name := ""
+	if qube != nil {
+		name = qube.Name
+	}
+	what := "dial " + d.inner.Address(qube)
+	rules := d.inj.match(name, "")
+	var onConn []Rule
+	for _, r := range rules {
+		switch {
+		case r.Fault == FaultLatency:
+			if err := sleep(ctx, r.Latency); err != nil {
+				return nil, fmt.Errorf("%w: %s delayed: %w", ErrInjected, what, err)
+			}
+			onConn = append(onConn, r)
+		case r.Fault == FaultDrop && r.AfterBytes == 0:
+			return nil, blackHole(ctx, what)
+		case r.Fault == FaultReset && r.AfterBytes == 0:
+			return nil, resetError(what)
+		default:
+			onConn = append(onConn, r)
+		}
+	}
+	conn, err := d.inner.DialAgent(ctx, qube)
+	if err != nil || len(onConn) == 0 {
+		return conn, err
+	}
+	return newConn(conn, onConn), nil
+}
+
+// conn applies byte-level faults to a connection's reads. A tripped reset
+// fails writes as well; everything else lets writes through, as a one-way
+// failure on a real link does.
+type conn struct {
+	net.Conn
+	rules []Rule
+
+	closeOnce sync.Once
+	closed    chan struct{}
+
+	mu       sync.Mutex
+	read     int
+	tripped  error // set once a reset or truncate has struck
+	deadline time.Time
+}
+
+func newConn(c net.Conn, rules []Rule) *conn {
+	return &conn{Conn: c, rules: rules, closed: make(chan struct{})}
+}
+
+func (c *conn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	tripped, read := c.tripped, c.read
+	c.mu.Unlock()
+	if tripped != nil {
+		return 0, tripped
+	}
+
+	limit := len(p)
+	var delay time.Duration
+	for _, r := range c.rules {
+		switch r.Fault {
+		case FaultLatency:
+			delay += r.Latency
+		case FaultSlow:
+			// A tenth of a second's worth at a time, so a trickle looks like
+			// one rather than like one long stall and a burst.
+			chunk := max(r.BytesPerSecond/10, 1)
+			limit = min(limit, chunk)
+			delay += slowDelay(chunk, r.BytesPerSecond)
+		case FaultDrop, FaultReset, FaultTruncate:
+			if read >= r.AfterBytes {
+				return 0, c.strike(r)
+			}
+			limit = min(limit, r.AfterBytes-read)
+		}
+	}
+	if delay > 0 {
+		if err := c.wait(delay); err != nil {
+			return 0, err
+		}
+	}
+	n, err := c.Conn.Read(p[:limit])
+	c.mu.Lock()
+	c.read += n
+	c.mu.Unlock()
+	return n, err
+}
+
+func (c *conn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	tripped := c.tripped
+	c.mu.Unlock()
+	if tripped != nil && tripped != io.EOF {
+		return 0, tripped
+	}
+	return c.Conn.Write(p)
+}
+
+// strike applies a byte-count fault whose moment has come.
+func (c *conn) strike(r Rule) error {
+	switch r.Fault {
+	case FaultDrop:
+		// Silence: nothing more arrives, and nothing says so, until the
+		// reader's deadline or a close.
+		return c.wait(0)
+	case FaultReset:
+		c.trip(resetError("connection"))
+	default:
+		c.trip(io.EOF)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tripped
+}
+
+func (c *conn) trip(err error) {
+	c.mu.Lock()
+	if c.tripped == nil {
+		c.tripped = err
+	}
+	c.mu.Unlock()
+	_ = c.Close()
+}
+
+// wait sleeps d (forever when d is 0) but wakes for a close or the read
+// deadline, which is how TLS and gRPC abandon a stalled read.
+func (c *conn) wait(d time.Duration) error {
+	c.mu.Lock()
+	deadline := c.deadline
+	c.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		t := time.NewTimer(time.Until(deadline))
+		defer t.Stop()
+		expired = t.C
+	}
+	select {
+	case <-timeout:
+		return nil
+	case <-expired:
+		return os.ErrDeadlineExceeded
+	case <-c.closed:
+		return net.ErrClosed
+	}
+}
+
+func (c *conn) SetDeadline(t time.Time) error {
+	c.setReadDeadline(t)
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error {
+	c.setReadDeadline(t)
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *conn) setReadDeadline(t time.Time) {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+}
+
+func (c *conn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
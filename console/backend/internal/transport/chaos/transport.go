@@ -0,0 +1,98 @@
+package chaos
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/slchris/qubes-air/console/internal/transport"
+	transportgrpc "github.com/slchris/qubes-air/console/internal/transport/grpc"
+)
+
+// Transport is a transport.Transport with faults injected into its calls.
+//
+// Latency, drop and reset strike before the call is forwarded, so a dropped
+// or reset call never reaches the agent — the conservative reading, since a
+// test can then assert nothing ran. Truncate and slow shape the response of a
+// call that did run.
+type Transport struct {
+	inner transport.Transport
+	inj   *Injector
+}
+
+var _ transport.Transport = (*Transport)(nil)
+
+// statusReporter is the gRPC client's description of its tunnels, which the
+// console's GET /transport shows (service.TransportStatusReporter).
+type statusReporter interface {
+	Status() transportgrpc.ClientStatus
+}
+
+// reportingTransport is a Transport around an inner one that reports its
+// status. A separate type because the console asks by type assertion: a wrapper
+// that always had Status would claim a status it does not have, and one that
+// never had it hides the tunnels of the chaos run being watched.
+type reportingTransport struct {
+	*Transport
+}
+
+// Status is the inner transport's: faults are injected per call, and never
+// into what the tunnel says about itself.
+func (t reportingTransport) Status() transportgrpc.ClientStatus {
+	return t.inner.(statusReporter).Status()
+}
+
+// Transport wraps inner. The wrapper reports inner's status when inner does,
+// and closes inner with it.
+func (i *Injector) Transport(inner transport.Transport) transport.Transport {
+	t := &Transport{inner: inner, inj: i}
+	if _, ok := inner.(statusReporter); ok {
+		return reportingTransport{t}
+	}
+	return t
+}
+
+// Close closes inner when it has a Close, so shutting the console down
+// releases the real connection whether or not chaos is on.
+func (t *Transport) Close() error {
+	if c, ok := t.inner.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Call forwards the call through whatever faults its rules inject.
+func (t *Transport) Call(ctx context.Context, target, service string, in []byte) ([]byte, error) {
+	rules := t.inj.match(target, service)
+	what := fmt.Sprintf("%s on %s", service, target)
+	for _, r := range rules {
+		switch r.Fault {
+		case FaultLatency:
+			if err := sleep(ctx, r.Latency); err != nil {
+				return nil, fmt.Errorf("%w: %s delayed: %w", ErrInjected, what, err)
+			}
+		case FaultDrop:
+			return nil, blackHole(ctx, what)
+		case FaultReset:
+			return nil, resetError(what)
+		}
+	}
+
+	out, err := t.inner.Call(ctx, target, service, in)
+	if err != nil {
+		return out, err
+	}
+	for _, r := range rules {
+		switch r.Fault {
+		case FaultTruncate:
+			if len(out) > r.AfterBytes {
+				out = out[:r.AfterBytes]
+			}
+		case FaultSlow:
+			if err := sleep(ctx, slowDelay(len(out), r.BytesPerSecond)); err != nil {
+				return nil, fmt.Errorf("%w: %s trickled past its deadline: %w", ErrInjected, what, err)
+			}
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,277 @@
+// attach.go — the relay ACCEPTING agents that dial out (RelayAttach.Attach).
+//
+// The mirror image of dialout.go. Each attached agent gets a Client of its own,
+// driven over the inbound stream instead of one it dialed, so everything a
+// Client does — calls, streams, flow control, cancellation, capabilities — is
+// available on an attached agent without a second implementation.
+//
+// Routing is by CERTIFICATE identity. An attached agent is known by the name in
+// its verified client certificate (agent-<qube>, see pki.AgentCommonName),
+// never by the remote_name it reports in its Handshake: that field is whatever
+// the host says, and a compromised remote that could claim another qube's name
+// would be handed that qube's calls.
+
+package grpc
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/slchris/qubes-air/console/internal/transport"
+	pb "github.com/slchris/qubes-air/console/internal/transport/relaypb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// agentCNPrefix is what an agent certificate's common name starts with; the
+// rest is the qube name. Mirrors pki.AgentCommonName.
+const agentCNPrefix = "agent-"
+
+// AttachConfig configures the relay's listener for dial-out agents.
+type AttachConfig struct {
+	Listen string      // host:port agents dial
+	TLS    *tls.Config // server certificate; ClientCAs verifies agent certificates
+	// CertRegistry, when set, authorizes each agent certificate as
+	// ServerConfig.CertRegistry does, and re-checks it while attached.
+	CertRegistry CertRegistry
+	// ReauthorizeInterval is how often that re-check runs (default
+	// reauthorizeInterval), as in ServerConfig.
+	ReauthorizeInterval time.Duration
+	// RelayName is the identity this relay gives in its Handshake.
+	RelayName string
+	// KeepAlive, StreamWindow and CompressThreshold apply to every attached
+	// agent's tunnel, as in ClientConfig.
+	KeepAlive         time.Duration
+	StreamWindow      int
+	CompressThreshold int
+	// ReversePolicy gates reverse calls from attached agents, each under the
+	// qube name from its certificate.
+	ReversePolicy *ReversePolicy
+}
+
+// AttachServer accepts agents that dial out and routes calls to them by
+// certificate identity. It satisfies transport.Transport.
+type AttachServer struct {
+	pb.UnimplementedRelayAttachServer
+	cfg     AttachConfig
+	reverse transport.ReverseHandler
+
+	mu     sync.Mutex
+	agents map[string]*attached // by qube name, from the certificate
+}
+
+// attached is one agent's live tunnel.
+type attached struct {
+	client *Client
+	cancel context.CancelFunc
+}
+
+var _ transport.Transport = (*AttachServer)(nil)
+
+// NewAttachServer builds the relay's attach listener. reverse handles reverse
+// calls from attached agents, exactly as for a Client.
+func NewAttachServer(cfg AttachConfig, reverse transport.ReverseHandler) *AttachServer {
+	return &AttachServer{cfg: cfg, reverse: reverse, agents: make(map[string]*attached)}
+}
+
+// Serve listens for agents with mTLS and blocks until ctx is canceled, then
+// stops gracefully and returns nil.
+func (a *AttachServer) Serve(ctx context.Context) error {
+	if a.cfg.TLS == nil {
+		return errors.New("grpc attach: nil TLS config (mTLS is required)")
+	}
+	// An attached agent is identified by its certificate, so a connection
+	// without one has no identity to route to. On a copy: the caller's config
+	// may be shared with a listener that asks for no client certificate.
+	tlsCfg := a.cfg.TLS.Clone()
+	tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+	if registry := a.cfg.CertRegistry; registry != nil {
+		tlsCfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			return authorizeChain(registry, cs.VerifiedChains)
+		}
+	}
+
+	var lc net.ListenConfig
+	lis, err := lc.Listen(ctx, "tcp", a.cfg.Listen)
+	if err != nil {
+		return fmt.Errorf("grpc attach: listen %q: %w", a.cfg.Listen, err)
+	}
+	gs := grpc.NewServer(grpc.Creds(credentials.NewTLS(tlsCfg)))
+	pb.RegisterRelayAttachServer(gs, a)
+
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			// Attached tunnels never end on their own; GracefulStop would wait
+			// on them forever. Detach everyone first.
+			a.detachAll()
+			gs.GracefulStop()
+		case <-stopped:
+		}
+	}()
+	err = gs.Serve(lis)
+	close(stopped)
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// Attach is the RPC handler: one call per connected agent, alive for as long
+// as its tunnel is.
+func (a *AttachServer) Attach(stream grpc.BidiStreamingServer[pb.Frame, pb.Frame]) error {
+	cn := peerCommonName(stream.Context())
+	name, ok := strings.CutPrefix(cn, agentCNPrefix)
+	if !ok || !transport.ValidName(name) {
+		log.Printf("grpc attach: refusing connection with certificate %q: not an agent identity", cn)
+		return fmt.Errorf("grpc attach: certificate %q is not an agent identity", cn)
+	}
+
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	if a.cfg.CertRegistry != nil {
+		if fp, ok := peerFingerprint(stream.Context()); ok {
+			go reauthorizeLoop(ctx, cancel, a.cfg.CertRegistry, a.cfg.ReauthorizeInterval, fp)
+		}
+	}
+
+	cli := NewClient(ClientConfig{
+		RemoteEndpoint:    "attached:" + name,
+		RelayName:         a.cfg.RelayName,
+		RemoteName:        name,
+		KeepAlive:         a.cfg.KeepAlive,
+		StreamWindow:      a.cfg.StreamWindow,
+		CompressThreshold: a.cfg.CompressThreshold,
+		ReversePolicy:     a.cfg.ReversePolicy,
+	}, a.reverse)
+	me := &attached{client: cli, cancel: cancel}
+
+	// A second connection under the same identity replaces the first. After a
+	// NAT rebinding the old connection is usually already dead and merely
+	// undetected; the agent dialing again is the best evidence there is.
+	a.mu.Lock()
+	prev := a.agents[name]
+	a.agents[name] = me
+	a.mu.Unlock()
+	if prev != nil {
+		log.Printf("grpc attach: agent %q reattached; dropping its previous tunnel", name)
+		prev.cancel()
+	}
+	log.Printf("grpc attach: agent %q attached", name)
+
+	_, err := cli.runTunnel(ctx, cli.endpoints[0], newAttachStream(ctx, stream), cancel)
+
+	a.mu.Lock()
+	if a.agents[name] == me {
+		delete(a.agents, name)
+	}
+	a.mu.Unlock()
+	log.Printf("grpc attach: agent %q detached: %v", name, err)
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// Agent returns the Client for an attached agent, by qube name.
+func (a *AttachServer) Agent(name string) (*Client, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	at, ok := a.agents[name]
+	if !ok {
+		return nil, false
+	}
+	return at.client, true
+}
+
+// Agents lists the qube names of the agents attached right now, sorted.
+func (a *AttachServer) Agents() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	out := make([]string, 0, len(a.agents))
+	for name := range a.agents {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Call routes a call to the agent attached under target. An agent that is not
+// attached is ErrNotConnected, the same answer a Client gives while its tunnel
+// is down.
+func (a *AttachServer) Call(ctx context.Context, target, service string, in []byte) ([]byte, error) {
+	if !transport.ValidName(target) {
+		return nil, transport.ErrInvalidName
+	}
+	cli, ok := a.Agent(target)
+	if !ok {
+		return nil, fmt.Errorf("agent %q is not attached: %w", target, ErrNotConnected)
+	}
+	return cli.Call(ctx, target, service, in)
+}
+
+// attachStream is an Attach stream whose Recv also ends when ctx does. The
+// handler's stream is bound to the RPC, not to the context Attach derives from
+// it, and that derived context is what revocation, a reattach and detachAll
+// cancel. Without this, canceling it would leave recvLoop blocked in Recv: a
+// revoked or replaced agent stayed attached and routable for as long as it
+// kept its connection open, and GracefulStop waited on it.
+type attachStream struct {
+	frameStream
+	ctx    context.Context
+	frames chan attachRecv
+}
+
+type attachRecv struct {
+	frame *pb.Frame
+	err   error
+}
+
+// newAttachStream starts the reader that feeds Recv. It exits on the stream's
+// first error or once ctx is done; returning from the handler ends the RPC,
+// which unblocks a Recv still in progress.
+func newAttachStream(ctx context.Context, raw frameStream) *attachStream {
+	s := &attachStream{frameStream: raw, ctx: ctx, frames: make(chan attachRecv)}
+	go func() {
+		for {
+			f, err := raw.Recv()
+			select {
+			case s.frames <- attachRecv{f, err}:
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return s
+}
+
+func (s *attachStream) Recv() (*pb.Frame, error) {
+	select {
+	case r := <-s.frames:
+		return r.frame, r.err
+	case <-s.ctx.Done():
+		return nil, s.ctx.Err()
+	}
+}
+
+func (s *attachStream) Context() context.Context { return s.ctx }
+
+func (a *AttachServer) detachAll() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, at := range a.agents {
+		at.cancel()
+	}
+}
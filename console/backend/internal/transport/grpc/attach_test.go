@@ -0,0 +1,282 @@
+package grpc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/slchris/qubes-air/console/internal/repository"
+	pb "github.com/slchris/qubes-air/console/internal/transport/relaypb"
+)
+
+// startAttachServer stands up a relay attach listener on a random localhost
+// port and returns it with its address.
+func startAttachServer(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey) (*AttachServer, string) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lis.Addr().String()
+	_ = lis.Close()
+
+	a := NewAttachServer(AttachConfig{Listen: addr, TLS: mkServerTLS(t, ca, caKey), RelayName: "sys-relay"}, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() { _ = a.Serve(ctx) }()
+	waitDial(t, addr)
+	return a, addr
+}
+
+// startDialOutAgent runs an agent that dials out to addr presenting a client
+// certificate for cn. It stops on the returned cancel or on test cleanup.
+func startDialOutAgent(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey, addr, cn string) context.CancelFunc {
+	t.Helper()
+	return startDialOutAgentWith(t, ca, mkLeaf(t, ca, caKey, cn, false), addr)
+}
+
+// startDialOutAgentWith is startDialOutAgent with a certificate the test holds.
+func startDialOutAgentWith(t *testing.T, ca *x509.Certificate, cert tls.Certificate, addr string) context.CancelFunc {
+	t.Helper()
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	tlsCfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ServerName:   "localhost",
+		MinVersion:   tls.VersionTLS13,
+	}
+	srv := NewServer(ServerConfig{}, tagInvoker{})
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() {
+		_ = srv.DialOut(ctx, DialOutConfig{
+			Endpoint: addr, TLS: tlsCfg,
+			ReconnectMin: 10 * time.Millisecond, ReconnectMax: 50 * time.Millisecond,
+		})
+	}()
+	return cancel
+}
+
+// waitAttached waits for name to be attached and returns its Client.
+func waitAttached(t *testing.T, a *AttachServer, name string) *Client {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if cli, ok := a.Agent(name); ok {
+			return cli
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("agent %q never attached (attached: %v)", name, a.Agents())
+	return nil
+}
+
+// TestDialOutServesCalls — an agent that dials out is reachable through the
+// relay by the name in its certificate, and a name nobody attached under is
+// ErrNotConnected.
+func TestDialOutServesCalls(t *testing.T) {
+	ca, caKey := mkCA(t)
+	a, addr := startAttachServer(t, ca, caKey)
+	startDialOutAgent(t, ca, caKey, addr, "agent-remote-dev")
+	cli := waitAttached(t, a, "remote-dev")
+
+	if _, err := callWhenReady(t, cli, "remote-dev", "qubesair.Ping", nil); err != nil {
+		t.Fatalf("tunnel: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	out, err := a.Call(ctx, "remote-dev", "qubesair.Exec", []byte("uname"))
+	if err != nil || string(out) != "handled[remote-dev/qubesair.Exec]:uname" {
+		t.Fatalf("call via the relay = %q, %v", out, err)
+	}
+	if _, err := a.Call(ctx, "remote-other", "qubesair.Ping", nil); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("call to an agent that is not attached = %v, want ErrNotConnected", err)
+	}
+	if got := a.Agents(); !slices.Equal(got, []string{"remote-dev"}) {
+		t.Errorf("Agents() = %v", got)
+	}
+}
+
+// TestAttachServeLeavesCallerTLSAlone — Serve requires client certificates and
+// installs the registry check on its own copy, not on the config it was given,
+// which the caller may be serving something else with.
+func TestAttachServeLeavesCallerTLSAlone(t *testing.T) {
+	ca, caKey := mkCA(t)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lis.Addr().String()
+	_ = lis.Close()
+	shared := mkServerTLS(t, ca, caKey)
+	shared.ClientAuth = tls.NoClientCert
+
+	a := NewAttachServer(AttachConfig{
+		Listen: addr, TLS: shared, RelayName: "sys-relay",
+		CertRegistry: &fakeRegistry{revoked: map[string]bool{}},
+	}, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() { _ = a.Serve(ctx) }()
+	waitDial(t, addr)
+	startDialOutAgent(t, ca, caKey, addr, "agent-remote-dev")
+	waitAttached(t, a, "remote-dev")
+
+	if shared.ClientAuth != tls.NoClientCert || shared.VerifyConnection != nil {
+		t.Errorf("Serve changed the caller's TLS config: ClientAuth %v, VerifyConnection set %v",
+			shared.ClientAuth, shared.VerifyConnection != nil)
+	}
+}
+
+// TestAttachRefusesNonAgentCertificates — a certificate from the right CA but
+// for another role (a relay's) names no agent, so it is not attached.
+func TestAttachRefusesNonAgentCertificates(t *testing.T) {
+	ca, caKey := mkCA(t)
+	a, addr := startAttachServer(t, ca, caKey)
+	startDialOutAgent(t, ca, caKey, addr, "sys-relay")
+
+	time.Sleep(300 * time.Millisecond)
+	if got := a.Agents(); len(got) != 0 {
+		t.Fatalf("a relay certificate was attached as %v", got)
+	}
+}
+
+// TestReattachReplacesTunnel — an agent that dials again under the same
+// identity takes over its name, and calls go to the new tunnel.
+func TestReattachReplacesTunnel(t *testing.T) {
+	ca, caKey := mkCA(t)
+	a, addr := startAttachServer(t, ca, caKey)
+	stopFirst := startDialOutAgent(t, ca, caKey, addr, "agent-remote-dev")
+	first := waitAttached(t, a, "remote-dev")
+
+	startDialOutAgent(t, ca, caKey, addr, "agent-remote-dev")
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if cli, ok := a.Agent("remote-dev"); ok && cli != first {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the second connection never replaced the first")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The first agent is still running and would reattach on its own; stop it
+	// so the name stays with the second.
+	stopFirst()
+
+	cli := waitAttached(t, a, "remote-dev")
+	if _, err := callWhenReady(t, cli, "remote-dev", "qubesair.Ping", nil); err != nil {
+		t.Fatalf("call after reattach: %v", err)
+	}
+	if got := a.Agents(); len(got) != 1 {
+		t.Errorf("Agents() = %v, want one entry per identity", got)
+	}
+}
+
+// TestRevokedAgentIsDetached — revoking an attached agent's certificate ends
+// its tunnel, not just the context around it: the agent leaves the routing
+// table, its Client loses its peer, and the agent is refused when it dials
+// again.
+func TestRevokedAgentIsDetached(t *testing.T) {
+	ca, caKey := mkCA(t)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lis.Addr().String()
+	_ = lis.Close()
+
+	reg := &fakeRegistry{revoked: map[string]bool{}}
+	a := NewAttachServer(AttachConfig{
+		Listen: addr, TLS: mkServerTLS(t, ca, caKey), RelayName: "sys-relay",
+		CertRegistry: reg, ReauthorizeInterval: 20 * time.Millisecond,
+	}, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() { _ = a.Serve(ctx) }()
+	waitDial(t, addr)
+
+	cert := mkLeaf(t, ca, caKey, "agent-remote-dev", false)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	startDialOutAgentWith(t, ca, cert, addr)
+	cli := waitAttached(t, a, "remote-dev")
+	if _, err := callWhenReady(t, cli, "remote-dev", "qubesair.Ping", nil); err != nil {
+		t.Fatalf("call before revocation: %v", err)
+	}
+
+	reg.revoke(repository.Fingerprint(leaf))
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, attached := a.Agent("remote-dev")
+		_, live := cli.Peer()
+		if !attached && !live {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("revoked agent still attached (%v) or its tunnel still live (%v)", attached, live)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The agent keeps dialing; every attempt must be refused.
+	time.Sleep(300 * time.Millisecond)
+	if got := a.Agents(); len(got) != 0 {
+		t.Fatalf("revoked agent reattached as %v", got)
+	}
+}
+
+// silentStream is an Attach stream whose relay has gone quiet: sends succeed,
+// nothing ever arrives.
+type silentStream struct {
+	ctx context.Context
+}
+
+func (s silentStream) Send(*pb.Frame) error     { return nil }
+func (s silentStream) Context() context.Context { return s.ctx }
+func (s silentStream) Recv() (*pb.Frame, error) { <-s.ctx.Done(); return nil, io.EOF }
+
+// TestDialOutDetectsDeadLink — a link that accepts writes and delivers nothing
+// (an expired NAT mapping) is ended after a few silent keepalive intervals, so
+// the agent redials instead of waiting forever.
+func TestDialOutDetectsDeadLink(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d := &dialOutStream{frameStream: silentStream{ctx: ctx}}
+	d.touch()
+
+	done := make(chan struct{})
+	go func() {
+		d.keepAlive(ctx, cancel, 10*time.Millisecond)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("a silent link was never declared dead")
+	}
+	if ctx.Err() == nil {
+		t.Error("the dead link's stream was not canceled")
+	}
+}
+
+// TestDialOutRefusesUnverifiedRelay — skipping the TLS stack's verification
+// without doing it ourselves would run whatever an impostor relay sends.
+func TestDialOutRefusesUnverifiedRelay(t *testing.T) {
+	if _, _, err := dialOutTLS(DialOutConfig{TLS: &tls.Config{InsecureSkipVerify: true}}); err == nil { //nolint:gosec // the point of the test
+		t.Fatal("a config that verifies nothing was accepted")
+	}
+	cfg := &tls.Config{InsecureSkipVerify: true, VerifyConnection: func(tls.ConnectionState) error { return nil }} //nolint:gosec // verified by the callback
+	if _, _, err := dialOutTLS(DialOutConfig{TLS: cfg}); err != nil {
+		t.Fatalf("a config with its own verification was refused: %v", err)
+	}
+}
@@ -0,0 +1,173 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// blockingInvoker runs until its context ends, reporting when it started and
+// how it was stopped.
+type blockingInvoker struct {
+	started chan time.Time // the deadline it was given (zero if none)
+	stopped chan error
+}
+
+func newBlockingInvoker() *blockingInvoker {
+	return &blockingInvoker{
+		started: make(chan time.Time, 1),
+		stopped: make(chan error, 1),
+	}
+}
+
+func (b *blockingInvoker) Invoke(ctx context.Context, _, _ string, _ []byte) ([]byte, error) {
+	dl, _ := ctx.Deadline()
+	b.started <- dl
+	<-ctx.Done()
+	b.stopped <- ctx.Err()
+	return nil, ctx.Err()
+}
+
+// cancelTunnel starts a server over inv with an optional forward policy and
+// returns a connected client.
+func cancelTunnel(t *testing.T, inv QrexecInvoker, forwards *ForwardPolicy) *Client {
+	t.Helper()
+	ca, caKey := mkCA(t)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lis.Addr().String()
+	_ = lis.Close()
+
+	srv := NewServer(ServerConfig{Listen: addr, TLS: mkServerTLS(t, ca, caKey), Forwards: forwards}, inv)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() { _ = srv.Serve(ctx) }()
+	waitDial(t, addr)
+
+	cli := NewClient(ClientConfig{
+		RemoteEndpoint: addr, RelayName: "sys-relay", RemoteName: "remote-dev",
+		TLS: mkClientTLS(t, ca, caKey),
+	}, nil)
+	go func() { _ = cli.Start(ctx) }()
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		if _, up := cli.Peer(); up {
+			return cli
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("tunnel never came up")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// TestCancelReachesRemoteInvocation — a caller that gives up must stop the
+// remote work, not leave it running to the agent's own timeout.
+func TestCancelReachesRemoteInvocation(t *testing.T) {
+	inv := newBlockingInvoker()
+	cli := cancelTunnel(t, inv, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := cli.Call(ctx, "remote-dev", "qubesair.Slow", nil)
+		done <- err
+	}()
+	select {
+	case <-inv.started:
+	case <-time.After(3 * time.Second):
+		t.Fatal("remote invocation never started")
+	}
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("Call returned %v, want context.Canceled", err)
+	}
+	select {
+	case err := <-inv.stopped:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("remote invocation ended with %v, want canceled", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("cancellation never reached the remote invocation")
+	}
+}
+
+// TestCallDeadlineReachesRemote — the caller's deadline bounds the remote
+// invocation too (plus skew grace), as a backstop for a lost Cancel frame; and
+// when the caller's deadline passes, the Cancel still stops it first.
+func TestCallDeadlineReachesRemote(t *testing.T) {
+	inv := newBlockingInvoker()
+	cli := cancelTunnel(t, inv, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	callDeadline, _ := ctx.Deadline()
+	_, err := cli.Call(ctx, "remote-dev", "qubesair.Slow", nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Call returned %v, want DeadlineExceeded", err)
+	}
+
+	remoteDeadline := <-inv.started
+	if remoteDeadline.IsZero() {
+		t.Fatal("the caller's deadline never reached the remote invocation")
+	}
+	if d := remoteDeadline.Sub(callDeadline); d < deadlineSkewGrace-50*time.Millisecond || d > deadlineSkewGrace+50*time.Millisecond {
+		t.Errorf("remote deadline is %s past the caller's, want the %s skew grace", d, deadlineSkewGrace)
+	}
+	select {
+	case err := <-inv.stopped:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("remote invocation ended with %v; the Cancel frame should beat the backstop", err)
+		}
+	case <-time.After(deadlineSkewGrace):
+		t.Fatal("remote invocation outlived its caller")
+	}
+}
+
+// TestCancelClosesStream — canceling a stream closes the agent's socket, so the
+// service behind it sees its client leave instead of an idle connection that
+// never ends.
+func TestCancelClosesStream(t *testing.T) {
+	svcLis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svcLis.Close()
+	closed := make(chan struct{})
+	go func() {
+		c, err := svcLis.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(io.Discard, c)
+		close(closed)
+	}()
+
+	cli := cancelTunnel(t, tagInvoker{}, &ForwardPolicy{Forwards: []Forward{
+		{Name: "svc", Port: svcLis.Addr().(*net.TCPAddr).Port},
+	}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stdinR, stdinW := io.Pipe() // never closed: only a Cancel can end this stream
+	defer stdinW.Close()
+	done := make(chan error, 1)
+	go func() { done <- cli.CallStream(ctx, "remote-dev", streamServicePrefix+"svc", stdinR, io.Discard) }()
+	if _, err := stdinW.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("CallStream returned %v, want context.Canceled", err)
+	}
+	select {
+	case <-closed:
+	case <-time.After(3 * time.Second):
+		t.Fatal("the agent never closed the stream's socket after Cancel")
+	}
+}
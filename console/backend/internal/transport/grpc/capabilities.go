@@ -0,0 +1,128 @@
+// capabilities.go — what each side of a tunnel says it can do.
+//
+// protocol_version alone forces lockstep: every feature either exists on both
+// sides or the version is bumped and the older side is refused. Capabilities
+// break that up. Each side lists what it handles in its Handshake, and a
+// feature is used only when the peer listed it — so a relay can start sending
+// Cancel frames, or compressing, the day it is upgraded, and every agent that
+// has not been upgraded yet simply never sees them.
+//
+// A v1 peer sends no capabilities at all, which reads as "none of the optional
+// features". That is exactly right: every v1 build predates them.
+
+package grpc
+
+import (
+	"slices"
+	"sort"
+
+	pb "github.com/slchris/qubes-air/console/internal/transport/relaypb"
+)
+
+// defaultMaxFrameSize is the largest DataChunk payload this build asks a peer
+// to send, and the size it chunks to when the peer did not say. Well under
+// gRPC's 4 MiB default message limit, which a single whole-body frame — a 16
+// MiB service response — used to exceed.
+const defaultMaxFrameSize = 1 << 20
+
+// Frame kind names as listed in Capabilities.frame_kinds.
+const (
+	frameKindWindowUpdate = "window_update"
+	frameKindCancel       = "cancel"
+)
+
+// localFrameKinds is every Frame.kind this build understands.
+var localFrameKinds = []string{
+	"handshake", "request_header", "data", "eos", "error", "keep_alive",
+	frameKindWindowUpdate, frameKindCancel,
+}
+
+// Capabilities is a peer's declared capabilities, as the rest of the console
+// sees them. It mirrors the proto message with JSON names so it can be stored
+// and served as it is.
+type Capabilities struct {
+	FrameKinds        []string `json:"frame_kinds,omitempty"`
+	FlowControl       bool     `json:"flow_control"`
+	Compression       []string `json:"compression,omitempty"`
+	Cancel            bool     `json:"cancel"`
+	StructuredResults bool     `json:"structured_results"`
+	MaxFrameSize      int      `json:"max_frame_size,omitempty"`
+	Services          []string `json:"services,omitempty"`
+}
+
+// HasFrameKind reports whether the peer understands a frame kind.
+func (c Capabilities) HasFrameKind(kind string) bool { return slices.Contains(c.FrameKinds, kind) }
+
+// frameSize is the largest payload to put in one DataChunk for this peer.
+func (c Capabilities) frameSize() int {
+	if c.MaxFrameSize > 0 && c.MaxFrameSize < defaultMaxFrameSize {
+		return c.MaxFrameSize
+	}
+	return defaultMaxFrameSize
+}
+
+// PeerInfo is what the other side of a tunnel said about itself in its
+// Handshake.
+type PeerInfo struct {
+	// Name is the peer's relay_name: on a client, the name the agent answered
+	// with; on a server, the relay that connected.
+	Name string `json:"name,omitempty"`
+	// ProtocolVersion is the wire version the tunnel runs at, which can be
+	// lower than this build's own when the peer is older.
+	ProtocolVersion string `json:"protocol_version"`
+	// BuildVersion never decides compatibility, as in the Handshake.
+	BuildVersion string       `json:"build_version,omitempty"`
+	Capabilities Capabilities `json:"capabilities"`
+}
+
+// peerInfoFrom reads a received Handshake.
+func peerInfoFrom(hs *pb.Handshake) PeerInfo {
+	info := PeerInfo{
+		Name:            hs.GetRelayName(),
+		ProtocolVersion: hs.GetProtocolVersion(),
+		BuildVersion:    hs.GetBuildVersion(),
+	}
+	if c := hs.GetCapabilities(); c != nil {
+		info.Capabilities = Capabilities{
+			FrameKinds:        c.GetFrameKinds(),
+			FlowControl:       c.GetFlowControl(),
+			Compression:       c.GetCompression(),
+			Cancel:            c.GetCancel(),
+			StructuredResults: c.GetStructuredResults(),
+			MaxFrameSize:      int(c.GetMaxFrameSize()),
+			Services:          c.GetServices(),
+		}
+	}
+	return info
+}
+
+// localCapabilities is what this build declares. window is the stream window
+// it advertises (zero: flow control declined); services is what an executor
+// exposes, nil on a relay.
+func localCapabilities(window uint32, services []string) *pb.Capabilities {
+	return &pb.Capabilities{
+		FrameKinds:   localFrameKinds,
+		FlowControl:  window != 0,
+		Cancel:       true,
+		MaxFrameSize: defaultMaxFrameSize,
+		Services:     services,
+	}
+}
+
+// ServiceLister is implemented by an invoker that can say which services it
+// exposes (agent.LocalInvoker does). The server includes the list in its
+// capabilities; an invoker without it advertises none.
+type ServiceLister interface {
+	Services() []string
+}
+
+// invokerServices returns the invoker's services, sorted, or nil.
+func invokerServices(inv QrexecInvoker) []string {
+	lister, ok := inv.(ServiceLister)
+	if !ok {
+		return nil
+	}
+	out := slices.Clone(lister.Services())
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,338 @@
+package grpc
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "github.com/slchris/qubes-air/console/internal/transport/relaypb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// listingInvoker is a tagInvoker that also declares its services.
+type listingInvoker struct{ tagInvoker }
+
+func (listingInvoker) Services() []string { return []string{"qubesair.Ping", "qubesair.Exec"} }
+
+// TestHandshakeExchangesCapabilities — after connecting, the client knows what
+// the agent declared: its version, what it handles, and what it exposes.
+func TestHandshakeExchangesCapabilities(t *testing.T) {
+	cli := cancelTunnel(t, listingInvoker{}, nil)
+	peer, ok := cli.Peer()
+	if !ok {
+		t.Fatal("Peer reported no tunnel")
+	}
+	if peer.ProtocolVersion != protocolVersion {
+		t.Errorf("protocol = %q, want %q", peer.ProtocolVersion, protocolVersion)
+	}
+	c := peer.Capabilities
+	if !c.Cancel || !c.FlowControl || !c.HasFrameKind(frameKindCancel) || !c.HasFrameKind(frameKindWindowUpdate) {
+		t.Errorf("capabilities missing features this build has: %+v", c)
+	}
+	if c.MaxFrameSize != defaultMaxFrameSize {
+		t.Errorf("max frame size = %d", c.MaxFrameSize)
+	}
+	if !slices.Equal(c.Services, []string{"qubesair.Exec", "qubesair.Ping"}) {
+		t.Errorf("services = %v, want the invoker's, sorted", c.Services)
+	}
+}
+
+// legacyServer speaks protocol v1 the way every agent before capabilities did:
+// it refuses any other version, acks with no capabilities, answers calls, and
+// records every frame kind it receives.
+type legacyServer struct {
+	pb.UnimplementedRelayTransportServer
+	mu   sync.Mutex
+	seen []string
+}
+
+func (l *legacyServer) saw(kind string) {
+	l.mu.Lock()
+	l.seen = append(l.seen, kind)
+	l.mu.Unlock()
+}
+
+func (l *legacyServer) Tunnel(stream grpc.BidiStreamingServer[pb.Frame, pb.Frame]) error {
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	if v := first.GetHandshake().GetProtocolVersion(); v != "v1" {
+		_ = stream.Send(errorFrame("", CodeProtocolMismatch, protocolMismatchMessage(v)))
+		return nil
+	}
+	if err := stream.Send(&pb.Frame{Kind: &pb.Frame_Handshake{Handshake: &pb.Handshake{ProtocolVersion: "v1"}}}); err != nil {
+		return err
+	}
+	for {
+		f, err := stream.Recv()
+		if err != nil {
+			return nil
+		}
+		switch k := f.GetKind().(type) {
+		case *pb.Frame_Cancel:
+			l.saw("cancel")
+		case *pb.Frame_Eos:
+			if k.Eos.GetStreamId() == streamRequest {
+				// Answer everything except a service that is meant to hang.
+				l.mu.Lock()
+				hang := slices.Contains(l.seen, "header:qubesair.Hang")
+				l.mu.Unlock()
+				if !hang {
+					_ = stream.Send(dataFrame(f.GetRequestId(), streamResponse, []byte("legacy")))
+					_ = stream.Send(eosFrame(f.GetRequestId(), streamResponse))
+				}
+			}
+		case *pb.Frame_RequestHeader:
+			l.saw("header:" + k.RequestHeader.GetQrexecService())
+		}
+	}
+}
+
+// TestClientFallsBackToV1 — a relay upgraded before its agents must still reach
+// them: refused as v2, it offers v1, and then uses none of the features the
+// agent never declared.
+func TestClientFallsBackToV1(t *testing.T) {
+	ca, caKey := mkCA(t)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := &legacyServer{}
+	gs := grpc.NewServer(grpc.Creds(credentials.NewTLS(mkServerTLS(t, ca, caKey))))
+	pb.RegisterRelayTransportServer(gs, legacy)
+	go func() { _ = gs.Serve(lis) }()
+	t.Cleanup(gs.Stop)
+
+	cli := NewClient(ClientConfig{
+		RemoteEndpoint: lis.Addr().String(), RelayName: "sys-relay", RemoteName: "remote-dev",
+		TLS: mkClientTLS(t, ca, caKey), ReconnectMin: 10 * time.Millisecond, ReconnectMax: 50 * time.Millisecond,
+	}, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() { _ = cli.Start(ctx) }()
+
+	out, err := callWhenReady(t, cli, "remote-dev", "qubesair.Ping", nil)
+	if err != nil || string(out) != "legacy" {
+		t.Fatalf("call to a v1 agent = %q, %v", out, err)
+	}
+	peer, _ := cli.Peer()
+	if peer.ProtocolVersion != "v1" || peer.Capabilities.Cancel {
+		t.Fatalf("peer = %+v, want v1 with no capabilities", peer)
+	}
+
+	// A canceled call must not send a Cancel frame the agent never declared.
+	callCtx, callCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer callCancel()
+	if _, err := cli.Call(callCtx, "remote-dev", "qubesair.Hang", nil); err == nil {
+		t.Fatal("the hanging call returned")
+	}
+	time.Sleep(100 * time.Millisecond)
+	legacy.mu.Lock()
+	defer legacy.mu.Unlock()
+	if slices.Contains(legacy.seen, "cancel") {
+		t.Error("client sent Cancel to an agent that never declared it")
+	}
+}
+
+// upgradingServer is an agent that speaks only v1 until it is upgraded, and
+// holds each tunnel until kicked.
+type upgradingServer struct {
+	pb.UnimplementedRelayTransportServer
+	upgraded atomic.Bool
+	refused  atomic.Int32 // handshakes refused for their version
+	kick     chan struct{}
+}
+
+func (u *upgradingServer) Tunnel(stream grpc.BidiStreamingServer[pb.Frame, pb.Frame]) error {
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	v := first.GetHandshake().GetProtocolVersion()
+	if v != "v1" && !(v == protocolVersion && u.upgraded.Load()) {
+		u.refused.Add(1)
+		_ = stream.Send(errorFrame("", CodeProtocolMismatch, protocolMismatchMessage(v)))
+		return nil
+	}
+	if err := stream.Send(&pb.Frame{Kind: &pb.Frame_Handshake{Handshake: &pb.Handshake{ProtocolVersion: v}}}); err != nil {
+		return err
+	}
+	select {
+	case <-u.kick:
+	case <-stream.Context().Done():
+	}
+	return nil
+}
+
+// TestClientOffersCurrentVersionAgainAfterFallingBack — one refusal must not
+// pin a client to v1: once the agent is upgraded, the next connection speaks
+// the current version.
+func TestClientOffersCurrentVersionAgainAfterFallingBack(t *testing.T) {
+	ca, caKey := mkCA(t)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent := &upgradingServer{kick: make(chan struct{})}
+	gs := grpc.NewServer(grpc.Creds(credentials.NewTLS(mkServerTLS(t, ca, caKey))))
+	pb.RegisterRelayTransportServer(gs, agent)
+	go func() { _ = gs.Serve(lis) }()
+	t.Cleanup(gs.Stop)
+
+	cli := NewClient(ClientConfig{
+		RemoteEndpoint: lis.Addr().String(), RelayName: "sys-relay", RemoteName: "remote-dev",
+		TLS: mkClientTLS(t, ca, caKey), ReconnectMin: 10 * time.Millisecond, ReconnectMax: 50 * time.Millisecond,
+	}, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() { _ = cli.Start(ctx) }()
+
+	waitPeer := func(want string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			if peer, ok := cli.Peer(); ok && peer.ProtocolVersion == want {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		peer, _ := cli.Peer()
+		t.Fatalf("peer protocol = %q, want %q", peer.ProtocolVersion, want)
+	}
+	waitPeer("v1")
+
+	// The endpoint is offered v1 until protocolReprobeInterval has passed.
+	ep := cli.endpoints[0]
+	ep.mu.Lock()
+	ep.offerSince = ep.offerSince.Add(-protocolReprobeInterval)
+	ep.mu.Unlock()
+	agent.upgraded.Store(true)
+	agent.kick <- struct{}{}
+	waitPeer(protocolVersion)
+}
+
+// TestFallbackIsRememberedPerEndpoint — once an endpoint has refused the
+// current version, every tunnel of the pool reconnects to it at v1 directly
+// instead of paying for a refused handshake first.
+func TestFallbackIsRememberedPerEndpoint(t *testing.T) {
+	ca, caKey := mkCA(t)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent := &upgradingServer{kick: make(chan struct{})}
+	gs := grpc.NewServer(grpc.Creds(credentials.NewTLS(mkServerTLS(t, ca, caKey))))
+	pb.RegisterRelayTransportServer(gs, agent)
+	go func() { _ = gs.Serve(lis) }()
+	t.Cleanup(gs.Stop)
+
+	cli := NewClient(ClientConfig{
+		RemoteEndpoint: lis.Addr().String(), RelayName: "sys-relay", RemoteName: "remote-dev", Tunnels: 3,
+		TLS: mkClientTLS(t, ca, caKey), ReconnectMin: 10 * time.Millisecond, ReconnectMax: 50 * time.Millisecond,
+	}, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() { _ = cli.Start(ctx) }()
+
+	// waitTunnels waits for all three tunnels to be up, reconnects of them
+	// having come back.
+	waitTunnels := func(reconnects int) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			st := cli.Status()
+			if st.Tunnels == 3 && st.Endpoints[0].Reconnects >= reconnects {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%d of 3 tunnels up, %d reconnects", st.Tunnels, st.Endpoints[0].Reconnects)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitTunnels(0)
+	before := agent.refused.Load()
+	if before == 0 {
+		t.Fatal("the agent refused nothing; the test proves nothing")
+	}
+	for i := 0; i < 3; i++ {
+		agent.kick <- struct{}{}
+	}
+	waitTunnels(3)
+	if after := agent.refused.Load(); after != before {
+		t.Errorf("reconnects to a v1 agent were refused %d more times", after-before)
+	}
+}
+
+// TestServerServesV1Relay — an agent upgraded first must keep serving relays
+// that still speak v1, and tell them v1 in its ack.
+func TestServerServesV1Relay(t *testing.T) {
+	ca, caKey := mkCA(t)
+	addr := startTestServer(t, mkServerTLS(t, ca, caKey))
+
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(credentials.NewTLS(mkClientTLS(t, ca, caKey))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := pb.NewRelayTransportClient(conn).Tunnel(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Send(&pb.Frame{Kind: &pb.Frame_Handshake{Handshake: &pb.Handshake{ProtocolVersion: "v1", RelayName: "old-relay"}}}); err != nil {
+		t.Fatal(err)
+	}
+	ack, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := ack.GetHandshake().GetProtocolVersion(); v != "v1" {
+		t.Fatalf("ack to a v1 relay says %q", v)
+	}
+	for _, f := range []*pb.Frame{
+		requestHeaderFrame("r1", pb.Direction_LOCAL_TO_REMOTE, "qubesair.Ping", "old-relay", "remote-dev", 0),
+		eosFrame("r1", streamRequest),
+	} {
+		if err := stream.Send(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	resp, err := stream.Recv()
+	if err != nil || !bytes.HasPrefix(resp.GetData().GetPayload(), []byte("handled[")) {
+		t.Fatalf("v1 relay's call = %v, %v", resp, err)
+	}
+}
+
+// TestLargeBodiesAreChunked — a body past gRPC's 4 MiB message limit used to
+// go out as one frame and kill the tunnel. Both directions now split it.
+func TestLargeBodiesAreChunked(t *testing.T) {
+	ca, caKey := mkCA(t)
+	addr := startTestServer(t, mkServerTLS(t, ca, caKey))
+	cli := NewClient(ClientConfig{RemoteEndpoint: addr, RelayName: "sys-relay", RemoteName: "remote-dev", TLS: mkClientTLS(t, ca, caKey)}, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() { _ = cli.Start(ctx) }()
+	if _, err := callWhenReady(t, cli, "remote-dev", "qubesair.Ping", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	body := bytes.Repeat([]byte("x"), 6<<20)
+	callCtx, c := context.WithTimeout(ctx, 10*time.Second)
+	defer c()
+	out, err := cli.Call(callCtx, "remote-dev", "qubesair.Echo", body)
+	if err != nil {
+		t.Fatalf("6 MiB call: %v", err)
+	}
+	if want := len("handled[remote-dev/qubesair.Echo]:") + len(body); len(out) != want {
+		t.Fatalf("response is %d bytes, want %d", len(out), want)
+	}
+}
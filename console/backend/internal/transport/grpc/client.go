@@ -1,12 +1,14 @@
 // client.go — LOCAL sys-relay side. Dials OUTBOUND to the remote Remote-Relay,
-// keeps one long-lived bidi Tunnel, multiplexes qrexec calls by request_id,
+// keeps long-lived bidi Tunnels (one by default; see pool.go for several, and
+// for failing over between endpoints), multiplexes qrexec calls by request_id,
 // reconnects on drop. Implements transport.Transport.
 //
 // SECURITY: the transport only moves frames; authorization always lives in the
 // two dom0s. A forward Call has already passed local dom0 policy A/B before it
 // reaches here. A reverse (REMOTE_TO_LOCAL) request is routed to c.reverse,
-// which hands it to the local dom0 (policy C: ask) — this file never decides
-// authorization, it only carries frames.
+// which hands it to the local dom0 (policy C: ask) — this file never grants
+// authorization. It can only narrow it: the optional ReversePolicy refuses
+// calls before dom0 is asked (see reversepolicy.go).
 
 package grpc
 
@@ -18,10 +20,13 @@ import (
 	"io"
 	"math/rand"
 	"net"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/slchris/qubes-air/console/internal/qrexec"
 	"github.com/slchris/qubes-air/console/internal/transport"
 	pb "github.com/slchris/qubes-air/console/internal/transport/relaypb"
 	"google.golang.org/grpc"
@@ -30,13 +35,20 @@ import (
 
 // ClientConfig configures the outbound relay client.
 type ClientConfig struct {
-	RemoteEndpoint string        // host:port of the remote Remote-Relay
-	RelayName      string        // local relay identity (sys-relay-<zone>)
-	RemoteName     string        // target remote_name (RemoteVM attr)
-	KeepAlive      time.Duration // heartbeat interval
-	ReconnectMin   time.Duration // backoff floor
-	ReconnectMax   time.Duration // backoff ceiling
-	TLS            *tls.Config   // mTLS: client cert (from vault), CA, server verify
+	RemoteEndpoint string // host:port of the remote Remote-Relay
+	// Endpoints, when set, replaces RemoteEndpoint with several endpoints for
+	// the same remote, tried in priority order (see pool.go). RemoteEndpoint
+	// alone is the one-entry list.
+	Endpoints []Endpoint
+	// Tunnels is how many tunnels to keep open at once; calls are spread
+	// across them. Zero or one keeps a single tunnel.
+	Tunnels      int
+	RelayName    string        // local relay identity (sys-relay-<zone>)
+	RemoteName   string        // target remote_name (RemoteVM attr)
+	KeepAlive    time.Duration // heartbeat interval
+	ReconnectMin time.Duration // backoff floor
+	ReconnectMax time.Duration // backoff ceiling
+	TLS          *tls.Config   // mTLS: client cert (from vault), CA, server verify
 	// TLSProvider, if set, is called on EACH (re)connect to obtain the current
 	// mTLS config. This is how certificate ROTATION takes effect without a
 	// restart: after vault rotates the relay cert, the next reconnect fetches the
@@ -52,6 +64,17 @@ type ClientConfig struct {
 	// Nil keeps gRPC's own dialing, byte for byte: the option below is only
 	// applied when this is set, so the routed path is untouched by the seam.
 	Dialer func(ctx context.Context, addr string) (net.Conn, error)
+	// StreamWindow is the receive window, in bytes, advertised for each
+	// streaming call (see flow.go). Zero uses defaultStreamWindow; negative
+	// declines flow control, which is only useful to exercise the legacy path.
+	StreamWindow int
+	// CompressThreshold is the smallest DataChunk payload compressed when the
+	// server accepts it (see compress.go). Zero uses defaultCompressThreshold;
+	// negative turns compression off in both directions.
+	CompressThreshold int
+	// ReversePolicy, when set, gates every reverse call from RemoteName before
+	// it reaches the reverse handler, and records each (see reversepolicy.go).
+	ReversePolicy *ReversePolicy
 }
 
 // withDefaults returns a copy of cfg with sane defaults filled in.
@@ -65,35 +88,83 @@ func (cfg ClientConfig) withDefaults() ClientConfig {
 	if cfg.ReconnectMax <= 0 {
 		cfg.ReconnectMax = 30 * time.Second
 	}
+	if len(cfg.Endpoints) == 0 && cfg.RemoteEndpoint != "" {
+		cfg.Endpoints = []Endpoint{{Address: cfg.RemoteEndpoint}}
+	}
+	if cfg.Tunnels < 1 {
+		cfg.Tunnels = 1
+	}
 	return cfg
 }
 
-// Client is the local relay's outbound gRPC transport. It maintains one Tunnel
-// and satisfies transport.Transport.
+// Client is the local relay's outbound gRPC transport. It maintains its
+// Tunnels and satisfies transport.Transport.
 type Client struct {
 	cfg     ClientConfig
 	reverse transport.ReverseHandler // handles REMOTE_TO_LOCAL frames → local dom0 (policy C: ask)
 
-	mu       sync.Mutex
-	inflight map[string]*pendingCall        // request_id → waiter (forward calls we originated)
-	streams  map[string]*pendingStream      // request_id → live stream (CallStream, e.g. GUI)
-	stream   pb.RelayTransport_TunnelClient // the live bidi stream (nil when disconnected)
-	sendMu   sync.Mutex                     // serializes Send: gRPC streams forbid concurrent Send
+	mu        sync.Mutex
+	inflight  map[string]*pendingCall   // request_id → waiter (forward calls we originated)
+	streams   map[string]*pendingStream // request_id → live stream (CallStream, e.g. GUI)
+	tunnels   []*tunnel                 // live tunnels, oldest first; empty when disconnected
+	endpoints []*endpointState          // configured endpoints, most preferred first
+	next      int                       // round-robin cursor over tunnels
+
+	compression compressionCounters // across every tunnel this client has had
+
+	// Reverse calls, for Status.
+	reverseReceived, reverseFailed          atomic.Uint64
+	reverseRefusedLocal, reverseRefusedDom0 atomic.Uint64
+}
+
+// tunnel is one live bidi stream and what was negotiated on it. Everything but
+// sendMu and the keepalive timing is fixed once the tunnel is published.
+type tunnel struct {
+	stream   frameStream
+	endpoint *endpointState
+	windows  streamWindows // negotiated stream windows; zero = no flow control
+	peer     PeerInfo      // what the server said about itself
+	enc      *chunkEncoder // compresses outgoing chunks; nil = plain
+	since    time.Time     // when the handshake completed
+	sendMu   sync.Mutex    // serializes Send: gRPC streams forbid concurrent Send
+
+	// The last keepalive sent, so its echo can be timed. Only our own echo
+	// counts: an attached agent sends keepalives of its own, stamped with its
+	// clock, and timing one of those would measure clock skew.
+	pingMs atomic.Int64
+	pingAt atomic.Int64 // unix nanos
+}
+
+// send serializes writes to the tunnel's stream.
+func (t *tunnel) send(frame *pb.Frame) error {
+	t.enc.encode(frame)
+	t.sendMu.Lock()
+	defer t.sendMu.Unlock()
+	return t.stream.Send(frame)
 }
 
 // pendingCall accumulates a forward call's response until EOS/error.
 type pendingCall struct {
+	t    *tunnel // the tunnel the call went out on
 	buf  []byte
 	done chan callResult
 }
 
 // pendingStream carries a streaming (unbuffered) forward call's response chunks
-// as they arrive, rather than accumulating them. recv is closed on EOS or error;
-// err (set before the close) distinguishes a clean end from a failure. Used by
-// CallStream to proxy a raw TCP stream (GUI/VNC) over the Tunnel.
+// as they arrive, rather than accumulating them. queue is closed on EOS or error
+// with the cause; win is the credit for request chunks sent to the peer (nil
+// without flow control). Used by CallStream to proxy a raw TCP stream (GUI/VNC)
+// over the Tunnel.
 type pendingStream struct {
-	recv chan []byte
-	err  error
+	t     *tunnel
+	queue *chunkQueue
+	win   *sendWindow
+}
+
+// end closes both directions of a stream; err is what CallStream returns.
+func (ps *pendingStream) end(err error) {
+	ps.queue.close(err)
+	ps.win.close()
 }
 
 type callResult struct {
@@ -101,55 +172,66 @@ type callResult struct {
 	err error
 }
 
+// RemoteError is a CallError the peer reported for one call. Callers switch on
+// Code (the stable Code* constants); Message is for people.
+type RemoteError struct {
+	Code    string
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("remote: %s: %s", e.Code, e.Message)
+}
+
+// IsRemoteCode reports whether err carries a RemoteError with the given code.
+func IsRemoteCode(err error, code string) bool {
+	var re *RemoteError
+	return errors.As(err, &re) && re.Code == code
+}
+
 // compile-time check: *Client satisfies transport.Transport.
 var _ transport.Transport = (*Client)(nil)
 
 // ErrNotConnected is returned by Call when there is no live tunnel.
 var ErrNotConnected = errors.New("transport/grpc: tunnel not connected")
 
+// handshakeTimeout bounds the wait for the server's Handshake. The tunnel is
+// not published until it arrives — that is when the two sides have agreed on
+// flow control — so a server that never answers must not hold it forever.
+const handshakeTimeout = 10 * time.Second
+
 // NewClient builds the client. reverse routes reverse calls to the local dom0;
 // it must never decide authorization itself.
 func NewClient(cfg ClientConfig, reverse transport.ReverseHandler) *Client {
+	cfg = cfg.withDefaults()
 	return &Client{
-		cfg:      cfg.withDefaults(),
-		reverse:  reverse,
-		inflight: make(map[string]*pendingCall),
-		streams:  make(map[string]*pendingStream),
+		cfg:       cfg,
+		reverse:   reverse,
+		inflight:  make(map[string]*pendingCall),
+		streams:   make(map[string]*pendingStream),
+		endpoints: newEndpointStates(cfg.Endpoints),
 	}
 }
 
-// Start dials outbound and keeps the Tunnel alive (reconnect + keepalive) until
-// ctx is canceled. Blocks; run it in its own goroutine. It returns ctx.Err()
-// when the context is canceled.
+// Start dials outbound and keeps the Tunnels alive (reconnect, failover,
+// keepalive) until ctx is canceled. Blocks; run it in its own goroutine. It
+// returns ctx.Err() when the context is canceled.
 func (c *Client) Start(ctx context.Context) error {
-	backoff := c.cfg.ReconnectMin
-	for {
-		if ctx.Err() != nil {
-			return ctx.Err()
-		}
-
-		err := c.runOnce(ctx)
-		if ctx.Err() != nil {
-			return ctx.Err()
-		}
-		// runOnce returned due to a connection error; back off and redial.
-		_ = err // connection errors are transient; loop and reconnect.
-
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case <-time.After(jitter(backoff)):
-		}
-		backoff *= 2
-		if backoff > c.cfg.ReconnectMax {
-			backoff = c.cfg.ReconnectMax
-		}
-	}
+	if len(c.endpoints) == 0 {
+		return errors.New("transport/grpc: no remote endpoint configured")
+	}
+	var wg sync.WaitGroup
+	for range c.cfg.Tunnels {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.maintain(ctx)
+		}()
+	}
+	wg.Wait()
+	return ctx.Err()
 }
 
-// runOnce dials, opens the Tunnel, sends the handshake, and pumps frames until
-// the connection drops or ctx is canceled. It always tears down inflight calls
-// before returning so no caller is left hanging.
 // resolveTLS returns the mTLS config for a connection attempt: the TLSProvider
 // (fresh, for rotation) if set, else the static TLS. mTLS is mandatory — a nil
 // result is an error rather than an insecure dial.
@@ -170,21 +252,27 @@ func (c *Client) resolveTLS() (*tls.Config, error) {
 	return c.cfg.TLS, nil
 }
 
-func (c *Client) runOnce(ctx context.Context) error {
+// runOnce dials ep, opens the Tunnel, sends the handshake, and pumps frames
+// until the connection drops or ctx is canceled. connected reports whether the
+// tunnel came up at all, which is what tells a failed connect (try the next
+// endpoint) from a dropped tunnel (start over from the most preferred). It
+// always tears down inflight calls before returning so no caller is left
+// hanging.
+func (c *Client) runOnce(ctx context.Context, ep *endpointState) (connected bool, err error) {
 	// Resolve mTLS for THIS connection. With a TLSProvider, each reconnect picks
 	// up the current cert — this is how rotation takes effect without a restart.
 	tlsCfg, err := c.resolveTLS()
 	if err != nil {
-		return fmt.Errorf("resolve mTLS: %w", err)
+		return false, fmt.Errorf("resolve mTLS: %w", err)
 	}
 	creds := credentials.NewTLS(tlsCfg)
 	opts := []grpc.DialOption{grpc.WithTransportCredentials(creds)}
 	if c.cfg.Dialer != nil {
 		opts = append(opts, grpc.WithContextDialer(c.cfg.Dialer))
 	}
-	conn, err := grpc.NewClient(c.cfg.RemoteEndpoint, opts...)
+	conn, err := grpc.NewClient(ep.addr, opts...)
 	if err != nil {
-		return fmt.Errorf("dial %s: %w", c.cfg.RemoteEndpoint, err)
+		return false, fmt.Errorf("dial %s: %w", ep.addr, err)
 	}
 	defer conn.Close()
 
@@ -194,33 +282,109 @@ func (c *Client) runOnce(ctx context.Context) error {
 
 	stream, err := pb.NewRelayTransportClient(conn).Tunnel(streamCtx)
 	if err != nil {
-		return fmt.Errorf("open tunnel: %w", err)
+		return false, fmt.Errorf("open tunnel: %w", err)
 	}
+	return c.runTunnel(streamCtx, ep, stream, cancel)
+}
 
-	// Publish the live stream; clear it (and fail inflight) on the way out.
-	c.setStream(stream)
-	defer c.clearStream(ErrNotConnected)
+// runTunnel drives the relay's half of the protocol over an established
+// stream — handshake, then frames until the stream ends — whichever side
+// dialed. cancel ends stream. It is what runOnce does after dialing out, and
+// what an AttachServer does with a stream an agent dialed in on.
+func (c *Client) runTunnel(ctx context.Context, ep *endpointState, stream frameStream, cancel context.CancelFunc) (connected bool, err error) {
+	// Handshake before publishing the stream: until the server's reply arrives
+	// we do not know whether it does flow control, and a stream started under
+	// the wrong assumption would either stall (waiting for credit the server
+	// never returns) or overrun a window the server enforces. No other
+	// goroutine has the stream yet, so this Send needs no lock.
+	ours := advertisedWindow(c.cfg.StreamWindow)
+	hello := handshakeFrame(c.cfg.RelayName, c.cfg.RemoteName, ours)
+	// An agent that predates this protocol version refuses it outright. Its
+	// endpoint is then offered the oldest one rather than never connecting;
+	// see handshakeDone for how long.
+	offered := ep.offeredVersion(time.Now())
+	hello.GetHandshake().ProtocolVersion = offered
+	hello.GetHandshake().Capabilities.Compression = advertisedCompression(c.cfg.CompressThreshold)
+	if err := stream.Send(hello); err != nil {
+		return false, fmt.Errorf("send handshake: %w", err)
+	}
+	ack, err := awaitHandshake(stream, cancel)
+	ep.handshakeDone(offered, err)
+	if err != nil {
+		return false, err
+	}
 
-	if err := c.send(handshakeFrame(c.cfg.RelayName, c.cfg.RemoteName)); err != nil {
-		return fmt.Errorf("send handshake: %w", err)
+	// Publish the live tunnel; remove it (and fail its inflight calls) on the
+	// way out.
+	peer := peerInfoFrom(ack)
+	t := &tunnel{
+		stream:   stream,
+		endpoint: ep,
+		windows:  negotiateWindows(ours, ack.GetInitialWindow()),
+		peer:     peer,
+		enc:      newChunkEncoder(c.cfg.CompressThreshold, peer.Capabilities, &c.compression),
+		since:    time.Now(),
 	}
+	c.addTunnel(t)
+	defer c.removeTunnel(t, ErrNotConnected)
 
-	// Keepalive ticker runs alongside recvLoop; both stop when streamCtx is done.
-	go c.keepAliveLoop(streamCtx)
+	// Keepalive ticker runs alongside recvLoop; both stop when ctx is done.
+	go c.keepAliveLoop(ctx, t)
 
 	// recvLoop blocks until the stream errors (drop) or ctx cancels.
-	return c.recvLoop(streamCtx, stream)
+	return true, c.recvLoop(ctx, t)
+}
+
+// Peer reports what the server said about itself in the handshake of the
+// oldest live tunnel: protocol and build version, and its capabilities. ok is
+// false when no tunnel is up.
+func (c *Client) Peer() (info PeerInfo, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.tunnels) == 0 {
+		return PeerInfo{}, false
+	}
+	return c.tunnels[0].peer, true
+}
+
+// CompressionStats reports what compression has saved on this client's
+// tunnels since it was built.
+func (c *Client) CompressionStats() CompressionStats {
+	return c.compression.snapshot()
 }
 
-func (c *Client) keepAliveLoop(ctx context.Context) {
-	t := time.NewTicker(c.cfg.KeepAlive)
-	defer t.Stop()
+// awaitHandshake reads the server's reply to our Handshake. A CallError in its
+// place is the server refusing us (a protocol mismatch) and is returned as a
+// RemoteError so it reads as a refusal, not a dropped connection.
+func awaitHandshake(stream frameStream, cancel context.CancelFunc) (*pb.Handshake, error) {
+	timer := time.AfterFunc(handshakeTimeout, cancel)
+	defer timer.Stop()
+	first, err := stream.Recv()
+	if err != nil {
+		return nil, fmt.Errorf("await handshake: %w", err)
+	}
+	if ce := first.GetError(); ce != nil {
+		return nil, &RemoteError{Code: ce.GetCode(), Message: ce.GetMessage()}
+	}
+	hs := first.GetHandshake()
+	if hs == nil {
+		return nil, fmt.Errorf("await handshake: expected Handshake, got %T", first.GetKind())
+	}
+	return hs, nil
+}
+
+func (c *Client) keepAliveLoop(ctx context.Context, t *tunnel) {
+	tick := time.NewTicker(c.cfg.KeepAlive)
+	defer tick.Stop()
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case <-t.C:
-			if err := c.send(keepAliveFrame(time.Now().UnixMilli())); err != nil {
+		case <-tick.C:
+			now := time.Now()
+			t.pingMs.Store(now.UnixMilli())
+			t.pingAt.Store(now.UnixNano())
+			if err := t.send(keepAliveFrame(now.UnixMilli())); err != nil {
 				return // stream is dead; recvLoop will observe it too.
 			}
 		}
@@ -236,13 +400,14 @@ func (c *Client) Call(ctx context.Context, target, service string, in []byte) ([
 	}
 
 	reqID := uuid.NewString()
-	pc := &pendingCall{done: make(chan callResult, 1)}
 
 	c.mu.Lock()
-	if c.stream == nil {
+	t := c.pickLocked()
+	if t == nil {
 		c.mu.Unlock()
 		return nil, ErrNotConnected
 	}
+	pc := &pendingCall{t: t, done: make(chan callResult, 1)}
 	c.inflight[reqID] = pc
 	c.mu.Unlock()
 
@@ -258,27 +423,43 @@ func (c *Client) Call(ctx context.Context, target, service string, in []byte) ([
 		deadlineMs = dl.UnixMilli()
 	}
 
-	// Header + request body + EOS(request). Sends are serialized by c.send.
-	if err := c.send(requestHeaderFrame(reqID, pb.Direction_LOCAL_TO_REMOTE, service, c.cfg.RelayName, target, deadlineMs)); err != nil {
+	// Header + request body + EOS(request). Sends are serialized by t.send.
+	// The body is split to the agent's frame size: one frame holding a large
+	// body would exceed gRPC's message limit and kill the whole tunnel.
+	if err := t.send(requestHeaderFrame(reqID, pb.Direction_LOCAL_TO_REMOTE, service, c.cfg.RelayName, target, deadlineMs)); err != nil {
 		return nil, fmt.Errorf("send header: %w", err)
 	}
-	if len(in) > 0 {
-		if err := c.send(dataFrame(reqID, streamRequest, in)); err != nil {
-			return nil, fmt.Errorf("send body: %w", err)
-		}
+	if err := sendChunked(reqID, streamRequest, in, t.peer.Capabilities.frameSize(), t.send); err != nil {
+		return nil, fmt.Errorf("send body: %w", err)
 	}
-	if err := c.send(eosFrame(reqID, streamRequest)); err != nil {
+	if err := t.send(eosFrame(reqID, streamRequest)); err != nil {
 		return nil, fmt.Errorf("send eos: %w", err)
 	}
 
 	select {
 	case <-ctx.Done():
+		cancelRemote(t, reqID, ctx.Err())
 		return nil, ctx.Err()
 	case res := <-pc.done:
 		return res.out, res.err
 	}
 }
 
+// cancelRemote tells the executor we have stopped waiting for reqID, so it
+// stops the work too. Without it the remote process runs to its own timeout,
+// holding an agent worker for a result nobody will read. Best effort: if the
+// tunnel is gone, so is the call on the other side.
+//
+// Only sent to an agent that declared it handles Cancel; an older one would
+// drop the frame anyway, and not sending it keeps that true by design rather
+// than by accident.
+func cancelRemote(t *tunnel, reqID string, cause error) {
+	if !t.peer.Capabilities.Cancel {
+		return
+	}
+	_ = t.send(cancelFrame(reqID, cause.Error()))
+}
+
 // CallStream runs a bidirectional forward call: stdin is streamed to the remote
 // as request chunks and response chunks are written to stdout as they arrive,
 // unbuffered. This is what carries a raw TCP stream (GUI/VNC over the agent's
@@ -291,13 +472,15 @@ func (c *Client) CallStream(ctx context.Context, target, service string, stdin i
 	}
 
 	reqID := uuid.NewString()
-	ps := &pendingStream{recv: make(chan []byte, 16)}
 
 	c.mu.Lock()
-	if c.stream == nil {
+	t := c.pickLocked()
+	if t == nil {
 		c.mu.Unlock()
 		return ErrNotConnected
 	}
+	windows := t.windows
+	ps := &pendingStream{t: t, queue: newChunkQueue(windows.recv), win: newSendWindow(windows.send)}
 	c.streams[reqID] = ps
 	c.mu.Unlock()
 	defer func() {
@@ -310,41 +493,52 @@ func (c *Client) CallStream(ctx context.Context, target, service string, stdin i
 	if dl, ok := ctx.Deadline(); ok {
 		deadlineMs = dl.UnixMilli()
 	}
-	if err := c.send(requestHeaderFrame(reqID, pb.Direction_LOCAL_TO_REMOTE, service, c.cfg.RelayName, target, deadlineMs)); err != nil {
+	if err := t.send(requestHeaderFrame(reqID, pb.Direction_LOCAL_TO_REMOTE, service, c.cfg.RelayName, target, deadlineMs)); err != nil {
 		return fmt.Errorf("send header: %w", err)
 	}
 
 	// stdin → request data frames, EOS when it ends. A send error means the
-	// tunnel died; the recv side observes that too and returns.
+	// tunnel died; the recv side observes that too and returns. With flow
+	// control on, a chunk goes out only as fast as the agent returns credit.
 	go func() {
-		buf := make([]byte, 32*1024)
+		buf := make([]byte, streamChunkSize)
 		for {
 			n, rerr := stdin.Read(buf)
 			if n > 0 {
 				chunk := append([]byte(nil), buf[:n]...)
-				if err := c.send(dataFrame(reqID, streamRequest, chunk)); err != nil {
+				if err := sendWindowed(ctx, ps.win, reqID, streamRequest, chunk, t.send); err != nil {
 					return
 				}
 			}
 			if rerr != nil {
-				_ = c.send(eosFrame(reqID, streamRequest))
+				_ = t.send(eosFrame(reqID, streamRequest))
 				return
 			}
 		}
 	}()
 
-	// response chunks → stdout until EOS (recv closed) or ctx cancels.
+	// response chunks → stdout until EOS (queue closed) or ctx cancels. Credit
+	// is returned only after stdout has taken the bytes: that is what makes a
+	// slow consumer slow down the agent rather than fill this process.
+	//
+	// Any way out other than the agent ending the stream — ctx, a stdout that
+	// stopped accepting — cancels it remotely, or the agent's socket stays open
+	// for a reader that is gone.
+	credit := newCreditReturner(reqID, streamResponse, windows.recv, t.send)
 	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case chunk, ok := <-ps.recv:
-			if !ok {
-				return ps.err
-			}
-			if _, err := stdout.Write(chunk); err != nil {
-				return err
+		chunk, ok, err := ps.queue.pop(ctx)
+		if !ok {
+			if err != nil && ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+				cancelRemote(t, reqID, err)
 			}
+			return err
+		}
+		if _, err := stdout.Write(chunk); err != nil {
+			cancelRemote(t, reqID, err)
+			return err
+		}
+		if err := credit.delivered(len(chunk)); err != nil {
+			return err
 		}
 	}
 }
@@ -355,12 +549,12 @@ func (c *Client) CallStream(ctx context.Context, target, service string, stdin i
 // A dispatch over frame types. Flat by nature; each arm is independent.
 //
 //nolint:gocyclo // frame-type dispatch
-func (c *Client) recvLoop(ctx context.Context, stream pb.RelayTransport_TunnelClient) error {
+func (c *Client) recvLoop(ctx context.Context, t *tunnel) error {
 	// reverse accumulates inbound reverse-request bodies by request_id.
 	reverseBuf := make(map[string]*reverseCall)
 
 	for {
-		frame, err := stream.Recv()
+		frame, err := t.stream.Recv()
 		if err != nil {
 			return err // connection dropped; Start will reconnect.
 		}
@@ -368,10 +562,26 @@ func (c *Client) recvLoop(ctx context.Context, stream pb.RelayTransport_TunnelCl
 
 		switch {
 		case frame.GetHandshake() != nil:
-			// Server ack; nothing to do.
+			// The ack was consumed before the stream was published; a second
+			// handshake is unexpected and ignored.
+
+		case frame.GetWindowUpdate() != nil:
+			// Credit for request chunks of one of our streams. Reverse calls
+			// are buffered whole and never flow-controlled. Only the tunnel
+			// the stream runs on may grant it: credit from another is a peer
+			// opening a window it does not own.
+			wu := frame.GetWindowUpdate()
+			if wu.GetStreamId() == streamRequest {
+				if ps, _ := c.callOn(t, reqID); ps != nil {
+					ps.win.grant(wu.GetIncrement())
+				}
+			}
 
 		case frame.GetKeepAlive() != nil:
-			// Heartbeat; liveness only.
+			// Heartbeat. The echo of our own is timed for Status.
+			if ms := frame.GetKeepAlive().GetUnixMs(); ms != 0 && ms == t.pingMs.Load() {
+				t.endpoint.recordRTT(time.Since(time.Unix(0, t.pingAt.Load())))
+			}
 
 		case frame.GetRequestHeader() != nil:
 			hdr := frame.GetRequestHeader()
@@ -383,14 +593,28 @@ func (c *Client) recvLoop(ctx context.Context, stream pb.RelayTransport_TunnelCl
 
 		case frame.GetData() != nil:
 			d := frame.GetData()
+			if err := decodeChunk(d, &c.compression); err != nil {
+				// One undecodable chunk fails its call, not the tunnel.
+				_ = t.send(errorFrame(reqID, codeInvalid, err.Error()))
+				delete(reverseBuf, reqID)
+				c.completeForward(t, reqID, err)
+				break
+			}
 			switch d.GetStreamId() {
 			case streamResponse:
 				// Response body for a forward call we originated.
-				c.appendForward(reqID, d.GetPayload())
+				c.appendForward(t, reqID, d.GetPayload())
 			case streamRequest:
-				// Body of an inbound reverse request.
+				// Body of an inbound reverse request. One over the policy's
+				// size limit is refused as soon as it is, not buffered whole.
 				if rc, ok := reverseBuf[reqID]; ok {
 					rc.buf = append(rc.buf, d.GetPayload()...)
+					if p := c.cfg.ReversePolicy; p != nil && len(rc.buf) > p.maxPayload(c.cfg.RemoteName) {
+						delete(reverseBuf, reqID)
+						c.reverseReceived.Add(1)
+						c.refuseReverse(t, reqID, rc, time.Now(), fmt.Errorf("%w: request exceeds %d bytes",
+							ErrReverseRefused, p.maxPayload(c.cfg.RemoteName)))
+					}
 				}
 			}
 
@@ -399,12 +623,12 @@ func (c *Client) recvLoop(ctx context.Context, stream pb.RelayTransport_TunnelCl
 			switch eos.GetStreamId() {
 			case streamResponse:
 				// Forward call complete.
-				c.completeForward(reqID, nil)
+				c.completeForward(t, reqID, nil)
 			case streamRequest:
 				// Inbound reverse request fully received → route to local dom0.
 				if rc, ok := reverseBuf[reqID]; ok {
 					delete(reverseBuf, reqID)
-					go c.handleReverse(ctx, reqID, rc)
+					go c.handleReverse(ctx, t, reqID, rc)
 				}
 			}
 
@@ -412,7 +636,7 @@ func (c *Client) recvLoop(ctx context.Context, stream pb.RelayTransport_TunnelCl
 			ce := frame.GetError()
 			// Error can terminate either a forward call or an in-progress reverse.
 			delete(reverseBuf, reqID)
-			c.completeForward(reqID, fmt.Errorf("remote: %s: %s", ce.GetCode(), ce.GetMessage()))
+			c.completeForward(t, reqID, &RemoteError{Code: ce.GetCode(), Message: ce.GetMessage()})
 		}
 	}
 }
@@ -425,35 +649,85 @@ type reverseCall struct {
 
 // handleReverse routes a completed inbound reverse request to the local dom0 via
 // c.reverse (policy C: ask), then streams the result back on the same request_id.
-// It NEVER decides authorization — c.reverse does that through dom0.
-func (c *Client) handleReverse(ctx context.Context, reqID string, rc *reverseCall) {
+// It NEVER grants authorization — c.reverse asks dom0 — but the reverse policy,
+// when configured, can refuse a call before dom0 is asked.
+func (c *Client) handleReverse(ctx context.Context, t *tunnel, reqID string, rc *reverseCall) {
+	c.reverseReceived.Add(1)
+	started := time.Now()
+	policy := c.cfg.ReversePolicy
+	if policy != nil {
+		release, err := policy.admit(c.cfg.RemoteName, rc.service, len(rc.buf))
+		if err != nil {
+			c.refuseReverse(t, reqID, rc, started, err)
+			return
+		}
+		defer release()
+	}
 	if c.reverse == nil {
-		_ = c.send(errorFrame(reqID, codeInternal, "no reverse handler"))
+		c.reverseFailed.Add(1)
+		c.recordReverse(rc, started, ReverseFailed, "no reverse handler")
+		_ = t.send(errorFrame(reqID, codeInternal, "no reverse handler"))
 		return
 	}
 	out, err := c.reverse(ctx, rc.service, rc.buf)
+	if errors.Is(err, qrexec.ErrRefused) {
+		c.reverseFailed.Add(1)
+		c.reverseRefusedDom0.Add(1)
+		c.recordReverse(rc, started, ReverseRefusedByDom0, err.Error())
+		_ = t.send(errorFrame(reqID, codeDenied, err.Error()))
+		return
+	}
 	if err != nil {
-		_ = c.send(errorFrame(reqID, codeInternal, err.Error()))
+		c.reverseFailed.Add(1)
+		c.recordReverse(rc, started, ReverseFailed, err.Error())
+		_ = t.send(errorFrame(reqID, codeInternal, err.Error()))
 		return
 	}
-	if len(out) > 0 {
-		if err := c.send(dataFrame(reqID, streamResponse, out)); err != nil {
-			return
-		}
+	c.recordReverse(rc, started, ReverseAllowed, "")
+	if err := sendChunked(reqID, streamResponse, out, t.peer.Capabilities.frameSize(), t.send); err != nil {
+		return
 	}
-	_ = c.send(eosFrame(reqID, streamResponse))
+	_ = t.send(eosFrame(reqID, streamResponse))
 }
 
-// appendForward delivers a response chunk: to a streaming call as it arrives, or
-// buffered into a plain forward call. The stream send blocks under back-pressure,
-// which is fine because relay-call gives each streaming call its own tunnel.
-func (c *Client) appendForward(reqID string, payload []byte) {
-	c.mu.Lock()
-	ps := c.streams[reqID]
-	pc := c.inflight[reqID]
-	c.mu.Unlock()
+// refuseReverse answers a reverse call the policy refused. A refusal over a
+// rate or concurrency limit is LIMITED, so the remote can tell "not now" from
+// "never".
+func (c *Client) refuseReverse(t *tunnel, reqID string, rc *reverseCall, started time.Time, err error) {
+	c.reverseFailed.Add(1)
+	c.reverseRefusedLocal.Add(1)
+	c.recordReverse(rc, started, ReverseRefusedLocal, err.Error())
+	code := codeDenied
+	if errors.Is(err, errReverseLimited) {
+		code = CodeLimited
+	}
+	_ = t.send(errorFrame(reqID, code, err.Error()))
+}
+
+// recordReverse records a reverse call with the policy, when there is one.
+func (c *Client) recordReverse(rc *reverseCall, started time.Time, outcome, reason string) {
+	if c.cfg.ReversePolicy == nil {
+		return
+	}
+	c.cfg.ReversePolicy.record(ReverseCallRecord{
+		At: started.UTC(), Remote: c.cfg.RemoteName, Service: rc.service, Bytes: len(rc.buf),
+		Outcome: outcome, Reason: reason, Duration: time.Since(started),
+	})
+}
+
+// appendForward delivers a response chunk: queued for a streaming call, or
+// buffered into a plain forward call. With flow control the queue push never
+// blocks (the window bounds it) and a peer overrunning the window fails that
+// one stream. Against an agent without flow control the push blocks once a
+// window's worth is queued — the only back-pressure such an agent respects —
+// which stalls this tunnel; relay-call keeps a tunnel per stream for that case.
+func (c *Client) appendForward(t *tunnel, reqID string, payload []byte) {
+	ps, pc := c.callOn(t, reqID)
 	if ps != nil {
-		ps.recv <- payload
+		if err := ps.queue.push(payload); err != nil {
+			_ = t.send(errorFrame(reqID, codeInvalid, err.Error()))
+			c.completeForward(t, reqID, err)
+		}
 		return
 	}
 	if pc != nil {
@@ -465,10 +739,9 @@ func (c *Client) appendForward(reqID string, payload []byte) {
 
 // completeForward delivers the final result (or error) to a forward-call waiter,
 // or ends a streaming call by closing its recv channel (err set first).
-func (c *Client) completeForward(reqID string, err error) {
+func (c *Client) completeForward(t *tunnel, reqID string, err error) {
 	c.mu.Lock()
-	ps := c.streams[reqID]
-	pc := c.inflight[reqID]
+	ps, pc := c.callOnLocked(t, reqID)
 	if ps != nil {
 		delete(c.streams, reqID)
 	}
@@ -477,8 +750,7 @@ func (c *Client) completeForward(reqID string, err error) {
 	}
 	c.mu.Unlock()
 	if ps != nil {
-		ps.err = err
-		close(ps.recv)
+		ps.end(err)
 		return
 	}
 	if pc == nil {
@@ -491,43 +763,63 @@ func (c *Client) completeForward(reqID string, err error) {
 	}
 }
 
-// setStream publishes the live stream.
-func (c *Client) setStream(stream pb.RelayTransport_TunnelClient) {
+// callOn looks up the call reqID names, if it went out on t. A frame for a
+// call on another tunnel is ignored: each agent answers only for the calls it
+// was sent, and one that names another tunnel's request must not be able to
+// answer or end it.
+func (c *Client) callOn(t *tunnel, reqID string) (*pendingStream, *pendingCall) {
 	c.mu.Lock()
-	c.stream = stream
+	defer c.mu.Unlock()
+	return c.callOnLocked(t, reqID)
+}
+
+// callOnLocked is callOn with c.mu held.
+func (c *Client) callOnLocked(t *tunnel, reqID string) (*pendingStream, *pendingCall) {
+	ps, pc := c.streams[reqID], c.inflight[reqID]
+	if ps != nil && ps.t != t {
+		ps = nil
+	}
+	if pc != nil && pc.t != t {
+		pc = nil
+	}
+	return ps, pc
+}
+
+// addTunnel publishes a live tunnel.
+func (c *Client) addTunnel(t *tunnel) {
+	c.mu.Lock()
+	c.tunnels = append(c.tunnels, t)
+	t.endpoint.up(t.since, t.peer)
 	c.mu.Unlock()
 }
 
-// clearStream drops the live stream and fails every inflight forward call so no
-// caller hangs across a reconnect.
-func (c *Client) clearStream(cause error) {
+// removeTunnel drops a tunnel and fails every forward call in flight on it so
+// no caller hangs across a reconnect. Calls on other tunnels are untouched.
+func (c *Client) removeTunnel(t *tunnel, cause error) {
 	c.mu.Lock()
-	c.stream = nil
-	pending := c.inflight
-	c.inflight = make(map[string]*pendingCall)
-	streams := c.streams
-	c.streams = make(map[string]*pendingStream)
+	c.tunnels = slices.DeleteFunc(c.tunnels, func(x *tunnel) bool { return x == t })
+	t.endpoint.down()
+	var pending []*pendingCall
+	for id, pc := range c.inflight {
+		if pc.t == t {
+			pending = append(pending, pc)
+			delete(c.inflight, id)
+		}
+	}
+	var streams []*pendingStream
+	for id, ps := range c.streams {
+		if ps.t == t {
+			streams = append(streams, ps)
+			delete(c.streams, id)
+		}
+	}
 	c.mu.Unlock()
 	for _, pc := range pending {
 		pc.done <- callResult{err: fmt.Errorf("%s: %w", codeUnavailable, cause)}
 	}
 	for _, ps := range streams {
-		ps.err = fmt.Errorf("%s: %w", codeUnavailable, cause)
-		close(ps.recv)
-	}
-}
-
-// send serializes writes to the live stream (gRPC forbids concurrent Send).
-func (c *Client) send(frame *pb.Frame) error {
-	c.mu.Lock()
-	stream := c.stream
-	c.mu.Unlock()
-	if stream == nil {
-		return ErrNotConnected
+		ps.end(fmt.Errorf("%s: %w", codeUnavailable, cause))
 	}
-	c.sendMu.Lock()
-	defer c.sendMu.Unlock()
-	return stream.Send(frame)
 }
 
 // jitter returns d ± up to 20% to avoid thundering-herd reconnects.
@@ -0,0 +1,186 @@
+// compress.go — optional compression of DataChunk payloads.
+//
+// FileCopy bodies and log transfers are mostly text and cross WAN links, where
+// they compress several-fold. Each side lists the codecs it can DECODE in
+// Capabilities.compression, and a sender compresses only with a codec its peer
+// listed — so an agent that predates this never sees a compressed frame.
+//
+// Compression is per frame, not per call. Small payloads (keystrokes on a VNC
+// stream) cost more to compress than they save, and some payloads do not
+// compress at all (an already-gzipped tarball, encrypted data); both go out
+// as they are, so one call routinely mixes compressed and plain frames and the
+// receiver decodes each on its own.
+//
+// Only gzip for now: it is in the standard library, and zstd would be the
+// first compression dependency this module takes on. A codec is a name in the
+// capability list, so adding one later needs no protocol change.
+//
+// Credit (flow.go) counts DECOMPRESSED bytes on both sides: the window bounds
+// what the receiver has to hold once a chunk is decoded, which is the memory
+// it is there to protect.
+
+package grpc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	pb "github.com/slchris/qubes-air/console/internal/transport/relaypb"
+)
+
+// compressionGzip is the gzip codec's name on the wire.
+const compressionGzip = "gzip"
+
+// defaultCompressThreshold is the smallest payload worth compressing. Below
+// about 4 KiB the gzip header and a round through the compressor cost more
+// than the few bytes saved — and interactive stream traffic, which is latency
+// sensitive, is almost all below it.
+const defaultCompressThreshold = 4 << 10
+
+// advertisedCompression maps a configured threshold to the codecs this side
+// lists in its handshake: nil (compression off) for a negative threshold.
+// Decoding does not depend on it — a peer only compresses with codecs we
+// listed, so turning it off here is enough to keep frames plain both ways.
+func advertisedCompression(threshold int) []string {
+	if threshold < 0 {
+		return nil
+	}
+	return []string{compressionGzip}
+}
+
+// CompressionStats counts what compression did on one side of the transport.
+// Bytes are payload bytes; framing is not counted.
+type CompressionStats struct {
+	// FramesCompressed is how many DataChunks went out compressed.
+	FramesCompressed uint64 `json:"frames_compressed"`
+	// SentRawBytes and SentWireBytes are those chunks' sizes before and after.
+	SentRawBytes  uint64 `json:"sent_raw_bytes"`
+	SentWireBytes uint64 `json:"sent_wire_bytes"`
+	// FramesDecompressed is how many compressed DataChunks were received.
+	FramesDecompressed uint64 `json:"frames_decompressed"`
+	// RecvWireBytes and RecvRawBytes are those chunks' sizes as received and
+	// once decoded.
+	RecvWireBytes uint64 `json:"recv_wire_bytes"`
+	RecvRawBytes  uint64 `json:"recv_raw_bytes"`
+}
+
+// BytesSaved is how many payload bytes compression kept off the wire, in both
+// directions.
+func (s CompressionStats) BytesSaved() uint64 {
+	return s.SentRawBytes - s.SentWireBytes + s.RecvRawBytes - s.RecvWireBytes
+}
+
+// compressionCounters is the live, concurrently updated form of
+// CompressionStats. One per Client or Server, shared by its tunnels.
+type compressionCounters struct {
+	framesCompressed, sentRaw, sentWire   atomic.Uint64
+	framesDecompressed, recvWire, recvRaw atomic.Uint64
+}
+
+func (c *compressionCounters) snapshot() CompressionStats {
+	return CompressionStats{
+		FramesCompressed:   c.framesCompressed.Load(),
+		SentRawBytes:       c.sentRaw.Load(),
+		SentWireBytes:      c.sentWire.Load(),
+		FramesDecompressed: c.framesDecompressed.Load(),
+		RecvWireBytes:      c.recvWire.Load(),
+		RecvRawBytes:       c.recvRaw.Load(),
+	}
+}
+
+// chunkEncoder compresses outgoing DataChunks for one tunnel. A nil encoder
+// sends everything as it is.
+type chunkEncoder struct {
+	threshold int
+	stats     *compressionCounters
+}
+
+// newChunkEncoder returns the encoder for a tunnel, or nil when either side
+// has compression off: we by a negative threshold, the peer by not listing
+// gzip.
+func newChunkEncoder(threshold int, peer Capabilities, stats *compressionCounters) *chunkEncoder {
+	if threshold < 0 || !slices.Contains(peer.Compression, compressionGzip) {
+		return nil
+	}
+	if threshold == 0 {
+		threshold = defaultCompressThreshold
+	}
+	return &chunkEncoder{threshold: threshold, stats: stats}
+}
+
+var gzipWriters = sync.Pool{New: func() any {
+	// BestSpeed: the link, not the CPU, is what this is for, and a tunnel
+	// carrying a GUI stream cannot afford to sit in the compressor.
+	w, _ := gzip.NewWriterLevel(io.Discard, gzip.BestSpeed)
+	return w
+}}
+
+// encode compresses f's payload in place when f is a DataChunk large enough
+// to be worth it and compression actually shrinks it. Anything else passes
+// through untouched. Call it outside the send lock: compressing a megabyte is
+// not something every other sender should wait on.
+func (e *chunkEncoder) encode(f *pb.Frame) {
+	d := f.GetData()
+	if e == nil || d == nil || d.GetCompression() != "" || len(d.GetPayload()) < e.threshold {
+		return
+	}
+	raw := d.GetPayload()
+	var buf bytes.Buffer
+	buf.Grow(len(raw) / 2)
+	w := gzipWriters.Get().(*gzip.Writer) //nolint:forcetypeassert // the pool only holds these
+	w.Reset(&buf)
+	_, werr := w.Write(raw)
+	cerr := w.Close()
+	gzipWriters.Put(w)
+	if werr != nil || cerr != nil || buf.Len() >= len(raw) {
+		// Incompressible (or, implausibly for an in-memory buffer, a write
+		// error): the plain payload is always a correct frame.
+		return
+	}
+	d.Payload = buf.Bytes()
+	d.Compression = compressionGzip
+	e.stats.framesCompressed.Add(1)
+	e.stats.sentRaw.Add(uint64(len(raw)))
+	e.stats.sentWire.Add(uint64(buf.Len()))
+}
+
+// decodeChunk replaces a compressed DataChunk's payload with the decoded bytes
+// and clears its compression, so everything downstream — delivery, credit,
+// relaying a reverse-call body onward — sees a plain chunk.
+//
+// The decoded size is capped at the frame size this build asks peers for:
+// every chunk was cut to that size before it was compressed, so anything
+// larger is a peer misbehaving, and a small frame that inflates to gigabytes
+// must not be allowed to.
+func decodeChunk(d *pb.DataChunk, stats *compressionCounters) error {
+	switch d.GetCompression() {
+	case "":
+		return nil
+	case compressionGzip:
+	default:
+		return fmt.Errorf("unsupported chunk compression %q", d.GetCompression())
+	}
+	wire := len(d.GetPayload())
+	r, err := gzip.NewReader(bytes.NewReader(d.GetPayload()))
+	if err != nil {
+		return fmt.Errorf("gzip chunk: %w", err)
+	}
+	raw, err := io.ReadAll(io.LimitReader(r, defaultMaxFrameSize+1))
+	if err != nil {
+		return fmt.Errorf("gzip chunk: %w", err)
+	}
+	if len(raw) > defaultMaxFrameSize {
+		return fmt.Errorf("gzip chunk decodes past the %d-byte frame limit", defaultMaxFrameSize)
+	}
+	d.Payload = raw
+	d.Compression = ""
+	stats.framesDecompressed.Add(1)
+	stats.recvWire.Add(uint64(wire))
+	stats.recvRaw.Add(uint64(len(raw)))
+	return nil
+}
@@ -0,0 +1,170 @@
+package grpc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/slchris/qubes-air/console/internal/transport/relaypb"
+)
+
+// TestChunkEncoderPicksFrames — only payloads that are big enough AND shrink
+// are compressed; everything else goes out exactly as it was, and what was
+// compressed decodes back to the original.
+func TestChunkEncoderPicksFrames(t *testing.T) {
+	var stats compressionCounters
+	peer := Capabilities{Compression: []string{compressionGzip}}
+	enc := newChunkEncoder(0, peer, &stats)
+
+	text := []byte(strings.Repeat("log line: everything is fine\n", 1000))
+	noise := make([]byte, 64<<10)
+	if _, err := rand.Read(noise); err != nil {
+		t.Fatal(err)
+	}
+	for name, tc := range map[string]struct {
+		payload    []byte
+		compressed bool
+	}{
+		"compressible": {text, true},
+		"small":        {[]byte("keystroke"), false},
+		"random":       {noise, false},
+	} {
+		f := dataFrame("r", streamResponse, bytes.Clone(tc.payload))
+		enc.encode(f)
+		if got := f.GetData().GetCompression() == compressionGzip; got != tc.compressed {
+			t.Errorf("%s: compressed = %v, want %v", name, got, tc.compressed)
+		}
+		if err := decodeChunk(f.GetData(), &stats); err != nil {
+			t.Fatalf("%s: decode: %v", name, err)
+		}
+		if !bytes.Equal(f.GetData().GetPayload(), tc.payload) || f.GetData().GetCompression() != "" {
+			t.Errorf("%s: did not round-trip", name)
+		}
+	}
+
+	s := stats.snapshot()
+	if s.FramesCompressed != 1 || s.FramesDecompressed != 1 || s.SentRawBytes != uint64(len(text)) {
+		t.Errorf("stats = %+v, want exactly the compressible frame counted", s)
+	}
+	if s.BytesSaved() == 0 || s.SentWireBytes >= s.SentRawBytes {
+		t.Errorf("stats show no savings: %+v", s)
+	}
+
+	// Either side turning it off means no encoder at all.
+	if newChunkEncoder(-1, peer, &stats) != nil || newChunkEncoder(0, Capabilities{}, &stats) != nil {
+		t.Error("encoder built with compression off on one side")
+	}
+	if advertisedCompression(-1) != nil || len(advertisedCompression(0)) != 1 {
+		t.Error("advertisedCompression does not follow the threshold")
+	}
+}
+
+// TestDecodeChunkRefusesAbuse — an unknown codec and a frame that inflates
+// past the frame limit fail that chunk instead of being trusted.
+func TestDecodeChunkRefusesAbuse(t *testing.T) {
+	var stats compressionCounters
+	if err := decodeChunk(&pb.DataChunk{Payload: []byte("x"), Compression: "lz4"}, &stats); err == nil {
+		t.Error("unknown codec accepted")
+	}
+
+	var bomb bytes.Buffer
+	w := gzip.NewWriter(&bomb)
+	_, _ = w.Write(make([]byte, defaultMaxFrameSize+1))
+	_ = w.Close()
+	if err := decodeChunk(&pb.DataChunk{Payload: bomb.Bytes(), Compression: compressionGzip}, &stats); err == nil {
+		t.Error("a chunk decoding past the frame limit was accepted")
+	}
+}
+
+// compressTunnel starts a server and a connected client with the given
+// compression thresholds.
+func compressTunnel(t *testing.T, serverThreshold, clientThreshold int) (*Client, *Server) {
+	t.Helper()
+	ca, caKey := mkCA(t)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lis.Addr().String()
+	_ = lis.Close()
+
+	srv := NewServer(ServerConfig{Listen: addr, TLS: mkServerTLS(t, ca, caKey), CompressThreshold: serverThreshold}, tagInvoker{})
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() { _ = srv.Serve(ctx) }()
+	waitDial(t, addr)
+
+	cli := NewClient(ClientConfig{
+		RemoteEndpoint: addr, RelayName: "sys-relay", RemoteName: "remote-dev",
+		TLS: mkClientTLS(t, ca, caKey), CompressThreshold: clientThreshold,
+	}, nil)
+	go func() { _ = cli.Start(ctx) }()
+	if _, err := callWhenReady(t, cli, "remote-dev", "qubesair.Ping", nil); err != nil {
+		t.Fatalf("tunnel: %v", err)
+	}
+	return cli, srv
+}
+
+// TestCompressedCallRoundTrip — a large body made of compressible and random
+// megabytes crosses the tunnel both ways intact, as a mix of compressed and
+// plain frames, and both sides count what was saved.
+func TestCompressedCallRoundTrip(t *testing.T) {
+	cli, srv := compressTunnel(t, 0, 0)
+
+	noise := make([]byte, 1<<20)
+	if _, err := rand.Read(noise); err != nil {
+		t.Fatal(err)
+	}
+	body := append(bytes.Repeat([]byte("a"), 2<<20), noise...)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	out, err := cli.Call(ctx, "remote-dev", "qubesair.FileCopy", body)
+	if err != nil {
+		t.Fatalf("call: %v", err)
+	}
+	want := append([]byte("handled[remote-dev/qubesair.FileCopy]:"), body...)
+	if !bytes.Equal(out, want) {
+		t.Fatalf("response of %d bytes does not match the %d expected", len(out), len(want))
+	}
+
+	cs, ss := cli.CompressionStats(), srv.CompressionStats()
+	if cs.FramesCompressed == 0 || ss.FramesDecompressed != cs.FramesCompressed {
+		t.Errorf("request: client compressed %d frames, server decoded %d", cs.FramesCompressed, ss.FramesDecompressed)
+	}
+	if ss.FramesCompressed == 0 || cs.FramesDecompressed != ss.FramesCompressed {
+		t.Errorf("response: server compressed %d frames, client decoded %d", ss.FramesCompressed, cs.FramesDecompressed)
+	}
+	// The random megabyte must have gone out plain: only the compressible
+	// two were counted.
+	if cs.SentRawBytes > 2<<20 {
+		t.Errorf("client counted %d raw bytes as compressed; the random part should have been sent plain", cs.SentRawBytes)
+	}
+	if cs.BytesSaved() < 1<<20 || ss.BytesSaved() < 1<<20 {
+		t.Errorf("savings too small: client %d, server %d", cs.BytesSaved(), ss.BytesSaved())
+	}
+}
+
+// TestCompressionOffOnOneSide — either side turning compression off keeps
+// every frame plain in both directions.
+func TestCompressionOffOnOneSide(t *testing.T) {
+	for name, th := range map[string][2]int{"server off": {-1, 0}, "client off": {0, -1}} {
+		t.Run(name, func(t *testing.T) {
+			cli, srv := compressTunnel(t, th[0], th[1])
+			body := bytes.Repeat([]byte("a"), 1<<20)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if _, err := cli.Call(ctx, "remote-dev", "qubesair.FileCopy", body); err != nil {
+				t.Fatal(err)
+			}
+			if cs, ss := cli.CompressionStats(), srv.CompressionStats(); cs != (CompressionStats{}) || ss != (CompressionStats{}) {
+				t.Errorf("compression happened anyway: client %+v, server %+v", cs, ss)
+			}
+		})
+	}
+}
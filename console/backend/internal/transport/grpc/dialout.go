@@ -0,0 +1,232 @@
+// dialout.go — the agent dialing OUT to a relay (RelayAttach.Attach).
+//
+// The ordinary direction has the relay dial the agent, so every remote needs a
+// reachable inbound port — which a remote behind home NAT does not have, and
+// which contradicts the zero-inbound firewall design besides. In dial-out mode
+// the agent opens the connection instead, and nothing else changes: once the
+// stream is up the relay still sends the Handshake and the calls, and the agent
+// runs exactly the code that serves a Tunnel (serveTunnel). Only who dialed is
+// different.
+//
+// Two things the dialing side has to own that a listener never did:
+//
+//   - Staying connected. The agent reconnects with backoff, as the relay's
+//     Client does, for as long as its context lives.
+//   - Noticing a dead link. A NAT mapping that silently expires leaves a TCP
+//     connection that accepts writes and never delivers anything. The agent
+//     sends KeepAlive frames to keep the mapping warm, and redials when it has
+//     heard nothing — not even the relay's own keepalives — for several
+//     intervals.
+
+package grpc
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pb "github.com/slchris/qubes-air/console/internal/transport/relaypb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// DialOutConfig configures an agent's outbound connection to a relay.
+type DialOutConfig struct {
+	// Endpoint is the relay's attach listener, host:port.
+	Endpoint string
+	// TLS is the agent's client identity and how it verifies the relay. It
+	// must verify: either by the TLS stack (RootCAs) or, with
+	// InsecureSkipVerify, by its own VerifyConnection — a dial-out agent runs
+	// whatever the other end sends, so an unauthenticated relay is refused.
+	TLS *tls.Config
+	// TLSProvider, if set, is called on each (re)connect instead of using TLS,
+	// so a renewed agent certificate is presented on the next connection.
+	TLSProvider func() (*tls.Config, error)
+	// Dialer replaces the default TCP dial, as in ClientConfig.
+	Dialer func(ctx context.Context, addr string) (net.Conn, error)
+	// KeepAlive is how often the agent sends a KeepAlive frame (default 20s).
+	// The link is declared dead after deadAfterKeepAlives intervals of silence.
+	KeepAlive    time.Duration
+	ReconnectMin time.Duration // backoff floor (default 500ms)
+	ReconnectMax time.Duration // backoff ceiling (default 30s)
+}
+
+// deadAfterKeepAlives is how many keepalive intervals of total silence end a
+// dial-out tunnel. The relay sends its own keepalives on the same interval by
+// default, so three missed is a dead link, not a quiet one.
+const deadAfterKeepAlives = 3
+
+func (cfg DialOutConfig) withDefaults() DialOutConfig {
+	if cfg.KeepAlive <= 0 {
+		cfg.KeepAlive = 20 * time.Second
+	}
+	if cfg.ReconnectMin <= 0 {
+		cfg.ReconnectMin = 500 * time.Millisecond
+	}
+	if cfg.ReconnectMax <= 0 {
+		cfg.ReconnectMax = 30 * time.Second
+	}
+	return cfg
+}
+
+// DialOut connects to the relay at cfg.Endpoint and serves the calls that
+// arrive on that connection, reconnecting whenever it drops, until ctx is
+// canceled. It blocks and returns nil on cancellation.
+//
+// It can run alongside Serve — an agent may both listen and dial out — and the
+// two share the invoker and forward policy, so a call is handled the same way
+// whichever direction its tunnel was opened in.
+func (s *Server) DialOut(ctx context.Context, cfg DialOutConfig) error {
+	cfg = cfg.withDefaults()
+	if cfg.Endpoint == "" {
+		return errors.New("grpc dial-out: no relay endpoint")
+	}
+	backoff := cfg.ReconnectMin
+	for {
+		started := time.Now()
+		err := s.dialOutOnce(ctx, cfg)
+		if ctx.Err() != nil {
+			return nil
+		}
+		log.Printf("grpc dial-out: tunnel to %s ended: %v", cfg.Endpoint, err)
+		// A tunnel that stayed up a while was healthy; start the backoff over
+		// rather than punishing the next drop for an outage long past.
+		if time.Since(started) > cfg.ReconnectMax {
+			backoff = cfg.ReconnectMin
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(jitter(backoff)):
+		}
+		backoff = min(backoff*2, cfg.ReconnectMax)
+	}
+}
+
+// dialOutOnce opens one Attach stream and serves it until it ends.
+func (s *Server) dialOutOnce(ctx context.Context, cfg DialOutConfig) error {
+	tlsCfg, relayCN, err := dialOutTLS(cfg)
+	if err != nil {
+		return err
+	}
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(credentials.NewTLS(tlsCfg))}
+	if cfg.Dialer != nil {
+		opts = append(opts, grpc.WithContextDialer(cfg.Dialer))
+	}
+	conn, err := grpc.NewClient(cfg.Endpoint, opts...)
+	if err != nil {
+		return fmt.Errorf("dial %s: %w", cfg.Endpoint, err)
+	}
+	defer conn.Close()
+
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	raw, err := pb.NewRelayAttachClient(conn).Attach(streamCtx)
+	if err != nil {
+		return fmt.Errorf("open attach stream: %w", err)
+	}
+	stream := &dialOutStream{frameStream: raw}
+	stream.touch()
+
+	go stream.keepAlive(streamCtx, cancel, cfg.KeepAlive)
+
+	// The stream exists only after the TLS handshake, so the verified name has
+	// been recorded by now.
+	cn, _ := relayCN.Load().(string)
+	log.Printf("grpc dial-out: attached to relay %s (%s)", cfg.Endpoint, orUnknown(cn))
+	return s.serveTunnel(stream, cn)
+}
+
+// dialOutTLS resolves the TLS config for one attempt and arranges for the
+// relay's verified certificate name to be recorded as the handshake completes:
+// the client side of a connection that skips the stack's own verification has
+// no VerifiedChains for peerCommonName to read.
+func dialOutTLS(cfg DialOutConfig) (*tls.Config, *atomic.Value, error) {
+	base := cfg.TLS
+	if cfg.TLSProvider != nil {
+		t, err := cfg.TLSProvider()
+		if err != nil {
+			return nil, nil, fmt.Errorf("resolve mTLS: %w", err)
+		}
+		base = t
+	}
+	if base == nil {
+		return nil, nil, errors.New("grpc dial-out: nil TLS config (mTLS required)")
+	}
+	if base.InsecureSkipVerify && base.VerifyConnection == nil {
+		return nil, nil, errors.New("grpc dial-out: TLS config verifies nothing; refusing an unauthenticated relay")
+	}
+	tlsCfg := base.Clone()
+	var relayCN atomic.Value
+	verify := base.VerifyConnection
+	tlsCfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		if verify != nil {
+			if err := verify(cs); err != nil {
+				return err
+			}
+		}
+		switch {
+		case len(cs.VerifiedChains) > 0 && len(cs.VerifiedChains[0]) > 0:
+			relayCN.Store(cs.VerifiedChains[0][0].Subject.CommonName)
+		case len(cs.PeerCertificates) > 0:
+			// Verified by the config's own VerifyConnection, which just passed.
+			relayCN.Store(cs.PeerCertificates[0].Subject.CommonName)
+		}
+		return nil
+	}
+	return tlsCfg, &relayCN, nil
+}
+
+// dialOutStream is an Attach stream as the agent holds it: sends serialized
+// (serveTunnel and the keepalive loop both send), and the time of the last
+// frame received kept for the dead-link check.
+type dialOutStream struct {
+	frameStream
+	sendMu sync.Mutex
+	last   atomic.Int64 // unix nanos of the last frame received
+}
+
+func (d *dialOutStream) Send(f *pb.Frame) error {
+	d.sendMu.Lock()
+	defer d.sendMu.Unlock()
+	return d.frameStream.Send(f)
+}
+
+func (d *dialOutStream) Recv() (*pb.Frame, error) {
+	f, err := d.frameStream.Recv()
+	if err == nil {
+		d.touch()
+	}
+	return f, err
+}
+
+func (d *dialOutStream) touch() { d.last.Store(time.Now().UnixNano()) }
+
+// keepAlive sends a KeepAlive every interval and ends the stream once nothing
+// has been received for deadAfterKeepAlives of them.
+func (d *dialOutStream) keepAlive(ctx context.Context, cancel context.CancelFunc, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if silent := time.Since(time.Unix(0, d.last.Load())); silent > deadAfterKeepAlives*interval {
+				log.Printf("grpc dial-out: nothing from the relay for %s; redialing", silent.Round(time.Second))
+				cancel()
+				return
+			}
+			if err := d.Send(keepAliveFrame(time.Now().UnixMilli())); err != nil {
+				cancel()
+				return
+			}
+		}
+	}
+}
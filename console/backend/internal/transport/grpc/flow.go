@@ -0,0 +1,330 @@
+// flow.go — credit-based flow control for streaming calls.
+//
+// Without it, a DataChunk is sent the moment its producer reads it, and the
+// receiver has two bad options for a chunk it cannot deliver yet: block the
+// tunnel's single receive loop (stalling keepalives and every other call on the
+// tunnel behind one slow VNC viewer), or buffer without bound. Credits give it a
+// third: the SENDER stops once it has as many unacknowledged bytes in flight as
+// the receiver advertised, and the receiver returns credit with a WindowUpdate
+// only after it has actually delivered the bytes. Buffering is then bounded by
+// the window, so the receive loop can queue a chunk and move on without ever
+// waiting on a socket.
+//
+// Negotiation is per tunnel: each side puts its window in Handshake.initial_window,
+// and flow control is on only when both are non-zero. A peer that predates the
+// field sends zero, and the tunnel then behaves exactly as before — including
+// the old back-pressure of blocking the receive loop, which is the only bound a
+// legacy sender respects.
+//
+// Only streaming calls (qubesair.StreamTCP) are flow-controlled. A plain Call
+// is buffered whole on both sides by design, so a window would bound nothing.
+
+package grpc
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	pb "github.com/slchris/qubes-air/console/internal/transport/relaypb"
+)
+
+// defaultStreamWindow is the receive window advertised per stream direction.
+// 256 KiB keeps a GUI stream's throughput up over a WAN round trip (8 read
+// buffers in flight) while bounding what one stalled stream can pin in memory.
+const defaultStreamWindow = 256 * 1024
+
+// streamChunkSize is the largest read a stream pump turns into one DataChunk.
+const streamChunkSize = 32 * 1024
+
+// errWindowExceeded means a peer sent more than the window it was granted —
+// a protocol violation the stream is failed for, never absorbed.
+var errWindowExceeded = errors.New("flow control window exceeded")
+
+// errStreamClosed is returned by a sendWindow once its stream has ended.
+var errStreamClosed = errors.New("stream closed")
+
+// advertisedWindow maps a configured window to what goes in the handshake:
+// zero picks the default, negative turns flow control off (advertises zero).
+func advertisedWindow(configured int) uint32 {
+	switch {
+	case configured < 0:
+		return 0
+	case configured == 0:
+		return defaultStreamWindow
+	default:
+		return uint32(configured) //nolint:gosec // operator-configured, positive
+	}
+}
+
+// streamWindows is what a tunnel's handshake settled for its streams. Each
+// direction is governed by its receiver: send is the peer's advertised window,
+// which our sendWindow spends; recv is our own, which our chunkQueue enforces
+// and our creditReturner replenishes. Sizing the receive side from the peer's
+// number instead works only while both ends happen to be configured alike —
+// a smaller queue than the peer sends into fails the stream, a larger credit
+// threshold than the peer's window never returns any and stalls it.
+type streamWindows struct {
+	send, recv uint32
+}
+
+// negotiateWindows returns the windows for a tunnel where we advertised ours
+// and the peer advertised peers — both zero when either side has flow control
+// off, since then neither side sends nor waits for credit.
+func negotiateWindows(ours, peers uint32) streamWindows {
+	if ours == 0 || peers == 0 {
+		return streamWindows{}
+	}
+	return streamWindows{send: peers, recv: ours}
+}
+
+func windowUpdateFrame(reqID string, streamID, increment uint32) *pb.Frame {
+	return &pb.Frame{
+		RequestId: reqID,
+		Kind:      &pb.Frame_WindowUpdate{WindowUpdate: &pb.WindowUpdate{StreamId: streamID, Increment: increment}},
+	}
+}
+
+// sendWindow is the sending side's credit for one stream direction. A nil
+// *sendWindow means flow control is off and every acquire is granted in full.
+type sendWindow struct {
+	mu     sync.Mutex
+	avail  int64
+	closed bool
+	wake   chan struct{} // cap 1: "credit arrived or closed"
+}
+
+func newSendWindow(initial uint32) *sendWindow {
+	if initial == 0 {
+		return nil
+	}
+	return &sendWindow{avail: int64(initial), wake: make(chan struct{}, 1)}
+}
+
+// acquire waits until some credit is available and takes up to n bytes of it.
+// It returns how many bytes may be sent now, which can be fewer than n: the
+// caller sends that much and asks again, so a large read trickles out as credit
+// returns instead of waiting for the whole of it at once.
+func (w *sendWindow) acquire(ctx context.Context, n int) (int, error) {
+	if w == nil {
+		return n, nil
+	}
+	for {
+		w.mu.Lock()
+		if w.closed {
+			w.mu.Unlock()
+			return 0, errStreamClosed
+		}
+		if w.avail > 0 {
+			take := int64(n)
+			if take > w.avail {
+				take = w.avail
+			}
+			w.avail -= take
+			w.mu.Unlock()
+			return int(take), nil
+		}
+		w.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-w.wake:
+		}
+	}
+}
+
+// grant adds credit returned by the peer.
+func (w *sendWindow) grant(n uint32) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	w.avail += int64(n)
+	w.mu.Unlock()
+	w.signal()
+}
+
+// close releases any acquire waiting on a stream that has ended.
+func (w *sendWindow) close() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	w.closed = true
+	w.mu.Unlock()
+	w.signal()
+}
+
+func (w *sendWindow) signal() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// chunkQueue hands received chunks from the tunnel's receive loop to the
+// goroutine that delivers them (to a socket on the agent, to stdout on the
+// relay), so the receive loop never waits on delivery.
+//
+// With flow control on, the queue can never legitimately hold more than the
+// window, and push reports a peer that overruns it. With flow control off the
+// peer respects no bound, so push falls back to the legacy behavior: block the
+// receive loop while window bytes are queued.
+type chunkQueue struct {
+	window int
+	flow   bool
+
+	mu     sync.Mutex
+	chunks [][]byte
+	bytes  int
+	closed bool
+	err    error         // why the queue was closed; nil for a clean end
+	ready  chan struct{} // cap 1: "chunk queued or closed"
+	space  chan struct{} // cap 1: "queue drained"; legacy back-pressure only
+}
+
+func newChunkQueue(window uint32) *chunkQueue {
+	q := &chunkQueue{
+		window: int(window),
+		flow:   window != 0,
+		ready:  make(chan struct{}, 1),
+		space:  make(chan struct{}, 1),
+	}
+	if !q.flow {
+		q.window = defaultStreamWindow
+	}
+	return q
+}
+
+// push queues a chunk. Pushing to a closed queue drops the chunk: the stream
+// has already ended and there is nobody left to deliver it to.
+func (q *chunkQueue) push(p []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		if q.closed {
+			return nil
+		}
+		if q.flow && q.bytes+len(p) > q.window {
+			return errWindowExceeded
+		}
+		if q.flow || q.bytes < q.window {
+			break
+		}
+		q.mu.Unlock()
+		<-q.space
+		q.mu.Lock()
+	}
+	q.chunks = append(q.chunks, p)
+	q.bytes += len(p)
+	notify(q.ready)
+	return nil
+}
+
+// close ends the queue. Chunks already queued are still delivered; err is what
+// pop reports once they are gone. Only the first close counts.
+func (q *chunkQueue) close(err error) {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		q.err = err
+	}
+	q.mu.Unlock()
+	notify(q.ready)
+	notify(q.space)
+}
+
+// pop waits for the next chunk. ok is false once the queue is closed and
+// drained, with err saying why.
+func (q *chunkQueue) pop(ctx context.Context) (chunk []byte, ok bool, err error) {
+	for {
+		q.mu.Lock()
+		if len(q.chunks) > 0 {
+			chunk = q.chunks[0]
+			q.chunks[0] = nil
+			q.chunks = q.chunks[1:]
+			q.bytes -= len(chunk)
+			q.mu.Unlock()
+			notify(q.space)
+			return chunk, true, nil
+		}
+		if q.closed {
+			err = q.err
+			q.mu.Unlock()
+			return nil, false, err
+		}
+		q.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		case <-q.ready:
+		}
+	}
+}
+
+// notify performs a non-blocking send on a cap-1 signal channel.
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// creditReturner batches WindowUpdates on the receiving side. Returning credit
+// for every chunk would double the frame count; returning it only once a
+// quarter of the window has been delivered keeps the sender busy while costing
+// one small frame per 64 KiB.
+//
+// It cannot deadlock: a sender is stalled only when window bytes are
+// outstanding, and once the receiver delivers them all, delivered >= window >=
+// the threshold, so the update goes out.
+type creditReturner struct {
+	reqID     string
+	streamID  uint32
+	threshold int
+	pending   int
+	send      func(*pb.Frame) error
+}
+
+// newCreditReturner returns nil when flow control is off.
+func newCreditReturner(reqID string, streamID, window uint32, send func(*pb.Frame) error) *creditReturner {
+	if window == 0 {
+		return nil
+	}
+	threshold := int(window) / 4
+	if threshold < 1 {
+		threshold = 1
+	}
+	return &creditReturner{reqID: reqID, streamID: streamID, threshold: threshold, send: send}
+}
+
+// delivered records n bytes handed to the consumer and returns credit once
+// enough has built up.
+func (r *creditReturner) delivered(n int) error {
+	if r == nil || n == 0 {
+		return nil
+	}
+	r.pending += n
+	if r.pending < r.threshold {
+		return nil
+	}
+	inc := r.pending
+	r.pending = 0
+	return r.send(windowUpdateFrame(r.reqID, r.streamID, uint32(inc))) //nolint:gosec // bounded by the window
+}
+
+// sendWindowed sends payload as DataChunks, each no larger than the credit
+// available when it goes out.
+func sendWindowed(ctx context.Context, w *sendWindow, reqID string, streamID uint32, payload []byte, send func(*pb.Frame) error) error {
+	for len(payload) > 0 {
+		n, err := w.acquire(ctx, len(payload))
+		if err != nil {
+			return err
+		}
+		if err := send(dataFrame(reqID, streamID, payload[:n])); err != nil {
+			return err
+		}
+		payload = payload[n:]
+	}
+	return nil
+}
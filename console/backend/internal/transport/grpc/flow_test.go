@@ -0,0 +1,310 @@
+package grpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	pb "github.com/slchris/qubes-air/console/internal/transport/relaypb"
+)
+
+func TestNegotiateWindows(t *testing.T) {
+	cases := []struct {
+		ours, peers uint32
+		want        streamWindows
+	}{
+		{defaultStreamWindow, defaultStreamWindow, streamWindows{defaultStreamWindow, defaultStreamWindow}},
+		{defaultStreamWindow, 4096, streamWindows{send: 4096, recv: defaultStreamWindow}}, // send into the PEER's, receive into ours
+		{4096, defaultStreamWindow, streamWindows{send: defaultStreamWindow, recv: 4096}},
+		{defaultStreamWindow, 0, streamWindows{}}, // peer predates flow control
+		{0, defaultStreamWindow, streamWindows{}}, // we declined it
+	}
+	for _, tc := range cases {
+		if got := negotiateWindows(tc.ours, tc.peers); got != tc.want {
+			t.Errorf("negotiateWindows(%d, %d) = %+v, want %+v", tc.ours, tc.peers, got, tc.want)
+		}
+	}
+	if advertisedWindow(0) != defaultStreamWindow || advertisedWindow(-1) != 0 || advertisedWindow(1024) != 1024 {
+		t.Errorf("advertisedWindow: 0→%d, -1→%d, 1024→%d",
+			advertisedWindow(0), advertisedWindow(-1), advertisedWindow(1024))
+	}
+}
+
+// TestSendWindowWaitsForCredit — a sender with no credit must wait, take no
+// more than it was granted, and be released when the stream ends.
+func TestSendWindowWaitsForCredit(t *testing.T) {
+	ctx := context.Background()
+	w := newSendWindow(10)
+	if n, err := w.acquire(ctx, 25); err != nil || n != 10 {
+		t.Fatalf("first acquire = %d, %v; want the whole window of 10", n, err)
+	}
+
+	got := make(chan int, 1)
+	go func() {
+		n, _ := w.acquire(ctx, 25)
+		got <- n
+	}()
+	select {
+	case n := <-got:
+		t.Fatalf("acquire returned %d with no credit", n)
+	case <-time.After(50 * time.Millisecond):
+	}
+	w.grant(4)
+	if n := <-got; n != 4 {
+		t.Fatalf("acquire after grant(4) = %d", n)
+	}
+
+	done := make(chan error, 1)
+	go func() { _, err := w.acquire(ctx, 1); done <- err }()
+	w.close()
+	if err := <-done; !errors.Is(err, errStreamClosed) {
+		t.Fatalf("acquire on a closed window: %v", err)
+	}
+
+	// No flow control: nothing is ever withheld.
+	var off *sendWindow
+	if n, err := off.acquire(ctx, 1<<20); err != nil || n != 1<<20 {
+		t.Fatalf("nil window acquire = %d, %v", n, err)
+	}
+}
+
+// TestChunkQueueRejectsOverrun — with flow control on, a peer that sends past
+// its window is violating the protocol, and the queue says so instead of
+// buffering it.
+func TestChunkQueueRejectsOverrun(t *testing.T) {
+	q := newChunkQueue(10)
+	if err := q.push(make([]byte, 6)); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.push(make([]byte, 6)); !errors.Is(err, errWindowExceeded) {
+		t.Fatalf("overrun push: want errWindowExceeded, got %v", err)
+	}
+	if _, ok, _ := q.pop(context.Background()); !ok {
+		t.Fatal("pop found nothing")
+	}
+	if err := q.push(make([]byte, 10)); err != nil {
+		t.Fatalf("push after drain: %v", err)
+	}
+
+	// Close keeps what is queued, then reports the cause.
+	cause := errors.New("gone")
+	q.close(cause)
+	if c, ok, _ := q.pop(context.Background()); !ok || len(c) != 10 {
+		t.Fatalf("queued chunk lost on close: %d, %v", len(c), ok)
+	}
+	if _, ok, err := q.pop(context.Background()); ok || !errors.Is(err, cause) {
+		t.Fatalf("drained closed queue = %v, %v", ok, err)
+	}
+}
+
+// TestChunkQueueLegacyBlocks — without flow control the sender respects no
+// bound, so the queue falls back to blocking the receive loop, as before.
+func TestChunkQueueLegacyBlocks(t *testing.T) {
+	q := newChunkQueue(0)
+	if err := q.push(make([]byte, defaultStreamWindow)); err != nil {
+		t.Fatal(err)
+	}
+	pushed := make(chan error, 1)
+	go func() { pushed <- q.push([]byte("x")) }()
+	select {
+	case <-pushed:
+		t.Fatal("legacy push did not block with a full window queued")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, ok, _ := q.pop(context.Background()); !ok {
+		t.Fatal("pop found nothing")
+	}
+	select {
+	case err := <-pushed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("legacy push never unblocked")
+	}
+}
+
+// flowTunnel starts an echo-or-source loopback service, a server forwarding it
+// as "svc", and a connected client. It returns the client.
+func flowTunnel(t *testing.T, serverWindow, clientWindow int, service func(net.Conn)) *Client {
+	t.Helper()
+	svcLis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = svcLis.Close() })
+	go func() {
+		for {
+			c, err := svcLis.Accept()
+			if err != nil {
+				return
+			}
+			go service(c)
+		}
+	}()
+
+	ca, caKey := mkCA(t)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lis.Addr().String()
+	_ = lis.Close()
+
+	srv := NewServer(ServerConfig{
+		Listen:       addr,
+		TLS:          mkServerTLS(t, ca, caKey),
+		Forwards:     &ForwardPolicy{Forwards: []Forward{{Name: "svc", Port: svcLis.Addr().(*net.TCPAddr).Port}}},
+		StreamWindow: serverWindow,
+	}, tagInvoker{})
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() { _ = srv.Serve(ctx) }()
+	waitDial(t, addr)
+
+	cli := NewClient(ClientConfig{
+		RemoteEndpoint: addr, RelayName: "sys-relay", RemoteName: "remote-dev",
+		TLS: mkClientTLS(t, ca, caKey), StreamWindow: clientWindow,
+	}, nil)
+	go func() { _ = cli.Start(ctx) }()
+	if _, err := callWhenReady(t, cli, "remote-dev", "qubesair.Ping", nil); err != nil {
+		t.Fatalf("tunnel: %v", err)
+	}
+	return cli
+}
+
+// TestStalledStreamDoesNotStallTunnel is the reason flow control exists: a
+// stream whose consumer stops reading — a frozen VNC viewer — must not block
+// keepalives or other calls on the same tunnel, and must lose no bytes once
+// its consumer resumes.
+func TestStalledStreamDoesNotStallTunnel(t *testing.T) {
+	payload := make([]byte, 8<<20)
+	if _, err := rand.Read(payload); err != nil {
+		t.Fatal(err)
+	}
+	cli := flowTunnel(t, 0, 0, func(c net.Conn) {
+		_, _ = c.Write(payload)
+		_ = c.Close()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	stdoutR, stdoutW := io.Pipe()
+	streamErr := make(chan error, 1)
+	go func() {
+		// stdin never ends: the stream is held open by the response side only.
+		stdinR, _ := io.Pipe()
+		err := cli.CallStream(ctx, "remote-dev", streamServicePrefix+"svc", stdinR, stdoutW)
+		_ = stdoutW.CloseWithError(err)
+		streamErr <- err
+	}()
+
+	// Nobody reads stdout yet. Ordinary calls must still get through.
+	time.Sleep(200 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		callCtx, c := context.WithTimeout(ctx, 2*time.Second)
+		_, err := cli.Call(callCtx, "remote-dev", "qubesair.Ping", []byte(strconv.Itoa(i)))
+		c()
+		if err != nil {
+			t.Fatalf("call %d behind a stalled stream: %v", i, err)
+		}
+	}
+
+	got, err := io.ReadAll(stdoutR)
+	if err != nil {
+		t.Fatalf("read stream: %v", err)
+	}
+	if sha256.Sum256(got) != sha256.Sum256(payload) {
+		t.Fatalf("stream delivered %d bytes that do not match the %d sent", len(got), len(payload))
+	}
+	if err := <-streamErr; err != nil {
+		t.Fatalf("stream ended with %v", err)
+	}
+}
+
+// TestFlowControlWithLegacyPeer — a peer that advertises no window (any build
+// from before flow control) must still carry streams in both directions, with
+// neither side waiting for credit the other will never send. So must two peers
+// configured with different windows.
+func TestFlowControlWithLegacyPeer(t *testing.T) {
+	echo := func(c net.Conn) { _, _ = io.Copy(c, c); _ = c.Close() }
+	for name, w := range map[string][2]int{
+		"legacy server":  {-1, 0},
+		"legacy client":  {0, -1},
+		"both windowed":  {0, 0},
+		"small windows":  {4096, 4096},
+		"smaller server": {4096, 0},
+		"smaller client": {0, 4096},
+	} {
+		t.Run(name, func(t *testing.T) {
+			cli := flowTunnel(t, w[0], w[1], echo)
+			payload := make([]byte, 1<<20)
+			if _, err := rand.Read(payload); err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			var out bytes.Buffer
+			if err := cli.CallStream(ctx, "remote-dev", streamServicePrefix+"svc", bytes.NewReader(payload), &out); err != nil {
+				t.Fatalf("stream: %v", err)
+			}
+			if !bytes.Equal(out.Bytes(), payload) {
+				t.Fatalf("echoed %d bytes, want %d identical", out.Len(), len(payload))
+			}
+		})
+	}
+}
+
+// scriptedStream delivers frames in order, then ends.
+type scriptedStream struct {
+	silentStream
+	frames []*pb.Frame
+}
+
+func (s *scriptedStream) Recv() (*pb.Frame, error) {
+	if len(s.frames) == 0 {
+		return nil, io.EOF
+	}
+	f := s.frames[0]
+	s.frames = s.frames[1:]
+	return f, nil
+}
+
+// TestWindowUpdateOnlyFromTheStreamsTunnel — credit for a stream's request
+// chunks is taken only from the tunnel the stream runs on. A peer on another
+// tunnel of the same client naming the stream's request_id grants nothing.
+func TestWindowUpdateOnlyFromTheStreamsTunnel(t *testing.T) {
+	cli := NewClient(ClientConfig{RemoteName: "remote-dev"}, nil)
+	owner := &tunnel{stream: silentStream{ctx: context.Background()}}
+	win := newSendWindow(16)
+	cli.mu.Lock()
+	cli.streams["s1"] = &pendingStream{t: owner, queue: newChunkQueue(16), win: win}
+	cli.mu.Unlock()
+	avail := func() int64 {
+		win.mu.Lock()
+		defer win.mu.Unlock()
+		return win.avail
+	}
+
+	grant := windowUpdateFrame("s1", streamRequest, 1<<20)
+	other := &tunnel{stream: &scriptedStream{frames: []*pb.Frame{grant}}}
+	if err := cli.recvLoop(context.Background(), other); !errors.Is(err, io.EOF) {
+		t.Fatalf("recvLoop = %v", err)
+	}
+	if got := avail(); got != 16 {
+		t.Fatalf("window = %d after a grant from another tunnel, want 16", got)
+	}
+
+	owner.stream = &scriptedStream{frames: []*pb.Frame{grant}}
+	_ = cli.recvLoop(context.Background(), owner)
+	if got := avail(); got != 16+1<<20 {
+		t.Errorf("window = %d after the owning tunnel's grant", got)
+	}
+}
@@ -0,0 +1,325 @@
+// forward.go — which local endpoints a qubesair.StreamTCP request may reach.
+//
+// A stream request asks the agent to open a socket on ITS host and splice it
+// onto the tunnel. That is the most powerful thing the tunnel can do: whatever
+// the agent can connect to, an authenticated caller can talk to. So the set of
+// reachable endpoints is an explicit, named list the operator wrote down, not a
+// range baked into the server — the old hard-coded GUI ranges are now simply
+// the default policy an agent gets when it is given none.
+
+package grpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/slchris/qubes-air/console/internal/transport"
+	"gopkg.in/yaml.v3"
+)
+
+// ServiceListForwards is the builtin through which a relay or the console asks
+// an agent what it forwards. BUILTIN because the answer is this process's own
+// policy; a script in ServiceDir could only guess at it.
+const ServiceListForwards = "qubesair.ListForwards"
+
+// defaultForwardBind is where a TCP forward dials when its bind is unset.
+// Loopback, so a forward reaches a service that is deliberately not on the LAN.
+const defaultForwardBind = "127.0.0.1"
+
+// Forward is one endpoint a stream request may be spliced onto.
+type Forward struct {
+	// Name addresses the forward as "qubesair.StreamTCP+<name>". Required, and
+	// never all digits: a numeric argument is a port, and a name that looked
+	// like one would make the two spellings ambiguous.
+	Name string `yaml:"name" json:"name"`
+	// Port is the TCP port dialed, and also addresses the forward as
+	// "qubesair.StreamTCP+<port>" — the spelling every existing GUI caller uses.
+	Port int `yaml:"port,omitempty" json:"port,omitempty"`
+	// PortMax, when set, widens Port into the inclusive range Port..PortMax. A
+	// range is reachable by port only: a name cannot say which port it means.
+	PortMax int `yaml:"port_max,omitempty" json:"port_max,omitempty"`
+	// Bind is the address dialed (default 127.0.0.1). It must be an IP literal;
+	// a hostname would make the policy depend on whatever the resolver says.
+	Bind string `yaml:"bind,omitempty" json:"bind,omitempty"`
+	// Unix, when set, is a socket path dialed instead of Bind:Port.
+	Unix string `yaml:"unix,omitempty" json:"unix,omitempty"`
+	// Hosts, when set, makes this a gateway forward: instead of one fixed
+	// address it reaches Port on any host inside these CIDRs, addressed as
+	// "qubesair.StreamTCP+<name>+<ip>". It is how a relay sitting on a zone's
+	// private network carries the console's agent connections into a zone the
+	// console has no route to. Still a list the operator wrote: a gateway
+	// forward reaches one port on the networks named here, never "anywhere".
+	// IPv4 only in practice: a service name cannot carry the colons of an
+	// IPv6 literal.
+	Hosts []string `yaml:"hosts,omitempty" json:"hosts,omitempty"`
+	// Roles lists the caller roles (see CallerRole) allowed to use the forward.
+	// Empty means any authenticated caller, which is what the GUI forwards have
+	// always allowed.
+	Roles []string `yaml:"roles,omitempty" json:"roles,omitempty"`
+}
+
+// ForwardPolicy is the full set of forwards an agent serves.
+type ForwardPolicy struct {
+	Forwards []Forward `yaml:"forwards" json:"forwards"`
+}
+
+// Forward policy errors. Both reach the caller as the same CodeForwardDenied
+// message and are told apart only in the agent's log: answering "no such
+// forward" differently from "not for you" would let a caller map the policy by
+// probing.
+var (
+	// ErrForwardNotConfigured means no forward matches the request.
+	ErrForwardNotConfigured = errors.New("no forward is configured for this request")
+	// ErrForwardRoleDenied means a forward matched but the caller's role may not use it.
+	ErrForwardRoleDenied = errors.New("caller role may not use this forward")
+	// ErrInvalidForwardPolicy means a policy failed validation at load.
+	ErrInvalidForwardPolicy = errors.New("invalid forward policy")
+)
+
+// DefaultForwardPolicy is what an agent serves when it is given no policy: the
+// two loopback GUI ranges the server used to hard-code, VNC on 5900-5910 and
+// Xpra (and other GUI servers) on 10000-10010. Keeping them as the default is
+// what lets an agent upgrade without its GUI path changing underneath it.
+func DefaultForwardPolicy() *ForwardPolicy {
+	return &ForwardPolicy{Forwards: []Forward{
+		{Name: "vnc", Port: 5900, PortMax: 5910},
+		{Name: "gui", Port: 10000, PortMax: 10010},
+	}}
+}
+
+// LoadForwardPolicy reads and validates a YAML forward policy.
+//
+// A policy that fails validation is an error, never a partial load: dropping
+// the one bad entry would leave the agent serving something other than what
+// the operator wrote, and the difference would only surface as a refused
+// connection somewhere far from the file.
+func LoadForwardPolicy(path string) (*ForwardPolicy, error) {
+	data, err := os.ReadFile(path) // #nosec G304 -- operator-supplied path
+	if err != nil {
+		return nil, fmt.Errorf("read forward policy: %w", err)
+	}
+	var p ForwardPolicy
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	// Unknown keys are rejected: "role:" for "roles:" would otherwise silently
+	// open a forward to every caller.
+	dec.KnownFields(true)
+	if err := dec.Decode(&p); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrInvalidForwardPolicy, path, err)
+	}
+	if err := p.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &p, nil
+}
+
+// Validate checks every forward and that no two can answer the same request.
+//
+//nolint:gocyclo // one check per field, each independent
+func (p *ForwardPolicy) Validate() error {
+	names := make(map[string]bool, len(p.Forwards))
+	for i, f := range p.Forwards {
+		bad := func(format string, args ...any) error {
+			return fmt.Errorf("%w: forward %d (%q): %s", ErrInvalidForwardPolicy, i, f.Name, fmt.Sprintf(format, args...))
+		}
+		if !transport.ValidName(f.Name) || strings.Contains(f.Name, "+") {
+			return bad("name must be non-empty and use only [A-Za-z0-9._-]")
+		}
+		if _, err := strconv.Atoi(f.Name); err == nil {
+			return bad("name must not be a number (numbers address ports)")
+		}
+		if names[f.Name] {
+			return bad("duplicate name")
+		}
+		names[f.Name] = true
+
+		if f.Port < 0 || f.Port > 65535 || f.PortMax < 0 || f.PortMax > 65535 {
+			return bad("port out of range")
+		}
+		if f.PortMax != 0 && f.PortMax < f.Port {
+			return bad("port_max %d is below port %d", f.PortMax, f.Port)
+		}
+		if f.PortMax != 0 && f.Port == 0 {
+			return bad("port_max needs port")
+		}
+		if f.Unix == "" && f.Port == 0 {
+			return bad("needs a port or a unix socket path")
+		}
+		if f.Unix != "" {
+			if !filepath.IsAbs(f.Unix) || filepath.Clean(f.Unix) != f.Unix {
+				return bad("unix socket path %q must be absolute and clean", f.Unix)
+			}
+			if f.Bind != "" {
+				return bad("bind and unix are mutually exclusive")
+			}
+			if f.PortMax != 0 {
+				return bad("a unix forward cannot span a port range")
+			}
+		}
+		if f.Bind != "" && net.ParseIP(f.Bind) == nil {
+			return bad("bind %q is not an IP address", f.Bind)
+		}
+		if len(f.Hosts) > 0 {
+			if f.Unix != "" || f.Bind != "" || f.PortMax != 0 {
+				return bad("hosts takes a single port and excludes bind and unix")
+			}
+			for _, h := range f.Hosts {
+				if _, _, err := net.ParseCIDR(h); err != nil {
+					return bad("host range %q is not a CIDR", h)
+				}
+			}
+		}
+		for _, r := range f.Roles {
+			if r == "" {
+				return bad("empty role")
+			}
+		}
+	}
+	// Overlapping ports would make "StreamTCP+<port>" resolve to whichever
+	// forward happens to come first — and the two may differ in who may use
+	// them, so order in a file would quietly become an access decision.
+	for i := range p.Forwards {
+		for j := i + 1; j < len(p.Forwards); j++ {
+			a, b := p.Forwards[i], p.Forwards[j]
+			// Gateway forwards are never addressed by port, so they cannot
+			// collide with anything that is.
+			if a.Port == 0 || b.Port == 0 || len(a.Hosts) > 0 || len(b.Hosts) > 0 {
+				continue
+			}
+			if a.Port <= b.lastPort() && b.Port <= a.lastPort() {
+				return fmt.Errorf("%w: forwards %q and %q overlap on ports", ErrInvalidForwardPolicy, a.Name, b.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// lastPort is the top of the forward's range (Port when it is a single port).
+func (f Forward) lastPort() int {
+	if f.PortMax != 0 {
+		return f.PortMax
+	}
+	return f.Port
+}
+
+// allows reports whether a caller with role may use the forward.
+func (f Forward) allows(role string) bool {
+	if len(f.Roles) == 0 {
+		return true
+	}
+	for _, r := range f.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// admits reports whether a gateway forward reaches ip.
+func (f Forward) admits(ip net.IP) bool {
+	for _, h := range f.Hosts {
+		if _, n, err := net.ParseCIDR(h); err == nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve maps a stream request's argument — a port, a forward name, or a
+// gateway forward's "name+ip" — and the caller's role to the network and
+// address to dial.
+func (p *ForwardPolicy) Resolve(arg, role string) (network, address string, err error) {
+	if name, host, ok := strings.Cut(arg, "+"); ok {
+		return p.resolveGateway(name, host, role)
+	}
+	f, port, err := p.match(arg)
+	if err != nil {
+		return "", "", err
+	}
+	if !f.allows(role) {
+		return "", "", fmt.Errorf("%w: %q (role %q)", ErrForwardRoleDenied, f.Name, role)
+	}
+	if f.Unix != "" {
+		return "unix", f.Unix, nil
+	}
+	bind := f.Bind
+	if bind == "" {
+		bind = defaultForwardBind
+	}
+	return "tcp", net.JoinHostPort(bind, strconv.Itoa(port)), nil
+}
+
+// resolveGateway resolves "name+ip" against a gateway forward. The host must be
+// an IP literal inside one of the forward's ranges; a hostname would make the
+// policy depend on the gateway's resolver, the same reason Bind refuses one.
+func (p *ForwardPolicy) resolveGateway(name, host, role string) (network, address string, err error) {
+	ip := net.ParseIP(host)
+	for _, f := range p.Forwards {
+		if f.Name != name || len(f.Hosts) == 0 {
+			continue
+		}
+		if ip == nil || !f.admits(ip) {
+			return "", "", fmt.Errorf("%w: %q does not reach %q", ErrForwardNotConfigured, name, host)
+		}
+		if !f.allows(role) {
+			return "", "", fmt.Errorf("%w: %q (role %q)", ErrForwardRoleDenied, f.Name, role)
+		}
+		return "tcp", net.JoinHostPort(ip.String(), strconv.Itoa(f.Port)), nil
+	}
+	return "", "", fmt.Errorf("%w: no gateway forward %q", ErrForwardNotConfigured, name)
+}
+
+// match finds the forward an argument addresses, and the port it selects.
+// Gateway forwards are skipped: without a host they do not say where to dial.
+func (p *ForwardPolicy) match(arg string) (Forward, int, error) {
+	if n, err := strconv.Atoi(arg); err == nil {
+		for _, f := range p.Forwards {
+			if len(f.Hosts) > 0 {
+				continue
+			}
+			if f.Port != 0 && n >= f.Port && n <= f.lastPort() {
+				return f, n, nil
+			}
+		}
+		return Forward{}, 0, fmt.Errorf("%w: port %d", ErrForwardNotConfigured, n)
+	}
+	for _, f := range p.Forwards {
+		if f.Name != arg {
+			continue
+		}
+		if len(f.Hosts) > 0 {
+			return Forward{}, 0, fmt.Errorf("%w: %q is a gateway; address it as name+ip", ErrForwardNotConfigured, arg)
+		}
+		if f.PortMax != 0 {
+			return Forward{}, 0, fmt.Errorf("%w: %q is a port range; address it by port", ErrForwardNotConfigured, arg)
+		}
+		return f, f.Port, nil
+	}
+	return Forward{}, 0, fmt.Errorf("%w: %q", ErrForwardNotConfigured, arg)
+}
+
+// ListBuiltin answers ServiceListForwards with the policy as JSON. Its
+// signature is agent.Builtin's, so an agent registers it directly.
+//
+// Every forward is listed regardless of the caller's role. The list is what a
+// relay or console needs to offer a user a choice; the decision is made again
+// on every stream request, so hiding an entry here would protect nothing.
+func (p *ForwardPolicy) ListBuiltin(_ context.Context, _ string, _ []byte) ([]byte, error) {
+	return json.Marshal(p)
+}
+
+// CallerRole derives a caller's role from its certificate common name: the
+// part before the first '-'. Every certificate this CA issues is named that
+// way — "console-probe", "relay-<qube>", "agent-<qube>" — so the role is a
+// property the issuer already pins, not something a caller can choose.
+func CallerRole(commonName string) string {
+	role, _, _ := strings.Cut(commonName, "-")
+	return role
+}
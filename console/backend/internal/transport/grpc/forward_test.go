@@ -0,0 +1,321 @@
+package grpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestDefaultForwardPolicyKeepsGUIRanges — an agent given no policy must reach
+// exactly what the server used to hard-code, or upgrading it would break GUI.
+func TestDefaultForwardPolicyKeepsGUIRanges(t *testing.T) {
+	p := DefaultForwardPolicy()
+	if err := p.Validate(); err != nil {
+		t.Fatalf("default policy invalid: %v", err)
+	}
+	for _, port := range []int{5900, 5905, 5910, 10000, 10010} {
+		network, addr, err := p.Resolve(strconv.Itoa(port), "relay")
+		if err != nil {
+			t.Errorf("port %d: %v", port, err)
+			continue
+		}
+		if network != "tcp" || addr != "127.0.0.1:"+strconv.Itoa(port) {
+			t.Errorf("port %d resolved to %s %s", port, network, addr)
+		}
+	}
+	for _, port := range []string{"22", "5899", "5911", "9999", "10011", "5432"} {
+		if _, _, err := p.Resolve(port, "relay"); !errors.Is(err, ErrForwardNotConfigured) {
+			t.Errorf("port %s: want ErrForwardNotConfigured, got %v", port, err)
+		}
+	}
+}
+
+func TestForwardPolicyResolve(t *testing.T) {
+	p := &ForwardPolicy{Forwards: []Forward{
+		{Name: "postgres", Port: 5432, Roles: []string{"relay"}},
+		{Name: "web", Port: 8080, Bind: "10.0.3.2"},
+		{Name: "app", Unix: "/run/app.sock", Roles: []string{"console"}},
+	}}
+	if err := p.Validate(); err != nil {
+		t.Fatalf("policy invalid: %v", err)
+	}
+
+	cases := []struct {
+		arg, role     string
+		network, addr string
+		err           error
+	}{
+		{arg: "5432", role: "relay", network: "tcp", addr: "127.0.0.1:5432"},
+		{arg: "postgres", role: "relay", network: "tcp", addr: "127.0.0.1:5432"},
+		{arg: "postgres", role: "console", err: ErrForwardRoleDenied},
+		{arg: "web", role: "anything", network: "tcp", addr: "10.0.3.2:8080"},
+		{arg: "app", role: "console", network: "unix", addr: "/run/app.sock"},
+		{arg: "app", role: "relay", err: ErrForwardRoleDenied},
+		{arg: "redis", role: "relay", err: ErrForwardNotConfigured},
+		{arg: "6379", role: "relay", err: ErrForwardNotConfigured},
+	}
+	for _, tc := range cases {
+		network, addr, err := p.Resolve(tc.arg, tc.role)
+		if tc.err != nil {
+			if !errors.Is(err, tc.err) {
+				t.Errorf("%s as %s: want %v, got %v", tc.arg, tc.role, tc.err, err)
+			}
+			continue
+		}
+		if err != nil || network != tc.network || addr != tc.addr {
+			t.Errorf("%s as %s: got (%s, %s, %v), want (%s, %s)",
+				tc.arg, tc.role, network, addr, err, tc.network, tc.addr)
+		}
+	}
+}
+
+// TestForwardPolicyRangeNeedsPort — a range has no single port a name could
+// mean, so naming it must be refused rather than picking one.
+func TestForwardPolicyRangeNeedsPort(t *testing.T) {
+	if _, _, err := DefaultForwardPolicy().Resolve("vnc", "relay"); !errors.Is(err, ErrForwardNotConfigured) {
+		t.Fatalf("naming a range: want ErrForwardNotConfigured, got %v", err)
+	}
+}
+
+func TestForwardPolicyValidateRejects(t *testing.T) {
+	cases := map[string]Forward{
+		"no name":        {Port: 80},
+		"numeric name":   {Name: "5432", Port: 5432},
+		"bad name":       {Name: "a/b", Port: 80},
+		"no target":      {Name: "x"},
+		"port too large": {Name: "x", Port: 70000},
+		"inverted range": {Name: "x", Port: 90, PortMax: 80},
+		"hostname bind":  {Name: "x", Port: 80, Bind: "db.internal"},
+		"relative unix":  {Name: "x", Unix: "run/app.sock"},
+		"unix and bind":  {Name: "x", Unix: "/run/a.sock", Bind: "127.0.0.1"},
+		"empty role":     {Name: "x", Port: 80, Roles: []string{""}},
+		"bad host range": {Name: "x", Port: 80, Hosts: []string{"10.0.0.1"}},
+		"hosts and bind": {Name: "x", Port: 80, Hosts: []string{"10.0.0.0/8"}, Bind: "127.0.0.1"},
+		"hosts range":    {Name: "x", Port: 80, PortMax: 90, Hosts: []string{"10.0.0.0/8"}},
+	}
+	for name, f := range cases {
+		p := &ForwardPolicy{Forwards: []Forward{f}}
+		if err := p.Validate(); !errors.Is(err, ErrInvalidForwardPolicy) {
+			t.Errorf("%s: want ErrInvalidForwardPolicy, got %v", name, err)
+		}
+	}
+
+	// Overlap: order in the file must never decide who may use a port.
+	overlap := &ForwardPolicy{Forwards: []Forward{
+		{Name: "a", Port: 5900, PortMax: 5910},
+		{Name: "b", Port: 5905, Roles: []string{"console"}},
+	}}
+	if err := overlap.Validate(); !errors.Is(err, ErrInvalidForwardPolicy) {
+		t.Errorf("overlapping ports: want ErrInvalidForwardPolicy, got %v", err)
+	}
+	dup := &ForwardPolicy{Forwards: []Forward{{Name: "a", Port: 1}, {Name: "a", Port: 2}}}
+	if err := dup.Validate(); !errors.Is(err, ErrInvalidForwardPolicy) {
+		t.Errorf("duplicate names: want ErrInvalidForwardPolicy, got %v", err)
+	}
+}
+
+// TestForwardPolicyGateway — a gateway forward reaches its one port on hosts
+// inside its ranges, only when addressed with a host, and never shadows a
+// loopback forward on the same port.
+func TestForwardPolicyGateway(t *testing.T) {
+	p := &ForwardPolicy{Forwards: []Forward{
+		{Name: "agents", Port: 8443, Hosts: []string{"10.20.0.0/16"}, Roles: []string{"console"}},
+		{Name: "local-agent", Port: 8443},
+	}}
+	if err := p.Validate(); err != nil {
+		t.Fatalf("policy invalid: %v", err)
+	}
+
+	network, addr, err := p.Resolve("agents+10.20.3.4", "console")
+	if err != nil || network != "tcp" || addr != "10.20.3.4:8443" {
+		t.Fatalf("agents+10.20.3.4 = (%s, %s, %v)", network, addr, err)
+	}
+	cases := map[string]struct {
+		arg, role string
+		err       error
+	}{
+		"outside the range": {arg: "agents+10.21.0.1", role: "console", err: ErrForwardNotConfigured},
+		"not an ip":         {arg: "agents+db.internal", role: "console", err: ErrForwardNotConfigured},
+		"wrong role":        {arg: "agents+10.20.3.4", role: "relay", err: ErrForwardRoleDenied},
+		"no host":           {arg: "agents", role: "console", err: ErrForwardNotConfigured},
+		"not a gateway":     {arg: "local-agent+10.20.3.4", role: "console", err: ErrForwardNotConfigured},
+	}
+	for name, tc := range cases {
+		if _, _, err := p.Resolve(tc.arg, tc.role); !errors.Is(err, tc.err) {
+			t.Errorf("%s: want %v, got %v", name, tc.err, err)
+		}
+	}
+	if _, addr, err := p.Resolve("8443", "console"); err != nil || addr != "127.0.0.1:8443" {
+		t.Errorf("port 8443 = (%s, %v), want the loopback forward", addr, err)
+	}
+}
+
+func TestLoadForwardPolicy(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "forwards.yaml")
+	if err := os.WriteFile(good, []byte(`forwards:
+  - name: postgres
+    port: 5432
+    roles: [relay]
+  - name: grafana
+    port: 3000
+`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := LoadForwardPolicy(good)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if len(p.Forwards) != 2 || p.Forwards[0].Roles[0] != "relay" {
+		t.Fatalf("loaded %+v", p.Forwards)
+	}
+
+	// A misspelled key must fail the load, not open the forward to everyone.
+	typo := filepath.Join(dir, "typo.yaml")
+	if err := os.WriteFile(typo, []byte("forwards:\n  - name: pg\n    port: 5432\n    role: [relay]\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadForwardPolicy(typo); !errors.Is(err, ErrInvalidForwardPolicy) {
+		t.Fatalf("unknown key: want ErrInvalidForwardPolicy, got %v", err)
+	}
+}
+
+func TestListBuiltinReportsPolicy(t *testing.T) {
+	p := &ForwardPolicy{Forwards: []Forward{{Name: "postgres", Port: 5432, Roles: []string{"relay"}}}}
+	out, err := p.ListBuiltin(context.Background(), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got ForwardPolicy
+	if err := json.Unmarshal(out, &got); err != nil {
+		t.Fatalf("reply is not JSON: %v: %s", err, out)
+	}
+	if len(got.Forwards) != 1 || got.Forwards[0].Name != "postgres" || got.Forwards[0].Port != 5432 {
+		t.Fatalf("listed %+v", got.Forwards)
+	}
+}
+
+func TestCallerRole(t *testing.T) {
+	for cn, want := range map[string]string{
+		"console-probe":   "console",
+		"relay-sys-relay": "relay",
+		"agent-remote-1":  "agent",
+		"pingcheck":       "pingcheck",
+		"":                "",
+	} {
+		if got := CallerRole(cn); got != want {
+			t.Errorf("CallerRole(%q) = %q, want %q", cn, got, want)
+		}
+	}
+}
+
+// TestStreamNamedForwardAndDenial drives the policy through a real tunnel: a
+// named forward outside the GUI ranges is reachable, a forward reserved for
+// another role is refused with CodeForwardDenied, and so is an unlisted port.
+func TestStreamNamedForwardAndDenial(t *testing.T) {
+	echoLis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echoLis.Close()
+	go func() {
+		for {
+			c, err := echoLis.Accept()
+			if err != nil {
+				return
+			}
+			go func() { _, _ = io.Copy(c, c); _ = c.Close() }()
+		}
+	}()
+	echoPort := echoLis.Addr().(*net.TCPAddr).Port
+
+	ca, caKey := mkCA(t)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lis.Addr().String()
+	_ = lis.Close()
+
+	// The test client's certificate is "sys-relay", so its role is "sys".
+	srv := NewServer(ServerConfig{
+		Listen: addr,
+		TLS:    mkServerTLS(t, ca, caKey),
+		Forwards: &ForwardPolicy{Forwards: []Forward{
+			{Name: "db", Port: echoPort, Roles: []string{"sys"}},
+			{Name: "admin", Port: 1, Roles: []string{"console"}},
+		}},
+	}, tagInvoker{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = srv.Serve(ctx) }()
+	waitDial(t, addr)
+
+	cli := NewClient(ClientConfig{
+		RemoteEndpoint: addr, RelayName: "sys-relay", RemoteName: "remote-dev",
+		TLS: mkClientTLS(t, ca, caKey),
+	}, nil)
+	go func() { _ = cli.Start(ctx) }()
+	if _, err := callWhenReady(t, cli, "remote-dev", "qubesair.Ping", nil); err != nil {
+		t.Fatalf("tunnel: %v", err)
+	}
+
+	stdinR, stdinW := io.Pipe()
+	stdoutR, stdoutW := io.Pipe()
+	go func() {
+		err := cli.CallStream(ctx, "remote-dev", streamServicePrefix+"db", stdinR, stdoutW)
+		_ = stdoutW.CloseWithError(err)
+	}()
+	go func() { _, _ = stdinW.Write([]byte("select 1")) }()
+	got := make([]byte, len("select 1"))
+	done := make(chan error, 1)
+	go func() { _, e := io.ReadFull(stdoutR, got); done <- e }()
+	select {
+	case e := <-done:
+		if e != nil || string(got) != "select 1" {
+			t.Fatalf("named forward echo = %q, %v", got, e)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("named forward never echoed")
+	}
+	_ = stdinW.Close()
+
+	for _, arg := range []string{"admin", "5900", "nope"} {
+		err := cli.CallStream(ctx, "remote-dev", streamServicePrefix+arg, strings.NewReader(""), io.Discard)
+		if !IsRemoteCode(err, CodeForwardDenied) {
+			t.Errorf("stream %q: want %s, got %v", arg, CodeForwardDenied, err)
+		}
+	}
+}
+
+// swappableForwards is a ForwardSource whose policy a test replaces.
+type swappableForwards struct{ p atomic.Pointer[ForwardPolicy] }
+
+func (s *swappableForwards) ForwardPolicy() *ForwardPolicy { return s.p.Load() }
+
+// TestForwardSourceIsReadPerRequest — a reloaded policy governs the next
+// stream request without rebuilding the server.
+func TestForwardSourceIsReadPerRequest(t *testing.T) {
+	src := &swappableForwards{}
+	srv := NewServer(ServerConfig{ForwardSource: src, Forwards: DefaultForwardPolicy()}, nil)
+
+	if _, _, err := srv.forwards().Resolve("5900", ""); err != nil {
+		t.Fatalf("an empty source should fall back to Forwards: %v", err)
+	}
+	src.p.Store(&ForwardPolicy{Forwards: []Forward{{Name: "db", Port: 5432}}})
+	if _, _, err := srv.forwards().Resolve("5900", ""); err == nil {
+		t.Error("the replaced policy still served VNC")
+	}
+	if _, addr, err := srv.forwards().Resolve("db", ""); err != nil || addr != "127.0.0.1:5432" {
+		t.Errorf("Resolve(db) = %q, %v", addr, err)
+	}
+}
@@ -1,6 +1,7 @@
 package grpc
 
 import (
+	"context"
 	"fmt"
 	"sort"
 
@@ -22,7 +23,21 @@ const (
 // Bump it only when the frame format or its semantics change — NOT when the
 // binary is released. Conflating the two would make every release an
 // incompatible one and break every agent in the field.
-const protocolVersion = "v1"
+//
+// v2 adds Capabilities to the Handshake and the rule that optional features are
+// used only when the peer declared them (see capabilities.go). A v2 server
+// still serves v1 relays, and a v2 client that is refused by a v1-only agent
+// retries as v1 — so either side can be upgraded first.
+const protocolVersion = "v2"
+
+// oldestProtocolVersion is what a client falls back to when its peer refuses
+// protocolVersion.
+const oldestProtocolVersion = "v1"
+
+// ProtocolVersion is protocolVersion for other packages: the newest wire
+// version this build offers, which is what a release manifest's min-protocol
+// is checked against on the console.
+const ProtocolVersion = protocolVersion
 
 // supportedProtocolVersions is every wire version this build can serve.
 //
@@ -31,11 +46,14 @@ const protocolVersion = "v1"
 // be upgraded in either order.
 var supportedProtocolVersions = map[string]bool{
 	"v1": true,
+	"v2": true,
 }
 
-// BuildVersion is this binary's build version, reported in the handshake for
-// observability only. It never participates in compatibility decisions.
-// Overridden at link time with -ldflags "-X ...BuildVersion=x.y.z".
+// BuildVersion is this binary's build version, reported in the handshake. It
+// never participates in protocol compatibility decisions; the console judges
+// an agent's build against its configured minimum, which is policy about the
+// build, not about the wire. Set from main's own stamped version, or at link
+// time with -ldflags "-X ...BuildVersion=x.y.z".
 var BuildVersion = "dev"
 
 // supportsProtocol reports whether this build can serve the given wire version.
@@ -59,13 +77,19 @@ func protocolMismatchMessage(got string) string {
 		got, supported)
 }
 
-func handshakeFrame(relayName, remoteName string) *pb.Frame {
+// handshakeFrame builds this side's Handshake at the current protocol version.
+// window is the stream receive window it advertises; zero declines flow
+// control (see flow.go). The capabilities list no services — an executor adds
+// its own.
+func handshakeFrame(relayName, remoteName string, window uint32) *pb.Frame {
 	return &pb.Frame{
 		Kind: &pb.Frame_Handshake{Handshake: &pb.Handshake{
 			ProtocolVersion: protocolVersion,
 			RelayName:       relayName,
 			RemoteName:      remoteName,
 			BuildVersion:    BuildVersion,
+			InitialWindow:   window,
+			Capabilities:    localCapabilities(window, nil),
 		}},
 	}
 }
@@ -90,6 +114,19 @@ func dataFrame(reqID string, streamID uint32, payload []byte) *pb.Frame {
 	}
 }
 
+// sendChunked sends payload as DataChunks of at most size bytes. An empty
+// payload sends nothing: EOS alone says "no body".
+func sendChunked(reqID string, streamID uint32, payload []byte, size int, send func(*pb.Frame) error) error {
+	for len(payload) > 0 {
+		n := min(len(payload), size)
+		if err := send(dataFrame(reqID, streamID, payload[:n])); err != nil {
+			return err
+		}
+		payload = payload[n:]
+	}
+	return nil
+}
+
 func eosFrame(reqID string, streamID uint32) *pb.Frame {
 	return &pb.Frame{
 		RequestId: reqID,
@@ -104,6 +141,13 @@ func errorFrame(reqID, code, msg string) *pb.Frame {
 	}
 }
 
+func cancelFrame(reqID, reason string) *pb.Frame {
+	return &pb.Frame{
+		RequestId: reqID,
+		Kind:      &pb.Frame_Cancel{Cancel: &pb.Cancel{Reason: reason}},
+	}
+}
+
 func keepAliveFrame(unixMs int64) *pb.Frame {
 	return &pb.Frame{
 		Kind: &pb.Frame_KeepAlive{KeepAlive: &pb.KeepAlive{UnixMs: unixMs}},
@@ -134,6 +178,17 @@ const (
 	CodeUnavailable = "UNAVAILABLE"
 	// CodeInternal: an unexpected failure.
 	CodeInternal = "INTERNAL"
+	// CodeForwardDenied: the agent's forward policy does not grant this stream
+	// request — no such forward, or not for the caller's role. Distinct from
+	// CodeDenied so a caller can tell "that port is not offered" from "that
+	// service refused", which call for different fixes on different hosts.
+	CodeForwardDenied = "FORWARD_DENIED"
+	// CodeCanceled: the caller canceled the call before it finished. Sent back
+	// only for the record — the caller has already stopped waiting.
+	CodeCanceled = "CANCELED"
+	// CodeLimited: the relay's reverse policy refused a call over its rate or
+	// concurrency limit. Unlike CodeDenied, the same call may succeed later.
+	CodeLimited = "LIMITED"
 )
 
 // orUnknown renders an empty version as something readable in a log line.
@@ -143,3 +198,13 @@ func orUnknown(v string) string {
 	}
 	return v
 }
+
+// frameStream is one bidi Frame stream, as either end of either RPC sees it:
+// a Tunnel the relay dialed or an Attach the agent dialed, from the client or
+// the server side. The protocol on it is the same in all four cases, so the
+// code driving it takes this and never asks which.
+type frameStream interface {
+	Send(*pb.Frame) error
+	Recv() (*pb.Frame, error)
+	Context() context.Context
+}
@@ -0,0 +1,86 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordingGate refuses one service and remembers who asked for what.
+type recordingGate struct {
+	mu     sync.Mutex
+	seen   []string
+	refuse string
+}
+
+func (g *recordingGate) Admit(peerCN, service string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.seen = append(g.seen, peerCN+" "+service)
+	if service == g.refuse {
+		return errors.New("not now")
+	}
+	return nil
+}
+
+// callerInvoker answers with the caller's certificate name as the server saw it.
+type callerInvoker struct{}
+
+func (callerInvoker) Invoke(ctx context.Context, _, _ string, _ []byte) ([]byte, error) {
+	return []byte(CallerCommonName(ctx)), nil
+}
+
+// TestCallGateSeesEveryCallAndRefusesBeforeDispatch — the gate is asked with
+// the verified certificate name, a refusal reaches the caller as DENIED, and
+// the refused call's body never reaches the invoker or comes back as if it
+// were a reverse call's.
+func TestCallGateSeesEveryCallAndRefusesBeforeDispatch(t *testing.T) {
+	ca, caKey := mkCA(t)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lis.Addr().String()
+	_ = lis.Close()
+
+	gate := &recordingGate{refuse: "qubesair.UnlockData"}
+	srv := NewServer(ServerConfig{Listen: addr, TLS: mkServerTLS(t, ca, caKey), CallGate: gate}, callerInvoker{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = srv.Serve(ctx) }()
+	waitDial(t, addr)
+
+	cli := NewClient(ClientConfig{
+		RemoteEndpoint: addr, RelayName: "sys-relay", RemoteName: "remote-dev",
+		TLS: mkClientTLS(t, ca, caKey),
+	}, nil)
+	go func() { _ = cli.Start(ctx) }()
+	out, err := callWhenReady(t, cli, "remote-dev", "qubesair.Ping", nil)
+	if err != nil {
+		t.Fatalf("tunnel: %v", err)
+	}
+	if string(out) != "sys-relay" {
+		t.Errorf("the invoker saw caller %q, want sys-relay", out)
+	}
+
+	_, err = cli.Call(ctx, "remote-dev", "qubesair.UnlockData", []byte(strings.Repeat("k", 64)))
+	if !IsRemoteCode(err, CodeDenied) || !strings.Contains(err.Error(), "not now") {
+		t.Fatalf("refused call = %v, want %s with the gate's reason", err, CodeDenied)
+	}
+	// The tunnel is still fine afterwards.
+	if _, err := cli.Call(ctx, "remote-dev", "qubesair.Ping", nil); err != nil {
+		t.Fatalf("call after a refusal: %v", err)
+	}
+
+	gate.mu.Lock()
+	defer gate.mu.Unlock()
+	if last := gate.seen[len(gate.seen)-1]; last != "sys-relay qubesair.Ping" {
+		t.Errorf("gate saw %q last", last)
+	}
+	if !strings.Contains(strings.Join(gate.seen, "\n"), "sys-relay qubesair.UnlockData") {
+		t.Errorf("gate never saw the refused call: %v", gate.seen)
+	}
+}
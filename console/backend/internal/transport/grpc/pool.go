@@ -0,0 +1,338 @@
+// pool.go — several endpoints and several tunnels behind one Client.
+//
+// A remote reachable more than one way (a LAN address and a public one, or two
+// relays fronting the same agent) is configured as a list of endpoints with
+// priorities. Each tunnel slot walks that list from the most preferred
+// endpoint down: a connect failure moves straight on to the next endpoint,
+// and only a full pass with nothing reachable backs off. Once up, a tunnel
+// stays on the endpoint it reached until it drops — failing BACK while it is
+// healthy would trade a working tunnel for a hypothetical better one and kill
+// the calls in flight on it — and its replacement starts from the top again.
+//
+// ClientConfig.Tunnels keeps that many slots filled, and calls are spread over
+// the live tunnels round-robin. One tunnel serializes every frame through one
+// HTTP/2 stream; a second gives a bulk FileCopy somewhere else to be than in
+// front of an interactive session's keystrokes. A tunnel that drops fails
+// only the calls that were on it.
+//
+// Each endpoint keeps the state an operator asks about when a remote is slow or
+// flapping — connected since when, the last keepalive round trip, how often it
+// reconnected, which build answered, and the last error — and Client.Status
+// reports it.
+
+package grpc
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Endpoint is one way of reaching the remote.
+type Endpoint struct {
+	Address string // host:port
+	// Priority orders endpoints: lower is preferred, and equal priorities are
+	// tried in the order listed.
+	Priority int
+}
+
+// PrioritizedEndpoints lists addrs as Endpoints preferred in the order given,
+// skipping blanks.
+func PrioritizedEndpoints(addrs ...string) []Endpoint {
+	var out []Endpoint
+	for _, a := range addrs {
+		if a = strings.TrimSpace(a); a != "" {
+			out = append(out, Endpoint{Address: a, Priority: len(out)})
+		}
+	}
+	return out
+}
+
+// endpointState is an endpoint and what has happened on it.
+type endpointState struct {
+	addr     string
+	priority int
+
+	mu         sync.Mutex
+	tunnels    int       // live tunnels to it
+	since      time.Time // when the oldest live tunnel came up
+	rtt        time.Duration
+	rtts       []RTTSample // the latest rttHistory samples, oldest first
+	drops      int
+	reconnects int
+	build      string // the remote's build, from its latest handshake
+	lastErr    string
+	lastErrAt  time.Time
+	offer      string    // protocol version to offer it; "" = protocolVersion
+	offerSince time.Time // when it refused protocolVersion
+}
+
+// newEndpointStates orders eps by priority, keeping the listed order among
+// equals.
+func newEndpointStates(eps []Endpoint) []*endpointState {
+	sorted := slices.Clone(eps)
+	slices.SortStableFunc(sorted, func(a, b Endpoint) int { return a.Priority - b.Priority })
+	out := make([]*endpointState, 0, len(sorted))
+	for _, ep := range sorted {
+		out = append(out, &endpointState{addr: ep.Address, priority: ep.Priority})
+	}
+	return out
+}
+
+// protocolReprobeInterval is how long an endpoint that refused the current
+// protocol version is offered the oldest one before the current one is tried
+// again. The relay is routinely upgraded before the agents it talks to, so a
+// refusal is the normal state for a while; offering the current version on
+// every reconnect would cost each one a refused handshake, and never offering
+// it again would keep an upgraded agent on v1 until the relay restarted.
+const protocolReprobeInterval = 10 * time.Minute
+
+// offeredVersion is the protocol version to offer this endpoint now.
+func (e *endpointState) offeredVersion(now time.Time) string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.offer == "" || now.Sub(e.offerSince) >= protocolReprobeInterval {
+		return protocolVersion
+	}
+	return e.offer
+}
+
+// handshakeDone records how a handshake offering offered ended. Kept per
+// endpoint, not per client: the endpoints of one client can run different
+// agent builds, and every tunnel of the pool to the same endpoint should
+// benefit from what one of them learned. Only a refusal of the current version
+// pins the endpoint to the oldest, and only a handshake that succeeds at the
+// current version releases it; a dial that failed says nothing about either.
+func (e *endpointState) handshakeDone(offered string, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	switch {
+	case IsRemoteCode(err, CodeProtocolMismatch) && offered != oldestProtocolVersion:
+		e.offer, e.offerSince = oldestProtocolVersion, time.Now()
+	case err == nil && offered == protocolVersion:
+		e.offer, e.offerSince = "", time.Time{}
+	}
+}
+
+func (e *endpointState) up(at time.Time, peer PeerInfo) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.tunnels == 0 {
+		e.since = at
+	}
+	e.tunnels++
+	if e.drops > e.reconnects {
+		e.reconnects++
+	}
+	e.build = peer.BuildVersion
+}
+
+func (e *endpointState) down() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.tunnels--
+	e.drops++
+	if e.tunnels == 0 {
+		e.since = time.Time{}
+	}
+}
+
+// rttHistory is how many keepalive round trips each endpoint remembers: at
+// the default 20s interval, the last ten minutes or so — enough to tell a link
+// that just got slow from one that always was.
+const rttHistory = 32
+
+func (e *endpointState) recordRTT(d time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.rtt = d
+	if len(e.rtts) == rttHistory {
+		e.rtts = append(e.rtts[:0], e.rtts[1:]...)
+	}
+	e.rtts = append(e.rtts, RTTSample{At: time.Now().UTC(), RTT: d, RTTMS: d.Milliseconds()})
+}
+
+func (e *endpointState) recordError(err error) {
+	if err == nil {
+		return
+	}
+	e.mu.Lock()
+	e.lastErr = err.Error()
+	e.lastErrAt = time.Now()
+	e.mu.Unlock()
+}
+
+// maintain keeps one tunnel slot filled, failing over between endpoints, until
+// ctx is canceled.
+func (c *Client) maintain(ctx context.Context) {
+	backoff := c.cfg.ReconnectMin
+	for ctx.Err() == nil {
+		connected := false
+		for _, ep := range c.endpoints {
+			up, err := c.runOnce(ctx, ep)
+			if ctx.Err() != nil {
+				return
+			}
+			ep.recordError(err)
+			if up {
+				// A tunnel that was up and dropped: the next attempt starts
+				// over from the most preferred endpoint.
+				connected = true
+				break
+			}
+			// Could not connect: fail over to the next endpoint now rather
+			// than after a backoff meant for an unreachable remote.
+		}
+		if connected {
+			backoff = c.cfg.ReconnectMin
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(jitter(backoff)):
+		}
+		if !connected {
+			backoff = min(backoff*2, c.cfg.ReconnectMax)
+		}
+	}
+}
+
+// pickLocked returns the live tunnel the next call should use, round-robin,
+// or nil when there is none. c.mu must be held.
+func (c *Client) pickLocked() *tunnel {
+	if len(c.tunnels) == 0 {
+		return nil
+	}
+	c.next = (c.next + 1) % len(c.tunnels)
+	return c.tunnels[c.next]
+}
+
+// ClientStatus is a Client's transport state, for the console to serve.
+type ClientStatus struct {
+	RelayName  string `json:"relay_name"`
+	RemoteName string `json:"remote_name"`
+	// Connected is whether any tunnel is up, i.e. whether a call can be made.
+	Connected bool `json:"connected"`
+	// Tunnels is how many tunnels are up, out of Configured.
+	Tunnels    int `json:"tunnels"`
+	Configured int `json:"configured_tunnels"`
+	// Peer is what the remote said about itself on the oldest live tunnel;
+	// nil when none is up.
+	Peer *PeerInfo `json:"peer,omitempty"`
+	// InFlight counts forward calls waiting on a response, Streams the
+	// streaming ones (GUI, port forwards) open right now.
+	InFlight     int              `json:"in_flight"`
+	Streams      int              `json:"streams"`
+	ReverseCalls ReverseCallStats `json:"reverse_calls"`
+	// RecentReverseCalls is the reverse policy's record of this remote's
+	// latest reverse calls, oldest first; empty without a policy.
+	RecentReverseCalls []ReverseCallRecord `json:"recent_reverse_calls,omitempty"`
+	Endpoints          []EndpointStatus    `json:"endpoints"`
+	Compression        CompressionStats    `json:"compression"`
+}
+
+// ReverseCallStats counts reverse (remote → local) calls since the client was
+// built.
+type ReverseCallStats struct {
+	Received uint64 `json:"received"`
+	// Failed is how many of those were answered with an error: refused here,
+	// refused by the local dom0, failed, or no reverse handler configured.
+	Failed uint64 `json:"failed"`
+	// RefusedLocally counts calls the reverse policy refused before dom0 was
+	// asked; RefusedByDom0 those dom0 policy refused.
+	RefusedLocally uint64 `json:"refused_locally"`
+	RefusedByDom0  uint64 `json:"refused_by_dom0"`
+}
+
+// RTTSample is one keepalive round trip.
+type RTTSample struct {
+	At    time.Time     `json:"at"`
+	RTT   time.Duration `json:"-"`
+	RTTMS int64         `json:"rtt_ms"`
+}
+
+// EndpointStatus is one endpoint's state.
+type EndpointStatus struct {
+	Endpoint string `json:"endpoint"`
+	Priority int    `json:"priority"`
+	// Tunnels is how many tunnels are up to this endpoint right now.
+	Tunnels int `json:"tunnels"`
+	// ConnectedSince is when the oldest of those came up; nil when none is.
+	ConnectedSince *time.Time `json:"connected_since,omitempty"`
+	// LastKeepAliveRTT is the round trip of the most recent keepalive echo;
+	// zero until one has come back.
+	LastKeepAliveRTT time.Duration `json:"-"`
+	// LastKeepAliveRTTMS is LastKeepAliveRTT in milliseconds, for callers that
+	// serialize this.
+	LastKeepAliveRTTMS int64 `json:"last_keepalive_rtt_ms"`
+	// RTTHistory is the latest keepalive round trips, oldest first.
+	RTTHistory []RTTSample `json:"rtt_history"`
+	// Reconnects counts tunnels to this endpoint that came up again after one
+	// had dropped.
+	Reconnects int `json:"reconnects"`
+	// RemoteBuild is the build the remote reported in its latest handshake
+	// here; observability only, like PeerInfo.BuildVersion.
+	RemoteBuild string `json:"remote_build,omitempty"`
+	// LastError is why the latest connection attempt or tunnel here ended.
+	// It is kept after a later success: a flapping endpoint is diagnosed by
+	// what it did last time.
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+}
+
+// Status reports every configured endpoint's state, most preferred first.
+func (c *Client) Status() ClientStatus {
+	c.mu.Lock()
+	st := ClientStatus{
+		RelayName:  c.cfg.RelayName,
+		RemoteName: c.cfg.RemoteName,
+		Connected:  len(c.tunnels) > 0,
+		Tunnels:    len(c.tunnels),
+		Configured: c.cfg.Tunnels,
+		InFlight:   len(c.inflight),
+		Streams:    len(c.streams),
+		ReverseCalls: ReverseCallStats{
+			Received:       c.reverseReceived.Load(),
+			Failed:         c.reverseFailed.Load(),
+			RefusedLocally: c.reverseRefusedLocal.Load(),
+			RefusedByDom0:  c.reverseRefusedDom0.Load(),
+		},
+		Endpoints:   make([]EndpointStatus, 0, len(c.endpoints)),
+		Compression: c.CompressionStats(),
+	}
+	if len(c.tunnels) > 0 {
+		peer := c.tunnels[0].peer
+		st.Peer = &peer
+	}
+	c.mu.Unlock()
+	if p := c.cfg.ReversePolicy; p != nil {
+		st.RecentReverseCalls = p.Records(c.cfg.RemoteName)
+	}
+	for _, e := range c.endpoints {
+		e.mu.Lock()
+		es := EndpointStatus{
+			Endpoint:           e.addr,
+			Priority:           e.priority,
+			Tunnels:            e.tunnels,
+			LastKeepAliveRTT:   e.rtt,
+			LastKeepAliveRTTMS: e.rtt.Milliseconds(),
+			RTTHistory:         slices.Clone(e.rtts),
+			Reconnects:         e.reconnects,
+			RemoteBuild:        e.build,
+			LastError:          e.lastErr,
+		}
+		if !e.since.IsZero() {
+			since := e.since
+			es.ConnectedSince = &since
+		}
+		if !e.lastErrAt.IsZero() {
+			at := e.lastErrAt
+			es.LastErrorAt = &at
+		}
+		e.mu.Unlock()
+		st.Endpoints = append(st.Endpoints, es)
+	}
+	return st
+}
@@ -0,0 +1,163 @@
+package grpc
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+)
+
+// startStoppableServer is startTestServer that also returns the Server, so a
+// test can take it down.
+func startStoppableServer(t *testing.T, serverTLS *tls.Config) (*Server, string) {
+	t.Helper()
+	addr := freeAddr(t)
+	srv := NewServer(ServerConfig{Listen: addr, TLS: serverTLS}, tagInvoker{})
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() { _ = srv.Serve(ctx) }()
+	waitDial(t, addr)
+	return srv, addr
+}
+
+// freeAddr is a localhost address nothing listens on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lis.Addr().String()
+	_ = lis.Close()
+	return addr
+}
+
+// waitStatus polls cli.Status until ok accepts it.
+func waitStatus(t *testing.T, cli *Client, what string, ok func(ClientStatus) bool) ClientStatus {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		st := cli.Status()
+		if ok(st) {
+			return st
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: never happened; status %+v", what, st)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestFailoverBetweenEndpoints — an unreachable preferred endpoint is skipped
+// for the next one; when the endpoint in use goes away, the tunnel moves to
+// another without the caller doing anything.
+func TestFailoverBetweenEndpoints(t *testing.T) {
+	ca, caKey := mkCA(t)
+	dead := freeAddr(t)
+	second, secondAddr := startStoppableServer(t, mkServerTLS(t, ca, caKey))
+	_, thirdAddr := startStoppableServer(t, mkServerTLS(t, ca, caKey))
+
+	cli := NewClient(ClientConfig{
+		// Listed out of order: priority, not position, decides.
+		Endpoints: []Endpoint{{Address: thirdAddr, Priority: 3}, {Address: dead, Priority: 1}, {Address: secondAddr, Priority: 2}},
+		RelayName: "sys-relay", RemoteName: "remote-dev", TLS: mkClientTLS(t, ca, caKey),
+		ReconnectMin: 10 * time.Millisecond, ReconnectMax: 50 * time.Millisecond,
+	}, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() { _ = cli.Start(ctx) }()
+
+	if _, err := callWhenReady(t, cli, "remote-dev", "qubesair.Ping", nil); err != nil {
+		t.Fatalf("call: %v", err)
+	}
+	st := cli.Status()
+	if len(st.Endpoints) != 3 || st.Endpoints[0].Endpoint != dead || st.Endpoints[1].Endpoint != secondAddr {
+		t.Fatalf("endpoints not in priority order: %+v", st.Endpoints)
+	}
+	if st.Endpoints[0].LastError == "" || st.Endpoints[0].Tunnels != 0 {
+		t.Errorf("the dead endpoint shows no failure: %+v", st.Endpoints[0])
+	}
+	if ep := st.Endpoints[1]; ep.Tunnels != 1 || ep.ConnectedSince == nil || ep.RemoteBuild != BuildVersion {
+		t.Errorf("the tunnel is not on the best reachable endpoint: %+v", ep)
+	}
+
+	second.Stop()
+	waitStatus(t, cli, "failover to the third endpoint", func(st ClientStatus) bool {
+		return st.Endpoints[2].Tunnels == 1
+	})
+	if _, err := callWhenReady(t, cli, "remote-dev", "qubesair.Ping", nil); err != nil {
+		t.Fatalf("call after failover: %v", err)
+	}
+}
+
+// TestPoolSpreadsCalls — with several tunnels configured all of them come up,
+// calls are dealt across them, and one dropping leaves the rest serving.
+func TestPoolSpreadsCalls(t *testing.T) {
+	ca, caKey := mkCA(t)
+	addr := startTestServer(t, mkServerTLS(t, ca, caKey))
+	cli := NewClient(ClientConfig{
+		RemoteEndpoint: addr, Tunnels: 3,
+		RelayName: "sys-relay", RemoteName: "remote-dev", TLS: mkClientTLS(t, ca, caKey),
+		ReconnectMin: 10 * time.Millisecond, ReconnectMax: 50 * time.Millisecond,
+	}, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() { _ = cli.Start(ctx) }()
+	waitStatus(t, cli, "three tunnels", func(st ClientStatus) bool { return st.Tunnels == 3 })
+
+	used := map[*tunnel]int{}
+	cli.mu.Lock()
+	for range 6 {
+		used[cli.pickLocked()]++
+	}
+	first := cli.tunnels[0]
+	cli.mu.Unlock()
+	if len(used) != 3 {
+		t.Errorf("6 calls used %d of 3 tunnels", len(used))
+	}
+
+	// Drop one tunnel; it is replaced, and calls keep working meanwhile.
+	first.stream.(interface{ CloseSend() error }).CloseSend() //nolint:errcheck // test teardown of one tunnel
+	for range 5 {
+		callCtx, c := context.WithTimeout(ctx, 5*time.Second)
+		_, err := cli.Call(callCtx, "remote-dev", "qubesair.Ping", nil)
+		c()
+		if err != nil && !IsRemoteCode(err, codeUnavailable) {
+			t.Fatalf("call during a drop: %v", err)
+		}
+	}
+	waitStatus(t, cli, "the dropped tunnel replaced", func(st ClientStatus) bool {
+		return st.Tunnels == 3 && st.Endpoints[0].Reconnects == 1
+	})
+}
+
+// TestStatusReportsKeepAliveRTT — the round trip of our keepalive's echo is
+// measured per endpoint and kept as a short history, alongside the handshake.
+func TestStatusReportsKeepAliveRTT(t *testing.T) {
+	ca, caKey := mkCA(t)
+	addr := startTestServer(t, mkServerTLS(t, ca, caKey))
+	cli := NewClient(ClientConfig{
+		RemoteEndpoint: addr, KeepAlive: 20 * time.Millisecond,
+		RelayName: "sys-relay", RemoteName: "remote-dev", TLS: mkClientTLS(t, ca, caKey),
+	}, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() { _ = cli.Start(ctx) }()
+
+	st := waitStatus(t, cli, "a keepalive echo", func(st ClientStatus) bool {
+		return st.Endpoints[0].LastKeepAliveRTT > 0
+	})
+	if st.Endpoints[0].LastKeepAliveRTT > 5*time.Second || !st.Connected || st.Configured != 1 {
+		t.Errorf("status = %+v", st)
+	}
+	if h := st.Endpoints[0].RTTHistory; len(h) == 0 || h[len(h)-1].RTT != st.Endpoints[0].LastKeepAliveRTT {
+		t.Errorf("RTT history %+v does not end with the last round trip", h)
+	}
+	if st.Peer == nil || st.Peer.ProtocolVersion != protocolVersion {
+		t.Errorf("peer = %+v, want the handshake's", st.Peer)
+	}
+	if st.InFlight != 0 || st.Streams != 0 {
+		t.Errorf("idle client reports %d calls and %d streams", st.InFlight, st.Streams)
+	}
+}
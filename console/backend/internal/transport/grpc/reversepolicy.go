@@ -0,0 +1,253 @@
+// reversepolicy.go — what a remote may ask of us, before dom0 is asked.
+//
+// A reverse call ends in a dom0 policy C prompt, and dom0 stays the authority
+// on whether it runs. But a prompt is not free: a compromised remote that can
+// send any service name at any rate can bury the user in prompts until one is
+// clicked through, probe which services exist by how they fail, or park large
+// bodies in relay memory. ReversePolicy is the relay's own gate in front of
+// the prompt: per remote, which service names it may ask for at all, how
+// often, how many at once, and how large. A call it refuses never reaches
+// dom0.
+//
+// Nothing here grants anything. A call the policy admits still needs dom0's
+// yes; the policy only narrows what dom0 gets asked.
+//
+// Every reverse call is recorded with its outcome — run, refused here, refused
+// by dom0, or failed — so that "why did I get that prompt" and "what has this
+// remote been asking for" have an answer after the fact.
+
+package grpc
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/slchris/qubes-air/console/internal/transport"
+)
+
+// AllowAnyService is the allowlist entry that admits every service name. It
+// exists for deployments that have not written an allowlist yet and is logged
+// as such; dom0 policy C is then the only filter.
+const AllowAnyService = "*"
+
+// Defaults for ReverseLimits fields left zero. They are sized for what reverse
+// calls are for — a credential fetch, a notification — not for bulk data.
+const (
+	defaultReverseRatePerMinute = 30
+	defaultReverseBurst         = 10
+	defaultReverseConcurrency   = 4
+	defaultReverseMaxPayload    = 1 << 20
+	defaultReverseHistory       = 256
+)
+
+// ReverseLimits is what one remote may ask for.
+type ReverseLimits struct {
+	// Allow lists the service names the remote may call. An entry without an
+	// argument ("qubesair.GetCredential") admits the service with any
+	// argument; one with an argument ("qubesair.GetCredential+gcp-key") admits
+	// exactly that. AllowAnyService admits everything. Empty admits nothing.
+	Allow []string `yaml:"allow"`
+	// RatePerMinute and Burst bound how fast calls are admitted: a token
+	// bucket of Burst tokens refilled at RatePerMinute (defaults 30 / 10).
+	RatePerMinute int `yaml:"rate_per_minute"`
+	Burst         int `yaml:"burst"`
+	// MaxConcurrent bounds the calls running at once (default 4). Calls over
+	// it are refused, not queued: a queue would only delay the prompt flood.
+	MaxConcurrent int `yaml:"max_concurrent"`
+	// MaxPayload bounds a call's request body in bytes (default 1 MiB).
+	MaxPayload int `yaml:"max_payload_bytes"`
+}
+
+func (l ReverseLimits) withDefaults() ReverseLimits {
+	if l.RatePerMinute <= 0 {
+		l.RatePerMinute = defaultReverseRatePerMinute
+	}
+	if l.Burst <= 0 {
+		l.Burst = defaultReverseBurst
+	}
+	if l.MaxConcurrent <= 0 {
+		l.MaxConcurrent = defaultReverseConcurrency
+	}
+	if l.MaxPayload <= 0 {
+		l.MaxPayload = defaultReverseMaxPayload
+	}
+	return l
+}
+
+// allows reports whether service is on the allowlist.
+func (l ReverseLimits) allows(service string) bool {
+	base, _, _ := strings.Cut(service, "+")
+	for _, a := range l.Allow {
+		if a == AllowAnyService || a == service || (!strings.Contains(a, "+") && a == base) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReversePolicyConfig configures a ReversePolicy.
+type ReversePolicyConfig struct {
+	// Remotes are per-remote limits, by remote name (the RemoteName a Client
+	// serves; for an attached agent, the qube name from its certificate).
+	Remotes map[string]ReverseLimits
+	// Default applies to remotes not in Remotes. Nil refuses every reverse
+	// call from them.
+	Default *ReverseLimits
+	// History is how many reverse calls are remembered (default 256).
+	History int
+}
+
+// Outcomes of a reverse call, as recorded.
+const (
+	ReverseAllowed       = "allowed"       // admitted, and dom0 let it run
+	ReverseRefusedLocal  = "refused_local" // refused by this policy; dom0 was not asked
+	ReverseRefusedByDom0 = "refused_dom0"  // admitted, and dom0 policy refused it
+	ReverseFailed        = "failed"        // admitted and run, and it failed
+)
+
+// ReverseCallRecord is one reverse call and what became of it.
+type ReverseCallRecord struct {
+	At      time.Time `json:"at"`
+	Remote  string    `json:"remote"`
+	Service string    `json:"service"`
+	Bytes   int       `json:"bytes"`
+	Outcome string    `json:"outcome"`
+	// Reason is why a call was refused or failed.
+	Reason   string        `json:"reason,omitempty"`
+	Duration time.Duration `json:"-"`
+	// DurationMS is Duration in milliseconds, for callers that serialize this.
+	DurationMS int64 `json:"duration_ms"`
+}
+
+// ErrReverseRefused is wrapped by every refusal of the policy's own.
+var ErrReverseRefused = errors.New("reverse call refused by relay policy")
+
+// errReverseLimited marks a refusal that is about pace, not permission: the
+// same call may be admitted later.
+var errReverseLimited = fmt.Errorf("%w: limit reached", ErrReverseRefused)
+
+// ReversePolicy admits or refuses reverse calls per remote and records every
+// one. One policy is shared by every Client it is given to, so the limits of a
+// remote hold across all of its tunnels.
+type ReversePolicy struct {
+	cfg ReversePolicyConfig
+
+	mu      sync.Mutex
+	remotes map[string]*reverseRemote
+	records []ReverseCallRecord // the latest cfg.History, oldest first
+}
+
+// reverseRemote is one remote's token bucket and running calls.
+type reverseRemote struct {
+	tokens  float64
+	filled  time.Time
+	running int
+}
+
+// NewReversePolicy builds a policy from cfg.
+func NewReversePolicy(cfg ReversePolicyConfig) *ReversePolicy {
+	if cfg.History <= 0 {
+		cfg.History = defaultReverseHistory
+	}
+	return &ReversePolicy{cfg: cfg, remotes: make(map[string]*reverseRemote)}
+}
+
+// limits returns the limits for remote, or false when it may call nothing.
+func (p *ReversePolicy) limits(remote string) (ReverseLimits, bool) {
+	if l, ok := p.cfg.Remotes[remote]; ok {
+		return l.withDefaults(), true
+	}
+	if p.cfg.Default != nil {
+		return p.cfg.Default.withDefaults(), true
+	}
+	return ReverseLimits{}, false
+}
+
+// maxPayload is the largest request body remote may send; zero when it may
+// send none at all.
+func (p *ReversePolicy) maxPayload(remote string) int {
+	l, ok := p.limits(remote)
+	if !ok {
+		return 0
+	}
+	return l.MaxPayload
+}
+
+// admit decides on a reverse call. Admitted, it returns a release to call once
+// the call is over; refused, an error wrapping ErrReverseRefused.
+func (p *ReversePolicy) admit(remote, service string, size int) (release func(), err error) {
+	l, ok := p.limits(remote)
+	switch {
+	case !ok:
+		return nil, fmt.Errorf("%w: remote %q may not make reverse calls", ErrReverseRefused, remote)
+	case !transport.ValidName(service):
+		return nil, fmt.Errorf("%w: invalid service name", ErrReverseRefused)
+	case !l.allows(service):
+		return nil, fmt.Errorf("%w: service %q is not allowed for remote %q", ErrReverseRefused, service, remote)
+	case size > l.MaxPayload:
+		return nil, fmt.Errorf("%w: request of %d bytes exceeds %d", ErrReverseRefused, size, l.MaxPayload)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	r := p.remotes[remote]
+	now := time.Now()
+	if r == nil {
+		r = &reverseRemote{tokens: float64(l.Burst), filled: now}
+		p.remotes[remote] = r
+	}
+	r.tokens = min(float64(l.Burst), r.tokens+now.Sub(r.filled).Minutes()*float64(l.RatePerMinute))
+	r.filled = now
+	if r.running >= l.MaxConcurrent {
+		return nil, fmt.Errorf("%w (%d reverse calls already running)", errReverseLimited, r.running)
+	}
+	if r.tokens < 1 {
+		return nil, fmt.Errorf("%w (more than %d reverse calls a minute)", errReverseLimited, l.RatePerMinute)
+	}
+	r.tokens--
+	r.running++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			p.mu.Lock()
+			r.running--
+			p.mu.Unlock()
+		})
+	}, nil
+}
+
+// record keeps rec and logs it. Refusals are logged loudly: each is either a
+// misconfigured allowlist or a remote asking for what it should not.
+func (p *ReversePolicy) record(rec ReverseCallRecord) {
+	rec.DurationMS = rec.Duration.Milliseconds()
+	if rec.Outcome == ReverseAllowed {
+		log.Printf("grpc reverse: %s %q from remote %q (%d bytes)", rec.Outcome, rec.Service, rec.Remote, rec.Bytes)
+	} else {
+		log.Printf("grpc reverse: %s %q from remote %q (%d bytes): %s",
+			strings.ToUpper(rec.Outcome), rec.Service, rec.Remote, rec.Bytes, rec.Reason)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.records) == p.cfg.History {
+		p.records = append(p.records[:0], p.records[1:]...)
+	}
+	p.records = append(p.records, rec)
+}
+
+// Records returns the remembered reverse calls from remote, oldest first; all
+// of them when remote is empty.
+func (p *ReversePolicy) Records(remote string) []ReverseCallRecord {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	out := make([]ReverseCallRecord, 0, len(p.records))
+	for _, r := range p.records {
+		if remote == "" || r.Remote == remote {
+			out = append(out, r)
+		}
+	}
+	return out
+}
@@ -0,0 +1,141 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/slchris/qubes-air/console/internal/qrexec"
+	pb "github.com/slchris/qubes-air/console/internal/transport/relaypb"
+)
+
+// recordingStream is a tunnel stream that keeps what is sent on it.
+type recordingStream struct {
+	silentStream
+	mu   sync.Mutex
+	sent []*pb.Frame
+}
+
+func (r *recordingStream) Send(f *pb.Frame) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sent = append(r.sent, f)
+	return nil
+}
+
+// lastError is the code of the last CallError sent, or "" if the last frame
+// was not one.
+func (r *recordingStream) lastError() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.sent) == 0 {
+		return ""
+	}
+	return r.sent[len(r.sent)-1].GetError().GetCode()
+}
+
+func TestReverseLimitsAllowlist(t *testing.T) {
+	l := ReverseLimits{Allow: []string{"qubesair.GetCredential", "qubesair.Notify+low"}}
+	for service, want := range map[string]bool{
+		"qubesair.GetCredential":         true,
+		"qubesair.GetCredential+gcp-key": true,
+		"qubesair.Notify+low":            true,
+		"qubesair.Notify+high":           false,
+		"qubesair.Notify":                false,
+		"qubesair.Exec":                  false,
+	} {
+		if got := l.allows(service); got != want {
+			t.Errorf("allows(%q) = %v, want %v", service, got, want)
+		}
+	}
+	if !(ReverseLimits{Allow: []string{AllowAnyService}}).allows("anything.At+all") {
+		t.Error("the wildcard entry does not admit everything")
+	}
+}
+
+func TestReversePolicyAdmit(t *testing.T) {
+	p := NewReversePolicy(ReversePolicyConfig{
+		Remotes: map[string]ReverseLimits{
+			"remote-dev": {Allow: []string{"qubesair.GetCredential"}, Burst: 2, RatePerMinute: 1, MaxConcurrent: 1, MaxPayload: 16},
+		},
+	})
+	if _, err := p.admit("remote-other", "qubesair.GetCredential", 0); !errors.Is(err, ErrReverseRefused) {
+		t.Errorf("a remote without limits and no default was admitted: %v", err)
+	}
+	if _, err := p.admit("remote-dev", "qubesair.Exec", 0); !errors.Is(err, ErrReverseRefused) {
+		t.Errorf("a service off the allowlist was admitted: %v", err)
+	}
+	if _, err := p.admit("remote-dev", "qubesair.GetCredential", 17); !errors.Is(err, ErrReverseRefused) {
+		t.Errorf("an oversized request was admitted: %v", err)
+	}
+
+	release, err := p.admit("remote-dev", "qubesair.GetCredential", 16)
+	if err != nil {
+		t.Fatalf("admit: %v", err)
+	}
+	if _, err := p.admit("remote-dev", "qubesair.GetCredential", 0); !errors.Is(err, errReverseLimited) {
+		t.Errorf("a call over the concurrency cap was admitted: %v", err)
+	}
+	release()
+	release() // idempotent
+	release, err = p.admit("remote-dev", "qubesair.GetCredential", 0)
+	if err != nil {
+		t.Fatalf("admit after release: %v", err)
+	}
+	release()
+	// The burst of two is spent, and one a minute refills nothing in a test.
+	if _, err := p.admit("remote-dev", "qubesair.GetCredential", 0); !errors.Is(err, errReverseLimited) {
+		t.Errorf("a call over the rate was admitted: %v", err)
+	}
+}
+
+// TestReverseCallsAreGatedAndRecorded — the client consults the policy before
+// the reverse handler, answers each refusal with the matching code, and
+// records every outcome.
+func TestReverseCallsAreGatedAndRecorded(t *testing.T) {
+	policy := NewReversePolicy(ReversePolicyConfig{
+		Default: &ReverseLimits{Allow: []string{"qubesair.GetCredential", "qubesair.Notify"}},
+	})
+	var handled []string
+	handler := func(_ context.Context, service string, _ []byte) ([]byte, error) {
+		handled = append(handled, service)
+		switch service {
+		case "qubesair.Notify":
+			return nil, fmt.Errorf("run: %w", qrexec.ErrRefused)
+		case "qubesair.GetCredential+broken":
+			return nil, errors.New("vault is down")
+		}
+		return []byte("secret"), nil
+	}
+	cli := NewClient(ClientConfig{RemoteName: "remote-dev", ReversePolicy: policy}, handler)
+	rec := &recordingStream{silentStream: silentStream{ctx: context.Background()}}
+	tun := &tunnel{stream: rec}
+
+	for i, tc := range []struct{ service, code, outcome string }{
+		{"qubesair.GetCredential+gcp-key", "", ReverseAllowed},
+		{"qubesair.Exec", CodeDenied, ReverseRefusedLocal},
+		{"qubesair.Notify", CodeDenied, ReverseRefusedByDom0},
+		{"qubesair.GetCredential+broken", CodeInternal, ReverseFailed},
+	} {
+		cli.handleReverse(context.Background(), tun, fmt.Sprint("r", i), &reverseCall{service: tc.service})
+		if got := rec.lastError(); got != tc.code {
+			t.Errorf("%s: answered with code %q, want %q", tc.service, got, tc.code)
+		}
+		recs := policy.Records("remote-dev")
+		if got := recs[len(recs)-1]; got.Service != tc.service || got.Outcome != tc.outcome {
+			t.Errorf("%s: recorded %+v, want outcome %s", tc.service, got, tc.outcome)
+		}
+	}
+	if len(handled) != 3 {
+		t.Errorf("the handler saw %v; a locally refused call must never reach it", handled)
+	}
+	st := cli.Status().ReverseCalls
+	if st.Received != 4 || st.Failed != 3 || st.RefusedLocally != 1 || st.RefusedByDom0 != 1 {
+		t.Errorf("reverse stats = %+v", st)
+	}
+	if got := cli.Status().RecentReverseCalls; len(got) != 4 {
+		t.Errorf("status shows %d recent reverse calls, want 4", len(got))
+	}
+}
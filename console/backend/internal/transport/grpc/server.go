@@ -15,7 +15,6 @@ import (
 	"io"
 	"log"
 	"net"
-	"strconv"
 	"strings"
 	"time"
 
@@ -53,6 +52,29 @@ type ServerConfig struct {
 	// means the certificate expires with a valid replacement sitting on disk,
 	// which is the failure renewal exists to prevent.
 	CertSource ServerCertSource
+	// Forwards decides which local endpoints a qubesair.StreamTCP request may
+	// reach. Nil serves DefaultForwardPolicy — the loopback GUI ranges — so a
+	// server configured before policies existed keeps its exact behavior.
+	Forwards *ForwardPolicy
+	// ForwardSource, when set, supplies the forward policy on EACH stream
+	// request instead of Forwards — the CertSource idea applied to policy, so a
+	// reloaded agent config governs the next stream without a restart. Streams
+	// already spliced keep running: they were admitted under the policy of
+	// their time, and cutting them would drop a user's session over an edit
+	// that may not even concern it.
+	ForwardSource ForwardSource
+	// StreamWindow is the receive window, in bytes, advertised for each
+	// streaming call (see flow.go). Zero uses defaultStreamWindow; negative
+	// declines flow control, which is only useful to exercise the legacy path.
+	StreamWindow int
+	// CompressThreshold is the smallest DataChunk payload compressed when the
+	// relay accepts it (see compress.go). Zero uses defaultCompressThreshold;
+	// negative turns compression off in both directions.
+	CompressThreshold int
+	// CallGate, when set, is asked before every call and stream is run, with
+	// the caller's certificate name. Nil admits everything the invoker would,
+	// which is the behavior before gates existed.
+	CallGate CallGate
 }
 
 // ServerCertSource hands out the certificate the listener presents.
@@ -61,6 +83,18 @@ type ServerCertSource interface {
 	ServerCertificate() (*tls.Certificate, error)
 }
 
+// ForwardSource hands out the current forward policy.
+type ForwardSource interface {
+	ForwardPolicy() *ForwardPolicy
+}
+
+// CallGate admits or refuses one call by who is making it. Implemented by
+// *deadman.Switch, which also counts the console's calls as check-ins — the
+// reason a gate sees every call rather than only the ones it might refuse.
+type CallGate interface {
+	Admit(peerCN, service string) error
+}
+
 // CertRegistry authorizes client certificates by fingerprint.
 // Implemented by repository.AgentCertRepository.
 type CertRegistry interface {
@@ -86,6 +120,19 @@ type QrexecInvoker interface {
 	Invoke(ctx context.Context, target, service string, in []byte) ([]byte, error)
 }
 
+// StreamOpener is implemented by an invoker that serves streaming services of
+// its own besides qubesair.StreamTCP (agent.LocalInvoker does, for
+// qubesair.Shell). The server splices such a call to the connection the
+// invoker opens exactly as it splices StreamTCP to a socket: request bytes are
+// written to it, what it produces goes back as the response, within the same
+// flow-control window.
+type StreamOpener interface {
+	// OpenStream opens the local end of a streaming call to service, or
+	// reports ok false when service is not one of the invoker's streams, so
+	// the call is dispatched as an ordinary one.
+	OpenStream(ctx context.Context, target, service string) (conn io.ReadWriteCloser, ok bool, err error)
+}
+
 // Server implements pb.RelayTransportServer. It only moves frames; all
 // authorization lives in the two dom0s (see Tunnel security notes).
 type Server struct {
@@ -95,6 +142,8 @@ type Server struct {
 
 	mu   sync.Mutex
 	grpc *grpc.Server
+
+	compression compressionCounters // across every tunnel served
 }
 
 // NewServer builds the remote server. invoker executes forward calls locally
@@ -103,6 +152,12 @@ func NewServer(cfg ServerConfig, invoker QrexecInvoker) *Server {
 	return &Server{cfg: cfg, invoker: invoker}
 }
 
+// CompressionStats reports what compression has saved on this server's
+// tunnels since it was built.
+func (s *Server) CompressionStats() CompressionStats {
+	return s.compression.snapshot()
+}
+
 // NewServerWithQrexec builds the remote server with the production qrexec
 // invoker (shells to qrexec-client-vm). This is the constructor a Remote-Relay
 // process uses. Forward calls reaching the invoker have been re-authorized by
@@ -124,19 +179,19 @@ func NewServerWithQrexec(cfg ServerConfig) *Server {
 // handshake, resumed or not, so revocation takes effect on the next connection
 // as the design intends.
 func (s *Server) verifyRegisteredConnection(cs tls.ConnectionState) error {
-	return s.authorizeChain(cs.VerifiedChains)
+	return authorizeChain(s.cfg.CertRegistry, cs.VerifiedChains)
 }
 
 // authorizeChain adds "and we still permit it" to a chain the TLS stack has
 // already verified as CA-signed and in date.
-func (s *Server) authorizeChain(chains [][]*x509.Certificate) error {
+func authorizeChain(registry CertRegistry, chains [][]*x509.Certificate) error {
 	if len(chains) == 0 || len(chains[0]) == 0 {
 		return fmt.Errorf("no verified certificate chain")
 	}
 	leaf := chains[0][0]
 	fp := repository.Fingerprint(leaf)
 
-	cert, err := s.cfg.CertRegistry.Authorize(context.Background(), fp)
+	cert, err := registry.Authorize(context.Background(), fp)
 	if err != nil {
 		// Log the distinct cases: an unregistered certificate that nonetheless
 		// carries a valid CA signature is a very different event from an
@@ -146,7 +201,7 @@ func (s *Server) authorizeChain(chains [][]*x509.Certificate) error {
 			fp[:16], leaf.Subject.CommonName, err)
 		return err
 	}
-	if err := s.cfg.CertRegistry.TouchLastSeen(context.Background(), fp); err != nil {
+	if err := registry.TouchLastSeen(context.Background(), fp); err != nil {
 		// Non-fatal: this is operational visibility, not authorization.
 		log.Printf("grpc server: could not record last-seen for %s: %v", fp[:16], err)
 	}
@@ -155,6 +210,53 @@ func (s *Server) authorizeChain(chains [][]*x509.Certificate) error {
 	return nil
 }
 
+// peerCommonName extracts the connected peer's certificate common name, the
+// input to CallerRole. Empty when the peer presented no verified certificate.
+func peerCommonName(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.AuthInfo == nil {
+		return ""
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.VerifiedChains) == 0 || len(tlsInfo.State.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return tlsInfo.State.VerifiedChains[0][0].Subject.CommonName
+}
+
+// callerKey carries the caller's certificate name on a served call's context.
+type callerKey struct{}
+
+// CallerCommonName is the verified certificate common name of whoever made
+// the call ctx belongs to; empty outside a served call. An agent builtin is
+// otherwise told nothing about its caller, and one that must heed only the
+// console needs to know.
+func CallerCommonName(ctx context.Context) string {
+	cn, _ := ctx.Value(callerKey{}).(string)
+	return cn
+}
+
+// admit asks the configured CallGate, if any, whether peerCN may run service.
+func (s *Server) admit(peerCN, service string) error {
+	if s.cfg.CallGate == nil {
+		return nil
+	}
+	return s.cfg.CallGate.Admit(peerCN, service)
+}
+
+// forwards returns the policy stream requests are resolved against.
+func (s *Server) forwards() *ForwardPolicy {
+	if s.cfg.ForwardSource != nil {
+		if p := s.cfg.ForwardSource.ForwardPolicy(); p != nil {
+			return p
+		}
+	}
+	if s.cfg.Forwards != nil {
+		return s.cfg.Forwards
+	}
+	return DefaultForwardPolicy()
+}
+
 // peerFingerprint extracts the connected peer's certificate fingerprint.
 func peerFingerprint(ctx context.Context) (string, bool) {
 	p, ok := peer.FromContext(ctx)
@@ -170,8 +272,7 @@ func peerFingerprint(ctx context.Context) (string, bool) {
 
 // reauthorizeLoop tears down the tunnel once its certificate stops being
 // authorized. It exits when the tunnel does.
-func (s *Server) reauthorizeLoop(ctx context.Context, cancel context.CancelFunc, fingerprint string) {
-	interval := s.cfg.ReauthorizeInterval
+func reauthorizeLoop(ctx context.Context, cancel context.CancelFunc, registry CertRegistry, interval time.Duration, fingerprint string) {
 	if interval <= 0 {
 		interval = reauthorizeInterval
 	}
@@ -183,7 +284,7 @@ func (s *Server) reauthorizeLoop(ctx context.Context, cancel context.CancelFunc,
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			if _, err := s.cfg.CertRegistry.Authorize(ctx, fingerprint); err != nil {
+			if _, err := registry.Authorize(ctx, fingerprint); err != nil {
 				if ctx.Err() != nil {
 					return // tunnel already closing
 				}
@@ -297,13 +398,15 @@ func (s *Server) Serve(ctx context.Context) error {
 	return err
 }
 
-// Stop immediately stops the server (for tests / forced shutdown).
+// Stop immediately stops the server (for tests / forced shutdown), closing the
+// tunnels that are up. GracefulStop would wait for them to end on their own,
+// which a Tunnel never does.
 func (s *Server) Stop() {
 	s.mu.Lock()
 	gs := s.grpc
 	s.mu.Unlock()
 	if gs != nil {
-		gs.GracefulStop()
+		gs.Stop()
 	}
 }
 
@@ -316,13 +419,22 @@ func (s *Server) Stop() {
 // this process). Reverse (REMOTE_TO_LOCAL) frames are only relayed back to the
 // local relay; their authorization is the LOCAL dom0 policy C (ask), enforced
 // on the client side — this handler must not let them skip that.
+func (s *Server) Tunnel(stream grpc.BidiStreamingServer[pb.Frame, pb.Frame]) error {
+	return s.serveTunnel(stream, peerCommonName(stream.Context()))
+}
+
+// serveTunnel runs the agent's half of the protocol on one stream, whether the
+// relay dialed in (Tunnel) or this agent dialed out (DialOut). peerCN is the
+// verified certificate name of the relay on the other end, the input to the
+// forward policy's role check.
+//
 // Frame dispatch plus the tunnel lifecycle (authorize, reauthorize, teardown).
 // Worth revisiting if it grows again; splitting it today would separate the
 // teardown paths from the branches that trigger them.
 //
 //nolint:gocyclo,funlen // frame dispatch plus lifecycle, kept together deliberately
-func (s *Server) Tunnel(stream grpc.BidiStreamingServer[pb.Frame, pb.Frame]) error {
-	ctx, cancelTunnel := context.WithCancel(stream.Context())
+func (s *Server) serveTunnel(stream frameStream, peerCN string) error {
+	ctx, cancelTunnel := context.WithCancel(context.WithValue(stream.Context(), callerKey{}, peerCN))
 	defer cancelTunnel()
 
 	// Re-authorize the peer certificate periodically for as long as the tunnel
@@ -334,14 +446,18 @@ func (s *Server) Tunnel(stream grpc.BidiStreamingServer[pb.Frame, pb.Frame]) err
 	// connection that is already open, or it is not revocation.
 	if s.cfg.CertRegistry != nil {
 		if fp, ok := peerFingerprint(stream.Context()); ok {
-			go s.reauthorizeLoop(ctx, cancelTunnel, fp)
+			go reauthorizeLoop(ctx, cancelTunnel, s.cfg.CertRegistry, s.cfg.ReauthorizeInterval, fp)
 		}
 	}
 
 	// Send is not concurrent-safe; serialize all sends through this mutex so
-	// per-request goroutines can reply independently.
+	// per-request goroutines can reply independently. enc is set once the
+	// handshake has said what the relay decodes, before any other sender
+	// exists; compressing happens before the lock.
 	var sendMu sync.Mutex
+	var enc *chunkEncoder
 	send := func(f *pb.Frame) error {
+		enc.encode(f)
 		sendMu.Lock()
 		defer sendMu.Unlock()
 		return stream.Send(f)
@@ -373,15 +489,31 @@ func (s *Server) Tunnel(stream grpc.BidiStreamingServer[pb.Frame, pb.Frame]) err
 		return fmt.Errorf("grpc server: %s", msg)
 	}
 	relayName := hs.GetRelayName()
+	// The role is read from the certificate once per tunnel: it is what the
+	// forward policy checks, and a certificate does not change mid-connection.
+	callerRole := CallerRole(peerCN)
 	remoteName := hs.GetRemoteName()
 	// Build version is observability only — logged so an operator can tell which
 	// agent build is actually running out there, without it gating anything.
 	log.Printf("grpc server: relay %q connected (protocol %s, build %s)",
 		relayName, hs.GetProtocolVersion(), orUnknown(hs.GetBuildVersion()))
-	// Acknowledge with our own Handshake frame.
-	if err := send(handshakeFrame(remoteName, relayName)); err != nil {
+	// Acknowledge with our own Handshake frame. Flow control is on for this
+	// tunnel only if the relay advertised a window too; an older relay sends
+	// none and gets the old unwindowed behavior.
+	ourWindow := advertisedWindow(s.cfg.StreamWindow)
+	windows := negotiateWindows(ourWindow, hs.GetInitialWindow())
+	// The ack names the version the relay offered: this tunnel runs at it, and
+	// a v1 relay must not be told about a protocol it cannot speak.
+	ack := handshakeFrame(remoteName, relayName, ourWindow)
+	ack.GetHandshake().ProtocolVersion = hs.GetProtocolVersion()
+	ack.GetHandshake().Capabilities.Services = invokerServices(s.invoker)
+	ack.GetHandshake().Capabilities.Compression = advertisedCompression(s.cfg.CompressThreshold)
+	if err := send(ack); err != nil {
 		return err
 	}
+	// What the relay can take, for choosing frame sizes on the way back.
+	relayCaps := peerInfoFrom(hs).Capabilities
+	enc = newChunkEncoder(s.cfg.CompressThreshold, relayCaps, &s.compression)
 
 	// --- Per-request accumulation of forward request bodies.
 	// Guarded by pendMu because request frames for different request_ids may
@@ -389,21 +521,40 @@ func (s *Server) Tunnel(stream grpc.BidiStreamingServer[pb.Frame, pb.Frame]) err
 	type pending struct {
 		header *pb.RequestHeader
 		body   []byte
+		// refused is a call the gate turned away: its body is read and
+		// dropped here, not relayed back as if it were a reverse call's.
+		refused bool
 	}
 	var pendMu sync.Mutex
 	pend := make(map[string]*pending)
 
 	// Live TCP-proxy streams (GUI, etc.), by request_id. Separate from pend: a
-	// stream's request bytes go straight to its socket, not into a buffer.
+	// stream's request bytes are queued for its socket's writer, not buffered
+	// whole.
 	var streamMu sync.Mutex
 	streamsByReq := make(map[string]*serverStream)
 	defer func() {
 		streamMu.Lock()
 		for _, ss := range streamsByReq {
-			_ = ss.conn.Close()
+			ss.abort()
 		}
 		streamMu.Unlock()
 	}()
+	dropStream := func(reqID string) bool {
+		streamMu.Lock()
+		defer streamMu.Unlock()
+		ss, ok := streamsByReq[reqID]
+		if ok {
+			ss.abort()
+			delete(streamsByReq, reqID)
+		}
+		return ok
+	}
+
+	// Running forward calls, by request_id, so a Cancel frame can reach the
+	// invocation's context.
+	var callsMu sync.Mutex
+	calls := make(map[string]context.CancelFunc)
 
 	// Track in-flight worker goroutines so we can wait for them on return.
 	var wg sync.WaitGroup
@@ -430,17 +581,30 @@ func (s *Server) Tunnel(stream grpc.BidiStreamingServer[pb.Frame, pb.Frame]) err
 			hdr := k.RequestHeader
 			switch hdr.GetDirection() {
 			case pb.Direction_LOCAL_TO_REMOTE:
+				// The gate is asked once, at the header, before anything is
+				// opened: a stream's local end may be a root helper's terminal.
+				if gerr := s.admit(peerCN, hdr.GetQrexecService()); gerr != nil {
+					log.Printf("grpc server: refusing %q for relay %q (%s): %v",
+						hdr.GetQrexecService(), relayName, orUnknown(peerCN), gerr)
+					_ = send(errorFrame(reqID, CodeDenied, gerr.Error()))
+					pendMu.Lock()
+					pend[reqID] = &pending{header: hdr, refused: true}
+					pendMu.Unlock()
+					break
+				}
 				if strings.HasPrefix(hdr.GetQrexecService(), streamServicePrefix) {
-					// TCP-proxy stream (GUI). A stream-prefixed request with a port
-					// outside the allowed range is REFUSED here — never routed to
-					// qrexec — so the tunnel can only reach the whitelisted loopback
-					// GUI ports.
-					port, ok := streamLocalPort(hdr.GetQrexecService())
-					if !ok {
-						_ = send(errorFrame(reqID, codeInvalid, "stream port not allowed"))
+					// TCP-proxy stream (GUI, a database, a web UI). A stream-prefixed
+					// request the forward policy does not grant is REFUSED here —
+					// never routed to qrexec — so the tunnel can only reach the
+					// endpoints the operator listed, and only for the roles listed.
+					network, address, ferr := s.forwards().Resolve(streamArg(hdr.GetQrexecService()), callerRole)
+					if ferr != nil {
+						log.Printf("grpc server: refusing stream %q for relay %q (role %q): %v",
+							hdr.GetQrexecService(), relayName, callerRole, ferr)
+						_ = send(errorFrame(reqID, CodeForwardDenied, "stream request not permitted by this agent's forward policy"))
 						break
 					}
-					ss, derr := s.startStream(ctx, reqID, port, send)
+					ss, derr := s.startStream(ctx, reqID, network, address, windows, send, dropStream)
 					if derr != nil {
 						_ = send(errorFrame(reqID, codeUnavailable, "stream dial: "+derr.Error()))
 						break
@@ -450,6 +614,21 @@ func (s *Server) Tunnel(stream grpc.BidiStreamingServer[pb.Frame, pb.Frame]) err
 					streamMu.Unlock()
 					break
 				}
+				if opener, canStream := s.invoker.(StreamOpener); canStream {
+					conn, isStream, oerr := opener.OpenStream(ctx, hdr.GetTargetQube(), hdr.GetQrexecService())
+					if oerr != nil {
+						log.Printf("grpc server: stream %q for relay %q: %v", hdr.GetQrexecService(), relayName, oerr)
+						_ = send(errorFrame(reqID, codeInternal, "stream open: "+oerr.Error()))
+						break
+					}
+					if isStream {
+						ss := s.serveStream(ctx, reqID, conn, windows, send, dropStream)
+						streamMu.Lock()
+						streamsByReq[reqID] = ss
+						streamMu.Unlock()
+						break
+					}
+				}
 				// Forward call: begin accumulating its request body.
 				pendMu.Lock()
 				pend[reqID] = &pending{header: hdr}
@@ -470,19 +649,27 @@ func (s *Server) Tunnel(stream grpc.BidiStreamingServer[pb.Frame, pb.Frame]) err
 
 		case *pb.Frame_Data:
 			reqID := frame.GetRequestId()
-			// A live TCP-proxy stream: write the request bytes straight to its
-			// socket. On write error the loopback side is gone — report and drop.
+			if derr := decodeChunk(k.Data, &s.compression); derr != nil {
+				// One undecodable chunk fails its call, not the tunnel.
+				_ = send(errorFrame(reqID, codeInvalid, derr.Error()))
+				dropStream(reqID)
+				pendMu.Lock()
+				delete(pend, reqID)
+				pendMu.Unlock()
+				break
+			}
+			// A live TCP-proxy stream: queue the request bytes for its socket's
+			// writer rather than writing here — a slow loopback reader must not
+			// stall this loop, and with it keepalives and every other call.
 			streamMu.Lock()
 			ss, isStream := streamsByReq[reqID]
 			streamMu.Unlock()
 			if isStream {
 				if k.Data.GetStreamId() == streamRequest {
-					if _, werr := ss.conn.Write(k.Data.GetPayload()); werr != nil {
-						_ = send(errorFrame(reqID, codeUnavailable, "stream write: "+werr.Error()))
-						_ = ss.conn.Close()
-						streamMu.Lock()
-						delete(streamsByReq, reqID)
-						streamMu.Unlock()
+					if perr := ss.queue.push(k.Data.GetPayload()); perr != nil {
+						log.Printf("grpc server: stream %s from relay %q: %v", reqID, relayName, perr)
+						_ = send(errorFrame(reqID, codeInvalid, perr.Error()))
+						dropStream(reqID)
 					}
 				}
 				break
@@ -498,7 +685,7 @@ func (s *Server) Tunnel(stream grpc.BidiStreamingServer[pb.Frame, pb.Frame]) err
 				}
 				break
 			}
-			if k.Data.GetStreamId() == streamRequest {
+			if k.Data.GetStreamId() == streamRequest && !p.refused {
 				pendMu.Lock()
 				p.body = append(p.body, k.Data.GetPayload()...)
 				pendMu.Unlock()
@@ -507,16 +694,16 @@ func (s *Server) Tunnel(stream grpc.BidiStreamingServer[pb.Frame, pb.Frame]) err
 
 		case *pb.Frame_Eos:
 			reqID := frame.GetRequestId()
-			// Stream: the client is done sending. Half-close the socket's write
-			// side so the loopback server sees EOF, but keep reading its response.
+			// Stream: the client is done sending. Closing the queue lets the
+			// writer drain what is still queued and then half-close the socket,
+			// so the loopback server sees EOF only after the last byte; its
+			// response keeps flowing.
 			streamMu.Lock()
 			ss, isStream := streamsByReq[reqID]
 			streamMu.Unlock()
 			if isStream {
 				if k.Eos.GetStreamId() == streamRequest {
-					if cw, ok := ss.conn.(interface{ CloseWrite() error }); ok {
-						_ = cw.CloseWrite()
-					}
+					ss.queue.close(nil)
 				}
 				break
 			}
@@ -539,27 +726,56 @@ func (s *Server) Tunnel(stream grpc.BidiStreamingServer[pb.Frame, pb.Frame]) err
 				delete(pend, reqID)
 			}
 			pendMu.Unlock()
-			if !ok {
+			if !ok || p.refused {
 				break
 			}
 
+			// Registered here, not in the goroutine, so a Cancel that arrives
+			// right behind the EOS cannot slip past before the call is known.
+			callCtx, cancelCall := callContext(ctx, p.header)
+			callsMu.Lock()
+			calls[reqID] = cancelCall
+			callsMu.Unlock()
+
 			wg.Add(1)
 			go func(reqID string, hdr *pb.RequestHeader, body []byte) {
 				defer wg.Done()
-				s.handleForward(ctx, reqID, hdr, body, send)
+				defer func() {
+					callsMu.Lock()
+					delete(calls, reqID)
+					callsMu.Unlock()
+					cancelCall()
+				}()
+				s.handleForward(callCtx, reqID, hdr, body, relayCaps.frameSize(), send)
 			}(reqID, p.header, p.body)
 
+		case *pb.Frame_Cancel:
+			// The relay stopped waiting. Stop whatever the request is doing: a
+			// running call's context is canceled (LocalInvoker kills the
+			// service's process group), a stream's socket is closed, and a body
+			// still being accumulated is dropped.
+			reqID := frame.GetRequestId()
+			callsMu.Lock()
+			cancelCall, running := calls[reqID]
+			callsMu.Unlock()
+			if running {
+				cancelCall()
+			}
+			pendMu.Lock()
+			_, accumulating := pend[reqID]
+			delete(pend, reqID)
+			pendMu.Unlock()
+			if dropStream(reqID) || running || accumulating {
+				log.Printf("grpc server: relay %q canceled request %s: %s",
+					relayName, reqID, k.Cancel.GetReason())
+			}
+
 		case *pb.Frame_Error:
 			// A call-level error reported by the peer. Relay reverse-path errors
 			// back; forward-path errors just drop the pending accumulation.
 			reqID := frame.GetRequestId()
 			// If it names a live stream, tear that stream's socket down.
-			streamMu.Lock()
-			if ss, isStream := streamsByReq[reqID]; isStream {
-				_ = ss.conn.Close()
-				delete(streamsByReq, reqID)
-			}
-			streamMu.Unlock()
+			dropStream(reqID)
 			pendMu.Lock()
 			_, isForward := pend[reqID]
 			if isForward {
@@ -572,6 +788,17 @@ func (s *Server) Tunnel(stream grpc.BidiStreamingServer[pb.Frame, pb.Frame]) err
 				}
 			}
 
+		case *pb.Frame_WindowUpdate:
+			// Credit for response chunks of a live stream.
+			if k.WindowUpdate.GetStreamId() == streamResponse {
+				streamMu.Lock()
+				ss := streamsByReq[frame.GetRequestId()]
+				streamMu.Unlock()
+				if ss != nil {
+					ss.win.grant(k.WindowUpdate.GetIncrement())
+				}
+			}
+
 		case *pb.Frame_Handshake:
 			// A second handshake is unexpected; ignore it.
 
@@ -584,7 +811,11 @@ func (s *Server) Tunnel(stream grpc.BidiStreamingServer[pb.Frame, pb.Frame]) err
 // handleForward executes an already-remote-dom0-authorized forward call via the
 // QrexecInvoker and streams the response (or a CallError) back. A per-call
 // failure never tears down the Tunnel.
-func (s *Server) handleForward(ctx context.Context, reqID string, hdr *pb.RequestHeader, body []byte, send func(*pb.Frame) error) {
+//
+// The response is split into frames of at most frameSize bytes: a service may
+// return up to 16 MiB, four times gRPC's default message limit.
+func (s *Server) handleForward(ctx context.Context, reqID string, hdr *pb.RequestHeader, body []byte,
+	frameSize int, send func(*pb.Frame) error) {
 	target := hdr.GetTargetQube()
 	service := hdr.GetQrexecService()
 
@@ -597,62 +828,96 @@ func (s *Server) handleForward(ctx context.Context, reqID string, hdr *pb.Reques
 	// Reaching here means the remote dom0/policy has re-authorized this call.
 	out, err := s.invoker.Invoke(ctx, target, service, body)
 	if err != nil {
-		_ = send(errorFrame(reqID, codeInternal, err.Error()))
+		// A canceled call is reported as such, for the record; the relay has
+		// already stopped waiting and will simply drop the frame.
+		switch ctx.Err() {
+		case context.Canceled:
+			_ = send(errorFrame(reqID, CodeCanceled, err.Error()))
+		case context.DeadlineExceeded:
+			_ = send(errorFrame(reqID, codeTimeout, err.Error()))
+		default:
+			_ = send(errorFrame(reqID, codeInternal, err.Error()))
+		}
 		return
 	}
-	if len(out) > 0 {
-		if err := send(dataFrame(reqID, streamResponse, out)); err != nil {
-			return
-		}
+	if err := sendChunked(reqID, streamResponse, out, frameSize, send); err != nil {
+		return
 	}
 	_ = send(eosFrame(reqID, streamResponse))
 }
 
-// streamServicePrefix marks a request that should be TCP-proxied to a loopback
-// port on THIS host rather than dispatched to a qrexec service. The port follows
-// the '+', e.g. "qubesair.StreamTCP+5900". This is how GUI (VNC/Xpra) rides the
-// agent's mTLS Tunnel without any port exposed on the remote's LAN.
+// deadlineSkewGrace is added to a caller's deadline before the agent enforces
+// it. deadline_unix_ms is an absolute time from the relay's clock; enforcing it
+// to the millisecond would let a few seconds of clock skew kill calls early.
+// The relay cancels on its own deadline regardless, so the grace only delays
+// the backstop for a Cancel frame that never arrived.
+const deadlineSkewGrace = 2 * time.Second
+
+// callContext derives a forward call's context from the tunnel's: cancelable by
+// a Cancel frame, and bounded by the caller's deadline when it sent one.
+func callContext(ctx context.Context, hdr *pb.RequestHeader) (context.Context, context.CancelFunc) {
+	if ms := hdr.GetDeadlineUnixMs(); ms > 0 {
+		return context.WithDeadline(ctx, time.UnixMilli(ms).Add(deadlineSkewGrace))
+	}
+	return context.WithCancel(ctx)
+}
+
+// streamServicePrefix marks a request that should be proxied to a socket on
+// THIS host rather than dispatched to a qrexec service. The port or forward name
+// follows the '+', e.g. "qubesair.StreamTCP+5900" or "qubesair.StreamTCP+postgres".
+// This is how GUI (VNC/Xpra) and other local services ride the agent's mTLS
+// Tunnel without any port exposed on the remote's LAN. What the argument may
+// reach is decided by the ForwardPolicy, not here.
 const streamServicePrefix = "qubesair.StreamTCP+"
 
-// streamLocalPort parses a stream service into its loopback port, if the service
-// is one and the port is in an allowed GUI range. The server dials only
-// 127.0.0.1:<port>, and only for these ports, so an authenticated relay cannot
-// use the tunnel to reach arbitrary local services (a database, the metadata
-// endpoint, ...). Widen the ranges here if a use case needs it.
-func streamLocalPort(service string) (int, bool) {
-	if !strings.HasPrefix(service, streamServicePrefix) {
-		return 0, false
-	}
-	p, err := strconv.Atoi(service[len(streamServicePrefix):])
-	if err != nil {
-		return 0, false
-	}
-	if (p >= 5900 && p <= 5910) || (p >= 10000 && p <= 10010) {
-		return p, true
-	}
-	return 0, false
+// streamArg returns the part of a stream service after the prefix.
+func streamArg(service string) string {
+	return strings.TrimPrefix(service, streamServicePrefix)
 }
 
-// serverStream is one live TCP proxy: the Tunnel side writes request bytes to
-// conn, and a reader goroutine turns conn's output into response frames.
+// serverStream is one live proxy — to a socket for StreamTCP, or to whatever an
+// invoker's StreamOpener returned: the Tunnel side queues request bytes for a
+// writer goroutine that feeds conn, and a reader goroutine turns conn's output
+// into response frames within the relay's window.
 type serverStream struct {
-	conn net.Conn
+	conn  io.ReadWriteCloser
+	queue *chunkQueue // request bytes waiting for conn
+	win   *sendWindow // credit for response bytes; nil without flow control
+}
+
+// abort tears the stream down in both directions.
+func (ss *serverStream) abort() {
+	_ = ss.conn.Close()
+	ss.queue.close(errStreamClosed)
+	ss.win.close()
 }
 
-// startStream dials 127.0.0.1:<port> and starts pumping its output back as
-// streamResponse frames. Request bytes arrive later via serverStream.conn.Write.
-func (s *Server) startStream(ctx context.Context, reqID string, port int, send func(*pb.Frame) error) (*serverStream, error) {
+// startStream dials the address the forward policy resolved, starts pumping
+// its output back as streamResponse frames, and starts the writer that feeds it
+// queued request bytes. drop removes the stream from the tunnel when the
+// writer finds the socket gone.
+func (s *Server) startStream(ctx context.Context, reqID, network, address string, windows streamWindows,
+	send func(*pb.Frame) error, drop func(reqID string) bool) (*serverStream, error) {
 	d := net.Dialer{Timeout: 10 * time.Second}
-	conn, err := d.DialContext(ctx, "tcp", "127.0.0.1:"+strconv.Itoa(port))
+	conn, err := d.DialContext(ctx, network, address)
 	if err != nil {
 		return nil, err
 	}
+	return s.serveStream(ctx, reqID, conn, windows, send, drop), nil
+}
+
+// serveStream pumps conn's output back as streamResponse frames and starts the
+// writer that feeds it queued request bytes.
+func (s *Server) serveStream(ctx context.Context, reqID string, conn io.ReadWriteCloser, windows streamWindows,
+	send func(*pb.Frame) error, drop func(reqID string) bool) *serverStream {
+	ss := &serverStream{conn: conn, queue: newChunkQueue(windows.recv), win: newSendWindow(windows.send)}
 	go func() {
-		buf := make([]byte, 32*1024)
+		buf := make([]byte, streamChunkSize)
 		for {
 			n, rerr := conn.Read(buf)
 			if n > 0 {
-				if serr := send(dataFrame(reqID, streamResponse, append([]byte(nil), buf[:n]...))); serr != nil {
+				chunk := append([]byte(nil), buf[:n]...)
+				if serr := sendWindowed(ctx, ss.win, reqID, streamResponse, chunk, send); serr != nil {
 					_ = conn.Close()
 					return
 				}
@@ -664,5 +929,34 @@ func (s *Server) startStream(ctx context.Context, reqID string, port int, send f
 			}
 		}
 	}()
-	return &serverStream{conn: conn}, nil
+	go ss.writeLoop(ctx, reqID, windows.recv, send, drop)
+	return ss
+}
+
+// writeLoop delivers queued request bytes to the socket, returning credit as
+// they are written. A clean end of the queue (the relay's EOS) half-closes the
+// socket's write side so the loopback server sees EOF but can still answer.
+func (ss *serverStream) writeLoop(ctx context.Context, reqID string, window uint32,
+	send func(*pb.Frame) error, drop func(reqID string) bool) {
+	credit := newCreditReturner(reqID, streamRequest, window, send)
+	for {
+		chunk, ok, err := ss.queue.pop(ctx)
+		if !ok {
+			if err == nil {
+				if cw, isTCP := ss.conn.(interface{ CloseWrite() error }); isTCP {
+					_ = cw.CloseWrite()
+				}
+			}
+			return
+		}
+		if _, werr := ss.conn.Write(chunk); werr != nil {
+			// The loopback side is gone — report and drop.
+			_ = send(errorFrame(reqID, codeUnavailable, "stream write: "+werr.Error()))
+			drop(reqID)
+			return
+		}
+		if cerr := credit.delivered(len(chunk)); cerr != nil {
+			return
+		}
+	}
 }
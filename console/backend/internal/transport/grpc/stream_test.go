@@ -2,6 +2,7 @@ package grpc
 
 import (
 	"context"
+	"errors"
 	"io"
 	"net"
 	"strings"
@@ -104,11 +105,103 @@ func TestClientServerStreamTCP(t *testing.T) {
 
 	// A non-allowlisted port must be refused (no dial to arbitrary local ports).
 	badErr := cli.CallStream(context.Background(), "remote-gpu", streamServicePrefix+"22", strings.NewReader(""), io.Discard)
-	if badErr == nil {
-		t.Fatal("stream to non-allowlisted port 22 should fail")
+	if !IsRemoteCode(badErr, CodeForwardDenied) {
+		t.Fatalf("stream to non-allowlisted port 22: want %s, got %v", CodeForwardDenied, badErr)
 	}
 
 	_ = stdinW.Close()
 	cliCancel()
 	srvCancel()
 }
+
+// streamInvoker serves qubesair.Echo as a stream of its own, as the agent
+// serves qubesair.Shell, and fails to open qubesair.Broken.
+type streamInvoker struct{ fakeInvoker }
+
+func (s *streamInvoker) OpenStream(_ context.Context, _, service string) (io.ReadWriteCloser, bool, error) {
+	switch service {
+	case "qubesair.Echo":
+		a, b := net.Pipe()
+		go func() { _, _ = io.Copy(b, b); _ = b.Close() }()
+		return a, true, nil
+	case "qubesair.Broken":
+		return nil, true, errors.New("helper unavailable")
+	}
+	return nil, false, nil
+}
+
+// TestClientServerStreamOpener — an invoker's own stream is spliced like a
+// StreamTCP socket, a failure to open it reaches the caller, and calls it does
+// not claim are still ordinary calls.
+func TestClientServerStreamOpener(t *testing.T) {
+	caCert, caKey := mkCA(t)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := lis.Addr().String()
+	_ = lis.Close()
+
+	srv := NewServer(ServerConfig{Listen: addr, TLS: mkServerTLS(t, caCert, caKey)}, &streamInvoker{})
+	srvCtx, srvCancel := context.WithCancel(context.Background())
+	defer srvCancel()
+	go func() { _ = srv.Serve(srvCtx) }()
+	waitDial(t, addr)
+
+	cli := NewClient(ClientConfig{
+		RemoteEndpoint: addr,
+		RelayName:      "sys-relay-test",
+		RemoteName:     "remote-test",
+		KeepAlive:      200 * time.Millisecond,
+		ReconnectMin:   20 * time.Millisecond,
+		ReconnectMax:   200 * time.Millisecond,
+		TLS:            mkClientTLS(t, caCert, caKey),
+	}, nil)
+	cliCtx, cliCancel := context.WithCancel(context.Background())
+	defer cliCancel()
+	go func() { _ = cli.Start(cliCtx) }()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		cctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		var out []byte
+		out, err = cli.Call(cctx, "remote-gpu", "qubesair.Ping", []byte("x"))
+		cancel()
+		if err == nil {
+			if string(out) != "remote-handled:x" {
+				t.Fatalf("an unclaimed service was not an ordinary call: %q", out)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("tunnel never came up: %v", err)
+		}
+		time.Sleep(30 * time.Millisecond)
+	}
+
+	stdinR, stdinW := io.Pipe()
+	stdoutR, stdoutW := io.Pipe()
+	go func() {
+		err := cli.CallStream(context.Background(), "remote-gpu", "qubesair.Echo", stdinR, stdoutW)
+		_ = stdoutW.CloseWithError(err)
+	}()
+	msg := []byte("keystrokes to a terminal")
+	go func() { _, _ = stdinW.Write(msg) }()
+	got := make([]byte, len(msg))
+	readDone := make(chan error, 1)
+	go func() { _, e := io.ReadFull(stdoutR, got); readDone <- e }()
+	select {
+	case e := <-readDone:
+		if e != nil || string(got) != string(msg) {
+			t.Fatalf("echo = %q, %v", got, e)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("did not receive echoed bytes within 3s")
+	}
+	_ = stdinW.Close()
+
+	err = cli.CallStream(context.Background(), "remote-gpu", "qubesair.Broken", strings.NewReader(""), io.Discard)
+	if !IsRemoteCode(err, CodeInternal) || !strings.Contains(err.Error(), "helper unavailable") {
+		t.Fatalf("stream that failed to open = %v, want %s with the reason", err, CodeInternal)
+	}
+}
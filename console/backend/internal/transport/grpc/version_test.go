@@ -29,7 +29,10 @@ func TestSupportsProtocol(t *testing.T) {
 	if !supportsProtocol(protocolVersion) {
 		t.Errorf("this build must serve its own protocol version %q", protocolVersion)
 	}
-	for _, v := range []string{"", "v0", "v2", "V1", "1", "garbage"} {
+	if !supportsProtocol(oldestProtocolVersion) {
+		t.Errorf("this build must keep serving %q peers, or upgrading it first strands them", oldestProtocolVersion)
+	}
+	for _, v := range []string{"", "v0", "v3", "V1", "1", "garbage"} {
 		if supportsProtocol(v) {
 			t.Errorf("must not claim to serve unknown protocol %q", v)
 		}
@@ -40,8 +43,8 @@ func TestSupportsProtocol(t *testing.T) {
 // reads when a connection is refused. It has to name both what arrived and what
 // is served, or the reader cannot tell which side to upgrade.
 func TestProtocolMismatchMessageIsActionable(t *testing.T) {
-	msg := protocolMismatchMessage("v2")
-	if !strings.Contains(msg, "v2") {
+	msg := protocolMismatchMessage("v3")
+	if !strings.Contains(msg, "v3") {
 		t.Errorf("message must name the version received: %q", msg)
 	}
 	if !strings.Contains(msg, protocolVersion) {
@@ -69,6 +72,7 @@ func TestErrorCodesAreStable(t *testing.T) {
 		"timeout":           CodeTimeout,
 		"unavailable":       CodeUnavailable,
 		"internal":          CodeInternal,
+		"canceled":          CodeCanceled,
 	}
 	expect := map[string]string{
 		"protocol mismatch": "PROTOCOL_MISMATCH",
@@ -76,6 +80,7 @@ func TestErrorCodesAreStable(t *testing.T) {
 		"timeout":           "TIMEOUT",
 		"unavailable":       "UNAVAILABLE",
 		"internal":          "INTERNAL",
+		"canceled":          "CANCELED",
 	}
 	for k, got := range want {
 		if got != expect[k] {
@@ -92,7 +97,7 @@ func TestHandshakeCarriesBuildVersion(t *testing.T) {
 	defer func() { BuildVersion = original }()
 	BuildVersion = "1.2.3"
 
-	f := handshakeFrame("sys-relay-pve", "remote-dev")
+	f := handshakeFrame("sys-relay-pve", "remote-dev", defaultStreamWindow)
 	hs := f.GetHandshake()
 	if hs == nil {
 		t.Fatal("expected a Handshake frame")
@@ -121,6 +121,8 @@ type Frame struct {
 	//	*Frame_Eos
 	//	*Frame_Error
 	//	*Frame_KeepAlive
+	//	*Frame_WindowUpdate
+	//	*Frame_Cancel
 	Kind          isFrame_Kind `protobuf_oneof:"kind"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
@@ -224,6 +226,24 @@ func (x *Frame) GetKeepAlive() *KeepAlive {
 	return nil
 }
 
+func (x *Frame) GetWindowUpdate() *WindowUpdate {
+	if x != nil {
+		if x, ok := x.Kind.(*Frame_WindowUpdate); ok {
+			return x.WindowUpdate
+		}
+	}
+	return nil
+}
+
+func (x *Frame) GetCancel() *Cancel {
+	if x != nil {
+		if x, ok := x.Kind.(*Frame_Cancel); ok {
+			return x.Cancel
+		}
+	}
+	return nil
+}
+
 type isFrame_Kind interface {
 	isFrame_Kind()
 }
@@ -252,6 +272,14 @@ type Frame_KeepAlive struct {
 	KeepAlive *KeepAlive `protobuf:"bytes,7,opt,name=keep_alive,json=keepAlive,proto3,oneof"` // 心跳保活
 }
 
+type Frame_WindowUpdate struct {
+	WindowUpdate *WindowUpdate `protobuf:"bytes,8,opt,name=window_update,json=windowUpdate,proto3,oneof"` // 流控：接收方归还发送额度
+}
+
+type Frame_Cancel struct {
+	Cancel *Cancel `protobuf:"bytes,9,opt,name=cancel,proto3,oneof"` // 发起方放弃该调用，执行方应停止
+}
+
 func (*Frame_Handshake) isFrame_Kind() {}
 
 func (*Frame_RequestHeader) isFrame_Kind() {}
@@ -264,6 +292,10 @@ func (*Frame_Error) isFrame_Kind() {}
 
 func (*Frame_KeepAlive) isFrame_Kind() {}
 
+func (*Frame_WindowUpdate) isFrame_Kind() {}
+
+func (*Frame_Cancel) isFrame_Kind() {}
+
 // Handshake：建流后 client→server（及 server→client 回应）首帧。
 // 承载协议版本与 relay 身份（remote_name 对齐 Qubes RemoteVM 的 remote_name 属性）。
 type Handshake struct {
@@ -277,7 +309,18 @@ type Handshake struct {
 	RemoteName      string `protobuf:"bytes,3,opt,name=remote_name,json=remoteName,proto3" json:"remote_name,omitempty"` // 目标远端标识（对齐 RemoteVM remote_name）
 	// build_version：发送方的构建版本（如 "0.3.7"）。**仅用于可观测性**，
 	// 不参与兼容性判断。运维排查「远端跑的是哪个 agent」时看这个。
-	BuildVersion  string `protobuf:"bytes,4,opt,name=build_version,json=buildVersion,proto3" json:"build_version,omitempty"`
+	BuildVersion string `protobuf:"bytes,4,opt,name=build_version,json=buildVersion,proto3" json:"build_version,omitempty"`
+	// initial_window：本端为每个流式调用、每个方向提供的初始接收窗口（字节）。
+	//
+	// 双方握手都带非 0 值时，该 Tunnel 上的流式调用（qubesair.StreamTCP）启用
+	// 基于额度的流控：发送方未被确认的 DataChunk 字节数不得超过对端窗口，
+	// 接收方把数据真正交付（写入 socket / stdout）后用 WindowUpdate 归还额度。
+	// 任一方为 0（旧版本不认识此字段）则整条 Tunnel 保持旧行为，不做流控。
+	InitialWindow uint32 `protobuf:"varint,5,opt,name=initial_window,json=initialWindow,proto3" json:"initial_window,omitempty"`
+	// capabilities：本端能力声明（protocol v2 起）。v1 对端不发送，视为全部缺省。
+	// 对端据此挑选功能（是否发 Cancel、帧多大、是否压缩…），而不是按版本号猜，
+	// 这样新功能可以逐台上线，不需要所有远端同时升级。
+	Capabilities  *Capabilities `protobuf:"bytes,6,opt,name=capabilities,proto3" json:"capabilities,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -340,6 +383,120 @@ func (x *Handshake) GetBuildVersion() string {
 	return ""
 }
 
+func (x *Handshake) GetInitialWindow() uint32 {
+	if x != nil {
+		return x.InitialWindow
+	}
+	return 0
+}
+
+func (x *Handshake) GetCapabilities() *Capabilities {
+	if x != nil {
+		return x.Capabilities
+	}
+	return nil
+}
+
+// Capabilities：一端在握手中声明的能力。只描述「我能处理什么」，不是授权。
+type Capabilities struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// frame_kinds：本端理解的 Frame.kind 名（如 "window_update"、"cancel"）。
+	FrameKinds []string `protobuf:"bytes,1,rep,name=frame_kinds,json=frameKinds,proto3" json:"frame_kinds,omitempty"`
+	// flow_control：本端支持 WindowUpdate 流控（是否启用仍看双方 initial_window）。
+	FlowControl bool `protobuf:"varint,2,opt,name=flow_control,json=flowControl,proto3" json:"flow_control,omitempty"`
+	// compression：本端能解压的 DataChunk 压缩算法（如 "gzip"）；空 = 不压缩。
+	Compression []string `protobuf:"bytes,3,rep,name=compression,proto3" json:"compression,omitempty"`
+	// cancel：本端处理 Cancel 帧，会停止对应调用。
+	Cancel bool `protobuf:"varint,4,opt,name=cancel,proto3" json:"cancel,omitempty"`
+	// structured_results：本端能产出结构化结果（退出码等）。目前尚无实现产出。
+	StructuredResults bool `protobuf:"varint,5,opt,name=structured_results,json=structuredResults,proto3" json:"structured_results,omitempty"`
+	// max_frame_size：本端愿意接收的单个 DataChunk payload 上限（字节）；0 = 未声明。
+	MaxFrameSize uint32 `protobuf:"varint,6,opt,name=max_frame_size,json=maxFrameSize,proto3" json:"max_frame_size,omitempty"`
+	// services：执行方对外提供的服务名（内建 + allowlist）。仅供展示与排错。
+	Services      []string `protobuf:"bytes,7,rep,name=services,proto3" json:"services,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Capabilities) Reset() {
+	*x = Capabilities{}
+	mi := &file_relay_transport_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Capabilities) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Capabilities) ProtoMessage() {}
+
+func (x *Capabilities) ProtoReflect() protoreflect.Message {
+	mi := &file_relay_transport_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Capabilities.ProtoReflect.Descriptor instead.
+func (*Capabilities) Descriptor() ([]byte, []int) {
+	return file_relay_transport_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *Capabilities) GetFrameKinds() []string {
+	if x != nil {
+		return x.FrameKinds
+	}
+	return nil
+}
+
+func (x *Capabilities) GetFlowControl() bool {
+	if x != nil {
+		return x.FlowControl
+	}
+	return false
+}
+
+func (x *Capabilities) GetCompression() []string {
+	if x != nil {
+		return x.Compression
+	}
+	return nil
+}
+
+func (x *Capabilities) GetCancel() bool {
+	if x != nil {
+		return x.Cancel
+	}
+	return false
+}
+
+func (x *Capabilities) GetStructuredResults() bool {
+	if x != nil {
+		return x.StructuredResults
+	}
+	return false
+}
+
+func (x *Capabilities) GetMaxFrameSize() uint32 {
+	if x != nil {
+		return x.MaxFrameSize
+	}
+	return 0
+}
+
+func (x *Capabilities) GetServices() []string {
+	if x != nil {
+		return x.Services
+	}
+	return nil
+}
+
 // RequestHeader：一次 qrexec 调用的头。
 type RequestHeader struct {
 	state     protoimpl.MessageState `protogen:"open.v1"`
@@ -358,7 +515,7 @@ type RequestHeader struct {
 
 func (x *RequestHeader) Reset() {
 	*x = RequestHeader{}
-	mi := &file_relay_transport_proto_msgTypes[2]
+	mi := &file_relay_transport_proto_msgTypes[3]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -370,7 +527,7 @@ func (x *RequestHeader) String() string {
 func (*RequestHeader) ProtoMessage() {}
 
 func (x *RequestHeader) ProtoReflect() protoreflect.Message {
-	mi := &file_relay_transport_proto_msgTypes[2]
+	mi := &file_relay_transport_proto_msgTypes[3]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -383,7 +540,7 @@ func (x *RequestHeader) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use RequestHeader.ProtoReflect.Descriptor instead.
 func (*RequestHeader) Descriptor() ([]byte, []int) {
-	return file_relay_transport_proto_rawDescGZIP(), []int{2}
+	return file_relay_transport_proto_rawDescGZIP(), []int{3}
 }
 
 func (x *RequestHeader) GetDirection() Direction {
@@ -427,15 +584,19 @@ type DataChunk struct {
 	// stream_id：区分同一调用内的子流。约定：
 	//
 	//	0 = 请求体（发起方→执行方），1 = 响应体（执行方→发起方），2 = stderr（可选）。
-	StreamId      uint32 `protobuf:"varint,1,opt,name=stream_id,json=streamId,proto3" json:"stream_id,omitempty"`
-	Payload       []byte `protobuf:"bytes,2,opt,name=payload,proto3" json:"payload,omitempty"`
+	StreamId uint32 `protobuf:"varint,1,opt,name=stream_id,json=streamId,proto3" json:"stream_id,omitempty"`
+	Payload  []byte `protobuf:"bytes,2,opt,name=payload,proto3" json:"payload,omitempty"`
+	// compression：payload 的编码。空 = 原样；"gzip" = gzip 压缩。只在对端于
+	// Capabilities.compression 中声明过该算法时才会使用，同一调用内可混用
+	// 压缩与未压缩的分块（小块、压不小的块原样发送）。
+	Compression   string `protobuf:"bytes,3,opt,name=compression,proto3" json:"compression,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
 
 func (x *DataChunk) Reset() {
 	*x = DataChunk{}
-	mi := &file_relay_transport_proto_msgTypes[3]
+	mi := &file_relay_transport_proto_msgTypes[4]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -447,7 +608,7 @@ func (x *DataChunk) String() string {
 func (*DataChunk) ProtoMessage() {}
 
 func (x *DataChunk) ProtoReflect() protoreflect.Message {
-	mi := &file_relay_transport_proto_msgTypes[3]
+	mi := &file_relay_transport_proto_msgTypes[4]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -460,7 +621,7 @@ func (x *DataChunk) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use DataChunk.ProtoReflect.Descriptor instead.
 func (*DataChunk) Descriptor() ([]byte, []int) {
-	return file_relay_transport_proto_rawDescGZIP(), []int{3}
+	return file_relay_transport_proto_rawDescGZIP(), []int{4}
 }
 
 func (x *DataChunk) GetStreamId() uint32 {
@@ -477,6 +638,13 @@ func (x *DataChunk) GetPayload() []byte {
 	return nil
 }
 
+func (x *DataChunk) GetCompression() string {
+	if x != nil {
+		return x.Compression
+	}
+	return ""
+}
+
 // EndOfStream：某个 stream_id 的数据结束。
 type EndOfStream struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
@@ -487,7 +655,7 @@ type EndOfStream struct {
 
 func (x *EndOfStream) Reset() {
 	*x = EndOfStream{}
-	mi := &file_relay_transport_proto_msgTypes[4]
+	mi := &file_relay_transport_proto_msgTypes[5]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -499,7 +667,7 @@ func (x *EndOfStream) String() string {
 func (*EndOfStream) ProtoMessage() {}
 
 func (x *EndOfStream) ProtoReflect() protoreflect.Message {
-	mi := &file_relay_transport_proto_msgTypes[4]
+	mi := &file_relay_transport_proto_msgTypes[5]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -512,7 +680,7 @@ func (x *EndOfStream) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use EndOfStream.ProtoReflect.Descriptor instead.
 func (*EndOfStream) Descriptor() ([]byte, []int) {
-	return file_relay_transport_proto_rawDescGZIP(), []int{4}
+	return file_relay_transport_proto_rawDescGZIP(), []int{5}
 }
 
 func (x *EndOfStream) GetStreamId() uint32 {
@@ -534,7 +702,7 @@ type CallError struct {
 
 func (x *CallError) Reset() {
 	*x = CallError{}
-	mi := &file_relay_transport_proto_msgTypes[5]
+	mi := &file_relay_transport_proto_msgTypes[6]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -546,7 +714,7 @@ func (x *CallError) String() string {
 func (*CallError) ProtoMessage() {}
 
 func (x *CallError) ProtoReflect() protoreflect.Message {
-	mi := &file_relay_transport_proto_msgTypes[5]
+	mi := &file_relay_transport_proto_msgTypes[6]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -559,7 +727,7 @@ func (x *CallError) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use CallError.ProtoReflect.Descriptor instead.
 func (*CallError) Descriptor() ([]byte, []int) {
-	return file_relay_transport_proto_rawDescGZIP(), []int{5}
+	return file_relay_transport_proto_rawDescGZIP(), []int{6}
 }
 
 func (x *CallError) GetCode() string {
@@ -576,6 +744,108 @@ func (x *CallError) GetMessage() string {
 	return ""
 }
 
+// WindowUpdate：流控额度归还。request_id 指明调用，stream_id 指明哪个方向的
+// 数据被消费（0 = 请求体，1 = 响应体），increment 为新增可发送字节数。
+// 只在握手协商启用流控后出现；KeepAlive 等控制帧不受窗口限制。
+type WindowUpdate struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	StreamId      uint32                 `protobuf:"varint,1,opt,name=stream_id,json=streamId,proto3" json:"stream_id,omitempty"`
+	Increment     uint32                 `protobuf:"varint,2,opt,name=increment,proto3" json:"increment,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *WindowUpdate) Reset() {
+	*x = WindowUpdate{}
+	mi := &file_relay_transport_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *WindowUpdate) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*WindowUpdate) ProtoMessage() {}
+
+func (x *WindowUpdate) ProtoReflect() protoreflect.Message {
+	mi := &file_relay_transport_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use WindowUpdate.ProtoReflect.Descriptor instead.
+func (*WindowUpdate) Descriptor() ([]byte, []int) {
+	return file_relay_transport_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *WindowUpdate) GetStreamId() uint32 {
+	if x != nil {
+		return x.StreamId
+	}
+	return 0
+}
+
+func (x *WindowUpdate) GetIncrement() uint32 {
+	if x != nil {
+		return x.Increment
+	}
+	return 0
+}
+
+// Cancel：发起方不再等待该 request_id（context 取消或超过 deadline）。
+// 执行方取消对应调用的 context：服务进程整组被杀，TCP 流的 socket 被关闭。
+// 旧版本执行方把它当未知帧忽略，调用只是跑到自己的超时为止——与以前相同。
+type Cancel struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Reason        string                 `protobuf:"bytes,1,opt,name=reason,proto3" json:"reason,omitempty"` // 仅供日志，如 "context canceled"
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Cancel) Reset() {
+	*x = Cancel{}
+	mi := &file_relay_transport_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Cancel) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Cancel) ProtoMessage() {}
+
+func (x *Cancel) ProtoReflect() protoreflect.Message {
+	mi := &file_relay_transport_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Cancel.ProtoReflect.Descriptor instead.
+func (*Cancel) Descriptor() ([]byte, []int) {
+	return file_relay_transport_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *Cancel) GetReason() string {
+	if x != nil {
+		return x.Reason
+	}
+	return ""
+}
+
 // KeepAlive：心跳。client 周期发送，server 回应；用于探活与保持 NAT 映射。
 // 断线由 client 侧检测并重连（替代 autossh 保活角色）。
 type KeepAlive struct {
@@ -587,7 +857,7 @@ type KeepAlive struct {
 
 func (x *KeepAlive) Reset() {
 	*x = KeepAlive{}
-	mi := &file_relay_transport_proto_msgTypes[6]
+	mi := &file_relay_transport_proto_msgTypes[9]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -599,7 +869,7 @@ func (x *KeepAlive) String() string {
 func (*KeepAlive) ProtoMessage() {}
 
 func (x *KeepAlive) ProtoReflect() protoreflect.Message {
-	mi := &file_relay_transport_proto_msgTypes[6]
+	mi := &file_relay_transport_proto_msgTypes[9]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -612,7 +882,7 @@ func (x *KeepAlive) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use KeepAlive.ProtoReflect.Descriptor instead.
 func (*KeepAlive) Descriptor() ([]byte, []int) {
-	return file_relay_transport_proto_rawDescGZIP(), []int{6}
+	return file_relay_transport_proto_rawDescGZIP(), []int{9}
 }
 
 func (x *KeepAlive) GetUnixMs() int64 {
@@ -626,7 +896,7 @@ var File_relay_transport_proto protoreflect.FileDescriptor
 
 const file_relay_transport_proto_rawDesc = "" +
 	"\n" +
-	"\x15relay_transport.proto\x12\x15qubesair.transport.v1\"\xac\x03\n" +
+	"\x15relay_transport.proto\x12\x15qubesair.transport.v1\"\xb1\x04\n" +
 	"\x05Frame\x12\x1d\n" +
 	"\n" +
 	"request_id\x18\x01 \x01(\tR\trequestId\x12@\n" +
@@ -636,15 +906,28 @@ const file_relay_transport_proto_rawDesc = "" +
 	"\x03eos\x18\x05 \x01(\v2\".qubesair.transport.v1.EndOfStreamH\x00R\x03eos\x128\n" +
 	"\x05error\x18\x06 \x01(\v2 .qubesair.transport.v1.CallErrorH\x00R\x05error\x12A\n" +
 	"\n" +
-	"keep_alive\x18\a \x01(\v2 .qubesair.transport.v1.KeepAliveH\x00R\tkeepAliveB\x06\n" +
-	"\x04kind\"\x9b\x01\n" +
+	"keep_alive\x18\a \x01(\v2 .qubesair.transport.v1.KeepAliveH\x00R\tkeepAlive\x12J\n" +
+	"\rwindow_update\x18\b \x01(\v2#.qubesair.transport.v1.WindowUpdateH\x00R\fwindowUpdate\x127\n" +
+	"\x06cancel\x18\t \x01(\v2\x1d.qubesair.transport.v1.CancelH\x00R\x06cancelB\x06\n" +
+	"\x04kind\"\x8b\x02\n" +
 	"\tHandshake\x12)\n" +
 	"\x10protocol_version\x18\x01 \x01(\tR\x0fprotocolVersion\x12\x1d\n" +
 	"\n" +
 	"relay_name\x18\x02 \x01(\tR\trelayName\x12\x1f\n" +
 	"\vremote_name\x18\x03 \x01(\tR\n" +
 	"remoteName\x12#\n" +
-	"\rbuild_version\x18\x04 \x01(\tR\fbuildVersion\"\xe2\x01\n" +
+	"\rbuild_version\x18\x04 \x01(\tR\fbuildVersion\x12%\n" +
+	"\x0einitial_window\x18\x05 \x01(\rR\rinitialWindow\x12G\n" +
+	"\fcapabilities\x18\x06 \x01(\v2#.qubesair.transport.v1.CapabilitiesR\fcapabilities\"\xfd\x01\n" +
+	"\fCapabilities\x12\x1f\n" +
+	"\vframe_kinds\x18\x01 \x03(\tR\n" +
+	"frameKinds\x12!\n" +
+	"\fflow_control\x18\x02 \x01(\bR\vflowControl\x12 \n" +
+	"\vcompression\x18\x03 \x03(\tR\vcompression\x12\x16\n" +
+	"\x06cancel\x18\x04 \x01(\bR\x06cancel\x12-\n" +
+	"\x12structured_results\x18\x05 \x01(\bR\x11structuredResults\x12$\n" +
+	"\x0emax_frame_size\x18\x06 \x01(\rR\fmaxFrameSize\x12\x1a\n" +
+	"\bservices\x18\a \x03(\tR\bservices\"\xe2\x01\n" +
 	"\rRequestHeader\x12>\n" +
 	"\tdirection\x18\x01 \x01(\x0e2 .qubesair.transport.v1.DirectionR\tdirection\x12%\n" +
 	"\x0eqrexec_service\x18\x02 \x01(\tR\rqrexecService\x12\x1f\n" +
@@ -652,15 +935,21 @@ const file_relay_transport_proto_rawDesc = "" +
 	"sourceQube\x12\x1f\n" +
 	"\vtarget_qube\x18\x04 \x01(\tR\n" +
 	"targetQube\x12(\n" +
-	"\x10deadline_unix_ms\x18\x05 \x01(\x03R\x0edeadlineUnixMs\"B\n" +
+	"\x10deadline_unix_ms\x18\x05 \x01(\x03R\x0edeadlineUnixMs\"d\n" +
 	"\tDataChunk\x12\x1b\n" +
 	"\tstream_id\x18\x01 \x01(\rR\bstreamId\x12\x18\n" +
-	"\apayload\x18\x02 \x01(\fR\apayload\"*\n" +
+	"\apayload\x18\x02 \x01(\fR\apayload\x12 \n" +
+	"\vcompression\x18\x03 \x01(\tR\vcompression\"*\n" +
 	"\vEndOfStream\x12\x1b\n" +
 	"\tstream_id\x18\x01 \x01(\rR\bstreamId\"9\n" +
 	"\tCallError\x12\x12\n" +
 	"\x04code\x18\x01 \x01(\tR\x04code\x12\x18\n" +
-	"\amessage\x18\x02 \x01(\tR\amessage\"$\n" +
+	"\amessage\x18\x02 \x01(\tR\amessage\"I\n" +
+	"\fWindowUpdate\x12\x1b\n" +
+	"\tstream_id\x18\x01 \x01(\rR\bstreamId\x12\x1c\n" +
+	"\tincrement\x18\x02 \x01(\rR\tincrement\" \n" +
+	"\x06Cancel\x12\x16\n" +
+	"\x06reason\x18\x01 \x01(\tR\x06reason\"$\n" +
 	"\tKeepAlive\x12\x17\n" +
 	"\aunix_ms\x18\x01 \x01(\x03R\x06unixMs*P\n" +
 	"\tDirection\x12\x19\n" +
@@ -668,7 +957,9 @@ const file_relay_transport_proto_rawDesc = "" +
 	"\x0fLOCAL_TO_REMOTE\x10\x01\x12\x13\n" +
 	"\x0fREMOTE_TO_LOCAL\x10\x022Z\n" +
 	"\x0eRelayTransport\x12H\n" +
-	"\x06Tunnel\x12\x1c.qubesair.transport.v1.Frame\x1a\x1c.qubesair.transport.v1.Frame(\x010\x01BIZGgithub.com/slchris/qubes-air/console/internal/transport/relaypb;relaypbb\x06proto3"
+	"\x06Tunnel\x12\x1c.qubesair.transport.v1.Frame\x1a\x1c.qubesair.transport.v1.Frame(\x010\x012W\n" +
+	"\vRelayAttach\x12H\n" +
+	"\x06Attach\x12\x1c.qubesair.transport.v1.Frame\x1a\x1c.qubesair.transport.v1.Frame(\x010\x01BIZGgithub.com/slchris/qubes-air/console/internal/transport/relaypb;relaypbb\x06proto3"
 
 var (
 	file_relay_transport_proto_rawDescOnce sync.Once
@@ -683,32 +974,40 @@ func file_relay_transport_proto_rawDescGZIP() []byte {
 }
 
 var file_relay_transport_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
-var file_relay_transport_proto_msgTypes = make([]protoimpl.MessageInfo, 7)
+var file_relay_transport_proto_msgTypes = make([]protoimpl.MessageInfo, 10)
 var file_relay_transport_proto_goTypes = []any{
 	(Direction)(0),        // 0: qubesair.transport.v1.Direction
 	(*Frame)(nil),         // 1: qubesair.transport.v1.Frame
 	(*Handshake)(nil),     // 2: qubesair.transport.v1.Handshake
-	(*RequestHeader)(nil), // 3: qubesair.transport.v1.RequestHeader
-	(*DataChunk)(nil),     // 4: qubesair.transport.v1.DataChunk
-	(*EndOfStream)(nil),   // 5: qubesair.transport.v1.EndOfStream
-	(*CallError)(nil),     // 6: qubesair.transport.v1.CallError
-	(*KeepAlive)(nil),     // 7: qubesair.transport.v1.KeepAlive
+	(*Capabilities)(nil),  // 3: qubesair.transport.v1.Capabilities
+	(*RequestHeader)(nil), // 4: qubesair.transport.v1.RequestHeader
+	(*DataChunk)(nil),     // 5: qubesair.transport.v1.DataChunk
+	(*EndOfStream)(nil),   // 6: qubesair.transport.v1.EndOfStream
+	(*CallError)(nil),     // 7: qubesair.transport.v1.CallError
+	(*WindowUpdate)(nil),  // 8: qubesair.transport.v1.WindowUpdate
+	(*Cancel)(nil),        // 9: qubesair.transport.v1.Cancel
+	(*KeepAlive)(nil),     // 10: qubesair.transport.v1.KeepAlive
 }
 var file_relay_transport_proto_depIdxs = []int32{
-	2, // 0: qubesair.transport.v1.Frame.handshake:type_name -> qubesair.transport.v1.Handshake
-	3, // 1: qubesair.transport.v1.Frame.request_header:type_name -> qubesair.transport.v1.RequestHeader
-	4, // 2: qubesair.transport.v1.Frame.data:type_name -> qubesair.transport.v1.DataChunk
-	5, // 3: qubesair.transport.v1.Frame.eos:type_name -> qubesair.transport.v1.EndOfStream
-	6, // 4: qubesair.transport.v1.Frame.error:type_name -> qubesair.transport.v1.CallError
-	7, // 5: qubesair.transport.v1.Frame.keep_alive:type_name -> qubesair.transport.v1.KeepAlive
-	0, // 6: qubesair.transport.v1.RequestHeader.direction:type_name -> qubesair.transport.v1.Direction
-	1, // 7: qubesair.transport.v1.RelayTransport.Tunnel:input_type -> qubesair.transport.v1.Frame
-	1, // 8: qubesair.transport.v1.RelayTransport.Tunnel:output_type -> qubesair.transport.v1.Frame
-	8, // [8:9] is the sub-list for method output_type
-	7, // [7:8] is the sub-list for method input_type
-	7, // [7:7] is the sub-list for extension type_name
-	7, // [7:7] is the sub-list for extension extendee
-	0, // [0:7] is the sub-list for field type_name
+	2,  // 0: qubesair.transport.v1.Frame.handshake:type_name -> qubesair.transport.v1.Handshake
+	4,  // 1: qubesair.transport.v1.Frame.request_header:type_name -> qubesair.transport.v1.RequestHeader
+	5,  // 2: qubesair.transport.v1.Frame.data:type_name -> qubesair.transport.v1.DataChunk
+	6,  // 3: qubesair.transport.v1.Frame.eos:type_name -> qubesair.transport.v1.EndOfStream
+	7,  // 4: qubesair.transport.v1.Frame.error:type_name -> qubesair.transport.v1.CallError
+	10, // 5: qubesair.transport.v1.Frame.keep_alive:type_name -> qubesair.transport.v1.KeepAlive
+	8,  // 6: qubesair.transport.v1.Frame.window_update:type_name -> qubesair.transport.v1.WindowUpdate
+	9,  // 7: qubesair.transport.v1.Frame.cancel:type_name -> qubesair.transport.v1.Cancel
+	3,  // 8: qubesair.transport.v1.Handshake.capabilities:type_name -> qubesair.transport.v1.Capabilities
+	0,  // 9: qubesair.transport.v1.RequestHeader.direction:type_name -> qubesair.transport.v1.Direction
+	1,  // 10: qubesair.transport.v1.RelayTransport.Tunnel:input_type -> qubesair.transport.v1.Frame
+	1,  // 11: qubesair.transport.v1.RelayAttach.Attach:input_type -> qubesair.transport.v1.Frame
+	1,  // 12: qubesair.transport.v1.RelayTransport.Tunnel:output_type -> qubesair.transport.v1.Frame
+	1,  // 13: qubesair.transport.v1.RelayAttach.Attach:output_type -> qubesair.transport.v1.Frame
+	12, // [12:14] is the sub-list for method output_type
+	10, // [10:12] is the sub-list for method input_type
+	10, // [10:10] is the sub-list for extension type_name
+	10, // [10:10] is the sub-list for extension extendee
+	0,  // [0:10] is the sub-list for field type_name
 }
 
 func init() { file_relay_transport_proto_init() }
@@ -723,6 +1022,8 @@ func file_relay_transport_proto_init() {
 		(*Frame_Eos)(nil),
 		(*Frame_Error)(nil),
 		(*Frame_KeepAlive)(nil),
+		(*Frame_WindowUpdate)(nil),
+		(*Frame_Cancel)(nil),
 	}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
@@ -730,9 +1031,9 @@ func file_relay_transport_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_relay_transport_proto_rawDesc), len(file_relay_transport_proto_rawDesc)),
 			NumEnums:      1,
-			NumMessages:   7,
+			NumMessages:   10,
 			NumExtensions: 0,
-			NumServices:   1,
+			NumServices:   2,
 		},
 		GoTypes:           file_relay_transport_proto_goTypes,
 		DependencyIndexes: file_relay_transport_proto_depIdxs,
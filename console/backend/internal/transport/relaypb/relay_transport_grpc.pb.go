@@ -147,3 +147,113 @@ var RelayTransport_ServiceDesc = grpc.ServiceDesc{
 	},
 	Metadata: "relay_transport.proto",
 }
+
+const (
+	RelayAttach_Attach_FullMethodName = "/qubesair.transport.v1.RelayAttach/Attach"
+)
+
+// RelayAttachClient is the client API for RelayAttach service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// RelayAttach：agent 出站模式（dial-out）。NAT 后的 remote 无法被 relay 拨入，
+// 于是由 agent 作为 gRPC 客户端主动连到 relay 监听的端口，remote 侧真正零入站。
+// 流建立后的角色与 Tunnel 完全一致：relay 仍是发起方（先发 Handshake、发
+// RequestHeader），agent 仍是执行方；帧格式不变，只是谁拨号变了。
+// relay 按 agent 的客户端证书身份（agent-<qube>）路由调用，而不是按 agent
+// 在 Handshake 里自报的名字。
+type RelayAttachClient interface {
+	Attach(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[Frame, Frame], error)
+}
+
+type relayAttachClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewRelayAttachClient(cc grpc.ClientConnInterface) RelayAttachClient {
+	return &relayAttachClient{cc}
+}
+
+func (c *relayAttachClient) Attach(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[Frame, Frame], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &RelayAttach_ServiceDesc.Streams[0], RelayAttach_Attach_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[Frame, Frame]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type RelayAttach_AttachClient = grpc.BidiStreamingClient[Frame, Frame]
+
+// RelayAttachServer is the server API for RelayAttach service.
+// All implementations must embed UnimplementedRelayAttachServer
+// for forward compatibility.
+//
+// RelayAttach：agent 出站模式（dial-out）。NAT 后的 remote 无法被 relay 拨入，
+// 于是由 agent 作为 gRPC 客户端主动连到 relay 监听的端口，remote 侧真正零入站。
+// 流建立后的角色与 Tunnel 完全一致：relay 仍是发起方（先发 Handshake、发
+// RequestHeader），agent 仍是执行方；帧格式不变，只是谁拨号变了。
+// relay 按 agent 的客户端证书身份（agent-<qube>）路由调用，而不是按 agent
+// 在 Handshake 里自报的名字。
+type RelayAttachServer interface {
+	Attach(grpc.BidiStreamingServer[Frame, Frame]) error
+	mustEmbedUnimplementedRelayAttachServer()
+}
+
+// UnimplementedRelayAttachServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedRelayAttachServer struct{}
+
+func (UnimplementedRelayAttachServer) Attach(grpc.BidiStreamingServer[Frame, Frame]) error {
+	return status.Error(codes.Unimplemented, "method Attach not implemented")
+}
+func (UnimplementedRelayAttachServer) mustEmbedUnimplementedRelayAttachServer() {}
+func (UnimplementedRelayAttachServer) testEmbeddedByValue()                     {}
+
+// UnsafeRelayAttachServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to RelayAttachServer will
+// result in compilation errors.
+type UnsafeRelayAttachServer interface {
+	mustEmbedUnimplementedRelayAttachServer()
+}
+
+func RegisterRelayAttachServer(s grpc.ServiceRegistrar, srv RelayAttachServer) {
+	// If the following call panics, it indicates UnimplementedRelayAttachServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&RelayAttach_ServiceDesc, srv)
+}
+
+func _RelayAttach_Attach_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(RelayAttachServer).Attach(&grpc.GenericServerStream[Frame, Frame]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type RelayAttach_AttachServer = grpc.BidiStreamingServer[Frame, Frame]
+
+// RelayAttach_ServiceDesc is the grpc.ServiceDesc for RelayAttach service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var RelayAttach_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "qubesair.transport.v1.RelayAttach",
+	HandlerType: (*RelayAttachServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Attach",
+			Handler:       _RelayAttach_Attach_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "relay_transport.proto",
+}
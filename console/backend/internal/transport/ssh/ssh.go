@@ -0,0 +1,373 @@
+// Package ssh is a transport.Transport over SSH, for sites where the only
+// egress a firewall lets out is SSH and the gRPC tunnel cannot be dialed.
+//
+// It is the Go counterpart of relay/transport/qubesair.SSHProxy and uses the
+// same arrangement as the relay/ssh templates: one outbound connection per
+// remote, kept open and reused, the remote's host key pinned from a
+// known_hosts file, a dedicated key that the remote's authorized_keys forces
+// onto a single helper (relay/ssh/qubesair-ssh-call). Each Call is one SSH
+// session on that connection: the helper is run with the target and service
+// as its two arguments, the request is its stdin and the response its stdout,
+// exactly as qrexec-client-vm would take them.
+//
+// DialContext opens a TCP connection from the remote end of the same SSH
+// connection (a direct-tcpip channel). That is how the console reaches agents
+// in a zone whose only way in is this SSH host: the remote's authorized_keys
+// must then allow port forwarding to the agents' port (permitopen), where a
+// calls-only key would carry no-port-forwarding.
+//
+// What it does not do, compared with the gRPC transport: no reverse calls (the
+// relay/ssh design carries those over a RemoteForward to a loopback sshd, not
+// through this connection), no capability negotiation, no multiple endpoints.
+// It is a fallback for hostile networks, not a replacement.
+//
+// Authorization is unchanged: the remote helper hands the call to the remote
+// dom0 like any other, and target and service are validated here before they
+// are put into the remote command line.
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/slchris/qubes-air/console/internal/qrexec"
+	"github.com/slchris/qubes-air/console/internal/transport"
+)
+
+// DefaultCommand is the remote helper a call runs when Config.Command is empty.
+const DefaultCommand = "qubesair-ssh-call"
+
+const (
+	defaultKeepAlive   = 30 * time.Second
+	defaultDialTimeout = 10 * time.Second
+	defaultMaxResponse = 64 << 20
+	// maxStderr bounds how much of the helper's stderr is kept for an error.
+	maxStderr = 4 << 10
+	// refusedExitCode is what qrexec-client-vm, and so the helper, exits with
+	// when the remote dom0 refuses the call.
+	refusedExitCode = 126
+)
+
+// ErrConnection wraps failures of the SSH connection itself, as opposed to a
+// call that reached the remote helper and failed there.
+var ErrConnection = errors.New("ssh transport: connection failed")
+
+// Config configures a Transport.
+type Config struct {
+	// Address is the remote's host:port; a bare host gets port 22.
+	Address string
+	// User is the remote account the helper runs as.
+	User string
+	// Signer is the client key. See LoadKey.
+	Signer gossh.Signer
+	// HostKeyCallback checks the remote's host key. Required: there is no
+	// trust-on-first-use. See KnownHosts.
+	HostKeyCallback gossh.HostKeyCallback
+	// Command is the remote helper and any leading arguments; the target and
+	// service are appended. Default DefaultCommand.
+	Command []string
+	// KeepAlive is how often an idle connection is checked (default 30s). A
+	// connection that does not answer is closed, and the next call redials.
+	KeepAlive time.Duration
+	// DialTimeout bounds connecting and the SSH handshake (default 10s).
+	DialTimeout time.Duration
+	// MaxResponse bounds a response body in bytes (default 64 MiB).
+	MaxResponse int
+}
+
+// Transport forwards qrexec calls over one reused SSH connection.
+type Transport struct {
+	cfg Config
+
+	mu     sync.Mutex
+	client *gossh.Client
+	closed bool
+}
+
+var _ transport.Transport = (*Transport)(nil)
+
+// New builds a Transport. It does not connect; the first call does.
+func New(cfg Config) (*Transport, error) {
+	if cfg.Address == "" || cfg.User == "" {
+		return nil, errors.New("ssh transport: address and user are required")
+	}
+	if cfg.Signer == nil {
+		return nil, errors.New("ssh transport: a client key is required")
+	}
+	if cfg.HostKeyCallback == nil {
+		return nil, errors.New("ssh transport: a host key check is required (known_hosts)")
+	}
+	if _, _, err := net.SplitHostPort(cfg.Address); err != nil {
+		cfg.Address = net.JoinHostPort(cfg.Address, "22")
+	}
+	if len(cfg.Command) == 0 {
+		cfg.Command = []string{DefaultCommand}
+	}
+	if cfg.KeepAlive <= 0 {
+		cfg.KeepAlive = defaultKeepAlive
+	}
+	if cfg.DialTimeout <= 0 {
+		cfg.DialTimeout = defaultDialTimeout
+	}
+	if cfg.MaxResponse <= 0 {
+		cfg.MaxResponse = defaultMaxResponse
+	}
+	return &Transport{cfg: cfg}, nil
+}
+
+// LoadKey reads an unencrypted private key file.
+func LoadKey(path string) (gossh.Signer, error) {
+	pem, err := os.ReadFile(path) // #nosec G304 -- operator-configured path
+	if err != nil {
+		return nil, err
+	}
+	return gossh.ParsePrivateKey(pem)
+}
+
+// KnownHosts builds a host key check that accepts only keys listed in path,
+// the same pinning as relay/ssh's UserKnownHostsFile.
+func KnownHosts(path string) (gossh.HostKeyCallback, error) {
+	return knownhosts.New(path)
+}
+
+// Call runs the remote helper for target and service with in as its stdin and
+// returns its stdout.
+func (t *Transport) Call(ctx context.Context, target, service string, in []byte) ([]byte, error) {
+	if !transport.ValidName(target) || !transport.ValidName(service) {
+		return nil, transport.ErrInvalidName
+	}
+	cli, err := t.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sess, err := cli.NewSession()
+	if err != nil {
+		// A connection that cannot open a session is dead even if nobody has
+		// noticed. Nothing ran, so one retry on a fresh connection is safe.
+		t.drop(cli)
+		if cli, err = t.connect(ctx); err != nil {
+			return nil, err
+		}
+		if sess, err = cli.NewSession(); err != nil {
+			t.drop(cli)
+			return nil, fmt.Errorf("%w: open session: %v", ErrConnection, err)
+		}
+	}
+	defer sess.Close()
+
+	stdout := &capped{max: t.cfg.MaxResponse}
+	stderr := &capped{max: maxStderr, truncate: true}
+	sess.Stdin = bytes.NewReader(in)
+	sess.Stdout = stdout
+	sess.Stderr = stderr
+	if err := sess.Start(t.command(target, service)); err != nil {
+		return nil, fmt.Errorf("%w: start %s: %v", ErrConnection, service, err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- sess.Wait() }()
+	select {
+	case <-ctx.Done():
+		// Best effort: not every sshd forwards signals, but closing the
+		// session closes the helper's stdin and stdout either way.
+		_ = sess.Signal(gossh.SIGKILL)
+		_ = sess.Close()
+		return nil, fmt.Errorf("ssh transport: %s on %s: %w", service, target, ctx.Err())
+	case err = <-done:
+	}
+	if stdout.overflow {
+		return nil, fmt.Errorf("ssh transport: %s on %s: response exceeds %d bytes", service, target, t.cfg.MaxResponse)
+	}
+	if err != nil {
+		return nil, t.callError(cli, target, service, err, stderr.String())
+	}
+	return stdout.Bytes(), nil
+}
+
+// DialContext connects to addr from the remote host, over the shared
+// connection. The caller's TLS runs end to end through the channel; the remote
+// sees only ciphertext.
+func (t *Transport) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	cli, err := t.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := cli.DialContext(ctx, network, addr)
+	var refused *gossh.OpenChannelError
+	if err == nil || errors.As(err, &refused) || ctx.Err() != nil {
+		// A refused channel is the remote's answer — forwarding not permitted,
+		// or nothing listening — and redialing would only ask again.
+		return conn, err
+	}
+	// Anything else means the connection itself is gone; as with a session,
+	// nothing was sent, so one retry on a fresh connection is safe.
+	t.drop(cli)
+	if cli, err = t.connect(ctx); err != nil {
+		return nil, err
+	}
+	if conn, err = cli.DialContext(ctx, network, addr); err != nil {
+		if !errors.As(err, &refused) {
+			t.drop(cli)
+			return nil, fmt.Errorf("%w: forward to %s: %v", ErrConnection, addr, err)
+		}
+		return nil, err
+	}
+	return conn, nil
+}
+
+// callError describes a failed session. An exit status is the helper's
+// answer; anything else means the connection went away under the call.
+func (t *Transport) callError(cli *gossh.Client, target, service string, err error, stderr string) error {
+	var exit *gossh.ExitError
+	if errors.As(err, &exit) {
+		if exit.ExitStatus() == refusedExitCode || strings.Contains(stderr, "Request refused") {
+			return fmt.Errorf("%w: %s on %s (stderr: %s)", qrexec.ErrRefused, service, target, strings.TrimSpace(stderr))
+		}
+		return fmt.Errorf("ssh transport: %s on %s exited %d: %s", service, target, exit.ExitStatus(), strings.TrimSpace(stderr))
+	}
+	t.drop(cli)
+	return fmt.Errorf("%w: %s on %s: %v", ErrConnection, service, target, err)
+}
+
+// command is the remote command line. Target and service have passed
+// ValidName, which admits no shell metacharacters; the configured helper is
+// quoted all the same, since the remote runs the line through a shell.
+func (t *Transport) command(target, service string) string {
+	parts := make([]string, 0, len(t.cfg.Command)+2)
+	for _, c := range t.cfg.Command {
+		parts = append(parts, shellQuote(c))
+	}
+	return strings.Join(append(parts, target, service), " ")
+}
+
+// connect returns the live connection, dialing one if there is none.
+func (t *Transport) connect(ctx context.Context) (*gossh.Client, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return nil, fmt.Errorf("%w: transport closed", ErrConnection)
+	}
+	if t.client != nil {
+		return t.client, nil
+	}
+
+	dctx, cancel := context.WithTimeout(ctx, t.cfg.DialTimeout)
+	defer cancel()
+	conn, err := (&net.Dialer{}).DialContext(dctx, "tcp", t.cfg.Address)
+	if err != nil {
+		return nil, fmt.Errorf("%w: dial %s: %v", ErrConnection, t.cfg.Address, err)
+	}
+	deadline, _ := dctx.Deadline()
+	_ = conn.SetDeadline(deadline)
+	c, chans, reqs, err := gossh.NewClientConn(conn, t.cfg.Address, &gossh.ClientConfig{
+		User:            t.cfg.User,
+		Auth:            []gossh.AuthMethod{gossh.PublicKeys(t.cfg.Signer)},
+		HostKeyCallback: t.cfg.HostKeyCallback,
+	})
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("%w: handshake with %s: %v", ErrConnection, t.cfg.Address, err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	t.client = gossh.NewClient(c, chans, reqs)
+	log.Printf("ssh transport: connected to %s@%s", t.cfg.User, t.cfg.Address)
+	go t.keepAlive(t.client)
+	return t.client, nil
+}
+
+// keepAlive checks cli every KeepAlive until it fails or is replaced, so a
+// connection a NAT silently dropped is noticed before a call waits on it.
+func (t *Transport) keepAlive(cli *gossh.Client) {
+	ticker := time.NewTicker(t.cfg.KeepAlive)
+	defer ticker.Stop()
+	for range ticker.C {
+		answered := make(chan error, 1)
+		go func() {
+			_, _, err := cli.SendRequest("keepalive@openssh.com", true, nil)
+			answered <- err
+		}()
+		var err error
+		select {
+		case err = <-answered:
+		case <-time.After(t.cfg.KeepAlive):
+			err = errors.New("no answer")
+		}
+		if err != nil {
+			log.Printf("ssh transport: keepalive to %s failed (%v); will redial", t.cfg.Address, err)
+			t.drop(cli)
+			return
+		}
+		t.mu.Lock()
+		current := t.client == cli
+		t.mu.Unlock()
+		if !current {
+			return
+		}
+	}
+}
+
+// drop closes cli and forgets it, if it is still the live connection.
+func (t *Transport) drop(cli *gossh.Client) {
+	t.mu.Lock()
+	if t.client == cli {
+		t.client = nil
+	}
+	t.mu.Unlock()
+	_ = cli.Close()
+}
+
+// Close closes the connection; later calls fail.
+func (t *Transport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	if t.client == nil {
+		return nil
+	}
+	err := t.client.Close()
+	t.client = nil
+	return err
+}
+
+// capped is a buffer that stops at max bytes. Past it, it either notes the
+// overflow and fails the write (a response) or silently drops the rest (the
+// stderr kept for an error message).
+type capped struct {
+	bytes.Buffer
+	max      int
+	truncate bool
+	overflow bool
+}
+
+func (c *capped) Write(p []byte) (int, error) {
+	room := c.max - c.Len()
+	if len(p) <= room {
+		return c.Buffer.Write(p)
+	}
+	if c.truncate {
+		c.Buffer.Write(p[:max(room, 0)])
+		return len(p), nil
+	}
+	c.overflow = true
+	return 0, io.ErrShortWrite
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./=:") == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,353 @@
+package ssh
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/slchris/qubes-air/console/internal/qrexec"
+	"github.com/slchris/qubes-air/console/internal/transport"
+)
+
+// testServer is an in-process sshd whose only command is a fake helper:
+//
+//	qubesair-ssh-call <target> qubesair.Echo     prints "<target>:<stdin>"
+//	qubesair-ssh-call <target> qubesair.Refused  exits 126, as a dom0 refusal
+//	qubesair-ssh-call <target> qubesair.Fail     exits 1
+//	qubesair-ssh-call <target> qubesair.Hang     never answers
+//
+// It also forwards direct-tcpip channels, to loopback addresses only.
+type testServer struct {
+	addr    string
+	hostKey gossh.Signer
+
+	mu       sync.Mutex
+	conns    []net.Conn
+	accepted int
+	commands []string
+}
+
+func newTestSigner(t *testing.T) gossh.Signer {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := gossh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func startTestServer(t *testing.T, clientKey gossh.PublicKey) *testServer {
+	t.Helper()
+	srv := &testServer{hostKey: newTestSigner(t)}
+	cfg := &gossh.ServerConfig{
+		PublicKeyCallback: func(_ gossh.ConnMetadata, key gossh.PublicKey) (*gossh.Permissions, error) {
+			if string(key.Marshal()) != string(clientKey.Marshal()) {
+				return nil, errors.New("unknown key")
+			}
+			return nil, nil
+		},
+	}
+	cfg.AddHostKey(srv.hostKey)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = lis.Close(); srv.dropAll() })
+	srv.addr = lis.Addr().String()
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			srv.mu.Lock()
+			srv.conns = append(srv.conns, conn)
+			srv.accepted++
+			srv.mu.Unlock()
+			go srv.serve(conn, cfg)
+		}
+	}()
+	return srv
+}
+
+func (s *testServer) serve(conn net.Conn, cfg *gossh.ServerConfig) {
+	_, chans, reqs, err := gossh.NewServerConn(conn, cfg)
+	if err != nil {
+		return
+	}
+	go gossh.DiscardRequests(reqs)
+	for nc := range chans {
+		if nc.ChannelType() == "direct-tcpip" {
+			go s.forward(nc)
+			continue
+		}
+		if nc.ChannelType() != "session" {
+			_ = nc.Reject(gossh.UnknownChannelType, "no")
+			continue
+		}
+		ch, chReqs, err := nc.Accept()
+		if err != nil {
+			return
+		}
+		go s.session(ch, chReqs)
+	}
+}
+
+func (s *testServer) session(ch gossh.Channel, reqs <-chan *gossh.Request) {
+	defer ch.Close()
+	for req := range reqs {
+		if req.Type != "exec" {
+			_ = req.Reply(false, nil)
+			continue
+		}
+		var exec struct{ Command string }
+		if err := gossh.Unmarshal(req.Payload, &exec); err != nil {
+			_ = req.Reply(false, nil)
+			return
+		}
+		_ = req.Reply(true, nil)
+		s.mu.Lock()
+		s.commands = append(s.commands, exec.Command)
+		s.mu.Unlock()
+
+		status := s.helper(ch, strings.Fields(exec.Command))
+		_, _ = ch.SendRequest("exit-status", false, gossh.Marshal(struct{ Status uint32 }{status}))
+		return
+	}
+}
+
+func (s *testServer) helper(ch gossh.Channel, argv []string) uint32 {
+	if len(argv) != 3 || argv[0] != DefaultCommand {
+		fmt.Fprintf(ch.Stderr(), "bad command %q", argv)
+		return 2
+	}
+	in, _ := io.ReadAll(ch)
+	switch argv[2] {
+	case "qubesair.Echo":
+		fmt.Fprintf(ch, "%s:%s", argv[1], in)
+		return 0
+	case "qubesair.Refused":
+		fmt.Fprint(ch.Stderr(), "Request refused")
+		return refusedExitCode
+	case "qubesair.Hang":
+		select {}
+	}
+	fmt.Fprint(ch.Stderr(), "boom")
+	return 1
+}
+
+// forward splices a direct-tcpip channel onto a loopback connection, refusing
+// anything else the way a permitopen line would.
+func (s *testServer) forward(nc gossh.NewChannel) {
+	var req struct {
+		Host     string
+		Port     uint32
+		OrigHost string
+		OrigPort uint32
+	}
+	if err := gossh.Unmarshal(nc.ExtraData(), &req); err != nil || req.Host != "127.0.0.1" {
+		_ = nc.Reject(gossh.Prohibited, "not permitted")
+		return
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort(req.Host, fmt.Sprint(req.Port)))
+	if err != nil {
+		_ = nc.Reject(gossh.ConnectionFailed, err.Error())
+		return
+	}
+	ch, reqs, err := nc.Accept()
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	go gossh.DiscardRequests(reqs)
+	go func() { _, _ = io.Copy(conn, ch); _ = conn.Close() }()
+	_, _ = io.Copy(ch, conn)
+	_ = ch.Close()
+}
+
+// dropAll cuts every connection, as a NAT timing out would.
+func (s *testServer) dropAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		_ = c.Close()
+	}
+	s.conns = nil
+}
+
+// newTestTransport returns a transport to srv that pins hostKey.
+func newTestTransport(t *testing.T, srv *testServer, key gossh.Signer, hostKey gossh.PublicKey) *Transport {
+	t.Helper()
+	known := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(srv.addr)}, hostKey)
+	if err := os.WriteFile(known, []byte(line+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	hk, err := KnownHosts(known)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, err := New(Config{Address: srv.addr, User: "relay", Signer: key, HostKeyCallback: hk})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = tr.Close() })
+	return tr
+}
+
+func TestCallRunsHelper(t *testing.T) {
+	key := newTestSigner(t)
+	srv := startTestServer(t, key.PublicKey())
+	tr := newTestTransport(t, srv, key, srv.hostKey.PublicKey())
+	ctx := context.Background()
+
+	out, err := tr.Call(ctx, "remote-dev", "qubesair.Echo", []byte("hello"))
+	if err != nil || string(out) != "remote-dev:hello" {
+		t.Fatalf("Call = %q, %v", out, err)
+	}
+	if _, err := tr.Call(ctx, "remote-dev", "qubesair.Refused", nil); !errors.Is(err, qrexec.ErrRefused) {
+		t.Errorf("a refusal = %v, want qrexec.ErrRefused", err)
+	}
+	if _, err := tr.Call(ctx, "remote-dev", "qubesair.Fail", nil); err == nil ||
+		errors.Is(err, ErrConnection) || !strings.Contains(err.Error(), "boom") {
+		t.Errorf("a failed call = %v, want the helper's exit and stderr", err)
+	}
+	if _, err := tr.Call(ctx, "remote-dev; rm -rf /", "qubesair.Echo", nil); !errors.Is(err, transport.ErrInvalidName) {
+		t.Errorf("an unsafe target = %v, want ErrInvalidName", err)
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.accepted != 1 {
+		t.Errorf("%d connections for %d calls; the connection must be reused", srv.accepted, len(srv.commands))
+	}
+	if len(srv.commands) != 3 || srv.commands[0] != "qubesair-ssh-call remote-dev qubesair.Echo" {
+		t.Errorf("remote commands = %q", srv.commands)
+	}
+}
+
+// TestHostKeyIsPinned — a remote presenting any key but the pinned one is
+// refused before a single call is made.
+func TestHostKeyIsPinned(t *testing.T) {
+	key := newTestSigner(t)
+	srv := startTestServer(t, key.PublicKey())
+	tr := newTestTransport(t, srv, key, newTestSigner(t).PublicKey())
+
+	if _, err := tr.Call(context.Background(), "remote-dev", "qubesair.Echo", nil); !errors.Is(err, ErrConnection) {
+		t.Fatalf("Call with an unpinned host key = %v, want ErrConnection", err)
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if len(srv.commands) != 0 {
+		t.Errorf("a command ran on an unverified host: %q", srv.commands)
+	}
+}
+
+// TestRedialsAfterDrop — a connection that died while idle is replaced by the
+// next call, which still succeeds.
+func TestRedialsAfterDrop(t *testing.T) {
+	key := newTestSigner(t)
+	srv := startTestServer(t, key.PublicKey())
+	tr := newTestTransport(t, srv, key, srv.hostKey.PublicKey())
+	ctx := context.Background()
+
+	if _, err := tr.Call(ctx, "remote-dev", "qubesair.Echo", nil); err != nil {
+		t.Fatal(err)
+	}
+	srv.dropAll()
+	time.Sleep(50 * time.Millisecond)
+	out, err := tr.Call(ctx, "remote-dev", "qubesair.Echo", []byte("again"))
+	if err != nil || string(out) != "remote-dev:again" {
+		t.Fatalf("Call after the connection dropped = %q, %v", out, err)
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.accepted != 2 {
+		t.Errorf("accepted %d connections, want a redial", srv.accepted)
+	}
+}
+
+func TestCallHonoursContext(t *testing.T) {
+	key := newTestSigner(t)
+	srv := startTestServer(t, key.PublicKey())
+	tr := newTestTransport(t, srv, key, srv.hostKey.PublicKey())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	if _, err := tr.Call(ctx, "remote-dev", "qubesair.Hang", nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("a hung call = %v, want the deadline", err)
+	}
+	if time.Since(started) > 2*time.Second {
+		t.Error("the call outlived its context")
+	}
+}
+
+// TestDialForwardsThroughRemote — a connection dialed through the transport
+// comes out of the remote host and shares the call connection; a destination
+// the remote will not forward to is refused without a redial.
+func TestDialForwardsThroughRemote(t *testing.T) {
+	key := newTestSigner(t)
+	srv := startTestServer(t, key.PublicKey())
+	tr := newTestTransport(t, srv, key, srv.hostKey.PublicKey())
+	ctx := context.Background()
+
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() { _, _ = io.Copy(c, c); _ = c.Close() }()
+		}
+	}()
+
+	conn, err := tr.DialContext(ctx, "tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo through the remote = %q, %v", buf, err)
+	}
+	if _, err := tr.Call(ctx, "remote-dev", "qubesair.Echo", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var refused *gossh.OpenChannelError
+	if _, err := tr.DialContext(ctx, "tcp", "10.9.9.9:8443"); !errors.As(err, &refused) {
+		t.Errorf("a forward the remote refuses = %v, want its refusal", err)
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.accepted != 1 {
+		t.Errorf("%d connections; dials and calls must share one", srv.accepted)
+	}
+}
@@ -322,6 +322,67 @@ export async function stopQube(id: string): Promise<Operation> {
   return post<Operation>(`/qubes/${id}/stop`);
 }
 
+/** Answer of a data disk lock. */
+export interface DataLockResult {
+  locked: boolean;
+  detail: string;
+}
+
+/**
+ * Closes a running qube's encrypted data disk: its agent syncs and unmounts
+ * /data and closes the LUKS mapping. A busy mount is refused with 409; the
+ * disk opens again on the next resume.
+ */
+export async function lockQubeData(id: string): Promise<DataLockResult> {
+  return post<DataLockResult>(`/qubes/${id}/lock-data`);
+}
+
+/** Answer of a data disk unlock. */
+export interface DataUnlockResult {
+  unlocked: boolean;
+  detail: string;
+}
+
+/**
+ * Pushes a running qube's data key to its agent again, reopening /data. The
+ * only way to reopen a disk the agent's dead man's switch closed; a wrong key
+ * or an agent below the minimum version is refused with 409.
+ */
+export async function unlockQubeData(id: string): Promise<DataUnlockResult> {
+  return post<DataUnlockResult>(`/qubes/${id}/unlock-data`);
+}
+
+/** WebSocket subprotocol of the qube terminal endpoint. */
+export const SHELL_PROTOCOL = 'qubes-air.shell';
+
+/**
+ * Opens an interactive terminal on a qube. Keystrokes go out as binary
+ * messages (send a string encoded with TextEncoder, or the bytes an xterm-style
+ * widget hands over); the terminal's output arrives as binary messages; the
+ * socket closes when the shell exits.
+ *
+ * A browser cannot set an Authorization header on a WebSocket, so the token is
+ * offered as a second subprotocol, "bearer.<token>", which the server checks
+ * and never selects.
+ */
+export function openQubeShell(id: string): WebSocket {
+  const url = new URL(`${API_BASE}/qubes/${id}/shell`, window.location.href);
+  url.protocol = url.protocol === 'https:' ? 'wss:' : 'ws:';
+  const protocols = [SHELL_PROTOCOL];
+  const token = readApiToken();
+  if (token) {
+    protocols.push(`bearer.${token}`);
+  }
+  const ws = new WebSocket(url, protocols);
+  ws.binaryType = 'arraybuffer';
+  return ws;
+}
+
+/** Tells a qube terminal its size; send it on open and on every resize. */
+export function sendShellResize(ws: WebSocket, rows: number, cols: number): void {
+  ws.send(JSON.stringify({ type: 'resize', rows, cols }));
+}
+
 // ============================================================================
 // System API
 // ============================================================================
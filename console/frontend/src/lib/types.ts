@@ -154,8 +154,67 @@ export interface Qube {
   agent_health?: AgentHealth;
   agent_last_probed_at?: string;
   agent_last_healthy_at?: string;
-  // The reason the last probe failed. Empty when healthy.
+  // The reason the last probe failed, or what is wrong on a degraded qube.
+  // Empty when healthy.
   agent_last_error?: string;
+  // What the agent declared in its last handshake; absent until it has answered.
+  agent?: AgentInfo;
+  // The agent's last qubesair.Status report; absent until one has arrived.
+  agent_status?: AgentStatus;
+}
+
+// The agent's status report, matching backend models.AgentStatus.
+export interface AgentStatus {
+  reported_at: string;
+  agent_uptime_seconds: number;
+  system_uptime_seconds?: number;
+  clock_offset_ms: number;
+  clock_synchronized?: boolean;
+  reboot_required: boolean;
+  cloud_init: string;
+  cloud_init_errors?: string[];
+  units: { name: string; load_state: string; active_state: string; sub_state: string }[];
+  data?: {
+    attached: boolean;
+    open: boolean;
+    mounted: boolean;
+    mount: string;
+    free_bytes?: number;
+    total_bytes?: number;
+  };
+  disks: { path: string; free_bytes: number; total_bytes: number }[];
+  dead_man?: AgentDeadMan;
+  problems?: string[];
+  errors?: string[];
+}
+
+// The agent's dead man's switch, matching backend models.AgentDeadMan.
+// last_check_in is the console's last call as the agent counts it.
+export interface AgentDeadMan {
+  enabled: boolean;
+  silence_seconds?: number;
+  on_revocation?: boolean;
+  last_check_in: string;
+  tripped?: boolean;
+  tripped_at?: string;
+  reason?: string;
+  lock_error?: string;
+}
+
+// Agent self-description, matching backend models.AgentInfo.
+export interface AgentInfo {
+  protocol_version: string;
+  build_version?: string;
+  capabilities: {
+    frame_kinds?: string[];
+    flow_control: boolean;
+    compression?: string[];
+    cancel: boolean;
+    structured_results: boolean;
+    max_frame_size?: number;
+    services?: string[];
+  };
+  reported_at: string;
 }
 
 // Agent health as reported by the console's background prober.
@@ -166,9 +225,11 @@ export interface Qube {
 // warning anywhere, which is precisely the "looks fine" failure the field
 // exists to prevent.
 //   healthy      — last probe succeeded
+//   degraded     — the agent answered, but its status report names a problem
+//                  (/data locked, a unit down; see agent_last_error)
 //   unreachable  — last probe failed (see agent_last_error)
 //   unknown      — not probed yet, or probing disabled
-export type AgentHealth = 'healthy' | 'unreachable' | 'unknown';
+export type AgentHealth = 'healthy' | 'degraded' | 'unreachable' | 'unknown';
 
 // Request payload for creating a qube
 export interface QubeCreateRequest {
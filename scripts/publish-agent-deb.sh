@@ -229,6 +229,45 @@ if ! curl -fsS -X POST "$ARTIFACT_BASE/api/artifacts" \
 fi
 echo >&2
 
+# 签名 (sign-agent-package -key 生成的 <deb>.sig) 有就一并上传: qubesair.Update
+# 在包 URL 后加 .sig 下载它, 远端只装用 update.pub 里的公钥签过名的包。没有签名
+# 的包照样能给新 qube 首次安装 (那条路靠哈希), 只是不能用来更新已有的 qube。
+SIG="$DEB.sig"
+if [ -f "$SIG" ]; then
+    info "上传签名 $(basename "$SIG") ..."
+    curl -fsS -X POST "$ARTIFACT_BASE/api/artifacts" \
+        -F "file=@$SIG" \
+        -b "$COOKIE_JAR" \
+        -F "directory=$ARTIFACT_DIR" \
+        -F "overwrite=$OVERWRITE" >&2 || die "签名上传失败。"
+    echo >&2
+else
+    warn "没有 $(basename "$SIG") —— 这个包不能用于 qubesair.Update (见 cmd/sign-agent-package)"
+fi
+
+# 发布清单 (sign-agent-package -key <私钥> -manifest <清单> <deb>... 生成) 有就随后
+# 上传, 必须在包之后: 清单先到, 就有一段时间新 qube 照着它去下一个还不存在的包。
+# 默认找 deb 旁边的 qubes-air-agent_<version>.manifest —— 按版本命名, 和包一样
+# 「发新版就换名字」, 已经钉了旧清单 URL 的 console 不会被悄悄换掉包。
+MANIFEST="${MANIFEST:-$(dirname "$DEB")/qubes-air-agent_${DEB_VERSION}.manifest}"
+if [ -f "$MANIFEST" ]; then
+    [ -f "$MANIFEST.sig" ] || die "有 $(basename "$MANIFEST") 却没有它的 .sig —— 用 sign-agent-package -manifest 重新生成"
+    # 清单必须点名刚上传的这个包和它的哈希; 否则 console 按清单配置出来的 qube
+    # 装的是别的东西。
+    grep -qxF "sha256 amd64 $LOCAL_SHA $DEB_NAME" "$MANIFEST" \
+        || die "$(basename "$MANIFEST") 没有列出 $DEB_NAME (sha256 $LOCAL_SHA)"
+    MANIFEST_URL="$ARTIFACT_BASE/local/$ARTIFACT_DIR/$(basename "$MANIFEST")"
+    for f in "$MANIFEST" "$MANIFEST.sig"; do
+        info "上传 $(basename "$f") ..."
+        curl -fsS -X POST "$ARTIFACT_BASE/api/artifacts" \
+            -F "file=@$f" \
+            -b "$COOKIE_JAR" \
+            -F "directory=$ARTIFACT_DIR" \
+            -F "overwrite=$OVERWRITE" >&2 || die "清单上传失败: $(basename "$f")"
+        echo >&2
+    done
+fi
+
 # ============================================
 # 5. 回读验证 —— 「它现在对外发什么」
 #
@@ -264,6 +303,22 @@ fi
 
 info "服务端字节与本地一致 ✓ (${SERVED_SIZE} bytes)"
 
+if [ -f "$SIG" ]; then
+    curl -fsS -H 'Cache-Control: no-cache' -H 'Pragma: no-cache' \
+         -o "$VERIFY_TMP" "$DEB_URL.sig" || die "签名下载不回来: $DEB_URL.sig"
+    cmp -s "$VERIFY_TMP" "$SIG" || die "服务端的签名与本地不一致: $DEB_URL.sig"
+    info "服务端签名与本地一致 ✓"
+fi
+
+if [ -n "${MANIFEST_URL:-}" ]; then
+    for f in "$MANIFEST" "$MANIFEST.sig"; do
+        curl -fsS -H 'Cache-Control: no-cache' -H 'Pragma: no-cache' \
+             -o "$VERIFY_TMP" "$MANIFEST_URL${f#"$MANIFEST"}" || die "清单下载不回来: $MANIFEST_URL${f#"$MANIFEST"}"
+        cmp -s "$VERIFY_TMP" "$f" || die "服务端的 $(basename "$f") 与本地不一致"
+    done
+    info "服务端清单与签名与本地一致 ✓"
+fi
+
 # ============================================
 # 6. 输出 console 配置
 # ============================================
@@ -271,7 +326,7 @@ info "服务端字节与本地一致 ✓ (${SERVED_SIZE} bytes)"
 warn "提醒: 上传要认证, 但**分发是明文 HTTP、无认证**。下面这个 SHA256 是这条链路上"
 warn "      唯一的完整性控制 —— 它必须原样进 console 配置, 不能事后凭记忆重打。"
 echo >&2
-info "${BOLD}把下面两行填进 console 配置:${NC}"
+info "${BOLD}把下面几行填进 console 配置:${NC}"
 echo >&2
 
 # 变量名必须与 console 的 config 一致 (internal/config/config.go 的
@@ -281,6 +336,12 @@ echo >&2
 #
 # VERSION 是**说明性**的 (console 以哈希为准), 但它是事后从 console 配置反查
 # 「这批 qube 跑的是哪次构建」的唯一线索 —— 镜像 ID 已经不再承载这个信息了。
+# 有清单时只打印清单 URL: console 把它和 agent_package_url/sha256 视为二选一,
+# 两样都配会拒绝启动。包的哈希和版本由签过名的清单给出。
+if [ -n "${MANIFEST_URL:-}" ]; then
+    echo "QUBES_AIR_AGENT_MANIFEST_URL=$MANIFEST_URL"
+    exit 0
+fi
 echo "QUBES_AIR_AGENT_PACKAGE_URL=$DEB_URL"
 echo "QUBES_AIR_AGENT_PACKAGE_SHA256=$LOCAL_SHA"
 echo "QUBES_AIR_AGENT_PACKAGE_VERSION=$DEB_VERSION"